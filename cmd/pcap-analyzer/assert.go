@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pcap-analyzer/internal/report"
+)
+
+// assertList is a repeatable flag.Value collecting -assert expressions.
+type assertList []report.Assertion
+
+func (l *assertList) String() string {
+	var s []string
+	for _, a := range *l {
+		s = append(s, a.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l *assertList) Set(value string) error {
+	a, err := report.ParseAssertion(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, a)
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// batchExtensions are the files batch treats as captures.
+var batchExtensions = map[string]bool{".pcap": true, ".pcapng": true, ".cap": true}
+
+// manifest records what batch has done with each capture of a directory
+// tree, so a re-run only processes what is new, changed or failed.
+type manifest struct {
+	Dir     string                    `json:"dir"`
+	Updated time.Time                 `json:"updated"`
+	Files   map[string]*manifestEntry `json:"files"`
+}
+
+// manifestEntry is one capture, keyed by its path relative to the tree.
+// Output and Profile are relative to the output directory.
+type manifestEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Seconds  float64   `json:"seconds"`
+	Requests int64     `json:"requests"`
+	Output   string    `json:"output,omitempty"`
+	Profile  string    `json:"profile,omitempty"`
+}
+
+// current reports whether e is a completed run of a capture as it is now.
+func (e *manifestEntry) current(info fs.FileInfo) bool {
+	return e.Status == "done" && e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+func loadManifest(path, dir string) (*manifest, error) {
+	m := &manifest{Dir: dir, Files: make(map[string]*manifestEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]*manifestEntry)
+	}
+	return m, nil
+}
+
+// save writes the manifest through a temporary file, so an interrupted
+// run never leaves it half written.
+func (m *manifest) save(path string) error {
+	m.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runBatch implements "pcap-analyzer batch".
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	maxStreamMemory := byteSize(16 << 20)
+	outDir := fs.String("out", "", "Directory to write each capture's output, the manifest and the combined report to")
+	manifestPath := fs.String("manifest", "", "Manifest file (default manifest.json in -out)")
+	parallel := fs.Int("parallel", 0, "Number of captures analyzed concurrently (0 = one per CPU)")
+	force := fs.Bool("force", false, "Process every capture again, even those the manifest records as done")
+	parseDNS := fs.Bool("dns", false, "Enable DNS analysis")
+	top := fs.Int("top", defaultTop, "Hosts and endpoints listed in the combined report")
+	fs.Var(&maxStreamMemory, "max-stream-memory", "Reassembled payload kept in memory per stream before spilling to disk")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer batch -out dir [flags] capture-dir\n")
+		fmt.Fprintf(fs.Output(), "Analyzes every .pcap, .pcapng and .cap file under capture-dir, skipping those already done, and prints a combined report.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *outDir == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*outDir, "manifest.json")
+	}
+	if *parallel <= 0 {
+		*parallel = runtime.NumCPU()
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	captures, err := findCaptures(dir, *outDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := loadManifest(*manifestPath, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Captures no longer in the tree drop out of the manifest and the
+	// combined report
+	for rel := range m.Files {
+		if _, ok := captures[rel]; !ok {
+			delete(m.Files, rel)
+		}
+	}
+	var todo []string
+	for rel, info := range captures {
+		if e := m.Files[rel]; *force || e == nil || !e.current(info) {
+			todo = append(todo, rel)
+		}
+	}
+	sort.Strings(todo)
+	log.Printf("Found %d captures in %s, %d to process", len(captures), dir, len(todo))
+
+	opts := analyzer.Options{
+		DNS:             *parseDNS,
+		MaxStreamMemory: int(maxStreamMemory),
+	}
+	var mu sync.Mutex
+	var done, failed int
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				e := processCapture(dir, *outDir, rel, captures[rel], opts)
+				mu.Lock()
+				m.Files[rel] = e
+				if err := m.save(*manifestPath); err != nil {
+					log.Fatal(err)
+				}
+				if e.Status == "done" {
+					done++
+					log.Printf("[%d/%d] %s: %d requests in %.1fs", done+failed, len(todo), rel, e.Requests, e.Seconds)
+				} else {
+					failed++
+					log.Printf("[%d/%d] %s: %s", done+failed, len(todo), rel, e.Error)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range todo {
+		jobs <- rel
+	}
+	close(jobs)
+	wg.Wait()
+	if err := m.save(*manifestPath); err != nil {
+		log.Fatal(err)
+	}
+
+	var profiles []*report.Profile
+	for _, rel := range sortedKeys(m.Files) {
+		e := m.Files[rel]
+		if e.Status != "done" {
+			continue
+		}
+		p, err := report.LoadProfile(filepath.Join(*outDir, e.Profile))
+		if err != nil {
+			log.Printf("Leaving %s out of the combined report: %v", rel, err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	combined := filepath.Join(*outDir, "combined.txt")
+	f, err := os.Create(combined)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.WriteCombined(f, profiles, *top)
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	report.WriteCombined(os.Stdout, profiles, *top)
+	log.Printf("Processed %d captures (%d failed, %d already done); combined report in %s",
+		done+failed, failed, len(captures)-len(todo), combined)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// findCaptures returns the captures under dir by path relative to it,
+// leaving out the output directory should it be inside.
+func findCaptures(dir, outDir string) (map[string]fs.FileInfo, error) {
+	skip, _ := filepath.Abs(outDir)
+	captures := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(path); abs == skip {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !batchExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		captures[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return captures, err
+}
+
+// processCapture analyzes one capture, writing its text output and summary
+// to rel.txt and its profile to rel.profile.json under outDir. Output is
+// written under temporary names and only renamed once the run succeeds.
+func processCapture(dir, outDir, rel string, info fs.FileInfo, opts analyzer.Options) *manifestEntry {
+	e := &manifestEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Started: time.Now().UTC(),
+		Status:  "failed",
+	}
+	e.Output, e.Profile = rel+".txt", rel+".profile.json"
+	out, profile := filepath.Join(outDir, e.Output), filepath.Join(outDir, e.Profile)
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(out + ".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(out + ".tmp")
+		w := bufio.NewWriter(f)
+		profiler := report.NewProfiler(rel)
+		h := output.Multi{output.NewText(w), report.NewSummary(w), profiler}
+		runErr := analyzer.Run(filepath.Join(dir, filepath.FromSlash(rel)), opts, h)
+		if err := w.Flush(); err != nil && runErr == nil {
+			runErr = err
+		}
+		if err := f.Close(); err != nil && runErr == nil {
+			runErr = err
+		}
+		if runErr != nil {
+			return runErr
+		}
+		p := profiler.Profile()
+		e.Requests = p.Requests
+		if err := p.Save(profile); err != nil {
+			return err
+		}
+		return os.Rename(out+".tmp", out)
+	}()
+	e.Seconds = time.Since(e.Started).Seconds()
+	if err != nil {
+		e.Error = err.Error()
+		e.Output, e.Profile = "", ""
+		return e
+	}
+	e.Status = "done"
+	return e
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
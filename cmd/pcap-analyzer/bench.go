@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// benchReporter prints throughput figures while a capture is processed and
+// a summary once it is done.
+type benchReporter struct {
+	w     io.Writer
+	stats *analyzer.Stats
+	start time.Time
+	done  chan struct{}
+	exit  chan struct{}
+}
+
+func startBench(w io.Writer, stats *analyzer.Stats) *benchReporter {
+	b := &benchReporter{
+		w:     w,
+		stats: stats,
+		start: time.Now(),
+		done:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *benchReporter) run() {
+	defer close(b.exit)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastPackets, lastBytes, lastStreams int64
+	last := b.start
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			packets, bytes, streams := b.stats.Packets.Load(), b.stats.Bytes.Load(), b.stats.Streams.Load()
+			secs := now.Sub(last).Seconds()
+			fmt.Fprintf(b.w, "[bench] %.0f packets/s  %.2f MB/s  %.0f streams/s  peak RSS %s\n",
+				float64(packets-lastPackets)/secs,
+				float64(bytes-lastBytes)/secs/(1<<20),
+				float64(streams-lastStreams)/secs,
+				formatBytes(peakRSS()))
+			lastPackets, lastBytes, lastStreams, last = packets, bytes, streams, now
+		}
+	}
+}
+
+// stop ends periodic reporting and prints the totals for the whole run.
+func (b *benchReporter) stop() {
+	close(b.done)
+	<-b.exit
+
+	elapsed := time.Since(b.start)
+	secs := elapsed.Seconds()
+	packets, bytes, streams := b.stats.Packets.Load(), b.stats.Bytes.Load(), b.stats.Streams.Load()
+	fmt.Fprintf(b.w, "\n=== Benchmark ===\n")
+	fmt.Fprintf(b.w, "Elapsed:  %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(b.w, "Packets:  %d (%.0f/s)\n", packets, float64(packets)/secs)
+	fmt.Fprintf(b.w, "Data:     %s (%.2f MB/s)\n", formatBytes(uint64(bytes)), float64(bytes)/secs/(1<<20))
+	fmt.Fprintf(b.w, "Streams:  %d (%.0f/s)\n", streams, float64(streams)/secs)
+	fmt.Fprintf(b.w, "Peak RSS: %s\n", formatBytes(peakRSS()))
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/pcap-analyzer/internal/alert"
+	"github.com/pcap-analyzer/internal/broker"
+	"github.com/pcap-analyzer/internal/clickhouse"
+	"github.com/pcap-analyzer/internal/kafka"
+	"github.com/pcap-analyzer/internal/metrics"
+	"github.com/pcap-analyzer/internal/otlp"
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/internal/rules"
+	"github.com/pcap-analyzer/internal/sensor"
+	"github.com/pcap-analyzer/internal/syslog"
+	"github.com/pcap-analyzer/internal/webhook"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/events"
+)
+
+// defaultFlushInterval is how often the daemon inserts buffered ClickHouse
+// rows when the configuration doesn't say.
+const defaultFlushInterval = 10 * time.Second
+
+// runDaemon implements "pcap-analyzer daemon".
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/pcap-analyzer/sensor.json", "Configuration file")
+	check := fs.Bool("check", false, "Check the configuration and the rules and indicators it names, then exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer daemon [-config sensor.json] [-check]\n")
+		fmt.Fprintf(fs.Output(), "Runs as a long-lived sensor configured by a file. SIGHUP reloads its rules, indicators and webhook filters.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := sensor.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	det, err := cfg.Detection()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logDetection(det)
+	if *check {
+		for _, s := range det.Rules.Skipped {
+			log.Printf("Skipped %v", s)
+		}
+		return
+	}
+
+	var alerter *alert.Alerter
+	if a := cfg.Alerts; a != nil {
+		ac := alert.Config{
+			SlackURL: a.Slack,
+			SMTP: alert.SMTP{
+				Addr:     a.SMTP,
+				From:     a.From,
+				To:       a.To,
+				User:     a.SMTPUser,
+				Password: os.Getenv("SMTP_PASSWORD"),
+			},
+			Rate:     a.Rate,
+			Cooldown: time.Duration(a.Cooldown),
+			Capture:  cfg.Interface + cfg.File,
+		}
+		if a.Template != "" {
+			b, err := os.ReadFile(a.Template)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ac.Template = string(b)
+		}
+		if alerter, err = alert.New(ac); err != nil {
+			log.Fatalf("alerts: %v", err)
+		}
+	}
+	detector := sensor.NewDetector(det, func(f report.Finding) {
+		log.Printf("%s: %s: %s", f.Kind, f.Summary, f.Detail)
+		if alerter != nil {
+			alerter.Notify(f)
+		}
+	})
+	// Detection looks at the traffic as captured; what leaves through the
+	// sinks is redacted when the config asks
+	var sinks output.Multi
+	var notifier *webhook.Notifier
+	if w := cfg.Webhook; w != nil {
+		if notifier, err = newNotifier(w.URLs, w.Filters, webhookRules(cfg, det)); err != nil {
+			log.Fatalf("webhook: %v", err)
+		}
+		sinks = append(sinks, notifier)
+	}
+	var sink *clickhouse.Sink
+	if c := cfg.ClickHouse; c != nil {
+		flush := time.Duration(c.Flush)
+		if flush == 0 {
+			flush = defaultFlushInterval
+		}
+		sink, err = clickhouse.New(clickhouse.Config{
+			URL:           c.URL,
+			Table:         c.Table,
+			User:          c.User,
+			Password:      os.Getenv("CLICKHOUSE_PASSWORD"),
+			BatchSize:     c.BatchSize,
+			Capture:       cfg.Interface + cfg.File,
+			FlushInterval: flush,
+		})
+		if err != nil {
+			log.Fatalf("ClickHouse: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	var producer *kafka.Producer
+	if k := cfg.Kafka; k != nil {
+		producer, err = kafka.New(kafka.Config{
+			Brokers:  k.Brokers,
+			Topic:    k.Topic,
+			TLS:      k.TLS,
+			CAFile:   k.CAFile,
+			CertFile: k.CertFile,
+			KeyFile:  k.KeyFile,
+			Insecure: k.Insecure,
+			SASL:     k.SASL,
+			User:     k.User,
+			Password: os.Getenv("KAFKA_PASSWORD"),
+			Capture:  cfg.Interface + cfg.File,
+			MaxBody:  k.MaxBody,
+		})
+		if err != nil {
+			log.Fatalf("Kafka: %v", err)
+		}
+		sinks = append(sinks, producer)
+	}
+	var exporter *otlp.Exporter
+	if o := cfg.OTLP; o != nil {
+		headers, err := otlp.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			log.Fatalf("OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+		flush := time.Duration(o.Flush)
+		if flush == 0 {
+			flush = defaultFlushInterval
+		}
+		exporter, err = otlp.New(otlp.Config{
+			Endpoint:      o.Endpoint,
+			Headers:       headers,
+			Service:       o.Service,
+			Capture:       cfg.Interface + cfg.File,
+			FlushInterval: flush,
+		})
+		if err != nil {
+			log.Fatalf("OTLP: %v", err)
+		}
+		sinks = append(sinks, exporter)
+	}
+	var syslogOut *syslog.Writer
+	if l := cfg.Syslog; l != nil {
+		syslogOut = newSyslog(l, cfg.Interface+cfg.File)
+		sinks = append(sinks, syslogOut)
+	}
+	counters := &analyzer.Stats{}
+	if m := cfg.Metrics; m != nil {
+		collector := metrics.New()
+		collector.Stats = counters
+		collector.MaxHosts = m.MaxHosts
+		sinks = append(sinks, collector)
+		serveMetrics(m.Addr, collector)
+	}
+	var b *broker.Broker
+	var srv *grpc.Server
+	if g := cfg.GRPC; g != nil {
+		b, srv = serveEvents(g)
+		sinks = append(sinks, b)
+	}
+	var redacted output.Handler = sinks
+	if r := cfg.Redact; r != nil {
+		rules := output.DefaultRedactRules
+		rules.Headers = append(rules.Headers[:len(rules.Headers):len(rules.Headers)], r.Headers...)
+		rules.Fields = append(rules.Fields[:len(rules.Fields):len(rules.Fields)], r.Fields...)
+		rules.Patterns = append(rules.Patterns[:len(rules.Patterns):len(rules.Patterns)], r.Regexps()...)
+		redacted = output.NewRedact(sinks, rules)
+	}
+	handler := output.Multi{detector, redacted}
+
+	opts := analyzer.Options{
+		DNS:             *cfg.DNS,
+		MaxStreamMemory: 16 << 20,
+		IdleTimeout:     time.Duration(cfg.IdleTimeout),
+		Stats:           counters,
+	}
+	done := make(chan error, 1)
+	go func() {
+		if cfg.Interface != "" {
+			done <- analyzer.Live(cfg.Interface, opts, handler)
+		} else {
+			done <- analyzer.Run(cfg.File, opts, handler)
+		}
+	}()
+	log.Printf("Capturing from %s", cfg.Interface+cfg.File)
+	sdNotify("READY=1")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				log.Printf("Received %v, shutting down", s)
+				running = false
+				break
+			}
+			sdNotify("RELOADING=1")
+			if next, err := reload(*configPath, cfg, detector, notifier); err != nil {
+				log.Printf("Reload failed, keeping the previous configuration: %v", err)
+			} else {
+				cfg = next
+			}
+			sdNotify("READY=1")
+		}
+	}
+
+	sdNotify("STOPPING=1")
+	if b != nil {
+		b.Close()
+		srv.GracefulStop()
+	}
+	if notifier != nil {
+		closeNotifier(notifier)
+	}
+	if sink != nil {
+		if err := sink.Close(); err != nil {
+			_, failed := sink.Inserted()
+			log.Printf("ClickHouse: %v (%d rows lost)", err, failed)
+		}
+	}
+	if producer != nil {
+		if err := producer.Close(); err != nil {
+			_, failed := producer.Counts()
+			log.Printf("Kafka: %v (%d transactions lost)", err, failed)
+		}
+	}
+	if exporter != nil {
+		if err := exporter.Close(); err != nil {
+			_, failed := exporter.Exported()
+			log.Printf("OTLP: %v (%d spans lost)", err, failed)
+		}
+	}
+	if syslogOut != nil {
+		if err := syslogOut.Close(); err != nil {
+			_, dropped := syslogOut.Counts()
+			log.Printf("syslog: %v (%d messages lost)", err, dropped)
+		}
+	}
+	if alerter != nil {
+		if err := alerter.Close(); err != nil {
+			log.Printf("alerts: %v", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// reload reads the configuration file again and switches to its rules,
+// indicators and webhook filters. The capture, and every connection it is
+// following, carries on as it was.
+func reload(path string, cfg *sensor.Config, detector *sensor.Detector, notifier *webhook.Notifier) (*sensor.Config, error) {
+	next, err := sensor.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	det, err := next.Detection()
+	if err != nil {
+		return nil, err
+	}
+	if notifier != nil && next.Webhook != nil {
+		if err := notifier.Reload(next.Webhook.Filters, webhookRules(next, det)); err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+	}
+	detector.Swap(det)
+	log.Printf("Reloaded %s", path)
+	logDetection(det)
+	if cfg.NeedsRestart(next) {
+		log.Printf("Settings other than rules, rule variables, indicators and webhook filters take effect on restart")
+	}
+	return next, nil
+}
+
+// webhookRules returns the rules the webhook posts matches of, if any.
+func webhookRules(cfg *sensor.Config, det *sensor.Detection) *rules.Set {
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+	return det.Rules
+}
+
+func logDetection(det *sensor.Detection) {
+	log.Printf("Loaded %d rules (%d skipped) and %d indicators", det.Rules.Len(), len(det.Rules.Skipped), det.IOC.Len())
+}
+
+// serveEvents starts the gRPC event stream of the grpc subcommand.
+func serveEvents(g *sensor.GRPC) (*broker.Broker, *grpc.Server) {
+	var serverOpts []grpc.ServerOption
+	if g.TLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(g.TLSCert, g.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	addr := g.Addr
+	if addr == "" {
+		addr = "localhost:9090"
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := broker.New(g.Buffer)
+	srv := grpc.NewServer(serverOpts...)
+	events.RegisterEventsServer(srv, b)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Serving events on %s", lis.Addr())
+	return b, srv
+}
+
+// sdNotify tells systemd of a change of state when it runs the daemon as a
+// Type=notify service, and does nothing otherwise.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// newSyslog returns the syslog writer of a configuration, whose facility
+// and severity Load has checked.
+func newSyslog(l *sensor.Syslog, capture string) *syslog.Writer {
+	facility, _ := syslog.Facility(l.Facility)
+	severity, _ := syslog.Severity(l.Severity)
+	w, err := syslog.New(syslog.Config{
+		Addr:     l.Addr,
+		Facility: facility,
+		Severity: severity,
+		Insecure: l.Insecure,
+		Capture:  capture,
+	})
+	if err != nil {
+		log.Fatalf("syslog: %v", err)
+	}
+	return w
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// runDiff implements "pcap-analyzer diff".
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer diff before after\n")
+		fmt.Fprintf(fs.Output(), "Each of before and after is a capture, a profile saved with -save-profile (.json) or a HAR file (.har).\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	before, err := profile(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	after, err := profile(fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	report.WriteDiff(os.Stdout, before, after)
+}
+
+// profile loads a saved profile or HAR file, or analyzes a capture into a
+// report.Profile.
+func profile(path string) (*report.Profile, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return report.LoadProfile(path)
+	case ".har":
+		return report.LoadHAR(path)
+	}
+	p := report.NewProfiler(path)
+	if err := analyzer.Run(path, analyzer.Options{}, p); err != nil {
+		return nil, err
+	}
+	return p.Profile(), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/pcap-analyzer/internal/broker"
+	"github.com/pcap-analyzer/internal/metrics"
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/internal/rules"
+	"github.com/pcap-analyzer/internal/webhook"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/events"
+)
+
+// runGRPC implements "pcap-analyzer grpc".
+func runGRPC(args []string) {
+	fs := flag.NewFlagSet("grpc", flag.ExitOnError)
+	maxStreamMemory := byteSize(16 << 20)
+	addr := fs.String("addr", "localhost:9090", "Address to listen on")
+	iface := fs.String("i", "", "Capture live from this network interface (Linux, needing root or CAP_NET_RAW, or Windows with Npcap)")
+	listIfaces := fs.Bool("list-interfaces", false, "List the network interfaces -i takes, and exit")
+	file := fs.String("r", "", "Read packets from this capture file, s3:// or gs:// URL instead, or - for standard input")
+	parseDNS := fs.Bool("dns", true, "Parse and stream DNS messages")
+	idleTimeout := fs.Duration("idle-timeout", 2*time.Minute, "Parse and release connections idle this long")
+	buffer := fs.Int("buffer", broker.DefaultBuffer, "Events queued per subscriber before events are dropped")
+	wait := fs.Int("wait", 0, "Wait for this many subscribers before reading packets")
+	tlsCert := fs.String("tls-cert", "", "Serve TLS with this certificate file")
+	tlsKey := fs.String("tls-key", "", "Private key file for -tls-cert")
+	metricsAddr := fs.String("metrics", "", "Also serve Prometheus metrics of the traffic seen on /metrics at this address, e.g. :9100")
+	var webhooks, webhookFilters, ruleFiles, ruleVars stringList
+	fs.Var(&webhooks, "webhook", "Also POST events matching -webhook-filter or -rules to this URL; may be repeated")
+	fs.Var(&webhookFilters, "webhook-filter", "Filter expression selecting events for -webhook; may be repeated")
+	fs.Var(&ruleFiles, "rules", "Suricata or Snort rule file whose HTTP and DNS alerts are posted to -webhook; may be repeated")
+	fs.Var(&ruleVars, "rule-var", "Set a rule variable, e.g. 'HOME_NET=[10.0.0.0/8,192.168.0.0/16]'; may be repeated")
+	fs.Var(&maxStreamMemory, "max-stream-memory", "Reassembled payload kept in memory per stream before spilling to disk")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer grpc -i interface | -r capture.pcap [flags]\n")
+		fmt.Fprintf(fs.Output(), "Serves a gRPC API streaming HTTP and DNS events to subscribers as packets are parsed.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *listIfaces {
+		listInterfaces()
+		return
+	}
+	if (*iface == "") == (*file == "") || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	var serverOpts []grpc.ServerOption
+	if *tlsCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	if len(webhooks) == 0 && (len(webhookFilters) > 0 || len(ruleFiles) > 0) {
+		log.Fatal("-webhook-filter and -rules need -webhook")
+	}
+	b := broker.New(*buffer)
+	handler := output.Multi{b}
+	var notifier *webhook.Notifier
+	if len(webhooks) > 0 {
+		var set *rules.Set
+		if len(ruleFiles) > 0 {
+			set = loadRules(ruleFiles, ruleVars)
+		}
+		var err error
+		notifier, err = newNotifier(webhooks, webhookFilters, set)
+		if err != nil {
+			log.Fatalf("-webhook: %v", err)
+		}
+		handler = append(handler, notifier)
+	}
+	counters := &analyzer.Stats{}
+	if *metricsAddr != "" {
+		collector := metrics.New()
+		collector.Stats = counters
+		handler = append(handler, collector)
+		serveMetrics(*metricsAddr, collector)
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := grpc.NewServer(serverOpts...)
+	events.RegisterEventsServer(srv, b)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Serving events on %s", lis.Addr())
+
+	opts := analyzer.Options{
+		DNS:             *parseDNS,
+		MaxStreamMemory: int(maxStreamMemory),
+		IdleTimeout:     *idleTimeout,
+		Stats:           counters,
+	}
+	done := make(chan error, 1)
+	go func() {
+		if *wait > 0 {
+			log.Printf("Waiting for %d subscribers", *wait)
+			b.WaitSubscribers(*wait)
+		}
+		switch {
+		case *iface != "":
+			done <- analyzer.Live(*iface, opts, handler)
+		case *file == "-":
+			done <- analyzer.RunReader(os.Stdin, opts, handler)
+		default:
+			done <- analyzer.Run(*file, opts, handler)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-done:
+	case s := <-sig:
+		log.Printf("Received %v, shutting down", s)
+	}
+	// Let subscribers receive what is queued before their streams end
+	b.Close()
+	srv.GracefulStop()
+	if notifier != nil {
+		closeNotifier(notifier)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
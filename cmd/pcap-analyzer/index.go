@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pcap-analyzer/internal/index"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// indexSuffix is appended to a capture's path to name its index.
+const indexSuffix = ".idx"
+
+// runIndex implements "pcap-analyzer index".
+func runIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	out := fs.String("o", "", "Index file to write (default: capture path + "+indexSuffix+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer index [-o file] capture.pcap\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	capture := fs.Arg(0)
+	if *out == "" {
+		*out = capture + indexSuffix
+	}
+
+	ix, err := index.Build(capture, analyzer.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ix.Save(*out); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Indexed %d packets, %d flows, %d requests, %d names into %s\n",
+		ix.Packets, len(ix.Flows), len(ix.Requests), len(ix.Names), *out)
+}
+
+// runQuery implements "pcap-analyzer query".
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var f index.Filter
+	var from, to string
+	fs.StringVar(&f.Host, "host", "", "Only this host; *.example.com matches subdomains")
+	fs.StringVar(&f.IP, "ip", "", "Only flows to or from this address")
+	fs.StringVar(&f.Method, "method", "", "Only requests with this method")
+	fs.IntVar(&f.Status, "status", 0, "Only requests answered with this status")
+	fs.StringVar(&from, "from", "", "Only traffic at or after this RFC 3339 time")
+	fs.StringVar(&to, "to", "", "Only traffic at or before this RFC 3339 time")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer query [flags] capture.pcap[%s] summary|flows|hosts|requests\n", indexSuffix)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if f.From, err = parseTime(from); err != nil {
+		log.Fatal(err)
+	}
+	if f.To, err = parseTime(to); err != nil {
+		log.Fatal(err)
+	}
+
+	path := fs.Arg(0)
+	if !strings.HasSuffix(path, indexSuffix) {
+		path += indexSuffix
+	}
+	ix, err := index.Load(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ix.Stale() {
+		log.Printf("warning: %s has changed since it was indexed", ix.Capture)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch fs.Arg(1) {
+	case "summary":
+		fmt.Fprintf(w, "Capture:\t%s\n", ix.Capture)
+		fmt.Fprintf(w, "Start:\t%s\n", ix.Start.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "End:\t%s\n", ix.End.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "Duration:\t%s\n", ix.End.Sub(ix.Start))
+		fmt.Fprintf(w, "Packets:\t%d\n", ix.Packets)
+		fmt.Fprintf(w, "Flows:\t%d\n", len(ix.Flows))
+		fmt.Fprintf(w, "Requests:\t%d\n", len(ix.Requests))
+		fmt.Fprintf(w, "DNS names:\t%d\n", len(ix.Names))
+	case "flows":
+		fmt.Fprintln(w, "FIRST\tPROTO\tSOURCE\tDESTINATION\tPACKETS\tBYTES\tDURATION\tPACKET#\tOFFSET")
+		for _, fl := range ix.FindFlows(f) {
+			fmt.Fprintf(w, "%s\t%s\t%s:%s\t%s:%s\t%d\t%d\t%s\t%d\t%d\n",
+				fl.First.Format(time.RFC3339Nano), fl.Proto, fl.SrcIP, fl.SrcPort, fl.DstIP, fl.DstPort,
+				fl.Packets, fl.Bytes, fl.Last.Sub(fl.First), fl.FirstPacket, fl.Offset)
+		}
+	case "hosts":
+		fmt.Fprintln(w, "HOST\tREQUESTS\tFIRST\tLAST\tADDRESSES")
+		for _, h := range ix.FindHosts(f) {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", h.Name, h.Requests,
+				h.First.Format(time.RFC3339), h.Last.Format(time.RFC3339), strings.Join(h.Addresses, ","))
+		}
+	case "requests":
+		fmt.Fprintln(w, "TIME\tMETHOD\tSTATUS\tURL")
+		for _, r := range ix.FindRequests(f) {
+			status := "-"
+			if r.Status != 0 {
+				status = fmt.Sprint(r.Status)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339Nano), r.Method, status, r.URL)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
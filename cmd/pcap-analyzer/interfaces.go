@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// listInterfaces prints the interfaces live capture can read from, for
+// -list-interfaces. Either the name or the friendly name may be given to
+// -i.
+func listInterfaces() {
+	ifaces, err := analyzer.Interfaces()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "NAME\tFRIENDLY NAME\tSTATE\tADDRESSES\tDESCRIPTION\n")
+	for _, i := range ifaces {
+		state := "down"
+		if i.Up {
+			state = "up"
+		}
+		if i.Loopback {
+			state += ",loopback"
+		}
+		addrs := strings.Join(i.Addresses, " ")
+		if addrs == "" {
+			addrs = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", i.Name, i.FriendlyName, state, addrs, i.Description)
+	}
+}
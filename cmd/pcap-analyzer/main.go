@@ -2,357 +2,988 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"compress/gzip"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/reassembly"
-	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/alert"
+	"github.com/pcap-analyzer/internal/asn"
+	"github.com/pcap-analyzer/internal/clickhouse"
+	"github.com/pcap-analyzer/internal/filter"
+	"github.com/pcap-analyzer/internal/fingerprint"
+	"github.com/pcap-analyzer/internal/grpcmsg"
+	"github.com/pcap-analyzer/internal/har"
+	"github.com/pcap-analyzer/internal/ioc"
+	"github.com/pcap-analyzer/internal/kafka"
+	"github.com/pcap-analyzer/internal/lookalike"
+	"github.com/pcap-analyzer/internal/objstore"
+	"github.com/pcap-analyzer/internal/otlp"
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/internal/rules"
+	"github.com/pcap-analyzer/internal/sqlite"
+	"github.com/pcap-analyzer/internal/syslog"
+	"github.com/pcap-analyzer/internal/tsdb"
+	"github.com/pcap-analyzer/internal/webhook"
+	"github.com/pcap-analyzer/pkg/analyzer"
 )
 
-type HTTPStream struct {
-	net, transport gopacket.Flow
-	r              tcpReader
-	reversed       bool
-}
+// defaultTop is how many hosts and flows reports list without -top.
+const defaultTop = 10
 
-type tcpReader struct {
-	bytes.Buffer
-	ident    string
-	isClient bool
-	parent   *HTTPStream
-}
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "query":
+			runQuery(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "sanitize":
+			runSanitize(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "grpc":
+			runGRPC(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "batch":
+			runBatch(os.Args[2:])
+			return
+		}
+	}
 
-func (t *tcpReader) Read(p []byte) (int, error) {
-	n, err := t.Buffer.Read(p)
-	return n, err
-}
+	var pcapFile string
+	var enableDNS bool
+	var workers, parseWorkers, dnsCacheSize, parallel, top int
+	var maxPages, maxConnPages int
+	var idleTimeout, flushInterval time.Duration
+	var bench, noProgress, constantMemory, noSummary, latency, bandwidth, sizes, errorReport, userAgents, sessions, anomalies, dnsCorrelation, cacheReport, secrets, redact, hashBodies, hashMD5, chunks, beacons, attacks, cleartext, downgrade, nameMismatch, tlsConns, dgaReport, idn, scanners, bruteForce bool
+	var pprofAddr, cpuProfile, memProfile string
+	var saveBodies, extractBinaries, checkpoint, client, clientOut string
+	var baselinePath, saveProfile, asnPath, timelineCSV string
+	var graphPath, graphFormat string
+	var mispURL, mispKey, mispLast, taxiiURL, taxiiUser, tlsFloor string
+	var filterExpr, writePcap, extractID, format, harPath, parquetDir string
+	var clickhouseURL, clickhouseTable, clickhouseUser string
+	var clickhouseBatch int
+	var sqlitePath string
+	var kafkaBrokers, kafkaTopic, kafkaCA, kafkaCert, kafkaKey, kafkaSASL, kafkaUser string
+	var kafkaTLS, kafkaInsecure bool
+	var kafkaMaxBody int
+	var otlpEndpoint, otlpService string
+	var syslogAddr, syslogFacility, syslogSeverity string
+	var syslogInsecure bool
+	var clickhouseCreate bool
+	var tsdbURL, tsdbFormat, tsdbUser string
+	var tsdbInterval time.Duration
+	var checkpointInterval, errorInterval, timeline time.Duration
+	var resume bool
+	maxStreamMemory := byteSize(16 << 20)
+	var maxMemory byteSize
+	var asserts assertList
+	var secretPatterns secretPatternList
+	var redactHeaders, redactFields stringList
+	var redactPatterns regexpList
+	var iocFiles, ruleFiles, ruleVars, fingerprintFiles, brandFiles stringList
+	var fieldNames, fieldOptions stringList
+	var protoFiles, protoPaths stringList
+	var keyLogs, tlsKeys stringList
+	var webhooks, webhookFilters stringList
+	var alertSlack, alertSMTP, alertFrom, alertSMTPUser, alertTemplate string
+	var alertTo stringList
+	var alertRate int
+	var alertCooldown time.Duration
+	var listIfaces bool
+	flag.StringVar(&pcapFile, "file", "", "Path to pcap, pcapng or HAR file, or an s3:// or gs:// URL to stream one from")
+	flag.StringVar(&filterExpr, "filter", "", "Only print and report the requests, responses and DNS messages matching this expression, e.g. 'host == \"*.example.com\" and status >= 500'")
+	flag.StringVar(&writePcap, "write-pcap", "", "Write the packets of the connections and DNS messages matching -filter to this pcap file")
+	flag.StringVar(&parquetDir, "parquet", "", "Write the HTTP transactions matching -filter to Parquet files under this directory, partitioned by hour as date=YYYY-MM-DD/hour=HH")
+	flag.StringVar(&harPath, "har", "", "Write the HTTP transactions matching -filter to this HAR 1.2 file, for browser developer tools and HAR viewers")
+	flag.StringVar(&extractID, "extract", "", "Write only the packets of this transaction (an ID such as 19.2 from the output) or flow (the number of its first packet) to -write-pcap")
+	flag.StringVar(&format, "T", "text", "Output format: text, json for a JSON object per message, fields to print the -e fields of every message as tshark -T fields does, ecs for Elastic Common Schema JSON lines, arkime for an Elasticsearch bulk request of Arkime sessions, zeek for a Zeek http.log, or eve for Suricata EVE JSON http events")
+	flag.StringVar(&format, "output", "text", "Same as -T")
+	flag.Var(&fieldNames, "e", "Field to print with -T fields, named as in tshark, e.g. http.host, http.request.uri or dns.qry.name; may be repeated")
+	flag.Var(&fieldOptions, "E", "Option for -T fields as in tshark: header=y|n, separator=/t|/s|<char>, aggregator=,|/s|<char>, occurrence=f|l|a, quote=d|s|n or escape=y|n; may be repeated")
+	flag.Var(&protoFiles, "proto", "A .proto file, or a descriptor set from protoc --descriptor_set_out or buf build -o, whose services name and decode the gRPC messages printed; may be repeated")
+	flag.Var(&protoPaths, "proto-path", "Directory the imports of -proto files are found in, besides their own; may be repeated")
+	arkimeNode := flag.String("arkime-node", "pcap-analyzer", "Arkime capture node the sessions of -T arkime are recorded against")
+	arkimePrefix := flag.String("arkime-prefix", "arkime_", "Arkime index prefix for -T arkime; empty before Arkime 5")
+	flag.Var(&keyLogs, "keylog", "Decrypt the TLS connections whose secrets this NSS key log file (SSLKEYLOGFILE) holds and parse the HTTP they carry; may be repeated")
+	flag.Var(&tlsKeys, "tls-key", "Decrypt the TLS 1.2 connections that used RSA key exchange with the server whose private key is in this PEM file; may be repeated")
+	flag.BoolVar(&enableDNS, "d", false, "Enable DNS analysis")
+	flag.BoolVar(&enableDNS, "dns", false, "Enable DNS analysis")
+	flag.IntVar(&workers, "workers", 0, "Number of TCP reassembly workers (0 = one per CPU)")
+	flag.IntVar(&parallel, "parallel", 0, "Number of capture files analyzed concurrently (0 = one per CPU)")
+	flag.IntVar(&parseWorkers, "parse-workers", 0, "Number of streams parsed concurrently (0 = 64)")
+	flag.Var(&maxStreamMemory, "max-stream-memory", "Reassembled data a stream may buffer in memory before spilling to disk (0 = unlimited)")
+	flag.IntVar(&maxPages, "max-buffered-pages", 0, "Out-of-order pages (about 2KB each) each reassembly worker may buffer; beyond it gaps are skipped and data lost (0 = unlimited)")
+	flag.IntVar(&maxConnPages, "max-buffered-pages-per-conn", 0, "Out-of-order pages a single connection may buffer (0 = unlimited)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Connection timeout: close connections idle this long, in capture time or by the clock when capturing live (0 = keep until the end)")
+	flag.DurationVar(&flushInterval, "flush-interval", 30*time.Second, "How often, in capture time or by the clock when capturing live, to look for idle connections")
+	flag.Var(&maxMemory, "max-memory", "Memory budget, e.g. 2GB; near it the oldest connections are closed and caches shrunk (0 = none)")
+	flag.IntVar(&dnsCacheSize, "dns-cache-size", 0, "Resolved addresses to remember, oldest forgotten first (0 = unlimited)")
+	flag.BoolVar(&constantMemory, "constant-memory", false, "Bound what the analyzer keeps per connection and per address for very large captures; explicit flags still take precedence")
+	flag.StringVar(&checkpoint, "checkpoint", "", "Save progress to this file periodically so an interrupted run can be resumed")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", time.Minute, "How often to save progress with -checkpoint")
+	flag.BoolVar(&resume, "resume", false, "Continue from the -checkpoint file if it was saved for the same capture")
+	flag.StringVar(&saveBodies, "save-bodies", "", "Write every request and response body, in full, to files in this directory")
+	flag.BoolVar(&hashBodies, "hash", false, "Print the SHA-256 of every request and response body, decoded and in full")
+	flag.BoolVar(&hashMD5, "md5", false, "Print the MD5 of every body as well (implies -hash)")
+	flag.BoolVar(&chunks, "chunks", false, "Print the chunk sizes and extensions of every chunked body, to debug its framing")
+	flag.StringVar(&extractBinaries, "extract-binaries", "", "Save every executable, script and archive transferred, named by SHA-256, to this directory")
+	flag.BoolVar(&bench, "bench", false, "Report throughput and peak memory on stderr")
+	flag.StringVar(&pprofAddr, "pprof", "", "Serve net/http/pprof on this address, e.g. :6060")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	flag.StringVar(&memProfile, "memprofile", "", "Write a heap profile to this file when done")
+	flag.IntVar(&top, "top", 0, "Print the N most-requested hosts, paths and clients at the end (0 = don't)")
+	flag.BoolVar(&latency, "latency", false, "Print response time percentiles per endpoint and handshake round trip times per server at the end")
+	flag.BoolVar(&bandwidth, "bandwidth", false, "Print traffic by protocol and the busiest hosts and flows at the end")
+	flag.BoolVar(&sizes, "sizes", false, "Print response size histograms per content type and endpoint at the end")
+	flag.BoolVar(&errorReport, "errors", false, "Print 4xx/5xx, reset and timeout counts per host at the end")
+	flag.DurationVar(&errorInterval, "error-interval", time.Minute, "Time bucket size for -errors")
+	flag.BoolVar(&userAgents, "user-agents", false, "Print every distinct User-Agent with request counts at the end")
+	flag.BoolVar(&sessions, "sessions", false, "Print DNS lookups, connections and requests per client at the end")
+	flag.StringVar(&client, "client", "", "Print the timeline of everything this client address did (implies -sessions)")
+	flag.StringVar(&clientOut, "client-out", "", "Write the -client timeline to this file as JSON lines instead")
+	flag.StringVar(&baselinePath, "baseline", "", "Compare against this saved profile (.json), HAR file (.har) or capture at the end")
+	flag.StringVar(&saveProfile, "save-profile", "", "Save a profile of this run as JSON, to use later with -baseline or diff")
+	flag.BoolVar(&anomalies, "anomalies", false, "Print rate spikes, new headers, error bursts and unusually large responses at the end")
+	flag.BoolVar(&scanners, "scanners", false, "Print clients that behave like scanners at the end: many 404s, walking numeric IDs, trying many ports or hosts, scanner User-Agents")
+	flag.BoolVar(&bruteForce, "brute-force", false, "Print bursts of 401/403 responses and login POSTs from one client to one service at the end, a sign of password guessing or credential stuffing")
+	flag.BoolVar(&attacks, "attacks", false, "Print requests carrying SQL injection, XSS, path traversal and command injection payloads, by source, at the end")
+	flag.BoolVar(&beacons, "beacons", false, "Print clients contacting a destination at suspiciously regular intervals at the end")
+	flag.Var(&asserts, "assert", "Check a metric of the whole capture, e.g. 'p99_latency<500ms' or 'error_rate<1%', exiting with status 1 if it fails; may be repeated")
+	flag.StringVar(&asnPath, "asn-db", "", "Label addresses in reports with their AS and organization from this MaxMind ASN database (.mmdb) or CIDR,ASN,organization table")
+	flag.DurationVar(&timeline, "timeline", 0, "Print requests, errors and bytes over time in buckets of this size, e.g. 1s (0 = don't)")
+	flag.StringVar(&timelineCSV, "timeline-csv", "", "Write the -timeline series to this file as CSV instead")
+	flag.StringVar(&graphPath, "graph", "", "Write a graph of which clients sent HTTP requests to which servers to this file, as Graphviz DOT or, for .mmd files, Mermaid")
+	flag.StringVar(&graphFormat, "graph-format", "", "Format of -graph: dot or mermaid (default: from the file's extension)")
+	flag.BoolVar(&dgaReport, "dga", false, "Print DNS names that look algorithmically generated and the clients that looked them up at the end (implies -d)")
+	flag.BoolVar(&idn, "idn", false, "Print internationalized (xn--) names looked up or requested, in their Unicode form, at the end (implies -d)")
+	flag.Var(&brandFiles, "brands", "Report names that look like the protected domains listed in this file: homoglyphs, typos and embedded brand names (implies -idn); may be repeated")
+	flag.BoolVar(&dnsCorrelation, "dns-correlation", false, "Print DNS names never connected to, addresses connected to without DNS, and resolution-to-connection gaps at the end (implies -d)")
+	flag.BoolVar(&cacheReport, "cache", false, "Print cacheability, cache hit ratios and redundant downloads per host at the end")
+	flag.BoolVar(&secrets, "secrets", false, "Print API keys, tokens and passwords found in headers, URLs and bodies at the end")
+	flag.BoolVar(&cleartext, "cleartext-creds", false, "Print the services that received passwords, Basic auth and tokens over unencrypted HTTP at the end")
+	flag.Var(&secretPatterns, "secret-pattern", "Also look for secrets matching NAME=REGEXP, the first group being the secret if there is one (implies -secrets); may be repeated")
+	flag.Var(&iocFiles, "ioc", "Report transactions and DNS records matching the domains, addresses, URLs and hashes in this indicator file (implies -d); may be repeated")
+	flag.StringVar(&mispURL, "misp", "", "Also match indicators marked for IDS on this MISP server, fetched at startup (implies -d)")
+	flag.StringVar(&mispKey, "misp-key", "", "MISP automation key (default $MISP_KEY)")
+	flag.StringVar(&mispLast, "misp-last", "", "Only fetch MISP indicators published within this long, e.g. 30d")
+	flag.StringVar(&taxiiURL, "taxii", "", "Also match the indicators in this TAXII 2.1 collection URL, fetched at startup (implies -d)")
+	flag.StringVar(&taxiiUser, "taxii-user", "", "TAXII user name; the password is read from $TAXII_PASSWORD")
+	flag.BoolVar(&downgrade, "downgrade", false, "Print signs of SSL stripping and TLS downgrades at the end: plain HTTP to hosts that use HTTPS, redirects to http:// and old TLS versions")
+	flag.StringVar(&tlsFloor, "tls-floor", "1.2", "Lowest acceptable TLS version for -downgrade")
+	flag.BoolVar(&nameMismatch, "name-mismatch", false, "Print TLS connections whose HTTP CONNECT Host, SNI and certificate names disagree at the end, a sign of domain fronting or misconfigured virtual hosts")
+	flag.BoolVar(&tlsConns, "tls", false, "Print the handshake of every TLS connection at the end: SNI, version, cipher suite and ALPN protocol chosen, and the cipher suites and protocols offered")
+	flag.Var(&fingerprintFiles, "tls-blocklist", "Report TLS connections whose JA3 or JA4 client fingerprint is in this blocklist file, such as the abuse.ch SSLBL JA3 CSV; may be repeated")
+	flag.Var(&ruleFiles, "rules", "Report alerts from the HTTP and DNS rules in this Suricata or Snort rule file (implies -d); may be repeated")
+	flag.Var(&ruleVars, "rule-var", "Set a rule variable, e.g. 'HOME_NET=[10.0.0.0/8,192.168.0.0/16]'; unset variables match anything; may be repeated")
+	flag.StringVar(&clickhouseURL, "clickhouse", "", "Insert every request, response and DNS message into ClickHouse at this HTTP interface URL, e.g. http://localhost:8123")
+	flag.StringVar(&clickhouseTable, "clickhouse-table", clickhouse.DefaultTable, "ClickHouse table to insert into, optionally as database.table")
+	flag.StringVar(&clickhouseUser, "clickhouse-user", "", "ClickHouse user name; the password is read from $CLICKHOUSE_PASSWORD")
+	flag.IntVar(&clickhouseBatch, "clickhouse-batch", clickhouse.DefaultBatchSize, "Rows per ClickHouse insert")
+	flag.BoolVar(&clickhouseCreate, "clickhouse-create", false, "Create the ClickHouse table if it doesn't exist")
+	flag.StringVar(&kafkaBrokers, "kafka", "", "Publish every HTTP transaction to Kafka through these comma-separated brokers, e.g. kafka1:9092,kafka2:9092")
+	flag.StringVar(&kafkaTopic, "kafka-topic", kafka.DefaultTopic, "Kafka topic to publish to")
+	flag.BoolVar(&kafkaTLS, "kafka-tls", false, "Connect to the Kafka brokers over TLS")
+	flag.StringVar(&kafkaCA, "kafka-ca", "", "Verify the Kafka brokers against the CA certificates in this PEM file (implies -kafka-tls)")
+	flag.StringVar(&kafkaCert, "kafka-cert", "", "Client certificate PEM file for the Kafka brokers (implies -kafka-tls)")
+	flag.StringVar(&kafkaKey, "kafka-key", "", "Key PEM file of -kafka-cert")
+	flag.BoolVar(&kafkaInsecure, "kafka-insecure", false, "Don't verify the Kafka brokers' TLS certificates")
+	flag.StringVar(&kafkaSASL, "kafka-sasl", "", "Kafka SASL mechanism: plain, scram-sha-256 or scram-sha-512")
+	flag.StringVar(&kafkaUser, "kafka-user", "", "Kafka SASL user name; the password is read from $KAFKA_PASSWORD")
+	flag.IntVar(&kafkaMaxBody, "kafka-max-body", 0, "Bytes of each body to include in Kafka events (0 = none)")
+	flag.StringVar(&otlpEndpoint, "otlp", "", "Export every HTTP transaction as an OpenTelemetry span to this OTLP/HTTP endpoint, e.g. http://localhost:4318; headers are read from $OTEL_EXPORTER_OTLP_HEADERS")
+	flag.StringVar(&otlpService, "otlp-service", "", "service.name of the -otlp spans (default: the host each request was sent to)")
+	flag.StringVar(&syslogAddr, "syslog", "", "Send a summary of each HTTP transaction matching -filter to this syslog server as an RFC 5424 message: udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log")
+	flag.StringVar(&syslogFacility, "syslog-facility", "local0", "Facility of -syslog messages, such as user, daemon or local0 to local7")
+	flag.StringVar(&syslogSeverity, "syslog-severity", "info", "Severity of -syslog messages, such as notice, info or warning")
+	flag.BoolVar(&syslogInsecure, "syslog-insecure", false, "Don't verify the syslog server's TLS certificate")
+	flag.StringVar(&sqlitePath, "sqlite", "", "Write every flow, HTTP transaction and DNS message to this SQLite database, creating it if need be (implies -d)")
+	flag.StringVar(&alertSlack, "alert-slack", "", "Send -ioc, -cleartext-creds and -beacons findings to this Slack incoming webhook URL")
+	flag.StringVar(&alertSMTP, "alert-smtp", "", "Send -ioc, -cleartext-creds and -beacons findings by email through this SMTP server host:port")
+	flag.StringVar(&alertFrom, "alert-from", "", "Sender address of -alert-smtp emails")
+	flag.Var(&alertTo, "alert-to", "Recipient of -alert-smtp emails; may be repeated")
+	flag.StringVar(&alertSMTPUser, "alert-smtp-user", "", "SMTP user name; the password is read from $SMTP_PASSWORD")
+	flag.StringVar(&alertTemplate, "alert-template", "", "Go text/template file rendering alert messages; the first line is the email subject")
+	flag.IntVar(&alertRate, "alert-rate", alert.DefaultRate, "Most alerts sent per minute; the rest are counted in a final message")
+	flag.DurationVar(&alertCooldown, "alert-cooldown", alert.DefaultCooldown, "Don't repeat the same finding within this long")
+	flag.Var(&webhooks, "webhook", "POST events matching -webhook-filter or -rules to this URL as they are parsed; may be repeated")
+	flag.Var(&webhookFilters, "webhook-filter", "Filter expression selecting events for -webhook; may be repeated")
+	flag.StringVar(&tsdbURL, "tsdb", "", "Write request rate, error rate, latency percentiles and DNS failures per bucket to this time-series database write URL")
+	flag.StringVar(&tsdbFormat, "tsdb-format", tsdb.Influx, "Format of -tsdb: influx (line protocol) or remote-write (Prometheus)")
+	flag.DurationVar(&tsdbInterval, "tsdb-interval", tsdb.DefaultInterval, "Bucket width of -tsdb metrics, in capture time")
+	flag.StringVar(&tsdbUser, "tsdb-user", "", "User name for -tsdb; the password is read from $TSDB_PASSWORD, or an API token from $TSDB_TOKEN")
+	flag.BoolVar(&redact, "redact", false, "Remove credentials, cookies, email addresses and card numbers from everything printed or saved")
+	flag.Var(&redactHeaders, "redact-header", "Also remove the values of this header (implies -redact); may be repeated")
+	flag.Var(&redactFields, "redact-field", "Also remove the values of this JSON field or query parameter (implies -redact); may be repeated")
+	flag.Var(&redactPatterns, "redact-pattern", "Also remove whatever matches this regular expression (implies -redact); may be repeated")
+	flag.BoolVar(&noSummary, "no-summary", false, "Don't print the traffic summary at the end")
+	flag.BoolVar(&noProgress, "no-progress", false, "Don't show a progress bar on stderr")
+	flag.BoolVar(&listIfaces, "list-interfaces", false, "List the network interfaces the grpc and daemon subcommands can capture from, and exit")
+	flag.Parse()
+	if listIfaces {
+		listInterfaces()
+		return
+	}
 
-type Context struct {
-	CaptureInfo gopacket.CaptureInfo
-}
+	// Further captures, such as rotated files, may follow the flags
+	var files []string
+	if pcapFile != "" {
+		files = append(files, pcapFile)
+	}
+	files = append(files, flag.Args()...)
+	if len(files) == 0 {
+		log.Fatal("Please provide a pcap or HAR file using -file flag")
+	}
+	eventFilter, err := filter.Compile(filterExpr)
+	if err != nil {
+		log.Fatalf("-filter: %v", err)
+	}
+	var extract *output.Extract
+	if extractID != "" {
+		if writePcap == "" {
+			log.Fatal("-extract needs -write-pcap")
+		}
+		// IDs count packets from the start of one capture
+		if len(files) != 1 {
+			log.Fatal("-extract works on a single capture")
+		}
+		if extract, err = output.NewExtract(extractID); err != nil {
+			log.Fatalf("-extract: %v", err)
+		}
+	}
+	var pcapOut *os.File
+	if writePcap != "" {
+		// The captures are read again once the run is over, so none of
+		// them may be the file written
+		if out, err := os.Stat(writePcap); err == nil {
+			for _, file := range files {
+				if in, err := os.Stat(file); err == nil && os.SameFile(in, out) {
+					log.Fatalf("-write-pcap %s would overwrite the capture being read", writePcap)
+				}
+			}
+		}
+		if pcapOut, err = os.Create(writePcap); err != nil {
+			log.Fatal(err)
+		}
+		defer pcapOut.Close()
+	}
+	var harOut *os.File
+	if harPath != "" {
+		for _, file := range files {
+			if in, err := os.Stat(file); err == nil {
+				if out, err := os.Stat(harPath); err == nil && os.SameFile(in, out) {
+					log.Fatalf("-har %s would overwrite the file being read", harPath)
+				}
+			}
+		}
+		if harOut, err = os.Create(harPath); err != nil {
+			log.Fatal(err)
+		}
+		defer harOut.Close()
+	}
 
-func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
-	return c.CaptureInfo
-}
+	opts := analyzer.Options{
+		DNS:                           enableDNS,
+		Workers:                       workers,
+		ParseWorkers:                  parseWorkers,
+		MaxStreamMemory:               int(maxStreamMemory),
+		IdleTimeout:                   idleTimeout,
+		FlushInterval:                 flushInterval,
+		DNSCacheSize:                  dnsCacheSize,
+		MaxBufferedPagesTotal:         maxPages,
+		MaxBufferedPagesPerConnection: maxConnPages,
+		SpoolBodies:                   saveBodies != "" || extractBinaries != "" || hashBodies || hashMD5,
+		HashBodies:                    hashBodies || hashMD5,
+		HashMD5:                       hashMD5,
+		RecordChunks:                  chunks,
+		MaxMemory:                     int64(maxMemory),
+		Checkpoint:                    checkpoint,
+		CheckpointInterval:            checkpointInterval,
+		Resume:                        resume,
+		Stats:                         &analyzer.Stats{},
+	}
+	if constantMemory {
+		applyConstantMemory(&opts)
+	}
+	if len(keyLogs) > 0 || len(tlsKeys) > 0 {
+		keys, err := analyzer.LoadKeyLog(keyLogs...)
+		if err != nil {
+			log.Fatalf("-keylog: %v", err)
+		}
+		if err := keys.LoadPrivateKeys(tlsKeys...); err != nil {
+			log.Fatalf("-tls-key: %v", err)
+		}
+		opts.TLSKeys = keys
+	}
 
-type tcpStreamFactory struct {
-	dnsCache *dns.Cache
-}
+	var asnDB *asn.DB
+	if asnPath != "" {
+		var err error
+		if asnDB, err = asn.Open(asnPath); err != nil {
+			log.Fatal(err)
+		}
+		defer asnDB.Close()
+	}
 
-// Helper function to decompress gzip content
-func decompressGzip(data []byte) ([]byte, error) {
-	reader := bytes.NewReader(data)
-	gzipReader, err := gzip.NewReader(reader)
-	if err != nil {
-		return nil, err
+	var alerter *alert.Alerter
+	if alertSlack != "" || alertSMTP != "" {
+		if len(iocFiles) == 0 && mispURL == "" && taxiiURL == "" && !cleartext && !beacons {
+			log.Fatal("alerts need -ioc, -misp, -taxii, -cleartext-creds or -beacons")
+		}
+		cfg := alert.Config{
+			SlackURL: alertSlack,
+			SMTP: alert.SMTP{
+				Addr:     alertSMTP,
+				From:     alertFrom,
+				To:       alertTo,
+				User:     alertSMTPUser,
+				Password: os.Getenv("SMTP_PASSWORD"),
+			},
+			Rate:     alertRate,
+			Cooldown: alertCooldown,
+			Capture:  strings.Join(files, ", "),
+		}
+		if alertTemplate != "" {
+			b, err := os.ReadFile(alertTemplate)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Template = string(b)
+		}
+		var err error
+		if alerter, err = alert.New(cfg); err != nil {
+			log.Fatalf("alerts: %v", err)
+		}
 	}
-	defer gzipReader.Close()
-	
-	return io.ReadAll(gzipReader)
-}
 
-func (h *HTTPStream) run(dnsCache *dns.Cache) {
-	// Wait for some data to be available
-	for i := 0; i < 100; i++ { // Max 1 second wait
-		if h.r.Buffer.Len() > 0 {
-			break
+	if len(fieldNames) > 0 && format != "fields" {
+		log.Fatal("-e needs -T fields")
+	}
+	var handler output.Multi
+	switch format {
+	case "text":
+		text := output.NewText(os.Stdout)
+		if len(protoFiles) > 0 {
+			protos, err := grpcmsg.Load(protoFiles, protoPaths)
+			if err != nil {
+				log.Fatalf("-proto: %v", err)
+			}
+			text.Protos = protos
+		}
+		handler = output.Multi{text}
+	case "fields":
+		fieldOpts := output.DefaultFieldOptions
+		for _, o := range fieldOptions {
+			if err := fieldOpts.Set(o); err != nil {
+				log.Fatalf("-E: %v", err)
+			}
+		}
+		fields, err := output.NewFields(os.Stdout, fieldNames, fieldOpts)
+		if err != nil {
+			log.Fatalf("-e: %v", err)
 		}
-		time.Sleep(10 * time.Millisecond)
+		handler = output.Multi{fields}
+		// Only the fields are printed, for scripts to read
+		noSummary = true
+	case "json":
+		handler = output.Multi{output.NewJSON(os.Stdout)}
+		noSummary = true
+	case "ecs":
+		handler = output.Multi{output.NewECS(os.Stdout)}
+		noSummary = true
+	case "arkime":
+		a := output.NewArkime(os.Stdout)
+		a.Node, a.Prefix = *arkimeNode, *arkimePrefix
+		handler = output.Multi{a}
+		noSummary = true
+	case "zeek":
+		handler = output.Multi{output.NewZeek(os.Stdout)}
+		noSummary = true
+	case "eve":
+		handler = output.Multi{output.NewEVE(os.Stdout)}
+		noSummary = true
+	default:
+		log.Fatalf("-T %s: want text, json, fields, ecs, arkime, zeek or eve", format)
 	}
-	
-	if h.r.Buffer.Len() == 0 {
-		return
+	if !noSummary {
+		summary := report.NewSummary(os.Stdout)
+		if constantMemory || maxMemory > 0 {
+			// Flows are forgotten once idle, like the connections
+			summary.IdleTimeout = opts.IdleTimeout
+		}
+		handler = append(handler, summary)
+	}
+	if top > 0 {
+		handler = append(handler, report.NewTop(os.Stdout, top))
+	}
+	n := top
+	if n <= 0 {
+		n = defaultTop
+	}
+	if bandwidth {
+		b := report.NewBandwidth(os.Stdout, n)
+		b.ASN = asnDB
+		handler = append(handler, b)
+	}
+	if sizes {
+		handler = append(handler, report.NewSizes(os.Stdout, n))
+	}
+	if errorReport {
+		e := report.NewErrors(os.Stdout, errorInterval)
+		e.ASN = asnDB
+		handler = append(handler, e)
 	}
-	
-	// Wait for buffer to fill up more to ensure we have complete headers
-	// Many HTTP requests span multiple TCP packets
-	prevLen := 0
-	for i := 0; i < 10; i++ {
-		currentLen := h.r.Buffer.Len()
-		if currentLen == prevLen && currentLen > 100 {
-			// Buffer stopped growing and has some data
-			break
-		}
-		prevLen = currentLen
-		time.Sleep(20 * time.Millisecond)
-	}
-	
-	// Check if this is TLS/encrypted traffic by looking at the destination port and data
-	dstPort := h.transport.Dst().String()
-	srcPort := h.transport.Src().String()
-	if dstPort == "443" || dstPort == "8443" || srcPort == "443" || srcPort == "8443" {
-		// Peek at first few bytes to confirm TLS
-		if h.r.Buffer.Len() >= 3 {
-			firstBytes := h.r.Buffer.Bytes()[:3]
-			if firstBytes[0] == 0x16 && firstBytes[1] == 0x03 {
-				return
+	if userAgents {
+		handler = append(handler, report.NewUserAgents(os.Stdout))
+	}
+	if sessions || client != "" {
+		s := report.NewSessions(os.Stdout)
+		s.Client = client
+		if clientOut != "" {
+			f, err := os.Create(clientOut)
+			if err != nil {
+				log.Fatal(err)
 			}
+			defer f.Close()
+			s.Export = f
 		}
+		handler = append(handler, s)
 	}
-	
-	buf := bufio.NewReader(&h.r)
-	
-	for {
-		// Peek at data to determine if this is HTTP request or response
-		peek, err := buf.Peek(8)
+	if timeline > 0 {
+		tl := report.NewTimeline(os.Stdout, timeline)
+		if timelineCSV != "" {
+			f, err := os.Create(timelineCSV)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			tl.CSV = f
+		}
+		handler = append(handler, tl)
+	}
+	if graphPath != "" {
+		if graphFormat == "" {
+			graphFormat = report.GraphFormat(graphPath)
+		}
+		if graphFormat != report.GraphDOT && graphFormat != report.GraphMermaid {
+			log.Fatalf("-graph-format %q: want dot or mermaid", graphFormat)
+		}
+		f, err := os.Create(graphPath)
 		if err != nil {
-			return
+			log.Fatal(err)
 		}
-		
-		peekStr := string(peek)
-		
-		
-		// Check if this looks like TLS handshake data
-		if len(peek) >= 3 && peek[0] == 0x16 && peek[1] == 0x03 {
-			return
+		defer f.Close()
+		handler = append(handler, report.NewGraph(f, graphFormat))
+	}
+	if dnsCorrelation {
+		opts.DNS = true
+		handler = append(handler, report.NewDNSCorrelation(os.Stdout))
+	}
+	if idn || len(brandFiles) > 0 {
+		var brands *lookalike.Brands
+		if len(brandFiles) > 0 {
+			var err error
+			if brands, err = lookalike.LoadBrands(brandFiles...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		opts.DNS = true
+		handler = append(handler, report.NewLookalikes(os.Stdout, brands))
+	}
+	if dgaReport {
+		opts.DNS = true
+		handler = append(handler, report.NewDGA(os.Stdout, n))
+	}
+	if len(iocFiles) > 0 || mispURL != "" || taxiiURL != "" {
+		set, err := ioc.Load(iocFiles...)
+		if err != nil {
+			log.Fatal(err)
 		}
-		
-		// HTTP responses start with "HTTP/"
-		if strings.HasPrefix(peekStr, "HTTP/") {
-			// Parse as HTTP response
-			dummyReq := &http.Request{Method: "GET"}
-			resp, err := http.ReadResponse(buf, dummyReq)
+		if mispURL != "" {
+			if mispKey == "" {
+				mispKey = os.Getenv("MISP_KEY")
+			}
+			indicators, err := ioc.FetchMISP(mispURL, mispKey, mispLast)
+			if err == nil {
+				err = set.AddAll(indicators)
+			}
 			if err != nil {
-				// Try to see if there's more data coming
-				time.Sleep(10 * time.Millisecond)
-				continue
+				log.Fatal(err)
+			}
+		}
+		if taxiiURL != "" {
+			indicators, err := ioc.FetchTAXII(taxiiURL, taxiiUser, os.Getenv("TAXII_PASSWORD"))
+			if err == nil {
+				err = set.AddAll(indicators)
 			}
-			h.printHTTPResponse(resp, dnsCache)
-		} else {
-			// Parse as HTTP request
-			req, err := http.ReadRequest(buf)
 			if err != nil {
-				// If we get an error, wait for more data and try again
-				// But only retry a few times to avoid infinite loops
-				time.Sleep(50 * time.Millisecond)
-				if h.r.Buffer.Len() > buf.Buffered() {
-					// More data arrived, try again
-					continue
-				}
-				// No more data coming, give up on this stream
-				return
+				log.Fatal(err)
 			}
-			h.printHTTPRequest(req, dnsCache)
 		}
+		opts.DNS = true
+		// Hash indicators are matched against whole bodies
+		if hashes, md5Digests := set.Hashes(); hashes {
+			opts.SpoolBodies, opts.HashBodies = true, true
+			opts.HashMD5 = opts.HashMD5 || md5Digests
+		}
+		r := report.NewIOC(os.Stdout, set)
+		if alerter != nil {
+			r.Notify = alerter.Notify
+		}
+		handler = append(handler, r)
 	}
-}
-
-func (h *HTTPStream) printHTTPRequest(req *http.Request, dnsCache *dns.Cache) {
-	dstIP := h.net.Dst().String()
-	dstPort := h.transport.Dst().String()
-	
-	// Use DNS cache for forward DNS, skip RDNS lookups to avoid blocking
-	dstFQDN := ""
-	if fqdn, ok := dnsCache.Get(dstIP); ok {
-		dstFQDN = fqdn
+	if downgrade {
+		floor, err := fingerprint.ParseVersion(tlsFloor)
+		if err != nil {
+			log.Fatalf("-tls-floor: %v", err)
+		}
+		handler = append(handler, report.NewDowngrade(os.Stdout, floor))
 	}
-
-	// Construct full URL with protocol and hostname
-	protocol := "http"
-	if dstPort == "443" || dstPort == "8443" {
-		protocol = "https"
+	if nameMismatch {
+		handler = append(handler, report.NewNameMismatch(os.Stdout))
 	}
-	
-	hostname := req.Host
-	if hostname == "" {
-		if dstFQDN != "" {
-			hostname = dstFQDN
-		} else {
-			hostname = dstIP
-		}
+	if tlsConns {
+		handler = append(handler, report.NewTLSConns(os.Stdout))
 	}
-	
-	if (protocol == "http" && dstPort != "80") || (protocol == "https" && dstPort != "443") {
-		if !strings.Contains(hostname, ":") {
-			hostname = hostname + ":" + dstPort
+	if len(fingerprintFiles) > 0 {
+		list, err := fingerprint.LoadBlocklist(fingerprintFiles...)
+		if err != nil {
+			log.Fatal(err)
 		}
+		handler = append(handler, report.NewFingerprints(os.Stdout, list))
 	}
-	
-	fullURL := fmt.Sprintf("%s://%s%s", protocol, hostname, req.URL.Path)
-	if req.URL.RawQuery != "" {
-		fullURL += "?" + req.URL.RawQuery
+	var ruleSet *rules.Set
+	if len(ruleFiles) > 0 {
+		ruleSet = loadRules(ruleFiles, ruleVars)
+		opts.DNS = true
+		handler = append(handler, report.NewAlerts(os.Stdout, ruleSet))
 	}
-
-	fmt.Printf("\n*********************************\n")
-	fmt.Printf("%s %s (%s)\n", req.Method, fullURL, req.Proto)
-	// Print all headers from the request
-	for name, values := range req.Header {
-		for _, value := range values {
-			fmt.Printf("  %s: %s\n", name, value)
+	if cacheReport {
+		handler = append(handler, report.NewCache(os.Stdout))
+	}
+	if anomalies {
+		handler = append(handler, report.NewAnomalies(os.Stdout))
+	}
+	if beacons {
+		b := report.NewBeacons(os.Stdout)
+		if alerter != nil {
+			b.Notify = alerter.Notify
 		}
+		handler = append(handler, b)
 	}
-	
-	// Debug: Check if there are more headers we might be missing
-	if req.ContentLength > 0 {
-		fmt.Printf("  [Content-Length: %d]\n", req.ContentLength)
+	if scanners {
+		handler = append(handler, report.NewScanners(os.Stdout))
 	}
-
-	if req.Body != nil {
-		body := make([]byte, 1024*1024) // 1MB max
-		n, _ := req.Body.Read(body)
-		if n > 0 {
-			bodyData := body[:n]
-			// Check if the request body is gzipped
-			if req.Header.Get("Content-Encoding") == "gzip" {
-				if decompressed, err := decompressGzip(bodyData); err == nil {
-					fmt.Printf("Request Body (%d bytes, decompressed from gzip):\n%s\n", len(decompressed), string(decompressed))
-				} else {
-					fmt.Printf("Request Body (%d bytes, gzip decompression failed):\n%s\n", n, string(bodyData))
-				}
-			} else {
-				fmt.Printf("Request Body (%d bytes):\n%s\n", n, string(bodyData))
+	if bruteForce {
+		handler = append(handler, report.NewBruteForce(os.Stdout))
+	}
+	if attacks {
+		handler = append(handler, report.NewAttacks(os.Stdout))
+	}
+	var assertions *report.Assertions
+	if len(asserts) > 0 {
+		assertions = report.NewAssertions(os.Stdout, asserts)
+		handler = append(handler, assertions)
+	}
+	if latency {
+		l := report.NewLatency(os.Stdout)
+		l.ASN = asnDB
+		handler = append(handler, l)
+	}
+	var baseline *report.Profile
+	var profiler *report.Profiler
+	if baselinePath != "" || saveProfile != "" {
+		if baselinePath != "" {
+			var err error
+			if baseline, err = profile(baselinePath); err != nil {
+				log.Fatal(err)
 			}
 		}
-		req.Body.Close()
-		fmt.Println("-------")
-	} else {
-		fmt.Println("-------")
+		profiler = report.NewProfiler(strings.Join(files, ", "))
+		handler = append(handler, profiler)
 	}
-}
-
-func (h *HTTPStream) printHTTPResponse(resp *http.Response, dnsCache *dns.Cache) {
-
-	fmt.Printf("%s (%s)\n", resp.Status, resp.Proto)
-	for name, values := range resp.Header {
-		for _, value := range values {
-			fmt.Printf("  %s: %s\n", name, value)
+	if saveBodies != "" {
+		bodies, err := output.NewBodies(saveBodies)
+		if err != nil {
+			log.Fatal(err)
 		}
+		bodies.Err = func(err error) { log.Printf("saving body: %v", err) }
+		handler = append(handler, bodies)
 	}
-
-	if resp.Body != nil {
-		body := make([]byte, 1024*1024) // 1MB max
-		n, _ := resp.Body.Read(body)
-		if n > 0 {
-			bodyData := body[:n]
-			// Check if the response body is gzipped
-			if resp.Header.Get("Content-Encoding") == "gzip" {
-				if decompressed, err := decompressGzip(bodyData); err == nil {
-					fmt.Printf("Response Body (%d bytes, decompressed from gzip):\n%s\n", len(decompressed), string(decompressed))
-				} else {
-					fmt.Printf("Response Body (%d bytes, gzip decompression failed):\n%s\n", n, string(bodyData))
+	if extractBinaries != "" {
+		binaries, err := output.NewBinaries(extractBinaries)
+		if err != nil {
+			log.Fatal(err)
+		}
+		binaries.Err = func(err error) { log.Printf("extracting binary: %v", err) }
+		handler = append(handler, binaries)
+	}
+	var sink *clickhouse.Sink
+	if clickhouseURL != "" {
+		var err error
+		sink, err = clickhouse.New(clickhouse.Config{
+			URL:       clickhouseURL,
+			Table:     clickhouseTable,
+			User:      clickhouseUser,
+			Password:  os.Getenv("CLICKHOUSE_PASSWORD"),
+			BatchSize: clickhouseBatch,
+			Capture:   strings.Join(files, ", "),
+			Create:    clickhouseCreate,
+		})
+		if err != nil {
+			log.Fatalf("ClickHouse: %v", err)
+		}
+		handler = append(handler, sink)
+	}
+	var producer *kafka.Producer
+	if kafkaBrokers != "" {
+		var err error
+		producer, err = kafka.New(kafka.Config{
+			Brokers:  strings.Split(kafkaBrokers, ","),
+			Topic:    kafkaTopic,
+			TLS:      kafkaTLS,
+			CAFile:   kafkaCA,
+			CertFile: kafkaCert,
+			KeyFile:  kafkaKey,
+			Insecure: kafkaInsecure,
+			SASL:     kafkaSASL,
+			User:     kafkaUser,
+			Password: os.Getenv("KAFKA_PASSWORD"),
+			Capture:  strings.Join(files, ", "),
+			MaxBody:  kafkaMaxBody,
+		})
+		if err != nil {
+			log.Fatalf("Kafka: %v", err)
+		}
+		handler = append(handler, producer)
+	}
+	var exporter *otlp.Exporter
+	if otlpEndpoint != "" {
+		headers, err := otlp.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			log.Fatalf("OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+		exporter, err = otlp.New(otlp.Config{
+			Endpoint: otlpEndpoint,
+			Headers:  headers,
+			Service:  otlpService,
+			Capture:  strings.Join(files, ", "),
+		})
+		if err != nil {
+			log.Fatalf("-otlp: %v", err)
+		}
+		handler = append(handler, exporter)
+	}
+	var sqliteDB *sqlite.DB
+	if sqlitePath != "" {
+		for _, file := range files {
+			if in, err := os.Stat(file); err == nil {
+				if out, err := os.Stat(sqlitePath); err == nil && os.SameFile(in, out) {
+					log.Fatalf("-sqlite %s would overwrite the capture being read", sqlitePath)
 				}
-			} else {
-				fmt.Printf("Response Body (%d bytes):\n%s\n", n, string(bodyData))
 			}
 		}
-		resp.Body.Close()
+		opts.DNS = true
+		var err error
+		if sqliteDB, err = sqlite.Open(sqlitePath, strings.Join(files, ", ")); err != nil {
+			log.Fatalf("-sqlite: %v", err)
+		}
+		handler = append(handler, sqliteDB)
+	}
+	var notifier *webhook.Notifier
+	if len(webhooks) > 0 {
+		var err error
+		notifier, err = newNotifier(webhooks, webhookFilters, ruleSet)
+		if err != nil {
+			log.Fatalf("-webhook: %v", err)
+		}
+		handler = append(handler, notifier)
+	} else if len(webhookFilters) > 0 {
+		log.Fatal("-webhook-filter needs -webhook")
+	}
+	var metrics *tsdb.Sink
+	if tsdbURL != "" {
+		var err error
+		metrics, err = tsdb.New(tsdb.Config{
+			URL:      tsdbURL,
+			Format:   tsdbFormat,
+			Interval: tsdbInterval,
+			Tags:     map[string]string{"capture": strings.Join(files, ", ")},
+			User:     tsdbUser,
+			Password: os.Getenv("TSDB_PASSWORD"),
+			Token:    os.Getenv("TSDB_TOKEN"),
+		})
+		if err != nil {
+			log.Fatalf("-tsdb: %v", err)
+		}
+		handler = append(handler, metrics)
+	}
+	// Everything printed or saved goes through redacted
+	redacted := func(h output.Handler) output.Handler { return h }
+	if redact || len(redactHeaders) > 0 || len(redactFields) > 0 || len(redactPatterns) > 0 {
+		rules := output.DefaultRedactRules
+		rules.Headers = append(rules.Headers[:len(rules.Headers):len(rules.Headers)], redactHeaders...)
+		rules.Fields = append(rules.Fields[:len(rules.Fields):len(rules.Fields)], redactFields...)
+		rules.Patterns = append(rules.Patterns[:len(rules.Patterns):len(rules.Patterns)], redactPatterns...)
+		redacted = func(h output.Handler) output.Handler { return output.NewRedact(h, rules) }
+		handler = output.Multi{redacted(handler)}
+	}
+	// Secrets and credentials are looked for in the traffic as captured;
+	// the reports mask or leave out the values themselves
+	if secrets || len(secretPatterns) > 0 {
+		handler = append(handler, report.NewSecrets(os.Stdout, secretPatterns))
+	}
+	if cleartext {
+		c := report.NewCleartext(os.Stdout)
+		if alerter != nil {
+			c.Notify = alerter.Notify
+		}
+		handler = append(handler, c)
+	}
+	var flows *output.FlowSet
+	if pcapOut != nil && extract == nil {
+		flows = output.NewFlowSet()
+		handler = append(handler, flows)
+	}
+	if filterExpr != "" {
+		handler = output.Multi{output.NewFilter(handler, eventFilter)}
+	}
+	if extract != nil {
+		// The transaction is found whether or not -filter prints it
+		handler = append(handler, extract)
+	}
+	// The files and servers written to filter events themselves, and are
+	// redacted like what is printed
+	var exports output.Multi
+	var harWriter *har.Writer
+	if harOut != nil {
+		// Filtered here rather than by -filter, which would let through
+		// the response of a transaction without its request
+		harWriter = har.NewWriter(harOut, "pcap-analyzer")
+		h := output.NewHAR(harWriter)
+		h.Filter = eventFilter
+		exports = append(exports, h)
+	}
+	var parquetOut *output.Parquet
+	if parquetDir != "" {
+		// Filtered here for the same reason as -har
+		if parquetOut, err = output.NewParquet(parquetDir); err != nil {
+			log.Fatalf("-parquet: %v", err)
+		}
+		parquetOut.Capture = strings.Join(files, ", ")
+		parquetOut.Filter = eventFilter
+		exports = append(exports, parquetOut)
+	}
+	var syslogOut *syslog.Writer
+	if syslogAddr != "" {
+		// Filtered here for the same reason as -har
+		facility, err := syslog.Facility(syslogFacility)
+		if err != nil {
+			log.Fatalf("-syslog-facility: %v", err)
+		}
+		severity, err := syslog.Severity(syslogSeverity)
+		if err != nil {
+			log.Fatalf("-syslog-severity: %v", err)
+		}
+		syslogOut, err = syslog.New(syslog.Config{
+			Addr:     syslogAddr,
+			Facility: facility,
+			Severity: severity,
+			Insecure: syslogInsecure,
+			Capture:  strings.Join(files, ", "),
+		})
+		if err != nil {
+			log.Fatalf("-syslog: %v", err)
+		}
+		syslogOut.Filter = eventFilter
+		exports = append(exports, syslogOut)
 	}
-}
-
-func (h *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
-	srcIP := net.Src().String()
-	dstIP := net.Dst().String()
-	srcPort := transport.Src().String()
-	dstPort := transport.Dst().String()
-		
-	hstream := &HTTPStream{
-		net:       net,
-		transport: transport,
-		r: tcpReader{
-			ident:    fmt.Sprintf("%s:%s->%s:%s", srcIP, dstIP, srcPort, dstPort),
-			isClient: false, // Not used anymore - content-based detection
-		},
-	}
-	hstream.r.parent = hstream
-
-	go hstream.run(h.dnsCache)
-
-	return &hstream.r
-}
-
-func (t *tcpReader) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
-	length, _ := sg.Lengths()
-	data := sg.Fetch(length)
-	t.Buffer.Write(data)
-}
-
-func (t *tcpReader) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	// Signal that reassembly is complete
-	// This allows any waiting HTTP parsers to process remaining data
-	return false
-}
-
-func (t *tcpReader) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, seq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
-	return true
-}
-
-func main() {
-	var pcapFile string
-	var enableDNS bool
-	flag.StringVar(&pcapFile, "file", "", "Path to pcap file")
-	flag.BoolVar(&enableDNS, "d", false, "Enable DNS analysis")
-	flag.BoolVar(&enableDNS, "dns", false, "Enable DNS analysis")
-	flag.Parse()
 
-	if pcapFile == "" {
-		log.Fatal("Please provide a pcap file using -file flag")
+	if len(exports) > 0 {
+		handler = append(handler, redacted(exports))
 	}
 
-	handle, err := pcap.OpenOffline(pcapFile)
+	prof, err := startProfiling(pprofAddr, cpuProfile, memProfile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer handle.Close()
 
-	dnsCache := dns.NewCache()
-
-	streamFactory := &tcpStreamFactory{
-		dnsCache: dnsCache,
+	var reporter *benchReporter
+	if bench {
+		reporter = startBench(os.Stderr, opts.Stats)
 	}
-	streamPool := reassembly.NewStreamPool(streamFactory)
-	assembler := reassembly.NewAssembler(streamPool)
-
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-
-	for packet := range packetSource.Packets() {
-		if enableDNS {
-			dns.ParsePacket(packet, dnsCache)
-		}
-
-		if tcp := packet.Layer(layers.LayerTypeTCP); tcp != nil {
-			tcpLayer := tcp.(*layers.TCP)
-			
-			// Get port information for filtering
-			srcPort := tcpLayer.SrcPort.String()
-			dstPort := tcpLayer.DstPort.String()
-			
-			// Only process TCP streams that might contain HTTP traffic
-			// Skip obvious non-HTTP ports but be more permissive
-			isHTTPPort := func(port string) bool {
-				switch port {
-				case "80", "8080", "8000", "8888", "3000", "5000", "9000":
-					return true // Common HTTP ports
-				case "443", "8443":
-					return true // HTTPS ports (we'll filter TLS later)
-				case "22", "23", "25", "53", "110", "143", "993", "995":
-					return false // Definitely not HTTP
-				default:
-					return true // Unknown ports - let content detection decide
+	// The progress bar redraws one line, so keep it away from the bench
+	// report and from logs that aren't terminals
+	var progress *progressReporter
+	if !noProgress && !bench && isTerminal(os.Stderr) {
+		var total int64
+		for _, file := range files {
+			if objstore.IsURL(file) {
+				if size, err := objstore.Size(file); err == nil {
+					total += size
 				}
+			} else if info, err := os.Stat(file); err == nil {
+				total += info.Size()
 			}
-			
-			if isHTTPPort(srcPort) || isHTTPPort(dstPort) {
-				assembler.AssembleWithContext(
-					packet.NetworkLayer().NetworkFlow(),
-					tcpLayer,
-					&Context{
-						CaptureInfo: packet.Metadata().CaptureInfo,
-					})
+		}
+		progress = startProgress(os.Stderr, opts.Stats, total)
+	}
+	if err := analyzer.RunFiles(files, parallel, opts, handler); err != nil {
+		log.Fatal(err)
+	}
+	if progress != nil {
+		progress.stop()
+	}
+	if sink != nil {
+		err := sink.Close()
+		inserted, failed := sink.Inserted()
+		log.Printf("Inserted %d rows into ClickHouse table %s", inserted, sink.Table())
+		if err != nil {
+			log.Fatalf("ClickHouse: %v (%d rows lost)", err, failed)
+		}
+	}
+	if producer != nil {
+		err := producer.Close()
+		sent, failed := producer.Counts()
+		log.Printf("Published %d HTTP transactions to Kafka topic %s", sent, producer.Topic())
+		if err != nil {
+			log.Fatalf("Kafka: %v (%d transactions lost)", err, failed)
+		}
+	}
+	if exporter != nil {
+		err := exporter.Close()
+		exported, failed := exporter.Exported()
+		log.Printf("Exported %d HTTP transactions as spans to %s", exported, exporter.Endpoint())
+		if err != nil {
+			log.Fatalf("OTLP: %v (%d spans lost)", err, failed)
+		}
+	}
+	if sqliteDB != nil {
+		err := sqliteDB.Close()
+		if err != nil {
+			log.Fatalf("-sqlite: %v", err)
+		}
+		c := sqliteDB.Counts()
+		log.Printf("Wrote %d requests, %d responses, %d DNS messages and %d flows to %s", c.Requests, c.Responses, c.DNS, c.Flows, sqlitePath)
+	}
+	if notifier != nil {
+		closeNotifier(notifier)
+	}
+	if alerter != nil {
+		err := alerter.Close()
+		sent, failed := alerter.Counts()
+		log.Printf("Sent %d alerts (%d failed)", sent, failed)
+		if err != nil {
+			log.Printf("alerts: %v", err)
+		}
+	}
+	if metrics != nil {
+		n, err := metrics.Write()
+		if err != nil {
+			log.Fatalf("-tsdb: %v (%d points written)", err, n)
+		}
+		log.Printf("Wrote %d points to %s", n, tsdbURL)
+	}
+	if harWriter != nil {
+		err := harWriter.Close()
+		if err == nil {
+			err = harOut.Close()
+		}
+		if err != nil {
+			log.Fatalf("-har: %v", err)
+		}
+		log.Printf("Wrote %d HTTP transactions to %s", harWriter.Entries(), harPath)
+	}
+	if parquetOut != nil {
+		err := parquetOut.Close()
+		rows, written := parquetOut.Written()
+		if err != nil {
+			log.Fatalf("-parquet: %v", err)
+		}
+		log.Printf("Wrote %d HTTP transactions to %d Parquet files under %s", rows, len(written), parquetDir)
+	}
+	if syslogOut != nil {
+		err := syslogOut.Close()
+		sent, dropped := syslogOut.Counts()
+		log.Printf("Sent %d HTTP transactions to syslog at %s", sent, syslogOut.Addr())
+		if err != nil {
+			log.Fatalf("-syslog: %v (%d messages lost)", err, dropped)
+		}
+		if dropped > 0 {
+			log.Printf("-syslog: %d messages dropped while the server fell behind", dropped)
+		}
+	}
+	if flows != nil {
+		w := bufio.NewWriter(pcapOut)
+		n, err := analyzer.WritePackets(files, w, flows.Keep)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = pcapOut.Close()
+		}
+		if err != nil {
+			log.Fatalf("-write-pcap: %v", err)
+		}
+		log.Printf("Wrote %d packets of %d connections and DNS messages to %s", n, flows.Len(), writePcap)
+	}
+	if extract != nil {
+		if !extract.Found() {
+			log.Fatalf("-extract: no transaction %s in %s", extractID, files[0])
+		}
+		w := bufio.NewWriter(pcapOut)
+		n, err := analyzer.WritePackets(files, w, extract.Keep)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = pcapOut.Close()
+		}
+		if err != nil {
+			log.Fatalf("-write-pcap: %v", err)
+		}
+		if n == 0 {
+			log.Fatalf("-extract: no packets of %s in %s", extractID, files[0])
+		}
+		log.Printf("Wrote %d packets of %s to %s", n, extractID, writePcap)
+	}
+	if profiler != nil {
+		current := profiler.Profile()
+		if saveProfile != "" {
+			if err := current.Save(saveProfile); err != nil {
+				log.Fatal(err)
 			}
 		}
+		if baseline != nil {
+			fmt.Printf("\n=== Baseline Comparison ===\n")
+			report.WriteDiff(os.Stdout, baseline, current)
+		}
+	}
+	if reporter != nil {
+		reporter.stop()
+	}
+	if err := prof.stop(); err != nil {
+		log.Fatal(err)
+	}
+	if assertions != nil && assertions.Failed() > 0 {
+		os.Exit(1)
 	}
-
-	// Flush remaining data and wait for parsers to complete
-	assembler.FlushAll()
-	time.Sleep(500 * time.Millisecond) // Give parsers time to process final data
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// TestMain runs the command itself when the test binary is run again with
+// PCAP_ANALYZER_MAIN set, so that tests can check what a command line does.
+func TestMain(m *testing.M) {
+	if os.Getenv("PCAP_ANALYZER_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and returns what it printed, failing the
+// test if it fails.
+func run(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "PCAP_ANALYZER_MAIN=1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("pcap-analyzer %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return string(out)
+}
+
+// secrets are what secretCapture sends that -redact removes.
+var secrets = []string{"hunter2", "abc123", "Bearer s3cr3t", "alice@example.com"}
+
+// secretCapture writes a capture of a request and response carrying
+// credentials and an email address, returning its path.
+func secretCapture(t *testing.T) string {
+	t.Helper()
+	b := testutil.NewBuilder()
+	b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80",
+		"GET /login?password=hunter2 HTTP/1.1\r\nHost: example.com\r\nCookie: session=abc123\r\nAuthorization: Bearer s3cr3t\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 30\r\n\r\nsigned in as alice@example.com")
+	path := filepath.Join(t.TempDir(), "secrets.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkRedacted fails the test if out holds any of the secrets.
+func checkRedacted(t *testing.T, what, out string) {
+	t.Helper()
+	for _, s := range secrets {
+		if strings.Contains(out, s) {
+			t.Errorf("%s: found %q despite -redact", what, s)
+		}
+	}
+}
+
+func TestRedactHAR(t *testing.T) {
+	capture := secretCapture(t)
+	har := func(args ...string) string {
+		path := filepath.Join(t.TempDir(), "out.har")
+		run(t, append(append(args, "-har", path), capture)...)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	plain := har()
+	for _, s := range secrets {
+		if !strings.Contains(plain, s) {
+			t.Fatalf("HAR file without -redact is missing %q:\n%s", s, plain)
+		}
+	}
+	checkRedacted(t, "HAR file", har("-redact"))
+}
+
+func TestRedactParquet(t *testing.T) {
+	capture := secretCapture(t)
+	// The values of the columns of every row written
+	rows := func(args ...string) string {
+		dir := t.TempDir()
+		run(t, append(append(args, "-parquet", dir), capture)...)
+		paths, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*.parquet"))
+		if len(paths) == 0 {
+			t.Fatal("no Parquet files written")
+		}
+		var values strings.Builder
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, _ := f.Stat()
+			pf, err := parquet.OpenFile(f, info.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := parquet.NewReader(pf)
+			buf := make([]parquet.Row, 16)
+			for {
+				n, err := r.ReadRows(buf)
+				for _, row := range buf[:n] {
+					for _, v := range row {
+						values.WriteString(v.String() + "\n")
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		return values.String()
+	}
+	plain := rows()
+	for _, s := range []string{"hunter2", "abc123", "Bearer s3cr3t"} {
+		if !strings.Contains(plain, s) {
+			t.Fatalf("Parquet files without -redact are missing %q:\n%s", s, plain)
+		}
+	}
+	checkRedacted(t, "Parquet files", rows("-redact"))
+}
+
+func TestRedactSyslog(t *testing.T) {
+	capture := secretCapture(t)
+	// The messages a syslog server is sent
+	messages := func(args ...string) string {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		run(t, append(append(args, "-syslog", "udp://"+conn.LocalAddr().String()), capture)...)
+		var msgs strings.Builder
+		buf := make([]byte, 64<<10)
+		for {
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			msgs.Write(buf[:n])
+		}
+		return msgs.String()
+	}
+	plain := messages()
+	if !strings.Contains(plain, "hunter2") {
+		t.Fatalf("syslog messages without -redact are missing the password:\n%s", plain)
+	}
+	checkRedacted(t, "syslog messages", messages("-redact"))
+}
+
+func TestRedactDaemon(t *testing.T) {
+	capture := secretCapture(t)
+	// The messages the daemon's syslog sink sends with redact set to
+	// section, or left out if it is empty
+	messages := func(section string) string {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		config := fmt.Sprintf(`{"file": %q, "syslog": {"addr": "udp://%s"}`, capture, conn.LocalAddr())
+		if section != "" {
+			config += `, "redact": ` + section
+		}
+		path := filepath.Join(t.TempDir(), "sensor.json")
+		if err := os.WriteFile(path, []byte(config+"}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		run(t, "daemon", "-config", path)
+		var msgs strings.Builder
+		buf := make([]byte, 64<<10)
+		for {
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			msgs.Write(buf[:n])
+		}
+		return msgs.String()
+	}
+	plain := messages("")
+	if !strings.Contains(plain, "hunter2") {
+		t.Fatalf("syslog messages without redact are missing the password:\n%s", plain)
+	}
+	checkRedacted(t, "syslog messages", messages("{}"))
+	if msgs := messages(`{"patterns": ["example\\.com"]}`); strings.Contains(msgs, "example.com") {
+		t.Errorf("syslog messages hold a name matching a redact pattern:\n%s", msgs)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// applyConstantMemory replaces the bounds in opts with those of
+// analyzer.ConstantMemory, except where a flag was given explicitly.
+func applyConstantMemory(opts *analyzer.Options) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	bounds := analyzer.ConstantMemory()
+	if !set["max-stream-memory"] {
+		opts.MaxStreamMemory = bounds.MaxStreamMemory
+	}
+	if !set["idle-timeout"] {
+		opts.IdleTimeout = bounds.IdleTimeout
+	}
+	if !set["flush-interval"] {
+		opts.FlushInterval = bounds.FlushInterval
+	}
+	if !set["dns-cache-size"] {
+		opts.DNSCacheSize = bounds.DNSCacheSize
+	}
+	if !set["max-buffered-pages"] {
+		opts.MaxBufferedPagesTotal = bounds.MaxBufferedPagesTotal
+	}
+	if !set["max-buffered-pages-per-conn"] {
+		opts.MaxBufferedPagesPerConnection = bounds.MaxBufferedPagesPerConnection
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/pcap-analyzer/internal/metrics"
+)
+
+// serveMetrics serves c on /metrics at addr until the process exits.
+func serveMetrics(addr string, c *metrics.Collector) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			log.Printf("metrics server: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics", lis.Addr())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+const progressWidth = 30
+
+// progressReporter redraws a single status line showing how much of the
+// capture file has been read.
+type progressReporter struct {
+	w     io.Writer
+	stats *analyzer.Stats
+	total int64
+	start time.Time
+	done  chan struct{}
+	exit  chan struct{}
+}
+
+func startProgress(w io.Writer, stats *analyzer.Stats, total int64) *progressReporter {
+	p := &progressReporter{
+		w:     w,
+		stats: stats,
+		total: total,
+		start: time.Now(),
+		done:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressReporter) run() {
+	defer close(p.exit)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.render()
+		}
+	}
+}
+
+func (p *progressReporter) render() {
+	read := p.stats.InputBytes.Load()
+	if read > p.total {
+		read = p.total
+	}
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(read) / float64(p.total)
+	}
+
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+
+	eta := "--"
+	if elapsed := time.Since(p.start); read > 0 && read < p.total {
+		remaining := time.Duration(float64(elapsed) * float64(p.total-read) / float64(read))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	fmt.Fprintf(p.w, "\r[%s] %5.1f%%  %s / %s  %d packets  ETA %s   ",
+		bar, fraction*100, formatBytes(uint64(read)), formatBytes(uint64(p.total)),
+		p.stats.Packets.Load(), eta)
+}
+
+// stop draws the final state and ends the line.
+func (p *progressReporter) stop() {
+	close(p.done)
+	<-p.exit
+	p.render()
+	fmt.Fprintln(p.w)
+}
+
+// isTerminal reports whether f is attached to a terminal rather than a
+// file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
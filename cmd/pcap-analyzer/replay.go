@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pcap-analyzer/internal/filter"
+	"github.com/pcap-analyzer/internal/replay"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// safeMethods are replayed without -unsafe, since sending them again
+// shouldn't change anything on the target.
+var safeMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true}
+
+// runReplay implements "pcap-analyzer replay".
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var setHeaders, dropHeaders, replacements, compareHeaders, ignoreFields stringList
+	target := fs.String("target", "", "Base URL to send requests to, such as https://staging.example.com")
+	expr := fs.String("filter", "", "Only replay requests matching this filter expression, such as 'host == \"*.example.com\" and status < 500'")
+	unsafe := fs.Bool("unsafe", false, "Also replay methods other than GET, HEAD and OPTIONS, which may change data on the target")
+	limit := fs.Int("limit", 0, "Replay at most this many requests (0 = all)")
+	rate := fs.Float64("rate", 0, "Requests sent per second at most (0 = no limit)")
+	concurrency := fs.Int("concurrency", 1, "Requests in flight at once")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time allowed for each request")
+	insecure := fs.Bool("insecure", false, "Don't verify the target's TLS certificate")
+	keepHost := fs.Bool("keep-host", false, "Send the captured Host header instead of the target's")
+	fs.Var(&setHeaders, "header", "Set a request header, such as 'Authorization: Bearer TOKEN'; may be repeated")
+	fs.Var(&dropHeaders, "drop-header", "Remove this request header, such as Cookie; may be repeated")
+	fs.Var(&replacements, "replace", "Replace text in request URIs and header values, as old=new; may be repeated")
+	fs.Var(&compareHeaders, "compare-header", "Also compare this response header; may be repeated")
+	fs.Var(&ignoreFields, "ignore-field", "Leave this JSON key out of body comparisons, such as timestamp; may be repeated")
+	verbose := fs.Bool("v", false, "List every request replayed, not only those that differ")
+	k6Script := fs.String("k6", "", "Write the requests as a k6 load-test script to this file instead of sending them; -target is then optional")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer replay -target URL [flags] capture.pcap\n")
+		fmt.Fprintf(fs.Output(), "       pcap-analyzer replay -k6 script.js [flags] capture.pcap\n")
+		fmt.Fprintf(fs.Output(), "Sends the captured HTTP requests to a live target and compares its responses with the captured ones.\n")
+		fmt.Fprintf(fs.Output(), "Exits with status 1 if any response differs or fails.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *target == "" && *k6Script == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var u *url.URL
+	if *target != "" {
+		var err error
+		u, err = url.Parse(*target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("invalid -target %q: want a URL such as https://staging.example.com", *target)
+		}
+	}
+	f, err := filter.Compile(*expr)
+	if err != nil {
+		log.Fatalf("invalid -filter: %v", err)
+	}
+
+	rules := replay.Rules{KeepHost: *keepHost, Set: http.Header{}, Drop: dropHeaders}
+	for _, h := range setHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			log.Fatalf("invalid -header %q: want 'Name: value'", h)
+		}
+		rules.Set.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for _, r := range replacements {
+		old, new, ok := strings.Cut(r, "=")
+		if !ok || old == "" {
+			log.Fatalf("invalid -replace %q: want old=new", r)
+		}
+		rules.Replace = append(rules.Replace, replay.Replacement{Old: old, New: new})
+	}
+
+	results, err := analyzer.AnalyzeFile(fs.Arg(0), analyzer.Options{DNS: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var txs []analyzer.Transaction
+	skipped := 0
+	for _, tx := range results.Transactions {
+		switch {
+		case tx.Request == nil:
+			continue
+		case tx.Response != nil && !f.MatchResponse(tx.Response), tx.Response == nil && !f.MatchRequest(tx.Request):
+			continue
+		case !*unsafe && !safeMethods[tx.Request.Method], tx.Request.Truncated():
+			skipped++
+			continue
+		}
+		if *limit > 0 && len(txs) == *limit {
+			break
+		}
+		txs = append(txs, tx)
+	}
+	if skipped > 0 {
+		log.Printf("Skipping %d requests that change data or whose bodies weren't captured in full; -unsafe replays the former", skipped)
+	}
+	if *k6Script != "" {
+		writeK6(*k6Script, fs.Arg(0), txs, replay.K6Config{Target: u, Rules: rules, Timeout: *timeout, Insecure: *insecure, Source: filepath.Base(fs.Arg(0))})
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	replayed := replay.Replay(ctx, txs, replay.Config{
+		Target:       u,
+		Rules:        rules,
+		Rate:         *rate,
+		Concurrency:  *concurrency,
+		Timeout:      *timeout,
+		Insecure:     *insecure,
+		Compare:      compareHeaders,
+		IgnoreFields: ignoreFields,
+	})
+	replay.Write(os.Stdout, u.String(), replayed, *verbose)
+	if s := replay.Summarize(replayed); s.Differed > 0 || s.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeK6 writes txs to path as a k6 script.
+func writeK6(path, input string, txs []analyzer.Transaction, cfg replay.K6Config) {
+	if in, err := os.Stat(input); err == nil {
+		if out, err := os.Stat(path); err == nil && os.SameFile(in, out) {
+			log.Fatalf("-k6 %s would overwrite the capture", path)
+		}
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := replay.WriteK6(out, txs, cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+	var first, last time.Time
+	for _, tx := range txs {
+		if first.IsZero() || tx.Time().Before(first) {
+			first = tx.Time()
+		}
+		if tx.Time().After(last) {
+			last = tx.Time()
+		}
+	}
+	span := last.Sub(first)
+	log.Printf("Wrote k6 script of %d requests spanning %s to %s", len(txs), span.Round(time.Millisecond), path)
+}
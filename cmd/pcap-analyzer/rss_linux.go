@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// peakRSS returns the process's maximum resident set size in bytes.
+func peakRSS() uint64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return uint64(ru.Maxrss) * 1024 // kilobytes on Linux
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import "runtime"
+
+// peakRSS approximates the process's peak memory with what the Go runtime
+// has obtained from the OS, since resident set size is not available here.
+func peakRSS() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/internal/sanitize"
+)
+
+// runSanitize implements "pcap-analyzer sanitize".
+func runSanitize(args []string) {
+	fs := flag.NewFlagSet("sanitize", flag.ExitOnError)
+	var redactHeaders, redactFields stringList
+	var redactPatterns regexpList
+	payload := fs.String("payload", sanitize.PayloadRedact, "What to do with payloads: keep, redact (mask credentials, cookies, emails and card numbers), headers (keep only HTTP headers, redacted) or zero")
+	mapFile := fs.String("map", "", "Write each original address and its replacement to this CSV file, to translate findings on the shared capture back")
+	fs.Var(&redactHeaders, "redact-header", "Also mask the values of this header; may be repeated")
+	fs.Var(&redactFields, "redact-field", "Also mask this query, form or JSON field; may be repeated")
+	fs.Var(&redactPatterns, "redact-pattern", "Also mask whatever this regular expression matches; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer sanitize [flags] capture.pcap sanitized.pcap\n")
+		fmt.Fprintf(fs.Output(), "Writes a copy of a capture with addresses remapped, MAC addresses randomized and payloads redacted.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	rules := output.DefaultRedactRules
+	rules.Headers = append(rules.Headers[:len(rules.Headers):len(rules.Headers)], redactHeaders...)
+	rules.Fields = append(rules.Fields[:len(rules.Fields):len(rules.Fields)], redactFields...)
+	rules.Patterns = append(rules.Patterns[:len(rules.Patterns):len(rules.Patterns)], redactPatterns...)
+	s, err := sanitize.File(fs.Arg(0), fs.Arg(1), sanitize.Options{Payload: *payload, Redact: rules})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *mapFile != "" {
+		if err := writeAddressMap(*mapFile, s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	st := s.Stats()
+	fmt.Fprintf(os.Stderr, "Sanitized %d packets into %s: %d addresses remapped, %d MAC addresses randomized, payloads %s\n",
+		st.Packets, fs.Arg(1), st.Addresses, st.MACs, payloadDone[*payload])
+}
+
+// payloadDone says what each payload mode did, for the summary.
+var payloadDone = map[string]string{
+	sanitize.PayloadKeep:    "kept",
+	sanitize.PayloadRedact:  "redacted",
+	sanitize.PayloadHeaders: "cut to their HTTP headers",
+	sanitize.PayloadZero:    "zeroed",
+}
+
+func writeAddressMap(path string, s *sanitize.Sanitizer) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "original,sanitized")
+	s.Mapping(func(original, sanitized net.IP) {
+		fmt.Fprintf(w, "%s,%s\n", original, sanitized)
+	})
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
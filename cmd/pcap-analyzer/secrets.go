@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pcap-analyzer/internal/report"
+)
+
+// secretPatternList is a repeatable flag.Value collecting -secret-pattern
+// expressions.
+type secretPatternList []report.SecretPattern
+
+func (l *secretPatternList) String() string {
+	var s []string
+	for _, p := range *l {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l *secretPatternList) Set(value string) error {
+	p, err := report.ParseSecretPattern(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, p)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pcap-analyzer/internal/server"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// runServe implements "pcap-analyzer serve".
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var allow stringList
+	maxUpload := byteSize(1 << 30)
+	maxStreamMemory := byteSize(16 << 20)
+	addr := fs.String("addr", "localhost:8080", "Address to listen on")
+	dir := fs.String("data", filepath.Join(os.TempDir(), "pcap-analyzer"), "Directory uploaded captures are stored in")
+	jobs := fs.Int("jobs", 1, "How many analysis jobs run at once")
+	fs.Var(&allow, "allow", "Allow captures in this directory to be analyzed in place by path; may be repeated")
+	fs.Var(&maxUpload, "max-upload", "Largest capture accepted for upload, e.g. 2GB (0 = no limit)")
+	fs.Var(&maxStreamMemory, "max-stream-memory", "Reassembled payload kept in memory per stream before spilling to disk")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap-analyzer serve [flags] [capture.pcap ...]\n")
+		fmt.Fprintf(fs.Output(), "Serves a web UI and an HTTP API for uploading captures, analyzing them and fetching the results as JSON.\n")
+		fmt.Fprintf(fs.Output(), "Captures named on the command line are analyzed right away.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	s, err := server.New(server.Config{
+		Dir:       *dir,
+		Allow:     allow,
+		MaxUpload: int64(maxUpload),
+		Jobs:      *jobs,
+		Options:   analyzer.Options{MaxStreamMemory: int(maxStreamMemory)},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, path := range fs.Args() {
+		c, err := s.Add(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := s.Start(c.ID, true); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Serving the UI on http://%s/ and the API under /api/", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
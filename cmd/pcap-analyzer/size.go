@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value accepting sizes such as "512KB", "16MB" or
+// "2GB". Plain numbers are bytes.
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+func (s *byteSize) String() string {
+	v := int64(*s)
+	for _, u := range sizeUnits[:3] {
+		if v != 0 && v%u.scale == 0 {
+			return fmt.Sprintf("%d%s", v/u.scale, u.suffix)
+		}
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	scale := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*s = byteSize(n * scale)
+	return nil
+}
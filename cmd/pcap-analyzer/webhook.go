@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pcap-analyzer/internal/rules"
+	"github.com/pcap-analyzer/internal/webhook"
+)
+
+// loadRules loads -rules files with the -rule-var values given as
+// NAME=VALUE.
+func loadRules(files, ruleVars []string) *rules.Set {
+	vars := make(map[string]string)
+	for _, v := range ruleVars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			log.Fatalf("-rule-var %q: want NAME=VALUE", v)
+		}
+		vars[strings.TrimPrefix(name, "$")] = value
+	}
+	set, err := rules.Load(vars, files...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return set
+}
+
+// newNotifier returns the handler for -webhook, signing with
+// $WEBHOOK_SECRET if it is set.
+func newNotifier(urls, filters []string, set *rules.Set) (*webhook.Notifier, error) {
+	return webhook.New(webhook.Config{
+		URLs:    urls,
+		Filters: filters,
+		Rules:   set,
+		Secret:  os.Getenv("WEBHOOK_SECRET"),
+	})
+}
+
+// closeNotifier waits for the notifications still queued and logs how
+// many were posted.
+func closeNotifier(n *webhook.Notifier) {
+	err := n.Close()
+	sent, failed, dropped := n.Counts()
+	log.Printf("Posted %d webhook notifications (%d failed, %d dropped)", sent, failed, dropped)
+	if err != nil {
+		log.Printf("-webhook: %v", err)
+	}
+}
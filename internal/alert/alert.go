@@ -0,0 +1,236 @@
+// Package alert sends detection findings, such as indicator matches,
+// cleartext credentials and beaconing, to Slack and by email, for teams
+// without a SIEM to collect them. Messages are rendered from a template and
+// rate limited so that a noisy capture doesn't flood the channel.
+package alert
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pcap-analyzer/internal/report"
+)
+
+// DefaultTemplate renders a finding when no template is given. The first
+// line of a message is the subject of its email.
+const DefaultTemplate = `[{{.Kind}}] {{.Summary}}
+{{.Detail}}
+Seen {{.Time.UTC.Format "2006-01-02 15:04:05"}} UTC in {{.Capture}}
+`
+
+// Defaults of Config.
+const (
+	DefaultRate     = 10
+	DefaultCooldown = time.Hour
+)
+
+// queueSize is how many messages may wait to be sent.
+const queueSize = 256
+
+// Config describes where findings are sent and how often.
+type Config struct {
+	// SlackURL is a Slack incoming webhook.
+	SlackURL string
+	// SMTP, if its Addr is set, sends findings by email.
+	SMTP SMTP
+	// Template is a text/template rendering a Message; empty means
+	// DefaultTemplate.
+	Template string
+	// Rate is how many findings are sent per minute at most, in bursts of
+	// up to as many; zero means DefaultRate.
+	Rate int
+	// Cooldown is how long the same finding isn't sent again for; zero
+	// means DefaultCooldown.
+	Cooldown time.Duration
+	// Capture names what was analyzed, for the messages.
+	Capture string
+}
+
+// Message is what a template renders: a finding and the capture it was
+// made in.
+type Message struct {
+	report.Finding
+	Capture string
+}
+
+// sender delivers one rendered message.
+type sender interface {
+	send(subject, text string) error
+}
+
+// Alerter receives findings with Notify and sends them on a goroutine of
+// its own. Findings beyond the rate, or repeating one sent within the
+// cooldown, are suppressed; Close sends a count of them.
+type Alerter struct {
+	cfg     Config
+	tmpl    *template.Template
+	senders []sender
+	queue   chan Message
+	done    chan struct{}
+
+	mu         sync.Mutex
+	tokens     float64
+	refilled   time.Time
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+	dropped    int
+	closed     bool
+
+	// Set by the sending goroutine, and read once it has finished
+	sent, failed int
+	err          error
+}
+
+// New parses cfg's template and starts sending.
+func New(cfg Config) (*Alerter, error) {
+	if cfg.Template == "" {
+		cfg.Template = DefaultTemplate
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = DefaultRate
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultCooldown
+	}
+	tmpl, err := template.New("alert").Parse(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	a := &Alerter{
+		cfg:        cfg,
+		tmpl:       tmpl,
+		queue:      make(chan Message, queueSize),
+		done:       make(chan struct{}),
+		tokens:     float64(cfg.Rate),
+		refilled:   time.Now(),
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	if cfg.SlackURL != "" {
+		s, err := newSlack(cfg.SlackURL)
+		if err != nil {
+			return nil, err
+		}
+		a.senders = append(a.senders, s)
+	}
+	if cfg.SMTP.Addr != "" {
+		s, err := newMailer(cfg.SMTP)
+		if err != nil {
+			return nil, err
+		}
+		a.senders = append(a.senders, s)
+	}
+	if len(a.senders) == 0 {
+		return nil, fmt.Errorf("no Slack webhook or SMTP server to alert through")
+	}
+	go a.sendAll()
+	return a, nil
+}
+
+// Notify queues f to be sent unless it is suppressed. It never blocks, so
+// it can be a report's FindingFunc.
+func (a *Alerter) Notify(f report.Finding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	now := time.Now()
+	key := f.Kind + " " + f.Key
+	if last, ok := a.lastSent[key]; ok && now.Sub(last) < a.cfg.Cooldown {
+		return
+	}
+	a.tokens += now.Sub(a.refilled).Minutes() * float64(a.cfg.Rate)
+	a.tokens = min(a.tokens, float64(a.cfg.Rate))
+	a.refilled = now
+	if a.tokens < 1 {
+		a.suppressed[f.Kind]++
+		return
+	}
+	select {
+	case a.queue <- Message{Finding: f, Capture: a.cfg.Capture}:
+		a.tokens--
+		a.lastSent[key] = now
+	default:
+		a.dropped++
+	}
+}
+
+// Close sends a count of the findings suppressed, if any, and waits for
+// every message to be sent; findings after Close are ignored. It returns
+// the first send that failed.
+func (a *Alerter) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		if len(a.suppressed) > 0 || a.dropped > 0 {
+			a.queue <- Message{Finding: a.digest(), Capture: a.cfg.Capture}
+		}
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return a.err
+}
+
+// digest is the finding that counts those suppressed. a.mu must be held.
+func (a *Alerter) digest() report.Finding {
+	total := a.dropped
+	var kinds []string
+	for kind, n := range a.suppressed {
+		total += n
+		kinds = append(kinds, fmt.Sprintf("%d %s", n, kind))
+	}
+	sort.Strings(kinds)
+	if a.dropped > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d dropped while sending fell behind", a.dropped))
+	}
+	return report.Finding{
+		Kind:    "summary",
+		Time:    time.Now(),
+		Summary: fmt.Sprintf("%d more findings were not sent to stay within %d per minute", total, a.cfg.Rate),
+		Detail:  strings.Join(kinds, ", "),
+	}
+}
+
+// Counts returns how many messages were sent and how many failed. It is
+// only valid after Close.
+func (a *Alerter) Counts() (sent, failed int) {
+	return a.sent, a.failed
+}
+
+func (a *Alerter) sendAll() {
+	defer close(a.done)
+	for m := range a.queue {
+		var b bytes.Buffer
+		if err := a.tmpl.Execute(&b, m); err != nil {
+			a.fail(fmt.Errorf("template: %w", err))
+			continue
+		}
+		text := strings.TrimSpace(b.String())
+		subject, _, _ := strings.Cut(text, "\n")
+		var err error
+		for _, s := range a.senders {
+			if e := s.send(subject, text); e != nil && err == nil {
+				err = e
+			}
+		}
+		if err != nil {
+			a.fail(err)
+			continue
+		}
+		a.sent++
+	}
+}
+
+func (a *Alerter) fail(err error) {
+	a.failed++
+	if a.err == nil {
+		a.err = err
+	}
+}
@@ -0,0 +1,138 @@
+package alert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each post to Slack.
+const requestTimeout = 10 * time.Second
+
+// slack posts messages to an incoming webhook.
+type slack struct {
+	url    string
+	client *http.Client
+}
+
+func newSlack(webhook string) (*slack, error) {
+	if u, err := url.Parse(webhook); err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("%q is not a Slack webhook URL", webhook)
+	}
+	return &slack{url: webhook, client: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+func (s *slack) send(subject, text string) error {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SMTP describes the mail server findings are sent through.
+type SMTP struct {
+	// Addr is the server's host:port. Port 465 is spoken TLS from the
+	// start; other ports are upgraded with STARTTLS when the server offers
+	// it.
+	Addr string
+	From string
+	To   []string
+	// User and Password log in with PLAIN authentication when User is set,
+	// which is only done over TLS or to localhost.
+	User, Password string
+}
+
+type mailer struct {
+	cfg  SMTP
+	host string
+}
+
+func newMailer(cfg SMTP) (*mailer, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP server %q: %w", cfg.Addr, err)
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("email alerts need a sender and at least one recipient")
+	}
+	return &mailer{cfg: cfg, host: host}, nil
+}
+
+func (m *mailer) send(subject, text string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+
+	var auth smtp.Auth
+	if m.cfg.User != "" {
+		auth = smtp.PlainAuth("", m.cfg.User, m.cfg.Password, m.host)
+	}
+	if _, port, _ := net.SplitHostPort(m.cfg.Addr); port != "465" {
+		if err := smtp.SendMail(m.cfg.Addr, auth, m.cfg.From, m.cfg.To, msg.Bytes()); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+		return nil
+	}
+	if err := m.sendTLS(auth, msg.Bytes()); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return nil
+}
+
+// sendTLS sends msg over a connection that is TLS from the start.
+func (m *mailer) sendTLS(auth smtp.Auth, msg []byte) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: requestTimeout}, "tcp", m.cfg.Addr, &tls.Config{ServerName: m.host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,179 @@
+// Package asn maps IP addresses to the autonomous system and organization
+// that announce them, from a MaxMind-format database or an offline table.
+package asn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what is known about the network an address belongs to.
+type Info struct {
+	// ASN is the autonomous system number, or zero if the source only
+	// names the network.
+	ASN uint
+	Org string
+}
+
+func (i Info) String() string {
+	switch {
+	case i.ASN == 0:
+		return i.Org
+	case i.Org == "":
+		return fmt.Sprintf("AS%d", i.ASN)
+	default:
+		return fmt.Sprintf("AS%d %s", i.ASN, i.Org)
+	}
+}
+
+// DB looks addresses up in one of the supported sources.
+type DB struct {
+	mmdb *maxminddb.Reader
+	// ranges are sorted by start and don't overlap.
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start, end net.IP // 16-byte forms
+	info       Info
+}
+
+// Open loads path, which is either a MaxMind DB such as GeoLite2-ASN.mmdb,
+// recognised by its .mmdb extension, or a text table. Table lines hold
+// either a CIDR, an AS number and an organization separated by commas, as
+// in
+//
+//	3.208.0.0/12,14618,AWS us-east-1
+//
+// or the tab-separated start address, end address, AS number, country and
+// description of the ip2asn tables. Blank lines and lines starting with #
+// are ignored, and an AS number of 0 means the network isn't announced.
+// Ranges in a table must not overlap.
+func Open(path string) (*DB, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &DB{mmdb: r}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, ok, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if ok {
+			db.ranges = append(db.ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+// parseLine parses one table line. Unannounced ranges are skipped.
+func parseLine(line string) (ipRange, bool, error) {
+	var r ipRange
+	var asn string
+	if fields := strings.Split(line, "\t"); len(fields) >= 5 {
+		r.start, r.end = net.ParseIP(fields[0]).To16(), net.ParseIP(fields[1]).To16()
+		if r.start == nil || r.end == nil {
+			return r, false, fmt.Errorf("bad address range %q - %q", fields[0], fields[1])
+		}
+		asn, r.info.Org = fields[2], fields[4]
+	} else {
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) != 3 {
+			return r, false, fmt.Errorf("want CIDR,ASN,organization")
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return r, false, err
+		}
+		r.start, r.end = rangeOf(network)
+		asn, r.info.Org = strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2])
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+	if err != nil {
+		return r, false, fmt.Errorf("bad AS number %q", asn)
+	}
+	r.info.ASN = uint(n)
+	if r.info.ASN == 0 && (r.info.Org == "" || r.info.Org == "Not routed") {
+		return r, false, nil
+	}
+	return r, true, nil
+}
+
+// rangeOf returns the first and last addresses of network in 16-byte form.
+func rangeOf(network *net.IPNet) (net.IP, net.IP) {
+	start := network.IP.To16()
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		// The 16-byte form of an IPv4 address has a fixed 12-byte prefix
+		mask = append(net.IPMask(bytes.Repeat([]byte{0xff}, 12)), mask...)
+	}
+	end := make(net.IP, net.IPv6len)
+	for i := range end {
+		end[i] = start[i] | ^mask[i]
+	}
+	return start, end
+}
+
+// Lookup returns what is known about ip, which is an address in text form.
+func (db *DB) Lookup(ip string) (Info, bool) {
+	addr := net.ParseIP(ip)
+	if db == nil || addr == nil {
+		return Info{}, false
+	}
+	if db.mmdb != nil {
+		var record struct {
+			ASN uint   `maxminddb:"autonomous_system_number"`
+			Org string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := db.mmdb.Lookup(addr, &record); err != nil || record.ASN == 0 && record.Org == "" {
+			return Info{}, false
+		}
+		return Info{ASN: record.ASN, Org: record.Org}, true
+	}
+
+	addr = addr.To16()
+	// The last range starting at or before addr is the only candidate
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, addr) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(addr, db.ranges[i].end) > 0 {
+		return Info{}, false
+	}
+	return db.ranges[i].info, true
+}
+
+// Close releases the database.
+func (db *DB) Close() error {
+	if db != nil && db.mmdb != nil {
+		return db.mmdb.Close()
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Package broker fans parsed events out to gRPC subscribers, each with its
+// own filter expression.
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pcap-analyzer/internal/filter"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/events"
+)
+
+// DefaultBuffer is how many events are queued per subscriber when New is
+// given zero.
+const DefaultBuffer = 1024
+
+// Broker is an analyzer.Handler that serves the events it is handed to the
+// subscribers of the Events service. Events are queued for each subscriber
+// whose filter they match; when a subscriber's queue is full further events
+// are dropped rather than holding up the capture, and the count is reported
+// on the next event it receives.
+type Broker struct {
+	events.UnimplementedEventsServer
+
+	buffer int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	subs map[*subscriber]struct{}
+	// done is closed once the capture has ended.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type subscriber struct {
+	filter  *filter.Filter
+	bodies  bool
+	maxBody int
+	events  chan *events.Event
+	dropped atomic.Uint64
+}
+
+// New returns a Broker queueing up to buffer events per subscriber.
+func New(buffer int) *Broker {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	b := &Broker{
+		buffer: buffer,
+		subs:   make(map[*subscriber]struct{}),
+		done:   make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Close ends every subscription once its queued events have been sent.
+// It is called when the capture ends, after the last event.
+func (b *Broker) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// WaitSubscribers blocks until at least n clients are subscribed.
+func (b *Broker) WaitSubscribers(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.subs) < n {
+		b.cond.Wait()
+	}
+}
+
+// Subscribers returns how many clients are subscribed.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Subscribe implements events.EventsServer.
+func (b *Broker) Subscribe(req *events.SubscribeRequest, stream events.Events_SubscribeServer) error {
+	f, err := filter.Compile(req.GetFilter())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "filter: %v", err)
+	}
+	select {
+	case <-b.done:
+		return status.Error(codes.Unavailable, "the capture has ended")
+	default:
+	}
+
+	s := &subscriber{
+		filter:  f,
+		bodies:  req.GetBodies(),
+		maxBody: int(req.GetMaxBodySize()),
+		events:  make(chan *events.Event, b.buffer),
+	}
+	if s.maxBody == 0 {
+		s.maxBody = defaultMaxBody
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}()
+
+	send := func(ev *events.Event) error {
+		ev.Dropped = s.dropped.Swap(0)
+		return stream.Send(ev)
+	}
+	for {
+		select {
+		case ev := <-s.events:
+			if err := send(ev); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-b.done:
+			// No more events will be published, so what is queued is all
+			// there is left
+			for {
+				select {
+				case ev := <-s.events:
+					if err := send(ev); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// HandleRequest implements analyzer.Handler.
+func (b *Broker) HandleRequest(req *analyzer.Request) {
+	b.publish(func(s *subscriber) *events.Event {
+		if !s.filter.MatchRequest(req) {
+			return nil
+		}
+		return requestEvent(req, s.body())
+	})
+}
+
+// HandleResponse implements analyzer.Handler.
+func (b *Broker) HandleResponse(resp *analyzer.Response) {
+	b.publish(func(s *subscriber) *events.Event {
+		if !s.filter.MatchResponse(resp) {
+			return nil
+		}
+		return responseEvent(resp, s.body())
+	})
+}
+
+// HandleDNS implements analyzer.Handler.
+func (b *Broker) HandleDNS(msg *analyzer.DNSMessage) {
+	b.publish(func(s *subscriber) *events.Event {
+		if !s.filter.MatchDNS(msg) {
+			return nil
+		}
+		return dnsEvent(msg)
+	})
+}
+
+// publish queues the event convert builds for each subscriber, skipping
+// those it returns nil for.
+func (b *Broker) publish(convert func(s *subscriber) *events.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		ev := convert(s)
+		if ev == nil {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// body returns how much of each body the subscriber wants, or -1 for none.
+func (s *subscriber) body() int {
+	if !s.bodies {
+		return -1
+	}
+	return s.maxBody
+}
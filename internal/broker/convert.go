@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/events"
+)
+
+// defaultMaxBody is how much of a body is sent when the subscriber asks for
+// bodies without a limit.
+const defaultMaxBody = 64 << 10
+
+// requestEvent converts req, with up to maxBody bytes of its body; a
+// negative maxBody leaves the body out.
+func requestEvent(req *analyzer.Request, maxBody int) *events.Event {
+	return &events.Event{
+		Time: timestamppb.New(req.Timestamp),
+		Message: &events.Event_Request{Request: &events.HTTPRequest{
+			Flow:     flow(req.Flow),
+			Method:   req.Method,
+			Url:      req.URL,
+			Uri:      req.URI,
+			Host:     req.Host,
+			Proto:    req.Proto,
+			Headers:  headers(req.Header),
+			BodySize: req.BodySize,
+			Body:     body(req.Body, maxBody),
+		}},
+	}
+}
+
+// responseEvent converts resp like requestEvent.
+func responseEvent(resp *analyzer.Response, maxBody int) *events.Event {
+	r := &events.HTTPResponse{
+		Flow:       flow(resp.Flow),
+		StatusCode: int32(resp.StatusCode),
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+		Headers:    headers(resp.Header),
+		BodySize:   resp.BodySize,
+		Body:       body(resp.Body, maxBody),
+	}
+	if req := resp.Request; req != nil {
+		r.Method = req.Method
+		r.Url = req.URL
+		r.Latency = durationpb.New(resp.Timestamp.Sub(req.Timestamp))
+	}
+	return &events.Event{
+		Time:    timestamppb.New(resp.Timestamp),
+		Message: &events.Event_Response{Response: r},
+	}
+}
+
+func dnsEvent(msg *analyzer.DNSMessage) *events.Event {
+	m := &events.DNSMessage{
+		SrcIp:    msg.SrcIP,
+		DstIp:    msg.DstIP,
+		Response: msg.Response,
+		Question: msg.Question,
+		Qtype:    msg.QType,
+		Rcode:    msg.Rcode,
+	}
+	for _, a := range msg.Answers {
+		m.Answers = append(m.Answers, &events.DNSRecord{Type: a.Type, Name: a.Name, Value: a.Value})
+	}
+	return &events.Event{
+		Time:    timestamppb.New(msg.Timestamp),
+		Message: &events.Event_Dns{Dns: m},
+	}
+}
+
+func flow(f httpstream.Flow) *events.Flow {
+	return &events.Flow{
+		SrcIp:   f.SrcIP,
+		SrcPort: portNumber(f.SrcPort),
+		DstIp:   f.DstIP,
+		DstPort: portNumber(f.DstPort),
+	}
+}
+
+func portNumber(p string) uint32 {
+	n, _ := strconv.ParseUint(p, 10, 16)
+	return uint32(n)
+}
+
+// headers returns h sorted by name, so events are stable across runs.
+func headers(h http.Header) []*events.Header {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*events.Header, len(names))
+	for i, name := range names {
+		out[i] = &events.Header{Name: name, Values: h[name]}
+	}
+	return out
+}
+
+// body copies up to max bytes of b, since the message may be gone by the
+// time the event is sent.
+func body(b []byte, max int) []byte {
+	if max < 0 || len(b) == 0 {
+		return nil
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return append([]byte(nil), b...)
+}
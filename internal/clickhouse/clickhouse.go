@@ -0,0 +1,413 @@
+// Package clickhouse inserts requests, responses and DNS messages into a
+// ClickHouse table, in batches over the server's HTTP interface.
+package clickhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+const (
+	// DefaultTable is the table rows go to when none is named.
+	DefaultTable = "pcap_events"
+	// DefaultBatchSize is how many rows an insert carries by default.
+	DefaultBatchSize = 10000
+)
+
+// requestTimeout bounds each request to the server.
+const requestTimeout = 2 * time.Minute
+
+// retries is how many times an insert the server couldn't take, or that
+// never reached it, is attempted again.
+const retries = 3
+
+// tableName matches a table name, optionally qualified by its database.
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Schema returns the statement creating a table the rows fit. Tables of
+// other shapes work too: columns the rows lack take their defaults, and
+// fields the table lacks are skipped.
+func Schema(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+    time         DateTime64(9, 'UTC'),
+    capture      LowCardinality(String),
+    type         LowCardinality(String),
+    id           String,
+    src_ip       String,
+    src_port     UInt16,
+    dst_ip       String,
+    dst_port     UInt16,
+    method       LowCardinality(String),
+    url          String,
+    host         LowCardinality(String),
+    proto        LowCardinality(String),
+    status       UInt16,
+    content_type LowCardinality(String),
+    user_agent   String,
+    body_size    UInt64,
+    latency_ms   Float64,
+    headers      Map(String, String),
+    name         String,
+    qtype        LowCardinality(String),
+    rcode        LowCardinality(String),
+    answers      Array(String)
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMM(time)
+ORDER BY (type, time)`
+}
+
+// Config describes where rows are inserted.
+type Config struct {
+	// URL is the server's HTTP interface, such as http://localhost:8123.
+	URL string
+	// Table is the table inserted into, optionally qualified by its
+	// database. Empty means DefaultTable.
+	Table string
+	// User and Password authenticate with the server when User is set.
+	User, Password string
+	// BatchSize is how many rows each insert carries; zero means
+	// DefaultBatchSize.
+	BatchSize int
+	// Capture fills the capture column of every row, telling the rows of
+	// different runs apart.
+	Capture string
+	// Create creates the table with Schema if it doesn't exist.
+	Create bool
+	// FlushInterval, if set, inserts the rows buffered this often even
+	// when the batch isn't full, so that a long-running capture with little
+	// traffic still shows up.
+	FlushInterval time.Duration
+}
+
+// row is one event as inserted, a JSONEachRow line. Requests and DNS
+// messages leave the other's columns empty; responses repeat the method,
+// URL and host of the request they answer.
+type row struct {
+	Time        string            `json:"time"`
+	Capture     string            `json:"capture"`
+	Type        string            `json:"type"`
+	ID          string            `json:"id"`
+	SrcIP       string            `json:"src_ip"`
+	SrcPort     uint16            `json:"src_port"`
+	DstIP       string            `json:"dst_ip"`
+	DstPort     uint16            `json:"dst_port"`
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	Host        string            `json:"host"`
+	Proto       string            `json:"proto"`
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	UserAgent   string            `json:"user_agent"`
+	BodySize    int64             `json:"body_size"`
+	LatencyMs   float64           `json:"latency_ms"`
+	Headers     map[string]string `json:"headers"`
+	Name        string            `json:"name"`
+	QType       string            `json:"qtype"`
+	Rcode       string            `json:"rcode"`
+	Answers     []string          `json:"answers"`
+}
+
+// Sink is a handler inserting every event it receives. Rows are buffered
+// until a batch is full; Close inserts the rest. Batches are inserted by a
+// goroutine of their own, one at a time, while the next one fills.
+type Sink struct {
+	cfg    Config
+	client *http.Client
+	table  string
+
+	mu     sync.Mutex
+	buf    *bytes.Buffer
+	rows   int
+	closed bool
+
+	batches chan batch
+	done    chan struct{}
+	// Set by the inserting goroutine, and read once it has finished
+	inserted int64
+	failed   int64
+	err      error
+}
+
+type batch struct {
+	data []byte
+	rows int
+}
+
+// New checks that the table exists, creating it if cfg asks, and returns a
+// Sink inserting into it.
+func New(cfg Config) (*Sink, error) {
+	if cfg.Table == "" {
+		cfg.Table = DefaultTable
+	}
+	if !tableName.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("%q is not a table name", cfg.Table)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not the URL of a ClickHouse HTTP interface", cfg.URL)
+	}
+	s := &Sink{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: requestTimeout},
+		table:   cfg.Table,
+		buf:     new(bytes.Buffer),
+		batches: make(chan batch, 1),
+		done:    make(chan struct{}),
+	}
+	if cfg.Create {
+		if _, err := s.query(Schema(s.table), nil, nil); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", s.table, err)
+		}
+	}
+	exists, err := s.query("EXISTS TABLE "+s.table, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(exists)) != "1" {
+		return nil, fmt.Errorf("table %s doesn't exist; create it, or pass -clickhouse-create", s.table)
+	}
+	go s.insertAll()
+	if cfg.FlushInterval > 0 {
+		go s.flushEvery(cfg.FlushInterval)
+	}
+	return s, nil
+}
+
+func (s *Sink) flushEvery(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		closed := s.closed
+		if !closed {
+			s.flush()
+		}
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+func (s *Sink) HandleRequest(req *httpstream.Request) {
+	r := s.httpRow("request", &req.Message)
+	r.Method, r.URL, r.Host = req.Method, req.URL, req.Host
+	r.UserAgent = req.Header.Get("User-Agent")
+	s.add(r)
+}
+
+func (s *Sink) HandleResponse(resp *httpstream.Response) {
+	r := s.httpRow("response", &resp.Message)
+	r.Status = resp.StatusCode
+	if req := resp.Request; req != nil {
+		r.Method, r.URL, r.Host = req.Method, req.URL, req.Host
+		r.UserAgent = req.Header.Get("User-Agent")
+		r.LatencyMs = float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+	}
+	s.add(r)
+}
+
+func (s *Sink) HandleDNS(msg *dns.Message) {
+	r := &row{
+		Time:    timestamp(msg.Timestamp),
+		Capture: s.cfg.Capture,
+		Type:    "dns",
+		SrcIP:   msg.SrcIP,
+		DstIP:   msg.DstIP,
+		Name:    strings.TrimSuffix(msg.Question, "."),
+		QType:   msg.QType,
+		Rcode:   msg.Rcode,
+		Answers: []string{},
+		Headers: map[string]string{},
+	}
+	for _, a := range msg.Answers {
+		r.Answers = append(r.Answers, strings.TrimSuffix(a.Value, "."))
+	}
+	s.add(r)
+}
+
+func (s *Sink) httpRow(typ string, m *httpstream.Message) *row {
+	r := &row{
+		Time:        timestamp(m.Timestamp),
+		Capture:     s.cfg.Capture,
+		Type:        typ,
+		ID:          m.ID(),
+		SrcIP:       m.SrcIP,
+		SrcPort:     port(m.SrcPort),
+		DstIP:       m.DstIP,
+		DstPort:     port(m.DstPort),
+		Proto:       m.Proto,
+		ContentType: m.Header.Get("Content-Type"),
+		BodySize:    m.BodySize,
+		Headers:     make(map[string]string, len(m.Header)),
+		Answers:     []string{},
+	}
+	for name, values := range m.Header {
+		r.Headers[name] = strings.Join(values, ", ")
+	}
+	return r
+}
+
+// timestamp formats t as DateTime64 columns parse it.
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000000")
+}
+
+func port(p string) uint16 {
+	n, _ := strconv.ParseUint(p, 10, 16)
+	return uint16(n)
+}
+
+func (s *Sink) add(r *row) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.buf.Write(line)
+	s.buf.WriteByte('\n')
+	s.rows++
+	if s.rows >= s.cfg.BatchSize {
+		s.flush()
+	}
+}
+
+// flush hands the buffered rows to the inserting goroutine, waiting while
+// it is still busy with the batch before. s.mu must be held.
+func (s *Sink) flush() {
+	if s.rows == 0 {
+		return
+	}
+	s.batches <- batch{data: s.buf.Bytes(), rows: s.rows}
+	s.buf = new(bytes.Buffer)
+	s.rows = 0
+}
+
+// Close inserts the rows still buffered and waits for every insert to
+// finish. Rows handled after Close are discarded. It returns the first
+// insert that failed; the other batches are inserted regardless.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	s.flush()
+	s.closed = true
+	close(s.batches)
+	s.mu.Unlock()
+	<-s.done
+	return s.err
+}
+
+// Inserted returns how many rows were inserted and how many were lost to
+// failed inserts. It is only valid after Close.
+func (s *Sink) Inserted() (inserted, failed int64) {
+	return s.inserted, s.failed
+}
+
+// Table returns the table rows are inserted into.
+func (s *Sink) Table() string {
+	return s.table
+}
+
+func (s *Sink) insertAll() {
+	defer close(s.done)
+	insert := "INSERT INTO " + s.table + " FORMAT JSONEachRow"
+	settings := url.Values{"input_format_skip_unknown_fields": {"1"}}
+	for b := range s.batches {
+		var body bytes.Buffer
+		zw := gzip.NewWriter(&body)
+		zw.Write(b.data)
+		zw.Close()
+		if _, err := s.query(insert, body.Bytes(), settings); err != nil {
+			s.failed += int64(b.rows)
+			if s.err == nil {
+				s.err = fmt.Errorf("inserting into %s: %w", s.table, err)
+			}
+			continue
+		}
+		s.inserted += int64(b.rows)
+	}
+}
+
+// query runs q, with gzipped data as the rows of an insert or else as the
+// body of the request itself, and returns the result. Requests that fail
+// to reach the server, or that it is too busy for, are retried.
+func (s *Sink) query(q string, data []byte, settings url.Values) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var result []byte
+		var retry bool
+		result, retry, err = s.do(q, data, settings)
+		if err == nil || !retry {
+			return result, err
+		}
+	}
+	return nil, err
+}
+
+func (s *Sink) do(q string, data []byte, settings url.Values) (result []byte, retry bool, err error) {
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return nil, false, err
+	}
+	params := u.Query()
+	for k, v := range settings {
+		params[k] = v
+	}
+	body := io.Reader(strings.NewReader(q))
+	if data != nil {
+		params.Set("query", q)
+		body = bytes.NewReader(data)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, false, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.cfg.User != "" {
+		req.SetBasicAuth(s.cfg.User, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	result, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(result))
+		if len(msg) > 500 {
+			msg = msg[:500] + "..."
+		}
+		busy := resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		return nil, busy, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return result, false, nil
+}
@@ -0,0 +1,130 @@
+// Package dga scores domain names for signs of having been generated by an
+// algorithm, as malware does to find its command and control servers among
+// thousands of candidate names.
+package dga
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// words is the corpus the character model is learned from: common English
+// and technical words, one per line.
+//
+//go:embed words.txt
+var words string
+
+// alphabet holds the characters of a label, with ^ and $ marking its start
+// and end.
+const alphabet = "^$abcdefghijklmnopqrstuvwxyz0123456789-"
+
+// minLabel is the shortest label scored; shorter ones hold too few
+// characters to tell chance from design.
+const minLabel = 8
+
+// model holds the natural log-probability of each character following
+// another in words.
+var model = train(words)
+
+func train(corpus string) [][]float64 {
+	n := len(alphabet)
+	counts := make([][]float64, n)
+	for i := range counts {
+		counts[i] = make([]float64, n)
+	}
+	for _, w := range strings.Fields(corpus) {
+		prev := 0
+		for _, c := range []byte(w + "$") {
+			i := strings.IndexByte(alphabet, c)
+			if i < 0 {
+				break
+			}
+			counts[prev][i]++
+			prev = i
+		}
+	}
+	// Add-half smoothing, so characters never seen together, such as
+	// digits, are unlikely rather than impossible
+	for _, row := range counts {
+		var total float64
+		for _, c := range row {
+			total += c + 0.5
+		}
+		for j, c := range row {
+			row[j] = math.Log((c + 0.5) / total)
+		}
+	}
+	return counts
+}
+
+// Score describes how random a domain name looks.
+type Score struct {
+	// Label is the part of the name scored: the one left of its public
+	// suffix, such as "example" for www.example.co.uk. Subdomains are left
+	// out, since CDNs and trackers fill them with hashes.
+	Label string
+	// Entropy is the Shannon entropy of the label in bits per character.
+	Entropy float64
+	// Bigram is the mean log-probability of each character of the label
+	// following the one before under the model; readable labels score
+	// above -3 and random letters near -4.5.
+	Bigram float64
+	// Value combines the above into a number from 0, readable, to 1,
+	// random.
+	Value float64
+}
+
+// Threshold is the Value above which a name is taken to be generated.
+const Threshold = 0.5
+
+// Analyze scores name. It returns false for names it can't judge: those
+// not under a known public suffix, reverse lookups, internationalized
+// names, names under hosting providers' suffixes and labels shorter than 8
+// characters.
+func Analyze(name string) (Score, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	if !icann || strings.HasSuffix(name, ".arpa") {
+		// Unknown top-level domains, and hosting providers' suffixes such
+		// as cloudfront.net, under which names are made up by the provider
+		return Score{}, false
+	}
+	registered, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return Score{}, false
+	}
+	label := strings.TrimSuffix(registered, "."+suffix)
+	if len(label) < minLabel || strings.HasPrefix(label, "xn--") {
+		return Score{}, false
+	}
+
+	s := Score{Label: label}
+	freq := make(map[byte]int)
+	var logProb float64
+	prev := 0
+	for _, c := range []byte(label + "$") {
+		i := strings.IndexByte(alphabet, c)
+		if i < 0 {
+			return Score{}, false
+		}
+		logProb += model[prev][i]
+		prev = i
+		if c == '$' {
+			break
+		}
+		freq[c]++
+	}
+	for _, n := range freq {
+		p := float64(n) / float64(len(label))
+		s.Entropy -= p * math.Log2(p)
+	}
+	s.Bigram = logProb / float64(len(label)+1)
+	// Mostly the bigram score, which separates readable labels from random
+	// ones far better than entropy; names of dictionary words, as some
+	// families generate, score as readable
+	s.Value = 1 / (1 + math.Exp(-(4*(-s.Bigram-4.3) + 1.5*(s.Entropy-3.2))))
+	return s, true
+}
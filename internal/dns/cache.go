@@ -12,6 +12,10 @@ type Cache struct {
 	mu       sync.RWMutex
 	entries  map[string]string // IP -> FQDN mapping
 	rdnsCache map[string]string // IP -> reverse DNS hostname mapping
+	// max bounds entries, evicting the oldest first; zero means no limit.
+	// order holds the IPs in insertion order when bounded.
+	max   int
+	order []string
 }
 
 func NewCache() *Cache {
@@ -21,9 +25,24 @@ func NewCache() *Cache {
 	}
 }
 
+// NewBoundedCache returns a cache holding at most max addresses. Once full,
+// the oldest address is forgotten for each new one.
+func NewBoundedCache(max int) *Cache {
+	c := NewCache()
+	c.max = max
+	return c
+}
+
 func (c *Cache) Add(ip, fqdn string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if _, ok := c.entries[ip]; !ok && c.max > 0 {
+		if len(c.order) >= c.max {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, ip)
+	}
 	c.entries[ip] = strings.TrimSuffix(fqdn, ".")
 }
 
@@ -34,6 +53,42 @@ func (c *Cache) Get(ip string) (string, bool) {
 	return fqdn, ok
 }
 
+// Trim forgets entries until at most keep remain, oldest first when the
+// cache is bounded. It returns how many were forgotten.
+func (c *Cache) Trim(keep int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for len(c.order) > keep {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+		dropped++
+	}
+	// An unbounded cache keeps no order, so drop arbitrary entries
+	for ip := range c.entries {
+		if len(c.entries) <= keep {
+			break
+		}
+		delete(c.entries, ip)
+		dropped++
+	}
+	if len(c.rdnsCache) > keep {
+		c.rdnsCache = make(map[string]string)
+	}
+	return dropped
+}
+
+// Entries returns a copy of the IP to FQDN mappings.
+func (c *Cache) Entries() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make(map[string]string, len(c.entries))
+	for ip, fqdn := range c.entries {
+		entries[ip] = fqdn
+	}
+	return entries
+}
+
 func (c *Cache) Size() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -63,7 +118,7 @@ func (c *Cache) GetWithRDNS(ip string) string {
 	if err != nil || len(names) == 0 {
 		// Cache negative result to avoid repeated lookups
 		c.mu.Lock()
-		c.rdnsCache[ip] = ""
+		c.addRDNS(ip, "")
 		c.mu.Unlock()
 		return ""
 	}
@@ -73,8 +128,17 @@ func (c *Cache) GetWithRDNS(ip string) string {
 	
 	// Cache the result
 	c.mu.Lock()
-	c.rdnsCache[ip] = hostname
+	c.addRDNS(ip, hostname)
 	c.mu.Unlock()
 	
 	return hostname
 }
+
+// addRDNS records a reverse lookup. A bounded cache starts over when the
+// reverse cache is full, since lookups are cheap to repeat.
+func (c *Cache) addRDNS(ip, hostname string) {
+	if c.max > 0 && len(c.rdnsCache) >= c.max {
+		c.rdnsCache = make(map[string]string)
+	}
+	c.rdnsCache[ip] = hostname
+}
@@ -1,48 +1,71 @@
 package dns
 
 import (
-	"fmt"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/miekg/dns"
 )
 
-func ParsePacket(packet gopacket.Packet, cache *Cache) {
-	if dnsLayer := packet.Layer(layers.LayerTypeDNS); dnsLayer != nil {
-		dnsPacket, _ := dnsLayer.(*layers.DNS)
+// Record is a single answer from a DNS response.
+type Record struct {
+	Type  string
+	Name  string
+	Value string
+}
 
-		msg := new(dns.Msg)
-		if err := msg.Unpack(dnsPacket.Contents); err != nil {
-			return
-		}
+// Message is a DNS query or response seen in the capture.
+type Message struct {
+	Timestamp time.Time
+	SrcIP     string
+	DstIP     string
+	Response  bool
+	Question  string
+	QType     string
+	Answers   []Record
+	// Rcode is the response code of a response, such as NXDOMAIN.
+	Rcode string
+}
 
-		if msg.Response && len(msg.Question) > 0 {
-			question := msg.Question[0].Name
-			fmt.Printf("\n=== DNS Response ===\n")
-			fmt.Printf("Time: %s\n", packet.Metadata().Timestamp.Format(time.RFC3339))
-			fmt.Printf("Query: %s\n", question)
-
-			for _, answer := range msg.Answer {
-				switch rr := answer.(type) {
-				case *dns.A:
-					fmt.Printf("  A Record: %s -> %s\n", rr.Hdr.Name, rr.A.String())
-					cache.Add(rr.A.String(), rr.Hdr.Name)
-				case *dns.AAAA:
-					fmt.Printf("  AAAA Record: %s -> %s\n", rr.Hdr.Name, rr.AAAA.String())
-					cache.Add(rr.AAAA.String(), rr.Hdr.Name)
-				case *dns.CNAME:
-					fmt.Printf("  CNAME Record: %s -> %s\n", rr.Hdr.Name, rr.Target)
-				}
-			}
-		} else if !msg.Response && len(msg.Question) > 0 {
-			question := msg.Question[0].Name
-			qtype := dns.TypeToString[msg.Question[0].Qtype]
+// Handler receives DNS messages as they are parsed.
+type Handler interface {
+	HandleDNS(msg *Message)
+}
 
-			fmt.Printf("\n=== DNS Query ===\n")
-			fmt.Printf("Time: %s\n", packet.Metadata().Timestamp.Format(time.RFC3339))
-			fmt.Printf("Query: %s (Type: %s)\n", question, qtype)
+// Parse decodes a DNS message from a UDP payload captured at ts, adding
+// resolved addresses to cache. It returns nil for payloads that are not
+// DNS messages with a question.
+func Parse(payload []byte, ts time.Time, srcIP, dstIP string, cache *Cache) *Message {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(payload); err != nil {
+		return nil
+	}
+	if len(msg.Question) == 0 {
+		return nil
+	}
+
+	m := &Message{
+		Timestamp: ts,
+		SrcIP:     srcIP,
+		DstIP:     dstIP,
+		Response:  msg.Response,
+		Question:  msg.Question[0].Name,
+		QType:     dns.TypeToString[msg.Question[0].Qtype],
+	}
+
+	if msg.Response {
+		m.Rcode = dns.RcodeToString[msg.Rcode]
+		for _, answer := range msg.Answer {
+			switch rr := answer.(type) {
+			case *dns.A:
+				m.Answers = append(m.Answers, Record{Type: "A", Name: rr.Hdr.Name, Value: rr.A.String()})
+				cache.Add(rr.A.String(), rr.Hdr.Name)
+			case *dns.AAAA:
+				m.Answers = append(m.Answers, Record{Type: "AAAA", Name: rr.Hdr.Name, Value: rr.AAAA.String()})
+				cache.Add(rr.AAAA.String(), rr.Hdr.Name)
+			case *dns.CNAME:
+				m.Answers = append(m.Answers, Record{Type: "CNAME", Name: rr.Hdr.Name, Value: rr.Target})
+			}
 		}
 	}
+	return m
 }
@@ -0,0 +1,108 @@
+// Package filetype recognises executables, scripts and archives by their
+// content rather than by what they are declared to be.
+package filetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+	"strings"
+)
+
+// Type is a kind of file.
+type Type struct {
+	Name string
+	// Ext is the usual file name extension, with its dot.
+	Ext string
+}
+
+// magic are the archive formats told apart by a fixed prefix.
+var magic = []struct {
+	prefix []byte
+	typ    Type
+}{
+	{[]byte("PK\x03\x04"), Type{"zip archive", ".zip"}},
+	{[]byte("\x1f\x8b"), Type{"gzip archive", ".gz"}},
+	{[]byte("BZh"), Type{"bzip2 archive", ".bz2"}},
+	{[]byte("\xfd7zXZ\x00"), Type{"xz archive", ".xz"}},
+	{[]byte("\x28\xb5\x2f\xfd"), Type{"zstd archive", ".zst"}},
+	{[]byte("7z\xbc\xaf\x27\x1c"), Type{"7-zip archive", ".7z"}},
+	{[]byte("Rar!\x1a\x07"), Type{"rar archive", ".rar"}},
+	{[]byte("MSCF\x00\x00\x00\x00"), Type{"cabinet archive", ".cab"}},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), Type{"OLE compound file (MSI, Office)", ".ole"}},
+}
+
+// Detect returns the type of a file starting with head, if it is an
+// executable, script or archive. A few hundred bytes of head are enough.
+func Detect(head []byte) (Type, bool) {
+	switch {
+	case isPE(head):
+		return Type{"PE executable", ".exe"}, true
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return Type{"ELF executable", ".elf"}, true
+	case isMachO(head):
+		return Type{"Mach-O executable", ".macho"}, true
+	case bytes.HasPrefix(head, []byte("#!")):
+		name := interpreter(head)
+		return Type{name + " script", scriptExt(name)}, true
+	case len(head) >= 9 && strings.EqualFold(string(head[:9]), "@echo off"):
+		return Type{"batch script", ".bat"}, true
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return Type{"tar archive", ".tar"}, true
+	}
+	for _, m := range magic {
+		if bytes.HasPrefix(head, m.prefix) {
+			return m.typ, true
+		}
+	}
+	return Type{}, false
+}
+
+// isPE checks for the PE signature the MZ header points at.
+func isPE(b []byte) bool {
+	if len(b) < 0x40 || !bytes.HasPrefix(b, []byte("MZ")) {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(b[0x3c:])
+	return uint64(offset)+4 <= uint64(len(b)) && string(b[offset:offset+4]) == "PE\x00\x00"
+}
+
+func isMachO(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(b) {
+	case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe:
+		return true
+	case 0xcafebabe:
+		// Java class files share the magic of universal binaries, but
+		// carry a version where those have a small architecture count
+		n := binary.BigEndian.Uint32(b[4:])
+		return n > 0 && n < 20
+	}
+	return false
+}
+
+// scriptExt returns the extension of scripts for an interpreter.
+func scriptExt(interpreter string) string {
+	for prefix, ext := range map[string]string{"python": ".py", "perl": ".pl", "ruby": ".rb", "node": ".js", "pwsh": ".ps1"} {
+		if strings.HasPrefix(interpreter, prefix) {
+			return ext
+		}
+	}
+	return ".sh"
+}
+
+// interpreter returns the program a #! line runs, such as "python3".
+func interpreter(b []byte) string {
+	line, _, _ := bytes.Cut(b[2:], []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "shell"
+	}
+	name := path.Base(fields[0])
+	if name == "env" && len(fields) > 1 {
+		name = fields[1]
+	}
+	return name
+}
@@ -0,0 +1,531 @@
+// Package filter compiles expressions selecting HTTP and DNS events, such
+// as
+//
+//	method == POST and host == "*.example.com" and status >= 500
+//	type == dns and (rcode == NXDOMAIN or name matches "^[a-z0-9]{20,}\.")
+//	header.user-agent contains curl or src_ip == 10.0.0.0/8
+//
+// An expression compares fields with ==, !=, <, <=, >, >=, contains and
+// matches (a regular expression), and combines comparisons with and (&&),
+// or (||), not (!) and parentheses. A field on its own is true when the
+// event has it. Host and name fields compare without case and match
+// subdomains with a leading "*."; address fields take CIDR blocks; latency
+// takes durations such as 500ms. A comparison on a field the event doesn't
+// have, such as status on a request, is false.
+package filter
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Filter is a compiled expression. The zero Filter, and a nil one, match
+// every event.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses expr. An empty expression matches every event.
+func Compile(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return &Filter{}, nil
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// MatchRequest reports whether req matches.
+func (f *Filter) MatchRequest(req *httpstream.Request) bool {
+	return f.match(&event{req: req})
+}
+
+// MatchResponse reports whether resp matches. Fields of the request it
+// answers, such as method and url, are those of resp.Request.
+func (f *Filter) MatchResponse(resp *httpstream.Response) bool {
+	return f.match(&event{resp: resp, req: resp.Request})
+}
+
+// MatchDNS reports whether msg matches.
+func (f *Filter) MatchDNS(msg *dns.Message) bool {
+	return f.match(&event{dns: msg})
+}
+
+func (f *Filter) match(e *event) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+	return f.root.eval(e)
+}
+
+// event is what fields are read from: a request, a response and the
+// request it answers, or a DNS message.
+type event struct {
+	req  *httpstream.Request
+	resp *httpstream.Response
+	dns  *dns.Message
+}
+
+// message returns the HTTP message the event is about.
+func (e *event) message() *httpstream.Message {
+	switch {
+	case e.resp != nil:
+		return &e.resp.Message
+	case e.req != nil:
+		return &e.req.Message
+	}
+	return nil
+}
+
+type kind int
+
+const (
+	kindString kind = iota
+	// kindHost strings compare without case, with "*." matching subdomains.
+	kindHost
+	kindNumber
+	kindIP
+	// kindDuration numbers are in nanoseconds.
+	kindDuration
+)
+
+// field reads the values of one field from an event. Fields with several
+// values, such as a repeated header, match when any value does.
+type field struct {
+	kind    kind
+	strings func(e *event) []string
+	numbers func(e *event) []float64
+}
+
+func str(get func(e *event) string) func(e *event) []string {
+	return func(e *event) []string {
+		if s := get(e); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+func num(get func(e *event) (float64, bool)) func(e *event) []float64 {
+	return func(e *event) []float64 {
+		if n, ok := get(e); ok {
+			return []float64{n}
+		}
+		return nil
+	}
+}
+
+func port(p string) (float64, bool) {
+	n, err := strconv.Atoi(p)
+	return float64(n), err == nil
+}
+
+// flow returns the endpoints of the event.
+func (e *event) flow() (srcIP, srcPort, dstIP, dstPort string, ok bool) {
+	if e.dns != nil {
+		return e.dns.SrcIP, "", e.dns.DstIP, "", true
+	}
+	if m := e.message(); m != nil {
+		return m.SrcIP, m.SrcPort, m.DstIP, m.DstPort, true
+	}
+	return "", "", "", "", false
+}
+
+var fields = map[string]field{
+	"type": {kind: kindString, strings: str(func(e *event) string {
+		switch {
+		case e.dns != nil:
+			return "dns"
+		case e.resp != nil:
+			return "response"
+		}
+		return "request"
+	})},
+	"method": {kind: kindString, strings: str(func(e *event) string {
+		if e.req != nil {
+			return e.req.Method
+		}
+		return ""
+	})},
+	"url": {kind: kindString, strings: str(func(e *event) string {
+		if e.req != nil {
+			return e.req.URL
+		}
+		return ""
+	})},
+	"uri": {kind: kindString, strings: str(func(e *event) string {
+		if e.req != nil {
+			return e.req.URI
+		}
+		return ""
+	})},
+	"path": {kind: kindString, strings: str(func(e *event) string {
+		if e.req == nil {
+			return ""
+		}
+		path, _, _ := strings.Cut(e.req.URI, "?")
+		return path
+	})},
+	"host": {kind: kindHost, strings: str(func(e *event) string {
+		if e.req == nil {
+			return ""
+		}
+		if h, _, err := net.SplitHostPort(e.req.Host); err == nil {
+			return h
+		}
+		return e.req.Host
+	})},
+	"proto": {kind: kindString, strings: str(func(e *event) string {
+		if m := e.message(); m != nil {
+			return m.Proto
+		}
+		return ""
+	})},
+	"content_type": {kind: kindString, strings: str(func(e *event) string {
+		if m := e.message(); m != nil {
+			ct, _, _ := strings.Cut(m.Header.Get("Content-Type"), ";")
+			return strings.TrimSpace(ct)
+		}
+		return ""
+	})},
+	"status": {kind: kindNumber, numbers: num(func(e *event) (float64, bool) {
+		if e.resp != nil {
+			return float64(e.resp.StatusCode), true
+		}
+		return 0, false
+	})},
+	"body_size": {kind: kindNumber, numbers: num(func(e *event) (float64, bool) {
+		if m := e.message(); m != nil {
+			return float64(m.BodySize), true
+		}
+		return 0, false
+	})},
+	"latency": {kind: kindDuration, numbers: num(func(e *event) (float64, bool) {
+		if e.resp != nil && e.req != nil {
+			return float64(e.resp.Timestamp.Sub(e.req.Timestamp)), true
+		}
+		return 0, false
+	})},
+	"src_ip": {kind: kindIP, strings: str(func(e *event) string {
+		ip, _, _, _, _ := e.flow()
+		return ip
+	})},
+	"dst_ip": {kind: kindIP, strings: str(func(e *event) string {
+		_, _, ip, _, _ := e.flow()
+		return ip
+	})},
+	"ip": {kind: kindIP, strings: func(e *event) []string {
+		src, _, dst, _, ok := e.flow()
+		if !ok {
+			return nil
+		}
+		return []string{src, dst}
+	}},
+	"src_port": {kind: kindNumber, numbers: num(func(e *event) (float64, bool) {
+		_, p, _, _, _ := e.flow()
+		return port(p)
+	})},
+	"dst_port": {kind: kindNumber, numbers: num(func(e *event) (float64, bool) {
+		_, _, _, p, _ := e.flow()
+		return port(p)
+	})},
+	"port": {kind: kindNumber, numbers: func(e *event) []float64 {
+		var ports []float64
+		_, src, _, dst, _ := e.flow()
+		for _, p := range []string{src, dst} {
+			if n, ok := port(p); ok {
+				ports = append(ports, n)
+			}
+		}
+		return ports
+	}},
+	"name": {kind: kindHost, strings: str(func(e *event) string {
+		if e.dns != nil {
+			return strings.TrimSuffix(e.dns.Question, ".")
+		}
+		return ""
+	})},
+	"qtype": {kind: kindString, strings: str(func(e *event) string {
+		if e.dns != nil {
+			return e.dns.QType
+		}
+		return ""
+	})},
+	"rcode": {kind: kindString, strings: str(func(e *event) string {
+		if e.dns != nil {
+			return e.dns.Rcode
+		}
+		return ""
+	})},
+	"answer": {kind: kindString, strings: func(e *event) []string {
+		if e.dns == nil {
+			return nil
+		}
+		values := make([]string, 0, len(e.dns.Answers))
+		for _, a := range e.dns.Answers {
+			values = append(values, strings.TrimSuffix(a.Value, "."))
+		}
+		return values
+	}},
+}
+
+// headerField reads the values of an HTTP header, as header.<name>.
+func headerField(name string) field {
+	name = http.CanonicalHeaderKey(name)
+	return field{kind: kindString, strings: func(e *event) []string {
+		if m := e.message(); m != nil {
+			return m.Header.Values(name)
+		}
+		return nil
+	}}
+}
+
+func lookupField(name string) (field, error) {
+	name = strings.ToLower(name)
+	if h, ok := strings.CutPrefix(name, "header."); ok && h != "" {
+		return headerField(h), nil
+	}
+	if f, ok := fields[name]; ok {
+		return f, nil
+	}
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return field{}, fmt.Errorf("unknown field %q; fields are %s and header.<name>", name, strings.Join(names, ", "))
+}
+
+// Expression tree
+
+type node interface {
+	eval(e *event) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(e *event) bool { return n.left.eval(e) && n.right.eval(e) }
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(e *event) bool { return n.left.eval(e) || n.right.eval(e) }
+
+type notNode struct{ x node }
+
+func (n notNode) eval(e *event) bool { return !n.x.eval(e) }
+
+// existsNode is a field on its own.
+type existsNode struct{ f field }
+
+func (n existsNode) eval(e *event) bool {
+	if n.f.numbers != nil {
+		return len(n.f.numbers(e)) > 0
+	}
+	return len(n.f.strings(e)) > 0
+}
+
+// compareNode compares a field's values with a literal.
+type compareNode struct {
+	f   field
+	op  string
+	lit string
+	num float64
+	ips []*net.IPNet
+	re  *regexp.Regexp
+}
+
+func (n *compareNode) eval(e *event) bool {
+	if n.f.numbers != nil {
+		values := n.f.numbers(e)
+		if len(values) == 0 {
+			return false
+		}
+		if n.op == "!=" {
+			for _, v := range values {
+				if v == n.num {
+					return false
+				}
+			}
+			return true
+		}
+		for _, v := range values {
+			if n.compareNumber(v) {
+				return true
+			}
+		}
+		return false
+	}
+	values := n.f.strings(e)
+	if len(values) == 0 {
+		return false
+	}
+	if n.op == "!=" {
+		for _, v := range values {
+			if n.equal(v) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if n.compareString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *compareNode) compareNumber(v float64) bool {
+	switch n.op {
+	case "==":
+		return v == n.num
+	case "<":
+		return v < n.num
+	case "<=":
+		return v <= n.num
+	case ">":
+		return v > n.num
+	case ">=":
+		return v >= n.num
+	}
+	return false
+}
+
+func (n *compareNode) equal(v string) bool {
+	switch n.f.kind {
+	case kindHost:
+		v = strings.ToLower(v)
+		if suffix, ok := strings.CutPrefix(n.lit, "*."); ok {
+			return v == suffix || strings.HasSuffix(v, "."+suffix)
+		}
+		return v == n.lit
+	case kindIP:
+		ip := net.ParseIP(v)
+		for _, block := range n.ips {
+			if ip != nil && block.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(v, n.lit)
+}
+
+func (n *compareNode) compareString(v string) bool {
+	switch n.op {
+	case "==":
+		return n.equal(v)
+	case "contains":
+		return strings.Contains(strings.ToLower(v), n.lit)
+	case "matches":
+		return n.re.MatchString(v)
+	}
+	// Ordering strings
+	c := strings.Compare(v, n.lit)
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func newCompare(name, op, lit string) (node, error) {
+	f, err := lookupField(name)
+	if err != nil {
+		return nil, err
+	}
+	n := &compareNode{f: f, op: op, lit: lit}
+	switch {
+	case op == "matches":
+		if f.numbers != nil {
+			return nil, fmt.Errorf("%s is a number and can't be matched against a regular expression", name)
+		}
+		if n.re, err = regexp.Compile(lit); err != nil {
+			return nil, fmt.Errorf("%s matches: %v", name, err)
+		}
+	case op == "contains":
+		if f.numbers != nil {
+			return nil, fmt.Errorf("%s is a number and can't contain text", name)
+		}
+		n.lit = strings.ToLower(lit)
+	case f.kind == kindNumber:
+		if n.num, err = strconv.ParseFloat(lit, 64); err != nil || math.IsNaN(n.num) {
+			return nil, fmt.Errorf("%s %s %q: not a number", name, op, lit)
+		}
+	case f.kind == kindDuration:
+		d, err := time.ParseDuration(lit)
+		if err != nil {
+			ms, perr := strconv.ParseFloat(lit, 64)
+			if perr != nil {
+				return nil, fmt.Errorf("%s %s %q: not a duration such as 500ms", name, op, lit)
+			}
+			d = time.Duration(ms * float64(time.Millisecond))
+		}
+		n.num = float64(d)
+	case f.kind == kindIP:
+		if op != "==" && op != "!=" {
+			return nil, fmt.Errorf("%s can only be compared with == and !=", name)
+		}
+		for _, s := range strings.Split(lit, ",") {
+			block, err := parseBlock(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("%s %s %q: %v", name, op, lit, err)
+			}
+			n.ips = append(n.ips, block)
+		}
+	case f.kind == kindHost:
+		n.lit = strings.ToLower(strings.TrimSuffix(lit, "."))
+	}
+	return n, nil
+}
+
+// parseBlock parses an address or CIDR block.
+func parseBlock(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, block, err := net.ParseCIDR(s)
+		return block, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an address or CIDR block")
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,209 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	// tokString is a quoted literal, which is never taken for a keyword.
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// comparisons are the comparison operators, longest first so that <= is
+// not read as <.
+var comparisons = []string{"==", "!=", "<=", ">=", "<", ">", "="}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokLParen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokRParen, ")"})
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) && (s[j+1] == c || s[j+1] == '\\') {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated string starting at %d", i)
+			}
+			tokens = append(tokens, token{tokString, b.String()})
+			i = j + 1
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, token{tokWord, "and"})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{tokWord, "or"})
+			i += 2
+		case c == '!' && !strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, token{tokWord, "not"})
+			i++
+		default:
+			if op := comparisonAt(s[i:]); op != "" {
+				if op == "=" {
+					tokens = append(tokens, token{tokOp, "=="})
+				} else {
+					tokens = append(tokens, token{tokOp, op})
+				}
+				i += len(op)
+				continue
+			}
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("()\"'!&|", rune(s[j])) && comparisonAt(s[j:]) == "" {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func comparisonAt(s string) string {
+	for _, op := range comparisons {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// parser is a recursive descent parser over the grammar
+//
+//	or      = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | primary
+//	primary = "(" or ")" | field [ op value ]
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// keyword reports whether the next token is the unquoted word kw, and
+// consumes it if so.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t != nil && t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (node, error) {
+	if p.keyword("not") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch {
+	case t.kind == tokLParen:
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.kind != tokRParen {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case t.kind != tokWord:
+		return nil, fmt.Errorf("expected a field, found %q", t.text)
+	}
+
+	name := t.text
+	op := ""
+	if next := p.peek(); next != nil {
+		switch {
+		case next.kind == tokOp:
+			op = next.text
+		case next.kind == tokWord && (strings.EqualFold(next.text, "contains") || strings.EqualFold(next.text, "matches")):
+			op = strings.ToLower(next.text)
+		}
+	}
+	if op == "" {
+		f, err := lookupField(name)
+		if err != nil {
+			return nil, err
+		}
+		return existsNode{f}, nil
+	}
+	p.pos++
+	value := p.peek()
+	if value == nil || (value.kind != tokWord && value.kind != tokString) {
+		return nil, fmt.Errorf("%s %s: missing value", name, op)
+	}
+	p.pos++
+	return newCompare(name, op, value.text)
+}
@@ -0,0 +1,102 @@
+package fingerprint
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Fingerprint kinds.
+const (
+	JA3 = "JA3"
+	JA4 = "JA4"
+)
+
+var (
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern = regexp.MustCompile(`^[tqd](?:1[0-3]|s3|00)[di]\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// Entry is one fingerprint on a blocklist.
+type Entry struct {
+	Fingerprint string
+	Kind        string
+	// Source is the file the entry came from.
+	Source string
+	// Comment is whatever followed the fingerprint, such as the malware
+	// it was listed for.
+	Comment string
+}
+
+// Blocklist is a set of JA3 and JA4 fingerprints.
+type Blocklist struct {
+	entries map[string]*Entry
+}
+
+// LoadBlocklist reads blocklist files holding one fingerprint per line,
+// optionally followed by a comma and a comment; blank lines and lines
+// starting with # are ignored. The abuse.ch SSLBL JA3 CSV, whose lines are
+// fingerprint, first seen, last seen and listing reason, is read as is and
+// the reason used as the comment.
+func LoadBlocklist(paths ...string) (*Blocklist, error) {
+	b := &Blocklist{entries: make(map[string]*Entry)}
+	for _, path := range paths {
+		if err := b.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Blocklist) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		e := &Entry{Fingerprint: value, Source: filepath.Base(path)}
+		switch {
+		case ja3Pattern.MatchString(value):
+			e.Kind = JA3
+		case ja4Pattern.MatchString(value):
+			e.Kind = JA4
+		default:
+			return fmt.Errorf("%s:%d: %q is neither a JA3 nor a JA4 fingerprint", path, n, fields[0])
+		}
+		if len(fields) == 4 {
+			// SSLBL: the listing reason follows the first and last seen dates
+			e.Comment = strings.TrimSpace(fields[3])
+		} else if len(fields) > 1 {
+			e.Comment = strings.TrimSpace(strings.Join(fields[1:], ","))
+		}
+		b.entries[value] = e
+	}
+	return scanner.Err()
+}
+
+// Len returns the number of fingerprints on the list.
+func (b *Blocklist) Len() int {
+	return len(b.entries)
+}
+
+// Match returns the entries h's JA3 and JA4 fingerprints are listed under.
+func (b *Blocklist) Match(h *ClientHello) []*Entry {
+	var matched []*Entry
+	for _, fp := range []string{h.JA3(), h.JA4()} {
+		if e, ok := b.entries[fp]; ok {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,445 @@
+// Package fingerprint parses TLS ClientHello messages, computes their JA3
+// and JA4 fingerprints and matches them against blocklists of known
+// malicious clients.
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Extension types the fingerprints treat specially.
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// ErrIncomplete is returned for a ClientHello that hasn't fully arrived.
+var ErrIncomplete = errors.New("incomplete ClientHello")
+
+// ClientHello is the part of a TLS ClientHello fingerprints are made of.
+// GREASE values are left out throughout.
+type ClientHello struct {
+	Version             uint16
+	Ciphers             []uint16
+	Extensions          []uint16
+	Curves              []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ALPN                []string
+	SNI                 string
+}
+
+// IsClientHello reports whether payload starts with a TLS handshake record
+// holding a ClientHello.
+func IsClientHello(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == 0x16 && payload[1] == 0x03 && payload[5] == 0x01
+}
+
+// IsServerHello reports whether payload starts with a TLS handshake record
+// holding a ServerHello.
+func IsServerHello(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == 0x16 && payload[1] == 0x03 && payload[5] == 0x02
+}
+
+// handshake returns the first handshake message of payload, joining its
+// fragments from consecutive records, without its 4-byte header.
+func handshake(payload []byte, typ byte) ([]byte, error) {
+	var msg []byte
+	for {
+		if len(payload) < 5 {
+			return nil, ErrIncomplete
+		}
+		if payload[0] != 0x16 {
+			return nil, errors.New("not a handshake record")
+		}
+		n := int(binary.BigEndian.Uint16(payload[3:5]))
+		if len(payload) < 5+n {
+			return nil, ErrIncomplete
+		}
+		msg = append(msg, payload[5:5+n]...)
+		payload = payload[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+handshakeLen(msg) {
+			break
+		}
+	}
+	if msg[0] != typ {
+		return nil, fmt.Errorf("handshake message %d, not %d", msg[0], typ)
+	}
+	return msg[4 : 4+handshakeLen(msg)], nil
+}
+
+// ParseClientHello parses the ClientHello at the start of a client's
+// payload, which may span several TLS records. ErrIncomplete means more
+// payload is needed.
+func ParseClientHello(payload []byte) (*ClientHello, error) {
+	msg, err := handshake(payload, 0x01)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{b: msg}
+	h := &ClientHello{Version: r.u16()}
+	r.skip(32) // random
+	r.bytes8() // session ID
+	ciphers := r.bytes16()
+	for c := (&reader{b: ciphers}); c.len() >= 2; {
+		if v := c.u16(); !grease(v) {
+			h.Ciphers = append(h.Ciphers, v)
+		}
+	}
+	r.bytes8() // compression methods
+	exts := &reader{b: r.bytes16()}
+	if r.short {
+		return nil, errors.New("truncated ClientHello")
+	}
+	for exts.len() >= 4 {
+		typ := exts.u16()
+		data := &reader{b: exts.bytes16()}
+		if grease(typ) {
+			continue
+		}
+		h.Extensions = append(h.Extensions, typ)
+		switch typ {
+		case extServerName:
+			names := &reader{b: data.bytes16()}
+			for names.len() >= 3 {
+				kind := names.u8()
+				name := names.bytes16()
+				if kind == 0 {
+					h.SNI = string(name)
+				}
+			}
+		case extSupportedGroups:
+			for g := (&reader{b: data.bytes16()}); g.len() >= 2; {
+				if v := g.u16(); !grease(v) {
+					h.Curves = append(h.Curves, v)
+				}
+			}
+		case extECPointFormats:
+			h.PointFormats = append(h.PointFormats, data.bytes8()...)
+		case extSignatureAlgorithms:
+			for s := (&reader{b: data.bytes16()}); s.len() >= 2; {
+				h.SignatureAlgorithms = append(h.SignatureAlgorithms, s.u16())
+			}
+		case extALPN:
+			for protos := (&reader{b: data.bytes16()}); protos.len() >= 1; {
+				if p := protos.bytes8(); len(p) > 0 {
+					h.ALPN = append(h.ALPN, string(p))
+				}
+			}
+		case extSupportedVersions:
+			for v := (&reader{b: data.bytes8()}); v.len() >= 2; {
+				if x := v.u16(); !grease(x) {
+					h.SupportedVersions = append(h.SupportedVersions, x)
+				}
+			}
+		}
+	}
+	return h, nil
+}
+
+// ServerHello is what a server chose in its ServerHello.
+type ServerHello struct {
+	// Version is the negotiated version, taken from the supported_versions
+	// extension for TLS 1.3.
+	Version uint16
+	Cipher  uint16
+	// ALPN is the application protocol the server chose, which is only
+	// sent in the ServerHello before TLS 1.3.
+	ALPN string
+	// Certificate is the server's own certificate, which is only sent in
+	// the clear before TLS 1.3. It is nil when it wasn't seen.
+	Certificate *x509.Certificate
+}
+
+// ParseServerHello parses the ServerHello at the start of a server's
+// payload. ErrIncomplete means more payload is needed.
+func ParseServerHello(payload []byte) (*ServerHello, error) {
+	msg, err := handshake(payload, 0x02)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{b: msg}
+	h := &ServerHello{Version: r.u16()}
+	r.skip(32) // random
+	r.bytes8() // session ID
+	h.Cipher = r.u16()
+	r.u8() // compression method
+	if r.short {
+		return nil, errors.New("truncated ServerHello")
+	}
+	exts := &reader{b: r.bytes16()}
+	for exts.len() >= 4 {
+		typ := exts.u16()
+		data := &reader{b: exts.bytes16()}
+		switch {
+		case typ == extSupportedVersions && data.len() == 2:
+			h.Version = data.u16()
+		case typ == extALPN:
+			h.ALPN = string((&reader{b: data.bytes16()}).bytes8())
+		}
+	}
+	return h, nil
+}
+
+// ParseCertificate returns the first certificate of the Certificate
+// message in a server's first flight, which before TLS 1.3 follows the
+// ServerHello in the clear. It returns nil without an error when the
+// flight has no certificate, as when a session is resumed. ErrIncomplete
+// means more payload is needed.
+func ParseCertificate(payload []byte) (*x509.Certificate, error) {
+	// Join the handshake records that have fully arrived
+	var msgs []byte
+	ended := false
+	for len(payload) >= 5 {
+		if payload[0] != 0x16 {
+			ended = true
+			break
+		}
+		n := int(binary.BigEndian.Uint16(payload[3:5]))
+		if len(payload) < 5+n {
+			break
+		}
+		msgs = append(msgs, payload[5:5+n]...)
+		payload = payload[5+n:]
+	}
+	for len(msgs) >= 4 && len(msgs) >= 4+handshakeLen(msgs) {
+		typ, body := msgs[0], msgs[4:4+handshakeLen(msgs)]
+		msgs = msgs[4+len(body):]
+		switch typ {
+		case 0x02: // ServerHello
+		case 0x0b:
+			r := &reader{b: body}
+			r.skip(3) // length of the chain
+			n := int(r.u8())<<16 | int(r.u16())
+			der := r.take(n)
+			if r.short {
+				return nil, errors.New("truncated Certificate")
+			}
+			return x509.ParseCertificate(der)
+		default:
+			return nil, nil
+		}
+	}
+	if ended {
+		return nil, nil
+	}
+	return nil, ErrIncomplete
+}
+
+// VersionName names a TLS protocol version, such as "TLS 1.2".
+func VersionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301, 0x0302, 0x0303, 0x0304:
+		return fmt.Sprintf("TLS 1.%d", v-0x0301)
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// ParseVersion parses a version written as "1.2", "TLS 1.2", "tls1.2" or
+// "SSL 3.0".
+func ParseVersion(s string) (uint16, error) {
+	v := strings.ToLower(strings.ReplaceAll(s, " ", ""))
+	switch strings.TrimPrefix(v, "tls") {
+	case "1.0":
+		return 0x0301, nil
+	case "1.1":
+		return 0x0302, nil
+	case "1.2":
+		return 0x0303, nil
+	case "1.3":
+		return 0x0304, nil
+	}
+	if v == "ssl3.0" || v == "ssl3" {
+		return 0x0300, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// handshakeLen returns the length of the handshake message msg starts
+// with, not counting its 4-byte header.
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+// grease reports whether v is a GREASE value (RFC 8701), which clients
+// send at random to keep servers tolerant and fingerprints ignore.
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// MaxVersion returns the highest version the client offered.
+func (h *ClientHello) MaxVersion() uint16 {
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		if v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+// JA3String returns the fields JA3 hashes: version, ciphers, extensions,
+// curves and point formats.
+func (h *ClientHello) JA3String() string {
+	formats := make([]uint16, len(h.PointFormats))
+	for i, f := range h.PointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.Ciphers), joinDecimal(h.Extensions), joinDecimal(h.Curves), joinDecimal(formats),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint: the MD5 digest of JA3String.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint, such as t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (h *ClientHello) JA4() string {
+	sni := "i"
+	if h.SNI != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 {
+		p := h.ALPN[0]
+		first, last := p[0], p[len(p)-1]
+		if alphanumeric(first) && alphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = fmt.Sprintf("%x%x", first>>4, last&0x0f)
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", tlsVersion(h.MaxVersion()), sni, min(len(h.Ciphers), 99), min(len(h.Extensions), 99), alpn)
+
+	ciphers := sortedHex(h.Ciphers, nil)
+	var exts []string
+	if len(h.Extensions) > 0 {
+		exts = sortedHex(h.Extensions, func(v uint16) bool { return v == extServerName || v == extALPN })
+		if len(h.SignatureAlgorithms) > 0 {
+			algs := make([]string, len(h.SignatureAlgorithms))
+			for i, s := range h.SignatureAlgorithms {
+				algs[i] = fmt.Sprintf("%04x", s)
+			}
+			exts = []string{strings.Join(exts, ",") + "_" + strings.Join(algs, ",")}
+		}
+	}
+	return a + "_" + truncatedHash(ciphers) + "_" + truncatedHash(exts)
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func alphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func joinDecimal(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// sortedHex formats values as four hex digits, sorted, leaving out those
+// skip reports.
+func sortedHex(values []uint16, skip func(uint16) bool) []string {
+	var s []string
+	for _, v := range values {
+		if skip == nil || !skip(v) {
+			s = append(s, fmt.Sprintf("%04x", v))
+		}
+	}
+	sort.Strings(s)
+	return s
+}
+
+// truncatedHash is the first 12 hex digits of the SHA-256 digest of the
+// comma-joined values, or zeros when there are none.
+func truncatedHash(values []string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// reader consumes big-endian fields, recording when it runs short rather
+// than failing each read.
+type reader struct {
+	b     []byte
+	short bool
+}
+
+func (r *reader) len() int {
+	return len(r.b)
+}
+
+func (r *reader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) skip(n int) {
+	r.take(n)
+}
+
+func (r *reader) bytes8() []byte {
+	return r.take(int(r.u8()))
+}
+
+func (r *reader) bytes16() []byte {
+	return r.take(int(r.u16()))
+}
+
+func (r *reader) take(n int) []byte {
+	if len(r.b) < n {
+		r.b, r.short = nil, true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
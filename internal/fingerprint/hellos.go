@@ -0,0 +1,80 @@
+package fingerprint
+
+import "github.com/pcap-analyzer/pkg/analyzer"
+
+// maxHelloSize bounds how much of a connection is buffered waiting for a
+// hello to complete.
+const maxHelloSize = 64 << 10
+
+// helloFlow follows one direction of a TLS connection until its hello has
+// arrived.
+type helloFlow struct {
+	client bool
+	buf    []byte
+	next   uint32
+	done   bool
+}
+
+// Hellos reads TLS ClientHellos and ServerHellos, with the certificate
+// that follows before TLS 1.3, from packets as they arrive. Segments out
+// of order are skipped, so a hello split across reordered segments is
+// missed. It isn't safe for concurrent use.
+type Hellos struct {
+	flows map[string]*helloFlow
+}
+
+func NewHellos() *Hellos {
+	return &Hellos{flows: make(map[string]*helloFlow)}
+}
+
+// Packet returns the hello p completes, if any.
+func (t *Hellos) Packet(p *analyzer.Packet) (*ClientHello, *ServerHello) {
+	if p.TCP == nil {
+		return nil, nil
+	}
+	key := p.Network.String() + " " + p.Transport.String()
+	payload := p.TCP.Payload
+	flow, ok := t.flows[key]
+	if p.TCP.FIN || p.TCP.RST {
+		delete(t.flows, key)
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	switch {
+	case !ok:
+		client := IsClientHello(payload)
+		if !client && !IsServerHello(payload) {
+			return nil, nil
+		}
+		flow = &helloFlow{client: client}
+		t.flows[key] = flow
+	case flow.done || p.TCP.Seq != flow.next:
+		return nil, nil
+	}
+	flow.buf = append(flow.buf, payload...)
+	flow.next = p.TCP.Seq + uint32(len(payload))
+
+	var client *ClientHello
+	var server *ServerHello
+	var err error
+	if flow.client {
+		client, err = ParseClientHello(flow.buf)
+	} else if server, err = ParseServerHello(flow.buf); err == nil && server.Version < 0x0304 {
+		// Wait for the certificate that follows, but settle for the
+		// ServerHello alone if it can't be read
+		var certErr error
+		server.Certificate, certErr = ParseCertificate(flow.buf)
+		if certErr == ErrIncomplete && len(flow.buf) < maxHelloSize {
+			return nil, nil
+		}
+	}
+	if err == ErrIncomplete && len(flow.buf) < maxHelloSize {
+		return nil, nil
+	}
+	flow.buf, flow.done = nil, true
+	if err != nil {
+		return nil, nil
+	}
+	return client, server
+}
@@ -0,0 +1,181 @@
+package grpcmsg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Decoder names and decodes the messages of the methods whose services it
+// has descriptors for.
+type Decoder struct {
+	files   *protoregistry.Files
+	types   *dynamicpb.Types
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+// Load reads the descriptors of paths: .proto files, compiled with their
+// imports found in importPaths or next to the file, and descriptor sets
+// as protoc --descriptor_set_out or buf build -o write them, best with
+// their imports included.
+func Load(paths, importPaths []string) (*Decoder, error) {
+	d := &Decoder{files: new(protoregistry.Files), methods: make(map[string]protoreflect.MethodDescriptor)}
+	var sources []string
+	imports := append([]string(nil), importPaths...)
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), ".proto") {
+			name, dir := protoName(path, importPaths)
+			sources = append(sources, name)
+			if dir != "" {
+				imports = append(imports, dir)
+			}
+			continue
+		}
+		if err := d.loadSet(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(sources) > 0 {
+		c := protocompile.Compiler{
+			Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: imports}),
+		}
+		files, err := c.Compile(context.Background(), sources...)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			d.register(f)
+		}
+	}
+	d.types = dynamicpb.NewTypes(d.files)
+	return d, nil
+}
+
+// protoName returns the name a .proto file is compiled under: relative to
+// the import path holding it, or else its base name, with its directory
+// to be searched as well.
+func protoName(path string, importPaths []string) (name, dir string) {
+	for _, ip := range importPaths {
+		if rel, err := filepath.Rel(ip, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel), ""
+		}
+	}
+	return filepath.Base(path), filepath.Dir(path)
+}
+
+// loadSet reads a descriptor set.
+func (d *Decoder) loadSet(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(b, set); err != nil {
+		return fmt.Errorf("%s: not a descriptor set: %v", path, err)
+	}
+	// Files come before those importing them; imports the set leaves out
+	// may be among the files already loaded or the well-known types
+	resolver := &fallbackResolver{d.files}
+	for _, fdp := range set.File {
+		if _, err := d.files.FindFileByPath(fdp.GetName()); err == nil {
+			continue
+		}
+		f, err := protodesc.NewFile(fdp, resolver)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		d.register(f)
+	}
+	return nil
+}
+
+// fallbackResolver finds files among those loaded and then among the
+// well-known types compiled into the program.
+type fallbackResolver struct {
+	*protoregistry.Files
+}
+
+func (r *fallbackResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if f, err := r.Files.FindFileByPath(path); err == nil {
+		return f, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *fallbackResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if desc, err := r.Files.FindDescriptorByName(name); err == nil {
+		return desc, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// register adds a file, and the files it imports, along with the methods
+// of its services. A file already registered is left as it is.
+func (d *Decoder) register(f protoreflect.FileDescriptor) {
+	if _, err := d.files.FindFileByPath(f.Path()); err == nil {
+		return
+	}
+	imports := f.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		d.register(imports.Get(i).FileDescriptor)
+	}
+	if d.files.RegisterFile(f) != nil {
+		return
+	}
+	services := f.Services()
+	for i := 0; i < services.Len(); i++ {
+		s := services.Get(i)
+		methods := s.Methods()
+		for j := 0; j < methods.Len(); j++ {
+			m := methods.Get(j)
+			d.methods["/"+string(s.FullName())+"/"+string(m.Name())] = m
+		}
+	}
+}
+
+// Methods returns how many methods the decoder knows.
+func (d *Decoder) Methods() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.methods)
+}
+
+// Format renders a message of the call to path, such as
+// /helloworld.Greeter/SayHello, as indented JSON named by the method's
+// input or, for a response, output type. Without the method's
+// descriptors, or when the message doesn't decode as its type, the message
+// is formatted as Raw does, and name is empty. A nil Decoder formats every
+// message as Raw does.
+func (d *Decoder) Format(path string, response bool, msg []byte) (text, name string) {
+	if d != nil {
+		if m, ok := d.methods[path]; ok {
+			desc := m.Input()
+			if response {
+				desc = m.Output()
+			}
+			dm := dynamicpb.NewMessage(desc)
+			if err := (proto.UnmarshalOptions{Resolver: d.types}).Unmarshal(msg, dm); err == nil {
+				opts := protojson.MarshalOptions{Multiline: true, Indent: "  ", Resolver: d.types}
+				if b, err := opts.Marshal(dm); err == nil {
+					return string(b), string(desc.FullName())
+				}
+			}
+		}
+	}
+	if text, ok := Raw(msg); ok {
+		return text, ""
+	}
+	return fmt.Sprintf("%q", msg), ""
+}
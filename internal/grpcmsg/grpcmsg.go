@@ -0,0 +1,184 @@
+// Package grpcmsg decodes the messages of gRPC calls carried in HTTP
+// bodies: the length-prefixed frames, and the protobuf in them, named by
+// the call's method when its descriptors are given and field by field
+// otherwise.
+package grpcmsg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxDepth bounds how deep raw decoding looks for nested messages.
+const maxDepth = 16
+
+// IsGRPC reports whether a Content-Type is that of gRPC, or of gRPC-Web in
+// binary form.
+func IsGRPC(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, base := range []string{"application/grpc", "application/grpc-web"} {
+		if t == base || strings.HasPrefix(t, base+"+") {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is one message of a gRPC body.
+type Message struct {
+	// Data is the message, decompressed when it was compressed with an
+	// encoding that is understood.
+	Data []byte
+	// Compressed is set when the message was sent compressed, and Err
+	// when it couldn't be decompressed.
+	Compressed bool
+	Err        error
+	// Trailer is set for the frame gRPC-Web sends its trailers in, whose
+	// Data is the header fields as text.
+	Trailer bool
+}
+
+// Split returns the messages of a gRPC body, decompressing those sent
+// compressed with encoding, the grpc-encoding header. A body cut short
+// returns the messages before the cut and an error.
+func Split(body []byte, encoding string) ([]Message, error) {
+	var msgs []Message
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return msgs, errors.New("gRPC frame header cut short")
+		}
+		flags, n := body[0], binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint64(n) > uint64(len(body)) {
+			return msgs, fmt.Errorf("gRPC message of %d bytes cut short at %d", n, len(body))
+		}
+		m := Message{Data: body[:n], Compressed: flags&1 != 0, Trailer: flags&0x80 != 0}
+		body = body[n:]
+		if m.Compressed {
+			m.Data, m.Err = decompress(m.Data, encoding)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func decompress(data []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return data, err
+		}
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return data, err
+		}
+		return out, nil
+	case "", "identity":
+		return data, errors.New("compressed message without grpc-encoding")
+	}
+	return data, fmt.Errorf("grpc-encoding %q not supported", encoding)
+}
+
+// Raw formats a protobuf message without its descriptor, as protoc
+// --decode_raw does: each field by number, with length-delimited fields
+// shown as text when they are printable, as nested messages when they
+// parse as one, and as escaped bytes otherwise. It reports false when b
+// isn't a well-formed message.
+func Raw(b []byte) (string, bool) {
+	var sb strings.Builder
+	if !raw(&sb, b, "", 0) {
+		return "", false
+	}
+	return strings.TrimSuffix(sb.String(), "\n"), true
+}
+
+func raw(sb *strings.Builder, b []byte, indent string, depth int) bool {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(sb, "%s%d: %d\n", indent, num, v)
+			b = b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(sb, "%s%d: 0x%08x\n", indent, num, v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(sb, "%s%d: 0x%016x\n", indent, num, v)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return false
+			}
+			b = b[n:]
+			var nested strings.Builder
+			switch {
+			case printable(v):
+				fmt.Fprintf(sb, "%s%d: %s\n", indent, num, strconv.Quote(string(v)))
+			case depth < maxDepth && raw(&nested, v, indent+"  ", depth+1):
+				fmt.Fprintf(sb, "%s%d {\n%s%s}\n", indent, num, nested.String(), indent)
+			default:
+				fmt.Fprintf(sb, "%s%d: %q\n", indent, num, v)
+			}
+		case protowire.StartGroupType:
+			v, n := protowire.ConsumeGroup(num, b)
+			if n < 0 {
+				return false
+			}
+			b = b[n:]
+			var nested strings.Builder
+			if depth >= maxDepth || !raw(&nested, v, indent+"  ", depth+1) {
+				return false
+			}
+			fmt.Fprintf(sb, "%s%d {\n%s%s}\n", indent, num, nested.String(), indent)
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// printable reports whether b is text: valid UTF-8 without control
+// characters other than whitespace.
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+// Package har reads HTTP Archive files, such as those saved by browsers and
+// intercepting proxies, as the requests and responses a capture of the same
+// traffic would yield.
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// unknownIP stands in for addresses a HAR file doesn't record, such as the
+// client's.
+const unknownIP = "0.0.0.0"
+
+type archive struct {
+	Log struct {
+		Entries []entry `json:"entries"`
+	} `json:"log"`
+}
+
+type entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the whole entry in milliseconds.
+	Time     float64  `json:"time"`
+	Request  request  `json:"request"`
+	Response response `json:"response"`
+	// Timings are in milliseconds, with -1 for phases that don't apply.
+	Timings struct {
+		Blocked float64 `json:"blocked"`
+		DNS     float64 `json:"dns"`
+		Connect float64 `json:"connect"`
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+	ServerIPAddress string `json:"serverIPAddress"`
+	// Connection is the ID of the connection, which browsers set to the
+	// client's port.
+	Connection string `json:"connection"`
+}
+
+type header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type request struct {
+	Method      string   `json:"method"`
+	URL         string   `json:"url"`
+	HTTPVersion string   `json:"httpVersion"`
+	Headers     []header `json:"headers"`
+	PostData    *struct {
+		Text   string `json:"text"`
+		Params []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"params"`
+	} `json:"postData"`
+}
+
+type response struct {
+	// Status is zero for requests that got no response.
+	Status      int      `json:"status"`
+	StatusText  string   `json:"statusText"`
+	HTTPVersion string   `json:"httpVersion"`
+	Headers     []header `json:"headers"`
+	Content     struct {
+		Text     string `json:"text"`
+		Encoding string `json:"encoding"`
+	} `json:"content"`
+}
+
+// Entry is one request from a HAR file and the response to it, which is
+// nil when none was received.
+type Entry struct {
+	Request  *httpstream.Request
+	Response *httpstream.Response
+	// Connect is how long opening the connection took, for the first
+	// request on it; Send how long the request took to go out after its
+	// first byte, and Receive the response to arrive after its first byte.
+	// They are zero when unknown.
+	Connect, Send, Receive time.Duration
+}
+
+// Options controls how entries are converted.
+type Options struct {
+	// HashBodies and HashMD5 set the digests of every body.
+	HashBodies, HashMD5 bool
+}
+
+// Sniff reports whether data, the start of a file, looks like a HAR file
+// rather than a capture.
+func Sniff(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+// Read decodes the HAR file in r. Entries whose URL can't be parsed are
+// skipped.
+//
+// HAR files record neither the client's address nor the bodies as sent, so
+// requests come from 0.0.0.0, from the port in the entry's connection ID
+// when it is one, and bodies are those the browser decoded, compressed
+// again as the message says they were sent. The request's timestamp is
+// when it was sent, after any connection setup, and the response's when
+// its first byte arrived.
+func Read(r io.Reader, opts Options) ([]Entry, error) {
+	var a archive
+	if err := json.NewDecoder(r).Decode(&a); err != nil {
+		return nil, fmt.Errorf("reading HAR: %w", err)
+	}
+	entries := make([]Entry, 0, len(a.Log.Entries))
+	for i := range a.Log.Entries {
+		if e, ok := convert(&a.Log.Entries[i], opts); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func convert(e *entry, opts Options) (Entry, bool) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil || u.Host == "" {
+		return Entry{}, false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	clientPort := "0"
+	if _, err := strconv.ParseUint(e.Connection, 10, 16); err == nil {
+		clientPort = e.Connection
+	}
+	serverIP := strings.Trim(e.ServerIPAddress, "[]")
+	if net.ParseIP(serverIP) == nil {
+		serverIP = unknownIP
+	}
+	flow := httpstream.Flow{SrcIP: unknownIP, SrcPort: clientPort, DstIP: serverIP, DstPort: port}
+
+	sent := e.StartedDateTime.Add(millis(e.Timings.Blocked) + millis(e.Timings.DNS) + millis(e.Timings.Connect))
+	req := &httpstream.Request{
+		Message: httpstream.Message{
+			Flow:      flow,
+			Timestamp: sent,
+			Proto:     proto(e.Request.HTTPVersion),
+			Header:    headers(e.Request.Headers),
+		},
+		Method:        e.Request.Method,
+		URL:           e.Request.URL,
+		URI:           u.RequestURI(),
+		Host:          u.Host,
+		ContentLength: -1,
+	}
+	if n, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64); err == nil {
+		req.ContentLength = n
+	}
+	if pd := e.Request.PostData; pd != nil {
+		body := []byte(pd.Text)
+		if len(body) == 0 && len(pd.Params) > 0 {
+			// Encoded by hand since url.Values would sort the fields
+			fields := make([]string, len(pd.Params))
+			for i, p := range pd.Params {
+				fields[i] = url.QueryEscape(p.Name) + "=" + url.QueryEscape(p.Value)
+			}
+			body = []byte(strings.Join(fields, "&"))
+		}
+		req.LoadBody(encode(req.Header, body), opts.HashBodies, opts.HashMD5)
+	}
+	if req.ContentLength < 0 {
+		req.ContentLength = req.BodySize
+	}
+	entry := Entry{Request: req, Connect: millis(e.Timings.Connect), Send: millis(e.Timings.Send)}
+	if e.Response.Status == 0 {
+		return entry, true
+	}
+
+	// Without send and wait timings the response is placed at the end of
+	// the entry
+	latency := millis(e.Time)
+	if e.Timings.Wait >= 0 {
+		latency = millis(e.Timings.Send) + millis(e.Timings.Wait)
+	}
+	status := e.Response.StatusText
+	if status == "" {
+		status = http.StatusText(e.Response.Status)
+	}
+	resp := &httpstream.Response{
+		Message: httpstream.Message{
+			Flow:      flow.Reverse(),
+			Timestamp: sent.Add(latency),
+			Proto:     proto(e.Response.HTTPVersion),
+			Header:    headers(e.Response.Headers),
+		},
+		Status:     strings.TrimSpace(strconv.Itoa(e.Response.Status) + " " + status),
+		StatusCode: e.Response.Status,
+		Request:    req,
+	}
+	body := []byte(e.Response.Content.Text)
+	if e.Response.Content.Encoding == "base64" {
+		if b, err := base64.StdEncoding.DecodeString(e.Response.Content.Text); err == nil {
+			body = b
+		}
+	}
+	if len(body) > 0 {
+		resp.LoadBody(encode(resp.Header, body), opts.HashBodies, opts.HashMD5)
+	}
+	entry.Response, entry.Receive = resp, millis(e.Timings.Receive)
+	return entry, true
+}
+
+// millis converts a HAR time in milliseconds, treating -1 as zero.
+func millis(ms float64) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// proto normalizes the protocol versions browsers write, such as "h2" and
+// "http/1.1", to the form HTTP messages carry.
+func proto(v string) string {
+	switch strings.ToLower(v) {
+	case "":
+		return "HTTP/1.1"
+	case "h2", "http/2", "http/2.0":
+		return "HTTP/2.0"
+	case "h3", "http/3", "http/3.0":
+		return "HTTP/3.0"
+	}
+	return strings.ToUpper(v)
+}
+
+// headers converts a HAR header list, leaving out the pseudo-headers of
+// HTTP/2 and HTTP/3 such as :authority.
+func headers(list []header) http.Header {
+	h := make(http.Header, len(list))
+	for _, hd := range list {
+		if strings.HasPrefix(hd.Name, ":") {
+			continue
+		}
+		h.Add(hd.Name, hd.Value)
+	}
+	return h
+}
+
+// encode compresses a body as its headers say it was sent, since HAR files
+// hold bodies decoded and messages hold them as transferred. A body whose
+// encoding isn't supported is kept decoded.
+func encode(h http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	encoded, err := httpstream.EncodeContent(h, body)
+	if err != nil {
+		return body
+	}
+	return encoded
+}
@@ -0,0 +1,241 @@
+package har
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Writer writes a HAR 1.2 file one entry at a time, so that the
+// transactions of a large capture needn't all be held until the end.
+type Writer struct {
+	w       *bufio.Writer
+	entries int
+	err     error
+}
+
+// NewWriter starts a HAR file on w, naming creator as the program that
+// made it.
+func NewWriter(w io.Writer, creator string) *Writer {
+	hw := &Writer{w: bufio.NewWriter(w)}
+	head, _ := json.Marshal(map[string]string{"name": creator, "version": "1.2"})
+	hw.write(`{"log":{"version":"1.2","creator":` + string(head) + `,"entries":[`)
+	return hw
+}
+
+func (w *Writer) write(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+// Entries returns how many entries have been written.
+func (w *Writer) Entries() int {
+	return w.entries
+}
+
+type outEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         outRequest  `json:"request"`
+	Response        outResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         outTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type nameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type outRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []nameValue `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	QueryString []nameValue `json:"queryString"`
+	PostData    *outContent `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type outResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []nameValue `json:"cookies"`
+	Headers     []nameValue `json:"headers"`
+	Content     outContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+// outContent serves as both a response's content and a request's
+// postData, which has no size.
+type outContent struct {
+	Size        *int64 `json:"size,omitempty"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// outTimings are in milliseconds, with -1 for phases that don't apply or
+// weren't seen.
+type outTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Write adds an entry. Its request must be set; a nil response is
+// written with status 0, as browsers record requests that failed. The
+// timings are taken from the timestamps of the messages along with the
+// entry's Connect, Send and Receive.
+func (w *Writer) Write(e Entry) error {
+	req, resp := e.Request, e.Response
+	out := outEntry{
+		StartedDateTime: req.Timestamp.Add(-e.Connect).UTC(),
+		Request: outRequest{
+			Method:      req.Method,
+			URL:         req.URL,
+			HTTPVersion: req.Proto,
+			Cookies:     cookies((&http.Request{Header: req.Header}).Cookies()),
+			Headers:     headerList(req.Header),
+			QueryString: []nameValue{},
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+		},
+		Response: outResponse{
+			Cookies:     []nameValue{},
+			Headers:     []nameValue{},
+			Content:     outContent{Size: new(int64)},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings:         outTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Receive: ms(e.Receive), Send: ms(e.Send)},
+		ServerIPAddress: req.DstIP,
+		// Browsers identify connections by the client's port, which is
+		// what Read takes this as
+		Connection: req.SrcPort,
+	}
+	if id := req.ID(); id != "" {
+		out.Comment = "ID " + id
+	}
+	if u, err := url.Parse(req.URL); err == nil {
+		for _, kv := range strings.Split(u.RawQuery, "&") {
+			if kv == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(kv, "=")
+			name, _ = url.QueryUnescape(name)
+			value, _ = url.QueryUnescape(value)
+			out.Request.QueryString = append(out.Request.QueryString, nameValue{name, value})
+		}
+	}
+	if req.BodySize > 0 {
+		pd := content(&req.Message)
+		pd.Size, pd.Compression = nil, 0
+		out.Request.PostData = &pd
+	}
+	if e.Connect > 0 {
+		out.Timings.Connect = ms(e.Connect)
+	}
+	if resp != nil {
+		_, out.Response.StatusText, _ = strings.Cut(resp.Status, " ")
+		out.Response.Status = resp.StatusCode
+		out.Response.HTTPVersion = resp.Proto
+		out.Response.Cookies = cookies((&http.Response{Header: resp.Header}).Cookies())
+		out.Response.Headers = headerList(resp.Header)
+		out.Response.Content = content(&resp.Message)
+		out.Response.RedirectURL = resp.Header.Get("Location")
+		out.Response.BodySize = resp.BodySize
+		out.Timings.Wait = ms(max(resp.Timestamp.Sub(req.Timestamp)-e.Send, 0))
+	}
+	out.Time = max(out.Timings.Connect, 0) + out.Timings.Send + out.Timings.Wait + out.Timings.Receive
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	if w.entries > 0 {
+		w.write(",")
+	}
+	w.write("\n" + string(data))
+	w.entries++
+	return w.err
+}
+
+// Close ends the file. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	w.write("\n]}}\n")
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func headerList(h http.Header) []nameValue {
+	list := []nameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			list = append(list, nameValue{name, v})
+		}
+	}
+	return list
+}
+
+func cookies(list []*http.Cookie) []nameValue {
+	out := make([]nameValue, len(list))
+	for i, c := range list {
+		out[i] = nameValue{c.Name, c.Value}
+	}
+	return out
+}
+
+// content returns a message's body as HAR holds it, decoded, and in base64
+// when it isn't text. Only the part of the body the message kept is
+// written.
+func content(m *httpstream.Message) outContent {
+	body, decoded, err := m.DecodedBody()
+	if err != nil {
+		body, decoded = m.Body, false
+	}
+	size := int64(len(body))
+	c := outContent{Size: &size, MimeType: m.Header.Get("Content-Type")}
+	if decoded {
+		c.Compression = size - int64(len(m.Body))
+	}
+	if m.BodySize > int64(len(m.Body)) {
+		c.Comment = "truncated to the first " + strconv.Itoa(len(m.Body)) + " of " + strconv.FormatInt(m.BodySize, 10) + " bytes"
+	}
+	if utf8.Valid(body) {
+		c.Text = string(body)
+	} else {
+		c.Text, c.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return c
+}
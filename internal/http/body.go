@@ -0,0 +1,155 @@
+package http
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxBody is the most of a message body that is kept in memory.
+const maxBody = 1024 * 1024
+
+// bodyPool holds the scratch buffers bodies are read into, so each message
+// only allocates as much as its body actually needs.
+var bodyPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, maxBody)
+		return &b
+	},
+}
+
+// readBody reads a message body into m and closes it. The first 1MB is kept
+// in m.Body; with spool set, a longer body is written in full to a
+// temporary file instead of being truncated.
+func readBody(m *Message, body io.ReadCloser, spool bool) {
+	if body == nil {
+		return
+	}
+	defer body.Close()
+	buf := bodyPool.Get().(*[]byte)
+	defer bodyPool.Put(buf)
+	n, err := io.ReadFull(body, *buf)
+	if n > 0 {
+		m.Body = append([]byte(nil), (*buf)[:n]...)
+	}
+	m.BodySize = int64(n)
+	if err != nil {
+		// The body ended within the buffer, or the stream did
+		return
+	}
+
+	if spool {
+		if f, err := os.CreateTemp("", "pcap-analyzer-body-*"); err == nil {
+			written, _ := f.Write(m.Body)
+			rest, _ := io.Copy(f, body)
+			m.spool = f
+			m.BodySize = int64(written) + rest
+			return
+		}
+	}
+	rest, _ := io.Copy(io.Discard, body)
+	m.BodySize += rest
+}
+
+// BodyReader returns a reader over the whole body. Bodies longer than the
+// in-memory limit are only available in full while the handler they were
+// passed to is running, and only when spooling is enabled on the stream;
+// otherwise the reader covers Body alone and Truncated reports true.
+func (m *Message) BodyReader() io.Reader {
+	if m.spool != nil {
+		return io.NewSectionReader(m.spool, 0, m.BodySize)
+	}
+	return bytes.NewReader(m.Body)
+}
+
+// DecodedReader returns a reader over the whole body with its
+// Content-Encodings removed. A body whose encodings aren't supported, or
+// that doesn't start like them, is read as is.
+func (m *Message) DecodedReader() io.Reader {
+	if codings := ContentCodings(m.Header); len(codings) > 0 {
+		if r, err := decodeReader(m.BodyReader(), codings); err == nil {
+			return r
+		}
+	}
+	return m.BodyReader()
+}
+
+// SetBody replaces the body with b, for handlers that rewrite messages
+// before passing them on. Any spooled copy is left to the original message,
+// so a body longer than b is reported as truncated.
+func (m *Message) SetBody(b []byte) {
+	m.BodySize += int64(len(b) - len(m.Body))
+	m.Body = b
+	m.spool = nil
+}
+
+// LoadBody sets the whole body of a message that wasn't parsed from a
+// stream, such as one read from a HAR file. The digests asked for are taken
+// of all of b, and like a parsed body only the first 1MB is kept.
+func (m *Message) LoadBody(b []byte, withSHA256, withMD5 bool) {
+	m.Body, m.BodySize, m.spool = b, int64(len(b)), nil
+	if withSHA256 || withMD5 {
+		hashBody(m, withSHA256, withMD5)
+	}
+	if len(m.Body) > maxBody {
+		m.Body = m.Body[:maxBody:maxBody]
+	}
+}
+
+// Truncated reports whether part of the body is unavailable.
+func (m *Message) Truncated() bool {
+	return m.spool == nil && m.BodySize > int64(len(m.Body))
+}
+
+// release removes the spooled copy of the body, if any.
+func (m *Message) release() {
+	if m.spool == nil {
+		return
+	}
+	m.spool.Close()
+	os.Remove(m.spool.Name())
+	m.spool = nil
+}
+
+// hashBody sets the digests of the body. A compressed body is hashed as
+// decoded, like the file a browser would save, unless it doesn't decode.
+func hashBody(m *Message, withSHA256, withMD5 bool) {
+	if m.BodySize == 0 {
+		return
+	}
+	sha, sum5 := sha256.New(), md5.New()
+	var ws []io.Writer
+	if withSHA256 {
+		ws = append(ws, sha)
+	}
+	if withMD5 {
+		ws = append(ws, sum5)
+	}
+	hashes := io.MultiWriter(ws...)
+	hash := func(r io.Reader) error {
+		sha.Reset()
+		sum5.Reset()
+		_, err := io.Copy(hashes, r)
+		return err
+	}
+
+	decoded := false
+	if codings := ContentCodings(m.Header); len(codings) > 0 {
+		if r, err := decodeReader(m.BodyReader(), codings); err == nil {
+			decoded = hash(r) == nil
+		}
+	}
+	if !decoded {
+		hash(m.BodyReader())
+	}
+	if withSHA256 {
+		m.SHA256 = hex.EncodeToString(sha.Sum(nil))
+	}
+	if withMD5 {
+		m.MD5 = hex.EncodeToString(sum5.Sum(nil))
+	}
+}
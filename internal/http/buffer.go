@@ -0,0 +1,98 @@
+package http
+
+import (
+	"io"
+	"os"
+)
+
+// spillBuffer is a FIFO byte queue that keeps at most limit bytes in memory
+// and appends the rest to a temporary file. A limit of zero keeps
+// everything in memory.
+type spillBuffer struct {
+	mem   chunkQueue
+	limit int
+	// file holds data that arrived while the memory buffer was full. Once
+	// spilling starts every write goes to the file until it is drained, so
+	// bytes are always read back in order.
+	file         *os.File
+	fileR, fileW int64
+	discarded    bool
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.discarded {
+		return len(p), nil
+	}
+	if b.file == nil && (b.limit == 0 || b.mem.Len()+len(p) <= b.limit) {
+		return b.mem.Write(p)
+	}
+	if b.file == nil {
+		f, err := os.CreateTemp("", "pcap-analyzer-stream-*")
+		if err != nil {
+			// Without somewhere to spill, keep the data in memory rather
+			// than lose it
+			return b.mem.Write(p)
+		}
+		b.file = f
+	}
+	n, err := b.file.WriteAt(p, b.fileW)
+	b.fileW += int64(n)
+	return n, err
+}
+
+func (b *spillBuffer) Read(p []byte) (int, error) {
+	if b.mem.Len() > 0 {
+		return b.mem.Read(p)
+	}
+	if b.file == nil || b.fileR == b.fileW {
+		return 0, io.EOF
+	}
+	if remaining := b.fileW - b.fileR; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.file.ReadAt(p, b.fileR)
+	b.fileR += int64(n)
+	if b.fileR == b.fileW {
+		b.removeFile()
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Len returns the number of unread bytes in memory and on disk.
+func (b *spillBuffer) Len() int {
+	return b.mem.Len() + int(b.fileW-b.fileR)
+}
+
+// Peek returns a copy of up to n unread bytes without consuming them.
+func (b *spillBuffer) Peek(n int) []byte {
+	out := b.mem.Peek(n)
+	if len(out) < n && b.file != nil {
+		more := make([]byte, n-len(out))
+		if remaining := b.fileW - b.fileR; int64(len(more)) > remaining {
+			more = more[:remaining]
+		}
+		m, _ := b.file.ReadAt(more, b.fileR)
+		out = append(out, more[:m]...)
+	}
+	return out
+}
+
+// Discard drops all buffered data and ignores further writes.
+func (b *spillBuffer) Discard() {
+	b.discarded = true
+	b.mem.Reset()
+	b.removeFile()
+}
+
+func (b *spillBuffer) removeFile() {
+	if b.file == nil {
+		return
+	}
+	b.file.Close()
+	os.Remove(b.file.Name())
+	b.file = nil
+	b.fileR, b.fileW = 0, 0
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxChunks is how many chunks of a body are recorded; later ones are
+// only counted.
+const maxChunks = 1000
+
+// maxChunkLine is the longest chunk size or trailer line followed, as
+// net/http allows.
+const maxChunkLine = 4096
+
+// States of a chunkScanner.
+const (
+	chunkSizeLine = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+	chunkDone
+)
+
+// chunkScanner follows the framing of a chunked body in the bytes read off
+// the connection while net/http decodes it, which hides the framing. Bytes
+// after the body are ignored.
+type chunkScanner struct {
+	state int
+	line  []byte
+	// left is what remains of the current chunk's data and off how much
+	// of the body has been seen.
+	left, off int64
+	count     int
+	record    bool
+	chunks    []Chunk
+	err       string
+	// follow has starts hold where the data of each chunk starts, in the
+	// body decoded and as sent, for wireOffset; size is how much data the
+	// chunks before the current one held.
+	follow bool
+	starts []chunkStart
+	size   int64
+}
+
+type chunkStart struct {
+	body, wire int64
+}
+
+func (c *chunkScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && c.state != chunkDone {
+		if c.state == chunkData {
+			k := min(c.left, int64(len(p)))
+			c.left -= k
+			c.off += k
+			p = p[k:]
+			if c.left == 0 {
+				c.state = chunkDataEnd
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.line = append(c.line, p...)
+			c.off += int64(len(p))
+			if len(c.line) > maxChunkLine {
+				c.fail("chunk line too long")
+			}
+			break
+		}
+		c.line = append(c.line, p[:i]...)
+		c.off += int64(i + 1)
+		p = p[i+1:]
+		c.endLine()
+		c.line = c.line[:0]
+	}
+	return n, nil
+}
+
+// endLine handles a line of framing, given without its LF.
+func (c *chunkScanner) endLine() {
+	start := c.off - int64(len(c.line)) - 1
+	line := string(bytes.TrimSuffix(c.line, []byte("\r")))
+	switch c.state {
+	case chunkSizeLine:
+		size, ext, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			c.fail(fmt.Sprintf("malformed chunk size %q at byte %d", line, start))
+			return
+		}
+		c.count++
+		if c.record && len(c.chunks) < maxChunks {
+			c.chunks = append(c.chunks, Chunk{Offset: start, Size: n, Ext: ext})
+		}
+		if n == 0 {
+			c.state = chunkTrailer
+		} else {
+			c.state, c.left = chunkData, n
+			if c.follow {
+				c.starts = append(c.starts, chunkStart{body: c.size, wire: c.off})
+			}
+			c.size += n
+		}
+	case chunkDataEnd:
+		if string(c.line) != "\r" {
+			c.fail(fmt.Sprintf("chunk data not followed by CRLF at byte %d", start))
+			return
+		}
+		c.state = chunkSizeLine
+	case chunkTrailer:
+		if line == "" {
+			c.state = chunkDone
+		}
+	}
+}
+
+// wireOffset returns where the byte at offset off of the body decoded was
+// in the body as sent. Offsets must be asked for in increasing order, and
+// only of data that has been scanned.
+func (c *chunkScanner) wireOffset(off int64) int64 {
+	for len(c.starts) > 1 && c.starts[1].body <= off {
+		c.starts = c.starts[1:]
+	}
+	if len(c.starts) == 0 {
+		return off
+	}
+	return c.starts[0].wire + off - c.starts[0].body
+}
+
+func (c *chunkScanner) fail(err string) {
+	c.err, c.state = err, chunkDone
+}
+
+// finish sets what was found of the framing of m's body, which has been
+// read.
+func (c *chunkScanner) finish(m *Message) {
+	if c.state != chunkDone {
+		c.err = "body ended before the last chunk"
+	}
+	m.ChunkCount, m.Chunks, m.ChunkError = c.count, c.chunks, c.err
+}
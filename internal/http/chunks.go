@@ -0,0 +1,111 @@
+package http
+
+import (
+	"io"
+	"sync"
+)
+
+// chunkSize is the size of the pooled slices reassembled payload is copied
+// into.
+const chunkSize = 32 << 10
+
+var chunkPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, chunkSize)
+		return &b
+	},
+}
+
+// chunkQueue is a FIFO of pooled fixed-size slices. Unlike bytes.Buffer it
+// never copies data to grow, and slices go back to the pool as soon as
+// they have been read.
+type chunkQueue struct {
+	chunks []*[]byte
+	// head is the read offset into the first chunk and tail the write
+	// offset into the last one.
+	head, tail int
+	n          int
+}
+
+func (q *chunkQueue) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(q.chunks) == 0 || q.tail == chunkSize {
+			q.chunks = append(q.chunks, chunkPool.Get().(*[]byte))
+			q.tail = 0
+		}
+		c := copy((*q.chunks[len(q.chunks)-1])[q.tail:], p)
+		q.tail += c
+		q.n += c
+		p = p[c:]
+	}
+	return written, nil
+}
+
+func (q *chunkQueue) Read(p []byte) (int, error) {
+	if q.n == 0 {
+		return 0, io.EOF
+	}
+	read := 0
+	for len(p) > 0 && q.n > 0 {
+		end := chunkSize
+		if len(q.chunks) == 1 {
+			end = q.tail
+		}
+		c := copy(p, (*q.chunks[0])[q.head:end])
+		q.head += c
+		q.n -= c
+		read += c
+		p = p[c:]
+		if q.head == end {
+			q.pop()
+		}
+	}
+	return read, nil
+}
+
+// pop returns the first chunk to the pool.
+func (q *chunkQueue) pop() {
+	chunkPool.Put(q.chunks[0])
+	q.chunks[0] = nil
+	q.chunks = q.chunks[1:]
+	q.head = 0
+	if len(q.chunks) == 0 {
+		q.tail = 0
+	}
+}
+
+// Len returns the number of unread bytes.
+func (q *chunkQueue) Len() int {
+	return q.n
+}
+
+// Peek returns a copy of up to n unread bytes without consuming them.
+func (q *chunkQueue) Peek(n int) []byte {
+	if n > q.n {
+		n = q.n
+	}
+	out := make([]byte, 0, n)
+	head := q.head
+	for i := 0; len(out) < n; i++ {
+		end := chunkSize
+		if i == len(q.chunks)-1 {
+			end = q.tail
+		}
+		chunk := (*q.chunks[i])[head:end]
+		if need := n - len(out); len(chunk) > need {
+			chunk = chunk[:need]
+		}
+		out = append(out, chunk...)
+		head = 0
+	}
+	return out
+}
+
+// Reset drops all unread data and returns the chunks to the pool.
+func (q *chunkQueue) Reset() {
+	for len(q.chunks) > 0 {
+		q.pop()
+	}
+	q.n = 0
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ContentCodings returns the Content-Encodings h lists, in the order they
+// were applied, leaving out identity.
+func ContentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// DecodeContent removes the Content-Encodings h lists from body, the last
+// applied first. gzip, deflate, br and zstd are understood. The boolean
+// reports whether any decoding was applied; on error body is returned as
+// is.
+func DecodeContent(h http.Header, body []byte) ([]byte, bool, error) {
+	codings := ContentCodings(h)
+	if len(codings) == 0 || len(body) == 0 {
+		return body, false, nil
+	}
+	r, err := decodeReader(bytes.NewReader(body), codings)
+	if err != nil {
+		return body, false, err
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return body, false, err
+	}
+	return decoded, true, nil
+}
+
+// EncodeContent applies the Content-Encodings h lists to body, for
+// messages whose body is rewritten or was only known decoded.
+func EncodeContent(h http.Header, body []byte) ([]byte, error) {
+	for _, c := range ContentCodings(h) {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch c {
+		case "gzip", "x-gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			w = zw
+		default:
+			return nil, fmt.Errorf("unsupported content coding %q", c)
+		}
+		w.Write(body)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
+
+// decodeReader returns r with codings removed, the last first.
+func decodeReader(r io.Reader, codings []string) (io.Reader, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = inflate(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			var d *zstd.Decoder
+			if d, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1)); err == nil {
+				r = d.IOReadCloser()
+			}
+		default:
+			err = fmt.Errorf("unsupported content coding %q", codings[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", codings[i], err)
+		}
+	}
+	return r, nil
+}
+
+// inflate decodes deflate content, which should be zlib-wrapped but some
+// servers send as raw deflate.
+func inflate(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	hdr, _ := br.Peek(2)
+	if len(hdr) == 2 && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
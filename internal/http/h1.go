@@ -0,0 +1,181 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// h1Conn parses HTTP/1.x from the two directions of a connection apart.
+// The payload arrives with both interleaved as it was captured, so each
+// direction takes what its side sent out of it; pipelined requests, and
+// responses that start before the request they follow has all been sent,
+// then don't get in the way of the other side's messages. Messages are
+// parsed in the order they started being captured in, and responses
+// matched to requests in the order they came.
+type h1Conn struct {
+	s *Stream
+	// dirs are the client's side of the connection and the server's, and
+	// cur the one whose message is being parsed
+	dirs [2]*h1Dir
+	cur  *h1Dir
+	// scratch holds payload being split between the directions
+	scratch []byte
+}
+
+// h1Dir is one direction of an HTTP/1.x connection.
+type h1Dir struct {
+	c      *h1Conn
+	server bool
+	// r holds what the side sent that has been taken off the connection,
+	// and buf reads it for net/http.
+	r   tcpReader
+	buf *bufio.Reader
+}
+
+func newH1Conn(s *Stream) *h1Conn {
+	c := &h1Conn{s: s}
+	for i := range c.dirs {
+		d := &h1Dir{c: c, server: i == 1}
+		d.r.cond = sync.NewCond(&d.r.mu)
+		d.r.buf.limit = s.r.buf.limit
+		d.buf = bufio.NewReader(d)
+		c.dirs[i] = d
+	}
+	return c
+}
+
+// next returns the direction whose next message was captured first,
+// taking payload off the connection until either has some, or nil when
+// all that has arrived has been parsed. A response waits for the request
+// it answers while the connection lasts: when a capture starts part way
+// through a connection, reassembly can hand over all the server sent
+// before what the client did.
+func (c *h1Conn) next() *h1Dir {
+	client, server := c.dirs[0], c.dirs[1]
+	for {
+		switch {
+		case client.unread() > 0 && server.unread() > 0:
+			if before(server.r.markAt(server.consumed()), client.r.markAt(client.consumed())) {
+				return server
+			}
+			return client
+		case client.unread() > 0:
+			return client
+		case server.unread() > 0 && len(c.s.pending) > 0:
+			return server
+		}
+		if c.s.r.Len() == 0 || !c.split() {
+			if server.unread() > 0 && c.s.r.isClosed() {
+				return server
+			}
+			return nil
+		}
+	}
+}
+
+// before reports whether the payload under a was captured before that
+// under b, or at the same time and ahead of it on the connection.
+func before(a, b mark) bool {
+	if !a.ts.Equal(b.ts) {
+		return a.ts.Before(b.ts)
+	}
+	return a.at < b.at
+}
+
+// split takes the next payload off the connection, waiting for it, and
+// hands each part of it to the direction that sent it. It reports false
+// once the connection has ended.
+func (c *h1Conn) split() bool {
+	if c.scratch == nil {
+		c.scratch = make([]byte, chunkSize)
+	}
+	off := c.s.r.offset()
+	n, _ := c.s.r.Read(c.scratch)
+	if n == 0 {
+		return false
+	}
+	for p := c.scratch[:n]; len(p) > 0; {
+		m := c.s.r.markAt(off)
+		k := len(p)
+		if m.end > off && m.end-off < int64(k) {
+			k = int(m.end - off)
+		}
+		d := c.dirs[0]
+		if m.server {
+			d = c.dirs[1]
+		}
+		d.r.writeAt(p[:k], m.ts, m.server, off)
+		p, off = p[k:], off+int64(k)
+	}
+	return true
+}
+
+// unread hands fn what the directions hold that hasn't been parsed, in the
+// order it was captured, for whatever takes the connection over from
+// HTTP/1.x.
+func (c *h1Conn) unread(fn func(p []byte, ts time.Time, server bool)) {
+	var parts [2][]h1Part
+	for i, d := range c.dirs {
+		off := d.consumed()
+		b := make([]byte, d.unread())
+		io.ReadFull(d.buf, b)
+		for len(b) > 0 {
+			m := d.r.markAt(off)
+			k := len(b)
+			if m.end > off && m.end-off < int64(k) {
+				k = int(m.end - off)
+			}
+			parts[i] = append(parts[i], h1Part{b[:k], m})
+			b, off = b[k:], off+int64(k)
+		}
+	}
+	for len(parts[0]) > 0 || len(parts[1]) > 0 {
+		i := 0
+		if len(parts[0]) == 0 || len(parts[1]) > 0 && parts[1][0].m.at < parts[0][0].m.at {
+			i = 1
+		}
+		fn(parts[i][0].p, parts[i][0].m.ts, parts[i][0].m.server)
+		parts[i] = parts[i][1:]
+	}
+}
+
+// h1Part is payload one direction sent, with the mark it came under.
+type h1Part struct {
+	p []byte
+	m mark
+}
+
+// discard releases what the directions hold.
+func (c *h1Conn) discard() {
+	for _, d := range c.dirs {
+		d.r.discard()
+	}
+}
+
+// Read reads what the side sent, waiting for more of the connection while
+// there is none, and shows the scanner of a chunked body being read what
+// it reads.
+func (d *h1Dir) Read(p []byte) (int, error) {
+	for d.r.Len() == 0 {
+		if !d.c.split() {
+			return 0, io.EOF
+		}
+	}
+	n, err := d.r.Read(p)
+	if d.c.s.chunks != nil {
+		d.c.s.chunks.Write(p[:n])
+	}
+	return n, err
+}
+
+// consumed returns how much of what the side sent has been parsed.
+func (d *h1Dir) consumed() int64 {
+	return d.r.offset() - int64(d.buf.Buffered())
+}
+
+// unread returns how much of what the side sent is waiting to be parsed.
+func (d *h1Dir) unread() int {
+	return d.buf.Buffered() + d.r.Len()
+}
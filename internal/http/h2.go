@@ -0,0 +1,547 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// maxH2Streams is how many HTTP/2 streams a connection holds open at once;
+// streams opened past it are not reported.
+const maxH2Streams = 1000
+
+// LooksLikeHTTP2 reports whether payload starts like the connection preface
+// of a client speaking HTTP/2 in the clear, h2c with prior knowledge.
+func LooksLikeHTTP2(payload []byte) bool {
+	n := min(len(payload), len(http2.ClientPreface))
+	return n > 0 && bytes.Equal(payload[:n], []byte(http2.ClientPreface[:n]))
+}
+
+// isH2CUpgrade reports whether resp switches the connection its request was
+// sent on to HTTP/2, as RFC 7540 section 3.2 has clients ask with
+// "Upgrade: h2c".
+func isH2CUpgrade(req *http.Request, resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") &&
+		req != nil && headerHasToken(req.Header, "Upgrade", "h2c")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// h2Conn decodes the HTTP/2 frames of a connection, given the payload of
+// each direction in the order it was sent: HPACK-compressed headers,
+// multiplexed streams and the DATA frames of their bodies. Each stream is
+// a request and its response, reported once each half has ended.
+type h2Conn struct {
+	s *Stream
+	// dirs are the client's side of the connection and the server's
+	dirs    [2]*h2Dir
+	streams map[uint32]*h2Stream
+	// failed is set once the connection can't be followed any further
+	failed bool
+
+	dnsCache *dns.Cache
+	h        Handler
+}
+
+// h2Dir is one direction of a connection.
+type h2Dir struct {
+	server bool
+	// buf holds payload not yet framed; read and written count its bytes
+	// from the start, and marks when they were captured
+	buf           bytes.Buffer
+	read, written int64
+	marks         []mark
+	// preface is set once the client's connection preface is behind it
+	preface bool
+
+	framer *http2.Framer
+	src    frameSource
+	dec    *hpack.Decoder
+
+	// The header block being received, for stream id or, in a
+	// PUSH_PROMISE, the stream promised
+	block      []byte
+	blockID    uint32
+	blockPush  bool
+	blockEnd   bool
+	blockStart time.Time
+}
+
+// frameSource hands the framer the frame it is to read.
+type frameSource struct {
+	b []byte
+}
+
+func (f *frameSource) Read(p []byte) (int, error) {
+	if len(f.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b)
+	f.b = f.b[n:]
+	return n, nil
+}
+
+// h2Stream is a request and its response on one HTTP/2 stream.
+type h2Stream struct {
+	id uint32
+	// req is the request once it has been reported
+	req           *Request
+	reqFields     []hpack.HeaderField
+	respFields    []hpack.HeaderField
+	reqTrailer    http.Header
+	respTrailer   http.Header
+	reqTS, respTS time.Time
+	reqBody       h2Body
+	respBody      h2Body
+	// respEvents parses the response's DATA as it arrives when it is a
+	// Server-Sent Events stream.
+	respEvents        *sseParser
+	reqDone, respDone bool
+}
+
+// h2Body collects the DATA of one side of a stream: the first maxBody
+// bytes in memory or, when bodies are spooled, all of them.
+type h2Body struct {
+	kept  []byte
+	spill *spillBuffer
+	size  int64
+}
+
+func (b *h2Body) write(p []byte, spool bool) {
+	b.size += int64(len(p))
+	if spool {
+		if b.spill == nil {
+			b.spill = &spillBuffer{limit: maxBody}
+		}
+		b.spill.Write(p)
+		return
+	}
+	if room := maxBody - len(b.kept); room > 0 {
+		b.kept = append(b.kept, p[:min(room, len(p))]...)
+	}
+}
+
+// reader returns the body for readBody, which frees it. Bytes that weren't
+// kept read as zeros, so that the body's size is counted in full.
+func (b *h2Body) reader() io.ReadCloser {
+	if b.spill != nil {
+		return spillReader{b.spill}
+	}
+	r := io.MultiReader(bytes.NewReader(b.kept), io.LimitReader(zeros{}, b.size-int64(len(b.kept))))
+	return io.NopCloser(r)
+}
+
+type spillReader struct {
+	*spillBuffer
+}
+
+func (r spillReader) Close() error {
+	r.Discard()
+	return nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func newH2Conn(s *Stream) *h2Conn {
+	c := &h2Conn{s: s, streams: make(map[uint32]*h2Stream)}
+	for i := range c.dirs {
+		d := &h2Dir{server: i == 1}
+		d.framer = http2.NewFramer(io.Discard, &d.src)
+		d.framer.SetMaxReadFrameSize(1<<24 - 1)
+		// A capture is taken as it is, not policed
+		d.framer.AllowIllegalReads = true
+		d.dec = hpack.NewDecoder(4096, nil)
+		c.dirs[i] = d
+	}
+	return c
+}
+
+// upgraded records the request that switched the connection to HTTP/2,
+// which RFC 7540 answers on stream 1.
+func (c *h2Conn) upgraded(req *Request) {
+	c.streams[1] = &h2Stream{id: 1, req: req, reqDone: true}
+}
+
+// stream returns the stream with id, opening it if there is room.
+func (c *h2Conn) stream(id uint32, open bool) *h2Stream {
+	st := c.streams[id]
+	if st == nil && open && id != 0 && len(c.streams) < maxH2Streams {
+		st = &h2Stream{id: id}
+		c.streams[id] = st
+	}
+	return st
+}
+
+// feed adds payload captured at ts, sent by the server if server is set,
+// and reports every message it completes to c.h.
+func (c *h2Conn) feed(p []byte, server bool, ts time.Time) {
+	if c.failed {
+		return
+	}
+	d := c.dirs[0]
+	if server {
+		d = c.dirs[1]
+	}
+	d.buf.Write(p)
+	d.written += int64(len(p))
+	d.marks = append(d.marks, mark{end: d.written, ts: ts})
+
+	if !d.server && !d.preface {
+		b := d.buf.Bytes()
+		if len(b) < len(http2.ClientPreface) && LooksLikeHTTP2(b) {
+			return
+		}
+		if LooksLikeHTTP2(b) {
+			d.consume(len(http2.ClientPreface))
+		}
+		d.preface = true
+	}
+
+	for !c.failed {
+		b := d.buf.Bytes()
+		if len(b) < 9 {
+			return
+		}
+		n := 9 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		if len(b) < n {
+			return
+		}
+		start := d.timeAt(d.read)
+		d.src.b = d.consume(n)
+		f, err := d.framer.ReadFrame()
+		if err != nil {
+			c.s.Stats.ParseErrors.Add(1)
+			continue
+		}
+		c.frame(d, f, start)
+	}
+}
+
+// consume removes n bytes from the front of the buffer, returning them.
+func (d *h2Dir) consume(n int) []byte {
+	d.read += int64(n)
+	return d.buf.Next(n)
+}
+
+// timeAt returns the capture time of the byte at offset off.
+func (d *h2Dir) timeAt(off int64) time.Time {
+	for len(d.marks) > 1 && d.marks[0].end <= off {
+		d.marks = d.marks[1:]
+	}
+	if len(d.marks) == 0 {
+		return time.Time{}
+	}
+	return d.marks[0].ts
+}
+
+func (c *h2Conn) frame(d *h2Dir, f http2.Frame, ts time.Time) {
+	spool := c.s.SpoolBodies
+	switch f := f.(type) {
+	case *http2.DataFrame:
+		st := c.stream(f.StreamID, false)
+		if st == nil {
+			return
+		}
+		if d.server {
+			st.respBody.write(f.Data(), spool)
+			if st.respEvents != nil {
+				st.respEvents.write(f.Data(), func(int) time.Time { return ts })
+			}
+		} else {
+			st.reqBody.write(f.Data(), spool)
+		}
+		if f.StreamEnded() {
+			c.ended(st, d.server)
+		}
+	case *http2.HeadersFrame:
+		d.block = append(d.block[:0], f.HeaderBlockFragment()...)
+		d.blockID, d.blockPush, d.blockEnd, d.blockStart = f.StreamID, false, f.StreamEnded(), ts
+		if f.HeadersEnded() {
+			c.headers(d)
+		}
+	case *http2.PushPromiseFrame:
+		d.block = append(d.block[:0], f.HeaderBlockFragment()...)
+		d.blockID, d.blockPush, d.blockEnd, d.blockStart = f.PromiseID, true, true, ts
+		if f.HeadersEnded() {
+			c.headers(d)
+		}
+	case *http2.ContinuationFrame:
+		if f.StreamID != d.blockID {
+			c.s.Stats.ParseErrors.Add(1)
+			return
+		}
+		d.block = append(d.block, f.HeaderBlockFragment()...)
+		if f.HeadersEnded() {
+			c.headers(d)
+		}
+	case *http2.RSTStreamFrame:
+		if st := c.stream(f.StreamID, false); st != nil {
+			c.finish(st)
+		}
+	case *http2.SettingsFrame:
+		// The table size a side allows is the one the other side's
+		// encoder may use
+		if v, ok := f.Value(http2.SettingHeaderTableSize); ok && !f.IsAck() {
+			other := c.dirs[1]
+			if d.server {
+				other = c.dirs[0]
+			}
+			other.dec.SetAllowedMaxDynamicTableSize(v)
+		}
+	}
+}
+
+// headers decodes a complete header block. Every block is decoded, even of
+// streams that aren't followed, to keep the decoder's table in step with
+// the encoder's.
+func (c *h2Conn) headers(d *h2Dir) {
+	fields, err := d.dec.DecodeFull(d.block)
+	if err != nil {
+		// Without the table the rest of the connection's headers can't
+		// be read
+		c.s.Stats.ParseErrors.Add(1)
+		c.failed = true
+		return
+	}
+	st := c.stream(d.blockID, true)
+	if st == nil {
+		return
+	}
+	switch {
+	case d.blockPush:
+		// A promised response's request, sent by the server
+		st.reqFields, st.reqTS, st.reqDone = fields, d.blockStart, true
+		c.advance(st)
+		return
+	case d.server && st.respFields == nil:
+		if code, _ := strconv.Atoi(pseudo(fields, ":status")); code >= 100 && code < 200 {
+			// Informational responses come before the final one
+			return
+		}
+		st.respFields, st.respTS = fields, d.blockStart
+		if isEventStream(pseudo(fields, "content-type"), pseudo(fields, "content-encoding")) {
+			st.respEvents = &sseParser{}
+		}
+	case d.server:
+		st.respTrailer = trailer(fields)
+	case st.reqFields == nil && st.req == nil:
+		st.reqFields, st.reqTS = fields, d.blockStart
+	default:
+		st.reqTrailer = trailer(fields)
+	}
+	if d.blockEnd {
+		c.ended(st, d.server)
+		return
+	}
+	c.advance(st)
+}
+
+func trailer(fields []hpack.HeaderField) http.Header {
+	h := make(http.Header)
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			h.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		}
+	}
+	return h
+}
+
+func pseudo(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// ended marks one side of a stream as ended.
+func (c *h2Conn) ended(st *h2Stream, server bool) {
+	if server {
+		st.respDone = true
+	} else {
+		st.reqDone = true
+	}
+	c.advance(st)
+}
+
+// advance reports what a stream has completed: its request once it has
+// ended, or once its response has, as a streaming request may outlast it;
+// and its response once it has ended.
+func (c *h2Conn) advance(st *h2Stream) {
+	if st.req == nil && st.reqFields != nil && (st.reqDone || st.respDone) {
+		c.request(st)
+	}
+	if st.respDone && st.respFields != nil {
+		c.response(st)
+	}
+	if st.reqDone && st.respDone {
+		delete(c.streams, st.id)
+	}
+}
+
+// finish reports what a stream has of its request and response, when it is
+// reset or the connection closes.
+func (c *h2Conn) finish(st *h2Stream) {
+	if st.req == nil && st.reqFields != nil {
+		c.request(st)
+	}
+	if st.respFields != nil {
+		c.response(st)
+	}
+	delete(c.streams, st.id)
+}
+
+func (c *h2Conn) request(st *h2Stream) {
+	header := make(http.Header)
+	var method, authority, path string
+	for _, f := range st.reqFields {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":authority":
+			authority = f.Value
+		case ":path":
+			path = f.Value
+		default:
+			if !strings.HasPrefix(f.Name, ":") {
+				header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+			}
+		}
+	}
+	// Cookies may be split across fields to compress better
+	if cookies := header.Values("Cookie"); len(cookies) > 1 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	host := authority
+	if host == "" {
+		host = header.Get("Host")
+	}
+	uri := path
+	if method == http.MethodConnect {
+		uri = authority
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		u = &url.URL{Path: path}
+	}
+	httpReq := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		Host:          host,
+		RequestURI:    uri,
+		ContentLength: contentLength(header, st.reqBody.size),
+		Body:          st.reqBody.reader(),
+		Trailer:       st.reqTrailer,
+	}
+	req := c.s.newRequest(httpReq, c.dnsCache, st.reqTS)
+	st.req = req
+	c.s.Stats.Requests.Add(1)
+	c.h.HandleRequest(req)
+	req.release()
+}
+
+func (c *h2Conn) response(st *h2Stream) {
+	header := make(http.Header)
+	code, _ := strconv.Atoi(pseudo(st.respFields, ":status"))
+	for _, f := range st.respFields {
+		if !strings.HasPrefix(f.Name, ":") {
+			header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		}
+	}
+	httpResp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		ContentLength: contentLength(header, st.respBody.size),
+		Body:          st.respBody.reader(),
+		Trailer:       st.respTrailer,
+	}
+	resp := c.s.newResponse(httpResp, st.req, st.respTS)
+	if st.respEvents != nil {
+		st.respEvents.finish(&resp.Message)
+	}
+	st.respFields = nil
+	c.s.Stats.Responses.Add(1)
+	c.h.HandleResponse(resp)
+	resp.release()
+}
+
+// contentLength is the length a message declares, or the length of what
+// was sent when it declares none.
+func contentLength(h http.Header, sent int64) int64 {
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		return n
+	}
+	return sent
+}
+
+// close reports the streams left open when the connection ends, in the
+// order they were opened.
+func (c *h2Conn) close() {
+	ids := make([]uint32, 0, len(c.streams))
+	for id := range c.streams {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		c.finish(c.streams[id])
+	}
+}
+
+// stepH2 feeds the HTTP/2 decoder the payload that has arrived, split
+// back into the directions it was sent in.
+func (s *Stream) stepH2(dnsCache *dns.Cache, h Handler) (done bool, err error) {
+	s.h2.dnsCache, s.h2.h = dnsCache, h
+	for s.buf.Buffered() > 0 || s.r.Len() > 0 {
+		off := s.r.offset() - int64(s.buf.Buffered())
+		m := s.r.markAt(off)
+		n := min(m.end-off, chunkSize)
+		if n <= 0 {
+			break
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(s.buf, p); err != nil {
+			break
+		}
+		s.h2.feed(p, m.server, m.ts)
+		if s.h2.failed {
+			break
+		}
+	}
+	if !s.r.isClosed() && !s.h2.failed {
+		return false, nil
+	}
+	s.h2.close()
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// TCPHealth counts signs of network trouble on a connection, in both
+// directions.
+type TCPHealth struct {
+	// Retransmissions are segments carrying payload that had already been
+	// seen.
+	Retransmissions int64
+	// OutOfOrder are segments that arrived ahead of a gap, either because
+	// they were reordered or because earlier data was lost.
+	OutOfOrder int64
+	// ZeroWindows are segments advertising a zero receive window.
+	ZeroWindows int64
+	Resets      int64
+}
+
+// Any reports whether anything was counted.
+func (h TCPHealth) Any() bool {
+	return h != TCPHealth{}
+}
+
+func (h TCPHealth) String() string {
+	var parts []string
+	add := func(n int64, what string) {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, what))
+		}
+	}
+	add(h.Retransmissions, "retransmitted")
+	add(h.OutOfOrder, "out of order")
+	add(h.ZeroWindows, "zero window")
+	add(h.Resets, "reset")
+	if len(parts) == 0 {
+		return "healthy"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// health accumulates a TCPHealth while the connection is reassembled and
+// its messages are parsed concurrently.
+type health struct {
+	retransmissions, outOfOrder, zeroWindows, resets atomic.Int64
+}
+
+func (h *health) add(d TCPHealth) {
+	h.retransmissions.Add(d.Retransmissions)
+	h.outOfOrder.Add(d.OutOfOrder)
+	h.zeroWindows.Add(d.ZeroWindows)
+	h.resets.Add(d.Resets)
+}
+
+func (h *health) snapshot() TCPHealth {
+	return TCPHealth{
+		Retransmissions: h.retransmissions.Load(),
+		OutOfOrder:      h.outOfOrder.Load(),
+		ZeroWindows:     h.zeroWindows.Load(),
+		Resets:          h.resets.Load(),
+	}
+}
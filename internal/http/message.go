@@ -0,0 +1,142 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Flow identifies the endpoints a message travelled between.
+type Flow struct {
+	SrcIP, SrcPort string
+	DstIP, DstPort string
+}
+
+func (f Flow) String() string {
+	return f.SrcIP + ":" + f.SrcPort + " -> " + f.DstIP + ":" + f.DstPort
+}
+
+// Reverse returns the flow in the opposite direction.
+func (f Flow) Reverse() Flow {
+	return Flow{SrcIP: f.DstIP, SrcPort: f.DstPort, DstIP: f.SrcIP, DstPort: f.SrcPort}
+}
+
+// Message holds the parts shared by requests and responses.
+type Message struct {
+	Flow
+	// Timestamp is the capture time of the first byte of the message.
+	Timestamp time.Time
+	Proto     string
+	Header    http.Header
+	// Trailer holds the header fields sent after the body, if any.
+	Trailer http.Header
+	// Body is the body as transferred, after any chunked encoding is
+	// removed but before Content-Encoding is decoded. At most the first
+	// 1MB is kept; use BodyReader for the rest.
+	Body []byte
+	// BodySize is the length of the whole body, which may exceed len(Body).
+	BodySize int64
+	// WireSize is the length of the body as sent, which with chunked
+	// transfer encoding includes the chunk framing and the trailer.
+	WireSize int64
+	// ChunkCount is how many chunks a chunked body was sent in, the last,
+	// empty one included, and ChunkError the first flaw in their framing.
+	// Chunks lists the first 1000 when the stream was asked to record them.
+	ChunkCount int
+	ChunkError string
+	Chunks     []Chunk
+	// Events are the events of a text/event-stream response without a
+	// Content-Encoding, parsed from the whole body however long it is.
+	// Only the first 16MB of their data are kept; EventCount counts every
+	// event.
+	Events     []Event
+	EventCount int
+	// SHA256 and MD5 are the hex digests of the whole body with its
+	// Content-Encoding removed, when the stream was asked for them.
+	SHA256, MD5 string
+	// TCP is the trouble seen on the connection up to the time the message
+	// was parsed, which is at least until its last byte arrived.
+	TCP TCPHealth
+	// Conn is the number of the packet that opened the message's connection
+	// and Seq the position of the request on it, counting from 1; responses
+	// carry their request's. Both are zero when unknown.
+	Conn int64
+	Seq  int
+	// Capture is the position, counting from 0, of the capture the message
+	// was read from when several are analyzed together.
+	Capture int
+	// Tunnel is the host:port that the proxy's CONNECT tunnel the message
+	// went through leads to, if it went through one.
+	Tunnel string
+
+	// spool holds the whole body when it was too long for Body.
+	spool *os.File
+}
+
+// ID identifies the transaction the message belongs to as "conn.seq", or
+// returns "" when it isn't known.
+func (m *Message) ID() string {
+	if m.Conn == 0 || m.Seq == 0 {
+		return ""
+	}
+	return strconv.FormatInt(m.Conn, 10) + "." + strconv.Itoa(m.Seq)
+}
+
+// DecodedBody returns the body with its Content-Encodings removed, as
+// DecodeContent does. The boolean reports whether any decoding was
+// applied.
+func (m *Message) DecodedBody() ([]byte, bool, error) {
+	return DecodeContent(m.Header, m.Body)
+}
+
+// Chunk is one chunk of a body sent with chunked transfer encoding.
+type Chunk struct {
+	// Offset is where the chunk's size line starts in the body as sent.
+	Offset int64
+	// Size is the length of the chunk's data, zero for the last chunk.
+	Size int64
+	// Ext holds the chunk extensions after the size, if any.
+	Ext string
+}
+
+// Event is one event of a Server-Sent Events stream.
+type Event struct {
+	// Timestamp is when the blank line ending the event was captured.
+	Timestamp time.Time
+	// Type is the event's name, "" for the default, message; ID and
+	// Retry are the id and reconnection time in milliseconds it set, if
+	// any.
+	Type, ID string
+	Retry    int
+	Data     string
+}
+
+// Request is an HTTP request reconstructed from a TCP stream.
+type Request struct {
+	Message
+	Method string
+	// URL is the absolute URL including scheme and host.
+	URL string
+	// URI is the request target exactly as sent on the wire.
+	URI           string
+	Host          string
+	ContentLength int64
+}
+
+// Response is an HTTP response reconstructed from a TCP stream.
+type Response struct {
+	Message
+	Status     string
+	StatusCode int
+	// Request is the request this response answers, or nil if it was not
+	// seen in the capture.
+	Request *Request
+}
+
+// Handler receives messages as streams are parsed. Methods are called
+// concurrently from the goroutines of different streams.
+type Handler interface {
+	HandleRequest(req *Request)
+	HandleResponse(resp *Response)
+}
@@ -0,0 +1,130 @@
+package http
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tcpReader buffers reassembled data until the parser consumes it. Writes
+// come from the assembler while the parser reads from a worker goroutine.
+// Reads block until data arrives or the stream is closed.
+type tcpReader struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    spillBuffer
+	closed bool
+	// read and written count bytes since the start of the stream; marks
+	// records when each written range was captured.
+	read, written int64
+	marks         []mark
+}
+
+// mark records the capture time of the payload ending at offset end, and
+// whether the server sent it. at is where the payload started in the
+// connection, with both directions counted, which orders the payload of
+// one direction against the other's.
+type mark struct {
+	end    int64
+	ts     time.Time
+	server bool
+	at     int64
+}
+
+func (t *tcpReader) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.buf.Len() == 0 && !t.closed && !t.buf.discarded {
+		t.cond.Wait()
+	}
+	if t.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, err := t.buf.Read(p)
+	t.read += int64(n)
+	return n, err
+}
+
+func (t *tcpReader) write(p []byte, ts time.Time, server bool) {
+	t.writeAt(p, ts, server, -1)
+}
+
+// writeAt writes payload that started at offset at of the connection, or
+// at the end of what has been written when at is negative.
+func (t *tcpReader) writeAt(p []byte, ts time.Time, server bool, at int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buf.discarded {
+		return
+	}
+	if at < 0 {
+		at = t.written
+	}
+	t.buf.Write(p)
+	t.written += int64(len(p))
+	t.marks = append(t.marks, mark{end: t.written, ts: ts, server: server, at: at})
+	t.cond.Broadcast()
+}
+
+// offset returns how many bytes have been read from the stream.
+func (t *tcpReader) offset() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.read
+}
+
+// timeAt returns the capture time of the byte at offset off. Offsets must
+// be queried in increasing order since older marks are discarded.
+func (t *tcpReader) timeAt(off int64) time.Time {
+	return t.markAt(off).ts
+}
+
+// markAt returns the mark of the payload holding the byte at offset off,
+// under the same ordering rule as timeAt.
+func (t *tcpReader) markAt(off int64) mark {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.marks) > 1 && t.marks[0].end <= off {
+		t.marks = t.marks[1:]
+	}
+	if len(t.marks) == 0 {
+		return mark{}
+	}
+	return t.marks[0]
+}
+
+func (t *tcpReader) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *tcpReader) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+func (t *tcpReader) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Len()
+}
+
+// peek returns a copy of up to n unread bytes without consuming them.
+func (t *tcpReader) peek(n int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Peek(n)
+}
+
+// discard frees the buffered payload and drops any that arrives later.
+func (t *tcpReader) discard() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf.Discard()
+	t.marks = nil
+	t.cond.Broadcast()
+}
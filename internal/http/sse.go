@@ -0,0 +1,146 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxEventData is how much event data of a Server-Sent Events stream is
+// kept; later events are only counted.
+const maxEventData = 16 << 20
+
+// isEventStream reports whether a response is a Server-Sent Events stream
+// whose events can be parsed as it is read, which takes it to have no
+// Content-Encoding.
+func isEventStream(contentType, contentEncoding string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/event-stream" && (contentEncoding == "" || strings.EqualFold(contentEncoding, "identity"))
+}
+
+// sseParser parses the events of a text/event-stream body as it arrives,
+// as the HTML standard has browsers do, so that they are all seen however
+// long the body is.
+type sseParser struct {
+	line []byte
+	// cr is set when the last line ended with a CR, which an LF may
+	// follow as part of the same line ending.
+	cr      bool
+	started bool
+	// The fields of the event being read
+	data      []byte
+	typ, id   string
+	retry     int
+	count     int
+	dataBytes int
+	events    []Event
+}
+
+// write parses the next bytes of the body; at returns the capture time of
+// the byte at an index of b.
+func (p *sseParser) write(b []byte, at func(i int) time.Time) {
+	for i := 0; i < len(b); {
+		if p.cr {
+			p.cr = false
+			if b[i] == '\n' {
+				i++
+				continue
+			}
+		}
+		j := bytes.IndexAny(b[i:], "\r\n")
+		if j < 0 {
+			p.appendLine(b[i:])
+			return
+		}
+		p.appendLine(b[i : i+j])
+		p.cr = b[i+j] == '\r'
+		p.endLine(at(i + j))
+		p.line = p.line[:0]
+		i += j + 1
+	}
+}
+
+// appendLine adds to the line being read, up to maxBody of it.
+func (p *sseParser) appendLine(b []byte) {
+	p.line = append(p.line, b[:min(len(b), maxBody-len(p.line))]...)
+}
+
+// endLine handles a line; ts is when its end arrived.
+func (p *sseParser) endLine(ts time.Time) {
+	line := p.line
+	if !p.started {
+		line = bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))
+		p.started = true
+	}
+	if len(line) == 0 {
+		p.dispatch(ts)
+		return
+	}
+	if line[0] == ':' {
+		// A comment, often sent to keep the connection open
+		return
+	}
+	name, value, _ := bytes.Cut(line, []byte(":"))
+	value = bytes.TrimPrefix(value, []byte(" "))
+	switch string(name) {
+	case "event":
+		p.typ = string(value)
+	case "data":
+		p.data = append(append(p.data, value...), '\n')
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 {
+			p.id = string(value)
+		}
+	case "retry":
+		if n, err := strconv.Atoi(string(value)); err == nil && n >= 0 {
+			p.retry = n
+		}
+	}
+}
+
+// dispatch ends the event being read, which is only one if it had data.
+func (p *sseParser) dispatch(ts time.Time) {
+	if len(p.data) > 0 {
+		p.count++
+		data := p.data[:len(p.data)-1]
+		if p.dataBytes+len(data) <= maxEventData {
+			p.dataBytes += len(data)
+			p.events = append(p.events, Event{Timestamp: ts, Type: p.typ, ID: p.id, Data: string(data), Retry: p.retry})
+		}
+	}
+	p.data, p.typ, p.id, p.retry = p.data[:0], "", "", 0
+}
+
+// finish sets the events found in m's body, which has been read. An event
+// the body ended in the middle of is dropped, as browsers drop it.
+func (p *sseParser) finish(m *Message) {
+	m.Events, m.EventCount = p.events, p.count
+}
+
+// sseReader passes a text/event-stream body through as it is read from
+// the connection, parsing its events and timing each by the packet that
+// ended it.
+type sseReader struct {
+	io.ReadCloser
+	d *h1Dir
+	p sseParser
+	// start is where the body starts in what its side sent, and read how
+	// much of it has been read.
+	start, read int64
+}
+
+func (r *sseReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.write(b[:n], func(i int) time.Time {
+		off := r.read + int64(i)
+		if c := r.d.c.s.chunks; c != nil {
+			off = c.wireOffset(off)
+		}
+		return r.d.r.timeAt(r.start + off)
+	})
+	r.read += int64(n)
+	return n, err
+}
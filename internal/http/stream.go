@@ -3,165 +3,554 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/stats"
+	"github.com/pcap-analyzer/internal/tlsdecrypt"
 )
 
+// ErrNotHTTP is returned by Step when a connection carries neither HTTP
+// nor TLS, or TLS decrypted to something else, so the caller can hand the
+// payload to another parser.
+var ErrNotHTTP = errors.New("stream does not contain HTTP")
+
+// Stream reconstructs HTTP messages from the reassembled payload of a
+// single TCP connection. Parsing is incremental: Step consumes whatever
+// messages have arrived and is called again when more payload does, so an
+// idle connection doesn't tie up a goroutine.
 type Stream struct {
 	net, transport gopacket.Flow
 	r              tcpReader
-	reversed       bool
+
+	// started is set once the payload has been identified as HTTP.
+	started bool
+	// Requests waiting for their response, oldest first
+	pending []*pendingRequest
+	// h1 parses the connection while it is HTTP/1.x, and h2 decodes it
+	// once it has turned out to be HTTP/2, reading it with buf
+	h1  *h1Conn
+	h2  *h2Conn
+	buf *bufio.Reader
+	// tls decrypts the connection when it carries TLS that Keys has the
+	// secrets of; appended is set once any payload has been.
+	tls      *tlsConn
+	appended bool
+
+	// SpoolBodies keeps bodies longer than the in-memory limit in
+	// temporary files so handlers can read them in full with
+	// Message.BodyReader. It must be set before the first Step.
+	SpoolBodies bool
+	// Stats counts the messages parsed and the errors found. NewStream
+	// gives each stream counters of its own; point it at shared ones to
+	// aggregate.
+	Stats *stats.Counters
+	// HashBodies sets the SHA-256 of every body, and HashMD5 its MD5 as
+	// well. Bodies longer than the in-memory limit are hashed in full only
+	// with SpoolBodies.
+	HashBodies, HashMD5 bool
+	// RecordChunks lists the chunks of chunked bodies in Message.Chunks;
+	// they are counted either way.
+	RecordChunks bool
+	// Conn is the number of the packet that opened the connection, which
+	// messages carry to identify their transaction.
+	Conn int64
+	// Keys, if set, decrypts TLS connections whose secrets it holds, so
+	// that the HTTP they carry is parsed. It must be set before the first
+	// Append.
+	Keys *tlsdecrypt.Keys
+
+	// chunks follows the framing of the chunked body being read.
+	chunks *chunkScanner
+
+	// requests counts the requests parsed so far.
+	requests int
+	health   health
+
+	// tunnel parses what a CONNECT tunnel set up on the connection
+	// carries, the rest of the connection, once there is one; mu guards
+	// handing the payload over to it. target is the host:port the tunnel
+	// of a stream made for one leads to.
+	mu     sync.Mutex
+	tunnel *Stream
+	target string
 }
 
-type tcpReader struct {
-	bytes.Buffer
-	ident    string
-	isClient bool
-	parent   *Stream
+// NewStream returns a stream that keeps at most maxBuffer bytes of unread
+// payload in memory, spilling the rest to a temporary file. Zero means no
+// limit.
+func NewStream(net, transport gopacket.Flow, maxBuffer int) *Stream {
+	s := &Stream{
+		net:       net,
+		transport: transport,
+	}
+	s.Stats = &stats.Counters{}
+	s.r.cond = sync.NewCond(&s.r.mu)
+	s.r.buf.limit = maxBuffer
+	return s
 }
 
-func (t *tcpReader) Read(p []byte) (int, error) {
-	n, err := t.Buffer.Read(p)
-	return n, err
+// Append adds reassembled payload captured at ts to the stream; server is
+// set for payload the server sent.
+func (s *Stream) Append(p []byte, ts time.Time, server bool) {
+	if len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnel != nil {
+		s.tunnel.Append(p, ts, server)
+		return
+	}
+	if !s.appended {
+		s.appended = true
+		if s.Keys != nil && LooksLikeTLS(p) {
+			s.tls = newTLSConn(s.Keys)
+		}
+	}
+	if s.tls != nil {
+		s.tls.write(&s.r, p, ts, server)
+		return
+	}
+	s.r.write(p, ts, server)
 }
 
-func (s *Stream) Run(dnsCache *dns.Cache) {
-	buf := bufio.NewReader(&s.r)
+// AddHealth records TCP trouble seen on the connection. Messages carry the
+// totals as of when they were parsed.
+func (s *Stream) AddHealth(h TCPHealth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnel != nil {
+		s.tunnel.AddHealth(h)
+		return
+	}
+	s.health.add(h)
+}
+
+// Close marks the end of the connection's payload.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnel != nil {
+		s.tunnel.Close()
+	}
+	return s.r.Close()
+}
+
+// Discard releases the stream's buffered payload, including any spilled to
+// disk. Payload appended afterwards is dropped.
+func (s *Stream) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnel != nil {
+		s.tunnel.Discard()
+	}
+	if s.h1 != nil {
+		s.h1.discard()
+	}
+	s.r.discard()
+}
+
+// Peek returns up to n bytes of unread payload without consuming them.
+func (s *Stream) Peek(n int) []byte {
+	return s.r.peek(n)
+}
+
+// Reader returns a reader over the unread payload that blocks until more
+// data arrives and reports io.EOF once the stream is closed.
+func (s *Stream) Reader() io.Reader {
+	return &s.r
+}
+
+// LooksLikeHTTP reports whether payload starts like an HTTP/1.x request or
+// response.
+func LooksLikeHTTP(payload []byte) bool {
+	if bytes.HasPrefix(payload, []byte("HTTP/")) {
+		return true
+	}
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"} {
+		if bytes.HasPrefix(payload, []byte(method+" ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// LooksLikeTLS reports whether payload starts with a TLS handshake record.
+func LooksLikeTLS(payload []byte) bool {
+	return len(payload) >= 3 && payload[0] == 0x16 && payload[1] == 0x03
+}
+
+// Step parses every message that has arrived so far, passing each one to
+// h. It returns done once the stream has been fully parsed or abandoned;
+// otherwise it should be called again when more payload arrives or the
+// stream is closed. A message that has only partly arrived is waited for.
+// ErrNotHTTP is returned, without consuming any payload, when the
+// connection is neither HTTP nor TLS. Once a CONNECT request has set a
+// tunnel up, what the tunnel carries is parsed as a connection of its own.
+func (s *Stream) Step(dnsCache *dns.Cache, h Handler) (done bool, err error) {
+	if s.tunnel != nil {
+		return s.stepTunnel(dnsCache, h)
+	}
+	if !s.started {
+		// Wait for enough payload to tell what the connection carries
+		first := s.r.peek(8)
+		if len(first) < 8 && !s.r.isClosed() {
+			return false, nil
+		}
+		if len(first) == 0 {
+			if s.tls != nil {
+				// Nothing could be decrypted
+				s.Stats.TLSFlows.Add(1)
+			}
+			return true, nil
+		}
+		if s.tls != nil {
+			s.Stats.DecryptedFlows.Add(1)
+		}
+		if LooksLikeTLS(first) {
+			s.Stats.TLSFlows.Add(1)
+			return true, nil
+		}
+		// Over TLS the server may speak first, so ALPN decides rather than
+		// the client's preface
+		h2 := LooksLikeHTTP2(first) || s.tls != nil && s.tls.dec.ALPN() == "h2"
+		if !h2 && !LooksLikeHTTP(first) {
+			return true, ErrNotHTTP
+		}
+		s.started = true
+		if h2 {
+			s.buf = bufio.NewReader(&s.r)
+			s.h2 = newH2Conn(s)
+		} else {
+			s.h1 = newH1Conn(s)
+		}
+	}
+	if s.h2 != nil {
+		return s.stepH2(dnsCache, h)
+	}
+
 	for {
-		if s.r.isClient {
-			req, err := http.ReadRequest(buf)
+		// Parse whichever side's next message started first. Only start on
+		// a message once some of it has arrived, so that an idle
+		// keep-alive connection gives its worker back
+		d := s.h1.next()
+		if d == nil {
+			return s.r.isClosed(), nil
+		}
+		s.h1.cur = d
+
+		peek, err := d.buf.Peek(8)
+		if err != nil {
+			// The side ended with a scrap too short to be a message
+			d.buf.Discard(d.buf.Buffered())
+			continue
+		}
+
+		// Check if this looks like TLS handshake data
+		if LooksLikeTLS(peek) {
+			return true, nil
+		}
+
+		start := d.r.timeAt(d.consumed())
+
+		if d.server {
+			if !bytes.HasPrefix(peek, []byte("HTTP/")) {
+				// Not a response; nothing more can be parsed
+				s.Stats.ParseErrors.Add(1)
+				return true, nil
+			}
+			// Parse as HTTP response, using the request it answers so
+			// that HEAD responses are framed correctly
+			httpReq := &http.Request{Method: "GET"}
+			var req *Request
+			if len(s.pending) > 0 {
+				httpReq, req = s.pending[0].httpReq, s.pending[0].req
+			}
+			resp, err := http.ReadResponse(d.buf, httpReq)
 			if err != nil {
-				return
+				s.Stats.ParseErrors.Add(1)
+				// Skip the malformed response and carry on with
+				// whatever follows it
+				continue
+			}
+			if resp.StatusCode/100 == 1 && resp.StatusCode != http.StatusSwitchingProtocols {
+				// An interim response, such as 100 Continue, comes ahead
+				// of the final one to the same request, which is the one
+				// that answers it
+				continue
+			}
+			if len(s.pending) > 0 {
+				s.pending = s.pending[1:]
+			}
+			tunnel := httpReq.Method == "CONNECT" && resp.StatusCode/100 == 2
+			if tunnel {
+				// The tunnel starts right after the header, which net/http
+				// would take for a body lasting until the connection closes
+				resp.Body = http.NoBody
+			}
+			r := s.newResponse(resp, req, start)
+			s.Stats.Responses.Add(1)
+			h.HandleResponse(r)
+			r.release()
+			if tunnel {
+				s.openTunnel(httpReq.Host)
+				s.Stats.Tunnels.Add(1)
+				return s.stepTunnel(dnsCache, h)
+			}
+			if isH2CUpgrade(httpReq, resp) {
+				// The rest of the connection is HTTP/2, starting with
+				// the response to this request on stream 1
+				s.h2 = newH2Conn(s)
+				s.h2.upgraded(req)
+				s.h2.dnsCache, s.h2.h = dnsCache, h
+				s.h1.unread(func(p []byte, ts time.Time, server bool) {
+					s.h2.feed(p, server, ts)
+				})
+				s.buf = bufio.NewReader(&s.r)
+				return s.stepH2(dnsCache, h)
 			}
-
-			s.printHTTPRequest(req, dnsCache)
 		} else {
-			resp, err := http.ReadResponse(buf, nil)
+			// Parse as HTTP request
+			httpReq, err := http.ReadRequest(d.buf)
 			if err != nil {
-				return
+				s.Stats.ParseErrors.Add(1)
+				// Either the stream ended mid-request or this isn't a
+				// request at all; nothing more can be parsed
+				return true, nil
+			}
+			req := s.newRequest(httpReq, dnsCache, start)
+			if len(s.pending) == maxPending {
+				// The responses were never captured; stop waiting for
+				// the oldest rather than queue without bound
+				s.pending = s.pending[1:]
 			}
+			s.pending = append(s.pending, &pendingRequest{httpReq: httpReq, req: req})
+			s.Stats.Requests.Add(1)
+			h.HandleRequest(req)
+			req.release()
+		}
+	}
+}
+
+// openTunnel hands the rest of the connection over to a stream of its own
+// parsing what a CONNECT tunnel to target carries, which may be TLS that
+// Keys decrypts.
+func (s *Stream) openTunnel(target string) {
+	t := NewStream(s.net, s.transport, s.r.buf.limit)
+	t.SpoolBodies, t.Stats = s.SpoolBodies, s.Stats
+	t.HashBodies, t.HashMD5, t.RecordChunks = s.HashBodies, s.HashMD5, s.RecordChunks
+	t.Conn, t.Keys = s.Conn, s.Keys
+	t.requests, t.target = s.requests, target
+	t.health.add(s.health.snapshot())
 
-			s.printHTTPResponse(resp, dnsCache)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// What has arrived of the tunnel so far, in the order it was captured
+	s.h1.unread(t.Append)
+	off := s.r.offset()
+	var rest []byte
+	for s.r.Len() > 0 {
+		b := make([]byte, s.r.Len())
+		n, _ := s.r.Read(b)
+		rest = append(rest, b[:n]...)
+	}
+	for len(rest) > 0 {
+		m := s.r.markAt(off)
+		n := len(rest)
+		if m.end > off && m.end-off < int64(n) {
+			n = int(m.end - off)
 		}
+		t.Append(rest[:n], m.ts, m.server)
+		rest, off = rest[n:], off+int64(n)
+	}
+	if s.r.isClosed() {
+		t.Close()
+	}
+	s.tunnel = t
+}
+
+// stepTunnel parses what the connection's CONNECT tunnel carries. A tunnel
+// of something other than HTTP or TLS is left alone.
+func (s *Stream) stepTunnel(dnsCache *dns.Cache, h Handler) (bool, error) {
+	done, err := s.tunnel.Step(dnsCache, h)
+	if errors.Is(err, ErrNotHTTP) {
+		return true, nil
 	}
+	return done, err
+}
+
+// isChunked reports whether a message's body was sent with chunked
+// transfer encoding, the only one net/http accepts.
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
 }
 
-func (s *Stream) printHTTPRequest(req *http.Request, dnsCache *dns.Cache) {
-	srcIP := s.net.Src().String()
-	dstIP := s.net.Dst().String()
-	srcPort := s.transport.Src().String()
-	dstPort := s.transport.Dst().String()
+// maxPending is how many requests a stream holds while waiting for their
+// responses.
+const maxPending = 64
 
-	srcFQDN := dnsCache.GetWithRDNS(srcIP)
-	dstFQDN := dnsCache.GetWithRDNS(dstIP)
+type pendingRequest struct {
+	httpReq *http.Request
+	req     *Request
+}
 
-	fmt.Printf("\n=== HTTP Request ===\n")
-	fmt.Printf("Time: %s\n", time.Now().Format(time.RFC3339))
-	fmt.Printf("Source: %s:%s", srcIP, srcPort)
-	if srcFQDN != "" {
-		fmt.Printf(" (%s)", srcFQDN)
+func (s *Stream) flow() Flow {
+	return Flow{
+		SrcIP:   s.net.Src().String(),
+		SrcPort: s.transport.Src().String(),
+		DstIP:   s.net.Dst().String(),
+		DstPort: s.transport.Dst().String(),
 	}
-	fmt.Printf("\n")
-	fmt.Printf("Destination: %s:%s", dstIP, dstPort)
-	if dstFQDN != "" {
-		fmt.Printf(" (%s)", dstFQDN)
+}
+
+func (s *Stream) newRequest(req *http.Request, dnsCache *dns.Cache, ts time.Time) *Request {
+	flow := s.flow()
+	dstIP := flow.DstIP
+	dstPort := flow.DstPort
+	var tunnelHost string
+	if s.target != "" {
+		// Requests through a tunnel go to its target rather than to the
+		// proxy the connection is with
+		if host, port, err := net.SplitHostPort(s.target); err == nil {
+			tunnelHost, dstPort = host, port
+		}
+	}
+
+	// Use DNS cache for forward DNS, skip RDNS lookups to avoid blocking
+	dstFQDN := ""
+	if fqdn, ok := dnsCache.Get(dstIP); ok {
+		dstFQDN = fqdn
+		s.Stats.DNSCacheHits.Add(1)
+	} else {
+		s.Stats.DNSCacheMisses.Add(1)
 	}
-	fmt.Printf("\n")
+
 	// Construct full URL with protocol and hostname
 	protocol := "http"
-	if dstPort == "443" || dstPort == "8443" {
+	if s.tls != nil || dstPort == "443" || dstPort == "8443" {
 		protocol = "https"
 	}
-	
+
 	hostname := req.Host
 	if hostname == "" {
-		// Fallback to destination FQDN or IP
-		if dstFQDN != "" {
+		if tunnelHost != "" {
+			hostname = tunnelHost
+		} else if dstFQDN != "" {
 			hostname = dstFQDN
 		} else {
 			hostname = dstIP
 		}
 	}
-	
-	// Remove port from hostname if it's a standard port
-	if (protocol == "http" && (dstPort == "80")) || (protocol == "https" && (dstPort == "443")) {
-		// Keep hostname as-is for standard ports
-	} else {
-		// Add port for non-standard ports
+
+	if (protocol == "http" && dstPort != "80") || (protocol == "https" && dstPort != "443") {
 		if !strings.Contains(hostname, ":") {
 			hostname = hostname + ":" + dstPort
 		}
 	}
-	
+
 	fullURL := fmt.Sprintf("%s://%s%s", protocol, hostname, req.URL.Path)
 	if req.URL.RawQuery != "" {
 		fullURL += "?" + req.URL.RawQuery
 	}
-	
-	fmt.Printf("Method: %s\n", req.Method)
-	fmt.Printf("URL: %s\n", fullURL)
-	fmt.Printf("Proto: %s\n", req.Proto)
-	fmt.Printf("Host: %s\n", req.Host)
-
-	fmt.Println("\nHeaders:")
-	for name, values := range req.Header {
-		for _, value := range values {
-			fmt.Printf("  %s: %s\n", name, value)
-		}
-	}
 
-	if req.Body != nil {
-		body := make([]byte, 1024*1024) // 1MB max
-		n, _ := req.Body.Read(body)
-		if n > 0 {
-			fmt.Printf("\nRequest Body (%d bytes):\n%s\n", n, string(body[:n]))
-		}
-		req.Body.Close()
+	r := &Request{
+		Message: Message{
+			Flow:      flow,
+			Timestamp: ts,
+			Proto:     req.Proto,
+			Header:    req.Header,
+			Trailer:   req.Trailer,
+			Conn:      s.Conn,
+			Seq:       s.requests + 1,
+			Tunnel:    s.target,
+		},
+		Method:        req.Method,
+		URL:           fullURL,
+		URI:           req.RequestURI,
+		Host:          req.Host,
+		ContentLength: req.ContentLength,
 	}
+	s.requests++
+	s.readBody(&r.Message, req.Body, isChunked(req.TransferEncoding))
+	// A chunked body's trailer is only known once it has been read
+	r.Trailer = req.Trailer
+	r.TCP = s.health.snapshot()
+	return r
 }
 
-func (s *Stream) printHTTPResponse(resp *http.Response, dnsCache *dns.Cache) {
-	srcIP := s.net.Src().String()
-	dstIP := s.net.Dst().String()
-	srcPort := s.transport.Src().String()
-	dstPort := s.transport.Dst().String()
-
-	srcFQDN := dnsCache.GetWithRDNS(srcIP)
-	dstFQDN := dnsCache.GetWithRDNS(dstIP)
-
-	fmt.Printf("\n=== HTTP Response ===\n")
-	fmt.Printf("Time: %s\n", time.Now().Format(time.RFC3339))
-	fmt.Printf("Source: %s:%s", srcIP, srcPort)
-	if srcFQDN != "" {
-		fmt.Printf(" (%s)", srcFQDN)
+func (s *Stream) newResponse(resp *http.Response, req *Request, ts time.Time) *Response {
+	r := &Response{
+		Message: Message{
+			// The connection was opened by the client, so responses travel
+			// in the reverse direction
+			Flow:      s.flow().Reverse(),
+			Timestamp: ts,
+			Proto:     resp.Proto,
+			Header:    resp.Header,
+			Trailer:   resp.Trailer,
+			Conn:      s.Conn,
+			Tunnel:    s.target,
+		},
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Request:    req,
 	}
-	fmt.Printf("\n")
-	fmt.Printf("Destination: %s:%s", dstIP, dstPort)
-	if dstFQDN != "" {
-		fmt.Printf(" (%s)", dstFQDN)
+	if req != nil {
+		r.Seq = req.Seq
 	}
-	fmt.Printf("\n")
-	fmt.Printf("Status: %s\n", resp.Status)
-	fmt.Printf("Proto: %s\n", resp.Proto)
+	s.readBody(&r.Message, resp.Body, isChunked(resp.TransferEncoding))
+	r.Trailer = resp.Trailer
+	r.TCP = s.health.snapshot()
+	return r
+}
 
-	fmt.Println("\nHeaders:")
-	for name, values := range resp.Header {
-		for _, value := range values {
-			fmt.Printf("  %s: %s\n", name, value)
+// readBody reads a message body, counting what had to be dropped. The
+// size it had on the wire is measured from what was read of the
+// connection, and the framing of a chunked body and the events of a
+// Server-Sent Events stream followed as it is read.
+func (s *Stream) readBody(m *Message, body io.ReadCloser, chunked bool) {
+	if s.h2 != nil {
+		// HTTP/2 frames bodies itself
+		readBody(m, body, s.SpoolBodies)
+		m.WireSize = m.BodySize
+	} else {
+		d := s.h1.cur
+		start := d.consumed()
+		hasBody := body != nil && body != http.NoBody
+		var events *sseReader
+		if hasBody && isEventStream(m.Header.Get("Content-Type"), m.Header.Get("Content-Encoding")) {
+			events = &sseReader{ReadCloser: body, d: d, start: start}
+			body = events
 		}
-	}
-
-	if resp.Body != nil {
-		body := make([]byte, 1024*1024) // 1MB max
-		n, _ := resp.Body.Read(body)
-		if n > 0 {
-			fmt.Printf("\nResponse Body (%d bytes):\n%s\n", n, string(body[:n]))
+		if chunked && hasBody {
+			s.chunks = &chunkScanner{record: s.RecordChunks, follow: events != nil}
+			// What was read ahead of the body before it started
+			b, _ := d.buf.Peek(d.buf.Buffered())
+			s.chunks.Write(b)
+		}
+		readBody(m, body, s.SpoolBodies)
+		m.WireSize = d.consumed() - start
+		if s.chunks != nil {
+			s.chunks.finish(m)
+			s.chunks = nil
 		}
-		resp.Body.Close()
+		if events != nil {
+			events.p.finish(m)
+		}
+	}
+	if s.HashBodies || s.HashMD5 {
+		hashBody(m, s.HashBodies, s.HashMD5)
+	}
+	if m.Truncated() {
+		s.Stats.TruncatedBytes.Add(m.BodySize - int64(len(m.Body)))
 	}
 }
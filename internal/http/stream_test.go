@@ -0,0 +1,315 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// collector keeps the messages a stream parses.
+type collector struct {
+	mu    sync.Mutex
+	reqs  []*Request
+	resps []*Response
+}
+
+func (c *collector) HandleRequest(req *Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqs = append(c.reqs, req)
+}
+
+func (c *collector) HandleResponse(resp *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resps = append(c.resps, resp)
+}
+
+const (
+	testClient = "10.0.0.1:40000"
+	testServer = "10.0.0.2:80"
+)
+
+// testStream returns a stream between testClient and testServer.
+func testStream() *Stream {
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x9c, 0x40}, []byte{0, 80})
+	return NewStream(net, transport, 0)
+}
+
+// appendPackets appends the TCP payload of packets to s in the order
+// given, as reassembly would hand it over. The server is on port 80.
+func appendPackets(s *Stream, packets []testutil.Packet) {
+	for _, p := range packets {
+		packet := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.Default)
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			s.Append(tcp.Payload, p.CaptureInfo.Timestamp, tcp.SrcPort == 80)
+		}
+	}
+}
+
+// step parses what s holds, reporting whether it is finished.
+func step(t *testing.T, s *Stream, c *collector) bool {
+	t.Helper()
+	done, err := s.Step(dns.NewCache(), c)
+	if err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	return done
+}
+
+// parseCapture has a stream take the payload of b's packets in capture
+// order, as reassembly would for a capture without loss, and parses it to
+// the end.
+func parseCapture(t *testing.T, b *testutil.Builder) (*collector, *Stream) {
+	t.Helper()
+	s := testStream()
+	appendPackets(s, b.Packets())
+	s.Close()
+	c := &collector{}
+	for i := 0; !step(t, s, c); i++ {
+		if i == 100 {
+			t.Fatal("stream never finished")
+		}
+	}
+	return c, s
+}
+
+// summaries describes the requests and responses c holds.
+func (c *collector) summaries() (reqs, resps []string) {
+	for _, r := range c.reqs {
+		reqs = append(reqs, requestSummary(r))
+	}
+	for _, r := range c.resps {
+		resps = append(resps, responseSummary(r))
+	}
+	return reqs, resps
+}
+
+// checkMessages reports how the messages c holds differ from those wanted.
+func checkMessages(t *testing.T, c *collector, wantReqs, wantResps []string) {
+	t.Helper()
+	reqs, resps := c.summaries()
+	if got, want := strings.Join(reqs, "\n"), strings.Join(wantReqs, "\n"); got != want {
+		t.Errorf("requests:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := strings.Join(resps, "\n"), strings.Join(wantResps, "\n"); got != want {
+		t.Errorf("responses:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// requestSummary describes a request as its method and URL, with the body
+// if there is one.
+func requestSummary(r *Request) string {
+	s := r.Method + " " + r.URL
+	if len(r.Body) > 0 {
+		s += " " + string(r.Body)
+	}
+	return s
+}
+
+// responseSummary describes a response as its status code, the path of
+// the request it answers and its body.
+func responseSummary(r *Response) string {
+	path := "-"
+	if r.Request != nil {
+		path = r.Request.URI
+	}
+	s := fmt.Sprintf("%d %s", r.StatusCode, path)
+	if len(r.Body) > 0 {
+		s += " " + string(r.Body)
+	}
+	return s
+}
+
+func TestStreamHTTP1(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(b *testutil.Builder)
+		reqs    []string
+		resps   []string
+		trailer map[string]string
+	}{
+		{
+			name: "segmented headers and bodies",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.SegmentSize = 5
+				c.ClientSend([]byte("POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world"))
+				c.ServerSend([]byte("HTTP/1.1 201 Created\r\nContent-Length: 7\r\n\r\ncreated"))
+				c.Close()
+			},
+			reqs:  []string{"POST http://example.com/form hello world"},
+			resps: []string{"201 /form created"},
+		},
+		{
+			name: "pipelined requests",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.ClientSend([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /c HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na" +
+					"HTTP/1.1 404 Not Found\r\nContent-Length: 1\r\n\r\nb" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nc"))
+				c.Close()
+			},
+			reqs: []string{
+				"GET http://example.com/a",
+				"GET http://example.com/b",
+				"GET http://example.com/c",
+			},
+			resps: []string{"200 /a a", "404 /b b", "200 /c c"},
+		},
+		{
+			name: "request sent during a response",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.ClientSend([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nfi"))
+				c.ClientSend([]byte("GET /b HTTP/1.1\r\nHost: exa"))
+				c.ServerSend([]byte("rst"))
+				c.ClientSend([]byte("mple.com\r\n\r\n"))
+				c.ServerSend([]byte("!HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nsecond"))
+				c.Close()
+			},
+			reqs:  []string{"GET http://example.com/a", "GET http://example.com/b"},
+			resps: []string{"200 /a first!", "200 /b second"},
+		},
+		{
+			name: "HEAD then GET",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.ClientSend([]byte("HEAD /big HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"))
+				c.ClientSend([]byte("GET /small HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				c.Close()
+			},
+			reqs:  []string{"HEAD http://example.com/big", "GET http://example.com/small"},
+			resps: []string{"200 /big", "200 /small ok"},
+		},
+		{
+			name: "100-continue",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.ClientSend([]byte("PUT /upload HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				c.ClientSend([]byte("data"))
+				c.ServerSend([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+				c.Close()
+			},
+			reqs:  []string{"PUT http://example.com/upload data"},
+			resps: []string{"204 /upload"},
+		},
+		{
+			name: "chunked body with trailer",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.SegmentSize = 7
+				c.ClientSend([]byte("GET /stream HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+					"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+				c.Close()
+			},
+			reqs:    []string{"GET http://example.com/stream"},
+			resps:   []string{"200 /stream hello world"},
+			trailer: map[string]string{"X-Checksum": "abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testutil.NewBuilder()
+			tt.build(b)
+			c, s := parseCapture(t, b)
+			if n := s.Stats.ParseErrors.Load(); n != 0 {
+				t.Errorf("%d parse errors", n)
+			}
+			checkMessages(t, c, tt.reqs, tt.resps)
+			for k, v := range tt.trailer {
+				if len(c.resps) == 0 || c.resps[0].Trailer.Get(k) != v {
+					t.Errorf("trailer %s isn't %q", k, v)
+				}
+			}
+		})
+	}
+}
+
+// midStream builds a connection whose handshake wasn't captured, carrying
+// two exchanges, and returns its packets with all the server sent ahead of
+// all the client did, as reassembly hands over a connection it never saw
+// start once it is flushed.
+func midStream() []testutil.Packet {
+	b := testutil.NewBuilder()
+	c := b.TCPConn(testClient, testServer)
+	c.ClientSend([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"))
+	c.ClientSend([]byte("GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	c.ServerSend([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 1\r\n\r\nb"))
+	var client, server []testutil.Packet
+	for _, p := range b.Packets() {
+		packet := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.Default)
+		if tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); tcp.SrcPort == 80 {
+			server = append(server, p)
+		} else {
+			client = append(client, p)
+		}
+	}
+	return append(server, client...)
+}
+
+func TestStreamMidStream(t *testing.T) {
+	s := testStream()
+	appendPackets(s, midStream())
+	s.Close()
+	c := &collector{}
+	for !step(t, s, c) {
+	}
+	checkMessages(t, c,
+		[]string{"GET http://example.com/a", "GET http://example.com/b"},
+		[]string{"200 /a a", "404 /b b"})
+}
+
+func TestStreamResponseWaitsForRequest(t *testing.T) {
+	packets := midStream()
+	s := testStream()
+	c := &collector{}
+	// Only the server's side has been handed over so far
+	appendPackets(s, packets[:2])
+	if step(t, s, c) {
+		t.Fatal("stream finished before it was closed")
+	}
+	if len(c.resps) != 0 {
+		t.Fatalf("parsed %d responses before their requests arrived", len(c.resps))
+	}
+	appendPackets(s, packets[2:])
+	s.Close()
+	for !step(t, s, c) {
+	}
+	checkMessages(t, c,
+		[]string{"GET http://example.com/a", "GET http://example.com/b"},
+		[]string{"200 /a a", "404 /b b"})
+}
+
+func TestStreamUnansweredResponse(t *testing.T) {
+	// A response to a request from before the capture started is parsed
+	// once the connection ends
+	b := testutil.NewBuilder()
+	b.TCPConn(testClient, testServer).ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nx"))
+	s := testStream()
+	c := &collector{}
+	appendPackets(s, b.Packets())
+	if step(t, s, c) || len(c.resps) != 0 {
+		t.Fatal("response parsed while a request could still come")
+	}
+	s.Close()
+	for !step(t, s, c) {
+	}
+	checkMessages(t, c, nil, []string{"200 - x"})
+}
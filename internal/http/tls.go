@@ -0,0 +1,57 @@
+package http
+
+import (
+	"time"
+
+	"github.com/pcap-analyzer/internal/tlsdecrypt"
+)
+
+// tlsConn decrypts a TLS connection as its payload is appended, so that
+// the stream's reader holds the plaintext, which is parsed like that of
+// any other connection.
+type tlsConn struct {
+	dec *tlsdecrypt.Conn
+	// sides record when what each side sent was captured, to time the
+	// records decrypted from it.
+	sides [2]tlsSide
+	// decrypted is set once any plaintext has come out, and err once the
+	// connection can't be decrypted any further.
+	decrypted bool
+	err       error
+}
+
+type tlsSide struct {
+	written int64
+	marks   []mark
+}
+
+func newTLSConn(keys *tlsdecrypt.Keys) *tlsConn {
+	return &tlsConn{dec: tlsdecrypt.NewConn(keys)}
+}
+
+// write decrypts the payload one side sent, writing the plaintext of the
+// records it completes to r.
+func (c *tlsConn) write(r *tcpReader, p []byte, ts time.Time, server bool) {
+	if c.err != nil {
+		return
+	}
+	d := &c.sides[0]
+	if server {
+		d = &c.sides[1]
+	}
+	d.written += int64(len(p))
+	d.marks = append(d.marks, mark{end: d.written, ts: ts, server: server})
+	c.err = c.dec.Write(server, p, func(data []byte, start int64) {
+		r.write(data, d.timeAt(start), server)
+		c.decrypted = true
+	})
+}
+
+// timeAt returns when the byte at offset off of what the side sent was
+// captured. Offsets must be queried in increasing order.
+func (d *tlsSide) timeAt(off int64) time.Time {
+	for len(d.marks) > 1 && d.marks[0].end <= off {
+		d.marks = d.marks[1:]
+	}
+	return d.marks[0].ts
+}
@@ -0,0 +1,171 @@
+package index
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Build analyzes the capture at path and returns its index. DNS parsing is
+// always enabled so that names can be indexed.
+func Build(path string, opts analyzer.Options) (*Index, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b := newBuilder()
+	opts.DNS = true
+	if err := analyzer.Run(path, opts, b); err != nil {
+		return nil, err
+	}
+	ix := b.finish()
+	ix.Capture = path
+	ix.Size = info.Size()
+	ix.ModTime = info.ModTime()
+	return ix, nil
+}
+
+// builder accumulates an index as a capture is analyzed.
+type builder struct {
+	mu sync.Mutex
+	ix Index
+	// flows maps a flow key, in either direction, to the latest flow with
+	// those endpoints.
+	flows    map[string]int
+	requests map[*httpstream.Request]int
+	names    map[string]int
+}
+
+func newBuilder() *builder {
+	return &builder{
+		ix:       Index{Version: Version},
+		flows:    make(map[string]int),
+		requests: make(map[*httpstream.Request]int),
+		names:    make(map[string]int),
+	}
+}
+
+func flowKey(proto, srcIP, srcPort, dstIP, dstPort string) string {
+	return proto + " " + srcIP + " " + srcPort + " " + dstIP + " " + dstPort
+}
+
+func (b *builder) HandlePacket(p *analyzer.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ts := p.CaptureInfo.Timestamp
+	if b.ix.Packets == 0 {
+		b.ix.Start = ts
+	}
+	b.ix.End = ts
+	b.ix.Packets++
+
+	proto := "udp"
+	if p.TCP != nil {
+		proto = "tcp"
+	}
+	src, dst := p.Network.Endpoints()
+	sport, dport := p.Transport.Endpoints()
+	key := flowKey(proto, src.String(), sport.String(), dst.String(), dport.String())
+	i, ok := b.flows[key]
+	// A SYN without ACK starts a new connection even if the endpoints were
+	// used before
+	if !ok || (p.TCP != nil && p.TCP.SYN && !p.TCP.ACK) {
+		i = len(b.ix.Flows)
+		b.ix.Flows = append(b.ix.Flows, Flow{
+			Proto:       proto,
+			SrcIP:       src.String(),
+			SrcPort:     sport.String(),
+			DstIP:       dst.String(),
+			DstPort:     dport.String(),
+			First:       ts,
+			FirstPacket: p.Number,
+			Offset:      p.Offset,
+		})
+		b.flows[key] = i
+		b.flows[flowKey(proto, dst.String(), dport.String(), src.String(), sport.String())] = i
+	}
+	f := &b.ix.Flows[i]
+	f.Last = ts
+	f.Packets++
+	f.Bytes += int64(p.CaptureInfo.Length)
+}
+
+func (b *builder) HandleRequest(req *httpstream.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	flow, ok := b.flows[flowKey("tcp", req.SrcIP, req.SrcPort, req.DstIP, req.DstPort)]
+	if !ok {
+		flow = -1
+	}
+	b.requests[req] = len(b.ix.Requests)
+	b.ix.Requests = append(b.ix.Requests, Request{
+		Time:   req.Timestamp,
+		Method: req.Method,
+		Host:   req.Host,
+		URL:    req.URL,
+		Flow:   flow,
+	})
+}
+
+func (b *builder) HandleResponse(resp *httpstream.Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.requests[resp.Request]; ok && resp.Request != nil {
+		b.ix.Requests[i].Status = resp.StatusCode
+		delete(b.requests, resp.Request)
+	}
+}
+
+func (b *builder) HandleDNS(msg *dns.Message) {
+	if !msg.Response {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rr := range msg.Answers {
+		if rr.Type != "A" && rr.Type != "AAAA" {
+			continue
+		}
+		name := strings.TrimSuffix(rr.Name, ".")
+		i, ok := b.names[name]
+		if !ok {
+			i = len(b.ix.Names)
+			b.ix.Names = append(b.ix.Names, Name{Name: name, First: msg.Timestamp})
+			b.names[name] = i
+		}
+		n := &b.ix.Names[i]
+		if !contains(n.Addresses, rr.Value) {
+			n.Addresses = append(n.Addresses, rr.Value)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *builder) finish() *Index {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Requests arrive as their streams are parsed rather than in capture
+	// order
+	sort.SliceStable(b.ix.Requests, func(i, j int) bool {
+		return b.ix.Requests[i].Time.Before(b.ix.Requests[j].Time)
+	})
+	sort.Slice(b.ix.Names, func(i, j int) bool {
+		return b.ix.Names[i].Name < b.ix.Names[j].Name
+	})
+	ix := b.ix
+	return &ix
+}
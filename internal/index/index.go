@@ -0,0 +1,123 @@
+// Package index builds a compact summary of a capture (its flows, hosts,
+// requests and DNS names) that can be queried without reading the capture
+// again.
+package index
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Version is bumped whenever the index format changes incompatibly.
+const Version = 1
+
+// Index is the summary of one capture.
+type Index struct {
+	Version int `json:"version"`
+	// Capture is the path of the indexed capture, and Size and ModTime
+	// identify the version of it that was indexed.
+	Capture string    `json:"capture"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Start and End are the first and last packet timestamps.
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Packets int64     `json:"packets"`
+
+	Flows    []Flow    `json:"flows"`
+	Requests []Request `json:"requests"`
+	Names    []Name    `json:"names"`
+}
+
+// Flow is a TCP connection or UDP conversation, oriented from the endpoint
+// that sent its first packet.
+type Flow struct {
+	Proto   string    `json:"proto"`
+	SrcIP   string    `json:"src_ip"`
+	SrcPort string    `json:"src_port"`
+	DstIP   string    `json:"dst_ip"`
+	DstPort string    `json:"dst_port"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Packets int64     `json:"packets"`
+	Bytes   int64     `json:"bytes"`
+	// FirstPacket is the 1-based number of the flow's first packet, and
+	// Offset where its record starts in the file, or -1 for pcapng.
+	FirstPacket int64 `json:"first_packet"`
+	Offset      int64 `json:"offset"`
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%s %s:%s -> %s:%s", f.Proto, f.SrcIP, f.SrcPort, f.DstIP, f.DstPort)
+}
+
+// Request is an HTTP request and, when it was captured, its response.
+type Request struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	URL    string    `json:"url"`
+	// Status is zero when no response was seen.
+	Status int `json:"status,omitempty"`
+	// Flow is the position of the request's connection in Index.Flows, or
+	// -1 if the connection wasn't seen.
+	Flow int `json:"flow"`
+}
+
+// Name is a DNS name with the addresses it resolved to.
+type Name struct {
+	Name      string    `json:"name"`
+	Addresses []string  `json:"addresses,omitempty"`
+	First     time.Time `json:"first"`
+}
+
+// Load reads an index written by Save.
+func Load(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not an index: %w", path, err)
+	}
+	var ix Index
+	if err := json.NewDecoder(zr).Decode(&ix); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if ix.Version != Version {
+		return nil, fmt.Errorf("%s: index version %d, want %d; rebuild it", path, ix.Version, Version)
+	}
+	return &ix, nil
+}
+
+// Save writes the index to path as gzip-compressed JSON.
+func (ix *Index) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if err := json.NewEncoder(zw).Encode(ix); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Stale reports whether the capture has changed since it was indexed.
+func (ix *Index) Stale() bool {
+	info, err := os.Stat(ix.Capture)
+	if err != nil {
+		return false
+	}
+	return info.Size() != ix.Size || !info.ModTime().Equal(ix.ModTime)
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter selects flows and requests. Zero fields match everything.
+type Filter struct {
+	// Host matches request hosts and DNS names, ignoring case; a leading
+	// "*." matches any subdomain.
+	Host string
+	// IP matches either endpoint of a flow.
+	IP       string
+	From, To time.Time
+	Method   string
+	Status   int
+}
+
+func (f Filter) matchTime(first, last time.Time) bool {
+	if !f.From.IsZero() && last.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && first.After(f.To) {
+		return false
+	}
+	return true
+}
+
+func (f Filter) matchHost(host string) bool {
+	if f.Host == "" {
+		return true
+	}
+	host = strings.ToLower(stripPort(host))
+	pattern := strings.ToLower(f.Host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// FindFlows returns the flows matching f in capture order. A host filter
+// selects flows that carried requests for that host or went to addresses
+// it resolved to.
+func (ix *Index) FindFlows(f Filter) []Flow {
+	var hostFlows map[int]bool
+	var hostIPs map[string]bool
+	if f.Host != "" {
+		hostFlows = make(map[int]bool)
+		for _, r := range ix.Requests {
+			if r.Flow >= 0 && f.matchHost(r.Host) {
+				hostFlows[r.Flow] = true
+			}
+		}
+		hostIPs = make(map[string]bool)
+		for _, n := range ix.Names {
+			if f.matchHost(n.Name) {
+				for _, a := range n.Addresses {
+					hostIPs[a] = true
+				}
+			}
+		}
+	}
+
+	var out []Flow
+	for i, fl := range ix.Flows {
+		if f.IP != "" && fl.SrcIP != f.IP && fl.DstIP != f.IP {
+			continue
+		}
+		if f.Host != "" && !hostFlows[i] && !hostIPs[fl.DstIP] {
+			continue
+		}
+		if !f.matchTime(fl.First, fl.Last) {
+			continue
+		}
+		out = append(out, fl)
+	}
+	return out
+}
+
+// FindRequests returns the requests matching f in time order.
+func (ix *Index) FindRequests(f Filter) []Request {
+	var out []Request
+	for _, r := range ix.Requests {
+		if !f.matchHost(r.Host) || !f.matchTime(r.Time, r.Time) {
+			continue
+		}
+		if f.Method != "" && !strings.EqualFold(r.Method, f.Method) {
+			continue
+		}
+		if f.Status != 0 && r.Status != f.Status {
+			continue
+		}
+		if f.IP != "" {
+			if r.Flow < 0 {
+				continue
+			}
+			fl := ix.Flows[r.Flow]
+			if fl.SrcIP != f.IP && fl.DstIP != f.IP {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Host summarizes the requests made to one host.
+type Host struct {
+	Name        string
+	Requests    int
+	First, Last time.Time
+	// Addresses are those the host's name resolved to in the capture.
+	Addresses []string
+}
+
+// FindHosts returns the hosts requests matching f were sent to, busiest first.
+func (ix *Index) FindHosts(f Filter) []Host {
+	addrs := make(map[string][]string)
+	for _, n := range ix.Names {
+		addrs[strings.ToLower(n.Name)] = n.Addresses
+	}
+
+	byName := make(map[string]*Host)
+	var out []*Host
+	for _, r := range ix.FindRequests(f) {
+		h, ok := byName[r.Host]
+		if !ok {
+			h = &Host{
+				Name:      r.Host,
+				First:     r.Time,
+				Addresses: addrs[strings.ToLower(stripPort(r.Host))],
+			}
+			byName[r.Host] = h
+			out = append(out, h)
+		}
+		h.Requests++
+		h.Last = r.Time
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Requests > out[j].Requests
+	})
+	hosts := make([]Host, len(out))
+	for i, h := range out {
+		hosts[i] = *h
+	}
+	return hosts
+}
+
+// stripPort removes the port, if any, from a Host header value.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,244 @@
+package ioc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// feedTimeout bounds each request to a threat intelligence server.
+const feedTimeout = time.Minute
+
+var feedClient = &http.Client{Timeout: feedTimeout}
+
+// mispTypes are the MISP attribute types that can be matched against
+// traffic. Composite types such as filename|sha256 carry the indicator
+// after the bar; ip-dst|port carries it before.
+var mispTypes = []string{
+	"domain", "hostname", "domain|ip", "ip-src", "ip-dst", "ip-src|port", "ip-dst|port",
+	"url", "md5", "sha1", "sha256", "filename|md5", "filename|sha1", "filename|sha256",
+}
+
+// FetchMISP returns the attributes marked for IDS use on a MISP server,
+// using its REST API with an automation key. A non-empty last limits them
+// to those published within that long, such as "30d".
+func FetchMISP(server, key, last string) ([]Indicator, error) {
+	query := map[string]any{
+		"returnFormat":     "json",
+		"to_ids":           true,
+		"type":             mispTypes,
+		"includeEventTags": true,
+	}
+	if last != "" {
+		query["last"] = last
+	}
+	body, _ := json.Marshal(query)
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+"/attributes/restSearch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	data, err := fetch(req)
+	if err != nil {
+		return nil, fmt.Errorf("MISP: %w", err)
+	}
+
+	var result struct {
+		Response struct {
+			Attribute []struct {
+				Type  string `json:"type"`
+				Value string `json:"value"`
+				Event struct {
+					ID   string `json:"id"`
+					Info string `json:"info"`
+					Tag  []struct {
+						Name string `json:"name"`
+					} `json:"Tag"`
+				} `json:"Event"`
+				Tag []struct {
+					Name string `json:"name"`
+				} `json:"Tag"`
+			} `json:"Attribute"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("MISP: %w", err)
+	}
+	var indicators []Indicator
+	for _, a := range result.Response.Attribute {
+		var tags []string
+		for _, t := range a.Event.Tag {
+			tags = append(tags, t.Name)
+		}
+		for _, t := range a.Tag {
+			tags = append(tags, t.Name)
+		}
+		source := "MISP event " + a.Event.ID
+		if a.Event.Info != "" {
+			source += ": " + a.Event.Info
+		}
+		for _, v := range mispValues(a.Type, a.Value) {
+			indicators = append(indicators, Indicator{Value: v, Source: source, Comment: strings.Join(tags, ", ")})
+		}
+	}
+	return indicators, nil
+}
+
+// mispValues extracts the matchable values of an attribute.
+func mispValues(typ, value string) []string {
+	first, second, composite := strings.Cut(value, "|")
+	switch {
+	case !composite:
+		return []string{value}
+	case typ == "domain|ip":
+		return []string{first, second}
+	case strings.HasSuffix(typ, "|port"):
+		return []string{first}
+	default:
+		return []string{second}
+	}
+}
+
+// FetchTAXII returns the indicators in a TAXII 2.1 collection, given the
+// URL of the collection, following pages until the server has no more.
+// User and password are sent with basic authentication when user is set.
+func FetchTAXII(collection, user, password string) ([]Indicator, error) {
+	objectsURL := strings.TrimSuffix(collection, "/") + "/objects/"
+	var objects []json.RawMessage
+	next := ""
+	for {
+		u := objectsURL
+		if next != "" {
+			u += "?next=" + url.QueryEscape(next)
+		}
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/taxii+json;version=2.1")
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		data, err := fetch(req)
+		if err != nil {
+			return nil, fmt.Errorf("TAXII: %w", err)
+		}
+		var envelope struct {
+			More    bool              `json:"more"`
+			Next    string            `json:"next"`
+			Objects []json.RawMessage `json:"objects"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, fmt.Errorf("TAXII: %w", err)
+		}
+		objects = append(objects, envelope.Objects...)
+		if !envelope.More || envelope.Next == "" {
+			break
+		}
+		next = envelope.Next
+	}
+	return stixIndicators(objects)
+}
+
+func fetch(req *http.Request) ([]byte, error) {
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return data, nil
+}
+
+// ParseSTIX returns the indicators of a STIX 2 bundle.
+func ParseSTIX(data []byte) ([]Indicator, error) {
+	var bundle struct {
+		Type    string            `json:"type"`
+		Objects []json.RawMessage `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Type != "bundle" {
+		return nil, fmt.Errorf("not a STIX bundle")
+	}
+	return stixIndicators(bundle.Objects)
+}
+
+// stixObject holds the fields of the STIX objects indicators are
+// attributed with.
+type stixObject struct {
+	Type             string   `json:"type"`
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	Pattern          string   `json:"pattern"`
+	PatternType      string   `json:"pattern_type"`
+	Labels           []string `json:"labels"`
+	IndicatorTypes   []string `json:"indicator_types"`
+	RelationshipType string   `json:"relationship_type"`
+	SourceRef        string   `json:"source_ref"`
+	TargetRef        string   `json:"target_ref"`
+}
+
+// stixComparison matches the comparisons of a STIX pattern that test
+// matchable values, such as [domain-name:value = 'example.com'].
+var stixComparison = regexp.MustCompile(`(domain-name|ipv4-addr|ipv6-addr|url|file):(value|hashes\.'?(?:MD5|SHA-1|SHA-256)'?)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// stixIndicators extracts the values of STIX indicator patterns, attributed
+// to whatever the bundle says each indicator indicates, such as a malware
+// family or threat actor.
+func stixIndicators(raw []json.RawMessage) ([]Indicator, error) {
+	objects := make([]stixObject, 0, len(raw))
+	names := make(map[string]string)
+	for _, r := range raw {
+		var o stixObject
+		if err := json.Unmarshal(r, &o); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+		if o.Name != "" {
+			names[o.ID] = o.Name
+		}
+	}
+	indicates := make(map[string][]string)
+	for _, o := range objects {
+		if o.Type == "relationship" && o.RelationshipType == "indicates" && names[o.TargetRef] != "" {
+			indicates[o.SourceRef] = append(indicates[o.SourceRef], names[o.TargetRef])
+		}
+	}
+
+	var indicators []Indicator
+	for _, o := range objects {
+		if o.Type != "indicator" || (o.PatternType != "" && o.PatternType != "stix") {
+			continue
+		}
+		source := "STIX " + o.ID
+		if o.Name != "" {
+			source = "STIX: " + o.Name
+		}
+		attribution := append([]string(nil), indicates[o.ID]...)
+		sort.Strings(attribution)
+		attribution = append(attribution, o.IndicatorTypes...)
+		attribution = append(attribution, o.Labels...)
+		for _, m := range stixComparison.FindAllStringSubmatch(o.Pattern, -1) {
+			value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[3])
+			indicators = append(indicators, Indicator{Value: value, Source: source, Comment: strings.Join(attribution, ", ")})
+		}
+	}
+	return indicators, nil
+}
@@ -0,0 +1,274 @@
+// Package ioc loads indicators of compromise, such as the domains,
+// addresses, URLs and file hashes of a threat report, and matches traffic
+// against them.
+package ioc
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of indicator.
+const (
+	Domain = "domain"
+	IP     = "ip"
+	URL    = "url"
+	Hash   = "hash"
+)
+
+// Indicator is one indicator with what is known about where it came from.
+type Indicator struct {
+	// Value is the indicator as written, refanged.
+	Value string
+	Kind  string
+	// Source names where the indicator came from: a file, or the MISP
+	// event or STIX object it was part of.
+	Source string
+	// Comment is whatever followed the value on its line in a file, or the
+	// tags and threats a feed attributed it to.
+	Comment string
+}
+
+// Set is the indicators of one or more files.
+type Set struct {
+	domains map[string]*Indicator
+	ips     map[string]*Indicator
+	nets    []network
+	urls    map[string]*Indicator
+	hashes  map[string]*Indicator
+}
+
+type network struct {
+	*net.IPNet
+	indicator *Indicator
+}
+
+// NewSet returns an empty set.
+func NewSet() *Set {
+	return &Set{
+		domains: make(map[string]*Indicator),
+		ips:     make(map[string]*Indicator),
+		urls:    make(map[string]*Indicator),
+		hashes:  make(map[string]*Indicator),
+	}
+}
+
+// Load reads indicator files. Each line holds one indicator, optionally
+// followed by a comma or whitespace and a comment; blank lines and lines
+// starting with # are ignored. The kind is told from the value: an IP
+// address or CIDR network, a URL with a scheme, an MD5, SHA-1 or SHA-256
+// hex digest, or otherwise a domain, which also matches its subdomains.
+// Defanged values such as hxxp://example[.]com are accepted. Files ending
+// in .json are read as STIX 2 bundles instead.
+func Load(paths ...string) (*Set, error) {
+	s := NewSet()
+	for _, path := range paths {
+		if err := s.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Set) load(path string) error {
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		indicators, err := ParseSTIX(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return s.AddAll(indicators)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value, comment := line, ""
+		if i := strings.IndexAny(line, ", \t"); i >= 0 {
+			value, comment = line[:i], strings.TrimSpace(strings.TrimLeft(line[i:], ", \t"))
+		}
+		if err := s.Add(Indicator{Value: value, Source: filepath.Base(path), Comment: comment}); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// AddAll adds indicators, stopping at the first that can't be added.
+func (s *Set) AddAll(indicators []Indicator) error {
+	for _, ind := range indicators {
+		if err := s.Add(ind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds an indicator, telling its kind from its value as Load does. A
+// later indicator with the same value replaces an earlier one.
+func (s *Set) Add(i Indicator) error {
+	value := refang(strings.TrimSpace(i.Value))
+	ind := &Indicator{Value: value, Source: i.Source, Comment: i.Comment}
+	switch {
+	case strings.Contains(value, "://"):
+		ind.Kind = URL
+		s.urls[normalizeURL(value)] = ind
+	case net.ParseIP(value) != nil:
+		ind.Kind = IP
+		s.ips[net.ParseIP(value).String()] = ind
+	case strings.Contains(value, "/"):
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		ind.Kind = IP
+		s.nets = append(s.nets, network{n, ind})
+	case isDigest(value):
+		ind.Kind = Hash
+		s.hashes[strings.ToLower(value)] = ind
+	case strings.Contains(value, "."):
+		ind.Kind = Domain
+		s.domains[normalizeDomain(value)] = ind
+	default:
+		return fmt.Errorf("can't tell what kind of indicator %q is", value)
+	}
+	return nil
+}
+
+// refang undoes the usual ways of making indicators safe to paste.
+func refang(v string) string {
+	v = strings.NewReplacer("[.]", ".", "(.)", ".", "{.}", ".", "[:]", ":", "[://]", "://").Replace(v)
+	for _, p := range []string{"hxxp", "hXXp", "fxp"} {
+		if strings.HasPrefix(v, p) {
+			v = strings.Replace(v, "xx", "tt", 1)
+			v = strings.Replace(v, "XX", "tt", 1)
+			v = strings.Replace(v, "fxp", "ftp", 1)
+		}
+	}
+	return v
+}
+
+func isDigest(v string) bool {
+	if n := len(v); n != 2*md5.Size && n != 2*sha1.Size && n != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(v)
+	return err == nil
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// normalizeURL drops the scheme, which captures can't always tell, and
+// lowercases the host.
+func normalizeURL(u string) string {
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		u = rest
+	}
+	host, path, _ := strings.Cut(u, "/")
+	return strings.ToLower(host) + "/" + path
+}
+
+// Len returns the number of indicators.
+func (s *Set) Len() int {
+	return len(s.domains) + len(s.ips) + len(s.nets) + len(s.urls) + len(s.hashes)
+}
+
+// Domain returns the indicator matching name or one of its parent domains.
+// A port after the name is ignored.
+func (s *Set) Domain(name string) *Indicator {
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	name = normalizeDomain(name)
+	for name != "" {
+		if ind, ok := s.domains[name]; ok {
+			return ind
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return nil
+}
+
+// IP returns the indicator matching addr, exactly or by network.
+func (s *Set) IP(addr string) *Indicator {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if ind, ok := s.ips[ip.String()]; ok {
+		return ind
+	}
+	for _, n := range s.nets {
+		if n.Contains(ip) {
+			return n.indicator
+		}
+	}
+	return nil
+}
+
+// URL returns the indicator matching u, with or without its query.
+func (s *Set) URL(u string) *Indicator {
+	if len(s.urls) == 0 {
+		return nil
+	}
+	u = normalizeURL(u)
+	if ind, ok := s.urls[u]; ok {
+		return ind
+	}
+	if base, _, ok := strings.Cut(u, "?"); ok {
+		return s.urls[base]
+	}
+	return nil
+}
+
+// Hashes reports whether any indicators are hashes, and whether any of
+// those are MD5 digests.
+func (s *Set) Hashes() (any, md5Digests bool) {
+	for h := range s.hashes {
+		if len(h) == 2*md5.Size {
+			return true, true
+		}
+	}
+	return len(s.hashes) > 0, false
+}
+
+// Digest returns the indicator matching a hex digest.
+func (s *Set) Digest(digest string) *Indicator {
+	return s.hashes[strings.ToLower(digest)]
+}
+
+// Body returns the indicator matching the MD5, SHA-1 or SHA-256 digest of
+// body.
+func (s *Set) Body(body []byte) *Indicator {
+	if len(s.hashes) == 0 || len(body) == 0 {
+		return nil
+	}
+	m, s1, s256 := md5.Sum(body), sha1.Sum(body), sha256.Sum256(body)
+	for _, sum := range [][]byte{m[:], s1[:], s256[:]} {
+		if ind, ok := s.hashes[hex.EncodeToString(sum)]; ok {
+			return ind
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+// Package kafka publishes HTTP transactions to a Kafka topic as they are
+// reconstructed, one JSON message each, for the consumers downstream of a
+// capture pipeline.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// DefaultTopic is the topic transactions go to when none is named.
+const DefaultTopic = "pcap-transactions"
+
+// checkTimeout bounds reaching the brokers when the producer starts.
+const checkTimeout = 10 * time.Second
+
+// Config describes the brokers and topic transactions are published to.
+type Config struct {
+	// Brokers are the host:port addresses of the brokers first contacted;
+	// the rest of the cluster is found from them.
+	Brokers []string
+	// Topic is published to; empty means DefaultTopic. It must exist.
+	Topic string
+
+	// TLS connects to the brokers over TLS. CAFile, if set, verifies their
+	// certificates instead of the system roots, and CertFile and KeyFile
+	// present a client certificate. Insecure skips the verification.
+	TLS               bool
+	CAFile            string
+	CertFile, KeyFile string
+	Insecure          bool
+	// SASL authenticates as User with Password, by the mechanism named:
+	// "plain", "scram-sha-256" or "scram-sha-512". Empty means none.
+	SASL           string
+	User, Password string
+
+	// Capture fills the capture field of every event, telling the events
+	// of different sensors apart.
+	Capture string
+	// MaxBody is how many bytes of each body an event carries, with gzip
+	// removed; zero leaves bodies out.
+	MaxBody int
+}
+
+// Event is the JSON value of each message: one transaction, with the
+// response missing for requests never answered, or the request for
+// responses to requests that weren't seen. The message key is the
+// connection's client and server, so the transactions of a connection
+// keep their order on one partition.
+type Event struct {
+	ID         string    `json:"id,omitempty"`
+	Capture    string    `json:"capture,omitempty"`
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	ClientPort string    `json:"client_port"`
+	ServerIP   string    `json:"server_ip"`
+	ServerPort string    `json:"server_port"`
+	Request    *Message  `json:"request,omitempty"`
+	Response   *Message  `json:"response,omitempty"`
+	LatencyMs  float64   `json:"latency_ms,omitempty"`
+}
+
+// Message is a request or response of an Event.
+type Message struct {
+	Time       time.Time           `json:"time"`
+	Method     string              `json:"method,omitempty"`
+	URL        string              `json:"url,omitempty"`
+	Host       string              `json:"host,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	StatusText string              `json:"status_text,omitempty"`
+	Proto      string              `json:"proto,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	BodySize   int64               `json:"body_size"`
+	SHA256     string              `json:"sha256,omitempty"`
+	// Body is text, or base64 when BodyEncoding says so. BodyTruncated
+	// marks bodies longer than Config.MaxBody or than was captured.
+	Body          string `json:"body,omitempty"`
+	BodyEncoding  string `json:"body_encoding,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+// Producer is a handler publishing a transaction as soon as its response
+// is parsed, and the requests still unanswered when it is closed.
+// Messages are batched and sent by the Kafka client in the background, so
+// the capture isn't held up by the brokers.
+type Producer struct {
+	cfg Config
+	w   *kafkago.Writer
+
+	mu      sync.Mutex
+	pending map[*httpstream.Request]bool
+	closed  bool
+
+	sent   atomic.Int64
+	failed atomic.Int64
+	// errMu guards err, the first batch that couldn't be published
+	errMu sync.Mutex
+	err   error
+}
+
+// New checks that the brokers can be reached and that the topic exists,
+// and returns a Producer publishing to it.
+func New(cfg Config) (*Producer, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("no brokers")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultTopic
+	}
+	transport := &kafkago.Transport{ClientID: "pcap-analyzer", MetadataTopics: []string{cfg.Topic}}
+	if cfg.TLS || cfg.CAFile != "" || cfg.CertFile != "" {
+		tlsConfig, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+	if cfg.SASL != "" {
+		mechanism, err := mechanism(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	client := &kafkago.Client{Addr: kafkago.TCP(cfg.Brokers...), Transport: transport}
+	meta, err := client.Metadata(ctx, &kafkago.MetadataRequest{Topics: []string{cfg.Topic}})
+	if err != nil {
+		return nil, fmt.Errorf("reaching %s: %w", strings.Join(cfg.Brokers, ", "), err)
+	}
+	found := false
+	for _, t := range meta.Topics {
+		if t.Name != cfg.Topic {
+			continue
+		}
+		if t.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", cfg.Topic, t.Error)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("topic %s doesn't exist", cfg.Topic)
+	}
+
+	p := &Producer{cfg: cfg, pending: make(map[*httpstream.Request]bool)}
+	p.w = &kafkago.Writer{
+		Addr:         kafkago.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafkago.Hash{},
+		Transport:    transport,
+		RequiredAcks: kafkago.RequireAll,
+		Compression:  kafkago.Snappy,
+		BatchTimeout: 100 * time.Millisecond,
+		Async:        true,
+		Completion:   p.completed,
+	}
+	return p, nil
+}
+
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func mechanism(cfg Config) (sasl.Mechanism, error) {
+	switch strings.ToLower(cfg.SASL) {
+	case "plain":
+		return plain.Mechanism{Username: cfg.User, Password: cfg.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, cfg.User, cfg.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, cfg.User, cfg.Password)
+	}
+	return nil, fmt.Errorf("unknown SASL mechanism %q: want plain, scram-sha-256 or scram-sha-512", cfg.SASL)
+}
+
+// completed is called by the writer once a batch has been published or
+// has failed for good.
+func (p *Producer) completed(messages []kafkago.Message, err error) {
+	if err == nil {
+		p.sent.Add(int64(len(messages)))
+		return
+	}
+	p.failed.Add(int64(len(messages)))
+	p.errMu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.errMu.Unlock()
+}
+
+func (p *Producer) HandleRequest(req *httpstream.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.pending[req] = true
+	}
+}
+
+func (p *Producer) HandleResponse(resp *httpstream.Response) {
+	p.mu.Lock()
+	req := resp.Request
+	if req != nil && p.pending[req] {
+		delete(p.pending, req)
+	} else {
+		req = nil
+	}
+	closed := p.closed
+	p.mu.Unlock()
+	if !closed {
+		p.publish(req, resp)
+	}
+}
+
+func (p *Producer) HandleDNS(*dns.Message) {}
+
+// publish queues the event of a transaction; one of req and resp may be
+// nil.
+func (p *Producer) publish(req *httpstream.Request, resp *httpstream.Response) {
+	e := Event{Capture: p.cfg.Capture}
+	if req != nil {
+		e.ID, e.Time = req.ID(), req.Timestamp.UTC()
+		e.ClientIP, e.ClientPort, e.ServerIP, e.ServerPort = req.SrcIP, req.SrcPort, req.DstIP, req.DstPort
+		e.Request = p.message(&req.Message)
+		e.Request.Method, e.Request.URL, e.Request.Host = req.Method, req.URL, req.Host
+	}
+	if resp != nil {
+		if req == nil {
+			e.ID, e.Time = resp.ID(), resp.Timestamp.UTC()
+			e.ClientIP, e.ClientPort, e.ServerIP, e.ServerPort = resp.DstIP, resp.DstPort, resp.SrcIP, resp.SrcPort
+		} else {
+			e.LatencyMs = float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+		}
+		e.Response = p.message(&resp.Message)
+		e.Response.Status = resp.StatusCode
+		_, e.Response.StatusText, _ = strings.Cut(resp.Status, " ")
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	key := net.JoinHostPort(e.ClientIP, e.ClientPort) + "-" + net.JoinHostPort(e.ServerIP, e.ServerPort)
+	// Async writes only fail once the writer is closed
+	p.w.WriteMessages(context.Background(), kafkago.Message{Key: []byte(key), Value: value, Time: e.Time})
+}
+
+func (p *Producer) message(m *httpstream.Message) *Message {
+	out := &Message{
+		Time:     m.Timestamp.UTC(),
+		Proto:    m.Proto,
+		Headers:  m.Header,
+		BodySize: m.BodySize,
+		SHA256:   m.SHA256,
+	}
+	if p.cfg.MaxBody <= 0 || len(m.Body) == 0 {
+		return out
+	}
+	body, _, err := m.DecodedBody()
+	if err != nil {
+		body = m.Body
+	}
+	out.BodyTruncated = m.BodySize > int64(len(m.Body))
+	if len(body) > p.cfg.MaxBody {
+		body, out.BodyTruncated = body[:p.cfg.MaxBody], true
+	}
+	if utf8.Valid(body) {
+		out.Body = string(body)
+	} else {
+		out.Body, out.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return out
+}
+
+// Close publishes the requests never answered and waits for every message
+// to be sent. Transactions handled after Close are discarded. It returns
+// the first batch that couldn't be published; the others are sent
+// regardless.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	unanswered := make([]*httpstream.Request, 0, len(p.pending))
+	for req := range p.pending {
+		unanswered = append(unanswered, req)
+	}
+	p.pending = nil
+	p.mu.Unlock()
+	sort.Slice(unanswered, func(i, j int) bool { return unanswered[i].Timestamp.Before(unanswered[j].Timestamp) })
+	for _, req := range unanswered {
+		p.publish(req, nil)
+	}
+	err := p.w.Close()
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return err
+}
+
+// Counts returns how many messages were published and how many were lost
+// to batches that failed. It is only final after Close.
+func (p *Producer) Counts() (sent, failed int64) {
+	return p.sent.Load(), p.failed.Load()
+}
+
+// Topic returns the topic published to.
+func (p *Producer) Topic() string {
+	return p.cfg.Topic
+}
@@ -0,0 +1,250 @@
+// Package lookalike decodes internationalized domain names and flags names
+// made to look like protected brand domains, as phishing sites are: letters
+// swapped for similar ones from other scripts, typos, and the brand's name
+// embedded in another domain.
+package lookalike
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Kinds of lookalike.
+const (
+	// Homoglyph names differ from the brand's only in characters that look
+	// alike, such as Cyrillic а for Latin a, or rn for m.
+	Homoglyph = "homoglyph"
+	// Typo names are one letter added, left out, changed or transposed
+	// away from the brand's.
+	Typo = "typo"
+	// OtherTLD names are the brand's under a suffix not on the list.
+	OtherTLD = "other TLD"
+	// Embedded names hold the brand's name as a label or hyphenated part
+	// of one, as in paypal.com.example.net or paypal-login.com.
+	Embedded = "embedded"
+)
+
+// Unicode returns name with its xn-- labels decoded, or name as it is when
+// they don't decode.
+func Unicode(name string) string {
+	if !strings.Contains(name, "xn--") {
+		return name
+	}
+	u, err := idna.Display.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return u
+}
+
+// ASCII returns name with non-ASCII labels encoded as xn-- labels, or name
+// as it is when they can't be encoded.
+func ASCII(name string) string {
+	a, err := idna.Display.ToASCII(name)
+	if err != nil {
+		return name
+	}
+	return a
+}
+
+// Scripts lists the Unicode scripts of the letters in name, such as
+// "Cyrillic, Latin". Several scripts in one name is rarely innocent.
+func Scripts(name string) string {
+	seen := make(map[string]bool)
+	for _, r := range name {
+		if r < 0x80 && !unicode.IsLetter(r) {
+			continue
+		}
+		for script, table := range unicode.Scripts {
+			if script != "Common" && script != "Inherited" && unicode.Is(table, r) {
+				seen[script] = true
+				break
+			}
+		}
+	}
+	scripts := make([]string, 0, len(seen))
+	for s := range seen {
+		scripts = append(scripts, s)
+	}
+	sort.Strings(scripts)
+	return strings.Join(scripts, ", ")
+}
+
+// Match is a name found to look like a brand's.
+type Match struct {
+	// Brand is the protected domain the name looks like.
+	Brand string
+	Kind  string
+}
+
+type brand struct {
+	domain, label, skeleton string
+}
+
+// Brands is a list of protected domains.
+type Brands struct {
+	brands []brand
+	// owned holds the listed domains, which with their subdomains are
+	// never lookalikes.
+	owned map[string]bool
+}
+
+// LoadBrands reads files listing one protected domain per line, such as
+// paypal.com, where subdomains stand for the domain they are under; blank
+// lines and lines starting with # are ignored. Every domain a brand owns
+// should be listed, since the brand's name under any other suffix is
+// reported.
+func LoadBrands(paths ...string) (*Brands, error) {
+	b := &Brands{owned: make(map[string]bool)}
+	for _, path := range paths {
+		if err := b.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Brands) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		registered, err := publicsuffix.EffectiveTLDPlusOne(ASCII(strings.TrimSuffix(strings.ToLower(line), ".")))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if b.owned[registered] {
+			continue
+		}
+		b.owned[registered] = true
+		label := Unicode(registered[:strings.IndexByte(registered, '.')])
+		b.brands = append(b.brands, brand{domain: registered, label: label, skeleton: skeleton(label)})
+	}
+	return scanner.Err()
+}
+
+// Len returns the number of protected domains.
+func (b *Brands) Len() int {
+	return len(b.brands)
+}
+
+// Check returns the brand name looks like, or nil if it looks like none or
+// is one of the listed domains or their subdomains. name may be given
+// either with xn-- labels or in Unicode.
+func (b *Brands) Check(name string) *Match {
+	name = ASCII(strings.TrimSuffix(strings.ToLower(name), "."))
+	for d := name; d != ""; {
+		if b.owned[d] {
+			return nil
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	registered, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return nil
+	}
+	label := Unicode(registered[:strings.IndexByte(registered, '.')])
+	skel := skeleton(label)
+
+	for _, br := range b.brands {
+		switch {
+		case label == br.label:
+			return &Match{Brand: br.domain, Kind: OtherTLD}
+		case skel == br.skeleton:
+			return &Match{Brand: br.domain, Kind: Homoglyph}
+		case len(br.skeleton) >= 5 && oneEdit(skel, br.skeleton):
+			return &Match{Brand: br.domain, Kind: Typo}
+		}
+	}
+	// The brand's name anywhere else in the name
+	parts := strings.FieldsFunc(Unicode(name), func(r rune) bool { return r == '.' || r == '-' })
+	for _, br := range b.brands {
+		if len(br.skeleton) < 4 {
+			continue
+		}
+		for _, p := range parts {
+			if skeleton(p) == br.skeleton {
+				return &Match{Brand: br.domain, Kind: Embedded}
+			}
+		}
+	}
+	return nil
+}
+
+// confusables maps letters that look like ASCII ones, and aren't taken
+// apart by compatibility decomposition, to the ASCII letter.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'l', 'ї': 'l', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'т': 't',
+	'у': 'y', 'ԝ': 'w', 'х': 'x', 'ь': 'b', 'п': 'n',
+	// Greek
+	'α': 'a', 'β': 'b', 'ϲ': 'c', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Armenian
+	'օ': 'o', 'ս': 'u', 'ո': 'n', 'հ': 'h', 'ց': 'g', 'զ': 'q',
+	// Latin letters without a decomposition
+	'ı': 'l', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ħ': 'h', 'ŧ': 't', 'ɡ': 'g', 'ɑ': 'a', 'ß': 'b',
+	// Digits
+	'0': 'o', '1': 'l', '3': 'e', '5': 's',
+	// i and l are told apart by the dot only
+	'i': 'l',
+}
+
+// skeleton reduces s to what it looks like: accents dropped, letters of
+// other scripts and digits mapped to the ASCII letters they resemble, and
+// letter pairs that look like one letter joined.
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(s)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return strings.NewReplacer("rn", "m", "vv", "w", "cl", "d").Replace(b.String())
+}
+
+// oneEdit reports whether a and b differ by exactly one inserted, deleted,
+// substituted or transposed character.
+func oneEdit(a, b string) bool {
+	x, y := []rune(a), []rune(b)
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+	if len(y)-len(x) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(x) && x[i] == y[i] {
+		i++
+	}
+	if i == len(x) {
+		return len(y) == len(x)+1
+	}
+	if len(x) == len(y) {
+		if string(x[i+1:]) == string(y[i+1:]) {
+			return true
+		}
+		return i+1 < len(x) && x[i] == y[i+1] && x[i+1] == y[i] && string(x[i+2:]) == string(y[i+2:])
+	}
+	return string(x[i:]) == string(y[i+1:])
+}
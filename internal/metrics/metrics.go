@@ -0,0 +1,270 @@
+// Package metrics counts what a capture has seen so far and serves it in
+// the Prometheus text format, so that a live capture can be scraped as a
+// lightweight passive monitor.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stats"
+)
+
+// DefaultMaxHosts is how many hosts get series of their own by default.
+const DefaultMaxHosts = 1000
+
+// otherHost labels the traffic of the hosts past the limit.
+const otherHost = "other"
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histogram: Prometheus's default buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector is a handler counting transactions, latencies and bytes by
+// host, and DNS messages by response code. It serves them, with the
+// processing counters in Stats, as a Prometheus /metrics endpoint.
+type Collector struct {
+	// Stats, if set, are the counters of the capture, exported as well.
+	Stats *stats.Counters
+	// MaxHosts bounds the hosts given series of their own, so that a
+	// capture seeing many doesn't grow without limit; the traffic of the
+	// others is counted under the host "other". Zero means
+	// DefaultMaxHosts.
+	MaxHosts int
+
+	mu    sync.Mutex
+	hosts map[string]*hostMetrics
+	dns   map[dnsKey]int64
+}
+
+type hostMetrics struct {
+	requests      map[string]int64 // by method
+	responses     map[string]int64 // by status class
+	requestBytes  int64
+	responseBytes int64
+	// latency counts the responses in each bucket of latencyBuckets, and
+	// the last one those slower than them all
+	latency    []int64
+	latencySum float64
+}
+
+type dnsKey struct {
+	typ, rcode string
+}
+
+// New returns an empty Collector.
+func New() *Collector {
+	return &Collector{
+		hosts: make(map[string]*hostMetrics),
+		dns:   make(map[dnsKey]int64),
+	}
+}
+
+func (c *Collector) HandleRequest(req *httpstream.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.host(hostName(req.Host, req.DstIP))
+	h.requests[req.Method]++
+	h.requestBytes += req.BodySize
+}
+
+func (c *Collector) HandleResponse(resp *httpstream.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := resp.SrcIP
+	if req := resp.Request; req != nil {
+		name = hostName(req.Host, req.DstIP)
+	}
+	h := c.host(name)
+	h.responses[statusClass(resp.StatusCode)]++
+	h.responseBytes += resp.BodySize
+	if req := resp.Request; req != nil {
+		latency := resp.Timestamp.Sub(req.Timestamp).Seconds()
+		i := sort.SearchFloat64s(latencyBuckets, latency)
+		h.latency[i]++
+		h.latencySum += latency
+	}
+}
+
+func (c *Collector) HandleDNS(msg *dns.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Response {
+		c.dns[dnsKey{"response", msg.Rcode}]++
+	} else {
+		c.dns[dnsKey{"query", ""}]++
+	}
+}
+
+// host returns the metrics of a host, or of "other" once MaxHosts have
+// been seen. c.mu must be held.
+func (c *Collector) host(name string) *hostMetrics {
+	h := c.hosts[name]
+	if h != nil {
+		return h
+	}
+	max := c.MaxHosts
+	if max <= 0 {
+		max = DefaultMaxHosts
+	}
+	if len(c.hosts) >= max {
+		name = otherHost
+		if h := c.hosts[name]; h != nil {
+			return h
+		}
+	}
+	h = &hostMetrics{
+		requests:  make(map[string]int64),
+		responses: make(map[string]int64),
+		latency:   make([]int64, len(latencyBuckets)+1),
+	}
+	c.hosts[name] = h
+	return h
+}
+
+// hostName is the Host header without its port, or the server's address
+// when there is none.
+func hostName(host, ip string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return ip
+	}
+	return strings.ToLower(host)
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	c.Write(bw)
+	bw.Flush()
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (c *Collector) Write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.hosts))
+	for name := range c.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(w, "pcap_http_requests_total", "counter", "HTTP requests seen, by host and method.")
+	for _, name := range names {
+		h := c.hosts[name]
+		for _, method := range sortedKeys(h.requests) {
+			fmt.Fprintf(w, "pcap_http_requests_total{host=%s,method=%s} %d\n", quote(name), quote(method), h.requests[method])
+		}
+	}
+	header(w, "pcap_http_responses_total", "counter", "HTTP responses seen, by host and status class.")
+	for _, name := range names {
+		h := c.hosts[name]
+		for _, class := range sortedKeys(h.responses) {
+			fmt.Fprintf(w, "pcap_http_responses_total{host=%s,class=%s} %d\n", quote(name), quote(class), h.responses[class])
+		}
+	}
+	header(w, "pcap_http_request_duration_seconds", "histogram", "Time from the first byte of each request to the first byte of its response, by host.")
+	for _, name := range names {
+		h := c.hosts[name]
+		var total int64
+		for _, n := range h.latency {
+			total += n
+		}
+		if total == 0 {
+			continue
+		}
+		var cumulative int64
+		for i, le := range latencyBuckets {
+			cumulative += h.latency[i]
+			fmt.Fprintf(w, "pcap_http_request_duration_seconds_bucket{host=%s,le=%q} %d\n", quote(name), strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "pcap_http_request_duration_seconds_bucket{host=%s,le=\"+Inf\"} %d\n", quote(name), total)
+		fmt.Fprintf(w, "pcap_http_request_duration_seconds_sum{host=%s} %g\n", quote(name), h.latencySum)
+		fmt.Fprintf(w, "pcap_http_request_duration_seconds_count{host=%s} %d\n", quote(name), total)
+	}
+	header(w, "pcap_http_request_body_bytes_total", "counter", "Bytes of request bodies, by host.")
+	for _, name := range names {
+		fmt.Fprintf(w, "pcap_http_request_body_bytes_total{host=%s} %d\n", quote(name), c.hosts[name].requestBytes)
+	}
+	header(w, "pcap_http_response_body_bytes_total", "counter", "Bytes of response bodies, by host.")
+	for _, name := range names {
+		fmt.Fprintf(w, "pcap_http_response_body_bytes_total{host=%s} %d\n", quote(name), c.hosts[name].responseBytes)
+	}
+
+	keys := make([]dnsKey, 0, len(c.dns))
+	for k := range c.dns {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].typ != keys[j].typ {
+			return keys[i].typ < keys[j].typ
+		}
+		return keys[i].rcode < keys[j].rcode
+	})
+	header(w, "pcap_dns_messages_total", "counter", "DNS messages seen, by type and response code.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "pcap_dns_messages_total{type=%s,rcode=%s} %d\n", quote(k.typ), quote(k.rcode), c.dns[k])
+	}
+
+	if c.Stats == nil {
+		return
+	}
+	s := c.Stats.Snapshot()
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"pcap_packets_total", "Packets captured.", s.Packets},
+		{"pcap_bytes_total", "Bytes of the packets captured.", s.Bytes},
+		{"pcap_skipped_packets_total", "Packets that weren't analyzed.", s.Skipped},
+		{"pcap_tcp_streams_total", "TCP connections reassembled.", s.Streams},
+		{"pcap_tls_flows_total", "Connections skipped because they carry TLS.", s.TLSFlows},
+		{"pcap_decrypted_tls_flows_total", "TLS connections decrypted with a key log.", s.DecryptedFlows},
+		{"pcap_connect_tunnels_total", "CONNECT tunnels set up through proxies.", s.Tunnels},
+		{"pcap_parse_errors_total", "HTTP and DNS messages that couldn't be parsed.", s.ParseErrors},
+		{"pcap_lost_tcp_bytes_total", "TCP payload reassembly skipped over.", s.LostBytes},
+		{"pcap_truncated_body_bytes_total", "Body data dropped past the in-memory limit.", s.TruncatedBytes},
+		{"pcap_dns_cache_hits_total", "Requests whose server address was among the DNS answers seen.", s.DNSCacheHits},
+		{"pcap_dns_cache_misses_total", "Requests whose server address wasn't among the DNS answers seen.", s.DNSCacheMisses},
+		{"pcap_memory_shed_total", "Times the memory budget was approached and state released.", s.Shed},
+	} {
+		header(w, m.name, "counter", m.help)
+		fmt.Fprintf(w, "%s %d\n", m.name, m.value)
+	}
+}
+
+func header(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// quote quotes a label value, escaping as the text format does.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
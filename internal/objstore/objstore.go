@@ -0,0 +1,215 @@
+// Package objstore streams captures from object storage, given s3:// or
+// gs:// URLs, so that archived captures can be analyzed as they download
+// rather than copied to local disk first.
+package objstore
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxResumes is how many times a read that fails part way through an
+// object is resumed.
+const maxResumes = 5
+
+var client = newClient()
+
+func newClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// Objects can take hours to stream, so only the wait for a response is
+	// bounded
+	t.ResponseHeaderTimeout = time.Minute
+	return &http.Client{Transport: t}
+}
+
+// IsURL reports whether name is an s3:// or gs:// URL rather than a path.
+func IsURL(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "gs://")
+}
+
+// store makes requests for an object of one provider.
+type store interface {
+	// request returns a signed request with method, GET or HEAD, for the
+	// object from offset on and, if etag is set, only while it matches.
+	request(method string, offset int64, etag string) (*http.Request, error)
+	// redirected reports whether resp names another region to request the
+	// object from, which the next request goes to.
+	redirected(resp *http.Response) bool
+}
+
+func locate(rawURL string) (store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return nil, fmt.Errorf("%s: want %s://bucket/object", rawURL, u.Scheme)
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3(bucket, key)
+	case "gs":
+		return newGCS(bucket, key), nil
+	}
+	return nil, fmt.Errorf("%s: not an s3:// or gs:// URL", rawURL)
+}
+
+// Object is an object being streamed. A read that fails part way, such as
+// when a connection is reset, is resumed with a range request from where
+// it stopped, as long as the object hasn't changed in the meantime.
+type Object struct {
+	url     string
+	store   store
+	body    io.ReadCloser
+	etag    string
+	offset  int64
+	size    int64
+	resumes int
+}
+
+// Open starts streaming the object at rawURL.
+func Open(rawURL string) (*Object, error) {
+	s, err := locate(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{url: rawURL, store: s}
+	resp, err := o.do(http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	o.body, o.size, o.etag = resp.Body, resp.ContentLength, resp.Header.Get("ETag")
+	return o, nil
+}
+
+// Size returns the length of the object at rawURL in bytes.
+func Size(rawURL string) (int64, error) {
+	s, err := locate(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	o := &Object{url: rawURL, store: s}
+	resp, err := o.do(http.MethodHead)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	for {
+		n, err := o.body.Read(p)
+		o.offset += int64(n)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+		if err == io.EOF {
+			if o.size < 0 || o.offset >= o.size {
+				return 0, io.EOF
+			}
+			err = io.ErrUnexpectedEOF
+		}
+		if o.resumes == maxResumes {
+			return 0, fmt.Errorf("%s: %w", o.url, err)
+		}
+		o.resumes++
+		o.body.Close()
+		resp, rerr := o.do(http.MethodGet)
+		if rerr != nil {
+			o.body = io.NopCloser(strings.NewReader(""))
+			o.resumes = maxResumes
+			return 0, fmt.Errorf("%w, after reading failed at byte %d: %v", rerr, o.offset, err)
+		}
+		o.body = resp.Body
+	}
+}
+
+func (o *Object) Close() error {
+	return o.body.Close()
+}
+
+// do requests the object from o.offset on, following one redirect to the
+// bucket's region.
+func (o *Object) do(method string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := o.store.request(method, o.offset, o.etag)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", o.url, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", o.url, err)
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+			return resp, nil
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if attempt == 0 && o.store.redirected(resp) {
+			continue
+		}
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			return nil, fmt.Errorf("%s: the object changed while it was read", o.url)
+		}
+		msg := errorMessage(body)
+		if msg == "" {
+			return nil, fmt.Errorf("%s: %s", o.url, resp.Status)
+		}
+		return nil, fmt.Errorf("%s: %s: %s", o.url, resp.Status, msg)
+	}
+}
+
+// errorMessage returns the message of an S3 XML or GCS JSON error body.
+func errorMessage(body []byte) string {
+	var s3 struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &s3) == nil && s3.Message != "" {
+		return s3.Code + ": " + s3.Message
+	}
+	var gcs struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &gcs) == nil && gcs.Error.Message != "" {
+		return gcs.Error.Message
+	}
+	return ""
+}
+
+// escapePath percent-encodes each segment of key as S3 signing requires:
+// everything but unreserved characters, with slashes left as they are.
+func escapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL returns base, such as "https://host", with the escaped path
+// added in a form net/http sends unchanged.
+func objectURL(base, path string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = strings.TrimSuffix(u.Path, "/") + "/" + escapePath(path)
+	u.Path, err = url.PathUnescape(u.RawPath)
+	return u, err
+}
@@ -0,0 +1,224 @@
+package objstore
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Object is an object in Amazon S3 or a service compatible with it.
+// Credentials come from the environment or the shared credentials file as
+// the AWS CLI reads them; without any, requests are unsigned, which public
+// buckets allow.
+type s3Object struct {
+	bucket, key string
+	region      string
+	// endpoint is $AWS_ENDPOINT_URL, such as a MinIO server, which is
+	// addressed path-style
+	endpoint string
+	creds    s3Credentials
+}
+
+type s3Credentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+func newS3(bucket, key string) (*s3Object, error) {
+	o := &s3Object{
+		bucket:   bucket,
+		key:      key,
+		region:   firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		endpoint: firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+	}
+	if o.region == "" {
+		o.region = "us-east-1"
+	}
+	var err error
+	if o.creds, err = loadS3Credentials(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// loadS3Credentials reads $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN, or failing those the $AWS_PROFILE (or default)
+// profile of ~/.aws/credentials.
+func loadS3Credentials() (s3Credentials, error) {
+	c := s3Credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.accessKey != "" {
+		if c.secretKey == "" {
+			return c, fmt.Errorf("AWS_ACCESS_KEY_ID is set without AWS_SECRET_ACCESS_KEY")
+		}
+		return c, nil
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return c, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c, nil
+	}
+	defer f.Close()
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var section string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			c.accessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			c.secretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			c.sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.accessKey != "" && c.secretKey == "" {
+		return c, fmt.Errorf("%s: profile %s has no aws_secret_access_key", path, profile)
+	}
+	return c, nil
+}
+
+func (o *s3Object) request(method string, offset int64, etag string) (*http.Request, error) {
+	var base, path string
+	switch {
+	case o.endpoint != "":
+		base, path = o.endpoint, o.bucket+"/"+o.key
+	case strings.Contains(o.bucket, "."):
+		// Virtual-hosted names with dots don't match the wildcard
+		// certificate
+		base, path = "https://s3."+o.region+".amazonaws.com", o.bucket+"/"+o.key
+	default:
+		base, path = "https://"+o.bucket+".s3."+o.region+".amazonaws.com", o.key
+	}
+	u, err := objectURL(base, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if o.creds.accessKey != "" {
+		signV4(req, o.creds, o.region, time.Now())
+	}
+	return req, nil
+}
+
+// redirected follows S3's answer to a request sent to the wrong region,
+// which names the bucket's region in a header.
+func (o *s3Object) redirected(resp *http.Response) bool {
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+	if region == "" || region == o.region {
+		return false
+	}
+	o.region = region
+	return true
+}
+
+// unsignedPayload stands in for the hash of a body in signatures of
+// requests that have none to hash.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signV4 signs req for S3 with AWS Signature Version 4, covering the host
+// and every header already set.
+func signV4(req *http.Request, c s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
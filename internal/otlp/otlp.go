@@ -0,0 +1,455 @@
+// Package otlp exports HTTP transactions as OpenTelemetry spans to an
+// OTLP/HTTP endpoint, such as a collector, Jaeger or Tempo, so captured
+// traffic can be viewed next to the traces of the applications involved.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/report"
+)
+
+// DefaultBatchSize is how many spans an export carries by default, as
+// with the OpenTelemetry SDKs.
+const DefaultBatchSize = 512
+
+// tracesPath is where the traces of an OTLP/HTTP endpoint are posted when
+// its URL doesn't name a path.
+const tracesPath = "/v1/traces"
+
+// requestTimeout bounds each export.
+const requestTimeout = 30 * time.Second
+
+// retries is how many times an export the endpoint was too busy for, or
+// that never reached it, is attempted again.
+const retries = 3
+
+// Config describes where spans are exported.
+type Config struct {
+	// Endpoint is the URL of an OTLP/HTTP receiver, such as
+	// http://localhost:4318. Spans are posted to /v1/traces under it
+	// unless it names a path of its own.
+	Endpoint string
+	// Headers are added to every export, for the receivers that want an
+	// API key or authorization.
+	Headers map[string]string
+	// Service is the service.name of every span. Empty means the host the
+	// request was sent to, so each server shows up as a service of its
+	// own.
+	Service string
+	// Capture fills the pcap.capture attribute of every span.
+	Capture string
+	// BatchSize is how many spans each export carries; zero means
+	// DefaultBatchSize.
+	BatchSize int
+	// FlushInterval, if set, exports the spans buffered this often even
+	// when the batch isn't full, so that a long-running capture with little
+	// traffic still shows up.
+	FlushInterval time.Duration
+}
+
+// Exporter is a handler turning each transaction into a client span once
+// its response is parsed, and the requests still unanswered when it is
+// closed into spans with an error status. Spans are buffered until a batch
+// is full and exported by a goroutine of their own, one batch at a time,
+// while the next one fills.
+type Exporter struct {
+	cfg      Config
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending map[*httpstream.Request]bool
+	buf     []span
+	closed  bool
+
+	batches chan []span
+	done    chan struct{}
+	// Set by the exporting goroutine, and read once it has finished
+	exported int64
+	failed   int64
+	err      error
+}
+
+// span is a span with the service it belongs to.
+type span struct {
+	service string
+	*tracepb.Span
+}
+
+// New returns an Exporter posting to the endpoint of cfg.
+func New(cfg Config) (*Exporter, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not the URL of an OTLP/HTTP endpoint", cfg.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	e := &Exporter{
+		cfg:      cfg,
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: requestTimeout},
+		pending:  make(map[*httpstream.Request]bool),
+		batches:  make(chan []span, 1),
+		done:     make(chan struct{}),
+	}
+	go e.exportAll()
+	if cfg.FlushInterval > 0 {
+		go e.flushEvery(cfg.FlushInterval)
+	}
+	return e, nil
+}
+
+func (e *Exporter) flushEvery(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.mu.Lock()
+		closed := e.closed
+		if !closed {
+			e.flush()
+		}
+		e.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+func (e *Exporter) HandleRequest(req *httpstream.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.pending[req] = true
+	}
+}
+
+func (e *Exporter) HandleResponse(resp *httpstream.Response) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Spans start from a request, so responses to requests that weren't
+	// seen are left out
+	if e.closed || resp.Request == nil || !e.pending[resp.Request] {
+		return
+	}
+	delete(e.pending, resp.Request)
+	e.add(e.span(resp.Request, resp))
+}
+
+func (e *Exporter) HandleDNS(*dns.Message) {}
+
+// span builds the span of a transaction; resp is nil for requests never
+// answered. A request carrying a W3C traceparent header gets a span in the
+// trace it names, as a child of the span that sent it.
+func (e *Exporter) span(req *httpstream.Request, resp *httpstream.Response) span {
+	s := &tracepb.Span{
+		SpanId:            randomID(8),
+		Kind:              tracepb.Span_SPAN_KIND_CLIENT,
+		StartTimeUnixNano: uint64(req.Timestamp.UnixNano()),
+		EndTimeUnixNano:   uint64(req.Timestamp.UnixNano()),
+	}
+	if traceID, parentID, ok := traceParent(req.Header.Get("Traceparent")); ok {
+		s.TraceId, s.ParentSpanId = traceID, parentID
+		s.TraceState = req.Header.Get("Tracestate")
+	} else {
+		s.TraceId = randomID(16)
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var path, scheme string
+	if u, err := url.Parse(req.URL); err == nil {
+		path, scheme = u.Path, u.Scheme
+	}
+	s.Name = req.Method + " " + report.PathTemplate(path)
+	attrs := []*commonpb.KeyValue{
+		stringAttr("http.method", req.Method),
+		stringAttr("http.url", req.URL),
+		stringAttr("http.target", req.URI),
+		stringAttr("http.scheme", scheme),
+		stringAttr("http.flavor", strings.TrimPrefix(req.Proto, "HTTP/")),
+		stringAttr("http.user_agent", req.Header.Get("User-Agent")),
+		intAttr("http.request_content_length", req.BodySize),
+		stringAttr("net.peer.name", host),
+		stringAttr("net.peer.ip", req.DstIP),
+		intAttr("net.peer.port", port(req.DstPort)),
+		stringAttr("net.host.ip", req.SrcIP),
+		intAttr("net.host.port", port(req.SrcPort)),
+		stringAttr("pcap.capture", e.cfg.Capture),
+		stringAttr("pcap.transaction_id", req.ID()),
+	}
+	if resp != nil {
+		// Only the first byte of a response is timed, so the span ends there
+		s.EndTimeUnixNano = uint64(resp.Timestamp.UnixNano())
+		attrs = append(attrs,
+			intAttr("http.status_code", int64(resp.StatusCode)),
+			intAttr("http.response_content_length", resp.BodySize),
+		)
+		// Client spans are errors from 400 on
+		if resp.StatusCode >= 400 {
+			s.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+		}
+	} else {
+		s.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "no response"}
+	}
+	for _, a := range attrs {
+		if v, ok := a.Value.Value.(*commonpb.AnyValue_StringValue); !ok || v.StringValue != "" {
+			s.Attributes = append(s.Attributes, a)
+		}
+	}
+
+	service := e.cfg.Service
+	if service == "" {
+		service = host
+	}
+	if service == "" {
+		service = req.DstIP
+	}
+	return span{service: service, Span: s}
+}
+
+// traceParent parses a W3C traceparent header into the trace and parent
+// span IDs it carries.
+func traceParent(h string) (traceID, spanID []byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, nil, false
+	}
+	// All-zero IDs are invalid
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return nil, nil, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, false
+	}
+	if spanID, err = hex.DecodeString(parts[2]); err != nil {
+		return nil, nil, false
+	}
+	return traceID, spanID, true
+}
+
+func randomID(n int) []byte {
+	id := make([]byte, n)
+	rand.Read(id)
+	return id
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttr(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+func port(p string) int64 {
+	n, _ := strconv.ParseUint(p, 10, 16)
+	return int64(n)
+}
+
+// add buffers a span, handing the batch over once it is full. e.mu must be
+// held.
+func (e *Exporter) add(s span) {
+	e.buf = append(e.buf, s)
+	if len(e.buf) >= e.cfg.BatchSize {
+		e.flush()
+	}
+}
+
+// flush hands the buffered spans to the exporting goroutine, waiting while
+// it is still busy with the batch before. e.mu must be held.
+func (e *Exporter) flush() {
+	if len(e.buf) == 0 {
+		return
+	}
+	e.batches <- e.buf
+	e.buf = nil
+}
+
+// Close exports the requests never answered and the spans still buffered,
+// and waits for every export to finish. Transactions handled after Close
+// are discarded. It returns the first export that failed or had spans
+// rejected; the other batches are exported regardless.
+func (e *Exporter) Close() error {
+	e.mu.Lock()
+	unanswered := make([]*httpstream.Request, 0, len(e.pending))
+	for req := range e.pending {
+		unanswered = append(unanswered, req)
+	}
+	sort.Slice(unanswered, func(i, j int) bool { return unanswered[i].Timestamp.Before(unanswered[j].Timestamp) })
+	for _, req := range unanswered {
+		e.add(e.span(req, nil))
+	}
+	e.pending = nil
+	e.flush()
+	e.closed = true
+	close(e.batches)
+	e.mu.Unlock()
+	<-e.done
+	return e.err
+}
+
+// Exported returns how many spans were exported and how many were lost to
+// failed exports or rejected by the endpoint. It is only valid after
+// Close.
+func (e *Exporter) Exported() (exported, failed int64) {
+	return e.exported, e.failed
+}
+
+// Endpoint returns the URL spans are posted to.
+func (e *Exporter) Endpoint() string {
+	return e.endpoint
+}
+
+func (e *Exporter) exportAll() {
+	defer close(e.done)
+	for b := range e.batches {
+		rejected, err := e.export(b)
+		if err != nil {
+			e.failed += int64(len(b))
+			if e.err == nil {
+				e.err = err
+			}
+			continue
+		}
+		e.exported += int64(len(b)) - rejected
+		e.failed += rejected
+		if rejected > 0 && e.err == nil {
+			e.err = fmt.Errorf("%s rejected %d spans", e.endpoint, rejected)
+		}
+	}
+}
+
+// export posts a batch, grouped by service, and returns how many of its
+// spans the endpoint rejected. Exports that fail to reach the endpoint, or
+// that it is too busy for, are retried.
+func (e *Exporter) export(b []span) (rejected int64, err error) {
+	var services []string
+	byService := make(map[string][]*tracepb.Span)
+	for _, s := range b {
+		if byService[s.service] == nil {
+			services = append(services, s.service)
+		}
+		byService[s.service] = append(byService[s.service], s.Span)
+	}
+	req := &collectorpb.ExportTraceServiceRequest{}
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, &tracepb.ResourceSpans{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", service)}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "pcap-analyzer"},
+				Spans: byService[service],
+			}},
+		})
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(data)
+	zw.Close()
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var retry bool
+		rejected, retry, err = e.post(body.Bytes())
+		if err == nil || !retry {
+			return rejected, err
+		}
+	}
+	return 0, err
+}
+
+func (e *Exporter) post(body []byte) (rejected int64, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "gzip")
+	for name, value := range e.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(result))
+		if resp.Header.Get("Content-Type") == "application/x-protobuf" {
+			msg = ""
+		}
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		err := fmt.Errorf("%s: %s %s", e.endpoint, resp.Status, msg)
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return 0, true, err
+		}
+		return 0, false, err
+	}
+	var out collectorpb.ExportTraceServiceResponse
+	if proto.Unmarshal(result, &out) == nil && out.PartialSuccess != nil {
+		rejected = out.PartialSuccess.RejectedSpans
+	}
+	return rejected, false, nil
+}
+
+// ParseHeaders parses headers given as OTEL_EXPORTER_OTLP_HEADERS gives
+// them: comma-separated name=value pairs, with values URL-encoded.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q is not name=value", pair)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", strings.TrimSpace(name), err)
+		}
+		headers[strings.TrimSpace(name)] = v
+	}
+	return headers, nil
+}
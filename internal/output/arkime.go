@@ -0,0 +1,528 @@
+package output
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/fingerprint"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// arkimeUDPTimeout is how long a UDP session may be quiet before its next
+// datagram starts a new one, as with Arkime's udpTimeout.
+const arkimeUDPTimeout = 60 * time.Second
+
+// Arkime writes the capture's sessions as an Elasticsearch bulk request
+// for Arkime's sessions3 indices, so they can be browsed and searched in
+// the Arkime viewer. As Arkime does, a session is a TCP connection or a
+// run of UDP datagrams between two endpoints, carrying the HTTP, DNS and
+// TLS metadata parsed from it. Sessions are written at the end of the run,
+// once every message has been parsed.
+type Arkime struct {
+	// Node is the capture node the sessions are recorded against.
+	Node string
+	// Prefix is Arkime's index prefix: "arkime_" from Arkime 5 and empty
+	// before.
+	Prefix string
+
+	mu     sync.Mutex
+	w      io.Writer
+	open   map[connKey]*arkimeFlow
+	byConn map[int64]*arkimeFlow
+	all    []*arkimeFlow
+	hellos *fingerprint.Hellos
+	// datagram is the last UDP packet, which any DNS message that follows
+	// was read from
+	datagram     datagramKey
+	datagramFlow *arkimeFlow
+}
+
+// NewArkime returns an Arkime writing to w, for node "pcap-analyzer" and
+// Arkime 5's index names.
+func NewArkime(w io.Writer) *Arkime {
+	return &Arkime{
+		Node:   "pcap-analyzer",
+		Prefix: "arkime_",
+		w:      w,
+		open:   make(map[connKey]*arkimeFlow),
+		byConn: make(map[int64]*arkimeFlow),
+		hellos: fingerprint.NewHellos(),
+	}
+}
+
+// arkimeSession is a document of Arkime's sessions3 index. Times are in
+// milliseconds since the epoch, and each list has a count alongside it.
+type arkimeSession struct {
+	Timestamp    int64           `json:"@timestamp"`
+	FirstPacket  int64           `json:"firstPacket"`
+	LastPacket   int64           `json:"lastPacket"`
+	Length       int64           `json:"length"`
+	IPProtocol   int             `json:"ipProtocol"`
+	Node         string          `json:"node"`
+	Source       arkimeEndpoint  `json:"source"`
+	Destination  arkimeEndpoint  `json:"destination"`
+	Network      arkimeCounts    `json:"network"`
+	Client       arkimeBytes     `json:"client"`
+	Server       arkimeBytes     `json:"server"`
+	TotDataBytes int64           `json:"totDataBytes"`
+	SegmentCnt   int             `json:"segmentCnt"`
+	Protocol     []string        `json:"protocol"`
+	ProtocolCnt  int             `json:"protocolCnt"`
+	TCPFlags     *arkimeTCPFlags `json:"tcpflags,omitempty"`
+	InitRTT      int64           `json:"initRTT,omitempty"`
+	SrcPayload8  string          `json:"srcPayload8,omitempty"`
+	DstPayload8  string          `json:"dstPayload8,omitempty"`
+	Tags         []string        `json:"tags"`
+	TagsCnt      int             `json:"tagsCnt"`
+	HTTP         *arkimeHTTP     `json:"http,omitempty"`
+	DNS          *arkimeDNS      `json:"dns,omitempty"`
+	TLS          *arkimeTLS      `json:"tls,omitempty"`
+	Cert         []arkimeCert    `json:"cert,omitempty"`
+	CertCnt      int             `json:"certCnt,omitempty"`
+}
+
+type arkimeEndpoint struct {
+	IP      string `json:"ip"`
+	Port    int    `json:"port,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Packets int64  `json:"packets"`
+}
+
+type arkimeCounts struct {
+	Packets int64 `json:"packets"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type arkimeBytes struct {
+	Bytes int64 `json:"bytes"`
+}
+
+type arkimeTCPFlags struct {
+	SYN     int `json:"syn"`
+	SYNACK  int `json:"syn-ack"`
+	ACK     int `json:"ack"`
+	PSH     int `json:"psh"`
+	FIN     int `json:"fin"`
+	RST     int `json:"rst"`
+	URG     int `json:"urg"`
+	SrcZero int `json:"srcZero"`
+	DstZero int `json:"dstZero"`
+}
+
+type arkimeHTTP struct {
+	Method            []string `json:"method,omitempty"`
+	MethodCnt         int      `json:"methodCnt,omitempty"`
+	Host              []string `json:"host,omitempty"`
+	HostCnt           int      `json:"hostCnt,omitempty"`
+	URI               []string `json:"uri,omitempty"`
+	URICnt            int      `json:"uriCnt,omitempty"`
+	Path              []string `json:"path,omitempty"`
+	PathCnt           int      `json:"pathCnt,omitempty"`
+	UserAgent         []string `json:"useragent,omitempty"`
+	UserAgentCnt      int      `json:"useragentCnt,omitempty"`
+	StatusCode        []int    `json:"statuscode,omitempty"`
+	StatusCodeCnt     int      `json:"statuscodeCnt,omitempty"`
+	ClientVersion     []string `json:"clientVersion,omitempty"`
+	ClientVersionCnt  int      `json:"clientVersionCnt,omitempty"`
+	ServerVersion     []string `json:"serverVersion,omitempty"`
+	ServerVersionCnt  int      `json:"serverVersionCnt,omitempty"`
+	RequestHeader     []string `json:"requestHeader,omitempty"`
+	RequestHeaderCnt  int      `json:"requestHeaderCnt,omitempty"`
+	ResponseHeader    []string `json:"responseHeader,omitempty"`
+	ResponseHeaderCnt int      `json:"responseHeaderCnt,omitempty"`
+	MD5               []string `json:"md5,omitempty"`
+	MD5Cnt            int      `json:"md5Cnt,omitempty"`
+	SHA256            []string `json:"sha256,omitempty"`
+	SHA256Cnt         int      `json:"sha256Cnt,omitempty"`
+}
+
+type arkimeDNS struct {
+	Host      []string `json:"host,omitempty"`
+	HostCnt   int      `json:"hostCnt,omitempty"`
+	IP        []string `json:"ip,omitempty"`
+	IPCnt     int      `json:"ipCnt,omitempty"`
+	QT        []string `json:"qt,omitempty"`
+	QTCnt     int      `json:"qtCnt,omitempty"`
+	QC        []string `json:"qc,omitempty"`
+	QCCnt     int      `json:"qcCnt,omitempty"`
+	Status    []string `json:"status,omitempty"`
+	StatusCnt int      `json:"statusCnt,omitempty"`
+	Opcode    []string `json:"opcode,omitempty"`
+	OpcodeCnt int      `json:"opcodeCnt,omitempty"`
+}
+
+type arkimeTLS struct {
+	Version    []string `json:"version,omitempty"`
+	VersionCnt int      `json:"versionCnt,omitempty"`
+	Cipher     []string `json:"cipher,omitempty"`
+	CipherCnt  int      `json:"cipherCnt,omitempty"`
+	JA3        []string `json:"ja3,omitempty"`
+	JA3Cnt     int      `json:"ja3Cnt,omitempty"`
+	JA4        []string `json:"ja4,omitempty"`
+	JA4Cnt     int      `json:"ja4Cnt,omitempty"`
+}
+
+type arkimeCert struct {
+	IssuerCN   []string `json:"issuerCN,omitempty"`
+	IssuerON   []string `json:"issuerON,omitempty"`
+	SubjectCN  []string `json:"subjectCN,omitempty"`
+	SubjectON  []string `json:"subjectON,omitempty"`
+	Alt        []string `json:"alt,omitempty"`
+	AltCnt     int      `json:"altCnt,omitempty"`
+	NotBefore  int64    `json:"notBefore"`
+	NotAfter   int64    `json:"notAfter"`
+	ValidDays  int64    `json:"validDays"`
+	Serial     string   `json:"serial"`
+	RemainDays int64    `json:"remainingDays"`
+}
+
+// arkimeFlow is a session being built.
+type arkimeFlow struct {
+	arkimeSession
+	key         connKey
+	first, last time.Time
+	// closed is set once a FIN or RST is seen, after which a SYN starts a
+	// new session on the same ports
+	closed bool
+	syn    time.Time
+	synAck bool
+}
+
+// addUnique appends s to list unless it is empty or already there.
+func addUnique(list *[]string, s string) {
+	if s == "" {
+		return
+	}
+	for _, v := range *list {
+		if v == s {
+			return
+		}
+	}
+	*list = append(*list, s)
+}
+
+func (a *Arkime) newFlow(key connKey, ts time.Time, srcIP, srcPort, dstIP, dstPort string, proto int) *arkimeFlow {
+	f := &arkimeFlow{key: key, first: ts, last: ts}
+	f.IPProtocol = proto
+	f.Source.IP, f.Destination.IP = srcIP, dstIP
+	f.Source.Port, _ = strconv.Atoi(srcPort)
+	f.Destination.Port, _ = strconv.Atoi(dstPort)
+	f.Protocol = []string{"tcp"}
+	if proto == int(layers.IPProtocolUDP) {
+		f.Protocol = []string{"udp"}
+	}
+	a.open[key] = f
+	a.all = append(a.all, f)
+	return f
+}
+
+// HandlePacket counts packets and bytes into their sessions, and reads
+// TLS hellos from them.
+func (a *Arkime) HandlePacket(p *analyzer.Packet) {
+	src, dst := p.Network.Endpoints()
+	sport, dport := p.Transport.Endpoints()
+	ts := p.CaptureInfo.Timestamp
+	key := newConnKey(src.String(), sport.String(), dst.String(), dport.String())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.open[key]
+	switch {
+	case f == nil:
+	case p.TCP != nil && p.TCP.SYN && !p.TCP.ACK && f.closed:
+		f = nil
+	case p.TCP == nil && ts.Sub(f.last) > arkimeUDPTimeout:
+		f = nil
+	}
+	if f == nil {
+		proto := int(layers.IPProtocolUDP)
+		if p.TCP != nil {
+			proto = int(layers.IPProtocolTCP)
+		}
+		// The sender of a SYN-ACK is the server, whatever was seen first
+		if p.TCP != nil && p.TCP.SYN && p.TCP.ACK {
+			f = a.newFlow(key, ts, dst.String(), dport.String(), src.String(), sport.String(), proto)
+		} else {
+			f = a.newFlow(key, ts, src.String(), sport.String(), dst.String(), dport.String(), proto)
+		}
+		if p.TCP != nil {
+			a.byConn[p.Number] = f
+		}
+	}
+	f.last = ts
+	fromSource := src.String() == f.Source.IP && sport.String() == strconv.Itoa(f.Source.Port)
+	size, payload := int64(p.CaptureInfo.Length), int64(len(p.Payload))
+	f.Network.Packets++
+	f.Network.Bytes += size
+	f.TotDataBytes += payload
+	if fromSource {
+		f.Source.Packets++
+		f.Source.Bytes += size
+		f.Client.Bytes += payload
+		if f.SrcPayload8 == "" && payload > 0 {
+			f.SrcPayload8 = hex.EncodeToString(p.Payload[:min(8, len(p.Payload))])
+		}
+	} else {
+		f.Destination.Packets++
+		f.Destination.Bytes += size
+		f.Server.Bytes += payload
+		if f.DstPayload8 == "" && payload > 0 {
+			f.DstPayload8 = hex.EncodeToString(p.Payload[:min(8, len(p.Payload))])
+		}
+	}
+
+	if tcp := p.TCP; tcp != nil {
+		if f.TCPFlags == nil {
+			f.TCPFlags = &arkimeTCPFlags{}
+		}
+		flags := f.TCPFlags
+		switch {
+		case tcp.SYN && tcp.ACK:
+			flags.SYNACK++
+			f.synAck = true
+		case tcp.SYN:
+			flags.SYN++
+			f.syn = ts
+		case tcp.ACK:
+			flags.ACK++
+			// The handshake's last ACK completes the round trip Arkime
+			// halves for initRTT
+			if f.synAck && !f.syn.IsZero() && f.InitRTT == 0 {
+				f.InitRTT = max(ts.Sub(f.syn).Milliseconds()/2, 1)
+			}
+		}
+		if tcp.PSH {
+			flags.PSH++
+		}
+		if tcp.URG {
+			flags.URG++
+		}
+		if tcp.FIN {
+			flags.FIN++
+			f.closed = true
+		}
+		if tcp.RST {
+			flags.RST++
+			f.closed = true
+		}
+		if tcp.Window == 0 && !tcp.RST {
+			if fromSource {
+				flags.SrcZero++
+			} else {
+				flags.DstZero++
+			}
+		}
+	} else {
+		a.datagram = datagramKey{ts.UnixNano(), src.String(), dst.String()}
+		a.datagramFlow = f
+	}
+
+	client, server := a.hellos.Packet(p)
+	if client == nil && server == nil {
+		return
+	}
+	addUnique(&f.Protocol, "tls")
+	if f.TLS == nil {
+		f.TLS = &arkimeTLS{}
+	}
+	if client != nil {
+		addUnique(&f.TLS.JA3, client.JA3())
+		addUnique(&f.TLS.JA4, client.JA4())
+		// Arkime files the server name with the HTTP hosts
+		if client.SNI != "" {
+			if f.HTTP == nil {
+				f.HTTP = &arkimeHTTP{}
+			}
+			addUnique(&f.HTTP.Host, strings.ToLower(client.SNI))
+		}
+		return
+	}
+	addUnique(&f.TLS.Version, strings.ReplaceAll(fingerprint.VersionName(server.Version), " ", "v"))
+	addUnique(&f.TLS.Cipher, tls.CipherSuiteName(server.Cipher))
+	if c := server.Certificate; c != nil {
+		f.Cert = append(f.Cert, arkimeCert{
+			IssuerCN:  nonEmpty(strings.ToLower(c.Issuer.CommonName)),
+			IssuerON:  c.Issuer.Organization,
+			SubjectCN: nonEmpty(strings.ToLower(c.Subject.CommonName)),
+			SubjectON: c.Subject.Organization,
+			Alt:       c.DNSNames,
+			NotBefore: c.NotBefore.UnixMilli(),
+			NotAfter:  c.NotAfter.UnixMilli(),
+			ValidDays: int64(c.NotAfter.Sub(c.NotBefore) / (24 * time.Hour)),
+			// As of the handshake rather than of the export
+			RemainDays: int64(c.NotAfter.Sub(ts) / (24 * time.Hour)),
+			Serial:     strings.ToLower(c.SerialNumber.Text(16)),
+		})
+	}
+}
+
+// httpFlow returns the session of a message, creating one when its
+// packets weren't seen, as when reading a HAR file.
+func (a *Arkime) httpFlow(m *httpstream.Message, client httpstream.Flow) *arkimeFlow {
+	if f := a.byConn[m.Conn]; m.Conn != 0 && f != nil {
+		return f
+	}
+	key := newConnKey(client.SrcIP, client.SrcPort, client.DstIP, client.DstPort)
+	if f := a.open[key]; f != nil {
+		return f
+	}
+	return a.newFlow(key, m.Timestamp, client.SrcIP, client.SrcPort, client.DstIP, client.DstPort, int(layers.IPProtocolTCP))
+}
+
+func (a *Arkime) HandleRequest(req *httpstream.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.httpFlow(&req.Message, req.Flow)
+	h := f.http()
+	addUnique(&h.Method, req.Method)
+	addUnique(&h.ClientVersion, strings.TrimPrefix(req.Proto, "HTTP/"))
+	addUnique(&h.UserAgent, req.Header.Get("User-Agent"))
+	for name := range req.Header {
+		addUnique(&h.RequestHeader, strings.ToLower(name))
+	}
+	addUnique(&h.MD5, req.MD5)
+	addUnique(&h.SHA256, req.SHA256)
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return
+	}
+	addUnique(&h.Host, strings.ToLower(u.Hostname()))
+	addUnique(&h.Path, u.Path)
+	// Arkime's URIs leave out the scheme
+	addUnique(&h.URI, "//"+u.Host+u.RequestURI())
+}
+
+func (a *Arkime) HandleResponse(resp *httpstream.Response) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.httpFlow(&resp.Message, resp.Flow.Reverse())
+	h := f.http()
+	seen := false
+	for _, code := range h.StatusCode {
+		seen = seen || code == resp.StatusCode
+	}
+	if !seen {
+		h.StatusCode = append(h.StatusCode, resp.StatusCode)
+	}
+	addUnique(&h.ServerVersion, strings.TrimPrefix(resp.Proto, "HTTP/"))
+	for name := range resp.Header {
+		addUnique(&h.ResponseHeader, strings.ToLower(name))
+	}
+	addUnique(&h.MD5, resp.MD5)
+	addUnique(&h.SHA256, resp.SHA256)
+}
+
+func (f *arkimeFlow) http() *arkimeHTTP {
+	addUnique(&f.Protocol, "http")
+	if f.HTTP == nil {
+		f.HTTP = &arkimeHTTP{}
+	}
+	return f.HTTP
+}
+
+func (a *Arkime) HandleDNS(msg *dns.Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.datagramFlow
+	if f == nil || a.datagram != (datagramKey{msg.Timestamp.UnixNano(), msg.SrcIP, msg.DstIP}) {
+		key := newConnKey(msg.SrcIP, "", msg.DstIP, "")
+		if f = a.open[key]; f == nil {
+			f = a.newFlow(key, msg.Timestamp, msg.SrcIP, "", msg.DstIP, "", int(layers.IPProtocolUDP))
+		}
+	}
+	addUnique(&f.Protocol, "dns")
+	if f.DNS == nil {
+		f.DNS = &arkimeDNS{}
+	}
+	d := f.DNS
+	addUnique(&d.Host, strings.ToLower(strings.TrimSuffix(msg.Question, ".")))
+	addUnique(&d.QT, msg.QType)
+	addUnique(&d.QC, "IN")
+	addUnique(&d.Opcode, "QUERY")
+	if !msg.Response {
+		return
+	}
+	addUnique(&d.Status, msg.Rcode)
+	for _, r := range msg.Answers {
+		if r.Type == "A" || r.Type == "AAAA" {
+			addUnique(&d.IP, r.Value)
+		}
+	}
+}
+
+// HandleStats writes the sessions, in the order they started.
+func (a *Arkime) HandleStats(analyzer.StatsSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sort.SliceStable(a.all, func(i, j int) bool { return a.all[i].first.Before(a.all[j].first) })
+	now := time.Now().UnixMilli()
+	enc := json.NewEncoder(a.w)
+	enc.SetEscapeHTML(false)
+	for _, f := range a.all {
+		type action struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		id := a.sessionID(f)
+		enc.Encode(map[string]action{"index": {Index: a.Prefix + "sessions3-" + id[:6], ID: id}})
+		enc.Encode(f.document(a.Node, now))
+	}
+	a.all = nil
+	a.open = make(map[connKey]*arkimeFlow)
+	a.byConn = make(map[int64]*arkimeFlow)
+}
+
+// sessionID returns an ID the way Arkime forms them, starting with the
+// day of the first packet, which the viewer takes the index from. It is
+// derived from the session, so exporting a capture again replaces its
+// sessions rather than adding them twice.
+func (a *Arkime) sessionID(f *arkimeFlow) string {
+	sum := sha256.Sum256([]byte(a.Node + " " + f.key.a + " " + f.key.b + " " + strconv.FormatInt(f.first.UnixNano(), 10)))
+	return f.first.UTC().Format("060102") + "-" + base64.RawURLEncoding.EncodeToString(sum[:18])
+}
+
+// document completes the session's fields for writing.
+func (f *arkimeFlow) document(node string, now int64) *arkimeSession {
+	s := &f.arkimeSession
+	s.Timestamp = now
+	s.Node = node
+	s.FirstPacket, s.LastPacket = f.first.UnixMilli(), f.last.UnixMilli()
+	s.Length = s.LastPacket - s.FirstPacket
+	s.SegmentCnt = 1
+	s.ProtocolCnt = len(s.Protocol)
+	s.Tags = []string{"pcap-analyzer"}
+	s.TagsCnt = len(s.Tags)
+	if h := s.HTTP; h != nil {
+		h.MethodCnt, h.HostCnt, h.URICnt, h.PathCnt = len(h.Method), len(h.Host), len(h.URI), len(h.Path)
+		h.UserAgentCnt, h.StatusCodeCnt = len(h.UserAgent), len(h.StatusCode)
+		h.ClientVersionCnt, h.ServerVersionCnt = len(h.ClientVersion), len(h.ServerVersion)
+		h.RequestHeaderCnt, h.ResponseHeaderCnt = len(h.RequestHeader), len(h.ResponseHeader)
+		h.MD5Cnt, h.SHA256Cnt = len(h.MD5), len(h.SHA256)
+	}
+	if d := s.DNS; d != nil {
+		d.HostCnt, d.IPCnt, d.QTCnt, d.QCCnt = len(d.Host), len(d.IP), len(d.QT), len(d.QC)
+		d.StatusCnt, d.OpcodeCnt = len(d.Status), len(d.Opcode)
+	}
+	if t := s.TLS; t != nil {
+		t.VersionCnt, t.CipherCnt, t.JA3Cnt, t.JA4Cnt = len(t.Version), len(t.Cipher), len(t.JA3), len(t.JA4)
+	}
+	for i := range s.Cert {
+		s.Cert[i].AltCnt = len(s.Cert[i].Alt)
+	}
+	s.CertCnt = len(s.Cert)
+	return s
+}
@@ -0,0 +1,76 @@
+package output
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filetype"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Binaries saves every executable, script and archive transferred in a
+// request or response body to a directory, named by its SHA-256 and
+// decoded from any Content-Encoding. Content is recognised whatever its
+// Content-Type says.
+type Binaries struct {
+	dir string
+	// Err is called with any error writing a file; nil ignores them.
+	Err func(error)
+}
+
+// NewBinaries creates dir if needed and returns a sink writing into it.
+func NewBinaries(dir string) (*Binaries, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Binaries{dir: dir}, nil
+}
+
+func (b *Binaries) HandleRequest(req *httpstream.Request) {
+	b.save(&req.Message)
+}
+
+func (b *Binaries) HandleResponse(resp *httpstream.Response) {
+	b.save(&resp.Message)
+}
+
+func (b *Binaries) HandleDNS(msg *dns.Message) {}
+
+func (b *Binaries) save(m *httpstream.Message) {
+	if m.BodySize == 0 {
+		return
+	}
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(m.DecodedReader(), head)
+	typ, ok := filetype.Detect(head[:n])
+	if !ok {
+		return
+	}
+	if err := b.write(m, typ); err != nil && b.Err != nil {
+		b.Err(err)
+	}
+}
+
+// write copies the body to a temporary file, hashing it on the way, and
+// renames it after its digest; the same file seen twice is kept once.
+func (b *Binaries) write(m *httpstream.Message, typ filetype.Type) error {
+	f, err := os.CreateTemp(b.dir, ".partial-*")
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), m.DecodedReader()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(b.dir, hex.EncodeToString(h.Sum(nil))+typ.Ext))
+}
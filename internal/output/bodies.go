@@ -0,0 +1,68 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Bodies writes every non-empty message body to its own file in a
+// directory. Bodies are copied straight from the stream's reader, so with
+// spooling enabled memory use doesn't grow with body size.
+type Bodies struct {
+	dir string
+	seq atomic.Int64
+	// Err is called with any error writing a body; nil ignores them.
+	Err func(error)
+}
+
+// NewBodies creates dir if needed and returns a sink writing into it.
+func NewBodies(dir string) (*Bodies, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Bodies{dir: dir}, nil
+}
+
+func (b *Bodies) HandleRequest(req *httpstream.Request) {
+	b.save("request", &req.Message)
+}
+
+func (b *Bodies) HandleResponse(resp *httpstream.Response) {
+	b.save("response", &resp.Message)
+}
+
+func (b *Bodies) HandleDNS(msg *dns.Message) {}
+
+// save writes the body as it was transferred; Content-Encoding is left
+// alone so the file matches the wire.
+func (b *Bodies) save(kind string, m *httpstream.Message) {
+	if m.BodySize == 0 {
+		return
+	}
+	name := fmt.Sprintf("%06d-%s-%s_%s-%s_%s.bin", b.seq.Add(1), kind,
+		m.SrcIP, m.SrcPort, m.DstIP, m.DstPort)
+	// IPv6 addresses contain colons, which some filesystems reject
+	name = strings.ReplaceAll(name, ":", ".")
+	if err := writeFile(filepath.Join(b.dir, name), m.BodyReader()); err != nil && b.Err != nil {
+		b.Err(err)
+	}
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,429 @@
+package output
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/fingerprint"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// ECSVersion is the Elastic Common Schema version the documents follow.
+const ECSVersion = "8.11.0"
+
+// ECS writes events as Elastic Common Schema documents, one JSON object
+// per line, for Elasticsearch and the Elastic Security dashboards and
+// rules built on those fields. An HTTP request and its response make one
+// document, written when the response arrives; requests never answered
+// are written at the end. TLS handshakes are documents of their own,
+// carrying the client's JA3 and, before TLS 1.3, the server's
+// certificate.
+type ECS struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	pending map[*httpstream.Request]bool
+	hellos  *fingerprint.Hellos
+	clients map[string]*ecsDoc
+}
+
+// NewECS returns an ECS writing one JSON document per line to w.
+func NewECS(w io.Writer) *ECS {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &ECS{
+		enc:     enc,
+		pending: make(map[*httpstream.Request]bool),
+		hellos:  fingerprint.NewHellos(),
+		clients: make(map[string]*ecsDoc),
+	}
+}
+
+type ecsDoc struct {
+	Timestamp   time.Time     `json:"@timestamp"`
+	ECS         ecsVersion    `json:"ecs"`
+	Event       ecsEvent      `json:"event"`
+	Source      *ecsEndpoint  `json:"source,omitempty"`
+	Destination *ecsEndpoint  `json:"destination,omitempty"`
+	Network     ecsNetwork    `json:"network"`
+	URL         *ecsURL       `json:"url,omitempty"`
+	HTTP        *ecsHTTP      `json:"http,omitempty"`
+	UserAgent   *ecsUserAgent `json:"user_agent,omitempty"`
+	DNS         *ecsDNS       `json:"dns,omitempty"`
+	TLS         *ecsTLS       `json:"tls,omitempty"`
+	Related     *ecsRelated   `json:"related,omitempty"`
+}
+
+type ecsVersion struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Dataset  string   `json:"dataset"`
+	Module   string   `json:"module"`
+	Outcome  string   `json:"outcome,omitempty"`
+	// Duration is in nanoseconds.
+	Duration int64 `json:"duration,omitempty"`
+}
+
+type ecsEndpoint struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port,omitempty"`
+}
+
+type ecsNetwork struct {
+	Transport string `json:"transport"`
+	Protocol  string `json:"protocol"`
+	Type      string `json:"type,omitempty"`
+}
+
+type ecsURL struct {
+	Full     string `json:"full"`
+	Original string `json:"original,omitempty"`
+	Scheme   string `json:"scheme,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+type ecsHTTP struct {
+	Version  string           `json:"version,omitempty"`
+	Request  *ecsHTTPRequest  `json:"request,omitempty"`
+	Response *ecsHTTPResponse `json:"response,omitempty"`
+}
+
+type ecsBody struct {
+	Bytes int64 `json:"bytes"`
+}
+
+type ecsHTTPRequest struct {
+	ID       string   `json:"id,omitempty"`
+	Method   string   `json:"method"`
+	Referrer string   `json:"referrer,omitempty"`
+	MimeType string   `json:"mime_type,omitempty"`
+	Body     *ecsBody `json:"body,omitempty"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int      `json:"status_code"`
+	MimeType   string   `json:"mime_type,omitempty"`
+	Body       *ecsBody `json:"body,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsDNS struct {
+	Type         string         `json:"type"`
+	Question     ecsDNSQuestion `json:"question"`
+	ResponseCode string         `json:"response_code,omitempty"`
+	Answers      []ecsDNSAnswer `json:"answers,omitempty"`
+	ResolvedIP   []string       `json:"resolved_ip,omitempty"`
+}
+
+type ecsDNSQuestion struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type ecsDNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+type ecsTLS struct {
+	VersionProtocol string        `json:"version_protocol,omitempty"`
+	Version         string        `json:"version,omitempty"`
+	Cipher          string        `json:"cipher,omitempty"`
+	Client          *ecsTLSClient `json:"client,omitempty"`
+	Server          *ecsTLSServer `json:"server,omitempty"`
+}
+
+type ecsTLSClient struct {
+	JA3        string `json:"ja3"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+type ecsTLSServer struct {
+	Subject   string     `json:"subject,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	X509      *ecsX509   `json:"x509,omitempty"`
+}
+
+type ecsX509 struct {
+	SerialNumber     string      `json:"serial_number,omitempty"`
+	AlternativeNames []string    `json:"alternative_names,omitempty"`
+	Subject          ecsX509Name `json:"subject"`
+	Issuer           ecsX509Name `json:"issuer"`
+}
+
+type ecsX509Name struct {
+	CommonName []string `json:"common_name,omitempty"`
+}
+
+type ecsRelated struct {
+	IP    []string `json:"ip,omitempty"`
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+func newECSDoc(ts time.Time, dataset string, category, typ []string) *ecsDoc {
+	return &ecsDoc{
+		Timestamp: ts.UTC(),
+		ECS:       ecsVersion{ECSVersion},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: category,
+			Type:     typ,
+			Dataset:  "pcap_analyzer." + dataset,
+			Module:   "pcap_analyzer",
+		},
+	}
+}
+
+func ecsEndpointOf(ip, port string) *ecsEndpoint {
+	p, _ := strconv.Atoi(port)
+	return &ecsEndpoint{IP: ip, Port: p}
+}
+
+// ipType returns ECS's network.type for an address.
+func ipType(ip string) string {
+	switch a := net.ParseIP(ip); {
+	case a == nil:
+		return ""
+	case a.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+func (e *ECS) write(d *ecsDoc) {
+	e.enc.Encode(d)
+}
+
+func (e *ECS) HandleRequest(req *httpstream.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[req] = true
+}
+
+func (e *ECS) HandleResponse(resp *httpstream.Response) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if resp.Request != nil {
+		delete(e.pending, resp.Request)
+	}
+	e.write(httpDoc(resp.Request, resp))
+}
+
+// HandleStats writes a document for each request that was never
+// answered, with no http.response and an event.outcome of unknown, then
+// the ClientHellos that were never answered.
+func (e *ECS) HandleStats(analyzer.StatsSnapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reqs := make([]*httpstream.Request, 0, len(e.pending))
+	for req := range e.pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Timestamp.Before(reqs[j].Timestamp) })
+	for _, req := range reqs {
+		e.write(httpDoc(req, nil))
+	}
+	e.pending = make(map[*httpstream.Request]bool)
+	e.flushHellos()
+}
+
+// httpDoc returns the document of a transaction, either half of which may
+// be missing.
+func httpDoc(req *httpstream.Request, resp *httpstream.Response) *ecsDoc {
+	var d *ecsDoc
+	var flow httpstream.Flow
+	if req != nil {
+		d = newECSDoc(req.Timestamp, "http", []string{"network", "web"}, []string{"access", "protocol"})
+		flow = req.Flow
+	} else {
+		d = newECSDoc(resp.Timestamp, "http", []string{"network", "web"}, []string{"access", "protocol"})
+		flow = resp.Flow.Reverse()
+	}
+	d.Source, d.Destination = ecsEndpointOf(flow.SrcIP, flow.SrcPort), ecsEndpointOf(flow.DstIP, flow.DstPort)
+	d.Network = ecsNetwork{Transport: "tcp", Protocol: "http", Type: ipType(flow.SrcIP)}
+	d.HTTP = &ecsHTTP{}
+	d.Related = &ecsRelated{IP: []string{flow.SrcIP, flow.DstIP}}
+
+	if req != nil {
+		d.HTTP.Version = strings.TrimPrefix(req.Proto, "HTTP/")
+		d.HTTP.Request = &ecsHTTPRequest{
+			ID:       req.ID(),
+			Method:   req.Method,
+			Referrer: req.Header.Get("Referer"),
+			MimeType: mimeType(req.Header.Get("Content-Type")),
+		}
+		if req.BodySize > 0 {
+			d.HTTP.Request.Body = &ecsBody{Bytes: req.BodySize}
+		}
+		if ua := req.Header.Get("User-Agent"); ua != "" {
+			d.UserAgent = &ecsUserAgent{Original: ua}
+		}
+		d.URL = ecsURLOf(req)
+		if d.URL.Domain != "" {
+			d.Related.Hosts = []string{d.URL.Domain}
+		}
+		d.Event.Outcome = "unknown"
+	}
+	if resp != nil {
+		if d.HTTP.Version == "" {
+			d.HTTP.Version = strings.TrimPrefix(resp.Proto, "HTTP/")
+		}
+		d.HTTP.Response = &ecsHTTPResponse{
+			StatusCode: resp.StatusCode,
+			MimeType:   mimeType(resp.Header.Get("Content-Type")),
+		}
+		if resp.BodySize > 0 {
+			d.HTTP.Response.Body = &ecsBody{Bytes: resp.BodySize}
+		}
+		d.Event.Outcome = "success"
+		if resp.StatusCode >= 400 {
+			d.Event.Outcome = "failure"
+		}
+		if req != nil {
+			d.Event.Duration = int64(resp.Timestamp.Sub(req.Timestamp))
+		}
+	}
+	return d
+}
+
+func ecsURLOf(req *httpstream.Request) *ecsURL {
+	u := &ecsURL{Full: req.URL, Original: req.URI}
+	p, err := url.Parse(req.URL)
+	if err != nil {
+		return u
+	}
+	u.Scheme, u.Domain, u.Path, u.Query = p.Scheme, p.Hostname(), p.Path, p.RawQuery
+	u.Port, _ = strconv.Atoi(p.Port())
+	return u
+}
+
+// mimeType strips the parameters from a Content-Type.
+func mimeType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(t)
+}
+
+func (e *ECS) HandleDNS(msg *dns.Message) {
+	d := newECSDoc(msg.Timestamp, "dns", []string{"network"}, []string{"protocol"})
+	d.Source, d.Destination = &ecsEndpoint{IP: msg.SrcIP}, &ecsEndpoint{IP: msg.DstIP}
+	d.Network = ecsNetwork{Transport: "udp", Protocol: "dns", Type: ipType(msg.SrcIP)}
+	name := strings.TrimSuffix(msg.Question, ".")
+	d.DNS = &ecsDNS{Type: "query", Question: ecsDNSQuestion{Name: name, Type: msg.QType}}
+	d.Related = &ecsRelated{IP: []string{msg.SrcIP, msg.DstIP}, Hosts: []string{name}}
+	if msg.Response {
+		d.DNS.Type = "answer"
+		d.DNS.ResponseCode = msg.Rcode
+		d.Event.Outcome = "success"
+		if msg.Rcode != "NOERROR" {
+			d.Event.Outcome = "failure"
+		}
+		for _, a := range msg.Answers {
+			d.DNS.Answers = append(d.DNS.Answers, ecsDNSAnswer{
+				Name: strings.TrimSuffix(a.Name, "."),
+				Type: a.Type,
+				Data: strings.TrimSuffix(a.Value, "."),
+			})
+			if a.Type == "A" || a.Type == "AAAA" {
+				d.DNS.ResolvedIP = append(d.DNS.ResolvedIP, a.Value)
+			}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.write(d)
+}
+
+// HandlePacket follows TLS handshakes. A ClientHello is held until the
+// ServerHello answering it, so the two make one document.
+func (e *ECS) HandlePacket(p *analyzer.Packet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	client, server := e.hellos.Packet(p)
+	switch {
+	case client != nil:
+		key := p.Network.String() + " " + p.Transport.String()
+		d := newECSDoc(p.CaptureInfo.Timestamp, "tls", []string{"network"}, []string{"connection", "protocol"})
+		src, dst := p.Network.Src().String(), p.Network.Dst().String()
+		d.Source, d.Destination = ecsEndpointOf(src, p.Transport.Src().String()), ecsEndpointOf(dst, p.Transport.Dst().String())
+		d.Network = ecsNetwork{Transport: "tcp", Protocol: "tls", Type: ipType(src)}
+		d.TLS = &ecsTLS{Client: &ecsTLSClient{JA3: client.JA3(), ServerName: client.SNI}}
+		d.Related = &ecsRelated{IP: []string{src, dst}}
+		if client.SNI != "" {
+			d.Related.Hosts = []string{client.SNI}
+		}
+		e.clients[key] = d
+	case server != nil:
+		key := p.Network.Reverse().String() + " " + p.Transport.Reverse().String()
+		d, ok := e.clients[key]
+		if !ok {
+			return
+		}
+		delete(e.clients, key)
+		d.TLS.VersionProtocol = "tls"
+		d.TLS.Version = strings.TrimPrefix(fingerprint.VersionName(server.Version), "TLS ")
+		if strings.HasPrefix(d.TLS.Version, "SSL") {
+			d.TLS.VersionProtocol, d.TLS.Version = "ssl", strings.TrimPrefix(d.TLS.Version, "SSL ")
+		}
+		d.TLS.Cipher = tls.CipherSuiteName(server.Cipher)
+		if c := server.Certificate; c != nil {
+			notBefore, notAfter := c.NotBefore.UTC(), c.NotAfter.UTC()
+			d.TLS.Server = &ecsTLSServer{
+				Subject:   c.Subject.String(),
+				Issuer:    c.Issuer.String(),
+				NotBefore: &notBefore,
+				NotAfter:  &notAfter,
+				X509: &ecsX509{
+					SerialNumber:     strings.ToUpper(c.SerialNumber.Text(16)),
+					AlternativeNames: c.DNSNames,
+					Subject:          ecsX509Name{CommonName: nonEmpty(c.Subject.CommonName)},
+					Issuer:           ecsX509Name{CommonName: nonEmpty(c.Issuer.CommonName)},
+				},
+			}
+		}
+		e.write(d)
+	}
+}
+
+// flushHellos writes the ClientHellos no ServerHello answered.
+func (e *ECS) flushHellos() {
+	docs := make([]*ecsDoc, 0, len(e.clients))
+	for _, d := range e.clients {
+		docs = append(docs, d)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Timestamp.Before(docs[j].Timestamp) })
+	for _, d := range docs {
+		e.write(d)
+	}
+	e.clients = make(map[string]*ecsDoc)
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
@@ -0,0 +1,194 @@
+package output
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// EVE writes HTTP transactions as Suricata's EVE JSON http events, one
+// per line, so that SIEM parsers and dashboards built for Suricata take
+// them unchanged. As with ECS, a request and its response make one event,
+// written when the response arrives; requests never answered are written
+// at the end. Flow IDs are derived from the connection, and events carry
+// the Community ID of their flow, for joining them with Zeek and
+// Suricata's own logs.
+type EVE struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	pending map[*httpstream.Request]bool
+}
+
+// NewEVE returns an EVE writing one event per line to w.
+func NewEVE(w io.Writer) *EVE {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &EVE{enc: enc, pending: make(map[*httpstream.Request]bool)}
+}
+
+type eveEvent struct {
+	Timestamp   string   `json:"timestamp"`
+	FlowID      uint64   `json:"flow_id"`
+	EventType   string   `json:"event_type"`
+	SrcIP       string   `json:"src_ip"`
+	SrcPort     int      `json:"src_port"`
+	DestIP      string   `json:"dest_ip"`
+	DestPort    int      `json:"dest_port"`
+	Proto       string   `json:"proto"`
+	PktSrc      string   `json:"pkt_src"`
+	CommunityID string   `json:"community_id,omitempty"`
+	TxID        int      `json:"tx_id"`
+	HTTP        *eveHTTP `json:"http"`
+}
+
+type eveHTTP struct {
+	Hostname        string `json:"hostname,omitempty"`
+	HTTPPort        int    `json:"http_port,omitempty"`
+	URL             string `json:"url,omitempty"`
+	HTTPUserAgent   string `json:"http_user_agent,omitempty"`
+	XFF             string `json:"xff,omitempty"`
+	HTTPContentType string `json:"http_content_type,omitempty"`
+	HTTPRefer       string `json:"http_refer,omitempty"`
+	HTTPMethod      string `json:"http_method,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	Status          int    `json:"status,omitempty"`
+	Redirect        string `json:"redirect,omitempty"`
+	Length          int64  `json:"length"`
+}
+
+func (e *EVE) HandleRequest(req *httpstream.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[req] = true
+}
+
+func (e *EVE) HandleResponse(resp *httpstream.Response) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if resp.Request != nil {
+		delete(e.pending, resp.Request)
+	}
+	e.enc.Encode(eveHTTPEvent(resp.Request, resp))
+}
+
+func (e *EVE) HandleDNS(*dns.Message) {}
+
+// HandleStats writes an http event for each request that was never
+// answered, with no status or response length.
+func (e *EVE) HandleStats(analyzer.StatsSnapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reqs := make([]*httpstream.Request, 0, len(e.pending))
+	for req := range e.pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Timestamp.Before(reqs[j].Timestamp) })
+	for _, req := range reqs {
+		e.enc.Encode(eveHTTPEvent(req, nil))
+	}
+	e.pending = make(map[*httpstream.Request]bool)
+}
+
+// eveHTTPEvent returns the event of a transaction, either half of which
+// may be missing.
+func eveHTTPEvent(req *httpstream.Request, resp *httpstream.Response) *eveEvent {
+	var flow httpstream.Flow
+	var ts time.Time
+	var conn int64
+	var seq int
+	if req != nil {
+		flow, ts, conn, seq = req.Flow, req.Timestamp, req.Conn, req.Seq
+	} else {
+		flow, ts, conn, seq = resp.Flow.Reverse(), resp.Timestamp, resp.Conn, resp.Seq
+	}
+	srcPort, _ := strconv.Atoi(flow.SrcPort)
+	dstPort, _ := strconv.Atoi(flow.DstPort)
+	ev := &eveEvent{
+		Timestamp:   ts.UTC().Format("2006-01-02T15:04:05.000000-0700"),
+		FlowID:      eveFlowID(conn, flow),
+		EventType:   "http",
+		SrcIP:       flow.SrcIP,
+		SrcPort:     srcPort,
+		DestIP:      flow.DstIP,
+		DestPort:    dstPort,
+		Proto:       "TCP",
+		PktSrc:      "wire/pcap",
+		CommunityID: communityID(flow.SrcIP, flow.DstIP, srcPort, dstPort, 6),
+		TxID:        max(seq-1, 0),
+		HTTP:        &eveHTTP{},
+	}
+	h := ev.HTTP
+	if req != nil {
+		h.Hostname = req.Host
+		if host, port, err := net.SplitHostPort(req.Host); err == nil {
+			h.Hostname = host
+			h.HTTPPort, _ = strconv.Atoi(port)
+		}
+		h.URL = req.URI
+		h.HTTPUserAgent = req.Header.Get("User-Agent")
+		h.XFF = req.Header.Get("X-Forwarded-For")
+		h.HTTPRefer = req.Header.Get("Referer")
+		h.HTTPMethod = req.Method
+		h.Protocol = req.Proto
+	}
+	if resp != nil {
+		if h.Protocol == "" {
+			h.Protocol = resp.Proto
+		}
+		h.HTTPContentType = mimeType(resp.Header.Get("Content-Type"))
+		h.Status = resp.StatusCode
+		h.Redirect = resp.Header.Get("Location")
+		h.Length = resp.BodySize
+	}
+	return ev
+}
+
+// eveFlowID returns the flow ID of a connection. Like Suricata's, it fits
+// in 51 bits, so that JSON readers holding numbers as doubles keep it
+// whole.
+func eveFlowID(conn int64, flow httpstream.Flow) uint64 {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(conn, 10) + " " + flow.String()))
+	return binary.BigEndian.Uint64(sum[:8]) & (1<<51 - 1)
+}
+
+// communityID returns the Community ID, version 1 with seed 0, of a flow:
+// the same for both directions, and computed the same way by Zeek,
+// Suricata and Arkime, so that their records of a flow can be joined. It
+// returns "" for addresses that don't parse.
+func communityID(srcIP, dstIP string, srcPort, dstPort int, proto byte) string {
+	src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP)
+	if src == nil || dst == nil {
+		return ""
+	}
+	if s4, d4 := src.To4(), dst.To4(); s4 != nil && d4 != nil {
+		src, dst = s4, d4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+	// The endpoints are ordered so that both directions hash the same
+	if c := bytes.Compare(src, dst); c > 0 || c == 0 && srcPort > dstPort {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	h := sha1.New()
+	h.Write([]byte{0, 0}) // seed
+	h.Write(src)
+	h.Write(dst)
+	h.Write([]byte{proto, 0})
+	binary.Write(h, binary.BigEndian, uint16(srcPort))
+	binary.Write(h, binary.BigEndian, uint16(dstPort))
+	return "1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
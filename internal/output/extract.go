@@ -0,0 +1,128 @@
+package output
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Extract picks the packets of one flow or transaction out of a capture
+// with Keep. A flow is named by the number of its first packet, as query
+// flows lists it, and a transaction by its ID in the text output, such as
+// 19.2 for the second request on the connection opened by packet 19.
+//
+// As a handler, Extract records when each request on the transaction's
+// connection was sent: a transaction's packets are those from its request
+// up to the next one, plus the connection's handshake. A pipelined response
+// that arrives after the next request was sent goes with the later
+// transaction.
+type Extract struct {
+	conn int64
+	// seq is zero when a whole flow is extracted.
+	seq int
+
+	mu     sync.Mutex
+	starts map[int]time.Time
+
+	// The flow's endpoints, and whether it has begun to close, are learnt
+	// from the packets Keep sees in capture order
+	key     connKey
+	tcp     bool
+	closing bool
+	done    bool
+}
+
+// NewExtract returns an Extract for a flow or transaction ID.
+func NewExtract(id string) (*Extract, error) {
+	connID, seqID, isTx := strings.Cut(id, ".")
+	conn, err := strconv.ParseInt(connID, 10, 64)
+	if err != nil || conn <= 0 {
+		return nil, fmt.Errorf("%q is neither a packet number nor a transaction ID", id)
+	}
+	e := &Extract{conn: conn, starts: make(map[int]time.Time)}
+	if isTx {
+		if e.seq, err = strconv.Atoi(seqID); err != nil || e.seq <= 0 {
+			return nil, fmt.Errorf("%q is neither a packet number nor a transaction ID", id)
+		}
+	}
+	return e, nil
+}
+
+func (e *Extract) HandleRequest(req *httpstream.Request) {
+	if req.Conn != e.conn {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.starts[req.Seq] = req.Timestamp
+}
+
+func (e *Extract) HandleResponse(resp *httpstream.Response) {}
+
+func (e *Extract) HandleDNS(msg *dns.Message) {}
+
+// Found reports whether the transaction was seen. It is always true for a
+// flow, which Keep looks for in the packets themselves.
+func (e *Extract) Found() bool {
+	if e.seq == 0 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.starts[e.seq]
+	return ok
+}
+
+// Keep reports whether p belongs to the flow or transaction. Packets must
+// be passed in capture order, once the capture has been analyzed.
+func (e *Extract) Keep(p *analyzer.Packet) bool {
+	if p.Number < e.conn || e.done {
+		return false
+	}
+	src, dst := p.Network.Endpoints()
+	sport, dport := p.Transport.Endpoints()
+	key := newConnKey(src.String(), sport.String(), dst.String(), dport.String())
+	if p.Number == e.conn {
+		e.key, e.tcp = key, p.TCP != nil
+	} else if key != e.key || e.tcp != (p.TCP != nil) {
+		return false
+	}
+
+	if tcp := p.TCP; tcp != nil {
+		if tcp.SYN && !tcp.ACK && e.closing {
+			// The ports have been reused by a new connection
+			e.done = true
+			return false
+		}
+		if tcp.FIN || tcp.RST {
+			e.closing = true
+		}
+		if tcp.SYN {
+			return true
+		}
+	}
+	if e.seq == 0 {
+		return true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	start, ok := e.starts[e.seq]
+	if !ok {
+		return false
+	}
+	ts := p.CaptureInfo.Timestamp
+	if e.seq > 1 && ts.Before(start) {
+		return false
+	}
+	if next, ok := e.starts[e.seq+1]; ok && !ts.Before(next) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,460 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// FieldOptions controls how Fields formats its lines, after tshark's -E
+// options.
+type FieldOptions struct {
+	// Header prints the field names as the first line.
+	Header bool
+	// Separator goes between fields and Aggregator between the values of
+	// a field that occurs more than once.
+	Separator, Aggregator string
+	// Occurrence picks which values of such a field are printed: 'f' the
+	// first, 'l' the last and 'a' all of them.
+	Occurrence byte
+	// Quote, if not zero, is put around every field.
+	Quote byte
+	// Escape writes tabs, newlines and backslashes in values as \t, \n
+	// and \\.
+	Escape bool
+}
+
+// DefaultFieldOptions are tshark's defaults.
+var DefaultFieldOptions = FieldOptions{Separator: "\t", Aggregator: ",", Occurrence: 'a', Escape: true}
+
+// Set applies an option in tshark's -E syntax, such as separator=, or
+// header=y.
+func (o *FieldOptions) Set(option string) error {
+	name, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return fmt.Errorf("%q: want name=value", option)
+	}
+	switch name {
+	case "header", "escape":
+		var on bool
+		switch value {
+		case "y":
+			on = true
+		case "n":
+		default:
+			return fmt.Errorf("%s=%s: want y or n", name, value)
+		}
+		if name == "header" {
+			o.Header = on
+		} else {
+			o.Escape = on
+		}
+	case "separator", "aggregator":
+		switch value {
+		case "/t":
+			value = "\t"
+		case "/s":
+			value = " "
+		case "":
+			return fmt.Errorf("%s: missing value", name)
+		}
+		if name == "separator" {
+			o.Separator = value
+		} else {
+			o.Aggregator = value
+		}
+	case "occurrence":
+		if value != "f" && value != "l" && value != "a" {
+			return fmt.Errorf("occurrence=%s: want f, l or a", value)
+		}
+		o.Occurrence = value[0]
+	case "quote":
+		switch value {
+		case "d":
+			o.Quote = '"'
+		case "s":
+			o.Quote = '\''
+		case "n":
+			o.Quote = 0
+		default:
+			return fmt.Errorf("quote=%s: want d, s or n", value)
+		}
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// fieldEvent is what a field is read from: a request, a response, or a
+// DNS message.
+type fieldEvent struct {
+	req  *httpstream.Request
+	resp *httpstream.Response
+	dns  *dns.Message
+}
+
+func (e *fieldEvent) message() *httpstream.Message {
+	switch {
+	case e.req != nil:
+		return &e.req.Message
+	case e.resp != nil:
+		return &e.resp.Message
+	}
+	return nil
+}
+
+// endpoints returns the event's addresses and, for HTTP, ports.
+func (e *fieldEvent) endpoints() (srcIP, srcPort, dstIP, dstPort string) {
+	if e.dns != nil {
+		return e.dns.SrcIP, "", e.dns.DstIP, ""
+	}
+	m := e.message()
+	return m.SrcIP, m.SrcPort, m.DstIP, m.DstPort
+}
+
+func (e *fieldEvent) time() time.Time {
+	if e.dns != nil {
+		return e.dns.Timestamp
+	}
+	return e.message().Timestamp
+}
+
+type fieldFunc func(e *fieldEvent) []string
+
+func one(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// address returns the address if it is of the wanted family.
+func address(addr string, v4 bool) []string {
+	ip := net.ParseIP(addr)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil
+	}
+	return []string{addr}
+}
+
+// headerFields are the tshark fields that are the value of a header.
+var headerFields = map[string]string{
+	"http.user_agent":       "User-Agent",
+	"http.referer":          "Referer",
+	"http.accept":           "Accept",
+	"http.accept_encoding":  "Accept-Encoding",
+	"http.accept_language":  "Accept-Language",
+	"http.authorization":    "Authorization",
+	"http.cookie":           "Cookie",
+	"http.connection":       "Connection",
+	"http.cache_control":    "Cache-Control",
+	"http.x_forwarded_for":  "X-Forwarded-For",
+	"http.content_type":     "Content-Type",
+	"http.content_length":   "Content-Length",
+	"http.content_encoding": "Content-Encoding",
+	"http.location":         "Location",
+	"http.server":           "Server",
+	"http.set_cookie":       "Set-Cookie",
+	"http.last_modified":    "Last-Modified",
+	"http.date":             "Date",
+}
+
+// fieldFuncs are the other supported fields, named as tshark names them.
+var fieldFuncs = map[string]fieldFunc{
+	"frame.time": func(e *fieldEvent) []string {
+		return []string{e.time().Local().Format("Jan _2, 2006 15:04:05.000000000 MST")}
+	},
+	"frame.time_epoch": func(e *fieldEvent) []string {
+		t := e.time()
+		return []string{fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())}
+	},
+	"ip.src": func(e *fieldEvent) []string {
+		src, _, _, _ := e.endpoints()
+		return address(src, true)
+	},
+	"ip.dst": func(e *fieldEvent) []string {
+		_, _, dst, _ := e.endpoints()
+		return address(dst, true)
+	},
+	"ipv6.src": func(e *fieldEvent) []string {
+		src, _, _, _ := e.endpoints()
+		return address(src, false)
+	},
+	"ipv6.dst": func(e *fieldEvent) []string {
+		_, _, dst, _ := e.endpoints()
+		return address(dst, false)
+	},
+	"tcp.srcport": func(e *fieldEvent) []string {
+		_, port, _, _ := e.endpoints()
+		return one(port)
+	},
+	"tcp.dstport": func(e *fieldEvent) []string {
+		_, _, _, port := e.endpoints()
+		return one(port)
+	},
+	"http.request.method": func(e *fieldEvent) []string {
+		if e.req == nil {
+			return nil
+		}
+		return one(e.req.Method)
+	},
+	"http.host": func(e *fieldEvent) []string {
+		// The request line and Host header are parsed out of the headers
+		if e.req == nil {
+			return nil
+		}
+		return one(e.req.Host)
+	},
+	"http.request.uri": func(e *fieldEvent) []string {
+		if e.req == nil {
+			return nil
+		}
+		return one(e.req.URI)
+	},
+	"http.request.full_uri": func(e *fieldEvent) []string {
+		if e.req == nil {
+			return nil
+		}
+		return one(e.req.URL)
+	},
+	"http.request.version": func(e *fieldEvent) []string {
+		if e.req == nil {
+			return nil
+		}
+		return one(e.req.Proto)
+	},
+	"http.response.code": func(e *fieldEvent) []string {
+		if e.resp == nil {
+			return nil
+		}
+		return []string{strconv.Itoa(e.resp.StatusCode)}
+	},
+	"http.response.phrase": func(e *fieldEvent) []string {
+		if e.resp == nil {
+			return nil
+		}
+		_, phrase, _ := strings.Cut(e.resp.Status, " ")
+		return one(phrase)
+	},
+	"http.response.version": func(e *fieldEvent) []string {
+		if e.resp == nil {
+			return nil
+		}
+		return one(e.resp.Proto)
+	},
+	"http.response_for.uri": func(e *fieldEvent) []string {
+		if e.resp == nil || e.resp.Request == nil {
+			return nil
+		}
+		return one(e.resp.Request.URL)
+	},
+	"http.time": func(e *fieldEvent) []string {
+		if e.resp == nil || e.resp.Request == nil {
+			return nil
+		}
+		d := e.resp.Timestamp.Sub(e.resp.Request.Timestamp)
+		return []string{strconv.FormatFloat(d.Seconds(), 'f', 9, 64)}
+	},
+	"http.file_data": func(e *fieldEvent) []string {
+		m := e.message()
+		if m == nil {
+			return nil
+		}
+		body, _, _ := m.DecodedBody()
+		return one(string(body))
+	},
+	"dns.qry.name": func(e *fieldEvent) []string {
+		if e.dns == nil {
+			return nil
+		}
+		return one(strings.TrimSuffix(e.dns.Question, "."))
+	},
+	"dns.qry.type": func(e *fieldEvent) []string {
+		if e.dns == nil {
+			return nil
+		}
+		if t, ok := mdns.StringToType[e.dns.QType]; ok {
+			return []string{strconv.Itoa(int(t))}
+		}
+		return nil
+	},
+	"dns.flags.response": func(e *fieldEvent) []string {
+		if e.dns == nil {
+			return nil
+		}
+		if e.dns.Response {
+			return []string{"1"}
+		}
+		return []string{"0"}
+	},
+	"dns.flags.rcode": func(e *fieldEvent) []string {
+		if e.dns == nil || !e.dns.Response {
+			return nil
+		}
+		if rc, ok := mdns.StringToRcode[e.dns.Rcode]; ok {
+			return []string{strconv.Itoa(rc)}
+		}
+		return nil
+	},
+	"dns.count.answers": func(e *fieldEvent) []string {
+		if e.dns == nil || !e.dns.Response {
+			return nil
+		}
+		return []string{strconv.Itoa(len(e.dns.Answers))}
+	},
+	"dns.resp.name": func(e *fieldEvent) []string {
+		if e.dns == nil {
+			return nil
+		}
+		var names []string
+		for _, rr := range e.dns.Answers {
+			names = append(names, strings.TrimSuffix(rr.Name, "."))
+		}
+		return names
+	},
+	"dns.a":     answers("A"),
+	"dns.aaaa":  answers("AAAA"),
+	"dns.cname": answers("CNAME"),
+}
+
+// answers returns the values of the answer records of type typ.
+func answers(typ string) fieldFunc {
+	return func(e *fieldEvent) []string {
+		if e.dns == nil {
+			return nil
+		}
+		var values []string
+		for _, rr := range e.dns.Answers {
+			if rr.Type == typ {
+				values = append(values, strings.TrimSuffix(rr.Value, "."))
+			}
+		}
+		return values
+	}
+}
+
+// FieldNames returns the names of the fields Fields supports, sorted.
+func FieldNames() []string {
+	names := make([]string, 0, len(fieldFuncs)+len(headerFields))
+	for name := range fieldFuncs {
+		names = append(names, name)
+	}
+	for name := range headerFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Fields prints the chosen fields of every request, response and DNS
+// message, one line each, like tshark -T fields does for every packet.
+// Events that have none of the fields are left out.
+type Fields struct {
+	mu     sync.Mutex
+	w      io.Writer
+	names  []string
+	fields []fieldFunc
+	opts   FieldOptions
+	// started is set once the header, if any, has been printed.
+	started bool
+}
+
+// NewFields returns a Fields printing the named fields, in the order given.
+func NewFields(w io.Writer, names []string, opts FieldOptions) (*Fields, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no fields chosen")
+	}
+	f := &Fields{w: w, names: names, opts: opts}
+	for _, name := range names {
+		if header, ok := headerFields[name]; ok {
+			f.fields = append(f.fields, func(e *fieldEvent) []string {
+				if m := e.message(); m != nil {
+					return m.Header.Values(header)
+				}
+				return nil
+			})
+			continue
+		}
+		fn, ok := fieldFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q; fields are %s", name, strings.Join(FieldNames(), ", "))
+		}
+		f.fields = append(f.fields, fn)
+	}
+	return f, nil
+}
+
+func (f *Fields) HandleRequest(req *httpstream.Request) {
+	f.print(&fieldEvent{req: req})
+}
+
+func (f *Fields) HandleResponse(resp *httpstream.Response) {
+	f.print(&fieldEvent{resp: resp})
+}
+
+func (f *Fields) HandleDNS(msg *dns.Message) {
+	f.print(&fieldEvent{dns: msg})
+}
+
+func (f *Fields) print(e *fieldEvent) {
+	row := make([]string, len(f.fields))
+	empty := true
+	for i, fn := range f.fields {
+		values := fn(e)
+		if len(values) == 0 {
+			continue
+		}
+		empty = false
+		switch f.opts.Occurrence {
+		case 'f':
+			values = values[:1]
+		case 'l':
+			values = values[len(values)-1:]
+		}
+		escaped := make([]string, len(values))
+		for j, v := range values {
+			escaped[j] = f.escape(v)
+		}
+		row[i] = strings.Join(escaped, f.opts.Aggregator)
+	}
+	if empty {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.started {
+		f.started = true
+		if f.opts.Header {
+			f.writeRow(f.names)
+		}
+	}
+	f.writeRow(row)
+}
+
+func (f *Fields) writeRow(row []string) {
+	line := strings.Join(row, f.opts.Separator)
+	if q := string(f.opts.Quote); f.opts.Quote != 0 {
+		line = q + strings.Join(row, q+f.opts.Separator+q) + q
+	}
+	fmt.Fprintln(f.w, line)
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (f *Fields) escape(v string) string {
+	if !f.opts.Escape {
+		return v
+	}
+	return escaper.Replace(v)
+}
@@ -0,0 +1,52 @@
+package output
+
+import (
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Filter passes on to Next only the requests, responses and DNS messages
+// that match an expression. Requests are matched on their own, so a filter
+// on a response field such as status passes responses alone; reports see
+// their requests through Response.Request. Packets and statistics always
+// pass.
+type Filter struct {
+	Next   Handler
+	filter *filter.Filter
+}
+
+func NewFilter(next Handler, f *filter.Filter) *Filter {
+	return &Filter{Next: next, filter: f}
+}
+
+func (f *Filter) HandleRequest(req *httpstream.Request) {
+	if f.filter.MatchRequest(req) {
+		f.Next.HandleRequest(req)
+	}
+}
+
+func (f *Filter) HandleResponse(resp *httpstream.Response) {
+	if f.filter.MatchResponse(resp) {
+		f.Next.HandleResponse(resp)
+	}
+}
+
+func (f *Filter) HandleDNS(msg *dns.Message) {
+	if f.filter.MatchDNS(msg) {
+		f.Next.HandleDNS(msg)
+	}
+}
+
+func (f *Filter) HandlePacket(p *analyzer.Packet) {
+	if ph, ok := f.Next.(analyzer.PacketHandler); ok {
+		ph.HandlePacket(p)
+	}
+}
+
+func (f *Filter) HandleStats(s analyzer.StatsSnapshot) {
+	if sh, ok := f.Next.(analyzer.StatsHandler); ok {
+		sh.HandleStats(s)
+	}
+}
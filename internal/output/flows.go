@@ -0,0 +1,140 @@
+package output
+
+import (
+	"sync"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// connKey identifies a TCP connection in either direction.
+type connKey struct {
+	a, b string
+}
+
+func newConnKey(srcIP, srcPort, dstIP, dstPort string) connKey {
+	a, b := srcIP+"|"+srcPort, dstIP+"|"+dstPort
+	if a > b {
+		a, b = b, a
+	}
+	return connKey{a, b}
+}
+
+// flowKey identifies a TCP connection within one of the captures read
+// together, whose packets are numbered from 1 each.
+type flowKey struct {
+	capture int
+	conn    connKey
+}
+
+// datagramKey identifies the packet a DNS message was read from.
+type datagramKey struct {
+	// ts is the capture time in nanoseconds
+	ts       int64
+	src, dst string
+}
+
+// FlowSet records the connections of the HTTP messages and the datagrams
+// of the DNS messages it is handed, so that their packets can be picked out
+// of the captures afterwards with Keep. Connections are told apart by the
+// capture and the packet that opened them, as the messages carry both, so
+// a later connection on the same addresses and ports isn't kept unless it
+// was recorded too.
+type FlowSet struct {
+	mu sync.Mutex
+	// conns holds the opening packet numbers recorded for each pair of
+	// endpoints; 0 stands for messages whose connection isn't known
+	conns     map[flowKey]map[int64]bool
+	datagrams map[datagramKey]bool
+
+	// Keep follows which connection owns each recorded pair of endpoints
+	// as it sees the packets in order
+	owners map[flowKey]*flowOwner
+}
+
+// flowOwner is the connection a pair of endpoints currently belongs to.
+type flowOwner struct {
+	number  int64
+	closing bool
+}
+
+func NewFlowSet() *FlowSet {
+	return &FlowSet{
+		conns:     make(map[flowKey]map[int64]bool),
+		datagrams: make(map[datagramKey]bool),
+		owners:    make(map[flowKey]*flowOwner),
+	}
+}
+
+func (s *FlowSet) HandleRequest(req *httpstream.Request) {
+	s.addConn(&req.Message)
+}
+
+func (s *FlowSet) HandleResponse(resp *httpstream.Response) {
+	s.addConn(&resp.Message)
+}
+
+func (s *FlowSet) HandleDNS(msg *dns.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datagrams[datagramKey{msg.Timestamp.UnixNano(), msg.SrcIP, msg.DstIP}] = true
+}
+
+func (s *FlowSet) addConn(m *httpstream.Message) {
+	key := flowKey{m.Capture, newConnKey(m.SrcIP, m.SrcPort, m.DstIP, m.DstPort)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[key] == nil {
+		s.conns[key] = make(map[int64]bool)
+	}
+	s.conns[key][m.Conn] = true
+}
+
+// Keep reports whether p belongs to a recorded connection or carried a
+// recorded DNS message. A connection is kept whole, handshake included.
+// Packets must be passed in capture order, once the captures have been
+// analyzed.
+func (s *FlowSet) Keep(p *analyzer.Packet) bool {
+	src, dst := p.Network.Endpoints()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.TCP == nil {
+		return s.datagrams[datagramKey{p.CaptureInfo.Timestamp.UnixNano(), src.String(), dst.String()}]
+	}
+	sport, dport := p.Transport.Endpoints()
+	key := flowKey{p.Capture, newConnKey(src.String(), sport.String(), dst.String(), dport.String())}
+	opened := s.conns[key]
+	if opened == nil {
+		return false
+	}
+	if opened[0] {
+		return true
+	}
+	// A connection starts with its first packet, with a SYN once the one
+	// before began to close, or wherever the analysis started a stream,
+	// as when an idle connection was flushed
+	o := s.owners[key]
+	switch {
+	case o == nil:
+		o = &flowOwner{number: p.Number}
+		s.owners[key] = o
+	case opened[p.Number], p.TCP.SYN && !p.TCP.ACK && o.closing:
+		o.number, o.closing = p.Number, false
+	}
+	if p.TCP.FIN || p.TCP.RST {
+		o.closing = true
+	}
+	return opened[o.number]
+}
+
+// Len returns how many connections and DNS datagrams have been recorded.
+func (s *FlowSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.datagrams)
+	for _, opened := range s.conns {
+		n += len(opened)
+	}
+	return n
+}
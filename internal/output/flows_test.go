@@ -0,0 +1,165 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// pathFilter hands the messages of requests for one path to a FlowSet.
+type pathFilter struct {
+	path  string
+	flows *FlowSet
+}
+
+func (f pathFilter) HandleRequest(req *httpstream.Request) {
+	if req.URI == f.path {
+		f.flows.HandleRequest(req)
+	}
+}
+
+func (f pathFilter) HandleResponse(resp *httpstream.Response) {
+	if resp.Request != nil && resp.Request.URI == f.path {
+		f.flows.HandleResponse(resp)
+	}
+}
+
+func (f pathFilter) HandleDNS(*dns.Message) {}
+
+func TestFlowSetCaptures(t *testing.T) {
+	// Both captures hold one connection on the same endpoints, opened by
+	// their first packet
+	dir := t.TempDir()
+	var paths []string
+	perFile := 0
+	for _, path := range []string{"/a", "/b"} {
+		b := testutil.NewBuilder()
+		b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80",
+			"GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		p := filepath.Join(dir, path[1:]+".pcap")
+		if err := b.WriteFile(p); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+		perFile = b.Len()
+	}
+
+	tests := []struct {
+		path string
+		want []int // captures whose packets are written
+	}{
+		{"/a", []int{0}},
+		{"/b", []int{1}},
+		{"/c", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			flows := NewFlowSet()
+			if err := analyzer.RunFiles(paths, 1, analyzer.Options{}, pathFilter{tt.path, flows}); err != nil {
+				t.Fatal(err)
+			}
+			var captures []int
+			keep := func(p *analyzer.Packet) bool {
+				ok := flows.Keep(p)
+				if ok && (len(captures) == 0 || captures[len(captures)-1] != p.Capture) {
+					captures = append(captures, p.Capture)
+				}
+				return ok
+			}
+			n, err := analyzer.WritePackets(paths, io.Discard, keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := n, int64(perFile*len(tt.want)); got != want {
+				t.Errorf("wrote %d packets, want %d", got, want)
+			}
+			if len(captures) != len(tt.want) || len(tt.want) > 0 && captures[0] != tt.want[0] {
+				t.Errorf("kept packets of captures %v, want %v", captures, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlowSetFilter(t *testing.T) {
+	// span is the packets of a flow, numbered from 1
+	type span struct{ first, last int64 }
+	b := testutil.NewBuilder()
+	add := func(build func()) span {
+		first := int64(b.Len()) + 1
+		build()
+		return span{first, int64(b.Len())}
+	}
+	exchange := func(client, server, path, status string) func() {
+		return func() {
+			b.HTTPExchange(client, server,
+				"GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n",
+				"HTTP/1.1 "+status+"\r\nContent-Length: 0\r\n\r\n")
+		}
+	}
+	lookup := add(func() {
+		b.DNSQuery("10.0.0.1:53000", "10.0.0.53:53", "example.com")
+		b.DNSResponse("10.0.0.1:53000", "10.0.0.53:53", "example.com", "10.0.0.2")
+	})
+	add(func() { b.DNSQuery("10.0.0.1:53001", "10.0.0.53:53", "example.org") })
+	a := add(exchange("10.0.0.1:40000", "10.0.0.2:80", "/a", "200 OK"))
+	other := add(exchange("10.0.0.1:40001", "10.0.0.3:80", "/b", "500 Internal Server Error"))
+	// A later connection on the same endpoints as the first
+	again := add(exchange("10.0.0.1:40000", "10.0.0.2:80", "/c", "404 Not Found"))
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want []span
+	}{
+		{"path == /a", []span{a}},
+		{"path == /c", []span{again}},
+		{"status >= 500", []span{other}},
+		{"dst_ip == 10.0.0.2", []span{a, again}},
+		{"type == dns and name == example.com", []span{lookup}},
+		{"method == GET", []span{a, other, again}},
+		{"status == 302", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := filter.Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flows := NewFlowSet()
+			if err := analyzer.Run(path, analyzer.Options{DNS: true}, NewFilter(flows, f)); err != nil {
+				t.Fatal(err)
+			}
+			var kept []int64
+			keep := func(p *analyzer.Packet) bool {
+				ok := flows.Keep(p)
+				if ok {
+					kept = append(kept, p.Number)
+				}
+				return ok
+			}
+			if _, err := analyzer.WritePackets([]string{path}, io.Discard, keep); err != nil {
+				t.Fatal(err)
+			}
+			var want []int64
+			for _, s := range tt.want {
+				for n := s.first; n <= s.last; n++ {
+					want = append(want, n)
+				}
+			}
+			if fmt.Sprint(kept) != fmt.Sprint(want) {
+				t.Errorf("kept packets %v, want %v", kept, want)
+			}
+		})
+	}
+}
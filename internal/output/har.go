@@ -0,0 +1,177 @@
+package output
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	"github.com/pcap-analyzer/internal/har"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// HAR writes transactions to a HAR file as their responses arrive, and the
+// requests never answered at the end. The packets of each connection time
+// the entries: how long its handshake took before the first request, and
+// how long each request and response took to go out after their first
+// byte.
+type HAR struct {
+	// Filter, when set, limits the file to the transactions whose request
+	// or response matches.
+	Filter *filter.Filter
+
+	mu      sync.Mutex
+	w       *har.Writer
+	pending map[*httpstream.Request]har.Entry
+	conns   map[connKey]*harConn
+	byConn  map[int64]*harConn
+}
+
+// harConn follows the handshake of a connection and the runs of payload
+// each side sends before the other answers.
+type harConn struct {
+	client           string
+	syn, established time.Time
+	synAck           bool
+	// bursts holds when each run that started like an HTTP message ended,
+	// by when it started
+	bursts     map[harBurst]time.Time
+	current    harBurst
+	tracking   bool
+	hasCurrent bool
+}
+
+type harBurst struct {
+	fromClient bool
+	// start is the capture time of the run's first packet, in nanoseconds
+	start int64
+}
+
+func NewHAR(w *har.Writer) *HAR {
+	return &HAR{
+		w:       w,
+		pending: make(map[*httpstream.Request]har.Entry),
+		conns:   make(map[connKey]*harConn),
+		byConn:  make(map[int64]*harConn),
+	}
+}
+
+func (h *HAR) HandlePacket(p *analyzer.Packet) {
+	tcp := p.TCP
+	if tcp == nil {
+		return
+	}
+	src, dst := p.Network.Endpoints()
+	sport, dport := p.Transport.Endpoints()
+	from := src.String() + "|" + sport.String()
+	ts := p.CaptureInfo.Timestamp
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := newConnKey(src.String(), sport.String(), dst.String(), dport.String())
+	c := h.conns[key]
+	if c == nil || tcp.SYN && !tcp.ACK && !c.syn.IsZero() && ts.After(c.syn) {
+		c = &harConn{client: from, bursts: make(map[harBurst]time.Time)}
+		if tcp.SYN && tcp.ACK {
+			c.client = dst.String() + "|" + dport.String()
+		}
+		h.conns[key] = c
+		h.byConn[p.Number] = c
+	}
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		c.syn = ts
+	case tcp.SYN:
+		c.synAck = true
+	case c.synAck && c.established.IsZero():
+		c.established = ts
+	}
+	if len(p.Payload) == 0 {
+		return
+	}
+	fromClient := from == c.client
+	if c.hasCurrent && c.current.fromClient == fromClient {
+		if c.tracking {
+			c.bursts[c.current] = ts
+		}
+		return
+	}
+	c.current, c.hasCurrent = harBurst{fromClient, ts.UnixNano()}, true
+	c.tracking = httpstream.LooksLikeHTTP(p.Payload)
+	if c.tracking {
+		c.bursts[c.current] = ts
+	}
+}
+
+// took returns how long the run of packets carrying m lasted after its
+// first, or zero when its packets weren't seen.
+func (h *HAR) took(m *httpstream.Message, fromClient bool) time.Duration {
+	c := h.byConn[m.Conn]
+	if m.Conn == 0 || c == nil {
+		return 0
+	}
+	b := harBurst{fromClient, m.Timestamp.UnixNano()}
+	end, ok := c.bursts[b]
+	if !ok {
+		return 0
+	}
+	delete(c.bursts, b)
+	return end.Sub(m.Timestamp)
+}
+
+func (h *HAR) HandleRequest(req *httpstream.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := har.Entry{Request: req, Send: h.took(&req.Message, true)}
+	if c := h.byConn[req.Conn]; req.Conn != 0 && c != nil && req.Seq == 1 {
+		if !c.syn.IsZero() && !c.established.IsZero() && !c.established.After(req.Timestamp) {
+			e.Connect = c.established.Sub(c.syn)
+		}
+	}
+	h.pending[req] = e
+}
+
+// matches reports whether a transaction passes the filter.
+func (h *HAR) matches(req *httpstream.Request, resp *httpstream.Response) bool {
+	return h.Filter == nil || h.Filter.MatchRequest(req) || resp != nil && h.Filter.MatchResponse(resp)
+}
+
+func (h *HAR) HandleResponse(resp *httpstream.Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// HAR entries start from a request, so responses to requests that
+	// weren't seen are left out
+	e, ok := h.pending[resp.Request]
+	if resp.Request == nil || !ok {
+		return
+	}
+	delete(h.pending, resp.Request)
+	e.Response = resp
+	e.Receive = h.took(&resp.Message, false)
+	if h.matches(e.Request, resp) {
+		h.w.Write(e)
+	}
+}
+
+func (h *HAR) HandleDNS(*dns.Message) {}
+
+// HandleStats writes an entry for each request that was never answered
+// and passes the filter, with a response of status 0 as browsers record
+// requests that failed.
+func (h *HAR) HandleStats(analyzer.StatsSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]har.Entry, 0, len(h.pending))
+	for _, e := range h.pending {
+		if h.matches(e.Request, nil) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Request.Timestamp.Before(entries[j].Request.Timestamp) })
+	for _, e := range entries {
+		h.w.Write(e)
+	}
+	h.pending = make(map[*httpstream.Request]har.Entry)
+}
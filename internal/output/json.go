@@ -0,0 +1,195 @@
+package output
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// JSON writes each request, response and DNS message as one JSON object
+// per line as it is parsed, for jq and other tools. Addresses that DNS
+// messages in the capture resolved carry the name they resolved from.
+type JSON struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	names map[string]string
+}
+
+// NewJSON returns a JSON writing to w.
+func NewJSON(w io.Writer) *JSON {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSON{enc: enc, names: make(map[string]string)}
+}
+
+type jsonRecord struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	SrcIP     string    `json:"src_ip"`
+	SrcPort   string    `json:"src_port,omitempty"`
+	SrcName   string    `json:"src_name,omitempty"`
+	DstIP     string    `json:"dst_ip"`
+	DstPort   string    `json:"dst_port,omitempty"`
+	DstName   string    `json:"dst_name,omitempty"`
+
+	// Requests
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	URI    string `json:"uri,omitempty"`
+	Host   string `json:"host,omitempty"`
+
+	// Responses
+	Status     string `json:"status,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	// ResponseTime is in seconds since the request.
+	ResponseTime float64 `json:"response_time,omitempty"`
+
+	Proto   string              `json:"proto,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Trailers are the header fields sent after the body.
+	Trailers map[string][]string `json:"trailers,omitempty"`
+	// Body is the body with any Content-Encoding removed, as text, or
+	// in base64 when BodyEncoding says so. At most the first 1MB is kept.
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	BodySize     int64  `json:"body_size,omitempty"`
+	// WireSize is the size of a chunked body with its framing, and the
+	// chunk fields describe that framing.
+	WireSize   int64       `json:"wire_size,omitempty"`
+	ChunkCount int         `json:"chunk_count,omitempty"`
+	ChunkError string      `json:"chunk_error,omitempty"`
+	Chunks     []jsonChunk `json:"chunks,omitempty"`
+	// Events are those of a Server-Sent Events stream.
+	Events        []jsonEvent `json:"events,omitempty"`
+	EventCount    int         `json:"event_count,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	BodyDecoded   bool        `json:"body_decoded,omitempty"`
+	SHA256        string      `json:"sha256,omitempty"`
+	MD5           string      `json:"md5,omitempty"`
+	TCP           string      `json:"tcp,omitempty"`
+	// Tunnel is the target of the CONNECT tunnel the message went
+	// through.
+	Tunnel string `json:"tunnel,omitempty"`
+
+	// DNS messages
+	Response bool            `json:"response,omitempty"`
+	Question string          `json:"question,omitempty"`
+	QType    string          `json:"qtype,omitempty"`
+	Rcode    string          `json:"rcode,omitempty"`
+	Answers  []jsonDNSAnswer `json:"answers,omitempty"`
+}
+
+type jsonDNSAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type jsonChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Ext    string `json:"ext,omitempty"`
+}
+
+type jsonEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Retry     int       `json:"retry,omitempty"`
+	Data      string    `json:"data"`
+}
+
+func (j *JSON) message(typ string, m *httpstream.Message) *jsonRecord {
+	r := &jsonRecord{
+		Type:      typ,
+		ID:        m.ID(),
+		Timestamp: m.Timestamp.UTC(),
+		SrcIP:     m.SrcIP,
+		SrcPort:   m.SrcPort,
+		SrcName:   j.names[m.SrcIP],
+		DstIP:     m.DstIP,
+		DstPort:   m.DstPort,
+		DstName:   j.names[m.DstIP],
+		Proto:     m.Proto,
+		Headers:   m.Header,
+		Trailers:  m.Trailer,
+		BodySize:  m.BodySize,
+		SHA256:    m.SHA256,
+		MD5:       m.MD5,
+		Tunnel:    m.Tunnel,
+	}
+	if m.TCP.Any() {
+		r.TCP = m.TCP.String()
+	}
+	if m.ChunkCount > 0 || m.ChunkError != "" {
+		r.WireSize, r.ChunkCount, r.ChunkError = m.WireSize, m.ChunkCount, m.ChunkError
+		for _, c := range m.Chunks {
+			r.Chunks = append(r.Chunks, jsonChunk{Offset: c.Offset, Size: c.Size, Ext: c.Ext})
+		}
+	}
+	r.EventCount = m.EventCount
+	for _, e := range m.Events {
+		r.Events = append(r.Events, jsonEvent{Timestamp: e.Timestamp.UTC(), Event: e.Type, ID: e.ID, Retry: e.Retry, Data: e.Data})
+	}
+	if len(m.Body) == 0 {
+		return r
+	}
+	r.BodyTruncated = m.BodySize > int64(len(m.Body))
+	body, decoded, err := m.DecodedBody()
+	r.BodyDecoded = decoded && err == nil
+	if utf8.Valid(body) {
+		r.Body = string(body)
+	} else {
+		r.Body, r.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return r
+}
+
+func (j *JSON) HandleRequest(req *httpstream.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := j.message("request", &req.Message)
+	r.Method, r.URL, r.URI, r.Host = req.Method, req.URL, req.URI, req.Host
+	j.enc.Encode(r)
+}
+
+func (j *JSON) HandleResponse(resp *httpstream.Response) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := j.message("response", &resp.Message)
+	r.Status, r.StatusCode = resp.Status, resp.StatusCode
+	if resp.Request != nil {
+		r.ResponseTime = resp.Timestamp.Sub(resp.Request.Timestamp).Seconds()
+	}
+	j.enc.Encode(r)
+}
+
+func (j *JSON) HandleDNS(msg *dns.Message) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := &jsonRecord{
+		Type:      "dns",
+		Timestamp: msg.Timestamp.UTC(),
+		SrcIP:     msg.SrcIP,
+		DstIP:     msg.DstIP,
+		Response:  msg.Response,
+		Question:  msg.Question,
+		QType:     msg.QType,
+		Rcode:     msg.Rcode,
+	}
+	for _, a := range msg.Answers {
+		r.Answers = append(r.Answers, jsonDNSAnswer{Name: a.Name, Type: a.Type, Value: a.Value})
+		if a.Type == "A" || a.Type == "AAAA" {
+			j.names[a.Value] = strings.TrimSuffix(msg.Question, ".")
+		}
+	}
+	j.enc.Encode(r)
+}
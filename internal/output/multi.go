@@ -0,0 +1,52 @@
+package output
+
+import (
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Handler receives every event of an analysis.
+type Handler interface {
+	httpstream.Handler
+	dns.Handler
+}
+
+// Multi passes each event to every handler in turn. Packets and statistics
+// go to the handlers that implement analyzer.PacketHandler and
+// analyzer.StatsHandler.
+type Multi []Handler
+
+func (m Multi) HandleRequest(req *httpstream.Request) {
+	for _, h := range m {
+		h.HandleRequest(req)
+	}
+}
+
+func (m Multi) HandleResponse(resp *httpstream.Response) {
+	for _, h := range m {
+		h.HandleResponse(resp)
+	}
+}
+
+func (m Multi) HandleDNS(msg *dns.Message) {
+	for _, h := range m {
+		h.HandleDNS(msg)
+	}
+}
+
+func (m Multi) HandlePacket(p *analyzer.Packet) {
+	for _, h := range m {
+		if ph, ok := h.(analyzer.PacketHandler); ok {
+			ph.HandlePacket(p)
+		}
+	}
+}
+
+func (m Multi) HandleStats(s analyzer.StatsSnapshot) {
+	for _, h := range m {
+		if sh, ok := h.(analyzer.StatsHandler); ok {
+			sh.HandleStats(s)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package output
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/report"
+)
+
+// parquetRowGroup is how many rows a file buffers before writing them out
+// as a row group.
+const parquetRowGroup = 50000
+
+// parquetLinger is how long before the latest hour seen the file of an
+// hour is kept open for transactions that arrive late; after that it is
+// closed and any later ones go to a new file.
+const parquetLinger = 2 * time.Hour
+
+// Parquet writes a row per HTTP transaction to Parquet files partitioned by
+// the hour of the request, as dir/date=2006-01-02/hour=15/part-N.parquet in
+// UTC, which DuckDB and Spark read as hive partitions. A transaction is
+// written once its response arrives; those never answered are written at
+// the end.
+type Parquet struct {
+	// Capture fills the capture column of every row.
+	Capture string
+	// Filter, when set, limits the files to the transactions whose request
+	// or response matches.
+	Filter *filter.Filter
+
+	mu      sync.Mutex
+	dir     string
+	pending map[*httpstream.Request]bool
+	files   map[int64]*parquetFile
+	latest  int64
+	rows    int64
+	written []string
+	err     error
+}
+
+type parquetFile struct {
+	f *os.File
+	w *parquet.GenericWriter[parquetRow]
+}
+
+// parquetRow is a transaction as stored. Columns of the response are null
+// for requests never answered.
+type parquetRow struct {
+	Time                int64             `parquet:"time,timestamp(microsecond)"`
+	Capture             string            `parquet:"capture,dict"`
+	ID                  string            `parquet:"id,optional"`
+	ClientIP            string            `parquet:"client_ip,dict"`
+	ClientPort          int32             `parquet:"client_port"`
+	ServerIP            string            `parquet:"server_ip,dict"`
+	ServerPort          int32             `parquet:"server_port"`
+	Method              string            `parquet:"method,dict"`
+	URL                 string            `parquet:"url"`
+	Host                string            `parquet:"host,dict,optional"`
+	Path                string            `parquet:"path"`
+	PathTemplate        string            `parquet:"path_template,dict"`
+	Proto               string            `parquet:"proto,dict,optional"`
+	UserAgent           string            `parquet:"user_agent,dict,optional"`
+	RequestContentType  string            `parquet:"request_content_type,dict,optional"`
+	RequestBodySize     int64             `parquet:"request_body_size"`
+	RequestHeaders      map[string]string `parquet:"request_headers"`
+	Status              *int32            `parquet:"status,optional"`
+	ResponseContentType string            `parquet:"response_content_type,dict,optional"`
+	ResponseBodySize    *int64            `parquet:"response_body_size,optional"`
+	LatencyMs           *float64          `parquet:"latency_ms,optional"`
+	ResponseHeaders     map[string]string `parquet:"response_headers"`
+}
+
+// NewParquet returns a Parquet writing under dir, creating it if need be.
+func NewParquet(dir string) (*Parquet, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Parquet{
+		dir:     dir,
+		pending: make(map[*httpstream.Request]bool),
+		files:   make(map[int64]*parquetFile),
+	}, nil
+}
+
+func (p *Parquet) HandleRequest(req *httpstream.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[req] = true
+}
+
+func (p *Parquet) HandleResponse(resp *httpstream.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Rows start from a request, so responses to requests that weren't
+	// seen are left out
+	if resp.Request == nil || !p.pending[resp.Request] {
+		return
+	}
+	delete(p.pending, resp.Request)
+	p.write(resp.Request, resp)
+}
+
+func (p *Parquet) HandleDNS(*dns.Message) {}
+
+// write adds the row of a transaction to the file of its hour. p.mu must
+// be held.
+func (p *Parquet) write(req *httpstream.Request, resp *httpstream.Response) {
+	if p.err != nil || p.Filter != nil && !p.Filter.MatchRequest(req) && (resp == nil || !p.Filter.MatchResponse(resp)) {
+		return
+	}
+	row := parquetRow{
+		Time:               req.Timestamp.UnixMicro(),
+		Capture:            p.Capture,
+		ID:                 req.ID(),
+		ClientIP:           req.SrcIP,
+		ClientPort:         parquetPort(req.SrcPort),
+		ServerIP:           req.DstIP,
+		ServerPort:         parquetPort(req.DstPort),
+		Method:             req.Method,
+		URL:                req.URL,
+		Host:               req.Host,
+		Proto:              req.Proto,
+		UserAgent:          req.Header.Get("User-Agent"),
+		RequestContentType: req.Header.Get("Content-Type"),
+		RequestBodySize:    req.BodySize,
+		RequestHeaders:     flatHeader(req.Message.Header),
+	}
+	if u, err := url.Parse(req.URL); err == nil {
+		row.Path = u.Path
+	}
+	row.PathTemplate = report.PathTemplate(row.Path)
+	if resp != nil {
+		status := int32(resp.StatusCode)
+		size := resp.BodySize
+		latency := float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+		row.Status, row.ResponseBodySize, row.LatencyMs = &status, &size, &latency
+		row.ResponseContentType = resp.Header.Get("Content-Type")
+		row.ResponseHeaders = flatHeader(resp.Header)
+	}
+
+	hour := req.Timestamp.UTC().Truncate(time.Hour).Unix()
+	pf := p.files[hour]
+	if pf == nil {
+		if pf, p.err = p.create(req.Timestamp.UTC()); p.err != nil {
+			return
+		}
+		p.files[hour] = pf
+	}
+	if _, p.err = pf.w.Write([]parquetRow{row}); p.err != nil {
+		return
+	}
+	p.rows++
+	if hour > p.latest {
+		p.latest = hour
+		for h, old := range p.files {
+			if time.Duration(p.latest-h)*time.Second > parquetLinger {
+				delete(p.files, h)
+				p.closeFile(old)
+			}
+		}
+	}
+}
+
+// create starts the next file of the hour of t, leaving the files already
+// there, from other runs or from this one, as they are.
+func (p *Parquet) create(t time.Time) (*parquetFile, error) {
+	dir := filepath.Join(p.dir, "date="+t.Format("2006-01-02"), "hour="+t.Format("15"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	for n := 0; ; n++ {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("part-%d.parquet", n)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		w := parquet.NewGenericWriter[parquetRow](f,
+			parquet.Compression(&parquet.Zstd),
+			parquet.MaxRowsPerRowGroup(parquetRowGroup),
+			parquet.CreatedBy("pcap-analyzer", "", ""),
+		)
+		p.written = append(p.written, f.Name())
+		return &parquetFile{f: f, w: w}, nil
+	}
+}
+
+// closeFile finishes a file. p.mu must be held.
+func (p *Parquet) closeFile(pf *parquetFile) {
+	err := pf.w.Close()
+	if cerr := pf.f.Close(); err == nil {
+		err = cerr
+	}
+	if p.err == nil && err != nil {
+		p.err = fmt.Errorf("%s: %w", pf.f.Name(), err)
+	}
+}
+
+// Close writes the requests never answered and finishes every file.
+func (p *Parquet) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	unanswered := make([]*httpstream.Request, 0, len(p.pending))
+	for req := range p.pending {
+		unanswered = append(unanswered, req)
+	}
+	sort.Slice(unanswered, func(i, j int) bool { return unanswered[i].Timestamp.Before(unanswered[j].Timestamp) })
+	for _, req := range unanswered {
+		p.write(req, nil)
+	}
+	p.pending = make(map[*httpstream.Request]bool)
+	for h, pf := range p.files {
+		delete(p.files, h)
+		p.closeFile(pf)
+	}
+	return p.err
+}
+
+// Written returns how many rows were written, and the files they went to.
+func (p *Parquet) Written() (rows int64, files []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rows, p.written
+}
+
+func parquetPort(s string) int32 {
+	n, _ := strconv.ParseUint(s, 10, 16)
+	return int32(n)
+}
+
+// flatHeader joins the values of each header as they would be folded onto
+// one line.
+func flatHeader(h map[string][]string) map[string]string {
+	m := make(map[string]string, len(h))
+	for name, values := range h {
+		m[name] = strings.Join(values, ", ")
+	}
+	return m
+}
@@ -0,0 +1,258 @@
+package output
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// redacted replaces every value removed by Redact.
+const redacted = "[REDACTED]"
+
+// RedactRules say what Redact removes.
+type RedactRules struct {
+	// Headers are header names whose values are removed.
+	Headers []string
+	// Fields are JSON object keys and query or form parameter names whose
+	// values are removed, matched without regard to case.
+	Fields []string
+	// Patterns are removed wherever they match in URLs, header values and
+	// bodies.
+	Patterns []*regexp.Regexp
+}
+
+var (
+	emailAddress = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// cardNumber matches candidates only; they are removed if they pass
+	// the Luhn check.
+	cardNumber = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// DefaultRedactRules remove credentials, cookies, email addresses and card
+// numbers.
+var DefaultRedactRules = RedactRules{
+	Headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"},
+	Fields: []string{"password", "passwd", "token", "access_token", "refresh_token", "id_token",
+		"secret", "client_secret", "api_key", "apikey"},
+	Patterns: []*regexp.Regexp{emailAddress, cardNumber},
+}
+
+// Redact passes every event on to Next with the values its rules match
+// replaced, so that nothing downstream sees them. Messages are copied, not
+// changed in place.
+type Redact struct {
+	Next Handler
+
+	headers map[string]bool
+	// headerLine matches the header lines of the headers to remove in raw
+	// message text, for Mask.
+	headerLine *regexp.Regexp
+	json       *regexp.Regexp
+	form       *regexp.Regexp
+	patterns   []*regexp.Regexp
+
+	mu sync.Mutex
+	// pending holds the copy passed on of each request not yet answered,
+	// so that its response refers to the same copy, as handlers pairing
+	// the two expect.
+	pending map[*httpstream.Request]*httpstream.Request
+}
+
+func NewRedact(next Handler, rules RedactRules) *Redact {
+	r := &Redact{
+		Next:     next,
+		headers:  make(map[string]bool),
+		patterns: rules.Patterns,
+		pending:  make(map[*httpstream.Request]*httpstream.Request),
+	}
+	var names []string
+	for _, h := range rules.Headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+		names = append(names, regexp.QuoteMeta(h))
+	}
+	if len(names) > 0 {
+		r.headerLine = regexp.MustCompile(`(?im)^(?:` + strings.Join(names, "|") + `)[ \t]*:[ \t]*([^\r\n]*)`)
+	}
+	if len(rules.Fields) > 0 {
+		names := make([]string, len(rules.Fields))
+		for i, f := range rules.Fields {
+			names[i] = regexp.QuoteMeta(f)
+		}
+		alt := strings.Join(names, "|")
+		r.json = regexp.MustCompile(`(?i)("(?:` + alt + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+		r.form = regexp.MustCompile(`(?i)((?:^|[?&;])(?:` + alt + `)=)[^&;#\s]*`)
+	}
+	return r
+}
+
+func (r *Redact) HandleRequest(req *httpstream.Request) {
+	c := r.request(req)
+	r.mu.Lock()
+	r.pending[req] = c
+	r.mu.Unlock()
+	r.Next.HandleRequest(c)
+}
+
+func (r *Redact) HandleResponse(resp *httpstream.Response) {
+	c := *resp
+	r.message(&c.Message)
+	if req := c.Request; req != nil {
+		r.mu.Lock()
+		c.Request = r.pending[req]
+		delete(r.pending, req)
+		r.mu.Unlock()
+		if c.Request == nil {
+			c.Request = r.request(req)
+		}
+	}
+	r.Next.HandleResponse(&c)
+}
+
+func (r *Redact) HandleDNS(msg *dns.Message) {
+	r.Next.HandleDNS(msg)
+}
+
+func (r *Redact) HandlePacket(p *analyzer.Packet) {
+	if ph, ok := r.Next.(analyzer.PacketHandler); ok {
+		ph.HandlePacket(p)
+	}
+}
+
+// HandleStats forgets the requests never answered, as the capture is over.
+func (r *Redact) HandleStats(s analyzer.StatsSnapshot) {
+	r.mu.Lock()
+	r.pending = make(map[*httpstream.Request]*httpstream.Request)
+	r.mu.Unlock()
+	if sh, ok := r.Next.(analyzer.StatsHandler); ok {
+		sh.HandleStats(s)
+	}
+}
+
+func (r *Redact) request(req *httpstream.Request) *httpstream.Request {
+	c := *req
+	c.URL = r.text(c.URL)
+	c.URI = r.text(c.URI)
+	c.Host = r.text(c.Host)
+	r.message(&c.Message)
+	return &c
+}
+
+func (r *Redact) message(m *httpstream.Message) {
+	header := make(http.Header, len(m.Header))
+	for name, values := range m.Header {
+		clean := make([]string, len(values))
+		for i, v := range values {
+			if r.headers[name] {
+				clean[i] = redacted
+			} else {
+				clean[i] = r.text(v)
+			}
+		}
+		header[name] = clean
+	}
+	m.Header = header
+	r.body(m)
+}
+
+// body redacts a textual body, compressing it again if it was compressed
+// so the message still matches its headers. Only the part held in memory can be
+// searched, so the rest of a longer body is dropped.
+func (r *Redact) body(m *httpstream.Message) {
+	body, decoded, err := m.DecodedBody()
+	if len(body) == 0 || err != nil || bytes.IndexByte(body[:min(len(body), 512)], 0) >= 0 {
+		return
+	}
+	clean := r.bytes(body)
+	if bytes.Equal(clean, body) && int64(len(m.Body)) == m.BodySize {
+		return
+	}
+	if decoded {
+		if clean, err = httpstream.EncodeContent(m.Header, clean); err != nil {
+			return
+		}
+	}
+	m.SetBody(clean)
+}
+
+func (r *Redact) text(s string) string {
+	return string(r.bytes([]byte(s)))
+}
+
+func (r *Redact) bytes(b []byte) []byte {
+	if r.json != nil {
+		b = r.json.ReplaceAll(b, []byte(`${1}"`+redacted+`"`))
+		b = r.form.ReplaceAll(b, []byte(`${1}`+redacted))
+	}
+	for _, re := range r.patterns {
+		b = re.ReplaceAllFunc(b, func(match []byte) []byte {
+			if re == cardNumber && !luhn(match) {
+				return match
+			}
+			return []byte(redacted)
+		})
+	}
+	return b
+}
+
+// Mask overwrites the values the rules match in b with asterisks, for data
+// whose length mustn't change, such as packet payloads. Unlike the
+// messages Redact passes on, b is raw protocol text, so header lines are
+// found by name.
+func (r *Redact) Mask(b []byte) {
+	if r.headerLine != nil {
+		for _, m := range r.headerLine.FindAllSubmatchIndex(b, -1) {
+			fill(b[m[2]:m[3]])
+		}
+	}
+	if r.json != nil {
+		for _, m := range r.json.FindAllSubmatchIndex(b, -1) {
+			start, end := m[4], m[5]
+			if b[start] == '"' {
+				start, end = start+1, end-1
+			}
+			fill(b[start:end])
+		}
+		for _, m := range r.form.FindAllSubmatchIndex(b, -1) {
+			fill(b[m[3]:m[1]])
+		}
+	}
+	for _, re := range r.patterns {
+		for _, m := range re.FindAllIndex(b, -1) {
+			if re != cardNumber || luhn(b[m[0]:m[1]]) {
+				fill(b[m[0]:m[1]])
+			}
+		}
+	}
+}
+
+func fill(b []byte) {
+	for i := range b {
+		b[i] = '*'
+	}
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum used by card
+// numbers.
+func luhn(s []byte) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// recorder keeps the messages it is handed.
+type recorder struct {
+	mu    sync.Mutex
+	reqs  []*httpstream.Request
+	resps []*httpstream.Response
+}
+
+func (r *recorder) HandleRequest(req *httpstream.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reqs = append(r.reqs, req)
+}
+
+func (r *recorder) HandleResponse(resp *httpstream.Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resps = append(r.resps, resp)
+}
+
+func (r *recorder) HandleDNS(*dns.Message) {}
+
+// text returns everything a sink could write of the request and response.
+func (r *recorder) text() string {
+	var b strings.Builder
+	for _, req := range r.reqs {
+		b.WriteString(req.URL + " " + req.URI + " " + req.Host + "\n")
+		req.Header.Write(&b)
+		b.Write(req.Body)
+	}
+	for _, resp := range r.resps {
+		resp.Header.Write(&b)
+		b.Write(resp.Body)
+	}
+	return b.String()
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    RedactRules
+		request  string
+		response string
+		gone     []string
+		kept     []string
+	}{
+		{
+			name:     "credentials and cookies",
+			rules:    DefaultRedactRules,
+			request:  "GET /login?password=hunter2&user=bob HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer s3cr3t\r\nCookie: session=abc123\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nSet-Cookie: session=def456\r\nContent-Length: 2\r\n\r\nok",
+			gone:     []string{"hunter2", "s3cr3t", "abc123", "def456"},
+			kept:     []string{"user=bob", "example.com"},
+		},
+		{
+			name:     "JSON and form fields",
+			rules:    DefaultRedactRules,
+			request:  "POST /token HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 33\r\n\r\nclient_secret=xyzzy&grant=refresh",
+			response: "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 41\r\n\r\n{\"access_token\": \"tok99\", \"expires\": 60}",
+			gone:     []string{"xyzzy", "tok99"},
+			kept:     []string{"grant=refresh", `"expires": 60`},
+		},
+		{
+			name:     "email addresses and card numbers",
+			rules:    DefaultRedactRules,
+			request:  "GET /orders HTTP/1.1\r\nHost: shop.example\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 51\r\n\r\nalice@example.com paid with 4111 1111 1111 1111 ok",
+			gone:     []string{"alice@example.com", "4111 1111 1111 1111"},
+			kept:     []string{"paid with"},
+		},
+		{
+			name:     "numbers failing the Luhn check are kept",
+			rules:    DefaultRedactRules,
+			request:  "GET /orders HTTP/1.1\r\nHost: shop.example\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 22\r\n\r\norder 4111111111111112",
+			kept:     []string{"4111111111111112"},
+		},
+		{
+			name:     "extra headers and fields",
+			rules:    RedactRules{Headers: []string{"X-Internal"}, Fields: []string{"ssn"}},
+			request:  "GET /people?ssn=078051120 HTTP/1.1\r\nHost: example.com\r\nX-Internal: build-7\r\nAuthorization: Basic Ym9i\r\n\r\n",
+			response: "HTTP/1.1 204 No Content\r\n\r\n",
+			gone:     []string{"078051120", "build-7"},
+			kept:     []string{"Basic Ym9i"},
+		},
+		{
+			name:     "patterns in the URL, host and body",
+			rules:    RedactRules{Patterns: []*regexp.Regexp{regexp.MustCompile(`internal\.example`)}},
+			request:  "GET /status HTTP/1.1\r\nHost: api.internal.example\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\ndb.internal.example\n",
+			gone:     []string{"internal.example"},
+			kept:     []string{"/status"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testutil.NewBuilder()
+			b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80", tt.request, tt.response)
+			path := filepath.Join(t.TempDir(), "capture.pcap")
+			if err := b.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			var r recorder
+			if err := analyzer.Run(path, analyzer.Options{}, NewRedact(&r, tt.rules)); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.reqs) != 1 || len(r.resps) != 1 {
+				t.Fatalf("got %d requests and %d responses, want 1 of each", len(r.reqs), len(r.resps))
+			}
+			// Handlers pair a response with its request by pointer
+			if r.resps[0].Request != r.reqs[0] {
+				t.Error("the response refers to another copy of the request than was handed on")
+			}
+			text := r.text()
+			for _, s := range tt.gone {
+				if strings.Contains(text, s) {
+					t.Errorf("found %q:\n%s", s, text)
+				}
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(text, s) {
+					t.Errorf("%q was removed:\n%s", s, text)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/grpcmsg"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/lookalike"
+	"github.com/pcap-analyzer/internal/stats"
+)
+
+// Text prints messages in the human-readable format of the CLI. Each
+// message is written in one piece so concurrent streams don't interleave.
+type Text struct {
+	// Protos, if set, has the descriptors gRPC messages are decoded by;
+	// without them, or for methods it doesn't know, messages are decoded
+	// field by field with numbers for names.
+	Protos *grpcmsg.Decoder
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewText(w io.Writer) *Text {
+	return &Text{w: w}
+}
+
+func (t *Text) HandleRequest(req *httpstream.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "\n*********************************\n")
+	fmt.Fprintf(t.w, "%s %s (%s)\n", req.Method, req.URL, req.Proto)
+	t.printID(&req.Message)
+	if u := lookalike.Unicode(req.Host); u != req.Host {
+		fmt.Fprintf(t.w, "  [Host in Unicode: %s]\n", u)
+	}
+	// Print all headers from the request
+	for name, values := range req.Header {
+		for _, value := range values {
+			fmt.Fprintf(t.w, "  %s: %s\n", name, value)
+		}
+	}
+	t.printTrailer(&req.Message)
+
+	// Debug: Check if there are more headers we might be missing
+	if req.ContentLength > 0 {
+		fmt.Fprintf(t.w, "  [Content-Length: %d]\n", req.ContentLength)
+	}
+	t.printHashes(&req.Message)
+	t.printChunks(&req.Message)
+
+	t.printBody("Request", &req.Message, req.URI, false)
+	fmt.Fprintln(t.w, "-------")
+}
+
+func (t *Text) HandleResponse(resp *httpstream.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "%s (%s)\n", resp.Status, resp.Proto)
+	t.printID(&resp.Message)
+	for name, values := range resp.Header {
+		for _, value := range values {
+			fmt.Fprintf(t.w, "  %s: %s\n", name, value)
+		}
+	}
+	t.printTrailer(&resp.Message)
+
+	if resp.TCP.Any() {
+		fmt.Fprintf(t.w, "  [TCP: %s]\n", resp.TCP)
+	}
+	t.printHashes(&resp.Message)
+	t.printChunks(&resp.Message)
+
+	path := ""
+	if resp.Request != nil {
+		path = resp.Request.URI
+	}
+	t.printBody("Response", &resp.Message, path, true)
+}
+
+// printID prints the transaction ID that -extract accepts, and the
+// CONNECT tunnel the message went through.
+func (t *Text) printID(m *httpstream.Message) {
+	if id := m.ID(); id != "" {
+		fmt.Fprintf(t.w, "  [ID: %s]\n", id)
+	}
+	if m.Tunnel != "" {
+		fmt.Fprintf(t.w, "  [Tunnel: %s]\n", m.Tunnel)
+	}
+}
+
+// printTrailer prints the header fields sent after the body.
+func (t *Text) printTrailer(m *httpstream.Message) {
+	for name, values := range m.Trailer {
+		for _, value := range values {
+			fmt.Fprintf(t.w, "  [Trailer] %s: %s\n", name, value)
+		}
+	}
+}
+
+func (t *Text) printHashes(m *httpstream.Message) {
+	if m.SHA256 != "" {
+		fmt.Fprintf(t.w, "  [SHA-256: %s]\n", m.SHA256)
+	}
+	if m.MD5 != "" {
+		fmt.Fprintf(t.w, "  [MD5: %s]\n", m.MD5)
+	}
+}
+
+// printChunks prints the framing of a chunked body: its size with and
+// without the framing and, when they were recorded, its chunks.
+func (t *Text) printChunks(m *httpstream.Message) {
+	if m.ChunkCount == 0 && m.ChunkError == "" {
+		return
+	}
+	noun := "chunks"
+	if m.ChunkCount == 1 {
+		noun = "chunk"
+	}
+	fmt.Fprintf(t.w, "  [Chunked: %d bytes in %d %s, %d bytes on the wire]\n", m.BodySize, m.ChunkCount, noun, m.WireSize)
+	for i, c := range m.Chunks {
+		ext := ""
+		if c.Ext != "" {
+			ext = "; " + strings.TrimSpace(c.Ext)
+		}
+		fmt.Fprintf(t.w, "  [Chunk %d at byte %d: %d bytes%s]\n", i+1, c.Offset, c.Size, ext)
+	}
+	if len(m.Chunks) < m.ChunkCount && len(m.Chunks) > 0 {
+		fmt.Fprintf(t.w, "  [%d more chunks not recorded]\n", m.ChunkCount-len(m.Chunks))
+	}
+	if m.ChunkError != "" {
+		fmt.Fprintf(t.w, "  [Chunked framing broken: %s]\n", m.ChunkError)
+	}
+}
+
+// printBody prints a message's body; path and response tell what it is
+// part of, for decoding gRPC.
+func (t *Text) printBody(kind string, m *httpstream.Message, path string, response bool) {
+	if len(m.Body) == 0 {
+		return
+	}
+	if grpcmsg.IsGRPC(m.Header.Get("Content-Type")) {
+		t.printGRPC(kind, m, path, response)
+		return
+	}
+	if m.EventCount > 0 {
+		t.printEvents(kind, m)
+		return
+	}
+	body, decoded, err := m.DecodedBody()
+	codings := strings.Join(httpstream.ContentCodings(m.Header), ", ")
+	switch {
+	case err != nil:
+		fmt.Fprintf(t.w, "%s Body (%d bytes, %s decompression failed):\n%s\n", kind, len(m.Body), codings, string(m.Body))
+	case decoded:
+		fmt.Fprintf(t.w, "%s Body (%d bytes, decompressed from %s):\n%s\n", kind, len(body), codings, string(body))
+	default:
+		fmt.Fprintf(t.w, "%s Body (%d bytes):\n%s\n", kind, len(body), string(body))
+	}
+}
+
+// printEvents prints each event of a Server-Sent Events stream with when
+// it arrived.
+func (t *Text) printEvents(kind string, m *httpstream.Message) {
+	noun := "server-sent events"
+	if m.EventCount == 1 {
+		noun = "server-sent event"
+	}
+	fmt.Fprintf(t.w, "%s Body (%d bytes, %d %s):\n", kind, m.BodySize, m.EventCount, noun)
+	for i, e := range m.Events {
+		name := e.Type
+		if name == "" {
+			name = "message"
+		}
+		if e.ID != "" {
+			name += ", id " + e.ID
+		}
+		if e.Retry > 0 {
+			name += fmt.Sprintf(", retry %dms", e.Retry)
+		}
+		fmt.Fprintf(t.w, "Event %d at %s (%s):\n%s\n", i+1, e.Timestamp.Format(time.RFC3339Nano), name, e.Data)
+	}
+	if len(m.Events) < m.EventCount {
+		fmt.Fprintf(t.w, "[%d more events not kept]\n", m.EventCount-len(m.Events))
+	}
+}
+
+// printGRPC prints each message of a gRPC body.
+func (t *Text) printGRPC(kind string, m *httpstream.Message, path string, response bool) {
+	msgs, err := grpcmsg.Split(m.Body, m.Header.Get("Grpc-Encoding"))
+	noun := "gRPC messages"
+	if len(msgs) == 1 {
+		noun = "gRPC message"
+	}
+	fmt.Fprintf(t.w, "%s Body (%d bytes, %d %s):\n", kind, m.BodySize, len(msgs), noun)
+	for i, msg := range msgs {
+		switch {
+		case msg.Trailer:
+			fmt.Fprintf(t.w, "gRPC-Web trailer:\n%s\n", strings.TrimSpace(string(msg.Data)))
+		case msg.Err != nil:
+			fmt.Fprintf(t.w, "gRPC message %d (%d bytes, compressed: %v)\n", i+1, len(msg.Data), msg.Err)
+		default:
+			text, name := t.Protos.Format(path, response, msg.Data)
+			if name != "" {
+				name = ", " + name
+			}
+			fmt.Fprintf(t.w, "gRPC message %d (%d bytes%s):\n%s\n", i+1, len(msg.Data), name, text)
+		}
+	}
+	switch {
+	case err != nil && m.Truncated():
+		fmt.Fprintf(t.w, "[rest of the body not kept]\n")
+	case err != nil:
+		fmt.Fprintf(t.w, "[%v]\n", err)
+	}
+}
+
+func (t *Text) HandleDNS(msg *dns.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !msg.Response {
+		fmt.Fprintf(t.w, "\n=== DNS Query ===\n")
+		fmt.Fprintf(t.w, "Time: %s\n", msg.Timestamp.Format(time.RFC3339))
+		fmt.Fprintf(t.w, "Query: %s%s (Type: %s)\n", msg.Question, unicodeName(msg.Question), msg.QType)
+		return
+	}
+
+	fmt.Fprintf(t.w, "\n=== DNS Response ===\n")
+	fmt.Fprintf(t.w, "Time: %s\n", msg.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(t.w, "Query: %s%s\n", msg.Question, unicodeName(msg.Question))
+	for _, rr := range msg.Answers {
+		fmt.Fprintf(t.w, "  %s Record: %s -> %s\n", rr.Type, rr.Name, rr.Value)
+	}
+}
+
+// unicodeName returns the Unicode form of an internationalized name in
+// brackets, or nothing for other names.
+func unicodeName(name string) string {
+	if u := lookalike.Unicode(name); u != name {
+		return " [" + u + "]"
+	}
+	return ""
+}
+
+// HandleStats prints the processing counters at the end of a run.
+func (t *Text) HandleStats(s stats.Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "\n=== Statistics ===\n")
+	fmt.Fprintf(t.w, "Packets:         %d (%d skipped)\n", s.Packets, s.Skipped)
+	fmt.Fprintf(t.w, "TCP streams:     %d\n", s.Streams)
+	fmt.Fprintf(t.w, "HTTP requests:   %d\n", s.Requests)
+	fmt.Fprintf(t.w, "HTTP responses:  %d\n", s.Responses)
+	fmt.Fprintf(t.w, "TLS flows:       %d\n", s.TLSFlows)
+	if s.DecryptedFlows > 0 {
+		fmt.Fprintf(t.w, "TLS decrypted:   %d\n", s.DecryptedFlows)
+	}
+	if s.Tunnels > 0 {
+		fmt.Fprintf(t.w, "CONNECT tunnels: %d\n", s.Tunnels)
+	}
+	fmt.Fprintf(t.w, "DNS messages:    %d\n", s.DNSMessages)
+	fmt.Fprintf(t.w, "Parse errors:    %d\n", s.ParseErrors)
+	fmt.Fprintf(t.w, "Body truncated:  %d bytes\n", s.TruncatedBytes)
+	fmt.Fprintf(t.w, "TCP data lost:   %d bytes\n", s.LostBytes)
+	if s.Shed > 0 {
+		fmt.Fprintf(t.w, "Memory shed:     %d times (%d connections closed early, %d DNS entries dropped)\n",
+			s.Shed, s.ShedConnections, s.ShedDNSEntries)
+	}
+}
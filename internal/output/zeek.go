@@ -0,0 +1,309 @@
+package output
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// zeekFields and zeekTypes are the columns of Zeek's http.log.
+var (
+	zeekFields = []string{
+		"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p",
+		"trans_depth", "method", "host", "uri", "referrer", "version",
+		"user_agent", "origin", "request_body_len", "response_body_len",
+		"status_code", "status_msg", "info_code", "info_msg", "tags",
+		"username", "password", "proxied", "orig_fuids", "orig_filenames",
+		"orig_mime_types", "resp_fuids", "resp_filenames", "resp_mime_types",
+	}
+	zeekTypes = []string{
+		"time", "string", "addr", "port", "addr", "port",
+		"count", "string", "string", "string", "string", "string",
+		"string", "string", "count", "count",
+		"count", "string", "count", "string", "set[enum]",
+		"string", "string", "set[string]", "vector[string]", "vector[string]",
+		"vector[string]", "vector[string]", "vector[string]", "vector[string]",
+	}
+)
+
+// zeekProxyHeaders are the headers Zeek records in proxied.
+var zeekProxyHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-From", "Client-Ip",
+	"Via", "Xroxy-Connection", "Proxy-Connection",
+}
+
+// Zeek values that aren't set, and sets and vectors that are empty.
+const (
+	zeekUnset = "-"
+	zeekEmpty = "(empty)"
+)
+
+// Zeek writes HTTP transactions as Zeek's http.log, tab-separated with
+// its header, so that tooling that reads Zeek logs takes the output as
+// is. As with ECS, a request and its response make one line, written when
+// the response arrives; requests never answered are written at the end.
+// Connection UIDs are derived from the connection rather than random, so
+// they are the same from one run to the next, and file IDs from the UID.
+// MIME types are sniffed from the bodies, as Zeek does, rather than taken
+// from Content-Type.
+type Zeek struct {
+	mu      sync.Mutex
+	w       io.Writer
+	pending map[*httpstream.Request]bool
+	opened  bool
+	last    time.Time
+}
+
+// NewZeek returns a Zeek writing to w.
+func NewZeek(w io.Writer) *Zeek {
+	return &Zeek{w: w, pending: make(map[*httpstream.Request]bool)}
+}
+
+func (z *Zeek) HandleRequest(req *httpstream.Request) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.pending[req] = true
+}
+
+func (z *Zeek) HandleResponse(resp *httpstream.Response) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if resp.Request != nil {
+		delete(z.pending, resp.Request)
+	}
+	z.write(resp.Request, resp)
+}
+
+func (z *Zeek) HandleDNS(*dns.Message) {}
+
+// HandleStats writes a row for each request that was never answered, with
+// the status and response fields unset, and closes the log.
+func (z *Zeek) HandleStats(analyzer.StatsSnapshot) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	reqs := make([]*httpstream.Request, 0, len(z.pending))
+	for req := range z.pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Timestamp.Before(reqs[j].Timestamp) })
+	for _, req := range reqs {
+		z.write(req, nil)
+	}
+	z.pending = make(map[*httpstream.Request]bool)
+	if !z.opened {
+		z.header(time.Now())
+		z.last = time.Now()
+	}
+	fmt.Fprintf(z.w, "#close\t%s\n", zeekLogTime(z.last))
+}
+
+// header writes the lines before the records, with the log opened at t.
+func (z *Zeek) header(t time.Time) {
+	fmt.Fprintf(z.w, "#separator \\x09\n")
+	fmt.Fprintf(z.w, "#set_separator\t,\n")
+	fmt.Fprintf(z.w, "#empty_field\t%s\n", zeekEmpty)
+	fmt.Fprintf(z.w, "#unset_field\t%s\n", zeekUnset)
+	fmt.Fprintf(z.w, "#path\thttp\n")
+	fmt.Fprintf(z.w, "#open\t%s\n", zeekLogTime(t))
+	fmt.Fprintf(z.w, "#fields\t%s\n", strings.Join(zeekFields, "\t"))
+	fmt.Fprintf(z.w, "#types\t%s\n", strings.Join(zeekTypes, "\t"))
+	z.opened = true
+}
+
+// zeekLogTime formats the time of #open and #close lines.
+func zeekLogTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02-15-04-05")
+}
+
+// write writes the line of a transaction, either half of which may be
+// missing. z.mu must be held.
+func (z *Zeek) write(req *httpstream.Request, resp *httpstream.Response) {
+	var flow httpstream.Flow
+	var ts time.Time
+	var conn int64
+	seq := 1
+	if req != nil {
+		flow, ts, conn = req.Flow, req.Timestamp, req.Conn
+		if req.Seq > 0 {
+			seq = req.Seq
+		}
+	} else {
+		flow, ts, conn = resp.Flow.Reverse(), resp.Timestamp, resp.Conn
+		if resp.Seq > 0 {
+			seq = resp.Seq
+		}
+	}
+	if !z.opened {
+		z.header(ts)
+	}
+	if ts.After(z.last) {
+		z.last = ts
+	}
+	uid := zeekUID(conn, flow)
+
+	rec := make(map[string]string, len(zeekFields))
+	rec["ts"] = fmt.Sprintf("%d.%06d", ts.Unix(), ts.Nanosecond()/1000)
+	rec["uid"] = uid
+	rec["id.orig_h"], rec["id.orig_p"] = flow.SrcIP, flow.SrcPort
+	rec["id.resp_h"], rec["id.resp_p"] = flow.DstIP, flow.DstPort
+	rec["trans_depth"] = strconv.Itoa(seq)
+	rec["tags"] = zeekEmpty
+	rec["request_body_len"], rec["response_body_len"] = "0", "0"
+	if req != nil {
+		rec["method"] = zeekString(req.Method)
+		rec["host"] = zeekString(req.Host)
+		rec["uri"] = zeekString(req.URI)
+		rec["referrer"] = zeekHeader(req.Header, "Referer")
+		rec["version"] = zeekString(strings.TrimPrefix(req.Proto, "HTTP/"))
+		rec["user_agent"] = zeekHeader(req.Header, "User-Agent")
+		rec["origin"] = zeekHeader(req.Header, "Origin")
+		rec["request_body_len"] = strconv.FormatInt(req.BodySize, 10)
+		if user, _, ok := basicAuth(req.Header.Get("Authorization")); ok {
+			rec["username"] = zeekString(user)
+		}
+		var proxied []string
+		for _, name := range zeekProxyHeaders {
+			if v := req.Header.Get(name); v != "" {
+				proxied = append(proxied, strings.ToUpper(name)+" -> "+v)
+			}
+		}
+		rec["proxied"] = zeekSet(proxied)
+		z.files(rec, "orig", uid, seq, &req.Message)
+	}
+	if resp != nil {
+		if rec["version"] == "" {
+			rec["version"] = zeekString(strings.TrimPrefix(resp.Proto, "HTTP/"))
+		}
+		rec["response_body_len"] = strconv.FormatInt(resp.BodySize, 10)
+		rec["status_code"] = strconv.Itoa(resp.StatusCode)
+		_, msg, _ := strings.Cut(resp.Status, " ")
+		rec["status_msg"] = zeekString(msg)
+		z.files(rec, "resp", uid, seq, &resp.Message)
+	}
+
+	var line bytes.Buffer
+	for i, field := range zeekFields {
+		if i > 0 {
+			line.WriteByte('\t')
+		}
+		v, ok := rec[field]
+		if !ok || v == "" {
+			v = zeekUnset
+		}
+		line.WriteString(v)
+	}
+	line.WriteByte('\n')
+	z.w.Write(line.Bytes())
+}
+
+// files fills the file columns of one side of a transaction, which Zeek
+// sets for every message with a body.
+func (z *Zeek) files(rec map[string]string, side, uid string, seq int, m *httpstream.Message) {
+	if m.BodySize == 0 {
+		return
+	}
+	rec[side+"_fuids"] = "F" + base62(sha256.Sum256([]byte(uid+"/"+strconv.Itoa(seq)+"/"+side)))
+	if _, params, err := mime.ParseMediaType(m.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		rec[side+"_filenames"] = zeekString(params["filename"])
+	}
+	body, _, _ := m.DecodedBody()
+	if t := sniffMIME(body); t != "" {
+		rec[side+"_mime_types"] = t
+	}
+}
+
+// sniffMIME returns the media type of a body by its content, calling JSON
+// text/json as Zeek's signatures do.
+func sniffMIME(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	t := mimeType(http.DetectContentType(body))
+	if t == "text/plain" {
+		switch trimmed := bytes.TrimSpace(body); {
+		case len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['):
+			return "text/json"
+		}
+	}
+	return t
+}
+
+// zeekUID returns the UID of a connection, "C" followed by 96 bits in
+// base62 as Zeek's are, derived from the connection so that it doesn't
+// change between runs.
+func zeekUID(conn int64, flow httpstream.Flow) string {
+	return "C" + base62(sha256.Sum256([]byte(strconv.FormatInt(conn, 10)+" "+flow.String())))
+}
+
+// base62 encodes the first 96 bits of a digest.
+func base62(sum [32]byte) string {
+	return new(big.Int).SetBytes(sum[:12]).Text(62)
+}
+
+// zeekString escapes a string value as Zeek's ASCII writer does: the
+// separators and anything unprintable as \x escapes, and the values that
+// mean unset or empty so that they aren't taken for them.
+func zeekString(s string) string {
+	if s == "" {
+		return zeekEmpty
+	}
+	if s == zeekUnset {
+		return `\x2d`
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == '\\' || c == '\t' {
+			fmt.Fprintf(&b, `\x%02x`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// zeekHeader is a header's value, or unset when it wasn't sent.
+func zeekHeader(h http.Header, name string) string {
+	if len(h.Values(name)) == 0 {
+		return zeekUnset
+	}
+	return zeekString(h.Get(name))
+}
+
+// zeekSet joins the elements of a set, or is unset when there are none.
+func zeekSet(values []string) string {
+	if len(values) == 0 {
+		return zeekUnset
+	}
+	for i, v := range values {
+		values[i] = strings.ReplaceAll(zeekString(v), ",", `\x2c`)
+	}
+	return strings.Join(values, ",")
+}
+
+// basicAuth decodes the credentials of a Basic Authorization header.
+func basicAuth(auth string) (user, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
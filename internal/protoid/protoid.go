@@ -0,0 +1,287 @@
+// Package protoid identifies the application protocol of a TCP or UDP flow
+// from signatures in the first payloads it carries, so that traffic the
+// analyzer doesn't parse can still be accounted for.
+package protoid
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Names of the protocols that aren't identified.
+const (
+	OtherTCP = "other TCP"
+	OtherUDP = "other UDP"
+)
+
+// maxTries is how many payload-carrying packets of a flow are looked at
+// before it is given up on. Some protocols speak first from the server and
+// some from the client, so a handful covers both.
+const maxTries = 4
+
+// Flow identifies one flow from its packets.
+type Flow struct {
+	// Proto is the flow's protocol, or "" until it has been identified.
+	Proto string
+	tries int
+}
+
+// Add looks at the next packet of the flow, unless it has already been
+// identified or given up on.
+func (f *Flow) Add(tcp bool, srcPort, dstPort uint16, payload []byte) {
+	if f.Proto != "" || f.tries >= maxTries || len(payload) == 0 {
+		return
+	}
+	f.tries++
+	if tcp {
+		f.Proto = TCP(srcPort, dstPort, payload)
+	} else {
+		f.Proto = UDP(srcPort, dstPort, payload)
+	}
+}
+
+// Name returns the flow's protocol, or OtherTCP or OtherUDP when it wasn't
+// identified.
+func (f *Flow) Name(tcp bool) string {
+	switch {
+	case f.Proto != "":
+		return f.Proto
+	case tcp:
+		return OtherTCP
+	}
+	return OtherUDP
+}
+
+// TCP returns the protocol of a TCP segment's payload, or "" when it
+// matches no signature. Ports only settle protocols whose messages look
+// alike, such as the greetings of FTP and SMTP.
+func TCP(srcPort, dstPort uint16, p []byte) string {
+	port := func(ports ...uint16) bool { return onPort(srcPort, dstPort, ports) }
+	switch {
+	case httpstream.LooksLikeTLS(p):
+		return "TLS"
+	case bytes.HasPrefix(p, []byte("SSH-")):
+		return "SSH"
+	case bytes.HasPrefix(p, []byte("RTSP/1.")), hasMethod(p, "rtsp://", "OPTIONS", "DESCRIBE", "SETUP", "PLAY"):
+		return "RTSP"
+	case bytes.HasPrefix(p, []byte("SIP/2.0 ")), hasMethod(p, "sip:", "INVITE", "REGISTER", "OPTIONS"):
+		return "SIP"
+	case httpstream.LooksLikeHTTP(p):
+		return "HTTP"
+	case len(p) >= 4 && httpstream.LooksLikeHTTP2(p):
+		return "HTTP/2"
+	case bytes.HasPrefix(p, []byte("220")):
+		// FTP and SMTP servers greet alike; most name themselves
+		line := bytes.ToUpper(firstLine(p))
+		switch {
+		case bytes.Contains(line, []byte("SMTP")), port(25, 465, 587):
+			return "SMTP"
+		case bytes.Contains(line, []byte("FTP")), port(21):
+			return "FTP"
+		}
+	case hasPrefixFold(p, "EHLO "), hasPrefixFold(p, "HELO "):
+		return "SMTP"
+	case bytes.HasPrefix(p, []byte("+OK")), port(110, 995) && hasPrefixFold(p, "USER "):
+		return "POP3"
+	case bytes.HasPrefix(p, []byte("* OK")), bytes.HasPrefix(p, []byte("* PREAUTH")):
+		return "IMAP"
+	case isRESP(p):
+		return "Redis"
+	case isMySQLGreeting(p):
+		return "MySQL"
+	case isPostgres(p):
+		return "PostgreSQL"
+	case len(p) >= 6 && p[0] == 3 && p[1] == 0 && int(binary.BigEndian.Uint16(p[2:])) == len(p) && (p[5] == 0xe0 || p[5] == 0xd0):
+		// A TPKT carrying an X.224 connection request or confirm
+		return "RDP"
+	case len(p) >= 8 && p[0] == 0 && (bytes.Equal(p[5:8], []byte("SMB")) && (p[4] == 0xff || p[4] == 0xfe || p[4] == 0xfd)):
+		return "SMB"
+	case isMongo(p):
+		return "MongoDB"
+	case isMQTTConnect(p):
+		return "MQTT"
+	case bytes.HasPrefix(p, []byte("AMQP\x00")):
+		return "AMQP"
+	case bytes.HasPrefix(p, []byte("\x13BitTorrent protocol")):
+		return "BitTorrent"
+	case bytes.HasPrefix(p, []byte("RFB 0")):
+		return "VNC"
+	case len(p) >= 2 && p[0] == 0xff && p[1] >= 0xfb && p[1] <= 0xfe:
+		// An IAC option negotiation
+		return "Telnet"
+	case bytes.HasPrefix(p, []byte("<stream:stream")), bytes.HasPrefix(p, []byte("<?xml")) && bytes.Contains(p, []byte("jabber")):
+		return "XMPP"
+	case port(389) && len(p) >= 2 && p[0] == 0x30:
+		return "LDAP"
+	case port(53) && len(p) >= 14:
+		return "DNS"
+	}
+	return ""
+}
+
+// UDP returns the protocol of a datagram's payload, or "" when it matches
+// no signature. Protocols whose payloads are too plain to be told apart on
+// their own, such as NTP, are also only recognized on their usual ports.
+func UDP(srcPort, dstPort uint16, p []byte) string {
+	port := func(ports ...uint16) bool { return onPort(srcPort, dstPort, ports) }
+	switch {
+	case port(53):
+		return "DNS"
+	case port(5353):
+		return "mDNS"
+	case port(5355):
+		return "LLMNR"
+	case port(137, 138):
+		return "NetBIOS"
+	case isQUIC(p):
+		return "QUIC"
+	case len(p) >= 20 && p[0]&0xc0 == 0 && binary.BigEndian.Uint32(p[4:]) == 0x2112a442:
+		return "STUN"
+	case isWireGuard(p):
+		return "WireGuard"
+	case port(1900) && (bytes.HasPrefix(p, []byte("M-SEARCH * ")) || bytes.HasPrefix(p, []byte("NOTIFY * ")) || bytes.HasPrefix(p, []byte("HTTP/1."))):
+		return "SSDP"
+	case bytes.HasPrefix(p, []byte("SIP/2.0 ")), hasMethod(p, "sip:", "INVITE", "REGISTER", "OPTIONS", "ACK", "BYE"):
+		return "SIP"
+	case port(123) && len(p) >= 48 && p[0]&7 >= 1 && p[0]&7 <= 5 && (p[0]>>3)&7 >= 1 && (p[0]>>3)&7 <= 4:
+		return "NTP"
+	case port(67, 68) && len(p) >= 240 && binary.BigEndian.Uint32(p[236:]) == 0x63825363:
+		return "DHCP"
+	case port(546, 547):
+		return "DHCPv6"
+	case port(161, 162) && len(p) >= 2 && p[0] == 0x30:
+		return "SNMP"
+	case port(514) && len(p) >= 2 && p[0] == '<':
+		return "Syslog"
+	case port(69) && len(p) >= 4 && p[0] == 0 && p[1] >= 1 && p[1] <= 5:
+		return "TFTP"
+	}
+	return ""
+}
+
+// onPort reports whether either port is one of ports.
+func onPort(srcPort, dstPort uint16, ports []uint16) bool {
+	for _, n := range ports {
+		if srcPort == n || dstPort == n {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLine(p []byte) []byte {
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		return p[:i]
+	}
+	return p
+}
+
+func hasPrefixFold(p []byte, prefix string) bool {
+	return len(p) >= len(prefix) && bytes.EqualFold(p[:len(prefix)], []byte(prefix))
+}
+
+// hasMethod reports whether p starts with a request line using one of the
+// methods on a URI with the scheme, as in "OPTIONS rtsp://".
+func hasMethod(p []byte, scheme string, methods ...string) bool {
+	for _, m := range methods {
+		if bytes.HasPrefix(p, []byte(m+" "+scheme)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRESP reports whether p is a Redis command: an array of bulk strings,
+// such as "*1\r\n$4\r\nPING\r\n".
+func isRESP(p []byte) bool {
+	if len(p) < 4 || p[0] != '*' {
+		return false
+	}
+	i := 1
+	for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+		i++
+	}
+	return i > 1 && bytes.HasPrefix(p[i:], []byte("\r\n$"))
+}
+
+// isMySQLGreeting reports whether p is the handshake a MySQL server opens
+// with: packet 0 of protocol version 10, then the server's version.
+func isMySQLGreeting(p []byte) bool {
+	if len(p) < 6 {
+		return false
+	}
+	n := int(p[0]) | int(p[1])<<8 | int(p[2])<<16
+	return n+4 == len(p) && p[3] == 0 && p[4] == 10 && p[5] >= '0' && p[5] <= '9'
+}
+
+// isPostgres reports whether p is a PostgreSQL startup message or a
+// request to switch to TLS or GSSAPI encryption.
+func isPostgres(p []byte) bool {
+	if len(p) < 8 || int(binary.BigEndian.Uint32(p)) != len(p) {
+		return false
+	}
+	switch binary.BigEndian.Uint32(p[4:]) {
+	case 196608, 80877103, 80877104:
+		return true
+	}
+	return false
+}
+
+// isMongo reports whether p is a MongoDB wire protocol message.
+func isMongo(p []byte) bool {
+	if len(p) < 16 || int(binary.LittleEndian.Uint32(p)) != len(p) {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(p[12:]) {
+	case 2013, 2004, 2012, 1:
+		// OP_MSG, OP_QUERY, OP_COMPRESSED and OP_REPLY
+		return true
+	}
+	return false
+}
+
+// isMQTTConnect reports whether p is an MQTT CONNECT packet.
+func isMQTTConnect(p []byte) bool {
+	if len(p) < 2 || p[0] != 0x10 {
+		return false
+	}
+	// The remaining length takes one to four bytes
+	i := 1
+	for i < len(p) && i < 5 && p[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	rest := p[min(i, len(p)):]
+	return bytes.HasPrefix(rest, []byte("\x00\x04MQTT")) || bytes.HasPrefix(rest, []byte("\x00\x06MQIsdp"))
+}
+
+// isQUIC reports whether p is a QUIC long header packet of a known version.
+func isQUIC(p []byte) bool {
+	if len(p) < 7 || p[0]&0xc0 != 0xc0 {
+		return false
+	}
+	v := binary.BigEndian.Uint32(p[1:])
+	// Versions 1 and 2, drafts, and version negotiation
+	return v == 1 || v == 0x6b3343cf || v&0xffffff00 == 0xff000000 || v == 0
+}
+
+// isWireGuard reports whether p is a WireGuard message: a type from 1 to 4,
+// three reserved zero bytes, and the size that type has.
+func isWireGuard(p []byte) bool {
+	if len(p) < 32 || p[1] != 0 || p[2] != 0 || p[3] != 0 {
+		return false
+	}
+	switch p[0] {
+	case 1:
+		return len(p) == 148
+	case 2:
+		return len(p) == 92
+	case 3:
+		return len(p) == 64
+	case 4:
+		return (len(p)-32)%16 == 0
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// maxDiffs is how many differences are listed per response.
+const maxDiffs = 10
+
+// comparer compares replayed responses with captured ones.
+type comparer struct {
+	headers []string
+	ignore  map[string]bool
+}
+
+func newComparer(cfg Config) *comparer {
+	c := &comparer{
+		headers: append([]string{"Content-Type", "Location"}, cfg.Compare...),
+		ignore:  make(map[string]bool),
+	}
+	for _, f := range cfg.IgnoreFields {
+		c.ignore[f] = true
+	}
+	return c
+}
+
+// compare returns the differences between the captured response and the
+// replayed one, whose body has been read into body.
+func (c *comparer) compare(captured *analyzer.Response, live *http.Response, body []byte) []string {
+	var diffs []string
+	if captured.StatusCode != live.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d -> %d", captured.StatusCode, live.StatusCode))
+	}
+	for _, name := range c.headers {
+		was, now := normalizeHeader(name, captured.Header.Get(name)), normalizeHeader(name, live.Header.Get(name))
+		if was != now {
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", http.CanonicalHeaderKey(name), quote(was), quote(now)))
+		}
+	}
+
+	was, _, err := captured.DecodedBody()
+	if err != nil || captured.Truncated() {
+		// A body that can't be compared in full isn't compared at all
+		return limit(diffs)
+	}
+	now := decode(live.Header, body)
+	if bytes.Equal(was, now) {
+		return limit(diffs)
+	}
+	var a, b any
+	if json.Unmarshal(was, &a) == nil && json.Unmarshal(now, &b) == nil {
+		diffs = c.compareJSON("$", a, b, diffs)
+	} else {
+		diffs = append(diffs, fmt.Sprintf("body: %d bytes -> %d bytes, first difference at byte %d", len(was), len(now), firstDifference(was, now)))
+	}
+	return limit(diffs)
+}
+
+// compareJSON appends the paths at which two decoded JSON values differ.
+func (c *comparer) compareJSON(path string, a, b any, diffs []string) []string {
+	if len(diffs) > maxDiffs {
+		return diffs
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if c.ignore[k] {
+				continue
+			}
+			va, inA := a[k]
+			vb, inB := b[k]
+			p := path + "." + k
+			switch {
+			case !inA:
+				diffs = append(diffs, fmt.Sprintf("body %s: added %s", p, jsonText(vb)))
+			case !inB:
+				diffs = append(diffs, fmt.Sprintf("body %s: removed, was %s", p, jsonText(va)))
+			default:
+				diffs = c.compareJSON(p, va, vb, diffs)
+			}
+		}
+		return diffs
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			break
+		}
+		if len(a) != len(b) {
+			diffs = append(diffs, fmt.Sprintf("body %s: %d items -> %d items", path, len(a), len(b)))
+		}
+		for i := 0; i < len(a) && i < len(b); i++ {
+			diffs = c.compareJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+		}
+		return diffs
+	default:
+		if jsonText(a) == jsonText(b) {
+			return diffs
+		}
+	}
+	return append(diffs, fmt.Sprintf("body %s: %s -> %s", path, jsonText(a), jsonText(b)))
+}
+
+// jsonText formats a decoded JSON value compactly, cut to a readable
+// length.
+func jsonText(v any) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 60 {
+		return string(b[:57]) + "..."
+	}
+	return string(b)
+}
+
+// normalizeHeader reduces a header value to what is compared: the media
+// type of Content-Type, and the path and query of a Location that names a
+// host, since the target's host differs from the capture's.
+func normalizeHeader(name, v string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Content-Type":
+		if mt, _, err := mime.ParseMediaType(v); err == nil {
+			return mt
+		}
+	case "Location":
+		if u, err := url.Parse(v); err == nil && u.Host != "" {
+			return u.RequestURI()
+		}
+	}
+	return v
+}
+
+// decode removes the Content-Encodings from a replayed body.
+func decode(h http.Header, body []byte) []byte {
+	decoded, _, _ := httpstream.DecodeContent(h, body)
+	return decoded
+}
+
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func quote(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// limit cuts diffs to maxDiffs, noting that there were more.
+func limit(diffs []string) []string {
+	if len(diffs) <= maxDiffs {
+		return diffs
+	}
+	return append(diffs[:maxDiffs], "...")
+}
@@ -0,0 +1,190 @@
+package replay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// K6Config describes a k6 script.
+type K6Config struct {
+	// Target is the base URL requests go to unless BASE_URL is set when
+	// the script runs. When nil, each request goes to its captured host.
+	Target *url.URL
+	Rules  Rules
+	// Timeout bounds each request; zero leaves k6's default.
+	Timeout  time.Duration
+	Insecure bool
+	// Source names the capture in the script's opening comment.
+	Source string
+}
+
+// k6Request is one request as the script holds it. Body64 replaces Body
+// for bodies that aren't text.
+type k6Request struct {
+	// At is seconds since the first request.
+	At      float64           `json:"at"`
+	Method  string            `json:"method"`
+	Origin  string            `json:"origin"`
+	Path    string            `json:"path"`
+	Name    string            `json:"name"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    *string           `json:"body,omitempty"`
+	Body64  string            `json:"body64,omitempty"`
+	// Status is the captured response's, checked against the replayed
+	// one, or zero when there was none.
+	Status int `json:"status,omitempty"`
+}
+
+// WriteK6 writes a k6 script that sends the requests of txs in order, each
+// at the same time after the first as in the capture, and checks that
+// each gets the status captured. The requests are rewritten by the rules
+// as a replay would send them. When the script runs, BASE_URL sends them
+// elsewhere, SPEED plays them faster or slower, and VUS and ITERATIONS
+// turn the one pass into a load test.
+func WriteK6(w io.Writer, txs []analyzer.Transaction, cfg K6Config) error {
+	txs = append([]analyzer.Transaction(nil), txs...)
+	sortByTime(txs)
+	reqs := make([]k6Request, 0, len(txs))
+	var first time.Time
+	for _, tx := range txs {
+		orig := tx.Request
+		target := cfg.Target
+		if target == nil {
+			u, err := url.Parse(orig.URL)
+			if err != nil {
+				return fmt.Errorf("%s: %w", orig.URL, err)
+			}
+			target = &url.URL{Scheme: u.Scheme, Host: u.Host}
+		}
+		req, err := rewrite(context.Background(), orig, Config{Target: target, Rules: cfg.Rules})
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first = orig.Timestamp
+		}
+		// The target's path belongs to the base URL, which BASE_URL replaces,
+		// rather than to each request's
+		base := strings.TrimSuffix(target.Scheme+"://"+target.Host+target.Path, "/")
+		path := strings.TrimPrefix(req.URL.RequestURI(), strings.TrimSuffix(target.Path, "/"))
+		name, _, _ := strings.Cut(path, "?")
+		r := k6Request{
+			At:     math.Round(orig.Timestamp.Sub(first).Seconds()*1000) / 1000,
+			Method: req.Method,
+			Origin: base,
+			Path:   path,
+			Name:   report.PathTemplate(name),
+		}
+		if len(req.Header) > 0 {
+			r.Headers = make(map[string]string, len(req.Header))
+			for name, values := range req.Header {
+				sep := ", "
+				if name == "Cookie" {
+					sep = "; "
+				}
+				r.Headers[name] = strings.Join(values, sep)
+			}
+		}
+		if req.Host != req.URL.Host {
+			if r.Headers == nil {
+				r.Headers = make(map[string]string)
+			}
+			r.Headers["Host"] = req.Host
+		}
+		if len(orig.Body) > 0 {
+			if utf8.Valid(orig.Body) {
+				body := string(orig.Body)
+				r.Body = &body
+			} else {
+				r.Body64 = base64.StdEncoding.EncodeToString(orig.Body)
+			}
+		}
+		if tx.Response != nil {
+			r.Status = tx.Response.StatusCode
+		}
+		reqs = append(reqs, r)
+	}
+
+	var span float64
+	if len(reqs) > 0 {
+		span = reqs[len(reqs)-1].At
+	}
+	// Room for every request to take as long again as the capture did,
+	// and then some
+	maxDuration := time.Duration(math.Ceil(2*span+60)) * time.Second
+	params := `{ headers: r.headers, redirects: 0, tags: { name: r.name }`
+	if cfg.Timeout > 0 {
+		params += fmt.Sprintf(", timeout: '%dms'", cfg.Timeout.Milliseconds())
+	}
+	params += " }"
+
+	fmt.Fprintf(w, "// Generated by pcap-analyzer from %s: %d requests over %.3fs.\n", cfg.Source, len(reqs), span)
+	fmt.Fprintf(w, "//\n")
+	fmt.Fprintf(w, "//   k6 run script.js\n")
+	fmt.Fprintf(w, "//   k6 run -e BASE_URL=https://staging.example.com -e VUS=20 -e ITERATIONS=100 -e SPEED=2 script.js\n")
+	fmt.Fprintf(w, "//\n")
+	fmt.Fprintf(w, "// BASE_URL sends every request to another host, SPEED plays them faster (2) or\n")
+	fmt.Fprintf(w, "// slower (0.5) than captured, and VUS runs that many copies of the sequence at\n")
+	fmt.Fprintf(w, "// once, ITERATIONS times each. SPEED=0 sends them back to back.\n")
+	fmt.Fprintf(w, "import http from 'k6/http';\n")
+	fmt.Fprintf(w, "import encoding from 'k6/encoding';\n")
+	fmt.Fprintf(w, "import { check, sleep } from 'k6';\n\n")
+	fmt.Fprintf(w, "export const options = {\n")
+	fmt.Fprintf(w, "  scenarios: {\n")
+	fmt.Fprintf(w, "    replay: {\n")
+	fmt.Fprintf(w, "      executor: 'per-vu-iterations',\n")
+	fmt.Fprintf(w, "      vus: Number(__ENV.VUS || 1),\n")
+	fmt.Fprintf(w, "      iterations: Number(__ENV.ITERATIONS || 1),\n")
+	fmt.Fprintf(w, "      maxDuration: '%s',\n", maxDuration)
+	fmt.Fprintf(w, "    },\n")
+	fmt.Fprintf(w, "  },\n")
+	if cfg.Insecure {
+		fmt.Fprintf(w, "  insecureSkipTLSVerify: true,\n")
+	}
+	fmt.Fprintf(w, "};\n\n")
+	fmt.Fprintf(w, "const BASE_URL = __ENV.BASE_URL ? __ENV.BASE_URL.replace(/\\/$/, '') : '';\n")
+	fmt.Fprintf(w, "const SPEED = Number(__ENV.SPEED || 1);\n\n")
+	fmt.Fprintf(w, "const requests = [\n")
+	for _, r := range reqs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %s,\n", line)
+	}
+	fmt.Fprintf(w, "];\n\n")
+	fmt.Fprintf(w, "export default function () {\n")
+	fmt.Fprintf(w, "  const start = Date.now();\n")
+	fmt.Fprintf(w, "  for (const r of requests) {\n")
+	fmt.Fprintf(w, "    if (SPEED > 0) {\n")
+	fmt.Fprintf(w, "      const wait = r.at / SPEED - (Date.now() - start) / 1000;\n")
+	fmt.Fprintf(w, "      if (wait > 0) {\n")
+	fmt.Fprintf(w, "        sleep(wait);\n")
+	fmt.Fprintf(w, "      }\n")
+	fmt.Fprintf(w, "    }\n")
+	fmt.Fprintf(w, "    const body = r.body64 !== undefined ? encoding.b64decode(r.body64) : r.body;\n")
+	fmt.Fprintf(w, "    const res = http.request(r.method, (BASE_URL || r.origin) + r.path, body, %s);\n", params)
+	fmt.Fprintf(w, "    if (r.status) {\n")
+	fmt.Fprintf(w, "      check(res, { [`${r.method} ${r.name} is ${r.status}`]: (res) => res.status === r.status });\n")
+	fmt.Fprintf(w, "    }\n")
+	fmt.Fprintf(w, "  }\n")
+	fmt.Fprintf(w, "}\n")
+	return nil
+}
+
+// sortByTime orders transactions by when their requests were sent.
+func sortByTime(txs []analyzer.Transaction) {
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].Time().Before(txs[j].Time()) })
+}
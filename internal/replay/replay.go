@@ -0,0 +1,238 @@
+// Package replay re-sends captured HTTP requests to a live target and
+// compares its responses with the captured ones.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// maxResponse is the most of a replayed response body that is read and
+// compared, matching what is kept of captured bodies.
+const maxResponse = 1 << 20
+
+// hopByHop are headers that describe the captured connection rather than
+// the request, and are never replayed.
+var hopByHop = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding",
+	"Te", "Trailer", "Upgrade", "Content-Length",
+}
+
+// Replacement replaces Old with New in URLs and header values.
+type Replacement struct {
+	Old, New string
+}
+
+// Rules rewrites requests before they are sent.
+type Rules struct {
+	// KeepHost sends the captured Host header rather than the target's.
+	KeepHost bool
+	// Set replaces headers, such as Authorization, or adds them.
+	Set http.Header
+	// Drop removes headers, such as Cookie.
+	Drop []string
+	// Replace is applied to the request URI and every header value, for
+	// hosts that also appear in Origin, Referer and the like.
+	Replace []Replacement
+}
+
+// Config describes a replay.
+type Config struct {
+	// Target is the scheme and host requests are sent to. A path is
+	// prepended to every request's.
+	Target *url.URL
+	Rules  Rules
+	// Rate caps the requests sent per second; zero means no cap.
+	Rate float64
+	// Concurrency is how many requests are in flight at once; zero means
+	// one, which replays in capture order.
+	Concurrency int
+	// Timeout bounds each request; zero means 30 seconds.
+	Timeout time.Duration
+	// Insecure skips verifying the target's certificate.
+	Insecure bool
+	// Compare lists response headers compared besides Content-Type and
+	// Location.
+	Compare []string
+	// IgnoreFields are JSON object keys left out of body comparisons, at
+	// any depth, such as timestamps and request IDs.
+	IgnoreFields []string
+}
+
+// Result is the outcome of replaying one transaction.
+type Result struct {
+	Request *analyzer.Request
+	// Captured is the response in the capture, or nil if none was seen.
+	Captured *analyzer.Response
+	// Status is the replayed response's status code, or zero when Err is
+	// set.
+	Status int
+	// Latency is from sending the request to the response's headers.
+	Latency time.Duration
+	Err     error
+	// Diffs describes how the replayed response differs from the captured
+	// one.
+	Diffs []string
+}
+
+// Replay sends the request of each transaction to the target and compares
+// the responses, returning results in the order of txs. It stops sending
+// when ctx is done.
+func Replay(ctx context.Context, txs []analyzer.Transaction, cfg Config) []Result {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Bodies are compared as transferred and decoded here, so the
+	// captured Accept-Encoding is honored rather than replaced by gzip
+	transport.DisableCompression = true
+	if cfg.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// Redirects are part of what is compared
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	cmp := newComparer(cfg)
+
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	workers := cfg.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	results := make([]Result, len(txs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				results[n] = replay(ctx, client, txs[n], cfg, cmp)
+			}
+		}()
+	}
+send:
+	for n := range txs {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		select {
+		case next <- n:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(next)
+	wg.Wait()
+	for n := range results {
+		if results[n].Request == nil {
+			results[n] = Result{Request: txs[n].Request, Captured: txs[n].Response, Err: ctx.Err()}
+		}
+	}
+	return results
+}
+
+func replay(ctx context.Context, client *http.Client, tx analyzer.Transaction, cfg Config, cmp *comparer) Result {
+	res := Result{Request: tx.Request, Captured: tx.Response}
+	req, err := rewrite(ctx, tx.Request, cfg)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer resp.Body.Close()
+	res.Latency = time.Since(start)
+	res.Status = resp.StatusCode
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if tx.Response != nil {
+		res.Diffs = cmp.compare(tx.Response, resp, body)
+	}
+	return res
+}
+
+// rewrite builds the request to send for a captured one.
+func rewrite(ctx context.Context, orig *analyzer.Request, cfg Config) (*http.Request, error) {
+	uri := orig.URI
+	if uri == "" || uri[0] != '/' {
+		// An absolute URI, as sent to a proxy
+		if u, err := url.Parse(orig.URL); err == nil {
+			uri = u.RequestURI()
+		}
+	}
+	uri = cfg.Rules.replace(uri)
+	target := strings.TrimSuffix(cfg.Target.Scheme+"://"+cfg.Target.Host+cfg.Target.Path, "/") + uri
+
+	var body io.Reader
+	if len(orig.Body) > 0 {
+		body = bytes.NewReader(orig.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, orig.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range orig.Header {
+		for _, v := range values {
+			req.Header.Add(name, cfg.Rules.replace(v))
+		}
+	}
+	for _, name := range hopByHop {
+		req.Header.Del(name)
+	}
+	if cfg.Rules.KeepHost {
+		req.Host = cfg.Rules.replace(orig.Host)
+	}
+	req.Header.Del("Host")
+	for _, name := range cfg.Rules.Drop {
+		req.Header.Del(name)
+	}
+	for name, values := range cfg.Rules.Set {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	// Go sends req.Host rather than a Host header
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	return req, nil
+}
+
+func (r Rules) replace(s string) string {
+	for _, rep := range r.Replace {
+		s = strings.ReplaceAll(s, rep.Old, rep.New)
+	}
+	return s
+}
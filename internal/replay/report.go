@@ -0,0 +1,116 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Summary counts the outcomes of a replay.
+type Summary struct {
+	// Replayed counts the requests that got a response from the target.
+	Replayed int
+	// Matched and Differed split those by whether the response matched
+	// the captured one. Unanswered got no response in the capture, so
+	// there was nothing to compare with.
+	Matched, Differed, Unanswered int
+	// Failed counts the requests that got no response from the target.
+	Failed int
+}
+
+// Summarize counts results.
+func Summarize(results []Result) Summary {
+	var s Summary
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			s.Failed++
+			continue
+		case r.Captured == nil:
+			s.Unanswered++
+		case len(r.Diffs) > 0:
+			s.Differed++
+		default:
+			s.Matched++
+		}
+		s.Replayed++
+	}
+	return s
+}
+
+// Write prints the requests whose responses differed or failed, every
+// request when verbose is set, and the totals with captured and replayed
+// response times.
+func Write(w io.Writer, target string, results []Result, verbose bool) {
+	fmt.Fprintf(w, "=== Replay against %s ===\n", target)
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(w, "FAIL   %s: %v\n", describe(r.Request), r.Err)
+		case len(r.Diffs) > 0:
+			fmt.Fprintf(w, "DIFF   %s\n", describe(r.Request))
+			for _, d := range r.Diffs {
+				fmt.Fprintf(w, "         %s\n", d)
+			}
+		case verbose && r.Captured == nil:
+			fmt.Fprintf(w, "NEW    %s: %d (no response in the capture)\n", describe(r.Request), r.Status)
+		case verbose:
+			fmt.Fprintf(w, "OK     %s: %d\n", describe(r.Request), r.Status)
+		}
+	}
+
+	s := Summarize(results)
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Requests:\t%d\n", len(results))
+	fmt.Fprintf(tw, "Matched:\t%d\n", s.Matched)
+	fmt.Fprintf(tw, "Differed:\t%d\n", s.Differed)
+	if s.Unanswered > 0 {
+		fmt.Fprintf(tw, "Not in capture:\t%d\n", s.Unanswered)
+	}
+	fmt.Fprintf(tw, "Failed:\t%d\n", s.Failed)
+	tw.Flush()
+
+	var captured, replayed []time.Duration
+	for _, r := range results {
+		if r.Err != nil || r.Captured == nil || r.Captured.Request == nil {
+			continue
+		}
+		captured = append(captured, r.Captured.Timestamp.Sub(r.Captured.Request.Timestamp))
+		replayed = append(replayed, r.Latency)
+	}
+	if len(captured) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "RESPONSE TIME\tP50\tP95\tMAX\n")
+	for _, row := range []struct {
+		name string
+		d    []time.Duration
+	}{{"captured", captured}, {"replayed", replayed}} {
+		sort.Slice(row.d, func(i, j int) bool { return row.d[i] < row.d[j] })
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\n", row.name, percentile(row.d, 50), percentile(row.d, 95), percentile(row.d, 100))
+	}
+	tw.Flush()
+}
+
+// percentile returns the p-th percentile of sorted durations, rounded for
+// display.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i].Round(100 * time.Microsecond)
+}
+
+// describe names a request in reports, as in "GET /api/items?id=1".
+func describe(req *analyzer.Request) string {
+	uri := req.URI
+	if uri == "" {
+		uri = req.URL
+	}
+	return req.Method + " " + uri
+}
@@ -0,0 +1,123 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/rules"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// alert is one rule matching one transaction or DNS query.
+type alert struct {
+	time   time.Time
+	rule   *rules.Rule
+	flow   string
+	detail string
+}
+
+// Alerts reports the transactions and DNS queries matching a set of IDS
+// rules.
+type Alerts struct {
+	w     io.Writer
+	rules *rules.Set
+
+	mu     sync.Mutex
+	alerts []alert
+}
+
+func NewAlerts(w io.Writer, set *rules.Set) *Alerts {
+	return &Alerts{w: w, rules: set}
+}
+
+func (a *Alerts) HandleRequest(req *httpstream.Request) {
+	a.add(a.rules.MatchRequest(req), req.Timestamp, req.Flow.String(), req.Method+" "+req.URL)
+}
+
+func (a *Alerts) HandleResponse(resp *httpstream.Response) {
+	matched := a.rules.MatchResponse(resp)
+	if len(matched) == 0 {
+		return
+	}
+	ts, detail := resp.Timestamp, resp.Status
+	if req := resp.Request; req != nil {
+		ts, detail = req.Timestamp, req.Method+" "+req.URL+" -> "+resp.Status
+	}
+	a.add(matched, ts, resp.Flow.Reverse().String(), detail)
+}
+
+func (a *Alerts) HandleDNS(msg *dns.Message) {
+	flow := msg.SrcIP + " -> " + msg.DstIP
+	a.add(a.rules.MatchDNS(msg), msg.Timestamp, flow, msg.QType+" "+strings.TrimSuffix(msg.Question, "."))
+}
+
+func (a *Alerts) add(matched []*rules.Rule, ts time.Time, flow, detail string) {
+	if len(matched) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range matched {
+		a.alerts = append(a.alerts, alert{ts, r, flow, detail})
+	}
+}
+
+func (a *Alerts) HandleStats(analyzer.StatsSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Fprintf(a.w, "\n=== IDS Alerts ===\n")
+	fmt.Fprintf(a.w, "%d rules loaded, %d skipped\n", a.rules.Len(), len(a.rules.Skipped))
+	if len(a.rules.Skipped) > 0 {
+		reasons := make(counter)
+		for _, s := range a.rules.Skipped {
+			reasons[s.Err.Error()]++
+		}
+		t := newTable(a.w)
+		fmt.Fprintln(t, "SKIPPED\tREASON")
+		for _, e := range reasons.top(10) {
+			fmt.Fprintf(t, "%d\t%s\n", e.count, e.key)
+		}
+		t.Flush()
+	}
+	if len(a.alerts) == 0 {
+		fmt.Fprintln(a.w, "\nNo alerts")
+		return
+	}
+
+	sort.Slice(a.alerts, func(i, j int) bool {
+		if !a.alerts[i].time.Equal(a.alerts[j].time) {
+			return a.alerts[i].time.Before(a.alerts[j].time)
+		}
+		return a.alerts[i].rule.SID < a.alerts[j].rule.SID
+	})
+	bySID := make(counter)
+	rulesBySID := make(map[string]*rules.Rule)
+	for _, al := range a.alerts {
+		sid := strconv.Itoa(al.rule.SID)
+		bySID[sid]++
+		rulesBySID[sid] = al.rule
+	}
+	fmt.Fprintln(a.w)
+	t := newTable(a.w)
+	fmt.Fprintln(t, "SID\tREV\tALERTS\tCLASSTYPE\tMSG")
+	for _, e := range bySID.top(0) {
+		r := rulesBySID[e.key]
+		fmt.Fprintf(t, "%d\t%d\t%d\t%s\t%s\n", r.SID, r.Rev, e.count, r.Classtype, r.Msg)
+	}
+	t.Flush()
+
+	fmt.Fprintln(a.w)
+	t = newTable(a.w)
+	fmt.Fprintln(t, "TIME\tSID\tFLOW\tMATCHED\tMSG")
+	for _, al := range a.alerts {
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\n", al.time.Format(time.RFC3339), al.rule.SID, al.flow, truncate(al.detail, 80), al.rule.Msg)
+	}
+	t.Flush()
+}
@@ -0,0 +1,241 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Thresholds of the anomaly checks. They are deliberately conservative:
+// each check needs enough traffic to know what normal is.
+const (
+	// A second is a spike when its requests are this many standard
+	// deviations above the mean, at least spikeMinRequests and at least
+	// double the mean, out of at least spikeMinSeconds seconds of traffic.
+	spikeDeviations  = 4
+	spikeMinRequests = 10
+	spikeMinSeconds  = 10
+
+	// A header is new when first seen after this share of the capture, in
+	// a capture of at least newHeaderMinMessages messages.
+	newHeaderAfter       = 0.25
+	newHeaderMinMessages = 20
+
+	// A burst is at least burstMinErrors identical errors within
+	// burstWindow.
+	burstMinErrors = 5
+	burstWindow    = 10 * time.Second
+
+	// A response is abnormally large when at least sizeMinResponses came
+	// from its endpoint and it is above the upper fence of their sizes and
+	// sizeMinRatio times their median.
+	sizeMinResponses = 10
+	sizeMinRatio     = 10
+	sizeMinBytes     = 1 << 10
+)
+
+// anomaly is one finding, reported in time order.
+type anomaly struct {
+	time   time.Time
+	kind   string
+	detail string
+}
+
+// sizeSample is a response size and when it was seen.
+type sizeSample struct {
+	time time.Time
+	size int64
+}
+
+// Anomalies runs statistical checks over the capture once it has been
+// read: request rate spikes, header fields that only appear partway
+// through, bursts of identical errors and responses far larger than usual
+// for their endpoint.
+type Anomalies struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	first, last time.Time
+	messages    int64
+	perSecond   map[int64]int64
+	// headers holds when each header name was first seen, by direction.
+	headers map[string]time.Time
+	errors  map[string][]time.Time
+	sizes   map[string][]sizeSample
+}
+
+func NewAnomalies(w io.Writer) *Anomalies {
+	return &Anomalies{
+		w:         w,
+		perSecond: make(map[int64]int64),
+		headers:   make(map[string]time.Time),
+		errors:    make(map[string][]time.Time),
+		sizes:     make(map[string][]sizeSample),
+	}
+}
+
+func (a *Anomalies) HandleRequest(req *httpstream.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.message(req.Timestamp, "request", req.Header)
+	a.perSecond[req.Timestamp.Unix()]++
+}
+
+func (a *Anomalies) HandleResponse(resp *httpstream.Response) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.message(resp.Timestamp, "response", resp.Header)
+	if resp.Request == nil {
+		return
+	}
+	key := endpointKey(resp.Request)
+	if resp.StatusCode >= 400 {
+		errKey := fmt.Sprintf("%d from %s", resp.StatusCode, key)
+		a.errors[errKey] = append(a.errors[errKey], resp.Timestamp)
+	}
+	a.sizes[key] = append(a.sizes[key], sizeSample{resp.Timestamp, resp.BodySize})
+}
+
+func (a *Anomalies) message(ts time.Time, direction string, header http.Header) {
+	a.messages++
+	if a.first.IsZero() || ts.Before(a.first) {
+		a.first = ts
+	}
+	if ts.After(a.last) {
+		a.last = ts
+	}
+	for name := range header {
+		key := direction + " header " + name
+		if first, ok := a.headers[key]; !ok || ts.Before(first) {
+			a.headers[key] = ts
+		}
+	}
+}
+
+func (a *Anomalies) HandleStats(analyzer.StatsSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.messages == 0 {
+		return
+	}
+
+	var found []anomaly
+	found = append(found, a.rateSpikes()...)
+	found = append(found, a.newHeaders()...)
+	found = append(found, a.errorBursts()...)
+	found = append(found, a.largeResponses()...)
+	sort.SliceStable(found, func(i, j int) bool { return found[i].time.Before(found[j].time) })
+
+	fmt.Fprintf(a.w, "\n=== Anomalies ===\n")
+	if len(found) == 0 {
+		fmt.Fprintln(a.w, "None found")
+		return
+	}
+	t := newTable(a.w)
+	fmt.Fprintln(t, "TIME\tKIND\tDETAIL")
+	for _, f := range found {
+		fmt.Fprintf(t, "%s\t%s\t%s\n", f.time.Format("2006-01-02 15:04:05"), f.kind, f.detail)
+	}
+	t.Flush()
+}
+
+// rateSpikes finds seconds with far more requests than usual. Seconds
+// without requests between the first and last count as zero.
+func (a *Anomalies) rateSpikes() []anomaly {
+	start, end := a.first.Unix(), a.last.Unix()
+	seconds := end - start + 1
+	if seconds < spikeMinSeconds {
+		return nil
+	}
+	var sum, sumSq float64
+	for _, n := range a.perSecond {
+		sum += float64(n)
+		sumSq += float64(n) * float64(n)
+	}
+	mean := sum / float64(seconds)
+	stddev := math.Sqrt(sumSq/float64(seconds) - mean*mean)
+
+	var found []anomaly
+	for sec, n := range a.perSecond {
+		if n >= spikeMinRequests && float64(n) >= 2*mean && float64(n) > mean+spikeDeviations*stddev {
+			found = append(found, anomaly{time.Unix(sec, 0).UTC(), "rate spike",
+				fmt.Sprintf("%d requests in one second, against %.1f on average", n, mean)})
+		}
+	}
+	return found
+}
+
+// newHeaders finds header fields first seen well into the capture.
+func (a *Anomalies) newHeaders() []anomaly {
+	if a.messages < newHeaderMinMessages {
+		return nil
+	}
+	cutoff := a.first.Add(time.Duration(float64(a.last.Sub(a.first)) * newHeaderAfter))
+	var found []anomaly
+	for key, first := range a.headers {
+		if first.After(cutoff) {
+			found = append(found, anomaly{first, "new header", key + " first seen"})
+		}
+	}
+	return found
+}
+
+// errorBursts finds the same error from the same endpoint repeated within
+// a short window, reporting each burst once.
+func (a *Anomalies) errorBursts() []anomaly {
+	var found []anomaly
+	for key, times := range a.errors {
+		if len(times) < burstMinErrors {
+			continue
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i := 0; i+burstMinErrors <= len(times); {
+			if times[i+burstMinErrors-1].Sub(times[i]) > burstWindow {
+				i++
+				continue
+			}
+			// Extend the burst while errors keep coming within the window
+			j := i + burstMinErrors
+			for j < len(times) && times[j].Sub(times[j-1]) <= burstWindow {
+				j++
+			}
+			found = append(found, anomaly{times[i], "error burst",
+				fmt.Sprintf("%d × %s over %s", j-i, key, times[j-1].Sub(times[i]).Round(time.Millisecond))})
+			i = j
+		}
+	}
+	return found
+}
+
+// largeResponses finds responses far larger than their endpoint's usual
+// size.
+func (a *Anomalies) largeResponses() []anomaly {
+	var found []anomaly
+	for key, samples := range a.sizes {
+		if len(samples) < sizeMinResponses {
+			continue
+		}
+		sizes := make([]int64, len(samples))
+		for i, s := range samples {
+			sizes[i] = s.size
+		}
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		q1, median, q3 := sizes[len(sizes)/4], sizes[len(sizes)/2], sizes[3*len(sizes)/4]
+		fence := q3 + 3*(q3-q1)
+		for _, s := range samples {
+			if s.size > fence && s.size >= sizeMinBytes && s.size >= sizeMinRatio*max(median, 1) {
+				found = append(found, anomaly{s.time, "large response",
+					fmt.Sprintf("%s from %s, against a median of %s", formatBytes(s.size), key, formatBytes(median))})
+			}
+		}
+	}
+	return found
+}
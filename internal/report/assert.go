@@ -0,0 +1,222 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// metricKind says how a metric's threshold is written.
+type metricKind int
+
+const (
+	kindCount    metricKind = iota // a plain number
+	kindRate                       // "1%" or a fraction such as "0.01"
+	kindDuration                   // "500ms"
+)
+
+// metrics are the names assertions can test, with how they are written.
+var metrics = map[string]metricKind{
+	"requests":          kindCount,
+	"unanswered":        kindCount,
+	"error_rate":        kindRate,
+	"client_error_rate": kindRate,
+	"p50_latency":       kindDuration,
+	"p90_latency":       kindDuration,
+	"p95_latency":       kindDuration,
+	"p99_latency":       kindDuration,
+	"max_latency":       kindDuration,
+	"parse_errors":      kindCount,
+	"lost_bytes":        kindCount,
+}
+
+// Comparison operators, longest first so "<=" isn't read as "<".
+var operators = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// Assertion is a threshold on a metric of the whole capture, such as
+// "p99_latency<500ms".
+type Assertion struct {
+	Metric string
+	Op     string
+	// Value is the threshold: nanoseconds for durations, a fraction for
+	// rates.
+	Value float64
+	text  string
+}
+
+// ParseAssertion parses METRIC OP VALUE, where OP is one of <, <=, >, >=,
+// == and !=.
+func ParseAssertion(s string) (Assertion, error) {
+	text := strings.ReplaceAll(s, " ", "")
+	for _, op := range operators {
+		i := strings.Index(text, op)
+		if i < 0 {
+			continue
+		}
+		a := Assertion{Metric: text[:i], Op: op, text: text}
+		kind, ok := metrics[a.Metric]
+		if !ok {
+			return Assertion{}, fmt.Errorf("assertion %q: unknown metric %q (known: %s)", s, a.Metric, metricNames())
+		}
+		v, err := parseThreshold(kind, text[i+len(op):])
+		if err != nil {
+			return Assertion{}, fmt.Errorf("assertion %q: %w", s, err)
+		}
+		a.Value = v
+		return a, nil
+	}
+	return Assertion{}, fmt.Errorf("assertion %q: want METRIC OP VALUE, such as p99_latency<500ms", s)
+}
+
+func parseThreshold(kind metricKind, s string) (float64, error) {
+	switch kind {
+	case kindDuration:
+		d, err := time.ParseDuration(s)
+		return float64(d), err
+	case kindRate:
+		if pct, ok := strings.CutSuffix(s, "%"); ok {
+			v, err := strconv.ParseFloat(pct, 64)
+			return v / 100, err
+		}
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func metricNames() string {
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (a Assertion) String() string {
+	return a.text
+}
+
+func (a Assertion) holds(v float64) bool {
+	switch a.Op {
+	case "<":
+		return v < a.Value
+	case "<=":
+		return v <= a.Value
+	case ">":
+		return v > a.Value
+	case ">=":
+		return v >= a.Value
+	case "==":
+		return v == a.Value
+	default:
+		return v != a.Value
+	}
+}
+
+// format writes a metric's value the way its thresholds are written.
+func format(kind metricKind, v float64) string {
+	switch kind {
+	case kindDuration:
+		return formatDuration(time.Duration(v))
+	case kindRate:
+		return fmt.Sprintf("%.2f%%", 100*v)
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
+
+// Assertions evaluates assertions over the whole capture once it has been
+// read. The error rate counts requests answered with a 5xx status or not at
+// all; the client error rate those answered with a 4xx status.
+type Assertions struct {
+	base
+	w          io.Writer
+	assertions []Assertion
+	mu         sync.Mutex
+
+	requests, unanswered   int64
+	serverErrs, clientErrs int64
+	latencies              samples
+	failed                 int
+}
+
+func NewAssertions(w io.Writer, assertions []Assertion) *Assertions {
+	return &Assertions{w: w, assertions: assertions}
+}
+
+func (a *Assertions) HandleRequest(*httpstream.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests++
+	a.unanswered++
+}
+
+func (a *Assertions) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unanswered--
+	switch {
+	case resp.StatusCode >= 500:
+		a.serverErrs++
+	case resp.StatusCode >= 400:
+		a.clientErrs++
+	}
+	a.latencies.add(resp.Timestamp.Sub(resp.Request.Timestamp))
+}
+
+func (a *Assertions) HandleStats(s analyzer.StatsSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	values := map[string]float64{
+		"requests":     float64(a.requests),
+		"unanswered":   float64(a.unanswered),
+		"parse_errors": float64(s.ParseErrors),
+		"lost_bytes":   float64(s.LostBytes),
+	}
+	if a.requests > 0 {
+		values["error_rate"] = float64(a.serverErrs+a.unanswered) / float64(a.requests)
+		values["client_error_rate"] = float64(a.clientErrs) / float64(a.requests)
+	}
+	if a.latencies.count > 0 {
+		for _, p := range []int{50, 90, 95, 99} {
+			values[fmt.Sprintf("p%d_latency", p)] = float64(a.latencies.percentile(float64(p)))
+		}
+		values["max_latency"] = float64(a.latencies.max)
+	}
+
+	fmt.Fprintf(a.w, "\n=== Assertions ===\n")
+	t := newTable(a.w)
+	for _, as := range a.assertions {
+		v, ok := values[as.Metric]
+		switch {
+		case !ok:
+			// Rates and latencies are undefined without requests
+			a.failed++
+			fmt.Fprintf(t, "FAIL\t%s\tno requests to measure\n", as)
+		case as.holds(v):
+			fmt.Fprintf(t, "PASS\t%s\t%s\n", as, format(metrics[as.Metric], v))
+		default:
+			a.failed++
+			fmt.Fprintf(t, "FAIL\t%s\t%s\n", as, format(metrics[as.Metric], v))
+		}
+	}
+	t.Flush()
+}
+
+// Failed returns how many assertions did not hold; it is valid once the
+// run has ended.
+func (a *Assertions) Failed() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.failed
+}
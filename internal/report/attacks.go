@@ -0,0 +1,187 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// attackPatterns are the signatures of each kind of web attack, matched
+// against decoded request input. They favour well-known payloads over
+// completeness, to keep false positives on ordinary traffic rare.
+var attackPatterns = []struct {
+	category string
+	re       *regexp.Regexp
+}{
+	{"sqli", regexp.MustCompile(`(?i)'\s*(?:or|and)\s+[\w'"]+\s*(?:=|like)\s*[\w'"]+`)},
+	{"sqli", regexp.MustCompile(`(?i)\bunion(?:\s|/\*.*?\*/)+(?:all(?:\s|/\*.*?\*/)+)?select\b`)},
+	{"sqli", regexp.MustCompile(`(?i);\s*(?:drop|insert|delete|update|shutdown|exec)\s`)},
+	{"sqli", regexp.MustCompile(`(?i)\b(?:sleep|benchmark|pg_sleep)\s*\(|\bwaitfor\s+delay\b`)},
+	{"sqli", regexp.MustCompile(`(?i)\binformation_schema\b|'\s*(?:--|#|/\*)`)},
+	{"xss", regexp.MustCompile(`(?i)<\s*script\b|javascript\s*:|document\.cookie`)},
+	{"xss", regexp.MustCompile(`(?i)<\s*(?:img|svg|iframe|body|video|audio|details)\b[^>]*\bon[a-z]+\s*=`)},
+	{"traversal", regexp.MustCompile(`(?:\.\.[/\\]){2,}|(?i)/etc/(?:passwd|shadow)\b|\bc:\\windows\\|\x00`)},
+	{"cmdi", regexp.MustCompile("(?i)(?:[;&|`]|\\$\\()\\s*(?:cat|ls|id|whoami|uname|wget|curl|nc|ncat|bash|sh|ping|powershell|cmd)\\b")},
+	{"cmdi", regexp.MustCompile(`/bin/(?:ba)?sh\b`)},
+	{"jndi", regexp.MustCompile(`(?i)\$\{\s*(?:jndi|\$\{lower:j\}|j\$\{)`)},
+}
+
+// attackCategories in the order the per-source table lists them.
+var attackCategories = []string{"sqli", "xss", "traversal", "cmdi", "jndi"}
+
+// attackHeaders are the request headers attack payloads are commonly sent
+// in, besides the URL and body.
+var attackHeaders = []string{"User-Agent", "Referer", "Cookie", "X-Forwarded-For", "X-Api-Version"}
+
+// suspiciousRequest is a request that matched at least one pattern.
+type suspiciousRequest struct {
+	time       time.Time
+	source     string
+	request    string
+	categories []string
+	location   string
+	match      string
+}
+
+// attackSource is what one client sent.
+type attackSource struct {
+	requests    int64
+	suspicious  int64
+	categories  counter
+	first, last time.Time
+}
+
+// Attacks reports requests carrying SQL injection, cross-site scripting,
+// path traversal, command injection and JNDI lookup payloads in their URL,
+// common headers or body, with a summary per source address.
+type Attacks struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	found   []suspiciousRequest
+	sources map[string]*attackSource
+}
+
+func NewAttacks(w io.Writer) *Attacks {
+	return &Attacks{w: w, sources: make(map[string]*attackSource)}
+}
+
+func (a *Attacks) HandleRequest(req *httpstream.Request) {
+	found, ok := scanRequest(req)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	src, exists := a.sources[req.SrcIP]
+	if !exists {
+		src = &attackSource{categories: make(counter)}
+		a.sources[req.SrcIP] = src
+	}
+	src.requests++
+	if !ok {
+		return
+	}
+	src.suspicious++
+	for _, c := range found.categories {
+		src.categories[c]++
+	}
+	if src.first.IsZero() || req.Timestamp.Before(src.first) {
+		src.first = req.Timestamp
+	}
+	if req.Timestamp.After(src.last) {
+		src.last = req.Timestamp
+	}
+	a.found = append(a.found, found)
+}
+
+// scanRequest matches the patterns against each part of the request in
+// turn, reporting every category found and the first match.
+func scanRequest(req *httpstream.Request) (suspiciousRequest, bool) {
+	s := suspiciousRequest{time: req.Timestamp, source: req.SrcIP, request: req.Method + " " + req.URI}
+	seen := make(map[string]bool)
+	scan := func(location, text string) {
+		for _, p := range attackPatterns {
+			m := p.re.FindString(text)
+			if m == "" || seen[p.category] {
+				continue
+			}
+			seen[p.category] = true
+			s.categories = append(s.categories, p.category)
+			if s.location == "" {
+				s.location, s.match = location, m
+			}
+		}
+	}
+	scan("url", decodeInput(req.URI))
+	for _, name := range attackHeaders {
+		for _, v := range req.Header.Values(name) {
+			scan("header "+name, decodeInput(v))
+		}
+	}
+	if body, _, err := req.DecodedBody(); err == nil && len(body) > 0 && bytes.IndexByte(body, 0) < 0 {
+		text := string(body)
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			text = decodeInput(text)
+		}
+		scan("body", text)
+	}
+	return s, len(s.categories) > 0
+}
+
+// decodeInput undoes URL encoding, twice to catch double encoding.
+func decodeInput(s string) string {
+	for i := 0; i < 2; i++ {
+		d, err := url.QueryUnescape(s)
+		if err != nil || d == s {
+			break
+		}
+		s = d
+	}
+	return s
+}
+
+func (a *Attacks) HandleStats(analyzer.StatsSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Fprintf(a.w, "\n=== Web Attacks by Source ===\n")
+	if len(a.found) == 0 {
+		fmt.Fprintln(a.w, "None found")
+		return
+	}
+	suspicious := make(counter)
+	for ip, src := range a.sources {
+		if src.suspicious > 0 {
+			suspicious[ip] = src.suspicious
+		}
+	}
+	t := newTable(a.w)
+	fmt.Fprintf(t, "SOURCE\tREQUESTS\tSUSPICIOUS\t%s\tFIRST\tLAST\n", strings.ToUpper(strings.Join(attackCategories, "\t")))
+	for _, e := range suspicious.top(0) {
+		src := a.sources[e.key]
+		fmt.Fprintf(t, "%s\t%d\t%d", e.key, src.requests, src.suspicious)
+		for _, c := range attackCategories {
+			fmt.Fprintf(t, "\t%d", src.categories[c])
+		}
+		fmt.Fprintf(t, "\t%s\t%s\n", src.first.Format(time.RFC3339), src.last.Format(time.RFC3339))
+	}
+	t.Flush()
+
+	sort.Slice(a.found, func(i, j int) bool { return a.found[i].time.Before(a.found[j].time) })
+	fmt.Fprintf(a.w, "\n=== Suspicious Requests ===\n")
+	t = newTable(a.w)
+	fmt.Fprintln(t, "TIME\tSOURCE\tATTACK\tLOCATION\tMATCH\tREQUEST")
+	for _, s := range a.found {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%q\t%s\n", s.time.Format(time.RFC3339), s.source, strings.Join(s.categories, ","),
+			s.location, truncate(s.match, 40), truncate(s.request, 80))
+	}
+	t.Flush()
+}
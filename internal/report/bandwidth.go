@@ -0,0 +1,172 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pcap-analyzer/internal/asn"
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/protoid"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// flowUsage is the traffic of one flow. The client is the endpoint that sent
+// the flow's first packet.
+type flowUsage struct {
+	client, server                   string
+	tcp                              bool
+	proto                            protoid.Flow
+	toServer, toClient               int64
+	toServerPackets, toClientPackets int64
+}
+
+// hostUsage is the traffic one address sent and received.
+type hostUsage struct {
+	sent, received int64
+	packets        int64
+}
+
+// Bandwidth reports traffic by protocol, by host and by flow, counting whole
+// packets as captured on the wire. TCP flows are classified by the first
+// payloads they carry, HTTP or not, as the summary does.
+type Bandwidth struct {
+	base
+	w  io.Writer
+	n  int
+	mu sync.Mutex
+
+	flows map[string]*flowUsage
+	hosts map[string]*hostUsage
+	// names maps addresses to the names DNS answers gave them.
+	names map[string]string
+
+	// ASN, if set, labels addresses with their network.
+	ASN *asn.DB
+}
+
+// NewBandwidth returns a report listing the n busiest hosts and flows.
+func NewBandwidth(w io.Writer, n int) *Bandwidth {
+	return &Bandwidth{
+		w:     w,
+		n:     n,
+		flows: make(map[string]*flowUsage),
+		hosts: make(map[string]*hostUsage),
+		names: make(map[string]string),
+	}
+}
+
+func (b *Bandwidth) HandlePacket(p *analyzer.Packet) {
+	key := stream.FlowKey(p.Network, p.Transport)
+	size := int64(p.CaptureInfo.Length)
+	src := p.Network.Src().String() + ":" + p.Transport.Src().String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.flows[key]
+	if !ok {
+		f = &flowUsage{
+			client: src,
+			server: p.Network.Dst().String() + ":" + p.Transport.Dst().String(),
+			tcp:    p.TCP != nil,
+		}
+		// A SYN/ACK answers the client's SYN even if that wasn't captured
+		if p.TCP != nil && p.TCP.SYN && p.TCP.ACK {
+			f.client, f.server = f.server, f.client
+		}
+		b.flows[key] = f
+	}
+	srcPort, dstPort := ports(p)
+	f.proto.Add(f.tcp, srcPort, dstPort, p.Payload)
+	if src == f.client {
+		f.toServer += size
+		f.toServerPackets++
+	} else {
+		f.toClient += size
+		f.toClientPackets++
+	}
+
+	b.host(p.Network.Src().String()).sent += size
+	b.host(p.Network.Src().String()).packets++
+	b.host(p.Network.Dst().String()).received += size
+	b.host(p.Network.Dst().String()).packets++
+}
+
+func (b *Bandwidth) host(ip string) *hostUsage {
+	h, ok := b.hosts[ip]
+	if !ok {
+		h = &hostUsage{}
+		b.hosts[ip] = h
+	}
+	return h
+}
+
+func (b *Bandwidth) HandleDNS(msg *dns.Message) {
+	if !msg.Response {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rr := range msg.Answers {
+		if rr.Type == "A" || rr.Type == "AAAA" {
+			b.names[rr.Value] = strings.TrimSuffix(rr.Name, ".")
+		}
+	}
+}
+
+func (b *Bandwidth) HandleStats(analyzer.StatsSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.flows) == 0 {
+		return
+	}
+
+	bytes, packets := make(counter), make(counter)
+	var total int64
+	for _, f := range b.flows {
+		bytes[f.proto.Name(f.tcp)] += f.toServer + f.toClient
+		packets[f.proto.Name(f.tcp)] += f.toServerPackets + f.toClientPackets
+		total += f.toServer + f.toClient
+	}
+	fmt.Fprintf(b.w, "\n=== Bandwidth by Protocol ===\n")
+	t := newTable(b.w)
+	fmt.Fprintln(t, "PROTOCOL\tBYTES\tPACKETS\tSHARE")
+	for _, e := range bytes.top(0) {
+		fmt.Fprintf(t, "%s\t%s\t%d\t%.1f%%\n", e.key, formatBytes(e.count), packets[e.key],
+			100*float64(e.count)/float64(max(total, 1)))
+	}
+	t.Flush()
+
+	talkers := make(counter, len(b.hosts))
+	for ip, h := range b.hosts {
+		talkers[ip] = h.sent + h.received
+	}
+	fmt.Fprintf(b.w, "\n=== Top %d Talkers ===\n", b.n)
+	t = newTable(b.w)
+	fmt.Fprintln(t, "HOST\tNAME\tSENT\tRECEIVED\tPACKETS")
+	for _, e := range talkers.top(b.n) {
+		h := b.hosts[e.key]
+		name := b.names[e.key]
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\n", label(b.ASN, e.key), name, formatBytes(h.sent), formatBytes(h.received), h.packets)
+	}
+	t.Flush()
+
+	flows := make(counter, len(b.flows))
+	for key, f := range b.flows {
+		flows[key] = f.toServer + f.toClient
+	}
+	fmt.Fprintf(b.w, "\n=== Top %d Flows ===\n", b.n)
+	t = newTable(b.w)
+	fmt.Fprintln(t, "CLIENT\tSERVER\tPROTOCOL\tSENT\tRECEIVED\tPACKETS")
+	for _, e := range flows.top(b.n) {
+		f := b.flows[e.key]
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%d\n", f.client, label(b.ASN, f.server), f.proto.Name(f.tcp),
+			formatBytes(f.toServer), formatBytes(f.toClient), f.toServerPackets+f.toClientPackets)
+	}
+	t.Flush()
+}
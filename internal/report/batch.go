@@ -0,0 +1,111 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// WriteCombined prints a report across the captures of a batch from their
+// profiles: the totals of each, then status classes, and the top hosts and
+// endpoints by requests over all of them. Percentiles can't be combined
+// from percentiles, so each endpoint shows the highest P95 of any capture.
+func WriteCombined(w io.Writer, profiles []*Profile, top int) {
+	var requests, unanswered int64
+	statuses := make(map[string]int64)
+	hosts := make(map[string]int64)
+	hostCaptures := make(map[string]int)
+	type endpoint struct {
+		key      string
+		requests int64
+		captures int
+		statuses map[string]int64
+		worstP95 time.Duration
+	}
+	endpoints := make(map[string]*endpoint)
+
+	fmt.Fprintf(w, "\n=== Captures ===\n")
+	t := newTable(w)
+	fmt.Fprintln(t, "CAPTURE\tSTART\tDURATION\tREQUESTS\t4XX\t5XX\tNO RESPONSE")
+	for _, p := range profiles {
+		start := "-"
+		if !p.Start.IsZero() {
+			start = p.Start.UTC().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", p.Capture, start, p.End.Sub(p.Start).Round(time.Millisecond),
+			p.Requests, p.Statuses["4xx"], p.Statuses["5xx"], p.Unanswered)
+
+		requests += p.Requests
+		unanswered += p.Unanswered
+		for class, n := range p.Statuses {
+			statuses[class] += n
+		}
+		for host, n := range p.Hosts {
+			hosts[host] += n
+			hostCaptures[host]++
+		}
+		for key, e := range p.Endpoints {
+			c, ok := endpoints[key]
+			if !ok {
+				c = &endpoint{key: key, statuses: make(map[string]int64)}
+				endpoints[key] = c
+			}
+			c.requests += e.Requests
+			c.captures++
+			for class, n := range e.Statuses {
+				c.statuses[class] += n
+			}
+			c.worstP95 = max(c.worstP95, e.P95)
+		}
+	}
+	fmt.Fprintf(t, "total (%d)\t\t\t%d\t%d\t%d\t%d\n", len(profiles), requests, statuses["4xx"], statuses["5xx"], unanswered)
+	t.Flush()
+
+	fmt.Fprintf(w, "\n=== Status Classes ===\n")
+	t = newTable(w)
+	fmt.Fprintln(t, "STATUS\tRESPONSES\tSHARE")
+	for _, class := range unionKeys(statuses, nil) {
+		fmt.Fprintf(t, "%s\t%d\t%s\n", class, statuses[class], share(statuses[class], requests))
+	}
+	fmt.Fprintf(t, "no response\t%d\t%s\n", unanswered, share(unanswered, requests))
+	t.Flush()
+
+	fmt.Fprintf(w, "\n=== Top Hosts ===\n")
+	t = newTable(w)
+	fmt.Fprintln(t, "HOST\tREQUESTS\tCAPTURES")
+	names := unionKeys(hosts, nil)
+	sort.SliceStable(names, func(i, j int) bool { return hosts[names[i]] > hosts[names[j]] })
+	for i, host := range names {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(t, "%s\t%d\t%d\n", host, hosts[host], hostCaptures[host])
+	}
+	t.Flush()
+
+	fmt.Fprintf(w, "\n=== Top Endpoints ===\n")
+	t = newTable(w)
+	fmt.Fprintln(t, "ENDPOINT\tREQUESTS\tCAPTURES\t4XX\t5XX\tWORST P95")
+	list := make([]*endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].requests != list[j].requests {
+			return list[i].requests > list[j].requests
+		}
+		return list[i].key < list[j].key
+	})
+	for i, e := range list {
+		if i == top {
+			break
+		}
+		p95 := "-"
+		if e.worstP95 > 0 {
+			p95 = formatDuration(e.worstP95)
+		}
+		fmt.Fprintf(t, "%s\t%d\t%d\t%d\t%d\t%s\n", e.key, e.requests, e.captures, e.statuses["4xx"], e.statuses["5xx"], p95)
+	}
+	t.Flush()
+}
@@ -0,0 +1,236 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Thresholds of beacon detection. A series is a candidate when it has at
+// least beaconMinEvents events at least beaconMinPeriod apart on median,
+// and its intervals deviate from the median by at most beaconMaxJitter of
+// it on median, so the odd missed or delayed beacon doesn't hide the rest.
+const (
+	beaconMinEvents = 6
+	beaconMinPeriod = time.Second
+	beaconMaxJitter = 0.2
+	// Payloads up to beaconSmall bytes count as small.
+	beaconSmall = 4 << 10
+)
+
+// beaconEvent is one request, or one connection, and the payload bytes it
+// carried in both directions.
+type beaconEvent struct {
+	time  time.Time
+	bytes int64
+}
+
+// beaconConn is a TCP connection that isn't HTTP, whose requests can't be
+// seen, so the connections themselves are timed.
+type beaconConn struct {
+	series string
+	start  time.Time
+	bytes  int64
+	http   bool
+}
+
+// beacon is a candidate series.
+type beacon struct {
+	series, kind string
+	events       int
+	period       time.Duration
+	jitter       float64
+	size         int64
+	confidence   float64
+	// last is when the latest event was seen.
+	last time.Time
+}
+
+// Beacons reports clients contacting the same destination at highly
+// regular intervals with small, similar payloads, the way malware checks in
+// with its command and control server. HTTP requests are timed per client
+// and host; other TCP connections, such as TLS, per client and server port.
+type Beacons struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	requests map[string][]beaconEvent
+	conns    map[string]*beaconConn
+
+	// Notify, if set, receives each candidate once the capture has been
+	// read, since beacons only show over time.
+	Notify FindingFunc
+}
+
+func NewBeacons(w io.Writer) *Beacons {
+	return &Beacons{w: w, requests: make(map[string][]beaconEvent), conns: make(map[string]*beaconConn)}
+}
+
+func (b *Beacons) HandleResponse(resp *httpstream.Response) {
+	req := resp.Request
+	if req == nil {
+		return
+	}
+	host, _ := hostPath(req)
+	series := req.SrcIP + " -> " + host
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests[series] = append(b.requests[series], beaconEvent{req.Timestamp, req.BodySize + resp.BodySize})
+}
+
+func (b *Beacons) HandlePacket(p *analyzer.Packet) {
+	if p.TCP == nil {
+		return
+	}
+	key := stream.FlowKey(p.Network, p.Transport)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.conns[key]
+	if !ok {
+		if !p.TCP.SYN || p.TCP.ACK {
+			// Only connections seen opening can be timed
+			return
+		}
+		c = &beaconConn{
+			series: p.Network.Src().String() + " -> " + p.Network.Dst().String() + ":" + p.Transport.Dst().String(),
+			start:  p.CaptureInfo.Timestamp,
+		}
+		b.conns[key] = c
+	}
+	if payload := p.TCP.Payload; len(payload) > 0 {
+		if c.bytes == 0 && httpstream.LooksLikeHTTP(payload) {
+			c.http = true
+		}
+		c.bytes += int64(len(payload))
+	}
+}
+
+func (b *Beacons) HandleStats(analyzer.StatsSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var found []beacon
+	for series, events := range b.requests {
+		if bc, ok := detectBeacon(series, "HTTP requests", events); ok {
+			found = append(found, bc)
+		}
+	}
+	conns := make(map[string][]beaconEvent)
+	for _, c := range b.conns {
+		if !c.http {
+			conns[c.series] = append(conns[c.series], beaconEvent{c.start, c.bytes})
+		}
+	}
+	for series, events := range conns {
+		if bc, ok := detectBeacon(series, "TCP connections", events); ok {
+			found = append(found, bc)
+		}
+	}
+
+	fmt.Fprintf(b.w, "\n=== Beaconing Candidates ===\n")
+	if len(found) == 0 {
+		fmt.Fprintln(b.w, "None found")
+		return
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].confidence != found[j].confidence {
+			return found[i].confidence > found[j].confidence
+		}
+		return found[i].series < found[j].series
+	})
+	if b.Notify != nil {
+		for _, bc := range found {
+			b.Notify(Finding{
+				Kind:    "beacon",
+				Time:    bc.last,
+				Key:     bc.series + " " + bc.kind,
+				Summary: fmt.Sprintf("Beaconing: %s every %s", bc.series, formatDuration(bc.period)),
+				Detail: fmt.Sprintf("%d %s, %.1f%% jitter, median size %s, %.0f%% confidence", bc.events, bc.kind,
+					100*bc.jitter, formatBytes(bc.size), 100*bc.confidence),
+			})
+		}
+	}
+	t := newTable(b.w)
+	fmt.Fprintln(t, "SERIES\tKIND\tEVENTS\tPERIOD\tJITTER\tMEDIAN SIZE\tCONFIDENCE")
+	for _, bc := range found {
+		fmt.Fprintf(t, "%s\t%s\t%d\t%s\t%.1f%%\t%s\t%.0f%%\n", bc.series, bc.kind, bc.events,
+			formatDuration(bc.period), 100*bc.jitter, formatBytes(bc.size), 100*bc.confidence)
+	}
+	t.Flush()
+}
+
+// detectBeacon checks whether events are regular enough to be a beacon.
+// Confidence weighs how regular the intervals are, how similar and how
+// small the payloads are, and how many events there were.
+func detectBeacon(series, kind string, events []beaconEvent) (beacon, bool) {
+	if len(events) < beaconMinEvents {
+		return beacon{}, false
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].time.Before(events[j].time) })
+	intervals := make([]float64, len(events)-1)
+	for i := range intervals {
+		intervals[i] = events[i+1].time.Sub(events[i].time).Seconds()
+	}
+	period := median(intervals)
+	if period < beaconMinPeriod.Seconds() {
+		return beacon{}, false
+	}
+	deviations := make([]float64, len(intervals))
+	for i, v := range intervals {
+		deviations[i] = math.Abs(v - period)
+	}
+	jitter := median(deviations) / period
+	if jitter > beaconMaxJitter {
+		return beacon{}, false
+	}
+
+	sizes := make([]float64, len(events))
+	var mean float64
+	for i, e := range events {
+		sizes[i] = float64(e.bytes)
+		mean += sizes[i] / float64(len(sizes))
+	}
+	var variance float64
+	for _, s := range sizes {
+		variance += (s - mean) * (s - mean) / float64(len(sizes))
+	}
+	similarity := 1.0
+	if mean > 0 {
+		similarity = math.Max(0, 1-math.Sqrt(variance)/mean)
+	}
+	size := median(sizes)
+	small := 0.0
+	if size <= beaconSmall {
+		small = 1
+	}
+	count := math.Min(1, float64(len(intervals))/20)
+
+	return beacon{
+		series:     series,
+		kind:       kind,
+		events:     len(events),
+		period:     time.Duration(period * float64(time.Second)),
+		jitter:     jitter,
+		size:       int64(size),
+		confidence: 0.45*(1-jitter/beaconMaxJitter) + 0.25*similarity + 0.1*small + 0.2*count,
+		last:       events[len(events)-1].time,
+	}, true
+}
+
+// median returns the median of values, which it sorts.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
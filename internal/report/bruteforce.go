@@ -0,0 +1,178 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// A client brute forces a service when it makes at least bruteMinAttempts
+// denied or login requests to it within bruteWindow.
+const (
+	bruteMinAttempts = 10
+	bruteWindow      = time.Minute
+	// bruteStuffingUsers is how many accounts tried make a burst credential
+	// stuffing rather than password guessing.
+	bruteStuffingUsers = 5
+)
+
+// loginPath matches the paths of common login endpoints.
+var loginPath = regexp.MustCompile(`(?i)log[_-]?in|sign[_-]?in|log[_-]?on|/auth(?:enticate)?\b|/session|/oauth2?/token|wp-login\.php|xmlrpc\.php|j_security_check`)
+
+// authAttempt is one denied or login exchange.
+type authAttempt struct {
+	time   time.Time
+	status int
+	login  bool
+	user   string
+	path   string
+}
+
+type bruteKey struct {
+	client, service string
+}
+
+// BruteForce reports bursts of authentication attempts from one client to
+// one service: responses of 401 Unauthorized or 403 Forbidden, and POSTs to
+// login endpoints or carrying a password whatever their answer, since failed
+// form logins are often answered 200.
+type BruteForce struct {
+	base
+	w io.Writer
+
+	mu       sync.Mutex
+	attempts map[bruteKey][]authAttempt
+}
+
+func NewBruteForce(w io.Writer) *BruteForce {
+	return &BruteForce{w: w, attempts: make(map[bruteKey][]authAttempt)}
+}
+
+func (b *BruteForce) HandleResponse(resp *httpstream.Response) {
+	req := resp.Request
+	a := authAttempt{time: resp.Timestamp, status: resp.StatusCode}
+	key := bruteKey{resp.DstIP, net.JoinHostPort(resp.SrcIP, resp.SrcPort)}
+	if req != nil {
+		a.time, a.path = req.Timestamp, withoutQuery(req.URI)
+		key.service = serviceName(req)
+		password := false
+		for _, c := range requestCredentials(req) {
+			if c.user != "" && a.user == "" {
+				a.user = c.user
+			}
+			password = password || strings.HasSuffix(c.kind, " password")
+		}
+		a.login = req.Method == "POST" && (loginPath.MatchString(a.path) || password)
+	}
+	if !a.login && a.status != 401 && a.status != 403 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts[key] = append(b.attempts[key], a)
+}
+
+// burst is the attempts of one client on one service that made a burst.
+type burst struct {
+	bruteKey
+	attempts      []authAttempt
+	peak          int
+	denied, posts int
+	users         map[string]bool
+}
+
+// peakAttempts returns the most attempts within bruteWindow of each other.
+// attempts must be sorted by time.
+func peakAttempts(attempts []authAttempt) int {
+	peak, start := 0, 0
+	for end := range attempts {
+		for attempts[end].time.Sub(attempts[start].time) > bruteWindow {
+			start++
+		}
+		peak = max(peak, end-start+1)
+	}
+	return peak
+}
+
+func (b *BruteForce) HandleStats(analyzer.StatsSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.w, "\n=== Authentication Brute Force ===\n")
+
+	var bursts []*burst
+	for key, attempts := range b.attempts {
+		if len(attempts) < bruteMinAttempts {
+			continue
+		}
+		sort.Slice(attempts, func(i, j int) bool { return attempts[i].time.Before(attempts[j].time) })
+		peak := peakAttempts(attempts)
+		if peak < bruteMinAttempts {
+			continue
+		}
+		br := &burst{bruteKey: key, attempts: attempts, peak: peak, users: make(map[string]bool)}
+		for _, a := range attempts {
+			if a.status == 401 || a.status == 403 {
+				br.denied++
+			}
+			if a.login {
+				br.posts++
+			}
+			if a.user != "" {
+				br.users[a.user] = true
+			}
+		}
+		bursts = append(bursts, br)
+	}
+	if len(bursts) == 0 {
+		fmt.Fprintf(b.w, "No bursts of %d or more denied or login requests within %s\n", bruteMinAttempts, bruteWindow)
+		return
+	}
+	sort.Slice(bursts, func(i, j int) bool {
+		if !bursts[i].attempts[0].time.Equal(bursts[j].attempts[0].time) {
+			return bursts[i].attempts[0].time.Before(bursts[j].attempts[0].time)
+		}
+		return bursts[i].client < bursts[j].client
+	})
+	fmt.Fprintf(b.w, "%d bursts of %d or more denied or login requests within %s\n", len(bursts), bruteMinAttempts, bruteWindow)
+	t := newTable(b.w)
+	fmt.Fprintln(t, "CLIENT\tSERVICE\tENDPOINT\tATTEMPTS\tDENIED\tLOGIN POSTS\tACCOUNTS\tKIND\tPEAK/MIN\tFIRST SEEN\tDURATION\tSTATUSES")
+	for _, br := range bursts {
+		paths := make(counter)
+		statuses := make(counter)
+		for _, a := range br.attempts {
+			if a.path != "" {
+				paths[a.path]++
+			}
+			statuses[strconv.Itoa(a.status)]++
+		}
+		endpoint := "-"
+		if top := paths.top(1); len(top) > 0 {
+			endpoint = truncate(top[0].key, 40)
+		}
+		var counts []string
+		for _, e := range statuses.top(0) {
+			counts = append(counts, fmt.Sprintf("%s×%d", e.key, e.count))
+		}
+		kind := "-"
+		switch {
+		case len(br.users) >= bruteStuffingUsers:
+			kind = "credential stuffing"
+		case len(br.users) > 0:
+			kind = "password guessing"
+		}
+		first, last := br.attempts[0].time, br.attempts[len(br.attempts)-1].time
+		fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%d\t%s\t%s\t%s\n", br.client, br.service, endpoint, len(br.attempts),
+			br.denied, br.posts, len(br.users), kind, br.peak, first.Format(time.RFC3339), last.Sub(first).Round(time.Millisecond),
+			strings.Join(counts, ", "))
+	}
+	t.Flush()
+}
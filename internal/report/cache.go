@@ -0,0 +1,179 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Cacheability of a response, as a shared cache such as a CDN or proxy sees
+// it.
+const (
+	cacheShared  = "cacheable"
+	cachePrivate = "private"
+	cacheNone    = "uncacheable"
+)
+
+// cacheableByDefault are the statuses a cache may store without explicit
+// freshness information.
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true,
+	308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheability classifies a response by its request method, status and
+// caching headers. Responses cacheable by default count only with a
+// validator or Last-Modified date, which heuristic freshness needs.
+func cacheability(resp *httpstream.Response) string {
+	if resp.Request != nil && resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead {
+		return cacheNone
+	}
+	cc := directives(resp.Header.Get("Cache-Control"))
+	switch {
+	case cc["no-store"]:
+		return cacheNone
+	case cc["private"]:
+		return cachePrivate
+	case cc["public"] || cc["max-age"] || cc["s-maxage"] || resp.Header.Get("Expires") != "":
+		return cacheShared
+	case cacheableByDefault[resp.StatusCode] && resp.Header.Get("Last-Modified") != "":
+		return cacheShared
+	}
+	return cacheNone
+}
+
+// directives returns the names of the Cache-Control directives in v.
+func directives(v string) map[string]bool {
+	d := make(map[string]bool)
+	for _, part := range strings.Split(v, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			d[strings.ToLower(name)] = true
+		}
+	}
+	return d
+}
+
+// cacheStatus infers whether a cache in front of the server answered the
+// request, from the headers CDNs and proxies commonly add. It returns "hit",
+// "miss" or "" when there is no telling.
+func cacheStatus(h http.Header) string {
+	for _, name := range []string{"X-Cache", "CF-Cache-Status", "X-Cache-Status", "X-Proxy-Cache", "Cache-Status"} {
+		v := strings.ToUpper(h.Get(name))
+		switch {
+		case v == "":
+		case strings.Contains(v, "HIT"):
+			return "hit"
+		case strings.Contains(v, "MISS"), strings.Contains(v, "EXPIRED"), strings.Contains(v, "BYPASS"):
+			return "miss"
+		}
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		return "hit"
+	}
+	return ""
+}
+
+// cacheCounts are the cache statistics of one host.
+type cacheCounts struct {
+	responses                 int64
+	shared, private, none     int64
+	hits, misses, revalidated int64
+	redundant                 int64
+}
+
+// Cache reports per host how cacheable responses were, how often a cache
+// answered, and how many bytes were downloaded again unchanged, which a
+// cache could have saved.
+type Cache struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	hosts map[string]*cacheCounts
+	// versions holds the validator, or else the size, of the last body
+	// downloaded from each URL.
+	versions map[string]string
+}
+
+func NewCache(w io.Writer) *Cache {
+	return &Cache{w: w, hosts: make(map[string]*cacheCounts), versions: make(map[string]string)}
+}
+
+func (c *Cache) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil {
+		return
+	}
+	host, _ := hostPath(resp.Request)
+	class := cacheability(resp)
+	status := cacheStatus(resp.Header)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[host]
+	if !ok {
+		h = &cacheCounts{}
+		c.hosts[host] = h
+	}
+	h.responses++
+	switch class {
+	case cacheShared:
+		h.shared++
+	case cachePrivate:
+		h.private++
+	default:
+		h.none++
+	}
+	switch status {
+	case "hit":
+		h.hits++
+	case "miss":
+		h.misses++
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		h.revalidated++
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.BodySize == 0 {
+		return
+	}
+	version := resp.Header.Get("ETag")
+	if version == "" {
+		version = strconv.FormatInt(resp.BodySize, 10)
+	}
+	if c.versions[resp.Request.URL] == version {
+		h.redundant += resp.BodySize
+	}
+	c.versions[resp.Request.URL] = version
+}
+
+func (c *Cache) HandleStats(analyzer.StatsSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.hosts) == 0 {
+		return
+	}
+	responses := make(counter, len(c.hosts))
+	for host, h := range c.hosts {
+		responses[host] = h.responses
+	}
+	fmt.Fprintf(c.w, "\n=== Cache Efficiency ===\n")
+	t := newTable(c.w)
+	fmt.Fprintln(t, "HOST\tRESPONSES\tCACHEABLE\tPRIVATE\tUNCACHEABLE\tHITS\tMISSES\tHIT RATIO\tNOT MODIFIED\tREDUNDANT")
+	for _, e := range responses.top(0) {
+		h := c.hosts[e.key]
+		ratio := "-"
+		if h.hits+h.misses > 0 {
+			ratio = fmt.Sprintf("%.1f%%", 100*float64(h.hits)/float64(h.hits+h.misses))
+		}
+		fmt.Fprintf(t, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%d\t%s\n", e.key, h.responses, h.shared, h.private, h.none,
+			h.hits, h.misses, ratio, h.revalidated, formatBytes(h.redundant))
+	}
+	t.Flush()
+}
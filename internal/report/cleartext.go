@@ -0,0 +1,269 @@
+package report
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// passwordField and tokenField match the names of query, form and JSON
+// fields that hold credentials.
+var (
+	passwordField = regexp.MustCompile(`(?i)^(?:.*[_-])?(?:password|passwd|passwort|pwd|pass|passphrase|pin)$`)
+	tokenField    = regexp.MustCompile(`(?i)^(?:access_?token|refresh_?token|id_?token|auth_?token|token|api_?key|apikey|client_?secret|secret|session_?id|sid)$`)
+	userField     = regexp.MustCompile(`(?i)^(?:user|username|user_?name|login|email|e-mail|account|uid|userid|user_id)$`)
+)
+
+// tokenHeaders carry API keys and tokens outside Authorization.
+var tokenHeaders = []string{"X-Api-Key", "Api-Key", "X-Auth-Token", "X-Access-Token", "X-Amz-Security-Token", "Private-Token"}
+
+// cleartextKey is one kind of credential sent to one service.
+type cleartextKey struct {
+	service, kind string
+}
+
+type cleartextFinding struct {
+	cleartextKey
+	server      string
+	requests    int64
+	clients     map[string]bool
+	users       map[string]bool
+	first, last time.Time
+	example     string
+}
+
+// Cleartext reports credentials sent over unencrypted HTTP: Basic and
+// bearer authorization, passwords in forms, JSON bodies and query strings,
+// and API keys and tokens. Each kind of credential is listed once per
+// service with how often it was sent and by how many clients and accounts.
+// Credential values are never printed.
+type Cleartext struct {
+	base
+	w io.Writer
+
+	mu       sync.Mutex
+	findings map[cleartextKey]*cleartextFinding
+	services map[string]bool
+
+	// Notify, if set, receives each kind of credential the first time it
+	// is sent to a service.
+	Notify FindingFunc
+}
+
+func NewCleartext(w io.Writer) *Cleartext {
+	return &Cleartext{w: w, findings: make(map[cleartextKey]*cleartextFinding), services: make(map[string]bool)}
+}
+
+// credential is one credential found in a request.
+type credential struct {
+	kind, user, where string
+}
+
+func (c *Cleartext) HandleRequest(req *httpstream.Request) {
+	creds := requestCredentials(req)
+	service := serviceName(req)
+	example := req.Method + " " + truncate(withoutQuery(req.URL), 60)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.services[service] = true
+	for _, cred := range creds {
+		key := cleartextKey{service, cred.kind}
+		f, ok := c.findings[key]
+		if !ok {
+			f = &cleartextFinding{
+				cleartextKey: key,
+				server:       net.JoinHostPort(req.DstIP, req.DstPort),
+				clients:      make(map[string]bool),
+				users:        make(map[string]bool),
+				first:        req.Timestamp,
+				example:      example + " " + cred.where,
+			}
+			c.findings[key] = f
+			if c.Notify != nil {
+				c.Notify(Finding{
+					Kind:    "cleartext",
+					Time:    req.Timestamp,
+					Key:     service + " " + cred.kind,
+					Summary: fmt.Sprintf("%s sent over unencrypted HTTP to %s", cred.kind, service),
+					Detail:  fmt.Sprintf("%s from %s to %s", f.example, req.SrcIP, f.server),
+				})
+			}
+		}
+		f.requests++
+		f.clients[req.SrcIP] = true
+		if cred.user != "" {
+			f.users[cred.user] = true
+		}
+		if req.Timestamp.Before(f.first) {
+			f.first = req.Timestamp
+			f.example = example + " " + cred.where
+		}
+		if req.Timestamp.After(f.last) {
+			f.last = req.Timestamp
+		}
+	}
+}
+
+// serviceName names the service a request was sent to by its host and,
+// unless it is 80, its port.
+func serviceName(req *httpstream.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.DstIP
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil && req.DstPort != "80" {
+		host = net.JoinHostPort(host, req.DstPort)
+	}
+	return strings.ToLower(host)
+}
+
+// withoutQuery drops the query string, which may hold the credentials.
+func withoutQuery(u string) string {
+	u, _, _ = strings.Cut(u, "?")
+	return u
+}
+
+// requestCredentials finds the credentials in a request's headers, query
+// string and body.
+func requestCredentials(req *httpstream.Request) []credential {
+	var creds []credential
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		if v := req.Header.Get(name); v != "" {
+			if c, ok := authCredential(v); ok {
+				c.where = "header " + name
+				creds = append(creds, c)
+			}
+		}
+	}
+	for _, name := range tokenHeaders {
+		if req.Header.Get(name) != "" {
+			creds = append(creds, credential{kind: "API key header", where: "header " + name})
+		}
+	}
+
+	if u, err := url.ParseRequestURI(req.URI); err == nil {
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				creds = append(creds, credential{kind: "URL password", user: u.User.Username(), where: "in URL"})
+			}
+		}
+		creds = append(creds, fieldCredentials(u.Query(), "query")...)
+	}
+
+	body, _, err := req.DecodedBody()
+	if err != nil || len(body) == 0 {
+		return creds
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			creds = append(creds, fieldCredentials(values, "form")...)
+		}
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) == nil {
+			values := make(url.Values)
+			for name, v := range fields {
+				if s, ok := v.(string); ok {
+					values.Set(name, s)
+				}
+			}
+			creds = append(creds, fieldCredentials(values, "JSON")...)
+		}
+	}
+	return creds
+}
+
+// authCredential classifies an Authorization header. Schemes that don't
+// send a reusable secret, such as Digest and Negotiate, aren't credentials
+// here.
+func authCredential(v string) (credential, bool) {
+	scheme, param, _ := strings.Cut(strings.TrimSpace(v), " ")
+	param = strings.TrimSpace(param)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		c := credential{kind: "Basic auth"}
+		if decoded, err := base64.StdEncoding.DecodeString(param); err == nil {
+			c.user, _, _ = strings.Cut(string(decoded), ":")
+		}
+		return c, true
+	case "bearer":
+		return credential{kind: "bearer token"}, true
+	case "digest", "negotiate", "ntlm", "kerberos", "":
+		return credential{}, false
+	default:
+		return credential{kind: scheme + " auth"}, true
+	}
+}
+
+// fieldCredentials finds password and token fields among values, with the
+// account they belong to when a user field is alongside.
+func fieldCredentials(values url.Values, where string) []credential {
+	user := ""
+	for name := range values {
+		if userField.MatchString(name) {
+			user = values.Get(name)
+		}
+	}
+	var creds []credential
+	for name := range values {
+		if values.Get(name) == "" {
+			continue
+		}
+		switch {
+		case passwordField.MatchString(name):
+			creds = append(creds, credential{kind: where + " password", user: user, where: where + " field " + name})
+		case tokenField.MatchString(name):
+			creds = append(creds, credential{kind: where + " token", where: where + " field " + name})
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].where < creds[j].where })
+	return creds
+}
+
+func (c *Cleartext) HandleStats(analyzer.StatsSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "\n=== Cleartext Credentials ===\n")
+	if len(c.findings) == 0 {
+		fmt.Fprintln(c.w, "No credentials sent over unencrypted HTTP")
+		return
+	}
+	findings := make([]*cleartextFinding, 0, len(c.findings))
+	exposed := make(map[string]bool)
+	for _, f := range c.findings {
+		findings = append(findings, f)
+		exposed[f.service] = true
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].service != findings[j].service {
+			return findings[i].service < findings[j].service
+		}
+		return findings[i].kind < findings[j].kind
+	})
+	fmt.Fprintf(c.w, "FINDING: credentials sent in cleartext to %d of %d HTTP services\n", len(exposed), len(c.services))
+	t := newTable(c.w)
+	fmt.Fprintln(t, "SERVICE\tSERVER\tCREDENTIAL\tREQUESTS\tCLIENTS\tACCOUNTS\tFIRST SEEN\tLAST SEEN\tFIRST REQUEST")
+	for _, f := range findings {
+		accounts := "-"
+		if len(f.users) > 0 {
+			accounts = fmt.Sprint(len(f.users))
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", f.service, f.server, f.kind, f.requests, len(f.clients), accounts,
+			f.first.Format(time.RFC3339), f.last.Format(time.RFC3339), f.example)
+	}
+	t.Flush()
+}
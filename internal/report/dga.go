@@ -0,0 +1,181 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dga"
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// queriedName is one DNS name and its score.
+type queriedName struct {
+	score    dga.Score
+	scored   bool
+	queries  int64
+	nxdomain int64
+	clients  map[string]bool
+	first    time.Time
+}
+
+func (q *queriedName) generated() bool {
+	return q.scored && q.score.Value >= dga.Threshold
+}
+
+// dgaClient is the DNS activity of one client.
+type dgaClient struct {
+	queries  int64
+	nxdomain int64
+	names    map[string]bool
+	// firstGenerated is when the client first looked up a generated name.
+	firstGenerated time.Time
+}
+
+// DGA reports DNS names that look algorithmically generated, going by how
+// unlike words their characters are, and the clients that looked them up.
+// Malware generating names to find its servers typically queries many of
+// them, most answered with NXDOMAIN.
+type DGA struct {
+	base
+	w io.Writer
+	n int
+
+	mu      sync.Mutex
+	names   map[string]*queriedName
+	clients map[string]*dgaClient
+}
+
+// NewDGA returns a report listing up to n names.
+func NewDGA(w io.Writer, n int) *DGA {
+	return &DGA{
+		w:       w,
+		n:       n,
+		names:   make(map[string]*queriedName),
+		clients: make(map[string]*dgaClient),
+	}
+}
+
+func (d *DGA) HandleDNS(msg *dns.Message) {
+	name := strings.TrimSuffix(strings.ToLower(msg.Question), ".")
+	if name == "" {
+		return
+	}
+	client := msg.SrcIP
+	if msg.Response {
+		client = msg.DstIP
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.names[name]
+	if !ok {
+		q = &queriedName{clients: make(map[string]bool), first: msg.Timestamp}
+		q.score, q.scored = dga.Analyze(name)
+		d.names[name] = q
+	}
+	c, ok := d.clients[client]
+	if !ok {
+		c = &dgaClient{names: make(map[string]bool)}
+		d.clients[client] = c
+	}
+	q.clients[client] = true
+	c.names[name] = true
+	if q.generated() && (c.firstGenerated.IsZero() || msg.Timestamp.Before(c.firstGenerated)) {
+		c.firstGenerated = msg.Timestamp
+	}
+	switch {
+	case !msg.Response:
+		q.queries++
+		c.queries++
+	case msg.Rcode == "NXDOMAIN":
+		q.nxdomain++
+		c.nxdomain++
+	}
+}
+
+func (d *DGA) HandleStats(analyzer.StatsSnapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "\n=== DGA Domains ===\n")
+
+	var scored int
+	var generated []string
+	for name, q := range d.names {
+		if q.scored {
+			scored++
+		}
+		if q.generated() {
+			generated = append(generated, name)
+		}
+	}
+	if len(generated) == 0 {
+		fmt.Fprintf(d.w, "None of %d names queried look algorithmically generated (%d long enough to judge)\n", len(d.names), scored)
+		return
+	}
+	fmt.Fprintf(d.w, "%d of %d names queried look algorithmically generated (score >= %.2f; %d long enough to judge)\n",
+		len(generated), len(d.names), dga.Threshold, scored)
+
+	// Clients that looked up generated names, most first
+	type clientRow struct {
+		ip        string
+		generated []string
+	}
+	var rows []*clientRow
+	for ip, c := range d.clients {
+		r := &clientRow{ip: ip}
+		for name := range c.names {
+			if !d.names[name].generated() {
+				continue
+			}
+			r.generated = append(r.generated, name)
+		}
+		if len(r.generated) > 0 {
+			sort.Strings(r.generated)
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if len(rows[i].generated) != len(rows[j].generated) {
+			return len(rows[i].generated) > len(rows[j].generated)
+		}
+		return rows[i].ip < rows[j].ip
+	})
+	t := newTable(d.w)
+	fmt.Fprintln(t, "CLIENT\tQUERIES\tNAMES\tGENERATED\tNXDOMAIN\tFIRST GENERATED\tEXAMPLES")
+	for _, r := range rows {
+		c := d.clients[r.ip]
+		examples := r.generated
+		if len(examples) > 3 {
+			examples = examples[:3]
+		}
+		fmt.Fprintf(t, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", r.ip, c.queries, len(c.names), len(r.generated), c.nxdomain,
+			c.firstGenerated.Format(time.RFC3339), strings.Join(examples, ", "))
+	}
+	t.Flush()
+
+	sort.Slice(generated, func(i, j int) bool {
+		a, b := d.names[generated[i]], d.names[generated[j]]
+		if a.score.Value != b.score.Value {
+			return a.score.Value > b.score.Value
+		}
+		return generated[i] < generated[j]
+	})
+	if len(generated) > d.n {
+		fmt.Fprintf(d.w, "\nTop %d of %d generated names:\n", d.n, len(generated))
+		generated = generated[:d.n]
+	} else {
+		fmt.Fprintln(d.w, "\nGenerated names:")
+	}
+	t = newTable(d.w)
+	fmt.Fprintln(t, "NAME\tSCORE\tENTROPY\tBIGRAM\tQUERIES\tNXDOMAIN\tCLIENTS\tFIRST SEEN")
+	for _, name := range generated {
+		q := d.names[name]
+		fmt.Fprintf(t, "%s\t%.2f\t%.2f\t%.2f\t%d\t%d\t%d\t%s\n", name, q.score.Value, q.score.Entropy, q.score.Bigram,
+			q.queries, q.nxdomain, len(q.clients), q.first.Format(time.RFC3339))
+	}
+	t.Flush()
+}
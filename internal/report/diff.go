@@ -0,0 +1,115 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Latency changes smaller than either bound are noise, not regressions.
+const (
+	latencyChangeRatio = 1.2
+	latencyChangeMin   = time.Millisecond
+)
+
+// WriteDiff prints what changed from profile a to profile b: hosts,
+// servers and endpoints that appeared or disappeared, the shift in status
+// classes, and response time changes on endpoints both share.
+func WriteDiff(w io.Writer, a, b *Profile) {
+	fmt.Fprintf(w, "--- %s (%d requests, %s)\n", a.Capture, a.Requests, a.End.Sub(a.Start).Round(time.Millisecond))
+	fmt.Fprintf(w, "+++ %s (%d requests, %s)\n", b.Capture, b.Requests, b.End.Sub(b.Start).Round(time.Millisecond))
+
+	writeSetDiff(w, "Hosts", "requests", a.Hosts, b.Hosts)
+	writeSetDiff(w, "Servers", "connection attempts", a.Servers, b.Servers)
+	writeSetDiff(w, "Endpoints", "requests", endpointCounts(a), endpointCounts(b))
+
+	fmt.Fprintf(w, "\n=== Status Classes ===\n")
+	t := newTable(w)
+	fmt.Fprintln(t, "STATUS\tBEFORE\tAFTER\tSHARE BEFORE\tSHARE AFTER")
+	for _, class := range unionKeys(a.Statuses, b.Statuses) {
+		fmt.Fprintf(t, "%s\t%d\t%d\t%s\t%s\n", class, a.Statuses[class], b.Statuses[class],
+			share(a.Statuses[class], a.Requests), share(b.Statuses[class], b.Requests))
+	}
+	fmt.Fprintf(t, "no response\t%d\t%d\t%s\t%s\n", a.Unanswered, b.Unanswered,
+		share(a.Unanswered, a.Requests), share(b.Unanswered, b.Requests))
+	t.Flush()
+
+	fmt.Fprintf(w, "\n=== Response Times ===\n")
+	t = newTable(w)
+	fmt.Fprintln(t, "ENDPOINT\tP50 BEFORE\tP50 AFTER\tP95 BEFORE\tP95 AFTER\tCHANGE")
+	for _, key := range unionKeys(endpointCounts(a), endpointCounts(b)) {
+		ea, eb := a.Endpoints[key], b.Endpoints[key]
+		if ea == nil || eb == nil || ea.P50 == 0 || eb.P50 == 0 {
+			continue
+		}
+		note := ""
+		switch {
+		case slower(ea.P50, eb.P50) || slower(ea.P95, eb.P95):
+			note = "slower"
+		case slower(eb.P50, ea.P50) && slower(eb.P95, ea.P95):
+			note = "faster"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\n", key, formatDuration(ea.P50), formatDuration(eb.P50),
+			formatDuration(ea.P95), formatDuration(eb.P95), note)
+	}
+	t.Flush()
+}
+
+// slower reports whether after is a meaningful increase over before.
+func slower(before, after time.Duration) bool {
+	return after-before >= latencyChangeMin && float64(after) >= float64(before)*latencyChangeRatio
+}
+
+// writeSetDiff lists the keys only one side has, with their counts.
+func writeSetDiff(w io.Writer, title, unit string, a, b map[string]int64) {
+	var lines []string
+	for _, k := range unionKeys(a, b) {
+		_, inA := a[k]
+		_, inB := b[k]
+		switch {
+		case !inB:
+			lines = append(lines, fmt.Sprintf("- %s (%d %s)", k, a[k], unit))
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+ %s (%d %s)", k, b[k], unit))
+		}
+	}
+	fmt.Fprintf(w, "\n=== %s ===\n", title)
+	if len(lines) == 0 {
+		fmt.Fprintf(w, "no change (%d)\n", len(a))
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func endpointCounts(p *Profile) map[string]int64 {
+	counts := make(map[string]int64, len(p.Endpoints))
+	for key, e := range p.Endpoints {
+		counts[key] = e.Requests
+	}
+	return counts
+}
+
+// unionKeys returns the keys of a and b, sorted.
+func unionKeys(a, b map[string]int64) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func share(n, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,198 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// resolution is a name an address was last resolved from, and when.
+type resolution struct {
+	name string
+	time time.Time
+}
+
+// resolvedName is what the correlation keeps of one DNS name.
+type resolvedName struct {
+	first     time.Time
+	addresses map[string]struct{}
+	// gaps holds the time from resolution to each connection made to one
+	// of the name's addresses.
+	gaps samples
+}
+
+// directContact is an address connected to without a DNS answer for it.
+type directContact struct {
+	first       time.Time
+	connections int64
+}
+
+// DNSCorrelation cross-references DNS answers with the TCP connections that
+// follow: names resolved but never connected to, addresses connected to
+// without having been resolved, which often means a hardcoded address, and
+// how long after resolution connections were made. Both DNS messages and
+// packets arrive in capture order, so each connection is matched against
+// the answers seen before it.
+type DNSCorrelation struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	byAddress map[string]resolution
+	names     map[string]*resolvedName
+	direct    map[string]*directContact
+	// syns holds the connections seen, so retransmitted SYNs aren't
+	// counted again.
+	syns map[string]struct{}
+}
+
+func NewDNSCorrelation(w io.Writer) *DNSCorrelation {
+	return &DNSCorrelation{
+		w:         w,
+		byAddress: make(map[string]resolution),
+		names:     make(map[string]*resolvedName),
+		direct:    make(map[string]*directContact),
+		syns:      make(map[string]struct{}),
+	}
+}
+
+func (c *DNSCorrelation) HandleDNS(msg *dns.Message) {
+	if !msg.Response {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rr := range msg.Answers {
+		if rr.Type != "A" && rr.Type != "AAAA" {
+			continue
+		}
+		name := strings.TrimSuffix(rr.Name, ".")
+		n, ok := c.names[name]
+		if !ok {
+			n = &resolvedName{first: msg.Timestamp, addresses: make(map[string]struct{})}
+			c.names[name] = n
+		}
+		n.addresses[rr.Value] = struct{}{}
+		c.byAddress[rr.Value] = resolution{name, msg.Timestamp}
+	}
+}
+
+func (c *DNSCorrelation) HandlePacket(p *analyzer.Packet) {
+	if p.TCP == nil || !p.TCP.SYN || p.TCP.ACK {
+		return
+	}
+	dst := p.Network.Dst().String()
+	ts := p.CaptureInfo.Timestamp
+	key := p.Network.String() + " " + p.Transport.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.syns[key]; ok {
+		return
+	}
+	c.syns[key] = struct{}{}
+	if r, ok := c.byAddress[dst]; ok {
+		n := c.names[r.name]
+		n.gaps.add(ts.Sub(r.time))
+		return
+	}
+	d, ok := c.direct[dst]
+	if !ok {
+		d = &directContact{first: ts}
+		c.direct[dst] = d
+	}
+	d.connections++
+}
+
+func (c *DNSCorrelation) HandleStats(analyzer.StatsSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var unused, used []string
+	for name, n := range c.names {
+		if n.gaps.count == 0 {
+			unused = append(unused, name)
+		} else {
+			used = append(used, name)
+		}
+	}
+	sort.Strings(unused)
+	sort.Strings(used)
+
+	fmt.Fprintf(c.w, "\n=== Resolved but Never Contacted ===\n")
+	if len(unused) == 0 {
+		fmt.Fprintln(c.w, "None")
+	} else {
+		t := newTable(c.w)
+		fmt.Fprintln(t, "NAME\tRESOLVED\tADDRESSES")
+		for _, name := range unused {
+			n := c.names[name]
+			fmt.Fprintf(t, "%s\t%s\t%s\n", name, n.first.Format(time.RFC3339), strings.Join(sortedKeys(n.addresses), ", "))
+		}
+		t.Flush()
+	}
+
+	fmt.Fprintf(c.w, "\n=== Contacted without DNS ===\n")
+	if len(c.direct) == 0 {
+		fmt.Fprintln(c.w, "None")
+	} else {
+		// Public addresses first; private ones are usually expected
+		addrs := make([]string, 0, len(c.direct))
+		for addr := range c.direct {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			pi, pj := isPrivate(addrs[i]), isPrivate(addrs[j])
+			if pi != pj {
+				return pj
+			}
+			return c.direct[addrs[i]].first.Before(c.direct[addrs[j]].first)
+		})
+		t := newTable(c.w)
+		fmt.Fprintln(t, "ADDRESS\tSCOPE\tCONNECTIONS\tFIRST")
+		for _, addr := range addrs {
+			d := c.direct[addr]
+			scope := "public"
+			if isPrivate(addr) {
+				scope = "private"
+			}
+			fmt.Fprintf(t, "%s\t%s\t%d\t%s\n", addr, scope, d.connections, d.first.Format(time.RFC3339))
+		}
+		t.Flush()
+	}
+
+	if len(used) == 0 {
+		return
+	}
+	fmt.Fprintf(c.w, "\n=== Resolution to Connection ===\n")
+	t := newTable(c.w)
+	fmt.Fprintln(t, "NAME\tCONNECTIONS\tMIN GAP\tMEDIAN GAP\tMAX GAP")
+	for _, name := range used {
+		gaps := &c.names[name].gaps
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\n", name, gaps.count, formatDuration(gaps.min),
+			formatDuration(gaps.percentile(50)), formatDuration(gaps.max))
+	}
+	t.Flush()
+}
+
+// isPrivate reports whether addr is private, loopback, link-local or
+// multicast, where connecting without DNS is routine.
+func isPrivate(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast())
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
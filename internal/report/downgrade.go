@@ -0,0 +1,259 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/fingerprint"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// plainHost is the plain HTTP traffic to one host.
+type plainHost struct {
+	requests, upgraded int64
+	clients            map[string]bool
+	first              time.Time
+	example            string
+}
+
+type insecureRedirect struct {
+	status   int
+	from, to string
+	count    int64
+	first    time.Time
+}
+
+// tlsConn is what the ClientHello of a connection said.
+type tlsConn struct {
+	client, server, sni string
+	offered             uint16
+}
+
+type weakKey struct {
+	client, server, sni, side string
+	version                   uint16
+}
+
+type weakHandshake struct {
+	weakKey
+	count int64
+	first time.Time
+}
+
+// Downgrade reports signs of SSL stripping and TLS downgrades: plain HTTP
+// requests to hosts that clients reach over HTTPS elsewhere in the capture,
+// redirects to http:// URLs, and TLS handshakes offering or negotiating a
+// version below a floor.
+type Downgrade struct {
+	base
+	w     io.Writer
+	floor uint16
+
+	mu         sync.Mutex
+	tls        *fingerprint.Hellos
+	httpsHosts map[string]bool
+	conns      map[string]*tlsConn
+	handshakes int64
+	weak       map[weakKey]*weakHandshake
+	plain      map[string]*plainHost
+	redirects  map[[2]string]*insecureRedirect
+}
+
+// NewDowngrade returns a report flagging handshakes below floor, such as
+// 0x0303 for TLS 1.2.
+func NewDowngrade(w io.Writer, floor uint16) *Downgrade {
+	return &Downgrade{
+		w:          w,
+		floor:      floor,
+		tls:        fingerprint.NewHellos(),
+		httpsHosts: make(map[string]bool),
+		conns:      make(map[string]*tlsConn),
+		weak:       make(map[weakKey]*weakHandshake),
+		plain:      make(map[string]*plainHost),
+		redirects:  make(map[[2]string]*insecureRedirect),
+	}
+}
+
+// hostOf normalizes a Host header or URL host for comparison with TLS
+// server names.
+func hostOf(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (d *Downgrade) HandleRequest(req *httpstream.Request) {
+	if req.Host == "" {
+		return
+	}
+	host := hostOf(req.Host)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.plain[host]
+	if !ok {
+		h = &plainHost{clients: make(map[string]bool), first: req.Timestamp, example: req.Method + " " + truncate(withoutQuery(req.URL), 60)}
+		d.plain[host] = h
+	}
+	h.requests++
+	h.clients[req.SrcIP] = true
+	if req.Timestamp.Before(h.first) {
+		h.first, h.example = req.Timestamp, req.Method+" "+truncate(withoutQuery(req.URL), 60)
+	}
+}
+
+func (d *Downgrade) HandleResponse(resp *httpstream.Response) {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 || resp.Request == nil {
+		return
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !loc.IsAbs() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch strings.ToLower(loc.Scheme) {
+	case "https":
+		if h, ok := d.plain[hostOf(resp.Request.Host)]; ok {
+			h.upgraded++
+		}
+	case "http":
+		key := [2]string{withoutQuery(resp.Request.URL), withoutQuery(loc.String())}
+		r, ok := d.redirects[key]
+		if !ok {
+			r = &insecureRedirect{status: resp.StatusCode, from: key[0], to: key[1], first: resp.Timestamp}
+			d.redirects[key] = r
+		}
+		r.count++
+		if resp.Timestamp.Before(r.first) {
+			r.first = resp.Timestamp
+		}
+	}
+}
+
+func (d *Downgrade) HandlePacket(p *analyzer.Packet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	client, server := d.tls.Packet(p)
+	key := stream.FlowKey(p.Network, p.Transport)
+	switch {
+	case client != nil:
+		c := &tlsConn{
+			client:  p.Network.Src().String(),
+			server:  p.Network.Dst().String() + ":" + p.Transport.Dst().String(),
+			sni:     hostOf(client.SNI),
+			offered: client.MaxVersion(),
+		}
+		d.conns[key] = c
+		if c.sni != "" {
+			d.httpsHosts[c.sni] = true
+		}
+		if c.offered < d.floor {
+			d.addWeak(c, "offered", c.offered, p.CaptureInfo.Timestamp)
+		}
+	case server != nil:
+		d.handshakes++
+		c, ok := d.conns[key]
+		if !ok {
+			// The ClientHello wasn't captured
+			c = &tlsConn{
+				client: p.Network.Dst().String(),
+				server: p.Network.Src().String() + ":" + p.Transport.Src().String(),
+			}
+		}
+		delete(d.conns, key)
+		if server.Version < d.floor && !(ok && c.offered < d.floor) {
+			d.addWeak(c, "negotiated", server.Version, p.CaptureInfo.Timestamp)
+		}
+	}
+}
+
+func (d *Downgrade) addWeak(c *tlsConn, side string, version uint16, ts time.Time) {
+	k := weakKey{c.client, c.server, c.sni, side, version}
+	w, ok := d.weak[k]
+	if !ok {
+		w = &weakHandshake{weakKey: k, first: ts}
+		d.weak[k] = w
+	}
+	w.count++
+}
+
+func (d *Downgrade) HandleStats(analyzer.StatsSnapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "\n=== TLS Downgrade and Stripping ===\n")
+
+	var stripped []string
+	for host, h := range d.plain {
+		if d.httpsHosts[host] && h.requests > h.upgraded {
+			stripped = append(stripped, host)
+		}
+	}
+	sort.Slice(stripped, func(i, j int) bool { return d.plain[stripped[i]].first.Before(d.plain[stripped[j]].first) })
+	if len(stripped) == 0 {
+		fmt.Fprintln(d.w, "No plain HTTP to hosts that use HTTPS")
+	} else {
+		fmt.Fprintln(d.w, "Plain HTTP to hosts that use HTTPS:")
+		t := newTable(d.w)
+		fmt.Fprintln(t, "HOST\tHTTP REQUESTS\tREDIRECTED TO HTTPS\tCLIENTS\tFIRST SEEN\tFIRST REQUEST")
+		for _, host := range stripped {
+			h := d.plain[host]
+			fmt.Fprintf(t, "%s\t%d\t%d\t%d\t%s\t%s\n", host, h.requests, h.upgraded, len(h.clients), h.first.Format(time.RFC3339), h.example)
+		}
+		t.Flush()
+	}
+
+	fmt.Fprintln(d.w)
+	if len(d.redirects) == 0 {
+		fmt.Fprintln(d.w, "No redirects to http://")
+	} else {
+		redirects := make([]*insecureRedirect, 0, len(d.redirects))
+		for _, r := range d.redirects {
+			redirects = append(redirects, r)
+		}
+		sort.Slice(redirects, func(i, j int) bool { return redirects[i].first.Before(redirects[j].first) })
+		fmt.Fprintln(d.w, "Redirects to http://:")
+		t := newTable(d.w)
+		fmt.Fprintln(t, "FIRST SEEN\tSTATUS\tFROM\tTO\tCOUNT\tTARGET USES HTTPS")
+		for _, r := range redirects {
+			usesHTTPS := "no"
+			if u, err := url.Parse(r.to); err == nil && d.httpsHosts[hostOf(u.Host)] {
+				usesHTTPS = "yes"
+			}
+			fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%d\t%s\n", r.first.Format(time.RFC3339), r.status, r.from, r.to, r.count, usesHTTPS)
+		}
+		t.Flush()
+	}
+
+	fmt.Fprintln(d.w)
+	floor := fingerprint.VersionName(d.floor)
+	if len(d.weak) == 0 {
+		fmt.Fprintf(d.w, "No TLS handshakes below %s (%d seen)\n", floor, d.handshakes)
+		return
+	}
+	weak := make([]*weakHandshake, 0, len(d.weak))
+	for _, w := range d.weak {
+		weak = append(weak, w)
+	}
+	sort.Slice(weak, func(i, j int) bool { return weak[i].first.Before(weak[j].first) })
+	fmt.Fprintf(d.w, "TLS handshakes below %s (%d seen):\n", floor, d.handshakes)
+	t := newTable(d.w)
+	fmt.Fprintln(t, "FIRST SEEN\tCLIENT\tSERVER\tSNI\tVERSION\tCOUNT")
+	for _, w := range weak {
+		sni := w.sni
+		if sni == "" {
+			sni = "-"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s %s\t%d\n", w.first.Format(time.RFC3339), w.client, w.server, sni,
+			fingerprint.VersionName(w.version), w.side, w.count)
+	}
+	t.Flush()
+}
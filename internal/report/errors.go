@@ -0,0 +1,234 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/asn"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// errorCounts are the failures seen for one host, overall or in one time
+// bucket.
+type errorCounts struct {
+	requests, answered         int64
+	clientErrors, serverErrors int64
+	resets, timeouts           int64
+}
+
+func (c *errorCounts) failures() int64 {
+	return c.clientErrors + c.serverErrors + c.resets + c.timeouts
+}
+
+// bucketKey identifies a host's counts in one time bucket.
+type bucketKey struct {
+	start time.Time
+	host  string
+}
+
+// connection is what the error report keeps of a TCP connection.
+type connection struct {
+	// host is the Host of the connection's first request, or the server's
+	// address without one.
+	host     string
+	syn      time.Time
+	answered bool
+	reset    time.Time
+}
+
+// Errors reports failure rates per destination host, overall and in time
+// buckets: 4xx and 5xx responses, connections reset, and timeouts, which are
+// requests that got no response and connection attempts that got no
+// SYN/ACK.
+type Errors struct {
+	base
+	w        io.Writer
+	interval time.Duration
+	mu       sync.Mutex
+
+	buckets     map[bucketKey]*errorCounts
+	connections map[string]*connection
+
+	// ASN, if set, labels hosts given by address with their network.
+	ASN *asn.DB
+}
+
+// NewErrors returns a report bucketing failures by interval.
+func NewErrors(w io.Writer, interval time.Duration) *Errors {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Errors{
+		w:           w,
+		interval:    interval,
+		buckets:     make(map[bucketKey]*errorCounts),
+		connections: make(map[string]*connection),
+	}
+}
+
+func (e *Errors) HandlePacket(p *analyzer.Packet) {
+	tcp := p.TCP
+	if tcp == nil || !(tcp.SYN || tcp.RST) {
+		return
+	}
+	src, dst := p.Network.Src().String(), p.Network.Dst().String()
+	key := connectionKey(src, p.Transport.Src().String(), dst, p.Transport.Dst().String())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c := e.connections[key]
+	if c == nil {
+		// Without a handshake, guess the server has the lower port
+		c = &connection{host: dst}
+		if tcp.SYN && tcp.ACK || !tcp.SYN && p.Transport.Src().LessThan(p.Transport.Dst()) {
+			c.host = src
+		}
+		e.connections[key] = c
+	}
+	switch {
+	case tcp.RST:
+		if c.reset.IsZero() {
+			c.reset = p.CaptureInfo.Timestamp
+		}
+	case tcp.ACK:
+		c.answered = true
+	case c.syn.IsZero():
+		c.syn = p.CaptureInfo.Timestamp
+	}
+}
+
+func (e *Errors) HandleRequest(req *httpstream.Request) {
+	host, _ := hostPath(req)
+	key := connectionKey(req.SrcIP, req.SrcPort, req.DstIP, req.DstPort)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bucket(req.Timestamp, host).requests++
+	// Attribute the connection's resets to the host it was used for
+	if c := e.connections[key]; c != nil && c.host == req.DstIP {
+		c.host = host
+	}
+}
+
+func (e *Errors) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil {
+		return
+	}
+	host, _ := hostPath(resp.Request)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Count against the request's bucket so unanswered requests add up
+	c := e.bucket(resp.Request.Timestamp, host)
+	c.answered++
+	switch {
+	case resp.StatusCode >= 500:
+		c.serverErrors++
+	case resp.StatusCode >= 400:
+		c.clientErrors++
+	}
+}
+
+func (e *Errors) bucket(ts time.Time, host string) *errorCounts {
+	key := bucketKey{ts.Truncate(e.interval), host}
+	c, ok := e.buckets[key]
+	if !ok {
+		c = &errorCounts{}
+		e.buckets[key] = c
+	}
+	return c
+}
+
+// connectionKey identifies a connection whichever direction its endpoints
+// are given in.
+func connectionKey(srcIP, srcPort, dstIP, dstPort string) string {
+	a, b := srcIP+":"+srcPort, dstIP+":"+dstPort
+	if b < a {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+func (e *Errors) HandleStats(analyzer.StatsSnapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, c := range e.connections {
+		if !c.reset.IsZero() {
+			e.bucket(c.reset, c.host).resets++
+		}
+		if !c.syn.IsZero() && !c.answered && c.reset.IsZero() {
+			e.bucket(c.syn, c.host).timeouts++
+		}
+	}
+	for _, c := range e.buckets {
+		c.timeouts += c.requests - c.answered
+	}
+
+	hosts := make(map[string]*errorCounts)
+	for key, c := range e.buckets {
+		h, ok := hosts[key.host]
+		if !ok {
+			h = &errorCounts{}
+			hosts[key.host] = h
+		}
+		h.requests += c.requests
+		h.answered += c.answered
+		h.clientErrors += c.clientErrors
+		h.serverErrors += c.serverErrors
+		h.resets += c.resets
+		h.timeouts += c.timeouts
+	}
+	if len(hosts) == 0 {
+		return
+	}
+
+	// Most failures first
+	failures := make(counter, len(hosts))
+	for host, c := range hosts {
+		failures[host] = c.failures()
+	}
+	fmt.Fprintf(e.w, "\n=== Errors by Host ===\n")
+	t := newTable(e.w)
+	fmt.Fprintln(t, "HOST\tREQUESTS\t4XX\t5XX\tERROR RATE\tRESETS\tTIMEOUTS")
+	for _, f := range failures.top(0) {
+		fmt.Fprintln(t, errorRow(label(e.ASN, f.key), hosts[f.key]))
+	}
+	t.Flush()
+
+	var keys []bucketKey
+	for key, c := range e.buckets {
+		if c.failures() > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].start.Equal(keys[j].start) {
+			return keys[i].start.Before(keys[j].start)
+		}
+		return keys[i].host < keys[j].host
+	})
+	fmt.Fprintf(e.w, "\n=== Errors over Time (%s buckets) ===\n", e.interval)
+	t = newTable(e.w)
+	fmt.Fprintln(t, "TIME\tHOST\tREQUESTS\t4XX\t5XX\tERROR RATE\tRESETS\tTIMEOUTS")
+	for _, key := range keys {
+		fmt.Fprintf(t, "%s\t%s\n", key.start.Format(time.RFC3339), errorRow(label(e.ASN, key.host), e.buckets[key]))
+	}
+	t.Flush()
+}
+
+// errorRow formats a host's counts as table cells. The error rate is the
+// share of requests that got a 4xx or 5xx response or none at all.
+func errorRow(host string, c *errorCounts) string {
+	rate := "-"
+	if c.requests > 0 {
+		failed := c.clientErrors + c.serverErrors + c.requests - c.answered
+		rate = fmt.Sprintf("%.1f%%", 100*float64(failed)/float64(c.requests))
+	}
+	return fmt.Sprintf("%s\t%d\t%d\t%d\t%s\t%d\t%d", host, c.requests, c.clientErrors, c.serverErrors, rate, c.resets, c.timeouts)
+}
@@ -0,0 +1,20 @@
+package report
+
+import "time"
+
+// Finding is a detection passed on as soon as it is made, for alerting,
+// rather than in a table at the end of the run.
+type Finding struct {
+	// Kind is "ioc", "cleartext" or "beacon".
+	Kind string
+	Time time.Time
+	// Key identifies what was found, so the same finding made again later
+	// can be told apart from a new one.
+	Key     string
+	Summary string
+	Detail  string
+}
+
+// FindingFunc receives findings. Reports call it with their lock held, so
+// it must not block.
+type FindingFunc func(Finding)
@@ -0,0 +1,103 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/fingerprint"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+type fingerprintKey struct {
+	fingerprint, client, server, sni string
+}
+
+type fingerprintMatch struct {
+	fingerprintKey
+	entry *fingerprint.Entry
+	count int64
+	first time.Time
+}
+
+// Fingerprints reports TLS connections whose ClientHello has a JA3 or JA4
+// fingerprint on a blocklist, with the server name the client asked for.
+type Fingerprints struct {
+	base
+	w    io.Writer
+	list *fingerprint.Blocklist
+
+	mu      sync.Mutex
+	tls     *fingerprint.Hellos
+	hellos  int64
+	matched int64
+	matches map[fingerprintKey]*fingerprintMatch
+}
+
+func NewFingerprints(w io.Writer, list *fingerprint.Blocklist) *Fingerprints {
+	return &Fingerprints{
+		w:       w,
+		list:    list,
+		tls:     fingerprint.NewHellos(),
+		matches: make(map[fingerprintKey]*fingerprintMatch),
+	}
+}
+
+func (f *Fingerprints) HandlePacket(p *analyzer.Packet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hello, _ := f.tls.Packet(p)
+	if hello == nil {
+		return
+	}
+	f.hellos++
+	entries := f.list.Match(hello)
+	if len(entries) > 0 {
+		f.matched++
+	}
+	client := p.Network.Src().String()
+	server := p.Network.Dst().String() + ":" + p.Transport.Dst().String()
+	for _, e := range entries {
+		k := fingerprintKey{e.Fingerprint, client, server, hello.SNI}
+		m, ok := f.matches[k]
+		if !ok {
+			m = &fingerprintMatch{fingerprintKey: k, entry: e, first: p.CaptureInfo.Timestamp}
+			f.matches[k] = m
+		}
+		m.count++
+	}
+}
+
+func (f *Fingerprints) HandleStats(analyzer.StatsSnapshot) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(f.w, "\n=== TLS Fingerprint Matches ===\n")
+	if len(f.matches) == 0 {
+		fmt.Fprintf(f.w, "None of %d TLS client hellos matched %d listed fingerprints\n", f.hellos, f.list.Len())
+		return
+	}
+	matches := make([]*fingerprintMatch, 0, len(f.matches))
+	for _, m := range f.matches {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].first.Equal(matches[j].first) {
+			return matches[i].first.Before(matches[j].first)
+		}
+		return matches[i].fingerprint < matches[j].fingerprint
+	})
+	fmt.Fprintf(f.w, "%d of %d TLS client hellos matched %d listed fingerprints\n", f.matched, f.hellos, f.list.Len())
+	t := newTable(f.w)
+	fmt.Fprintln(t, "FIRST SEEN\tCLIENT\tSERVER\tSNI\tKIND\tFINGERPRINT\tCOUNT\tSOURCE\tCOMMENT")
+	for _, m := range matches {
+		sni := m.sni
+		if sni == "" {
+			sni = "-"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", m.first.Format(time.RFC3339), m.client, m.server, sni,
+			m.entry.Kind, m.fingerprint, m.count, m.entry.Source, m.entry.Comment)
+	}
+	t.Flush()
+}
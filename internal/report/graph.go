@@ -0,0 +1,223 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Graph formats.
+const (
+	GraphDOT     = "dot"
+	GraphMermaid = "mermaid"
+)
+
+// graphNames is how many of the host names a server was reached by its
+// node lists.
+const graphNames = 3
+
+// GraphFormat returns the format a graph file's extension calls for:
+// Mermaid for .mmd and .mermaid, DOT otherwise.
+func GraphFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mmd", ".mermaid":
+		return GraphMermaid
+	}
+	return GraphDOT
+}
+
+// graphEdge is the traffic from one client to one server.
+type graphEdge struct {
+	requests int64
+	methods  counter
+	errors   int64
+}
+
+// Graph draws which clients sent HTTP requests to which servers, as a
+// Graphviz DOT or Mermaid flowchart, so that the dependencies between
+// services show. Nodes are addresses, so that a server calling others is
+// one node whichever side it is on; servers are labelled with the host
+// names they were reached by. Edges carry the number of requests, by
+// method, and of error responses.
+type Graph struct {
+	base
+	w      io.Writer
+	format string
+	mu     sync.Mutex
+
+	edges map[[2]string]*graphEdge
+	names map[string]counter
+}
+
+// NewGraph returns a Graph written to w in format, GraphDOT or
+// GraphMermaid, once the capture has been read.
+func NewGraph(w io.Writer, format string) *Graph {
+	return &Graph{
+		w:      w,
+		format: format,
+		edges:  make(map[[2]string]*graphEdge),
+		names:  make(map[string]counter),
+	}
+}
+
+func (g *Graph) edge(req *httpstream.Request) *graphEdge {
+	key := [2]string{req.SrcIP, req.DstIP}
+	e := g.edges[key]
+	if e == nil {
+		e = &graphEdge{methods: make(counter)}
+		g.edges[key] = e
+	}
+	return e
+}
+
+func (g *Graph) HandleRequest(req *httpstream.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.edge(req)
+	e.requests++
+	e.methods[req.Method]++
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "" && host != req.DstIP {
+		if g.names[req.DstIP] == nil {
+			g.names[req.DstIP] = make(counter)
+		}
+		g.names[req.DstIP][strings.ToLower(host)]++
+	}
+}
+
+func (g *Graph) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil || resp.StatusCode < 400 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edge(resp.Request).errors++
+}
+
+func (g *Graph) HandleStats(analyzer.StatsSnapshot) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([][2]string, 0, len(g.edges))
+	ids := make(map[string]string)
+	var addrs []string
+	var busiest int64
+	for key, e := range g.edges {
+		keys = append(keys, key)
+		for _, addr := range key {
+			if _, ok := ids[addr]; !ok {
+				ids[addr] = ""
+				addrs = append(addrs, addr)
+			}
+		}
+		busiest = max(busiest, e.requests)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return compareIPs(keys[i][0], keys[j][0]) < 0
+		}
+		return compareIPs(keys[i][1], keys[j][1]) < 0
+	})
+	sort.Slice(addrs, func(i, j int) bool { return compareIPs(addrs[i], addrs[j]) < 0 })
+	for i, addr := range addrs {
+		ids[addr] = fmt.Sprintf("n%d", i)
+	}
+
+	if g.format == GraphMermaid {
+		fmt.Fprintf(g.w, "flowchart LR\n")
+		for _, addr := range addrs {
+			fmt.Fprintf(g.w, "  %s[\"%s\"]\n", ids[addr], mermaidText(strings.Join(g.label(addr), "\n")))
+		}
+		for _, key := range keys {
+			fmt.Fprintf(g.w, "  %s -->|\"%s\"| %s\n", ids[key[0]], mermaidText(strings.Join(g.edges[key].label(), "\n")), ids[key[1]])
+		}
+		return
+	}
+
+	fmt.Fprintf(g.w, "digraph http {\n")
+	fmt.Fprintf(g.w, "  rankdir=LR;\n")
+	fmt.Fprintf(g.w, "  node [shape=box, fontname=\"Helvetica\"];\n")
+	fmt.Fprintf(g.w, "  edge [fontname=\"Helvetica\", fontsize=10];\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(g.w, "  %s [label=%s];\n", ids[addr], dotString(strings.Join(g.label(addr), "\n")))
+	}
+	for _, key := range keys {
+		e := g.edges[key]
+		// Wider for busier edges, from 1 to 5
+		width := 1 + 4*math.Log1p(float64(e.requests))/math.Log1p(float64(busiest))
+		attrs := fmt.Sprintf("label=%s, penwidth=%.1f", dotString(strings.Join(e.label(), "\n")), width)
+		if e.errors > 0 {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(g.w, "  %s -> %s [%s];\n", ids[key[0]], ids[key[1]], attrs)
+	}
+	fmt.Fprintf(g.w, "}\n")
+}
+
+// label is the lines of an address's node: its host names, most used
+// first, then the address.
+func (g *Graph) label(addr string) []string {
+	var lines []string
+	names := g.names[addr].top(0)
+	for i, n := range names {
+		if i == graphNames {
+			lines = append(lines, fmt.Sprintf("+%d more", len(names)-graphNames))
+			break
+		}
+		lines = append(lines, n.key)
+	}
+	return append(lines, addr)
+}
+
+// label is the lines of an edge: requests, by method, and errors.
+func (e *graphEdge) label() []string {
+	lines := []string{plural(e.requests, "request")}
+	var methods []string
+	for _, m := range e.methods.top(0) {
+		methods = append(methods, fmt.Sprintf("%s %d", m.key, m.count))
+	}
+	lines = append(lines, strings.Join(methods, ", "))
+	if e.errors > 0 {
+		lines = append(lines, plural(e.errors, "error"))
+	}
+	return lines
+}
+
+// compareIPs orders addresses numerically, IPv4 first.
+func compareIPs(a, b string) int {
+	x, errA := netip.ParseAddr(a)
+	y, errB := netip.ParseAddr(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	return x.Compare(y)
+}
+
+func plural(n int64, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// dotString quotes s as a DOT string, with newlines as line breaks.
+func dotString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// mermaidText escapes s for a quoted Mermaid label, with newlines as line
+// breaks.
+func mermaidText(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", "<br/>", "<", "#lt;", ">", "#gt;").Replace(s)
+}
@@ -0,0 +1,93 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// har is the part of an HTTP Archive that a profile is built from.
+type har struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the whole entry in milliseconds.
+	Time    float64 `json:"time"`
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		// Status is zero for requests that got no response.
+		Status int `json:"status"`
+	} `json:"response"`
+	Timings struct {
+		Send float64 `json:"send"`
+		Wait float64 `json:"wait"`
+	} `json:"timings"`
+	ServerIPAddress string `json:"serverIPAddress"`
+	Connection      string `json:"connection"`
+}
+
+// LoadHAR builds a profile from an HTTP Archive, such as one saved by a
+// browser, so a capture can be compared against it. Response times are the
+// send and wait timings, which like those measured from a capture run from
+// the start of the request to the start of the response.
+func LoadHAR(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var h har
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	p := newProfile(path)
+	connections := make(map[string]bool)
+	for _, e := range h.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		ep := p.endpoint(e.Request.Method + " " + u.Host + PathTemplate(path))
+
+		p.seen(e.StartedDateTime)
+		p.Requests++
+		p.Hosts[u.Host]++
+		ep.Requests++
+		if e.ServerIPAddress != "" && !connections[e.Connection] {
+			p.Servers[e.ServerIPAddress]++
+			// Entries without a connection ID each count as one
+			if e.Connection != "" {
+				connections[e.Connection] = true
+			}
+		}
+
+		if e.Response.Status == 0 {
+			p.Unanswered++
+			continue
+		}
+		class := statusClass(e.Response.Status)
+		p.Statuses[class]++
+		ep.Statuses[class]++
+		ms := e.Time
+		if e.Timings.Wait >= 0 {
+			ms = e.Timings.Wait + max(e.Timings.Send, 0)
+		}
+		ep.latencies.add(time.Duration(ms * float64(time.Millisecond)))
+		p.seen(e.StartedDateTime.Add(time.Duration(e.Time * float64(time.Millisecond))))
+	}
+	p.finish()
+	return p, nil
+}
@@ -0,0 +1,168 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/ioc"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// iocKey identifies a match: the same indicator matched the same way again
+// only adds to its count.
+type iocKey struct {
+	indicator *ioc.Indicator
+	where     string
+}
+
+type iocMatch struct {
+	iocKey
+	count  int64
+	first  time.Time
+	detail string
+}
+
+// IOC reports transactions and DNS records matching a set of indicators of
+// compromise.
+type IOC struct {
+	w   io.Writer
+	set atomic.Pointer[ioc.Set]
+
+	mu      sync.Mutex
+	matches map[iocKey]*iocMatch
+
+	// Notify, if set, receives each indicator the first time it matches a
+	// given way.
+	Notify FindingFunc
+}
+
+func NewIOC(w io.Writer, set *ioc.Set) *IOC {
+	r := &IOC{w: w, matches: make(map[iocKey]*iocMatch)}
+	r.set.Store(set)
+	return r
+}
+
+// SetIndicators replaces the indicators matched from the next event on.
+// Matches already made are kept.
+func (r *IOC) SetIndicators(set *ioc.Set) {
+	r.set.Store(set)
+}
+
+func (r *IOC) HandleRequest(req *httpstream.Request) {
+	set := r.set.Load()
+	detail := req.Method + " " + req.URL
+	r.match(set.Domain(req.Host), "request host", req.Timestamp, detail)
+	r.match(set.URL(req.URL), "request URL", req.Timestamp, detail)
+	r.match(set.IP(req.DstIP), "server address", req.Timestamp, detail)
+	r.match(set.IP(req.SrcIP), "client address", req.Timestamp, detail)
+	r.match(matchBody(set, &req.Message), "request body", req.Timestamp, detail)
+}
+
+func (r *IOC) HandleResponse(resp *httpstream.Response) {
+	detail := resp.Status
+	if resp.Request != nil {
+		detail = resp.Request.Method + " " + resp.Request.URL + " -> " + resp.Status
+	}
+	r.match(matchBody(r.set.Load(), &resp.Message), "response body", resp.Timestamp, detail)
+}
+
+// matchBody matches the digests of the decoded body, as computed by the stream
+// or, failing that, of the part in memory if that is all of it.
+func matchBody(set *ioc.Set, m *httpstream.Message) *ioc.Indicator {
+	for _, digest := range []string{m.SHA256, m.MD5} {
+		if ind := set.Digest(digest); digest != "" && ind != nil {
+			return ind
+		}
+	}
+	if m.Truncated() {
+		return nil
+	}
+	body, _, err := m.DecodedBody()
+	if err != nil {
+		return nil
+	}
+	return set.Body(body)
+}
+
+func (r *IOC) HandleDNS(msg *dns.Message) {
+	set := r.set.Load()
+	name := strings.TrimSuffix(msg.Question, ".")
+	if !msg.Response {
+		r.match(set.Domain(name), "DNS query", msg.Timestamp, fmt.Sprintf("%s asked for %s %s", msg.SrcIP, msg.QType, name))
+		return
+	}
+	for _, rr := range msg.Answers {
+		detail := fmt.Sprintf("%s %s %s", strings.TrimSuffix(rr.Name, "."), rr.Type, rr.Value)
+		r.match(set.Domain(rr.Name), "DNS answer", msg.Timestamp, detail)
+		switch rr.Type {
+		case "A", "AAAA":
+			r.match(set.IP(rr.Value), "DNS answer", msg.Timestamp, detail)
+		case "CNAME":
+			r.match(set.Domain(rr.Value), "DNS answer", msg.Timestamp, detail)
+		}
+	}
+}
+
+func (r *IOC) match(ind *ioc.Indicator, where string, ts time.Time, detail string) {
+	if ind == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := iocKey{ind, where}
+	m, ok := r.matches[key]
+	if !ok {
+		m = &iocMatch{iocKey: key, first: ts, detail: detail}
+		r.matches[key] = m
+		if r.Notify != nil {
+			r.Notify(Finding{
+				Kind:    "ioc",
+				Time:    ts,
+				Key:     ind.Kind + " " + ind.Value + " " + where,
+				Summary: fmt.Sprintf("Indicator %s (%s) matched in %s", ind.Value, ind.Kind, where),
+				Detail:  strings.TrimSpace(detail + "\nSource: " + ind.Source + " " + ind.Comment),
+			})
+		}
+	}
+	m.count++
+	if ts.Before(m.first) {
+		m.first, m.detail = ts, detail
+	}
+}
+
+func (r *IOC) HandleStats(analyzer.StatsSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.w, "\n=== Indicator Matches ===\n")
+	if len(r.matches) == 0 {
+		fmt.Fprintf(r.w, "None of %d indicators matched\n", r.set.Load().Len())
+		return
+	}
+	matches := make([]*iocMatch, 0, len(r.matches))
+	matched := make(map[*ioc.Indicator]bool)
+	for _, m := range r.matches {
+		matches = append(matches, m)
+		matched[m.indicator] = true
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].first.Equal(matches[j].first) {
+			return matches[i].first.Before(matches[j].first)
+		}
+		return matches[i].where < matches[j].where
+	})
+	fmt.Fprintf(r.w, "%d of %d indicators matched\n", len(matched), r.set.Load().Len())
+	t := newTable(r.w)
+	fmt.Fprintln(t, "FIRST SEEN\tINDICATOR\tKIND\tMATCHED\tCOUNT\tFIRST MATCH\tSOURCE\tCOMMENT")
+	for _, m := range matches {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", m.first.Format(time.RFC3339), m.indicator.Value, m.indicator.Kind,
+			m.where, m.count, m.detail, m.indicator.Source, m.indicator.Comment)
+	}
+	t.Flush()
+}
@@ -0,0 +1,155 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/asn"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Latency reports response time percentiles per endpoint, the host and path
+// of a request, and network round trip times per server. Response time runs
+// from the first byte of the request to the first byte of its response, both
+// as captured. Round trip time runs from a connection's SYN to the ACK of its
+// SYN/ACK, which is a full round trip wherever the capture was taken.
+type Latency struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	endpoints map[string]*samples
+	servers   map[string]*samples
+	// handshakes holds connections whose handshake hasn't completed, by
+	// stream.FlowKey.
+	handshakes map[string]*handshake
+
+	// ASN, if set, labels servers with their network.
+	ASN *asn.DB
+}
+
+// handshake is the part of a TCP handshake seen so far.
+type handshake struct {
+	server   string
+	syn      time.Time
+	answered bool
+}
+
+func NewLatency(w io.Writer) *Latency {
+	return &Latency{
+		w:          w,
+		endpoints:  make(map[string]*samples),
+		servers:    make(map[string]*samples),
+		handshakes: make(map[string]*handshake),
+	}
+}
+
+func (l *Latency) HandlePacket(p *analyzer.Packet) {
+	tcp := p.TCP
+	if tcp == nil || !(tcp.SYN || tcp.ACK || tcp.RST) {
+		return
+	}
+	key := stream.FlowKey(p.Network, p.Transport)
+	ts := p.CaptureInfo.Timestamp
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hs := l.handshakes[key]
+	switch {
+	case tcp.RST:
+		delete(l.handshakes, key)
+	case tcp.SYN && !tcp.ACK:
+		// A retransmitted SYN restarts the handshake it is answered by
+		l.handshakes[key] = &handshake{
+			server: p.Network.Dst().String() + ":" + p.Transport.Dst().String(),
+			syn:    ts,
+		}
+	case hs == nil:
+	case tcp.SYN:
+		hs.answered = true
+	case hs.answered && p.Network.Src().String()+":"+p.Transport.Src().String() != hs.server:
+		addSample(l.servers, hs.server, ts.Sub(hs.syn))
+		delete(l.handshakes, key)
+	}
+}
+
+func (l *Latency) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil {
+		return
+	}
+	d := resp.Timestamp.Sub(resp.Request.Timestamp)
+	if d < 0 {
+		d = 0
+	}
+	host, path := hostPath(resp.Request)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addSample(l.endpoints, host+path, d)
+}
+
+// addSample adds d to the samples of key.
+func addSample(m map[string]*samples, key string, d time.Duration) {
+	s, ok := m[key]
+	if !ok {
+		s = &samples{}
+		m[key] = s
+	}
+	s.add(d)
+}
+
+func (l *Latency) HandleStats(analyzer.StatsSnapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.print("Response Times", "ENDPOINT", l.endpoints, nil)
+	l.print("Network Round Trip Times", "SERVER", l.servers, l.ASN)
+}
+
+// print writes a table of percentiles for each key, busiest first, labelling
+// keys with their network if db is set.
+func (l *Latency) print(title, column string, keys map[string]*samples, db *asn.DB) {
+	if len(keys) == 0 {
+		return
+	}
+	counts := make(counter, len(keys))
+	for key, s := range keys {
+		counts[key] = s.count
+	}
+
+	fmt.Fprintf(l.w, "\n=== %s ===\n", title)
+	t := newTable(l.w)
+	fmt.Fprintf(t, "%s\tCOUNT\tP50\tP95\tP99\tMAX\n", column)
+	for _, e := range counts.top(0) {
+		s := keys[e.key]
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\t%s\n", label(db, e.key), e.count,
+			formatDuration(s.percentile(50)),
+			formatDuration(s.percentile(95)),
+			formatDuration(s.percentile(99)),
+			formatDuration(s.max))
+	}
+	t.Flush()
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
@@ -0,0 +1,156 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/lookalike"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// flaggedName is an internationalized name, or one that looks like a
+// protected domain.
+type flaggedName struct {
+	name, unicode, scripts string
+	match                  *lookalike.Match
+	sources, clients       map[string]bool
+	count                  int64
+	first                  time.Time
+}
+
+// Lookalikes reports internationalized names looked up or requested, in
+// their Unicode form, and names that look like a list of protected brand
+// domains, for phishing investigations.
+type Lookalikes struct {
+	base
+	w      io.Writer
+	brands *lookalike.Brands
+
+	mu sync.Mutex
+	// names holds every name checked, with nil for those not flagged, so
+	// that each is only checked once.
+	names map[string]*flaggedName
+}
+
+// NewLookalikes returns the report. brands may be nil to only list
+// internationalized names.
+func NewLookalikes(w io.Writer, brands *lookalike.Brands) *Lookalikes {
+	return &Lookalikes{w: w, brands: brands, names: make(map[string]*flaggedName)}
+}
+
+func (l *Lookalikes) HandleDNS(msg *dns.Message) {
+	if msg.Response {
+		return
+	}
+	l.add(strings.TrimSuffix(strings.ToLower(msg.Question), "."), "DNS", msg.SrcIP, msg.Timestamp)
+}
+
+func (l *Lookalikes) HandleRequest(req *httpstream.Request) {
+	if req.Host != "" {
+		l.add(hostOf(req.Host), "HTTP", req.SrcIP, req.Timestamp)
+	}
+}
+
+func (l *Lookalikes) add(name, source, client string, ts time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.names[name]
+	if !ok {
+		u := lookalike.Unicode(name)
+		var match *lookalike.Match
+		if l.brands != nil {
+			match = l.brands.Check(name)
+		}
+		if u != name || match != nil {
+			f = &flaggedName{
+				name: name, unicode: u, scripts: lookalike.Scripts(u), match: match,
+				sources: make(map[string]bool), clients: make(map[string]bool), first: ts,
+			}
+		}
+		l.names[name] = f
+	}
+	if f == nil {
+		return
+	}
+	f.sources[source] = true
+	f.clients[client] = true
+	f.count++
+	if ts.Before(f.first) {
+		f.first = ts
+	}
+}
+
+func (l *Lookalikes) HandleStats(analyzer.StatsSnapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "\n=== Internationalized and Lookalike Names ===\n")
+
+	var idn, lookalikes []*flaggedName
+	for _, f := range l.names {
+		if f == nil {
+			continue
+		}
+		if f.unicode != f.name {
+			idn = append(idn, f)
+		}
+		if f.match != nil {
+			lookalikes = append(lookalikes, f)
+		}
+	}
+	byFirst := func(s []*flaggedName) {
+		sort.Slice(s, func(i, j int) bool {
+			if !s[i].first.Equal(s[j].first) {
+				return s[i].first.Before(s[j].first)
+			}
+			return s[i].name < s[j].name
+		})
+	}
+	byFirst(idn)
+	byFirst(lookalikes)
+
+	if len(idn) == 0 {
+		fmt.Fprintf(l.w, "No internationalized names among %d seen\n", len(l.names))
+	} else {
+		fmt.Fprintf(l.w, "%d internationalized names among %d seen:\n", len(idn), len(l.names))
+		t := newTable(l.w)
+		fmt.Fprintln(t, "NAME\tUNICODE\tSCRIPTS\tSOURCE\tCLIENTS\tCOUNT\tFIRST SEEN")
+		for _, f := range idn {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", f.name, f.unicode, f.scripts, sources(f.sources),
+				len(f.clients), f.count, f.first.Format(time.RFC3339))
+		}
+		t.Flush()
+	}
+
+	if l.brands == nil {
+		return
+	}
+	fmt.Fprintln(l.w)
+	if len(lookalikes) == 0 {
+		fmt.Fprintf(l.w, "No lookalikes of %d protected domains\n", l.brands.Len())
+		return
+	}
+	fmt.Fprintf(l.w, "Lookalikes of %d protected domains:\n", l.brands.Len())
+	t := newTable(l.w)
+	fmt.Fprintln(t, "NAME\tUNICODE\tLOOKS LIKE\tKIND\tSOURCE\tCLIENTS\tCOUNT\tFIRST SEEN")
+	for _, f := range lookalikes {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", f.name, f.unicode, f.match.Brand, f.match.Kind, sources(f.sources),
+			len(f.clients), f.count, f.first.Format(time.RFC3339))
+	}
+	t.Flush()
+}
+
+// sources lists where a name was seen, such as "DNS, HTTP".
+func sources(set map[string]bool) string {
+	s := make([]string, 0, len(set))
+	for source := range set {
+		s = append(s, source)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,197 @@
+package report
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/fingerprint"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Kinds of name mismatch.
+const (
+	mismatchHostSNI  = "Host/SNI"
+	mismatchSNICert  = "SNI/certificate"
+	mismatchHostCert = "Host/certificate"
+)
+
+// namedConn is what one TLS connection said about the server it was for.
+type namedConn struct {
+	first     time.Time
+	host, sni string
+	cert      *x509.Certificate
+}
+
+type mismatchKey struct {
+	client, server, kind, host, sni, cert string
+}
+
+type nameMismatch struct {
+	mismatchKey
+	count int64
+	first time.Time
+}
+
+// NameMismatch reports TLS connections where the HTTP Host, the server name
+// (SNI) the client asked for and the names on the server's certificate
+// disagree, as in domain fronting or misconfigured virtual hosting. The Host
+// of a TLS connection is only visible when it was opened through a proxy
+// with CONNECT, and the certificate only before TLS 1.3.
+type NameMismatch struct {
+	base
+	w io.Writer
+
+	mu    sync.Mutex
+	tls   *fingerprint.Hellos
+	conns map[string]*namedConn
+}
+
+func NewNameMismatch(w io.Writer) *NameMismatch {
+	return &NameMismatch{
+		w:     w,
+		tls:   fingerprint.NewHellos(),
+		conns: make(map[string]*namedConn),
+	}
+}
+
+// conn returns the connection from client to server, both as ip:port.
+func (n *NameMismatch) conn(client, server string, ts time.Time) *namedConn {
+	key := client + " " + server
+	c, ok := n.conns[key]
+	if !ok {
+		c = &namedConn{first: ts}
+		n.conns[key] = c
+	}
+	if ts.Before(c.first) {
+		c.first = ts
+	}
+	return c
+}
+
+func (n *NameMismatch) HandleRequest(req *httpstream.Request) {
+	if req.Method != "CONNECT" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := n.conn(req.SrcIP+":"+req.SrcPort, req.DstIP+":"+req.DstPort, req.Timestamp)
+	c.host = hostOf(req.Host)
+}
+
+func (n *NameMismatch) HandlePacket(p *analyzer.Packet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	client, server := n.tls.Packet(p)
+	src := p.Network.Src().String() + ":" + p.Transport.Src().String()
+	dst := p.Network.Dst().String() + ":" + p.Transport.Dst().String()
+	switch {
+	case client != nil:
+		n.conn(src, dst, p.CaptureInfo.Timestamp).sni = hostOf(client.SNI)
+	case server != nil && server.Certificate != nil:
+		n.conn(dst, src, p.CaptureInfo.Timestamp).cert = server.Certificate
+	}
+}
+
+// certNames lists the names a certificate is valid for.
+func certNames(cert *x509.Certificate) string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return "CN=" + cert.Subject.CommonName
+	}
+	return strings.Join(names, ",")
+}
+
+func (n *NameMismatch) HandleStats(analyzer.StatsSnapshot) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fmt.Fprintf(n.w, "\n=== Host, SNI and Certificate Mismatches ===\n")
+
+	var compared, withHost, withCert int
+	found := make(map[mismatchKey]*nameMismatch)
+	for key, c := range n.conns {
+		if c.sni == "" && c.cert == nil {
+			// Not TLS, or its handshake wasn't captured
+			continue
+		}
+		compared++
+		if c.host != "" {
+			withHost++
+		}
+		if c.cert != nil {
+			withCert++
+		}
+		var kinds []string
+		if c.host != "" && c.sni != "" && c.host != c.sni && net.ParseIP(c.host) == nil {
+			kinds = append(kinds, mismatchHostSNI)
+		}
+		if c.cert != nil {
+			if c.sni != "" && c.cert.VerifyHostname(c.sni) != nil {
+				kinds = append(kinds, mismatchSNICert)
+			} else if c.sni == "" && c.host != "" && c.cert.VerifyHostname(c.host) != nil {
+				kinds = append(kinds, mismatchHostCert)
+			}
+		}
+		if len(kinds) == 0 {
+			continue
+		}
+		client, server, _ := strings.Cut(key, " ")
+		if h, _, err := net.SplitHostPort(client); err == nil {
+			client = h
+		}
+		cert := "-"
+		if c.cert != nil {
+			cert = truncate(certNames(c.cert), 60)
+		}
+		for _, kind := range kinds {
+			k := mismatchKey{client, server, kind, orDash(c.host), orDash(c.sni), cert}
+			m, ok := found[k]
+			if !ok {
+				m = &nameMismatch{mismatchKey: k, first: c.first}
+				found[k] = m
+			}
+			m.count++
+			if c.first.Before(m.first) {
+				m.first = c.first
+			}
+		}
+	}
+
+	fmt.Fprintf(n.w, "Compared names on %d TLS connections (%d opened with CONNECT, %d with a certificate in the clear)\n", compared, withHost, withCert)
+	if len(found) == 0 {
+		fmt.Fprintln(n.w, "No mismatches")
+		return
+	}
+	mismatches := make([]*nameMismatch, 0, len(found))
+	for _, m := range found {
+		mismatches = append(mismatches, m)
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if !mismatches[i].first.Equal(mismatches[j].first) {
+			return mismatches[i].first.Before(mismatches[j].first)
+		}
+		return mismatches[i].kind < mismatches[j].kind
+	})
+	t := newTable(n.w)
+	fmt.Fprintln(t, "FIRST SEEN\tCLIENT\tSERVER\tMISMATCH\tHOST\tSNI\tCERTIFICATE\tCONNECTIONS")
+	for _, m := range mismatches {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", m.first.Format(time.RFC3339), m.client, m.server, m.kind, m.host, m.sni, m.cert, m.count)
+	}
+	t.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
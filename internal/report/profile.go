@@ -0,0 +1,173 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Profile condenses a capture into what is compared between captures: the
+// hosts and endpoints used, how requests were answered and how fast.
+type Profile struct {
+	Capture    string    `json:"capture"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Requests   int64     `json:"requests"`
+	Unanswered int64     `json:"unanswered"`
+	// Statuses counts responses by status class, such as "2xx".
+	Statuses map[string]int64 `json:"statuses"`
+	// Hosts counts requests by Host header.
+	Hosts map[string]int64 `json:"hosts"`
+	// Servers counts connection attempts, SYNs, by server address.
+	Servers   map[string]int64     `json:"servers"`
+	Endpoints map[string]*Endpoint `json:"endpoints"`
+}
+
+// Endpoint profiles the requests of one method to one path template on one
+// host. Its key in Profile.Endpoints is "METHOD host/path".
+type Endpoint struct {
+	Requests int64            `json:"requests"`
+	Statuses map[string]int64 `json:"statuses"`
+	// Response time percentiles; zero when no request was answered.
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+
+	latencies samples
+}
+
+func newProfile(capture string) *Profile {
+	return &Profile{
+		Capture:   capture,
+		Statuses:  make(map[string]int64),
+		Hosts:     make(map[string]int64),
+		Servers:   make(map[string]int64),
+		Endpoints: make(map[string]*Endpoint),
+	}
+}
+
+func (p *Profile) endpoint(key string) *Endpoint {
+	e, ok := p.Endpoints[key]
+	if !ok {
+		e = &Endpoint{Statuses: make(map[string]int64)}
+		p.Endpoints[key] = e
+	}
+	return e
+}
+
+func (p *Profile) seen(ts time.Time) {
+	if p.Start.IsZero() || ts.Before(p.Start) {
+		p.Start = ts
+	}
+	if ts.After(p.End) {
+		p.End = ts
+	}
+}
+
+// endpointKey identifies the endpoint a request was sent to.
+func endpointKey(req *httpstream.Request) string {
+	host, path := hostPath(req)
+	return req.Method + " " + host + path
+}
+
+// finish computes the endpoints' percentiles from their samples.
+func (p *Profile) finish() {
+	for _, e := range p.Endpoints {
+		if e.latencies.count == 0 {
+			continue
+		}
+		e.P50 = e.latencies.percentile(50)
+		e.P95 = e.latencies.percentile(95)
+		e.P99 = e.latencies.percentile(99)
+	}
+}
+
+// LoadProfile reads a profile saved with Save.
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Save writes the profile as JSON, to be compared against later.
+func (p *Profile) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// Profiler builds a Profile from the events of a run.
+type Profiler struct {
+	base
+	mu sync.Mutex
+	p  *Profile
+}
+
+func NewProfiler(capture string) *Profiler {
+	return &Profiler{p: newProfile(capture)}
+}
+
+func (pr *Profiler) HandlePacket(p *analyzer.Packet) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.p.seen(p.CaptureInfo.Timestamp)
+	if p.TCP != nil && p.TCP.SYN && !p.TCP.ACK {
+		pr.p.Servers[p.Network.Dst().String()]++
+	}
+}
+
+func (pr *Profiler) HandleRequest(req *httpstream.Request) {
+	host, _ := hostPath(req)
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.p.Requests++
+	pr.p.Unanswered++
+	pr.p.Hosts[host]++
+	pr.p.endpoint(endpointKey(req)).Requests++
+}
+
+func (pr *Profiler) HandleResponse(resp *httpstream.Response) {
+	class := statusClass(resp.StatusCode)
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.p.Statuses[class]++
+	if resp.Request == nil {
+		return
+	}
+	pr.p.Unanswered--
+	e := pr.p.endpoint(endpointKey(resp.Request))
+	e.Statuses[class]++
+	e.latencies.add(resp.Timestamp.Sub(resp.Request.Timestamp))
+}
+
+// HandleStats completes the profile's percentiles.
+func (pr *Profiler) HandleStats(analyzer.StatsSnapshot) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.p.finish()
+}
+
+// Profile returns the profile built so far; it is complete once the run
+// has ended.
+func (pr *Profiler) Profile() *Profile {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.p
+}
@@ -0,0 +1,124 @@
+// Package report aggregates analysis events into tables printed at the end
+// of a run.
+package report
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pcap-analyzer/internal/asn"
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Report is a handler that accumulates what it needs while a capture is
+// analyzed and prints itself once the run is over. Reports are written
+// when HandleStats, the last event of a run, is received.
+type Report interface {
+	analyzer.Handler
+	analyzer.StatsHandler
+}
+
+// base provides no-op handlers for the events a report doesn't use.
+type base struct{}
+
+func (base) HandleRequest(*httpstream.Request)   {}
+func (base) HandleResponse(*httpstream.Response) {}
+func (base) HandleDNS(*dns.Message)              {}
+
+// counter counts occurrences of string keys.
+type counter map[string]int64
+
+// entry is one key of a counter with its count.
+type entry struct {
+	key   string
+	count int64
+}
+
+// top returns up to n entries, largest count first and ties in key order.
+// Zero n returns every entry.
+func (c counter) top(n int) []entry {
+	entries := make([]entry, 0, len(c))
+	for k, v := range c {
+		entries = append(entries, entry{k, v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].key < entries[j].key
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// contentType returns the media type of a response without parameters.
+func contentType(resp *httpstream.Response) string {
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		return "(none)"
+	}
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		return mt
+	}
+	return ct
+}
+
+// label appends the network an address, optionally followed by a port,
+// belongs to when db knows it, as in "3.5.0.1:443 (AS16509 AMAZON-02)".
+func label(db *asn.DB, addr string) string {
+	if db == nil {
+		return addr
+	}
+	ip := addr
+	if net.ParseIP(ip) == nil {
+		if i := strings.LastIndex(addr, ":"); i > 0 {
+			ip = addr[:i]
+		}
+	}
+	if info, ok := db.Lookup(ip); ok {
+		return addr + " (" + info.String() + ")"
+	}
+	return addr
+}
+
+// ports returns a packet's source and destination ports.
+func ports(p *analyzer.Packet) (src, dst uint16) {
+	s, d := p.Transport.Endpoints()
+	return binary.BigEndian.Uint16(s.Raw()), binary.BigEndian.Uint16(d.Raw())
+}
+
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// truncate shortens s to at most n runes, marking the cut with "…".
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
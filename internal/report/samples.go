@@ -0,0 +1,57 @@
+package report
+
+import (
+	"sort"
+	"time"
+)
+
+// maxSamples is how many durations a samples keeps. Percentiles of more
+// are taken from a uniform random sample of them, which is within a
+// fraction of a percentile of the exact value.
+const maxSamples = 10000
+
+// samples collects durations for percentiles in bounded memory: the count,
+// minimum and maximum are exact, and past maxSamples each new duration
+// replaces a kept one at random (reservoir sampling).
+type samples struct {
+	kept     []time.Duration
+	count    int64
+	min, max time.Duration
+	sorted   bool
+	// rng is the state of the xorshift generator picking replacements,
+	// seeded the same way every time so reports are reproducible.
+	rng uint64
+}
+
+func (s *samples) add(d time.Duration) {
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if s.count == 0 || d > s.max {
+		s.max = d
+	}
+	s.count++
+	s.sorted = false
+	if len(s.kept) < maxSamples {
+		s.kept = append(s.kept, d)
+		return
+	}
+	if s.rng == 0 {
+		s.rng = 0x9e3779b97f4a7c15
+	}
+	s.rng ^= s.rng << 13
+	s.rng ^= s.rng >> 7
+	s.rng ^= s.rng << 17
+	if i := s.rng % uint64(s.count); i < maxSamples {
+		s.kept[i] = d
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the durations.
+func (s *samples) percentile(p float64) time.Duration {
+	if !s.sorted {
+		sort.Slice(s.kept, func(i, j int) bool { return s.kept[i] < s.kept[j] })
+		s.sorted = true
+	}
+	return percentile(s.kept, p)
+}
@@ -0,0 +1,67 @@
+package report
+
+import (
+	"testing"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+func TestSamplesBounded(t *testing.T) {
+	const n = 20 * maxSamples
+	var s samples
+	// Added in an order unrelated to their value
+	for i := 0; i < n; i++ {
+		s.add(time.Duration((i*7919)%n+1) * time.Microsecond)
+	}
+	if len(s.kept) > maxSamples {
+		t.Errorf("kept %d samples, want at most %d", len(s.kept), maxSamples)
+	}
+	if s.count != n || s.min != time.Microsecond || s.max != n*time.Microsecond {
+		t.Errorf("count %d, min %v, max %v; want %d, 1µs, %v", s.count, s.min, s.max, n, n*time.Microsecond)
+	}
+	for _, p := range []float64{50, 95, 99} {
+		want := time.Duration(p / 100 * n * float64(time.Microsecond))
+		got := s.percentile(p)
+		if diff := got - want; diff < -n*time.Microsecond/50 || diff > n*time.Microsecond/50 {
+			t.Errorf("p%v is %v, want about %v", p, got, want)
+		}
+	}
+}
+
+func TestSamplesExactWhenFew(t *testing.T) {
+	var s samples
+	for _, ms := range []int{30, 10, 20} {
+		s.add(time.Duration(ms) * time.Millisecond)
+	}
+	if got := s.percentile(50); got != 20*time.Millisecond {
+		t.Errorf("p50 is %v, want 20ms", got)
+	}
+	s.add(40 * time.Millisecond)
+	if got := s.percentile(100); got != 40*time.Millisecond {
+		t.Errorf("p100 is %v after adding 40ms, want 40ms", got)
+	}
+}
+
+func TestLatencyBounded(t *testing.T) {
+	l := NewLatency(nil)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3*maxSamples; i++ {
+		req := &httpstream.Request{Host: "example.com", URL: "http://example.com/api"}
+		req.Timestamp = start
+		resp := &httpstream.Response{Request: req}
+		resp.Timestamp = start.Add(time.Duration(i) * time.Millisecond)
+		l.HandleResponse(resp)
+	}
+	if len(l.endpoints) != 1 {
+		t.Fatalf("got %d endpoints, want 1", len(l.endpoints))
+	}
+	for key, s := range l.endpoints {
+		if len(s.kept) > maxSamples {
+			t.Errorf("%s: kept %d samples, want at most %d", key, len(s.kept), maxSamples)
+		}
+		if s.count != 3*maxSamples {
+			t.Errorf("%s: counted %d responses, want %d", key, s.count, 3*maxSamples)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Thresholds of the scanner checks, set well above what browsers and API
+// clients do in ordinary use.
+const (
+	// A client probes for paths when at least scanMinNotFound of its
+	// requests, and at least half, were answered 404.
+	scanMinNotFound = 20
+	// A client enumerates when it requests at least scanMinIDs distinct
+	// numbers in the same place of the same path, spread over no more than
+	// three times as many numbers.
+	scanMinIDs = 20
+	// A client port scans when it tries at least scanMinPorts ports on one
+	// host, and sweeps when it tries one port on at least scanMinHosts
+	// hosts.
+	scanMinPorts = 20
+	scanMinHosts = 20
+)
+
+// scannerAgent matches the User-Agents of well-known vulnerability
+// scanners, fuzzers and internet-wide survey tools.
+var scannerAgent = regexp.MustCompile(`(?i)nikto|sqlmap|nmap|masscan|zgrab|nuclei|dirbuster|gobuster|\bdirb\b|ffuf|wfuzz|feroxbuster|` +
+	`acunetix|nessus|openvas|qualys|wpscan|whatweb|arachni|w3af|skipfish|owasp zap|zaproxy|netsparker|appscan|webinspect|` +
+	`jaeles|censysinspect|expanse|internet-measurement|fuzz faster`)
+
+// pagingParams are query parameters that walk through pages of results,
+// which clients legitimately do in order.
+var pagingParams = map[string]bool{"page": true, "p": true, "offset": true, "start": true, "skip": true, "limit": true, "per_page": true, "pagesize": true, "page_size": true}
+
+// enumeration is the numbers a client requested in one path template.
+type enumeration struct {
+	ids      map[int64]bool
+	min, max int64
+}
+
+// scanClient is the evidence gathered about one client.
+type scanClient struct {
+	first, last time.Time
+
+	requests  int64
+	responses int64
+	notFound  int64
+	// missing holds a few of the paths answered 404.
+	missing []string
+	agent   string
+	agents  int64
+	enums   map[string]*enumeration
+
+	// targets holds the host and port of each connection attempt.
+	targets           map[[2]string]bool
+	refused           int64
+	synFirst, synLast time.Time
+}
+
+// Scanners reports clients that behave like scanners: many requests for
+// paths that don't exist, requests walking through numeric IDs, connection
+// attempts to many ports or hosts, and scanner User-Agents, with the
+// evidence for each.
+type Scanners struct {
+	base
+	w io.Writer
+
+	mu      sync.Mutex
+	clients map[string]*scanClient
+	// attempts holds connections the client has sent a SYN on and not yet
+	// heard back from, so a reset can be counted as refused.
+	attempts map[string]bool
+}
+
+func NewScanners(w io.Writer) *Scanners {
+	return &Scanners{w: w, clients: make(map[string]*scanClient), attempts: make(map[string]bool)}
+}
+
+func (s *Scanners) client(ip string, ts time.Time) *scanClient {
+	c, ok := s.clients[ip]
+	if !ok {
+		c = &scanClient{first: ts, last: ts, enums: make(map[string]*enumeration), targets: make(map[[2]string]bool)}
+		s.clients[ip] = c
+	}
+	if ts.Before(c.first) {
+		c.first = ts
+	}
+	if ts.After(c.last) {
+		c.last = ts
+	}
+	return c
+}
+
+func (s *Scanners) HandleRequest(req *httpstream.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(req.SrcIP, req.Timestamp)
+	c.requests++
+	if ua := req.Header.Get("User-Agent"); scannerAgent.MatchString(ua) {
+		c.agents++
+		if c.agent == "" {
+			c.agent = ua
+		}
+	}
+	if tmpl, id, ok := enumerationKey(req.URI); ok {
+		e, ok := c.enums[tmpl]
+		if !ok {
+			e = &enumeration{ids: make(map[int64]bool), min: id, max: id}
+			c.enums[tmpl] = e
+		}
+		e.ids[id] = true
+		e.min, e.max = min(e.min, id), max(e.max, id)
+	}
+}
+
+// enumerationKey returns a request target with its last numeric path
+// segment, or failing that its first numeric query value, replaced by
+// {id}, and the number replaced.
+func enumerationKey(uri string) (string, int64, bool) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", 0, false
+	}
+	segments := strings.Split(u.Path, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if seg := segments[i]; seg != "" && len(seg) <= 9 && isNumber(seg) {
+			id, _ := strconv.ParseInt(seg, 10, 64)
+			segments[i] = placeholderID
+			return strings.Join(segments, "/"), id, true
+		}
+	}
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if pagingParams[strings.ToLower(name)] {
+			continue
+		}
+		v := query.Get(name)
+		if v != "" && len(v) <= 9 && isNumber(v) {
+			id, _ := strconv.ParseInt(v, 10, 64)
+			return u.Path + "?" + name + "=" + placeholderID, id, true
+		}
+	}
+	return "", 0, false
+}
+
+func (s *Scanners) HandleResponse(resp *httpstream.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(resp.DstIP, resp.Timestamp)
+	c.responses++
+	if resp.StatusCode != 404 {
+		return
+	}
+	c.notFound++
+	if len(c.missing) < 3 && resp.Request != nil {
+		c.missing = append(c.missing, truncate(withoutQuery(resp.Request.URI), 40))
+	}
+}
+
+func (s *Scanners) HandlePacket(p *analyzer.Packet) {
+	if p.TCP == nil {
+		return
+	}
+	key := p.Network.String() + " " + p.Transport.String()
+	ts := p.CaptureInfo.Timestamp
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case p.TCP.SYN && !p.TCP.ACK:
+		c := s.client(p.Network.Src().String(), ts)
+		c.targets[[2]string{p.Network.Dst().String(), p.Transport.Dst().String()}] = true
+		if c.synFirst.IsZero() {
+			c.synFirst = ts
+		}
+		c.synLast = ts
+		s.attempts[key] = true
+	case p.TCP.RST:
+		// A reset in answer to a SYN: the port is closed
+		reverse := p.Network.Reverse().String() + " " + p.Transport.Reverse().String()
+		if s.attempts[reverse] {
+			delete(s.attempts, reverse)
+			s.clients[p.Network.Dst().String()].refused++
+		}
+	default:
+		delete(s.attempts, p.Network.Reverse().String()+" "+p.Transport.Reverse().String())
+	}
+}
+
+// evidence lists why c looks like a scanner, strongest first.
+func (c *scanClient) evidence() []string {
+	var found []string
+	if c.agents > 0 {
+		found = append(found, fmt.Sprintf("scanner User-Agent %q on %d of %d requests", truncate(c.agent, 60), c.agents, c.requests))
+	}
+	if c.notFound >= scanMinNotFound && c.notFound*2 >= c.responses {
+		found = append(found, fmt.Sprintf("%d of %d responses were 404 Not Found, such as %s", c.notFound, c.responses, strings.Join(c.missing, ", ")))
+	}
+	var tmpls []string
+	for tmpl, e := range c.enums {
+		if n := int64(len(e.ids)); n >= scanMinIDs && e.max-e.min < 3*n {
+			tmpls = append(tmpls, tmpl)
+		}
+	}
+	sort.Strings(tmpls)
+	for _, tmpl := range tmpls {
+		e := c.enums[tmpl]
+		found = append(found, fmt.Sprintf("walked %s through %d IDs from %d to %d", truncate(tmpl, 60), len(e.ids), e.min, e.max))
+	}
+
+	ports := make(map[string]map[string]bool)
+	hosts := make(map[string]map[string]bool)
+	for t := range c.targets {
+		if ports[t[0]] == nil {
+			ports[t[0]] = make(map[string]bool)
+		}
+		ports[t[0]][t[1]] = true
+		if hosts[t[1]] == nil {
+			hosts[t[1]] = make(map[string]bool)
+		}
+		hosts[t[1]][t[0]] = true
+	}
+	window := c.synLast.Sub(c.synFirst).Round(time.Millisecond)
+	var scanned, swept []string
+	for host, p := range ports {
+		if len(p) >= scanMinPorts {
+			scanned = append(scanned, host)
+		}
+	}
+	for port, h := range hosts {
+		if len(h) >= scanMinHosts {
+			swept = append(swept, port)
+		}
+	}
+	sortBySize(scanned, ports)
+	sortBySize(swept, hosts)
+	for _, host := range scanned {
+		found = append(found, fmt.Sprintf("tried %d ports on %s", len(ports[host]), host))
+	}
+	for _, port := range swept {
+		found = append(found, fmt.Sprintf("tried port %s on %d hosts", port, len(hosts[port])))
+	}
+	if len(scanned) > 0 || len(swept) > 0 {
+		found = append(found, fmt.Sprintf("%d host and port pairs tried in %s, %d refused", len(c.targets), window, c.refused))
+	}
+	return found
+}
+
+// sortBySize sorts keys by the size of their set in sets, largest first.
+func sortBySize(keys []string, sets map[string]map[string]bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		if len(sets[keys[i]]) != len(sets[keys[j]]) {
+			return len(sets[keys[i]]) > len(sets[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+func (s *Scanners) HandleStats(analyzer.StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "\n=== Scanners ===\n")
+
+	type flagged struct {
+		ip       string
+		evidence []string
+	}
+	var scanners []flagged
+	for ip, c := range s.clients {
+		if e := c.evidence(); len(e) > 0 {
+			scanners = append(scanners, flagged{ip, e})
+		}
+	}
+	if len(scanners) == 0 {
+		fmt.Fprintf(s.w, "None of %d clients behaved like a scanner\n", len(s.clients))
+		return
+	}
+	sort.Slice(scanners, func(i, j int) bool {
+		a, b := s.clients[scanners[i].ip], s.clients[scanners[j].ip]
+		if !a.first.Equal(b.first) {
+			return a.first.Before(b.first)
+		}
+		return scanners[i].ip < scanners[j].ip
+	})
+	fmt.Fprintf(s.w, "%d of %d clients behaved like scanners\n", len(scanners), len(s.clients))
+	for _, f := range scanners {
+		c := s.clients[f.ip]
+		fmt.Fprintf(s.w, "\n%s: %d requests, %d host and port pairs tried, %s to %s\n", f.ip, c.requests, len(c.targets),
+			c.first.Format(time.RFC3339), c.last.Format(time.RFC3339))
+		for _, e := range f.evidence {
+			fmt.Fprintf(s.w, "  - %s\n", e)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// SecretPattern is a named regular expression for a kind of secret. When
+// the expression has a capture group, the first group is the secret and the
+// rest of the match its context.
+type SecretPattern struct {
+	Name string
+	Re   *regexp.Regexp
+}
+
+// DefaultSecretPatterns are the secrets looked for without any being given.
+var DefaultSecretPatterns = []SecretPattern{
+	{"aws-access-key", regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`)},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws.{0,20}secret.{0,20}?["'=: ]+([A-Za-z0-9/+]{40})\b`)},
+	{"bearer-token", regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`)},
+	{"basic-auth", regexp.MustCompile(`(?i)\bbasic\s+([A-Za-z0-9+/]{8,}=*)`)},
+	{"jwt", regexp.MustCompile(`\b(eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*)`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{"github-token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,})\b`)},
+	{"slack-token", regexp.MustCompile(`\b(xox[abprs]-[A-Za-z0-9-]{10,})`)},
+	{"google-api-key", regexp.MustCompile(`\b(AIza[0-9A-Za-z_\-]{35})`)},
+	{"stripe-key", regexp.MustCompile(`\b([rs]k_live_[0-9A-Za-z]{24,})`)},
+	{"url-password", regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`)},
+	{"password", regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret|api_?key|access_?token|client_?secret)["']?\s*[=:]\s*["']?([^\s&"',;}]{4,})`)},
+}
+
+// ParseSecretPattern parses NAME=REGEXP.
+func ParseSecretPattern(s string) (SecretPattern, error) {
+	name, expr, ok := strings.Cut(s, "=")
+	if !ok || name == "" || expr == "" {
+		return SecretPattern{}, fmt.Errorf("secret pattern %q: want NAME=REGEXP", s)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return SecretPattern{}, fmt.Errorf("secret pattern %q: %w", s, err)
+	}
+	return SecretPattern{Name: name, Re: re}, nil
+}
+
+func (p SecretPattern) String() string {
+	return p.Name + "=" + p.Re.String()
+}
+
+// secretKey identifies a finding: the same secret found in the same place
+// again only adds to its count.
+type secretKey struct {
+	pattern, location, secret string
+}
+
+type secretFinding struct {
+	secretKey
+	count int64
+	first time.Time
+	flow  httpstream.Flow
+}
+
+// Secrets reports API keys, tokens and passwords found in request and
+// response headers, URLs and bodies. Secrets are masked in the output.
+type Secrets struct {
+	base
+	w        io.Writer
+	patterns []SecretPattern
+
+	mu       sync.Mutex
+	findings map[secretKey]*secretFinding
+}
+
+// NewSecrets returns a report looking for DefaultSecretPatterns and extra.
+func NewSecrets(w io.Writer, extra []SecretPattern) *Secrets {
+	return &Secrets{
+		w:        w,
+		patterns: append(append([]SecretPattern(nil), DefaultSecretPatterns...), extra...),
+		findings: make(map[secretKey]*secretFinding),
+	}
+}
+
+func (s *Secrets) HandleRequest(req *httpstream.Request) {
+	s.scan(&req.Message, "url", []byte(req.URL))
+	s.scanMessage(&req.Message, "request")
+}
+
+func (s *Secrets) HandleResponse(resp *httpstream.Response) {
+	s.scanMessage(&resp.Message, "response")
+}
+
+func (s *Secrets) scanMessage(m *httpstream.Message, kind string) {
+	for name, values := range m.Header {
+		for _, v := range values {
+			s.scan(m, "header "+name, []byte(name+": "+v))
+		}
+	}
+	body, _, err := m.DecodedBody()
+	if err != nil {
+		body = m.Body
+	}
+	s.scan(m, kind+" body", body)
+}
+
+func (s *Secrets) scan(m *httpstream.Message, location string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	for _, p := range s.patterns {
+		for _, match := range p.Re.FindAllSubmatchIndex(data, -1) {
+			start, end := match[0], match[1]
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			loc := location
+			if strings.HasSuffix(location, "body") {
+				loc = fmt.Sprintf("%s at %d", location, start)
+			}
+			s.add(m, secretKey{p.Name, loc, mask(string(data[start:end]))})
+		}
+	}
+}
+
+func (s *Secrets) add(m *httpstream.Message, key secretKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.findings[key]
+	if !ok {
+		f = &secretFinding{secretKey: key, first: m.Timestamp, flow: m.Flow}
+		s.findings[key] = f
+	}
+	f.count++
+	if m.Timestamp.Before(f.first) {
+		f.first, f.flow = m.Timestamp, m.Flow
+	}
+}
+
+// mask hides all but the ends of a secret, enough to tell secrets apart
+// without disclosing them.
+func mask(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return fmt.Sprintf("%s…%s (%d chars)", secret[:4], secret[len(secret)-2:], len(secret))
+}
+
+func (s *Secrets) HandleStats(analyzer.StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "\n=== Secrets ===\n")
+	if len(s.findings) == 0 {
+		fmt.Fprintln(s.w, "None found")
+		return
+	}
+	findings := make([]*secretFinding, 0, len(s.findings))
+	for _, f := range s.findings {
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if !findings[i].first.Equal(findings[j].first) {
+			return findings[i].first.Before(findings[j].first)
+		}
+		return findings[i].pattern < findings[j].pattern
+	})
+	t := newTable(s.w)
+	fmt.Fprintln(t, "FIRST SEEN\tPATTERN\tLOCATION\tCOUNT\tFLOW\tVALUE")
+	for _, f := range findings {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%s\t%s\n", f.first.Format(time.RFC3339), f.pattern, f.location, f.count, f.flow, f.secret)
+	}
+	t.Flush()
+}
@@ -0,0 +1,214 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// clientActivity is what the session report counts per client address.
+type clientActivity struct {
+	lookups, connections, requests int64
+	first, last                    time.Time
+	hosts                          map[string]struct{}
+}
+
+func (a *clientActivity) seen(ts time.Time) {
+	if a.first.IsZero() || ts.Before(a.first) {
+		a.first = ts
+	}
+	if ts.After(a.last) {
+		a.last = ts
+	}
+}
+
+// event is one entry of a client's timeline.
+type event struct {
+	Time time.Time `json:"time"`
+	// Type is dns-query, dns-answer, connect, reset, request or response.
+	Type string `json:"type"`
+	// Flow is the connection or DNS exchange, from the client's side.
+	Flow   string `json:"flow"`
+	Detail string `json:"detail"`
+}
+
+// Sessions groups activity by client address. It counts DNS lookups,
+// connections and requests for every client and, for one client if asked,
+// keeps a timeline of everything that client did.
+type Sessions struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	clients map[string]*clientActivity
+	// connecting holds connections whose SYN was seen, so retransmitted
+	// SYNs aren't counted again.
+	connecting map[string]struct{}
+
+	// Client selects the address whose timeline is kept.
+	Client string
+	// Export, if set, receives the timeline as JSON lines instead of the
+	// report.
+	Export io.Writer
+	events []event
+}
+
+func NewSessions(w io.Writer) *Sessions {
+	return &Sessions{
+		w:          w,
+		clients:    make(map[string]*clientActivity),
+		connecting: make(map[string]struct{}),
+	}
+}
+
+func (s *Sessions) client(ip string) *clientActivity {
+	a, ok := s.clients[ip]
+	if !ok {
+		a = &clientActivity{hosts: make(map[string]struct{})}
+		s.clients[ip] = a
+	}
+	return a
+}
+
+func (s *Sessions) HandlePacket(p *analyzer.Packet) {
+	tcp := p.TCP
+	if tcp == nil || !(tcp.SYN && !tcp.ACK || tcp.RST) {
+		return
+	}
+	src, dst := p.Network.Src().String(), p.Network.Dst().String()
+	flow := fmt.Sprintf("%s:%s -> %s:%s", src, p.Transport.Src(), dst, p.Transport.Dst())
+	ts := p.CaptureInfo.Timestamp
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tcp.SYN {
+		if _, ok := s.connecting[flow]; ok {
+			if src == s.Client {
+				s.events = append(s.events, event{ts, "connect", flow, "SYN retransmitted"})
+			}
+			return
+		}
+		s.connecting[flow] = struct{}{}
+		a := s.client(src)
+		a.connections++
+		a.seen(ts)
+		if src == s.Client {
+			s.events = append(s.events, event{ts, "connect", flow, ""})
+		}
+		return
+	}
+	// The client port may be reused once the connection is gone
+	delete(s.connecting, flow)
+	delete(s.connecting, fmt.Sprintf("%s:%s -> %s:%s", dst, p.Transport.Dst(), src, p.Transport.Src()))
+	switch s.Client {
+	case src:
+		s.events = append(s.events, event{ts, "reset", flow, "sent by client"})
+	case dst:
+		flow = fmt.Sprintf("%s:%s -> %s:%s", dst, p.Transport.Dst(), src, p.Transport.Src())
+		s.events = append(s.events, event{ts, "reset", flow, "sent by server"})
+	}
+}
+
+func (s *Sessions) HandleDNS(msg *dns.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !msg.Response {
+		a := s.client(msg.SrcIP)
+		a.lookups++
+		a.seen(msg.Timestamp)
+		if msg.SrcIP == s.Client {
+			s.events = append(s.events, event{msg.Timestamp, "dns-query", msg.SrcIP + " -> " + msg.DstIP,
+				msg.Question + " " + msg.QType})
+		}
+		return
+	}
+	if msg.DstIP == s.Client {
+		answers := "no answers"
+		if len(msg.Answers) > 0 {
+			var values []string
+			for _, rr := range msg.Answers {
+				values = append(values, rr.Type+" "+rr.Value)
+			}
+			answers = strings.Join(values, ", ")
+		}
+		s.events = append(s.events, event{msg.Timestamp, "dns-answer", msg.DstIP + " -> " + msg.SrcIP,
+			msg.Question + " = " + answers})
+	}
+}
+
+func (s *Sessions) HandleRequest(req *httpstream.Request) {
+	host, _ := hostPath(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.client(req.SrcIP)
+	a.requests++
+	a.seen(req.Timestamp)
+	a.hosts[host] = struct{}{}
+	if req.SrcIP == s.Client {
+		s.events = append(s.events, event{req.Timestamp, "request", req.Flow.String(), req.Method + " " + req.URL})
+	}
+}
+
+func (s *Sessions) HandleResponse(resp *httpstream.Response) {
+	if resp.DstIP != s.Client || s.Client == "" {
+		return
+	}
+	detail := fmt.Sprintf("%s (%d bytes)", resp.Status, resp.BodySize)
+	if resp.Request != nil {
+		detail = fmt.Sprintf("%s for %s %s (%d bytes in %s)", resp.Status, resp.Request.Method, resp.Request.URL,
+			resp.BodySize, formatDuration(resp.Timestamp.Sub(resp.Request.Timestamp)))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event{resp.Timestamp, "response", resp.Flow.Reverse().String(), detail})
+}
+
+func (s *Sessions) HandleStats(analyzer.StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) > 0 {
+		activity := make(counter, len(s.clients))
+		for ip, a := range s.clients {
+			activity[ip] = a.lookups + a.connections + a.requests
+		}
+		fmt.Fprintf(s.w, "\n=== Clients ===\n")
+		t := newTable(s.w)
+		fmt.Fprintln(t, "CLIENT\tDNS LOOKUPS\tCONNECTIONS\tREQUESTS\tHOSTS\tFIRST SEEN\tLAST SEEN")
+		for _, e := range activity.top(0) {
+			a := s.clients[e.key]
+			fmt.Fprintf(t, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", e.key, a.lookups, a.connections, a.requests,
+				len(a.hosts), a.first.Format(time.RFC3339), a.last.Format(time.RFC3339))
+		}
+		t.Flush()
+	}
+
+	if s.Client == "" {
+		return
+	}
+	// Streams are parsed concurrently, so put events back in capture order
+	sort.SliceStable(s.events, func(i, j int) bool { return s.events[i].Time.Before(s.events[j].Time) })
+	if s.Export != nil {
+		enc := json.NewEncoder(s.Export)
+		enc.SetEscapeHTML(false)
+		for _, e := range s.events {
+			enc.Encode(e)
+		}
+		return
+	}
+	fmt.Fprintf(s.w, "\n=== Timeline of %s ===\n", s.Client)
+	t := newTable(s.w)
+	fmt.Fprintln(t, "TIME\tEVENT\tFLOW\tDETAIL")
+	for _, e := range s.events {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", e.Time.Format("2006-01-02 15:04:05.000"), e.Type, e.Flow, e.Detail)
+	}
+	t.Flush()
+}
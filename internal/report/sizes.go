@@ -0,0 +1,130 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// sizeBuckets are the histogram buckets: empty bodies, then bodies below
+// each limit. A last bucket holds everything larger.
+var sizeBuckets = [...]struct {
+	limit int64
+	label string
+}{
+	{0, "0"},
+	{1 << 10, "<1K"},
+	{10 << 10, "<10K"},
+	{100 << 10, "<100K"},
+	{1 << 20, "<1M"},
+	{10 << 20, "<10M"},
+}
+
+// sizeHistogram counts response bodies by size.
+type sizeHistogram struct {
+	buckets    [len(sizeBuckets) + 1]int64
+	sizes      []int64
+	compressed int64
+}
+
+func (h *sizeHistogram) add(size int64, compressed bool) {
+	i := 0
+	if size > 0 {
+		i = 1
+		for i < len(sizeBuckets) && size >= sizeBuckets[i].limit {
+			i++
+		}
+	}
+	h.buckets[i]++
+	h.sizes = append(h.sizes, size)
+	if compressed {
+		h.compressed++
+	}
+}
+
+// Sizes reports the distribution of response body sizes, as transferred,
+// per content type and per endpoint.
+type Sizes struct {
+	base
+	w  io.Writer
+	n  int
+	mu sync.Mutex
+
+	contentTypes map[string]*sizeHistogram
+	endpoints    map[string]*sizeHistogram
+}
+
+// NewSizes returns a report listing every content type and the n busiest
+// endpoints.
+func NewSizes(w io.Writer, n int) *Sizes {
+	return &Sizes{
+		w:            w,
+		n:            n,
+		contentTypes: make(map[string]*sizeHistogram),
+		endpoints:    make(map[string]*sizeHistogram),
+	}
+}
+
+func (s *Sizes) HandleResponse(resp *httpstream.Response) {
+	compressed := resp.Header.Get("Content-Encoding") != ""
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	histogram(s.contentTypes, contentType(resp)).add(resp.BodySize, compressed)
+	if resp.Request != nil {
+		host, path := hostPath(resp.Request)
+		histogram(s.endpoints, host+path).add(resp.BodySize, compressed)
+	}
+}
+
+func histogram(m map[string]*sizeHistogram, key string) *sizeHistogram {
+	h, ok := m[key]
+	if !ok {
+		h = &sizeHistogram{}
+		m[key] = h
+	}
+	return h
+}
+
+func (s *Sizes) HandleStats(analyzer.StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.print("Response Sizes by Content Type", "CONTENT TYPE", s.contentTypes, 0)
+	s.print(fmt.Sprintf("Response Sizes by Endpoint (top %d)", s.n), "ENDPOINT", s.endpoints, s.n)
+}
+
+// print writes a histogram per key, busiest first, limited to n keys unless
+// n is zero.
+func (s *Sizes) print(title, column string, histograms map[string]*sizeHistogram, n int) {
+	if len(histograms) == 0 {
+		return
+	}
+	counts := make(counter, len(histograms))
+	for key, h := range histograms {
+		counts[key] = int64(len(h.sizes))
+	}
+
+	fmt.Fprintf(s.w, "\n=== %s ===\n", title)
+	t := newTable(s.w)
+	fmt.Fprintf(t, "%s\tCOUNT", column)
+	for _, b := range sizeBuckets {
+		fmt.Fprintf(t, "\t%s", b.label)
+	}
+	fmt.Fprintf(t, "\t>=10M\tMEDIAN\tMAX\tCOMPRESSED\n")
+	for _, e := range counts.top(n) {
+		h := histograms[e.key]
+		fmt.Fprintf(t, "%s\t%d", e.key, e.count)
+		for _, c := range h.buckets {
+			fmt.Fprintf(t, "\t%d", c)
+		}
+		sort.Slice(h.sizes, func(i, j int) bool { return h.sizes[i] < h.sizes[j] })
+		fmt.Fprintf(t, "\t%s\t%s\t%.0f%%\n",
+			formatBytes(h.sizes[(len(h.sizes)-1)/2]),
+			formatBytes(h.sizes[len(h.sizes)-1]),
+			100*float64(h.compressed)/float64(e.count))
+	}
+	t.Flush()
+}
@@ -0,0 +1,286 @@
+package report
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/filetype"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/protoid"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// topContentTypes is how many content types the summary lists.
+const topContentTypes = 10
+
+// Summary reports totals for the whole capture: transactions by method,
+// status class and content type, traffic by direction and by protocol, and
+// the time the capture covers. Executables, scripts and archives transferred are listed
+// one by one.
+type Summary struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+	// IdleTimeout, if set, has flows that have seen no packets for this
+	// long, in capture time, added to the protocol totals and forgotten, so
+	// that only the flows still active are kept. A flow that carries on
+	// after that is counted again.
+	IdleTimeout time.Duration
+
+	first, last time.Time
+	// Traffic is split by direction guessing that the endpoint with the
+	// lower port is the server, which holds for ephemeral client ports.
+	toServer, toClient               int64
+	toServerPackets, toClientPackets int64
+
+	requests, unanswered int64
+	methods              counter
+	statuses             counter
+	contentTypes         counter
+	contentBytes         counter
+	binaries             []binaryTransfer
+	// flows identifies the protocol of every TCP and UDP flow, HTTP or not,
+	// and the totals by protocol hold the flows forgotten for IdleTimeout.
+	flows                                map[stream.FlowID]*protoFlow
+	protoFlows, protoBytes, protoPackets counter
+	nextSweep                            time.Time
+}
+
+// protoFlow is a flow's traffic and what it was identified as.
+type protoFlow struct {
+	id      protoid.Flow
+	tcp     bool
+	bytes   int64
+	packets int64
+	last    time.Time
+}
+
+// binaryTransfer is an executable, script or archive seen in a body.
+type binaryTransfer struct {
+	time      time.Time
+	direction string
+	typ       string
+	declared  string
+	size      int64
+	url       string
+	sha256    string
+}
+
+func NewSummary(w io.Writer) *Summary {
+	return &Summary{
+		w:            w,
+		methods:      make(counter),
+		statuses:     make(counter),
+		contentTypes: make(counter),
+		contentBytes: make(counter),
+		flows:        make(map[stream.FlowID]*protoFlow),
+		protoFlows:   make(counter),
+		protoBytes:   make(counter),
+		protoPackets: make(counter),
+	}
+}
+
+func (s *Summary) HandlePacket(p *analyzer.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := p.CaptureInfo.Timestamp
+	if s.first.IsZero() || ts.Before(s.first) {
+		s.first = ts
+	}
+	if ts.After(s.last) {
+		s.last = ts
+	}
+	key := stream.NewFlowID(p.Network, p.Transport)
+	f, ok := s.flows[key]
+	if !ok {
+		f = &protoFlow{tcp: p.TCP != nil}
+		s.flows[key] = f
+	}
+	srcPort, dstPort := ports(p)
+	f.id.Add(f.tcp, srcPort, dstPort, p.Payload)
+	f.bytes += int64(p.CaptureInfo.Length)
+	f.packets++
+	f.last = ts
+	if s.IdleTimeout > 0 {
+		if s.nextSweep.IsZero() {
+			s.nextSweep = ts.Add(s.IdleTimeout)
+		} else if !ts.Before(s.nextSweep) {
+			s.forgetIdle(ts.Add(-s.IdleTimeout))
+			s.nextSweep = ts.Add(s.IdleTimeout)
+		}
+	}
+
+	src, dst := p.Transport.Endpoints()
+	if src.LessThan(dst) {
+		s.toClient += int64(p.CaptureInfo.Length)
+		s.toClientPackets++
+	} else {
+		s.toServer += int64(p.CaptureInfo.Length)
+		s.toServerPackets++
+	}
+}
+
+// forgetIdle adds the flows that have seen no packets since before to the
+// protocol totals and forgets them.
+func (s *Summary) forgetIdle(before time.Time) {
+	for key, f := range s.flows {
+		if f.last.Before(before) {
+			s.addProtoTotals(f)
+			delete(s.flows, key)
+		}
+	}
+}
+
+func (s *Summary) addProtoTotals(f *protoFlow) {
+	name := f.id.Name(f.tcp)
+	s.protoFlows[name]++
+	s.protoBytes[name] += f.bytes
+	s.protoPackets[name] += f.packets
+}
+
+func (s *Summary) HandleRequest(req *httpstream.Request) {
+	b, binary := detectBinary(&req.Message, "upload", req.URL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.unanswered++
+	s.methods[req.Method]++
+	if binary {
+		s.binaries = append(s.binaries, b)
+	}
+}
+
+func (s *Summary) HandleResponse(resp *httpstream.Response) {
+	url := ""
+	if resp.Request != nil {
+		url = resp.Request.URL
+	}
+	b, binary := detectBinary(&resp.Message, "download", url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp.Request != nil {
+		s.unanswered--
+	}
+	s.statuses[fmt.Sprintf("%dxx", resp.StatusCode/100)]++
+	contentType := contentType(resp)
+	s.contentTypes[contentType]++
+	s.contentBytes[contentType] += resp.BodySize
+	if binary {
+		s.binaries = append(s.binaries, b)
+	}
+}
+
+// detectBinary recognises a body by its content and hashes it, unless only
+// part of it was kept.
+func detectBinary(m *httpstream.Message, direction, url string) (binaryTransfer, bool) {
+	if m.BodySize == 0 {
+		return binaryTransfer{}, false
+	}
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(m.DecodedReader(), head)
+	typ, ok := filetype.Detect(head[:n])
+	if !ok {
+		return binaryTransfer{}, false
+	}
+	b := binaryTransfer{
+		time:      m.Timestamp,
+		direction: direction,
+		typ:       typ.Name,
+		declared:  m.Header.Get("Content-Type"),
+		size:      m.BodySize,
+		url:       url,
+		sha256:    "-",
+	}
+	switch {
+	case m.SHA256 != "":
+		b.sha256 = m.SHA256
+	case !m.Truncated():
+		h := sha256.New()
+		if size, err := io.Copy(h, m.DecodedReader()); err == nil {
+			b.sha256, b.size = hex.EncodeToString(h.Sum(nil)), size
+		}
+	}
+	if b.declared == "" {
+		b.declared = "(none)"
+	}
+	return b, true
+}
+
+func (s *Summary) HandleStats(analyzer.StatsSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.w, "\n=== Traffic Summary ===\n")
+	t := newTable(s.w)
+	if !s.first.IsZero() {
+		fmt.Fprintf(t, "Capture:\t%s to %s (%s)\n",
+			s.first.Format(time.RFC3339), s.last.Format(time.RFC3339), s.last.Sub(s.first).Round(time.Millisecond))
+	}
+	fmt.Fprintf(t, "Transactions:\t%d (%d without response)\n", s.requests, s.unanswered)
+	fmt.Fprintf(t, "Client to server:\t%s in %d packets\n", formatBytes(s.toServer), s.toServerPackets)
+	fmt.Fprintf(t, "Server to client:\t%s in %d packets\n", formatBytes(s.toClient), s.toClientPackets)
+	t.Flush()
+
+	for _, f := range s.flows {
+		s.addProtoTotals(f)
+	}
+	s.flows = make(map[stream.FlowID]*protoFlow)
+	if len(s.protoFlows) > 0 {
+		var total int64
+		for _, n := range s.protoBytes {
+			total += n
+		}
+		fmt.Fprintln(s.w)
+		t = newTable(s.w)
+		fmt.Fprintln(t, "PROTOCOL\tFLOWS\tPACKETS\tBYTES\tSHARE")
+		for _, e := range s.protoBytes.top(0) {
+			fmt.Fprintf(t, "%s\t%d\t%d\t%s\t%.1f%%\n", e.key, s.protoFlows[e.key], s.protoPackets[e.key], formatBytes(e.count),
+				100*float64(e.count)/float64(max(total, 1)))
+		}
+		t.Flush()
+	}
+	if len(s.methods) > 0 {
+		fmt.Fprintln(s.w)
+		t = newTable(s.w)
+		fmt.Fprintln(t, "METHOD\tREQUESTS")
+		for _, e := range s.methods.top(0) {
+			fmt.Fprintf(t, "%s\t%d\n", e.key, e.count)
+		}
+		t.Flush()
+	}
+	if len(s.statuses) > 0 {
+		fmt.Fprintln(s.w)
+		t = newTable(s.w)
+		fmt.Fprintln(t, "STATUS\tRESPONSES")
+		for _, e := range s.statuses.top(0) {
+			fmt.Fprintf(t, "%s\t%d\n", e.key, e.count)
+		}
+		t.Flush()
+	}
+	if len(s.contentTypes) > 0 {
+		fmt.Fprintln(s.w)
+		t = newTable(s.w)
+		fmt.Fprintln(t, "CONTENT TYPE\tRESPONSES\tBODY BYTES")
+		for _, e := range s.contentTypes.top(topContentTypes) {
+			fmt.Fprintf(t, "%s\t%d\t%s\n", e.key, e.count, formatBytes(s.contentBytes[e.key]))
+		}
+		t.Flush()
+	}
+	if len(s.binaries) > 0 {
+		sort.Slice(s.binaries, func(i, j int) bool { return s.binaries[i].time.Before(s.binaries[j].time) })
+		fmt.Fprintln(s.w)
+		t = newTable(s.w)
+		fmt.Fprintln(t, "BINARY TRANSFER\tTIME\tTYPE\tDECLARED AS\tSIZE\tURL\tSHA-256")
+		for _, b := range s.binaries {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.direction, b.time.Format(time.RFC3339), b.typ,
+				b.declared, formatBytes(b.size), b.url, b.sha256)
+		}
+		t.Flush()
+	}
+}
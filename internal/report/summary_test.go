@@ -0,0 +1,100 @@
+package report
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// udpPacket returns a datagram from port of 10.0.0.1 to port 53 of
+// 10.0.0.2, or the reply if reply is set.
+func udpPacket(port uint16, ts time.Time, reply bool) *analyzer.Packet {
+	p := &analyzer.Packet{
+		CaptureInfo: gopacket.CaptureInfo{Timestamp: ts, Length: 100, CaptureLength: 100},
+		Network:     gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}),
+		Transport:   gopacket.NewFlow(layers.EndpointUDPPort, binary.BigEndian.AppendUint16(nil, port), []byte{0, 53}),
+		Payload:     []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0},
+	}
+	if reply {
+		p.Network, p.Transport = p.Network.Reverse(), p.Transport.Reverse()
+	}
+	return p
+}
+
+func TestSummaryFlows(t *testing.T) {
+	s := NewSummary(io.Discard)
+	start := time.Unix(1700000000, 0)
+	s.HandlePacket(udpPacket(40000, start, false))
+	s.HandlePacket(udpPacket(40000, start, true))
+	s.HandlePacket(udpPacket(40001, start, false))
+	if len(s.flows) != 2 {
+		t.Errorf("got %d flows, want 2: a query and its reply are one flow", len(s.flows))
+	}
+
+	// Packets of a flow already seen are counted without allocating
+	p := udpPacket(40000, start, true)
+	if n := testing.AllocsPerRun(100, func() { s.HandlePacket(p) }); n != 0 {
+		t.Errorf("HandlePacket allocated %v times per packet", n)
+	}
+}
+
+// handleFlows hands s one datagram each of n flows, a millisecond apart,
+// returning the most flows s held at once.
+func handleFlows(s *Summary, n int, start time.Time) int {
+	most := 0
+	for i := 0; i < n; i++ {
+		p := udpPacket(uint16(1024+i%60000), start.Add(time.Duration(i)*time.Millisecond), false)
+		// Ports alone would repeat, so the client address counts on
+		p.Network = gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 1, byte(i >> 16), byte(i >> 8)}, []byte{10, 0, 0, 2})
+		s.HandlePacket(p)
+		most = max(most, len(s.flows))
+	}
+	return most
+}
+
+func TestSummaryForgetsIdleFlows(t *testing.T) {
+	const n = 200000
+	start := time.Unix(1700000000, 0)
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	s := NewSummary(io.Discard)
+	s.IdleTimeout = time.Second
+	before := heap()
+	most := handleFlows(s, n, start)
+	grown := int64(heap()) - int64(before)
+	runtime.KeepAlive(s)
+	// A thousand flows start each second, and each is kept for at most
+	// two timeouts
+	if most > 2100 {
+		t.Errorf("held %d flows at once, want at most 2100", most)
+	}
+	if grown > 4<<20 {
+		t.Errorf("heap grew by %d bytes over %d flows", grown, n)
+	}
+
+	s.HandleStats(analyzer.StatsSnapshot{})
+	var flows int64
+	for _, c := range s.protoFlows {
+		flows += c
+	}
+	if flows != n {
+		t.Errorf("counted %d flows, want %d", flows, n)
+	}
+
+	// Without the timeout, every flow is kept until the end
+	s = NewSummary(io.Discard)
+	if most := handleFlows(s, n, start); most != n {
+		t.Errorf("held %d flows without a timeout, want %d", most, n)
+	}
+}
@@ -0,0 +1,81 @@
+package report
+
+import "strings"
+
+// Placeholders for the path segments templating collapses.
+const (
+	placeholderID   = "{id}"
+	placeholderUUID = "{uuid}"
+	placeholderHash = "{hash}"
+)
+
+// minHashLen is the shortest hex segment taken for a hash or object ID
+// rather than a word such as "cafe" or "deadbeef".
+const minHashLen = 16
+
+// PathTemplate collapses the segments of path that identify a resource
+// rather than an endpoint, so /users/42/orders and /users/7/orders both
+// become /users/{id}/orders. Numbers become {id}, UUIDs {uuid}, and long hex
+// strings such as digests and object IDs {hash}.
+func PathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		switch {
+		case seg == "":
+		case isNumber(seg):
+			segments[i] = placeholderID
+		case isUUID(seg):
+			segments[i] = placeholderUUID
+		case len(seg) >= minHashLen && isHex(seg):
+			segments[i] = placeholderHash
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isNumber(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isHex reports whether s is all hex digits with at least one decimal
+// digit, since a long run of a-f alone is more likely a word.
+func isHex(s string) bool {
+	digit := false
+	for i := 0; i < len(s); i++ {
+		if !isHexDigit(s[i]) {
+			return false
+		}
+		if s[i] <= '9' {
+			digit = true
+		}
+	}
+	return digit
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isUUID reports whether s has the 8-4-4-4-12 form of a UUID.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if s[i] != '-' {
+				return false
+			}
+			continue
+		}
+		if !isHexDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
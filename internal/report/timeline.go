@@ -0,0 +1,136 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// timelineBarWidth is the width of the request bars at the busiest bucket.
+const timelineBarWidth = 40
+
+// timelineBucket is the traffic in one interval.
+type timelineBucket struct {
+	requests, errors int64
+	bytes, packets   int64
+}
+
+// Timeline reports traffic over time in fixed buckets: requests started,
+// 4xx and 5xx responses and packet bytes on the wire. Buckets without
+// traffic between the first and last are included, so the shape of the
+// traffic shows.
+type Timeline struct {
+	base
+	w        io.Writer
+	interval time.Duration
+	mu       sync.Mutex
+
+	buckets map[int64]*timelineBucket
+
+	// CSV, if set, receives the series as CSV instead of the report.
+	CSV io.Writer
+}
+
+func NewTimeline(w io.Writer, interval time.Duration) *Timeline {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Timeline{w: w, interval: interval, buckets: make(map[int64]*timelineBucket)}
+}
+
+func (t *Timeline) bucket(ts time.Time) *timelineBucket {
+	i := ts.UnixNano() / int64(t.interval)
+	b, ok := t.buckets[i]
+	if !ok {
+		b = &timelineBucket{}
+		t.buckets[i] = b
+	}
+	return b
+}
+
+func (t *Timeline) HandlePacket(p *analyzer.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(p.CaptureInfo.Timestamp)
+	b.bytes += int64(p.CaptureInfo.Length)
+	b.packets++
+}
+
+func (t *Timeline) HandleRequest(req *httpstream.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bucket(req.Timestamp).requests++
+}
+
+func (t *Timeline) HandleResponse(resp *httpstream.Response) {
+	if resp.StatusCode < 400 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bucket(resp.Timestamp).errors++
+}
+
+func (t *Timeline) HandleStats(analyzer.StatsSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.buckets) == 0 {
+		return
+	}
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	var busiest int64
+	for i, b := range t.buckets {
+		if i < first {
+			first = i
+		}
+		if i > last {
+			last = i
+		}
+		busiest = max(busiest, b.requests)
+	}
+
+	if t.CSV != nil {
+		w := csv.NewWriter(t.CSV)
+		w.Write([]string{"time", "requests", "errors", "bytes", "packets"})
+		for i := first; i <= last; i++ {
+			b := t.buckets[i]
+			if b == nil {
+				b = &timelineBucket{}
+			}
+			w.Write([]string{
+				time.Unix(0, i*int64(t.interval)).UTC().Format(time.RFC3339Nano),
+				strconv.FormatInt(b.requests, 10),
+				strconv.FormatInt(b.errors, 10),
+				strconv.FormatInt(b.bytes, 10),
+				strconv.FormatInt(b.packets, 10),
+			})
+		}
+		w.Flush()
+		return
+	}
+
+	fmt.Fprintf(t.w, "\n=== Timeline (%s buckets) ===\n", t.interval)
+	tw := newTable(t.w)
+	fmt.Fprintln(tw, "TIME\tREQUESTS\tERRORS\tBYTES")
+	for i := first; i <= last; i++ {
+		b := t.buckets[i]
+		if b == nil {
+			b = &timelineBucket{}
+		}
+		bar := ""
+		if busiest > 0 {
+			bar = strings.Repeat("#", int((b.requests*timelineBarWidth+busiest-1)/busiest))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", time.Unix(0, i*int64(t.interval)).UTC().Format("2006-01-02 15:04:05.000"),
+			b.requests, b.errors, formatBytes(b.bytes), bar)
+	}
+	tw.Flush()
+}
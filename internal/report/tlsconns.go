@@ -0,0 +1,132 @@
+package report
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/fingerprint"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// handshakeConn is what the hellos of one TLS connection said.
+type handshakeConn struct {
+	first          time.Time
+	client, server string
+	hello          *fingerprint.ClientHello
+	reply          *fingerprint.ServerHello
+}
+
+// TLSConns reports the handshake of every TLS connection: the server name
+// (SNI) the client asked for, the version and cipher suite the server
+// chose, the application protocols (ALPN) offered and chosen, and the
+// cipher suites each client offered. None of it needs the traffic to be
+// decrypted, so it tells which hosts HTTPS connections were for.
+type TLSConns struct {
+	base
+	w io.Writer
+
+	mu    sync.Mutex
+	tls   *fingerprint.Hellos
+	conns []*handshakeConn
+	open  map[string]*handshakeConn
+}
+
+func NewTLSConns(w io.Writer) *TLSConns {
+	return &TLSConns{
+		w:    w,
+		tls:  fingerprint.NewHellos(),
+		open: make(map[string]*handshakeConn),
+	}
+}
+
+// conn returns the latest connection from client to server, both as
+// ip:port, starting one when there is none or fresh is set.
+func (t *TLSConns) conn(client, server string, ts time.Time, fresh bool) *handshakeConn {
+	key := client + " " + server
+	c, ok := t.open[key]
+	if !ok || fresh {
+		c = &handshakeConn{first: ts, client: client, server: server}
+		t.open[key] = c
+		t.conns = append(t.conns, c)
+	}
+	return c
+}
+
+func (t *TLSConns) HandlePacket(p *analyzer.Packet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, server := t.tls.Packet(p)
+	src := p.Network.Src().String() + ":" + p.Transport.Src().String()
+	dst := p.Network.Dst().String() + ":" + p.Transport.Dst().String()
+	switch {
+	case client != nil:
+		t.conn(src, dst, p.CaptureInfo.Timestamp, true).hello = client
+	case server != nil:
+		t.conn(dst, src, p.CaptureInfo.Timestamp, false).reply = server
+	}
+}
+
+func (t *TLSConns) HandleStats(analyzer.StatsSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "\n=== TLS Connections ===\n")
+	if len(t.conns) == 0 {
+		fmt.Fprintf(t.w, "No TLS handshakes seen\n")
+		return
+	}
+	sort.SliceStable(t.conns, func(i, j int) bool { return t.conns[i].first.Before(t.conns[j].first) })
+
+	// Clients offer the same suites on every connection, so each distinct
+	// list is printed once, below, and referred to by number
+	offers := make(map[string]int)
+	var offerLists []string
+	var replies int
+	tw := newTable(t.w)
+	fmt.Fprintln(tw, "FIRST SEEN\tCLIENT\tSERVER\tSNI\tVERSION\tCIPHER\tALPN\tOFFERED ALPN\tOFFERED CIPHERS")
+	for _, c := range t.conns {
+		sni, version, cipher, alpn, offeredALPN, offered := "-", "-", "-", "-", "-", "-"
+		if c.hello != nil {
+			if c.hello.SNI != "" {
+				sni = c.hello.SNI
+			}
+			if len(c.hello.ALPN) > 0 {
+				offeredALPN = strings.Join(c.hello.ALPN, ",")
+			}
+			names := make([]string, len(c.hello.Ciphers))
+			for i, id := range c.hello.Ciphers {
+				names[i] = tls.CipherSuiteName(id)
+			}
+			list := strings.Join(names, ", ")
+			n, ok := offers[list]
+			if !ok {
+				offerLists = append(offerLists, list)
+				n = len(offerLists)
+				offers[list] = n
+			}
+			offered = fmt.Sprintf("%d suites [%d]", len(names), n)
+		}
+		if c.reply != nil {
+			replies++
+			version = fingerprint.VersionName(c.reply.Version)
+			cipher = tls.CipherSuiteName(c.reply.Cipher)
+			if c.reply.ALPN != "" {
+				alpn = c.reply.ALPN
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.first.Format(time.RFC3339), c.client, c.server,
+			sni, version, cipher, alpn, offeredALPN, offered)
+	}
+	tw.Flush()
+	fmt.Fprintf(t.w, "%d TLS connections, %d with the server's hello\n", len(t.conns), replies)
+	if len(offerLists) > 0 {
+		fmt.Fprintf(t.w, "\nOffered cipher suites:\n")
+		for i, list := range offerLists {
+			fmt.Fprintf(t.w, "  [%d] %s\n", i+1, list)
+		}
+	}
+}
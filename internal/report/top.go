@@ -0,0 +1,111 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Top reports the most-requested hosts, paths and client addresses, each
+// by request count and by body bytes transferred in both directions.
+type Top struct {
+	base
+	w  io.Writer
+	n  int
+	mu sync.Mutex
+
+	hosts, paths, clients             counter
+	hostBytes, pathBytes, clientBytes counter
+}
+
+// NewTop returns a report listing the n busiest entries of each table.
+func NewTop(w io.Writer, n int) *Top {
+	return &Top{
+		w:           w,
+		n:           n,
+		hosts:       make(counter),
+		paths:       make(counter),
+		clients:     make(counter),
+		hostBytes:   make(counter),
+		pathBytes:   make(counter),
+		clientBytes: make(counter),
+	}
+}
+
+func (t *Top) HandleRequest(req *httpstream.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	host, path := hostPath(req)
+	t.hosts[host]++
+	t.paths[path]++
+	t.clients[req.SrcIP]++
+	t.addBytes(req, req.BodySize)
+}
+
+func (t *Top) HandleResponse(resp *httpstream.Response) {
+	if resp.Request == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addBytes(resp.Request, resp.BodySize)
+}
+
+func (t *Top) addBytes(req *httpstream.Request, n int64) {
+	host, path := hostPath(req)
+	t.hostBytes[host] += n
+	t.pathBytes[path] += n
+	t.clientBytes[req.SrcIP] += n
+}
+
+func (t *Top) HandleStats(analyzer.StatsSnapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.print("hosts", "HOST", t.hosts, t.hostBytes)
+	t.print("paths", "PATH", t.paths, t.pathBytes)
+	t.print("clients", "CLIENT", t.clients, t.clientBytes)
+}
+
+// print writes the busiest keys by request count and then by bytes.
+func (t *Top) print(title, column string, requests, bytes counter) {
+	if len(requests) == 0 {
+		return
+	}
+	fmt.Fprintf(t.w, "\n=== Top %d %s by requests ===\n", t.n, title)
+	tw := newTable(t.w)
+	fmt.Fprintf(tw, "%s\tREQUESTS\tBYTES\n", column)
+	for _, e := range requests.top(t.n) {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", e.key, e.count, formatBytes(bytes[e.key]))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(t.w, "\n=== Top %d %s by bytes ===\n", t.n, title)
+	tw = newTable(t.w)
+	fmt.Fprintf(tw, "%s\tBYTES\tREQUESTS\n", column)
+	for _, e := range bytes.top(t.n) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", e.key, formatBytes(e.count), requests[e.key])
+	}
+	tw.Flush()
+}
+
+// hostPath returns the host a request was sent to, falling back to the
+// server address without a Host header, and the template of its path
+// without the query.
+func hostPath(req *httpstream.Request) (host, path string) {
+	host = req.Host
+	if host == "" {
+		host = req.DstIP
+	}
+	path = req.URI
+	if u, err := url.ParseRequestURI(req.URI); err == nil {
+		path = u.EscapedPath()
+	}
+	if path == "" {
+		path = "/"
+	}
+	return host, PathTemplate(path)
+}
@@ -0,0 +1,77 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// userAgent is what the inventory keeps of one User-Agent string.
+type userAgent struct {
+	first, last time.Time
+	clients     map[string]struct{}
+}
+
+// UserAgents reports every distinct User-Agent with how often and by how
+// many client addresses it was sent, and when it was first and last seen.
+type UserAgents struct {
+	base
+	w  io.Writer
+	mu sync.Mutex
+
+	requests counter
+	agents   map[string]*userAgent
+}
+
+func NewUserAgents(w io.Writer) *UserAgents {
+	return &UserAgents{
+		w:        w,
+		requests: make(counter),
+		agents:   make(map[string]*userAgent),
+	}
+}
+
+func (u *UserAgents) HandleRequest(req *httpstream.Request) {
+	ua := req.Header.Get("User-Agent")
+	if ua == "" {
+		ua = "(none)"
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requests[ua]++
+	a, ok := u.agents[ua]
+	if !ok {
+		a = &userAgent{first: req.Timestamp, last: req.Timestamp, clients: make(map[string]struct{})}
+		u.agents[ua] = a
+	}
+	// Streams are parsed concurrently, so requests arrive out of order
+	if req.Timestamp.Before(a.first) {
+		a.first = req.Timestamp
+	}
+	if req.Timestamp.After(a.last) {
+		a.last = req.Timestamp
+	}
+	a.clients[req.SrcIP] = struct{}{}
+}
+
+func (u *UserAgents) HandleStats(analyzer.StatsSnapshot) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.agents) == 0 {
+		return
+	}
+	fmt.Fprintf(u.w, "\n=== User Agents ===\n")
+	t := newTable(u.w)
+	// User agents go last as they vary so much in length
+	fmt.Fprintln(t, "REQUESTS\tCLIENTS\tFIRST SEEN\tLAST SEEN\tUSER AGENT")
+	for _, e := range u.requests.top(0) {
+		a := u.agents[e.key]
+		fmt.Fprintf(t, "%d\t%d\t%s\t%s\t%s\n", e.count, len(a.clients),
+			a.first.Format(time.RFC3339), a.last.Format(time.RFC3339), e.key)
+	}
+	t.Flush()
+}
@@ -0,0 +1,364 @@
+package rules
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// transaction is what a rule is checked against: an HTTP request and maybe
+// its response, or a DNS query name.
+type transaction struct {
+	req   *httpstream.Request
+	resp  *httpstream.Response
+	query string
+}
+
+// side returns the message a direction-dependent buffer such as http.header
+// reads from: the response for rules inspecting the server's side.
+func (t *transaction) side(response bool) *httpstream.Message {
+	switch {
+	case response && t.resp != nil:
+		return &t.resp.Message
+	case !response && t.req != nil:
+		return &t.req.Message
+	}
+	return nil
+}
+
+// bufferOf extracts each supported buffer from a transaction. The boolean
+// reports whether the buffer exists; rules can't match missing buffers.
+var bufferOf = map[string]func(t *transaction, response bool) ([]byte, bool){
+	"http.uri": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil {
+			return nil, false
+		}
+		uri := t.req.URI
+		if u, err := url.PathUnescape(uri); err == nil {
+			uri = u
+		}
+		return []byte(uri), true
+	},
+	"http.uri.raw": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil {
+			return nil, false
+		}
+		return []byte(t.req.URI), true
+	},
+	"http.method": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil {
+			return nil, false
+		}
+		return []byte(t.req.Method), true
+	},
+	"http.request_line": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil {
+			return nil, false
+		}
+		return []byte(t.req.Method + " " + t.req.URI + " " + t.req.Proto), true
+	},
+	"http.host": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil || t.req.Host == "" {
+			return nil, false
+		}
+		host := t.req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return []byte(strings.ToLower(host)), true
+	},
+	"http.host.raw": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil || t.req.Host == "" {
+			return nil, false
+		}
+		return []byte(t.req.Host), true
+	},
+	"http.cookie":       requestHeader("Cookie"),
+	"http.user_agent":   requestHeader("User-Agent"),
+	"http.referer":      requestHeader("Referer"),
+	"http.accept":       requestHeader("Accept"),
+	"http.accept_lang":  requestHeader("Accept-Language"),
+	"http.accept_enc":   requestHeader("Accept-Encoding"),
+	"http.connection":   eitherHeader("Connection"),
+	"http.content_type": eitherHeader("Content-Type"),
+	"http.content_len":  eitherHeader("Content-Length"),
+	"http.server":       responseHeader("Server"),
+	"http.location":     responseHeader("Location"),
+	"http.request_body": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil || len(t.req.Body) == 0 {
+			return nil, false
+		}
+		body, _, _ := t.req.DecodedBody()
+		return body, true
+	},
+	"http.response_body": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.resp == nil || len(t.resp.Body) == 0 {
+			return nil, false
+		}
+		body, _, _ := t.resp.DecodedBody()
+		return body, true
+	},
+	"http.stat_code": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.resp == nil {
+			return nil, false
+		}
+		return []byte(strconv.Itoa(t.resp.StatusCode)), true
+	},
+	"http.stat_msg": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.resp == nil {
+			return nil, false
+		}
+		_, msg, _ := strings.Cut(t.resp.Status, " ")
+		return []byte(msg), true
+	},
+	"http.response_line": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.resp == nil {
+			return nil, false
+		}
+		return []byte(t.resp.Proto + " " + t.resp.Status), true
+	},
+	"http.protocol": func(t *transaction, response bool) ([]byte, bool) {
+		if m := t.side(response); m != nil {
+			return []byte(m.Proto), true
+		}
+		return nil, false
+	},
+	"http.header": func(t *transaction, response bool) ([]byte, bool) {
+		if m := t.side(response); m != nil {
+			return headerBlock(m.Header, true), true
+		}
+		return nil, false
+	},
+	"http.header.raw": func(t *transaction, response bool) ([]byte, bool) {
+		if m := t.side(response); m != nil {
+			return headerBlock(m.Header, false), true
+		}
+		return nil, false
+	},
+	"http.header_names": func(t *transaction, response bool) ([]byte, bool) {
+		m := t.side(response)
+		if m == nil {
+			return nil, false
+		}
+		var b bytes.Buffer
+		b.WriteString("\r\n")
+		for _, name := range sortedNames(m.Header) {
+			b.WriteString(name + "\r\n")
+		}
+		b.WriteString("\r\n")
+		return b.Bytes(), true
+	},
+	"http.start": start,
+	// payload is content outside any buffer, matched against the message
+	// reconstructed as it was sent.
+	"payload": func(t *transaction, response bool) ([]byte, bool) {
+		b, ok := start(t, response)
+		if !ok {
+			return nil, false
+		}
+		return append(b, t.side(response).Body...), true
+	},
+	"dns.query": func(t *transaction, _ bool) ([]byte, bool) {
+		if t.query == "" {
+			return nil, false
+		}
+		return []byte(t.query), true
+	},
+}
+
+// responseBuffers only exist once the response has arrived.
+var responseBuffers = map[string]bool{
+	"http.response_body": true,
+	"http.stat_code":     true,
+	"http.stat_msg":      true,
+	"http.response_line": true,
+	"http.server":        true,
+	"http.location":      true,
+}
+
+// start returns the start line and headers of a message.
+func start(t *transaction, response bool) ([]byte, bool) {
+	m := t.side(response)
+	if m == nil {
+		return nil, false
+	}
+	var b bytes.Buffer
+	if response {
+		b.WriteString(t.resp.Proto + " " + t.resp.Status + "\r\n")
+	} else {
+		b.WriteString(t.req.Method + " " + t.req.URI + " " + t.req.Proto + "\r\n")
+	}
+	b.Write(headerBlock(m.Header, false))
+	b.WriteString("\r\n")
+	return b.Bytes(), true
+}
+
+func requestHeader(name string) func(*transaction, bool) ([]byte, bool) {
+	return func(t *transaction, _ bool) ([]byte, bool) {
+		if t.req == nil {
+			return nil, false
+		}
+		return header(&t.req.Message, name)
+	}
+}
+
+func responseHeader(name string) func(*transaction, bool) ([]byte, bool) {
+	return func(t *transaction, _ bool) ([]byte, bool) {
+		if t.resp == nil {
+			return nil, false
+		}
+		return header(&t.resp.Message, name)
+	}
+}
+
+func eitherHeader(name string) func(*transaction, bool) ([]byte, bool) {
+	return func(t *transaction, response bool) ([]byte, bool) {
+		if m := t.side(response); m != nil {
+			return header(m, name)
+		}
+		return nil, false
+	}
+}
+
+func header(m *httpstream.Message, name string) ([]byte, bool) {
+	values := m.Header.Values(name)
+	if len(values) == 0 {
+		return nil, false
+	}
+	return []byte(strings.Join(values, ", ")), true
+}
+
+// headerBlock formats headers as "Name: value\r\n" lines. Suricata leaves
+// cookies out of the normalized header buffer.
+func headerBlock(h http.Header, normalized bool) []byte {
+	var b bytes.Buffer
+	for _, name := range sortedNames(h) {
+		if normalized && (name == "Cookie" || name == "Set-Cookie") {
+			continue
+		}
+		for _, v := range h[name] {
+			b.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// sortedNames returns the header names in a stable order; the order on the
+// wire isn't kept.
+func sortedNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matcher is one content or pcre option with its modifiers.
+type matcher struct {
+	content []byte
+	re      *regexp.Regexp
+	negated bool
+
+	nocase, startswith, endswith bool
+	offset, depth                int
+	// relative is set by distance, within or pcre's R flag, making the
+	// match relative to the end of the previous one in the buffer.
+	relative         bool
+	distance, within int
+}
+
+func (r *Rule) matchBuffers(t *transaction) bool {
+	for name, list := range r.buffers {
+		buf, ok := bufferOf[name](t, r.response)
+		if !ok || !matchList(list, buf, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchList reports whether the matchers, in order, match buf with the
+// previous match ending at prev. Every position of a positive match is
+// tried, so a later relative match can use any of them.
+func matchList(list []*matcher, buf []byte, prev int) bool {
+	if len(list) == 0 {
+		return true
+	}
+	m := list[0]
+	var ends []int
+	if m.re != nil {
+		ends = m.matchPCRE(buf, prev)
+	} else {
+		ends = m.matchContent(buf, prev)
+	}
+	if m.negated {
+		return len(ends) == 0 && matchList(list[1:], buf, prev)
+	}
+	for _, end := range ends {
+		if matchList(list[1:], buf, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchContent returns the end of every occurrence allowed by the
+// modifiers.
+func (m *matcher) matchContent(buf []byte, prev int) []int {
+	lo, hi := m.offset, len(buf)
+	if m.relative {
+		lo = prev + m.distance
+		if m.within > 0 {
+			hi = min(hi, prev+m.distance+m.within)
+		}
+	} else if m.depth > 0 {
+		hi = min(hi, m.offset+m.depth)
+	}
+	if m.startswith {
+		hi = min(hi, lo+len(m.content))
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	if lo >= hi {
+		return nil
+	}
+	hay, needle := buf[lo:hi], m.content
+	if m.nocase {
+		hay, needle = bytes.ToLower(hay), bytes.ToLower(needle)
+	}
+	var ends []int
+	for i := 0; ; {
+		j := bytes.Index(hay[i:], needle)
+		if j < 0 {
+			break
+		}
+		end := lo + i + j + len(needle)
+		if !m.endswith || end == len(buf) {
+			ends = append(ends, end)
+		}
+		i += j + 1
+	}
+	return ends
+}
+
+// matchPCRE returns the end of every match of the expression.
+func (m *matcher) matchPCRE(buf []byte, prev int) []int {
+	start := 0
+	if m.relative {
+		start = prev
+	}
+	var ends []int
+	for _, loc := range m.re.FindAllIndex(buf[start:], -1) {
+		ends = append(ends, start+loc[1])
+	}
+	return ends
+}
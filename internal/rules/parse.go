@@ -0,0 +1,536 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// legacyModifiers move the content before them into a buffer, in the
+// Snort style.
+var legacyModifiers = map[string]string{
+	"http_uri":         "http.uri",
+	"http_raw_uri":     "http.uri.raw",
+	"http_method":      "http.method",
+	"http_header":      "http.header",
+	"http_raw_header":  "http.header.raw",
+	"http_cookie":      "http.cookie",
+	"http_user_agent":  "http.user_agent",
+	"http_host":        "http.host",
+	"http_raw_host":    "http.host.raw",
+	"http_client_body": "http.request_body",
+	"http_server_body": "http.response_body",
+	"http_stat_code":   "http.stat_code",
+	"http_stat_msg":    "http.stat_msg",
+}
+
+// bufferAliases are the other names Suricata accepts for buffers.
+var bufferAliases = map[string]string{
+	"file.data":       "http.response_body",
+	"file_data":       "http.response_body",
+	"dns_query":       "dns.query",
+	"http.user-agent": "http.user_agent",
+}
+
+// pcreBuffers are the buffers selected by pcre's Snort-style flags.
+var pcreBuffers = map[rune]string{
+	'U': "http.uri",
+	'I': "http.uri.raw",
+	'H': "http.header",
+	'D': "http.header.raw",
+	'M': "http.method",
+	'C': "http.cookie",
+	'P': "http.request_body",
+	'Q': "http.response_body",
+	'S': "http.stat_code",
+	'Y': "http.stat_msg",
+	'V': "http.user_agent",
+	'W': "http.host",
+	'Z': "http.host.raw",
+}
+
+// ignoredKeywords don't affect which transactions match, or only limit how
+// often an alert is raised.
+var ignoredKeywords = map[string]bool{
+	"gid": true, "reference": true, "metadata": true, "priority": true,
+	"fast_pattern": true, "rawbytes": true, "target": true, "threshold": true,
+	"detection_filter": true, "app-layer-protocol": true, "tag": true,
+}
+
+// parse parses one rule.
+func parse(text string, vars map[string]string) (*Rule, error) {
+	open := strings.Index(text, "(")
+	if open < 0 || !strings.HasSuffix(text, ")") {
+		return nil, errors.New("want HEADER (OPTIONS)")
+	}
+	header := fields(text[:open])
+	if len(header) != 7 {
+		return nil, errors.New("want ACTION PROTO SRC SPORT -> DST DPORT")
+	}
+	r := &Rule{Text: text, buffers: make(map[string][]*matcher)}
+	if header[0] != "alert" {
+		return nil, fmt.Errorf("only alert rules are supported, not %s", header[0])
+	}
+	proto := header[1]
+	switch header[4] {
+	case "->":
+	case "<>":
+		r.both = true
+	default:
+		return nil, fmt.Errorf("bad direction %q", header[4])
+	}
+	var err error
+	if r.src, err = parseAddrs(header[2], vars, 0); err != nil {
+		return nil, err
+	}
+	if r.sport, err = parsePorts(header[3], vars, 0); err != nil {
+		return nil, err
+	}
+	if r.dst, err = parseAddrs(header[5], vars, 0); err != nil {
+		return nil, err
+	}
+	if r.dport, err = parsePorts(header[6], vars, 0); err != nil {
+		return nil, err
+	}
+
+	buffer := "payload"
+	var last *matcher
+	var lastBuffer string
+	toClient := false
+	for _, opt := range options(text[open+1 : len(text)-1]) {
+		key, value, _ := strings.Cut(opt, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if alias, ok := bufferAliases[key]; ok {
+			key = alias
+		}
+		switch {
+		case key == "msg":
+			r.Msg = unquote(value)
+		case key == "sid":
+			r.SID, err = strconv.Atoi(value)
+		case key == "rev":
+			r.Rev, err = strconv.Atoi(value)
+		case key == "classtype":
+			r.Classtype = value
+		case key == "flow":
+			toClient = strings.Contains(value, "to_client") || strings.Contains(value, "from_server")
+		case ignoredKeywords[key]:
+		case strings.HasPrefix(key, "http.") || key == "dns.query":
+			if _, ok := bufferOf[key]; !ok {
+				return nil, fmt.Errorf("unsupported buffer %s", key)
+			}
+			buffer = key
+		case key == "content":
+			last, err = parseContent(value)
+			if err == nil {
+				lastBuffer = buffer
+				r.buffers[buffer] = append(r.buffers[buffer], last)
+			}
+		case key == "pcre":
+			var b string
+			last, b, err = parsePCRE(value)
+			if err == nil {
+				if b == "" {
+					b = buffer
+				}
+				lastBuffer = b
+				r.buffers[b] = append(r.buffers[b], last)
+			}
+		case legacyModifiers[key] != "":
+			if last == nil || last.re != nil {
+				return nil, fmt.Errorf("%s without a content before it", key)
+			}
+			list := r.buffers[lastBuffer]
+			r.buffers[lastBuffer] = list[:len(list)-1]
+			lastBuffer = legacyModifiers[key]
+			r.buffers[lastBuffer] = append(r.buffers[lastBuffer], last)
+		case key == "nocase" || key == "startswith" || key == "endswith" ||
+			key == "depth" || key == "offset" || key == "distance" || key == "within":
+			if last == nil || last.re != nil {
+				return nil, fmt.Errorf("%s without a content before it", key)
+			}
+			err = last.modify(key, value)
+		default:
+			return nil, fmt.Errorf("unsupported keyword %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	for k, list := range r.buffers {
+		if len(list) == 0 {
+			delete(r.buffers, k)
+		}
+	}
+	if r.SID == 0 {
+		return nil, errors.New("no sid")
+	}
+
+	httpRule, dnsRule := false, false
+	for b := range r.buffers {
+		switch {
+		case b == "dns.query":
+			dnsRule = true
+		case b != "payload":
+			httpRule = true
+			r.response = r.response || responseBuffers[b]
+		}
+	}
+	switch {
+	case httpRule && dnsRule:
+		return nil, errors.New("mixes HTTP and DNS keywords")
+	case dnsRule:
+		r.dns = true
+		if proto != "dns" && proto != "udp" && proto != "ip" && proto != "any" {
+			return nil, fmt.Errorf("dns.query in a %s rule", proto)
+		}
+	case httpRule:
+		if proto != "http" && proto != "http1" && proto != "tcp" && proto != "ip" && proto != "any" {
+			return nil, fmt.Errorf("HTTP keywords in a %s rule", proto)
+		}
+		r.response = r.response || toClient
+	default:
+		return nil, errors.New("no HTTP or DNS keywords")
+	}
+	return r, nil
+}
+
+// fields splits a rule header on whitespace, keeping bracketed lists, which
+// may contain spaces, together.
+func fields(s string) []string {
+	var out []string
+	var cur strings.Builder
+	depth := 0
+	for _, c := range s {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case (c == ' ' || c == '\t') && depth == 0:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+			continue
+		case c == ' ' || c == '\t':
+			continue
+		}
+		cur.WriteRune(c)
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// options splits rule options on the semicolons that end them, skipping
+// escaped ones and those in quotes.
+func options(s string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			if opt := strings.TrimSpace(cur.String()); opt != "" {
+				out = append(out, opt)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(c)
+	}
+	if opt := strings.TrimSpace(cur.String()); opt != "" {
+		out = append(out, opt)
+	}
+	return out
+}
+
+// unquote removes the quotes around a value and its escapes.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range s {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// parseContent parses a content value, which may be negated and contain
+// |41 42| hex sections.
+func parseContent(value string) (*matcher, error) {
+	m := &matcher{}
+	if strings.HasPrefix(value, "!") {
+		m.negated = true
+		value = strings.TrimSpace(value[1:])
+	}
+	s := unquote(value)
+	var out []byte
+	for {
+		i := strings.Index(s, "|")
+		if i < 0 {
+			out = append(out, s...)
+			break
+		}
+		out = append(out, s[:i]...)
+		j := strings.Index(s[i+1:], "|")
+		if j < 0 {
+			return nil, errors.New("unterminated hex section")
+		}
+		for _, h := range strings.Fields(s[i+1 : i+1+j]) {
+			if len(h)%2 != 0 {
+				return nil, fmt.Errorf("bad hex %q", h)
+			}
+			for k := 0; k < len(h); k += 2 {
+				v, err := strconv.ParseUint(h[k:k+2], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("bad hex %q", h)
+				}
+				out = append(out, byte(v))
+			}
+		}
+		s = s[i+1+j+1:]
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty content")
+	}
+	m.content = out
+	return m, nil
+}
+
+// parsePCRE parses a pcre value, returning the buffer its flags select, if
+// any.
+func parsePCRE(value string) (*matcher, string, error) {
+	m := &matcher{}
+	if strings.HasPrefix(value, "!") {
+		m.negated = true
+		value = strings.TrimSpace(value[1:])
+	}
+	s := strings.TrimSpace(value)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	end := strings.LastIndex(s, "/")
+	if !strings.HasPrefix(s, "/") || end <= 0 {
+		return nil, "", errors.New("want /REGEXP/FLAGS")
+	}
+	expr, flags := strings.ReplaceAll(s[1:end], `\;`, ";"), s[end+1:]
+	var goFlags, buffer string
+	for _, f := range flags {
+		switch f {
+		case 'i', 's', 'm':
+			goFlags += string(f)
+		case 'R':
+			m.relative = true
+		case 'B', 'O':
+		default:
+			b, ok := pcreBuffers[f]
+			if !ok {
+				return nil, "", fmt.Errorf("unsupported flag %c", f)
+			}
+			buffer = b
+		}
+	}
+	if goFlags != "" {
+		expr = "(?" + goFlags + ")" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, "", err
+	}
+	m.re = re
+	return m, buffer, nil
+}
+
+// modify applies a content modifier.
+func (m *matcher) modify(key, value string) error {
+	switch key {
+	case "nocase":
+		m.nocase = true
+		return nil
+	case "startswith":
+		m.startswith = true
+		return nil
+	case "endswith":
+		m.endswith = true
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	switch key {
+	case "depth":
+		m.depth = n
+	case "offset":
+		m.offset = n
+	case "distance":
+		m.distance, m.relative = n, true
+	case "within":
+		m.within, m.relative = n, true
+	}
+	return nil
+}
+
+// maxVarDepth bounds how deeply variables may refer to each other.
+const maxVarDepth = 8
+
+// parseAddrs parses an address specification such as
+// [10.0.0.0/8,!10.1.0.0/16] or $HOME_NET.
+func parseAddrs(s string, vars map[string]string, depth int) (addrs, error) {
+	var a addrs
+	if depth > maxVarDepth {
+		return a, errors.New("variables nested too deeply")
+	}
+	if neg, ok := strings.CutPrefix(s, "!"); ok {
+		inner, err := parseAddrs(neg, vars, depth+1)
+		if err != nil {
+			return a, err
+		}
+		return addrs{any: true, excludes: []addrs{inner}}, nil
+	}
+	switch {
+	case s == "any":
+		a.any = true
+		return a, nil
+	case strings.HasPrefix(s, "$"):
+		v, ok := vars[s[1:]]
+		if !ok {
+			a.any = true
+			return a, nil
+		}
+		return parseAddrs(strings.ReplaceAll(v, " ", ""), vars, depth+1)
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		for _, item := range splitList(s[1 : len(s)-1]) {
+			neg, negated := strings.CutPrefix(item, "!")
+			inner, err := parseAddrs(neg, vars, depth+1)
+			if err != nil {
+				return a, err
+			}
+			if negated {
+				a.excludes = append(a.excludes, inner)
+			} else {
+				a.include = append(a.include, inner.include...)
+				a.any = a.any || inner.any
+				a.exclude = append(a.exclude, inner.exclude...)
+				a.excludes = append(a.excludes, inner.excludes...)
+			}
+		}
+		if len(a.include) == 0 && !a.any {
+			a.any = true
+		}
+		return a, nil
+	}
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			a.include = append(a.include, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			return a, nil
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return a, fmt.Errorf("bad address %q", s)
+	}
+	a.include = append(a.include, n)
+	return a, nil
+}
+
+// parsePorts parses a port specification such as [80,8000:8080,!8081].
+func parsePorts(s string, vars map[string]string, depth int) (ports, error) {
+	var p ports
+	if depth > maxVarDepth {
+		return p, errors.New("variables nested too deeply")
+	}
+	switch {
+	case s == "any":
+		p.any = true
+		return p, nil
+	case strings.HasPrefix(s, "$"):
+		v, ok := vars[s[1:]]
+		if !ok {
+			p.any = true
+			return p, nil
+		}
+		return parsePorts(strings.ReplaceAll(v, " ", ""), vars, depth+1)
+	case strings.HasPrefix(s, "!"):
+		inner, err := parsePorts(s[1:], vars, depth+1)
+		if err != nil {
+			return p, err
+		}
+		return ports{any: true, exclude: inner.include}, nil
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		for _, item := range splitList(s[1 : len(s)-1]) {
+			inner, err := parsePorts(item, vars, depth+1)
+			if err != nil {
+				return p, err
+			}
+			p.any = p.any || inner.any && len(inner.exclude) == 0
+			p.include = append(p.include, inner.include...)
+			p.exclude = append(p.exclude, inner.exclude...)
+		}
+		if len(p.include) == 0 && !p.any {
+			p.any = true
+		}
+		return p, nil
+	}
+	lo, hi, isRange := strings.Cut(s, ":")
+	if !isRange {
+		hi = lo
+	}
+	if lo == "" {
+		lo = "0"
+	}
+	if hi == "" {
+		hi = "65535"
+	}
+	l, err1 := strconv.Atoi(lo)
+	h, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil {
+		return p, fmt.Errorf("bad port %q", s)
+	}
+	p.include = append(p.include, [2]int{l, h})
+	return p, nil
+}
+
+// splitList splits a bracketed list on the commas outside nested brackets.
+func splitList(s string) []string {
+	var out []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				out = append(out, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(out, s[start:])
+}
@@ -0,0 +1,227 @@
+// Package rules evaluates the HTTP and DNS part of Suricata and Snort rules
+// against reconstructed transactions, so existing IDS rules can be run over
+// offline captures.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Rule is a parsed alert rule.
+type Rule struct {
+	SID, Rev  int
+	Msg       string
+	Classtype string
+	// Text is the rule as written.
+	Text string
+
+	src, dst     addrs
+	sport, dport ports
+	// both is set for rules using <>, which match either direction.
+	both bool
+	// response is set for rules inspecting the server's side of the
+	// transaction, which are checked once the response has arrived.
+	response bool
+	// dns is set for rules inspecting DNS queries rather than HTTP.
+	dns     bool
+	buffers map[string][]*matcher
+}
+
+// Skipped is a rule that couldn't be loaded, usually because it uses a
+// keyword that isn't supported.
+type Skipped struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (s Skipped) Error() string {
+	return fmt.Sprintf("%s:%d: %v", s.File, s.Line, s.Err)
+}
+
+// Set is the rules of one or more files.
+type Set struct {
+	http, dns []*Rule
+	// Skipped are the rules that couldn't be loaded.
+	Skipped []Skipped
+}
+
+// Load reads rule files. Variables such as $HOME_NET are looked up in vars,
+// whose values are written as in suricata.yaml; variables not in vars match
+// any address or port. Rules without HTTP or DNS keywords, and rules using
+// keywords that aren't supported, are skipped and listed in Set.Skipped.
+func Load(vars map[string]string, paths ...string) (*Set, error) {
+	s := &Set{}
+	for _, path := range paths {
+		if err := s.load(path, vars); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Set) load(path string, vars map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var text string
+	start := 0
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			start = n
+		}
+		// A rule may be continued over several lines with a trailing \
+		if cont, ok := strings.CutSuffix(line, `\`); ok {
+			text += cont
+			continue
+		}
+		text += line
+		if text != "" && !strings.HasPrefix(text, "#") {
+			r, err := parse(text, vars)
+			switch {
+			case err != nil:
+				s.Skipped = append(s.Skipped, Skipped{path, start, err})
+			case r.dns:
+				s.dns = append(s.dns, r)
+			default:
+				s.http = append(s.http, r)
+			}
+		}
+		text = ""
+	}
+	return scanner.Err()
+}
+
+// Len returns the number of rules loaded.
+func (s *Set) Len() int {
+	return len(s.http) + len(s.dns)
+}
+
+// MatchRequest returns the rules matching a request on its own: those
+// inspecting only the client's side of a transaction.
+func (s *Set) MatchRequest(req *httpstream.Request) []*Rule {
+	t := &transaction{req: req}
+	var matched []*Rule
+	for _, r := range s.http {
+		if !r.response && r.matchFlow(req.Flow) && r.matchBuffers(t) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// MatchResponse returns the rules inspecting the server's side of a
+// transaction that match resp and the request it answers.
+func (s *Set) MatchResponse(resp *httpstream.Response) []*Rule {
+	t := &transaction{req: resp.Request, resp: resp}
+	var matched []*Rule
+	for _, r := range s.http {
+		if r.response && r.matchFlow(resp.Flow) && r.matchBuffers(t) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// MatchDNS returns the rules matching a DNS query. Ports aren't known for
+// DNS messages, so port constraints are ignored.
+func (s *Set) MatchDNS(msg *dns.Message) []*Rule {
+	if msg.Response {
+		return nil
+	}
+	t := &transaction{query: strings.TrimSuffix(msg.Question, ".")}
+	flow := httpstream.Flow{SrcIP: msg.SrcIP, DstIP: msg.DstIP}
+	var matched []*Rule
+	for _, r := range s.dns {
+		if r.matchFlow(flow) && r.matchBuffers(t) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+func (r *Rule) matchFlow(f httpstream.Flow) bool {
+	if r.matchEndpoints(f) {
+		return true
+	}
+	return r.both && r.matchEndpoints(f.Reverse())
+}
+
+func (r *Rule) matchEndpoints(f httpstream.Flow) bool {
+	return r.src.match(net.ParseIP(f.SrcIP)) && r.dst.match(net.ParseIP(f.DstIP)) &&
+		(r.dns || r.sport.match(f.SrcPort) && r.dport.match(f.DstPort))
+}
+
+// addrs matches addresses against a rule's address specification.
+type addrs struct {
+	any      bool
+	include  []*net.IPNet
+	exclude  []*net.IPNet
+	excludes []addrs
+}
+
+func (a addrs) match(ip net.IP) bool {
+	if ip == nil {
+		return a.any
+	}
+	for _, n := range a.exclude {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, e := range a.excludes {
+		if e.match(ip) {
+			return false
+		}
+	}
+	if a.any {
+		return true
+	}
+	for _, n := range a.include {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ports matches ports against a rule's port specification.
+type ports struct {
+	any     bool
+	include [][2]int
+	exclude [][2]int
+}
+
+func (p ports) match(port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return p.any
+	}
+	for _, r := range p.exclude {
+		if n >= r[0] && n <= r[1] {
+			return false
+		}
+	}
+	if p.any {
+		return true
+	}
+	for _, r := range p.include {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
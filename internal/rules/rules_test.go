@@ -0,0 +1,142 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// counter counts the events matching a set's rules.
+type counter struct {
+	set     *Set
+	mu      sync.Mutex
+	matches int
+}
+
+func (c *counter) add(rules []*Rule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(rules) > 0 {
+		c.matches++
+	}
+}
+
+func (c *counter) HandleRequest(req *httpstream.Request)    { c.add(c.set.MatchRequest(req)) }
+func (c *counter) HandleResponse(resp *httpstream.Response) { c.add(c.set.MatchResponse(resp)) }
+func (c *counter) HandleDNS(msg *dns.Message)               { c.add(c.set.MatchDNS(msg)) }
+
+// capture writes a capture of a DNS lookup and two HTTP transactions,
+// returning its path.
+func capture(t *testing.T) string {
+	t.Helper()
+	b := testutil.NewBuilder()
+	b.DNSQuery("10.0.0.1:53000", "10.0.0.53:53", "evil.example.com")
+	b.DNSResponse("10.0.0.1:53000", "10.0.0.53:53", "evil.example.com", "192.0.2.7")
+	b.HTTPExchange("10.0.0.1:40000", "192.0.2.7:80",
+		"GET /admin/login.php?id=1%27%20OR%201=1 HTTP/1.1\r\nHost: Evil.Example.com\r\nUser-Agent: sqlmap/1.7\r\nCookie: session=abc\r\n\r\n",
+		"HTTP/1.1 500 Internal Server Error\r\nServer: Apache\r\nContent-Length: 31\r\n\r\nYou have an error in SQL syntax")
+	b.HTTPExchange("10.0.0.1:40001", "192.0.2.8:8080",
+		"POST /upload HTTP/1.1\r\nHost: files.example.com\r\nContent-Length: 11\r\n\r\nhello world",
+		"HTTP/1.1 201 Created\r\nLocation: /files/1\r\nContent-Length: 0\r\n\r\n")
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRules(t *testing.T) {
+	path := capture(t)
+	tests := []struct {
+		name string
+		rule string
+		vars map[string]string
+		// matches is how many events the rule matches, or -1 if it is
+		// skipped.
+		matches int
+	}{
+		{"sticky buffer", `alert http any any -> any any (msg:"sqlmap"; http.user_agent; content:"sqlmap"; sid:1;)`, nil, 1},
+		{"legacy modifier", `alert http any any -> any any (msg:"admin"; content:"/admin/"; http_uri; sid:1;)`, nil, 1},
+		{"decoded URI", `alert http any any -> any any (msg:"sqli"; http.uri; content:"' OR 1=1"; sid:1;)`, nil, 1},
+		{"raw URI", `alert http any any -> any any (msg:"sqli"; http.uri.raw; content:"%27%20OR"; sid:1;)`, nil, 1},
+		{"host is lowercased", `alert http any any -> any any (msg:"host"; http.host; content:"evil.example.com"; startswith; endswith; sid:1;)`, nil, 1},
+		{"nocase", `alert http any any -> any any (msg:"method"; http.method; content:"get"; nocase; sid:1;)`, nil, 1},
+		{"case matters", `alert http any any -> any any (msg:"method"; http.method; content:"get"; sid:1;)`, nil, 0},
+		{"depth", `alert http any any -> any any (msg:"uri"; http.uri; content:"login"; depth:6; sid:1;)`, nil, 0},
+		{"distance and within", `alert http any any -> any any (msg:"uri"; http.uri; content:"/admin"; content:"login"; distance:1; within:5; sid:1;)`, nil, 1},
+		{"negated content", `alert http any any -> any any (msg:"no cookie"; http.cookie; content:!"session"; sid:1;)`, nil, 0},
+		{"pcre", `alert http any any -> any any (msg:"pcre"; pcre:"/\/upload$/U"; sid:1;)`, nil, 1},
+		{"request body", `alert http any any -> any any (msg:"body"; http.request_body; content:"hello"; sid:1;)`, nil, 1},
+		{"response body", `alert http any any -> any any (msg:"sql error"; file.data; content:"SQL syntax"; sid:1;)`, nil, 1},
+		{"status code", `alert http any any -> any any (msg:"5xx"; http.stat_code; content:"5"; startswith; sid:1;)`, nil, 1},
+		{"server header", `alert http any any -> any any (msg:"apache"; http.server; content:"Apache"; sid:1;)`, nil, 1},
+		{"payload", `alert tcp any any -> any any (msg:"payload"; content:"User-Agent|3a 20|sqlmap"; http.method; content:"GET"; sid:1;)`, nil, 1},
+		{"destination port", `alert http any any -> any 8080 (msg:"8080"; http.method; content:"POST"; sid:1;)`, nil, 1},
+		{"other port", `alert http any any -> any 443 (msg:"443"; http.method; content:"POST"; sid:1;)`, nil, 0},
+		{"variables", `alert http $HOME_NET any -> $EXTERNAL_NET any (msg:"out"; http.method; content:"GET"; sid:1;)`,
+			map[string]string{"HOME_NET": "[10.0.0.0/8]", "EXTERNAL_NET": "!$HOME_NET"}, 1},
+		{"wrong direction", `alert http any any -> 10.0.0.0/8 any (msg:"in"; http.method; content:"GET"; sid:1;)`, nil, 0},
+		{"either direction", `alert http 192.0.2.0/24 any <> 10.0.0.0/8 any (msg:"both"; http.method; content:"GET"; sid:1;)`, nil, 1},
+		{"DNS query", `alert dns any any -> any any (msg:"evil"; dns.query; content:"evil.example"; sid:1;)`, nil, 1},
+		{"DNS query elsewhere", `alert dns any any -> any any (msg:"good"; dns.query; content:"good.example"; sid:1;)`, nil, 0},
+		{"unsupported keyword", `alert http any any -> any any (msg:"bytes"; http.uri; content:"a"; byte_test:1,>,2,0; sid:1;)`, nil, -1},
+		{"no HTTP or DNS keywords", `alert tcp any any -> any any (msg:"tcp"; content:"a"; sid:1;)`, nil, -1},
+		{"not an alert", `drop http any any -> any any (msg:"drop"; http.uri; content:"a"; sid:1;)`, nil, -1},
+		{"no sid", `alert http any any -> any any (msg:"none"; http.uri; content:"a";)`, nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "test.rules")
+			if err := os.WriteFile(file, []byte("# a comment\n"+tt.rule+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			set, err := Load(tt.vars, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.matches < 0 {
+				if set.Len() != 0 || len(set.Skipped) != 1 {
+					t.Fatalf("loaded %d rules and skipped %v, want the rule skipped", set.Len(), set.Skipped)
+				}
+				if s := set.Skipped[0]; s.Line != 2 {
+					t.Errorf("skipped rule on line %d, want 2", s.Line)
+				}
+				return
+			}
+			if len(set.Skipped) != 0 {
+				t.Fatalf("skipped %v", set.Skipped)
+			}
+			c := &counter{set: set}
+			if err := analyzer.Run(path, analyzer.Options{DNS: true}, c); err != nil {
+				t.Fatal(err)
+			}
+			if c.matches != tt.matches {
+				t.Errorf("matched %d events, want %d", c.matches, tt.matches)
+			}
+		})
+	}
+}
+
+func TestLoadContinuedRule(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.rules")
+	rule := "alert http any any -> any any (msg:\"split\"; \\\n  http.uri; content:\"/admin\"; \\\n  sid:7; rev:2;)\n"
+	if err := os.WriteFile(file, []byte(rule), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set, err := Load(nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 1 || len(set.Skipped) != 0 {
+		t.Fatalf("loaded %d rules and skipped %v, want 1 rule", set.Len(), set.Skipped)
+	}
+	if r := set.http[0]; r.SID != 7 || r.Rev != 2 || r.Msg != "split" {
+		t.Errorf("got sid %d rev %d msg %q", r.SID, r.Rev, r.Msg)
+	}
+}
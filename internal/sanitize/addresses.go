@@ -0,0 +1,92 @@
+package sanitize
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Replacement addresses are handed out in order from these ranges: private
+// and link-local addresses stay private, and public addresses are moved to
+// the range reserved for benchmarking, so the result still shows which
+// side of a network edge each endpoint was on.
+var (
+	private4 = addressRange{start: net.IPv4(10, 0, 0, 0), size: 1 << 24}
+	public4  = addressRange{start: net.IPv4(198, 18, 0, 0), size: 1 << 17}
+	private6 = addressRange{start: net.ParseIP("fd00::"), size: 1 << 32}
+	public6  = addressRange{start: net.ParseIP("2001:db8::"), size: 1 << 32}
+)
+
+type addressRange struct {
+	start      net.IP
+	size, next uint64
+}
+
+// allocate returns the next address of the range, skipping IPv4 addresses
+// ending in .0 and .255, which look like network and broadcast addresses.
+func (r *addressRange) allocate() (net.IP, error) {
+	for {
+		r.next++
+		if r.next >= r.size {
+			return nil, errors.New("too many distinct addresses to remap")
+		}
+		ip := make(net.IP, len(r.start))
+		copy(ip, r.start)
+		tail := ip[len(ip)-4:]
+		binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+uint32(r.next))
+		if v4 := ip.To4(); v4 != nil && (v4[3] == 0 || v4[3] == 255) {
+			continue
+		}
+		return ip, nil
+	}
+}
+
+// addressMap remaps addresses consistently. Loopback, multicast,
+// broadcast and unspecified addresses, which say nothing about a network,
+// are kept.
+type addressMap struct {
+	m                                    map[string]net.IP
+	order                                []string
+	private4, public4, private6, public6 addressRange
+}
+
+func newAddressMap() *addressMap {
+	return &addressMap{
+		m:        make(map[string]net.IP),
+		private4: private4, public4: public4, private6: private6, public6: public6,
+	}
+}
+
+func (a *addressMap) len() int {
+	return len(a.m)
+}
+
+func (a *addressMap) get(ip net.IP) (net.IP, error) {
+	if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() || ip.Equal(net.IPv4bcast) {
+		return ip, nil
+	}
+	key := string(ip.To16())
+	if repl, ok := a.m[key]; ok {
+		return repl, nil
+	}
+	var r *addressRange
+	switch private := ip.IsPrivate() || ip.IsLinkLocalUnicast() || cgnat.Contains(ip); {
+	case ip.To4() != nil && private:
+		r = &a.private4
+	case ip.To4() != nil:
+		r = &a.public4
+	case private:
+		r = &a.private6
+	default:
+		r = &a.public6
+	}
+	repl, err := r.allocate()
+	if err != nil {
+		return nil, err
+	}
+	a.m[key] = repl
+	a.order = append(a.order, key)
+	return repl, nil
+}
+
+var _, cgnat, _ = net.ParseCIDR("100.64.0.0/10")
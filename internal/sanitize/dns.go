@@ -0,0 +1,63 @@
+package sanitize
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errBadDNS stops the walk over a message that isn't well formed; the
+// rest of it is left as it is.
+var errBadDNS = errors.New("malformed DNS message")
+
+// dns remaps the addresses in the A and AAAA records of a DNS message in
+// place, so lookups agree with the remapped traffic.
+func (s *Sanitizer) dns(msg []byte) error {
+	if len(msg) < 12 {
+		return nil
+	}
+	off := 12
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	records := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipName(msg, off); err != nil || off+4 > len(msg) {
+			return nil
+		}
+		off += 4
+	}
+	for i := 0; i < records; i++ {
+		if off, err = skipName(msg, off); err != nil || off+10 > len(msg) {
+			return nil
+		}
+		typ := binary.BigEndian.Uint16(msg[off : off+2])
+		n := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+n > len(msg) {
+			return nil
+		}
+		if (typ == 1 && n == 4) || (typ == 28 && n == 16) {
+			if err := s.addr(msg[off : off+n]); err != nil {
+				return err
+			}
+		}
+		off += n
+	}
+	return nil
+}
+
+// skipName returns the offset just past the domain name at off.
+func skipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// A compression pointer ends the name
+			return off + 2, nil
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, errBadDNS
+}
@@ -0,0 +1,384 @@
+// Package sanitize rewrites captures so they can be shared: addresses are
+// remapped consistently, MAC addresses randomized and payloads redacted or
+// zeroed, while packet sizes, timing and TCP sequence numbers are kept so
+// the result still reassembles and analyzes the same way.
+package sanitize
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/output"
+)
+
+// What is done with TCP and UDP payloads.
+const (
+	// PayloadKeep leaves payloads as they are.
+	PayloadKeep = "keep"
+	// PayloadRedact masks the values the redaction rules match in each
+	// packet with asterisks.
+	PayloadRedact = "redact"
+	// PayloadHeaders keeps HTTP start lines and headers, masked as with
+	// PayloadRedact, and zeroes everything else.
+	PayloadHeaders = "headers"
+	// PayloadZero zeroes every payload.
+	PayloadZero = "zero"
+)
+
+// Options controls what Sanitize changes.
+type Options struct {
+	// Payload is one of the Payload constants.
+	Payload string
+	// Redact is what PayloadRedact and PayloadHeaders mask.
+	Redact output.RedactRules
+}
+
+// Stats describes a sanitized capture.
+type Stats struct {
+	Packets   int64
+	Addresses int
+	MACs      int
+}
+
+// Sanitizer rewrites packets. Addresses and MACs are mapped the same way
+// for every packet it rewrites.
+type Sanitizer struct {
+	opts   Options
+	link   layers.LinkType
+	masker *output.Redact
+	addrs  *addressMap
+	macs   map[[6]byte][6]byte
+	// inHeaders records the flow directions in the middle of HTTP headers
+	// that continue in the next segment.
+	inHeaders map[string]bool
+	packets   int64
+}
+
+func NewSanitizer(link layers.LinkType, opts Options) (*Sanitizer, error) {
+	switch opts.Payload {
+	case PayloadKeep, PayloadRedact, PayloadHeaders, PayloadZero:
+	default:
+		return nil, fmt.Errorf("unknown payload mode %q", opts.Payload)
+	}
+	return &Sanitizer{
+		opts:      opts,
+		link:      link,
+		masker:    output.NewRedact(nil, opts.Redact),
+		addrs:     newAddressMap(),
+		macs:      make(map[[6]byte][6]byte),
+		inHeaders: make(map[string]bool),
+	}, nil
+}
+
+// File sanitizes the pcap or pcapng capture at in into a pcap file at out,
+// returning the sanitizer for its statistics and address mapping.
+func File(in, out string, opts Options) (*Sanitizer, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	var r interface {
+		gopacket.PacketDataSource
+		LinkType() layers.LinkType
+	}
+	snaplen := uint32(262144)
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		var pr *pcapgo.Reader
+		if pr, err = pcapgo.NewReader(br); err == nil {
+			r, snaplen = pr, pr.Snaplen()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSanitizer(r.LinkType(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(o)
+	w := pcapgo.NewWriterNanos(bw)
+	if err := w.WriteFileHeader(snaplen, r.LinkType()); err != nil {
+		o.Close()
+		return nil, err
+	}
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		if err := s.Packet(data); err != nil {
+			o.Close()
+			return nil, err
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			o.Close()
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		o.Close()
+		return nil, err
+	}
+	if err := o.Close(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stats returns what has been rewritten so far.
+func (s *Sanitizer) Stats() Stats {
+	return Stats{Packets: s.packets, Addresses: s.addrs.len(), MACs: len(s.macs)}
+}
+
+// Mapping calls fn with each original address and the one it was replaced
+// with, in the order they were first seen.
+func (s *Sanitizer) Mapping(fn func(original, sanitized net.IP)) {
+	for _, a := range s.addrs.order {
+		fn(net.IP(a), s.addrs.m[a])
+	}
+}
+
+// Packet rewrites data, a packet of the sanitizer's link type, in place.
+func (s *Sanitizer) Packet(data []byte) error {
+	s.packets++
+	p := gopacket.NewPacket(data, s.link, gopacket.DecodeOptions{NoCopy: true})
+	var ip4 *layers.IPv4
+	var ip6 *layers.IPv6
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.Ethernet:
+			s.mac(l.Contents[0:6])
+			s.mac(l.Contents[6:12])
+		case *layers.LinuxSLL:
+			if l.AddrLen == 6 {
+				s.mac(l.Contents[6:12])
+			}
+		case *layers.ARP:
+			if len(l.SourceHwAddress) == 6 {
+				s.mac(l.SourceHwAddress)
+				s.mac(l.DstHwAddress)
+			}
+			if err := s.addr(l.SourceProtAddress); err != nil {
+				return err
+			}
+			if err := s.addr(l.DstProtAddress); err != nil {
+				return err
+			}
+		case *layers.IPv4:
+			if ip4 != nil || ip6 != nil {
+				// Only the outer header of tunnelled packets is known
+				// to be complete
+				continue
+			}
+			ip4 = l
+			if err := s.addr(l.Contents[12:16]); err != nil {
+				return err
+			}
+			if err := s.addr(l.Contents[16:20]); err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint16(l.Contents[10:12], 0)
+			binary.BigEndian.PutUint16(l.Contents[10:12], checksum(0, l.Contents))
+		case *layers.IPv6:
+			if ip4 != nil || ip6 != nil {
+				continue
+			}
+			ip6 = l
+			if err := s.addr(l.Contents[8:24]); err != nil {
+				return err
+			}
+			if err := s.addr(l.Contents[24:40]); err != nil {
+				return err
+			}
+		case *layers.TCP:
+			s.tcp(p, l)
+			s.transportChecksum(ip4, ip6, layers.IPProtocolTCP, 16)
+			return nil
+		case *layers.UDP:
+			if l.SrcPort == 53 || l.DstPort == 53 || l.SrcPort == 5353 || l.DstPort == 5353 {
+				if s.opts.Payload == PayloadZero {
+					clear(l.Payload)
+				} else if err := s.dns(l.Payload); err != nil {
+					return err
+				}
+			} else {
+				s.payload(l.Payload)
+			}
+			if binary.BigEndian.Uint16(l.Contents[6:8]) != 0 || ip6 != nil {
+				s.transportChecksum(ip4, ip6, layers.IPProtocolUDP, 6)
+			}
+			return nil
+		case *layers.ICMPv4, *layers.ICMPv6:
+			// ICMP errors quote the packet they are about, addresses and
+			// all, and neighbor discovery carries MACs
+			if s.opts.Payload != PayloadKeep {
+				clear(l.LayerPayload())
+				if _, ok := l.(*layers.ICMPv6); ok {
+					s.transportChecksum(ip4, ip6, layers.IPProtocolICMPv6, 2)
+				} else {
+					c := l.LayerContents()
+					binary.BigEndian.PutUint16(c[2:4], 0)
+					binary.BigEndian.PutUint16(c[2:4], checksum(checksumAdd(0, c), l.LayerPayload()))
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// payload treats a UDP payload, or a TCP payload outside HTTP, according
+// to the payload mode.
+func (s *Sanitizer) payload(b []byte) {
+	switch s.opts.Payload {
+	case PayloadRedact:
+		s.masker.Mask(b)
+	case PayloadHeaders, PayloadZero:
+		clear(b)
+	}
+}
+
+func (s *Sanitizer) tcp(p gopacket.Packet, l *layers.TCP) {
+	b := l.Payload
+	if s.opts.Payload != PayloadHeaders {
+		s.payload(b)
+		return
+	}
+	// Keep HTTP headers, which may continue from the previous segment of
+	// the same direction, and any pipelined message starting right after
+	// them; zero the rest
+	key := p.NetworkLayer().NetworkFlow().String() + " " + l.TransportFlow().String()
+	inHeaders := s.inHeaders[key]
+	for len(b) > 0 {
+		if !inHeaders && !httpstream.LooksLikeHTTP(b) {
+			clear(b)
+			break
+		}
+		end := bytes.Index(b, []byte("\r\n\r\n"))
+		if end < 0 {
+			s.masker.Mask(b)
+			inHeaders = true
+			break
+		}
+		s.masker.Mask(b[:end+4])
+		b, inHeaders = b[end+4:], false
+	}
+	if inHeaders {
+		s.inHeaders[key] = true
+	} else {
+		delete(s.inHeaders, key)
+	}
+}
+
+// transportChecksum recomputes the checksum at offset in the transport
+// header, unless the packet was cut short by the capture's snap length, or
+// the IPv6 header is followed by extension headers.
+func (s *Sanitizer) transportChecksum(ip4 *layers.IPv4, ip6 *layers.IPv6, proto layers.IPProtocol, offset int) {
+	var segment, pseudo []byte
+	switch {
+	case ip4 != nil:
+		if int(ip4.Length) != len(ip4.Contents)+len(ip4.Payload) || ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0 {
+			return
+		}
+		segment = ip4.Payload
+		pseudo = append(append([]byte(nil), ip4.Contents[12:20]...), 0, byte(proto), byte(len(segment)>>8), byte(len(segment)))
+	case ip6 != nil:
+		if ip6.NextHeader != proto || int(ip6.Length) != len(ip6.Payload) {
+			return
+		}
+		segment = ip6.Payload
+		pseudo = append(append([]byte(nil), ip6.Contents[8:40]...),
+			byte(len(segment)>>24), byte(len(segment)>>16), byte(len(segment)>>8), byte(len(segment)), 0, 0, 0, byte(proto))
+	default:
+		return
+	}
+	if len(segment) < offset+2 {
+		return
+	}
+	binary.BigEndian.PutUint16(segment[offset:offset+2], 0)
+	sum := checksum(checksumAdd(0, pseudo), segment)
+	if sum == 0 && proto == layers.IPProtocolUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[offset:offset+2], sum)
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum is the Internet checksum of b, continuing from sum.
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumAdd(sum, b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// mac replaces a unicast MAC address in place with a random, locally
+// administered one. Broadcast and multicast addresses are kept.
+func (s *Sanitizer) mac(b []byte) {
+	if len(b) != 6 || b[0]&0x01 != 0 {
+		return
+	}
+	var orig [6]byte
+	copy(orig[:], b)
+	repl, ok := s.macs[orig]
+	if !ok {
+		rand.Read(repl[:])
+		repl[0] = repl[0]&0xfc | 0x02
+		s.macs[orig] = repl
+	}
+	copy(b, repl[:])
+}
+
+// addr replaces an IPv4 or IPv6 address in place.
+func (s *Sanitizer) addr(b []byte) error {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil
+	}
+	repl, err := s.addrs.get(net.IP(b))
+	if err != nil {
+		return err
+	}
+	if len(b) == net.IPv4len {
+		repl = repl.To4()
+	}
+	copy(b, repl)
+	return nil
+}
@@ -0,0 +1,189 @@
+package sanitize
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/output"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// recorder keeps the messages it is handed.
+type recorder struct {
+	mu    sync.Mutex
+	reqs  []*httpstream.Request
+	resps []*httpstream.Response
+	dns   []*dns.Message
+}
+
+func (r *recorder) HandleRequest(req *httpstream.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reqs = append(r.reqs, req)
+}
+
+func (r *recorder) HandleResponse(resp *httpstream.Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resps = append(r.resps, resp)
+}
+
+func (r *recorder) HandleDNS(msg *dns.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = append(r.dns, msg)
+}
+
+const (
+	request  = "POST /login?password=hunter2 HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: Bearer s3cr3t\r\nContent-Length: 22\r\n\r\nuser=alice@example.com"
+	response = "HTTP/1.1 200 OK\r\nContent-Length: 14\r\n\r\nwelcome, alice"
+)
+
+// capture writes a capture of a client at 192.168.1.5 looking up
+// api.example.com and posting credentials to it, returning its path.
+func capture(t *testing.T) string {
+	t.Helper()
+	b := testutil.NewBuilder()
+	b.DNSQuery("192.168.1.5:53000", "192.168.1.1:53", "api.example.com")
+	b.DNSResponse("192.168.1.5:53000", "192.168.1.1:53", "api.example.com", "93.184.216.34")
+	b.HTTPExchange("192.168.1.5:40000", "93.184.216.34:80", request, response)
+	path := filepath.Join(t.TempDir(), "in.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkChecksums fails the test if a packet of the capture at path has an
+// IPv4, TCP or UDP checksum that doesn't match its contents.
+func checkChecksums(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; ; n++ {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		p := gopacket.NewPacket(data, r.LinkType(), gopacket.Default)
+		ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if ip == nil {
+			continue
+		}
+		if checksum(0, ip.Contents) != 0 {
+			t.Errorf("packet %d: bad IPv4 checksum", n)
+		}
+		// Summed with the pseudo-header, a segment holding the right
+		// checksum sums to zero
+		pseudo := append(append([]byte(nil), ip.Contents[12:20]...), 0, byte(ip.Protocol), byte(len(ip.Payload)>>8), byte(len(ip.Payload)))
+		if checksum(checksumAdd(0, pseudo), ip.Payload) != 0 {
+			t.Errorf("packet %d: bad %v checksum", n, ip.Protocol)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	in := capture(t)
+	secrets := []string{"hunter2", "s3cr3t", "alice@example.com"}
+	tests := []struct {
+		payload string
+		// http is whether the HTTP messages survive, and secrets whether
+		// the credentials in them do.
+		http, secrets bool
+		// body is what is left of the response body.
+		body string
+	}{
+		{PayloadKeep, true, true, "welcome, alice"},
+		{PayloadRedact, true, false, "welcome, alice"},
+		{PayloadHeaders, true, false, strings.Repeat("\x00", 14)},
+		{PayloadZero, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out.pcap")
+			s, err := File(in, out, Options{Payload: tt.payload, Redact: output.DefaultRedactRules})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st := s.Stats(); st.Packets == 0 || st.Addresses != 3 || st.MACs != 2 {
+				t.Errorf("got %+v, want 3 addresses and 2 MACs remapped", st)
+			}
+			mapping := make(map[string]string)
+			s.Mapping(func(original, sanitized net.IP) { mapping[original.String()] = sanitized.String() })
+			// Private addresses stay private and public ones move to
+			// the benchmarking range
+			if a := mapping["192.168.1.5"]; !strings.HasPrefix(a, "10.") {
+				t.Errorf("192.168.1.5 became %s", a)
+			}
+			if a := mapping["93.184.216.34"]; !strings.HasPrefix(a, "198.18.") {
+				t.Errorf("93.184.216.34 became %s", a)
+			}
+			checkChecksums(t, out)
+
+			var r recorder
+			if err := analyzer.Run(out, analyzer.Options{DNS: true}, &r); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.http {
+				if len(r.reqs) != 0 || len(r.resps) != 0 {
+					t.Errorf("got %d requests and %d responses from zeroed payloads", len(r.reqs), len(r.resps))
+				}
+				return
+			}
+			if len(r.reqs) != 1 || len(r.resps) != 1 {
+				t.Fatalf("got %d requests and %d responses, want 1 of each", len(r.reqs), len(r.resps))
+			}
+			req, resp := r.reqs[0], r.resps[0]
+			if req.Flow.SrcIP != mapping["192.168.1.5"] || req.Flow.DstIP != mapping["93.184.216.34"] {
+				t.Errorf("request from %s to %s, want the remapped addresses", req.Flow.SrcIP, req.Flow.DstIP)
+			}
+			// The lookup answers with the server's new address
+			var answers []string
+			for _, msg := range r.dns {
+				for _, a := range msg.Answers {
+					answers = append(answers, a.Value)
+				}
+			}
+			if len(answers) != 1 || answers[0] != req.Flow.DstIP {
+				t.Errorf("DNS answered %v, want the server's new address %s", answers, req.Flow.DstIP)
+			}
+			if string(resp.Body) != tt.body {
+				t.Errorf("got response body %q, want %q", resp.Body, tt.body)
+			}
+			var text bytes.Buffer
+			text.WriteString(req.URI + "\n")
+			req.Header.Write(&text)
+			text.Write(req.Body)
+			for _, secret := range secrets {
+				if got := strings.Contains(text.String(), secret); got != tt.secrets {
+					t.Errorf("found %q: %v, want %v:\n%s", secret, got, tt.secrets, text.String())
+				}
+			}
+		})
+	}
+}
+
+func TestNewSanitizer(t *testing.T) {
+	if _, err := NewSanitizer(layers.LinkTypeEthernet, Options{Payload: "scramble"}); err == nil {
+		t.Error("accepted an unknown payload mode")
+	}
+}
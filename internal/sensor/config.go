@@ -0,0 +1,229 @@
+// Package sensor holds what the daemon subcommand runs from: its
+// configuration file, and the detection that SIGHUP reloads while the
+// capture goes on.
+package sensor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/pcap-analyzer/internal/syslog"
+)
+
+// Config is the daemon's configuration file, in JSON. Passwords and
+// secrets aren't part of it; they are read from the environment, as with
+// the command-line flags.
+type Config struct {
+	// Interface is captured live; File reads a capture instead, for trying
+	// a configuration out.
+	Interface string `json:"interface"`
+	File      string `json:"file"`
+	// DNS parses DNS messages; it defaults to true.
+	DNS *bool `json:"dns"`
+	// IdleTimeout parses and releases connections idle this long; it
+	// defaults to 2m.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	// Rules are Suricata or Snort rule files, with the variables they use.
+	Rules    []string          `json:"rules"`
+	RuleVars map[string]string `json:"rule_vars"`
+	// IOC are indicator files.
+	IOC []string `json:"ioc"`
+
+	GRPC       *GRPC       `json:"grpc"`
+	Webhook    *Webhook    `json:"webhook"`
+	ClickHouse *ClickHouse `json:"clickhouse"`
+	Kafka      *Kafka      `json:"kafka"`
+	OTLP       *OTLP       `json:"otlp"`
+	Syslog     *Syslog     `json:"syslog"`
+	Metrics    *Metrics    `json:"metrics"`
+	Alerts     *Alerts     `json:"alerts"`
+	Redact     *Redact     `json:"redact"`
+}
+
+// GRPC serves the event stream of the grpc subcommand.
+type GRPC struct {
+	Addr    string `json:"addr"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	Buffer  int    `json:"buffer"`
+}
+
+// Webhook posts the events matching Filters or Config.Rules to URLs.
+type Webhook struct {
+	URLs    []string `json:"urls"`
+	Filters []string `json:"filters"`
+}
+
+// ClickHouse inserts every event into a table.
+type ClickHouse struct {
+	URL       string   `json:"url"`
+	Table     string   `json:"table"`
+	User      string   `json:"user"`
+	BatchSize int      `json:"batch_size"`
+	Flush     Duration `json:"flush_interval"`
+}
+
+// Kafka publishes every HTTP transaction to a topic.
+type Kafka struct {
+	Brokers  []string `json:"brokers"`
+	Topic    string   `json:"topic"`
+	TLS      bool     `json:"tls"`
+	CAFile   string   `json:"ca_file"`
+	CertFile string   `json:"cert_file"`
+	KeyFile  string   `json:"key_file"`
+	Insecure bool     `json:"insecure"`
+	SASL     string   `json:"sasl"`
+	User     string   `json:"user"`
+	MaxBody  int      `json:"max_body"`
+}
+
+// OTLP exports every HTTP transaction as an OpenTelemetry span.
+type OTLP struct {
+	Endpoint string   `json:"endpoint"`
+	Service  string   `json:"service"`
+	Flush    Duration `json:"flush_interval"`
+}
+
+// Syslog sends a summary of every HTTP transaction to a syslog server.
+// Facility and Severity are names, defaulting to local0 and info.
+type Syslog struct {
+	Addr     string `json:"addr"`
+	Facility string `json:"facility"`
+	Severity string `json:"severity"`
+	Insecure bool   `json:"insecure"`
+}
+
+// Metrics serves Prometheus metrics of the traffic seen on /metrics.
+type Metrics struct {
+	Addr     string `json:"addr"`
+	MaxHosts int    `json:"max_hosts"`
+}
+
+// Alerts sends rule and indicator matches to Slack or by email.
+type Alerts struct {
+	Slack    string   `json:"slack"`
+	SMTP     string   `json:"smtp"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	SMTPUser string   `json:"smtp_user"`
+	Template string   `json:"template"`
+	Rate     int      `json:"rate"`
+	Cooldown Duration `json:"cooldown"`
+}
+
+// Redact removes credentials, cookies, email addresses and card numbers
+// from everything the sinks are sent, as -redact does, along with the
+// values of Headers and Fields and whatever Patterns match.
+type Redact struct {
+	Headers  []string `json:"headers"`
+	Fields   []string `json:"fields"`
+	Patterns []string `json:"patterns"`
+}
+
+// Regexps returns the compiled Patterns, which Load has checked.
+func (r *Redact) Regexps() []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(r.Patterns))
+	for i, p := range r.Patterns {
+		res[i] = regexp.MustCompile(p)
+	}
+	return res
+}
+
+// Duration is a time.Duration written as a string such as "90s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings such as \"90s\"")
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load reads and checks a configuration file. Unknown keys are errors, so
+// that a misspelt setting isn't silently ignored.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if (c.Interface == "") == (c.File == "") {
+		return nil, fmt.Errorf("%s: set one of interface and file", path)
+	}
+	if c.DNS == nil {
+		dns := true
+		c.DNS = &dns
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = Duration(2 * time.Minute)
+	}
+	if c.Webhook != nil && len(c.Webhook.Filters) == 0 && len(c.Rules) == 0 {
+		return nil, fmt.Errorf("%s: webhook needs filters or rules", path)
+	}
+	if l := c.Syslog; l != nil {
+		if l.Facility == "" {
+			l.Facility = "local0"
+		}
+		if l.Severity == "" {
+			l.Severity = "info"
+		}
+		if _, err := syslog.Facility(l.Facility); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if _, err := syslog.Severity(l.Severity); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if c.Metrics != nil && c.Metrics.Addr == "" {
+		return nil, fmt.Errorf("%s: metrics needs addr", path)
+	}
+	if c.Alerts != nil && len(c.Rules) == 0 && len(c.IOC) == 0 {
+		return nil, fmt.Errorf("%s: alerts need rules or ioc", path)
+	}
+	if c.Redact != nil {
+		for _, p := range c.Redact.Patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("%s: redact: %w", path, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// fixed returns a copy of c without the settings SIGHUP reloads: rules,
+// rule variables, indicators and webhook filters.
+func (c *Config) fixed() Config {
+	r := *c
+	r.Rules, r.RuleVars, r.IOC = nil, nil, nil
+	if c.Webhook != nil {
+		w := *c.Webhook
+		w.Filters = nil
+		r.Webhook = &w
+	}
+	return r
+}
+
+// NeedsRestart reports whether switching from c to next changes settings
+// that SIGHUP doesn't reload.
+func (c *Config) NeedsRestart(next *Config) bool {
+	a, _ := json.Marshal(c.fixed())
+	b, _ := json.Marshal(next.fixed())
+	return !bytes.Equal(a, b)
+}
@@ -0,0 +1,98 @@
+package sensor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/ioc"
+	"github.com/pcap-analyzer/internal/report"
+	"github.com/pcap-analyzer/internal/rules"
+)
+
+// Detection is the rules and indicators of a configuration.
+type Detection struct {
+	Rules *rules.Set
+	IOC   *ioc.Set
+}
+
+// Detection loads c's rule and indicator files. Either may be empty.
+func (c *Config) Detection() (*Detection, error) {
+	vars := make(map[string]string, len(c.RuleVars))
+	for name, value := range c.RuleVars {
+		vars[strings.TrimPrefix(name, "$")] = value
+	}
+	set, err := rules.Load(vars, c.Rules...)
+	if err != nil {
+		return nil, err
+	}
+	iocs, err := ioc.Load(c.IOC...)
+	if err != nil {
+		return nil, err
+	}
+	return &Detection{Rules: set, IOC: iocs}, nil
+}
+
+// Detector is a handler matching events against IDS rules and indicators
+// of compromise, which Swap replaces while the capture goes on, and passing
+// each match to Notify as a finding. Unlike the reports, it keeps no record
+// of rule matches, so it can run indefinitely.
+type Detector struct {
+	current atomic.Pointer[Detection]
+	ioc     *report.IOC
+	notify  report.FindingFunc
+}
+
+func NewDetector(det *Detection, notify report.FindingFunc) *Detector {
+	d := &Detector{notify: notify}
+	d.current.Store(det)
+	// Indicator matches are counted per indicator and way it matched, which
+	// is bounded; the report itself is never printed
+	d.ioc = report.NewIOC(io.Discard, det.IOC)
+	d.ioc.Notify = notify
+	return d
+}
+
+// Swap switches to det from the next event on.
+func (d *Detector) Swap(det *Detection) {
+	d.current.Store(det)
+	d.ioc.SetIndicators(det.IOC)
+}
+
+func (d *Detector) HandleRequest(req *httpstream.Request) {
+	d.match(d.current.Load().Rules.MatchRequest(req), req.SrcIP, req.DstIP, req.Flow.String()+" "+req.Method+" "+req.URL, req.Timestamp)
+	d.ioc.HandleRequest(req)
+}
+
+func (d *Detector) HandleResponse(resp *httpstream.Response) {
+	detail := resp.Flow.Reverse().String() + " " + resp.Status
+	if req := resp.Request; req != nil {
+		detail = resp.Flow.Reverse().String() + " " + req.Method + " " + req.URL + " -> " + resp.Status
+	}
+	d.match(d.current.Load().Rules.MatchResponse(resp), resp.DstIP, resp.SrcIP, detail, resp.Timestamp)
+	d.ioc.HandleResponse(resp)
+}
+
+func (d *Detector) HandleDNS(msg *dns.Message) {
+	detail := msg.SrcIP + " -> " + msg.DstIP + " " + msg.QType + " " + strings.TrimSuffix(msg.Question, ".")
+	d.match(d.current.Load().Rules.MatchDNS(msg), msg.SrcIP, msg.DstIP, detail, msg.Timestamp)
+	d.ioc.HandleDNS(msg)
+}
+
+// match notifies each rule that matched an event between client and
+// server. Repeats of a rule between the same hosts share a key.
+func (d *Detector) match(matched []*rules.Rule, client, server, detail string, ts time.Time) {
+	for _, r := range matched {
+		d.notify(report.Finding{
+			Kind:    "rule",
+			Time:    ts,
+			Key:     fmt.Sprintf("%d %s %s", r.SID, client, server),
+			Summary: fmt.Sprintf("Rule %d: %s", r.SID, r.Msg),
+			Detail:  detail,
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Transaction is a request and its response as returned by the API. Either
+// side's fields are empty when only half of the exchange was captured.
+type Transaction struct {
+	// ID is the transaction's position in capture order, starting at 1.
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Server string    `json:"server"`
+	Method string    `json:"method,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	// Status is zero when no response was seen.
+	Status          int         `json:"status,omitempty"`
+	StatusText      string      `json:"status_text,omitempty"`
+	ContentType     string      `json:"content_type,omitempty"`
+	RequestHeaders  http.Header `json:"request_headers,omitempty"`
+	ResponseHeaders http.Header `json:"response_headers,omitempty"`
+	RequestSize     int64       `json:"request_body_size"`
+	ResponseSize    int64       `json:"response_body_size"`
+	// Duration is from the start of the request to the start of the
+	// response, in milliseconds.
+	Duration float64 `json:"duration_ms,omitempty"`
+	// RequestBody and ResponseBody hold the first previewSize bytes of
+	// text bodies, with their Content-Encoding removed. They are only
+	// returned for a single transaction.
+	RequestBody  string `json:"request_body,omitempty"`
+	ResponseBody string `json:"response_body,omitempty"`
+}
+
+// previewSize is how much of each text body is kept.
+const previewSize = 4096
+
+// bodyPreview returns the start of m's body if it is text.
+func bodyPreview(m *httpstream.Message) string {
+	body, _, err := m.DecodedBody()
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+	if len(body) > previewSize {
+		body = body[:previewSize]
+		// Don't let a character cut in two make the body look binary
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if !utf8.Valid(body) || bytes.IndexByte(body, 0) >= 0 {
+		return ""
+	}
+	return string(body)
+}
+
+// DNSMessage is a DNS query or response as returned by the API.
+type DNSMessage struct {
+	Time     time.Time   `json:"time"`
+	Client   string      `json:"client"`
+	Server   string      `json:"server"`
+	Response bool        `json:"response"`
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Rcode    string      `json:"rcode,omitempty"`
+	Answers  []DNSAnswer `json:"answers,omitempty"`
+}
+
+// DNSAnswer is one record of a DNS response.
+type DNSAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Summary holds totals for a whole capture.
+type Summary struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     float64   `json:"duration_seconds"`
+	Transactions int       `json:"transactions"`
+	// Unanswered counts requests no response was seen for.
+	Unanswered   int                    `json:"unanswered"`
+	DNSMessages  int                    `json:"dns_messages"`
+	Methods      map[string]int         `json:"methods"`
+	Statuses     map[string]int         `json:"statuses"`
+	ContentTypes map[string]int         `json:"content_types"`
+	Hosts        []HostCount            `json:"hosts"`
+	Stats        analyzer.StatsSnapshot `json:"stats"`
+}
+
+// HostCount is the traffic to one host. Errors counts responses with a
+// status of 400 or more, and Bytes both bodies of every transaction.
+type HostCount struct {
+	Host     string `json:"host"`
+	Requests int    `json:"requests"`
+	Errors   int    `json:"errors"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Results is everything a job extracted from its capture.
+type Results struct {
+	Transactions []Transaction
+	DNS          []DNSMessage
+	Summary      Summary
+}
+
+// collector is the Handler a job runs with, converting events to their API
+// form as they arrive so the parsed messages can be released.
+type collector struct {
+	mu           sync.Mutex
+	transactions []Transaction
+	byRequest    map[*httpstream.Request]int
+	dns          []DNSMessage
+	stats        analyzer.StatsSnapshot
+}
+
+func newCollector() *collector {
+	return &collector{byRequest: make(map[*httpstream.Request]int)}
+}
+
+func (c *collector) HandleRequest(req *httpstream.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byRequest[req] = len(c.transactions)
+	c.transactions = append(c.transactions, Transaction{
+		Time:           req.Timestamp,
+		Client:         net.JoinHostPort(req.SrcIP, req.SrcPort),
+		Server:         net.JoinHostPort(req.DstIP, req.DstPort),
+		Method:         req.Method,
+		URL:            req.URL,
+		Host:           req.Host,
+		RequestHeaders: req.Header,
+		RequestSize:    req.BodySize,
+		RequestBody:    bodyPreview(&req.Message),
+	})
+}
+
+func (c *collector) HandleResponse(resp *httpstream.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.byRequest[resp.Request]
+	if !ok || resp.Request == nil {
+		i = len(c.transactions)
+		c.transactions = append(c.transactions, Transaction{
+			Time:   resp.Timestamp,
+			Client: net.JoinHostPort(resp.DstIP, resp.DstPort),
+			Server: net.JoinHostPort(resp.SrcIP, resp.SrcPort),
+		})
+	}
+	delete(c.byRequest, resp.Request)
+	t := &c.transactions[i]
+	t.Status = resp.StatusCode
+	t.StatusText = resp.Status
+	t.ContentType = resp.Header.Get("Content-Type")
+	t.ResponseHeaders = resp.Header
+	t.ResponseSize = resp.BodySize
+	t.ResponseBody = bodyPreview(&resp.Message)
+	if ok {
+		t.Duration = float64(resp.Timestamp.Sub(t.Time)) / float64(time.Millisecond)
+	}
+}
+
+func (c *collector) HandleDNS(msg *dns.Message) {
+	m := DNSMessage{
+		Time:     msg.Timestamp,
+		Client:   msg.SrcIP,
+		Server:   msg.DstIP,
+		Response: msg.Response,
+		Name:     msg.Question,
+		Type:     msg.QType,
+		Rcode:    msg.Rcode,
+	}
+	if msg.Response {
+		m.Client, m.Server = msg.DstIP, msg.SrcIP
+	}
+	for _, a := range msg.Answers {
+		m.Answers = append(m.Answers, DNSAnswer{Name: a.Name, Type: a.Type, Value: a.Value})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dns = append(c.dns, m)
+}
+
+func (c *collector) HandleStats(s analyzer.StatsSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = s
+}
+
+// results sorts what was collected into capture order and totals it.
+func (c *collector) results() *Results {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sort.SliceStable(c.transactions, func(i, j int) bool { return c.transactions[i].Time.Before(c.transactions[j].Time) })
+	sort.SliceStable(c.dns, func(i, j int) bool { return c.dns[i].Time.Before(c.dns[j].Time) })
+
+	s := Summary{
+		Transactions: len(c.transactions),
+		DNSMessages:  len(c.dns),
+		Methods:      make(map[string]int),
+		Statuses:     make(map[string]int),
+		ContentTypes: make(map[string]int),
+		Stats:        c.stats,
+	}
+	hosts := make(map[string]*HostCount)
+	seen := func(ts time.Time) {
+		if s.Start.IsZero() || ts.Before(s.Start) {
+			s.Start = ts
+		}
+		if ts.After(s.End) {
+			s.End = ts
+		}
+	}
+	for i := range c.transactions {
+		t := &c.transactions[i]
+		t.ID = i + 1
+		seen(t.Time)
+		if t.Method != "" {
+			s.Methods[t.Method]++
+			h, ok := hosts[t.Host]
+			if !ok {
+				h = &HostCount{Host: t.Host}
+				hosts[t.Host] = h
+			}
+			h.Requests++
+			h.Bytes += t.RequestSize + t.ResponseSize
+			if t.Status >= 400 {
+				h.Errors++
+			}
+			if t.Status == 0 {
+				s.Unanswered++
+			}
+		}
+		if t.Status != 0 {
+			s.Statuses[strconv.Itoa(t.Status)]++
+		}
+		if t.ContentType != "" {
+			s.ContentTypes[mediaType(t.ContentType)]++
+		}
+	}
+	for _, m := range c.dns {
+		seen(m.Time)
+	}
+	s.Duration = s.End.Sub(s.Start).Seconds()
+	for _, h := range hosts {
+		s.Hosts = append(s.Hosts, *h)
+	}
+	sort.Slice(s.Hosts, func(i, j int) bool {
+		if s.Hosts[i].Requests != s.Hosts[j].Requests {
+			return s.Hosts[i].Requests > s.Hosts[j].Requests
+		}
+		return s.Hosts[i].Host < s.Hosts[j].Host
+	})
+	return &Results{Transactions: c.transactions, DNS: c.dns, Summary: s}
+}
+
+// mediaType returns a Content-Type without its parameters.
+func mediaType(contentType string) string {
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(strings.ToLower(mt))
+}
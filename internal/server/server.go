@@ -0,0 +1,726 @@
+// Package server exposes the analyzer over an HTTP API: captures are
+// uploaded or referenced by path, analyzed by jobs in the background, and
+// their transactions, DNS messages and summaries fetched as JSON. A web UI
+// for browsing the results is served from the same address.
+package server
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Job states.
+const (
+	Queued  = "queued"
+	Running = "running"
+	Done    = "done"
+	Failed  = "failed"
+)
+
+// defaultLimit and maxLimit bound how many items one page of results holds.
+const (
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// ui is the single-page web UI, which uses nothing but the API.
+//
+//go:embed ui
+var ui embed.FS
+
+// Capture is a capture file the server can analyze.
+type Capture struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Path is set for captures referenced in place rather than uploaded.
+	Path    string    `json:"path,omitempty"`
+	Created time.Time `json:"created"`
+
+	file string
+}
+
+// Job is one analysis of a capture.
+type Job struct {
+	ID       string     `json:"id"`
+	Capture  string     `json:"capture"`
+	DNS      bool       `json:"dns"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Progress is what has been processed so far, while the job runs and
+	// after it ends.
+	Progress *analyzer.StatsSnapshot `json:"progress,omitempty"`
+
+	stats   *analyzer.Stats
+	results *Results
+}
+
+// Config controls a Server.
+type Config struct {
+	// Dir is where uploaded captures are stored.
+	Dir string
+	// Allow lists directories captures may be referenced from by path.
+	// When empty, captures can only be uploaded.
+	Allow []string
+	// MaxUpload is the largest upload accepted, in bytes. Zero means no
+	// limit.
+	MaxUpload int64
+	// Jobs is how many jobs run at once; zero means one.
+	Jobs int
+	// Options are the analyzer options every job starts from.
+	Options analyzer.Options
+}
+
+// Server is the HTTP API. It keeps jobs and their results in memory.
+type Server struct {
+	cfg   Config
+	slots chan struct{}
+	mux   *http.ServeMux
+
+	mu       sync.Mutex
+	captures map[string]*Capture
+	jobs     map[string]*Job
+}
+
+// New returns a server storing uploads in cfg.Dir, which is created if it
+// doesn't exist.
+func New(cfg Config) (*Server, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	for i, dir := range cfg.Allow {
+		abs, err := filepath.Abs(dir)
+		if err == nil {
+			abs, err = filepath.EvalSymlinks(abs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg.Allow[i] = abs
+	}
+	if cfg.Jobs <= 0 {
+		cfg.Jobs = 1
+	}
+	s := &Server{
+		cfg:      cfg,
+		slots:    make(chan struct{}, cfg.Jobs),
+		mux:      http.NewServeMux(),
+		captures: make(map[string]*Capture),
+		jobs:     make(map[string]*Job),
+	}
+	s.mux.HandleFunc("/api/captures", s.handleCaptures)
+	s.mux.HandleFunc("/api/captures/", s.handleCapture)
+	s.mux.HandleFunc("/api/jobs", s.handleJobs)
+	s.mux.HandleFunc("/api/jobs/", s.handleJob)
+	static, err := fs.Sub(ui, "ui")
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Handle("/", http.FileServer(http.FS(static)))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// apiError is an error with the HTTP status it is reported with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func errorf(status int, format string, args ...any) error {
+	return &apiError{status, fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var ae *apiError
+	if errors.As(err, &ae) {
+		status = ae.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, errorf(http.StatusMethodNotAllowed, "method not allowed"))
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleCaptures lists captures, and adds one from an upload or a JSON
+// body naming a file under an allowed directory.
+func (s *Server) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		list := make([]*Capture, 0, len(s.captures))
+		for _, c := range s.captures {
+			list = append(list, c)
+		}
+		s.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var c *Capture
+		var err error
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+			c, err = s.reference(r)
+		} else {
+			c, err = s.upload(r)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s.mu.Lock()
+		s.captures[c.ID] = c
+		s.mu.Unlock()
+		writeJSON(w, http.StatusCreated, c)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// upload stores the request body, or the "file" part of a multipart form,
+// as a new capture. The name is taken from the form's file name or the
+// name query parameter.
+func (s *Server) upload(r *http.Request) (*Capture, error) {
+	body := r.Body
+	if s.cfg.MaxUpload > 0 {
+		body = http.MaxBytesReader(nil, body, s.cfg.MaxUpload)
+	}
+	c := &Capture{ID: newID(), Name: r.URL.Query().Get("name"), Created: time.Now()}
+	var src io.Reader = body
+	if mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		part, err := findPart(body, params["boundary"], "file")
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			c.Name = part.FileName()
+		}
+		src = part
+	}
+	if c.Name == "" {
+		c.Name = c.ID + ".pcap"
+	}
+	c.Name = filepath.Base(c.Name)
+	c.file = filepath.Join(s.cfg.Dir, c.ID+filepath.Ext(c.Name))
+
+	f, err := os.Create(c.file)
+	if err != nil {
+		return nil, err
+	}
+	c.Size, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && c.Size == 0 {
+		err = errorf(http.StatusBadRequest, "empty upload")
+	}
+	if err != nil {
+		os.Remove(c.file)
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			err = errorf(http.StatusRequestEntityTooLarge, "upload larger than %d bytes", mbe.Limit)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// reference adds a capture already on disk, named by the path field of a
+// JSON body. The path must be inside one of the allowed directories.
+func (s *Server) reference(r *http.Request) (*Capture, error) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+	if body.Path == "" {
+		return nil, errorf(http.StatusBadRequest, "path is required")
+	}
+	if len(s.cfg.Allow) == 0 {
+		return nil, errorf(http.StatusForbidden, "referencing captures by path is not enabled")
+	}
+	abs, err := filepath.Abs(body.Path)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return nil, errorf(http.StatusNotFound, "%s: no such file", body.Path)
+	}
+	if !s.allowed(abs) {
+		return nil, errorf(http.StatusForbidden, "%s is not in an allowed directory", body.Path)
+	}
+	info, err := os.Stat(abs)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, errorf(http.StatusNotFound, "%s: not a file", body.Path)
+	}
+	return &Capture{ID: newID(), Name: filepath.Base(abs), Size: info.Size(), Path: abs, Created: time.Now(), file: abs}, nil
+}
+
+// Add adds the capture at path, which need not be in an allowed directory,
+// such as one named on the command line.
+func (s *Server) Add(path string) (*Capture, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{ID: newID(), Name: filepath.Base(abs), Size: info.Size(), Path: abs, Created: time.Now(), file: abs}
+	s.mu.Lock()
+	s.captures[c.ID] = c
+	s.mu.Unlock()
+	return c, nil
+}
+
+// allowed reports whether path, which must be absolute with symbolic links
+// resolved, is inside an allowed directory.
+func (s *Server) allowed(path string) bool {
+	for _, dir := range s.cfg.Allow {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCapture returns or deletes one capture. Deleting an uploaded
+// capture removes its file; referenced files are left alone.
+func (s *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/captures/")
+	s.mu.Lock()
+	c, ok := s.captures[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, errorf(http.StatusNotFound, "no capture %q", id))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, c)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.captures, id)
+		s.mu.Unlock()
+		if c.Path == "" {
+			os.Remove(c.file)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleJobs lists jobs, and starts one on the capture named in a JSON
+// body.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		list := make([]*Job, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			list = append(list, j.view())
+		}
+		s.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var body struct {
+			Capture string `json:"capture"`
+			DNS     *bool  `json:"dns"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, errorf(http.StatusBadRequest, "invalid JSON: %v", err))
+			return
+		}
+		view, err := s.Start(body.Capture, body.DNS == nil || *body.DNS)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, view)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// Start queues a job analyzing the capture with the given ID, with DNS
+// parsing if dns is set, and returns a copy of it.
+func (s *Server) Start(capture string, dns bool) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.captures[capture]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no capture %q", capture)
+	}
+	j := &Job{ID: newID(), Capture: c.ID, DNS: dns, Status: Queued, Created: time.Now(), stats: &analyzer.Stats{}}
+	s.jobs[j.ID] = j
+	go s.run(j, c.file)
+	return j.view(), nil
+}
+
+// view returns a copy of j safe to encode while it runs. The server's lock
+// must be held.
+func (j *Job) view() *Job {
+	v := *j
+	if j.Status != Queued {
+		snap := j.stats.Snapshot()
+		v.Progress = &snap
+	}
+	return &v
+}
+
+// run analyzes a capture for j once a slot is free.
+func (s *Server) run(j *Job, path string) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	s.mu.Lock()
+	started := time.Now()
+	j.Status, j.Started = Running, &started
+	s.mu.Unlock()
+
+	opts := s.cfg.Options
+	opts.DNS = opts.DNS || j.DNS
+	opts.Stats = j.stats
+	c := newCollector()
+	err := analyzer.Run(path, opts, c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	j.Finished = &finished
+	if err != nil {
+		j.Status, j.Error = Failed, err.Error()
+		log.Printf("job %s: %v", j.ID, err)
+		return
+	}
+	j.Status, j.results = Done, c.results()
+}
+
+// handleJob serves a job's status and, once it is done, its results:
+// /api/jobs/{id}, /api/jobs/{id}/transactions[/{n}], /api/jobs/{id}/dns,
+// /api/jobs/{id}/summary and /api/jobs/{id}/timeline. Deleting a job
+// discards its results.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, part, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var view *Job
+	if ok {
+		view = j.view()
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, errorf(http.StatusNotFound, "no job %q", id))
+		return
+	}
+	if part == "" && r.Method == http.MethodDelete {
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+	if part == "" {
+		writeJSON(w, http.StatusOK, view)
+		return
+	}
+	res := view.results
+	if res == nil {
+		writeError(w, errorf(http.StatusConflict, "job %s is %s", id, view.Status))
+		return
+	}
+	q := r.URL.Query()
+	part, n, _ := strings.Cut(part, "/")
+	switch part {
+	case "summary":
+		writeJSON(w, http.StatusOK, res.Summary)
+	case "transactions":
+		if n != "" {
+			i, err := strconv.Atoi(n)
+			if err != nil || i < 1 || i > len(res.Transactions) {
+				writeError(w, errorf(http.StatusNotFound, "no transaction %q", n))
+				return
+			}
+			writeJSON(w, http.StatusOK, res.Transactions[i-1])
+			return
+		}
+		f, err := parseFilter(q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var matched []Transaction
+		for _, t := range res.Transactions {
+			if f.match(t) {
+				t.RequestBody, t.ResponseBody = "", ""
+				matched = append(matched, t)
+			}
+		}
+		writePage(w, q, matched)
+	case "timeline":
+		f, err := parseFilter(q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		buckets := defaultBuckets
+		if v := first(q, "buckets"); v != "" {
+			if buckets, err = strconv.Atoi(v); err != nil || buckets < 1 || buckets > maxBuckets {
+				writeError(w, errorf(http.StatusBadRequest, "invalid buckets %q", v))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, timeline(res, f, buckets))
+	case "dns":
+		name := strings.ToLower(strings.TrimSuffix(q.Get("name"), "."))
+		typ := strings.ToUpper(q.Get("type"))
+		var matched []DNSMessage
+		for _, m := range res.DNS {
+			if name != "" && !matchHost(strings.TrimSuffix(m.Name, "."), name) {
+				continue
+			}
+			if typ != "" && m.Type != typ {
+				continue
+			}
+			matched = append(matched, m)
+		}
+		writePage(w, q, matched)
+	default:
+		writeError(w, errorf(http.StatusNotFound, "no such result %q", part))
+	}
+}
+
+// defaultBuckets and maxBuckets bound how many intervals a timeline is
+// split into.
+const (
+	defaultBuckets = 60
+	maxBuckets     = 1000
+)
+
+// Timeline counts the transactions in equal intervals of a capture.
+type Timeline struct {
+	Start time.Time `json:"start"`
+	// Interval is the length of each bucket in seconds.
+	Interval float64  `json:"interval_seconds"`
+	Buckets  []Bucket `json:"buckets"`
+}
+
+// Bucket is one interval of a timeline. Statuses counts transactions by
+// status class, such as "2xx", with "none" for those without a response.
+type Bucket struct {
+	Time     time.Time      `json:"time"`
+	Total    int            `json:"total"`
+	Statuses map[string]int `json:"statuses"`
+	Bytes    int64          `json:"bytes"`
+}
+
+// timeline splits the capture into n buckets and counts the transactions
+// f matches in each.
+func timeline(res *Results, f filter, n int) Timeline {
+	start, end := res.Summary.Start, res.Summary.End
+	interval := end.Sub(start) / time.Duration(n)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	tl := Timeline{Start: start, Interval: interval.Seconds(), Buckets: make([]Bucket, n)}
+	for i := range tl.Buckets {
+		tl.Buckets[i] = Bucket{Time: start.Add(time.Duration(i) * interval), Statuses: make(map[string]int)}
+	}
+	for _, t := range res.Transactions {
+		if !f.match(t) {
+			continue
+		}
+		i := min(int(t.Time.Sub(start)/interval), n-1)
+		b := &tl.Buckets[i]
+		b.Total++
+		b.Bytes += t.RequestSize + t.ResponseSize
+		class := "none"
+		if t.Status != 0 {
+			class = fmt.Sprintf("%dxx", t.Status/100)
+		}
+		b.Statuses[class]++
+	}
+	return tl
+}
+
+// page is one page of a list of results.
+type page[T any] struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Items  []T `json:"items"`
+}
+
+// writePage writes the part of items selected by the offset and limit
+// query parameters.
+func writePage[T any](w http.ResponseWriter, q map[string][]string, items []T) {
+	offset, limit := 0, defaultLimit
+	if v := first(q, "offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, errorf(http.StatusBadRequest, "invalid offset %q", v))
+			return
+		}
+		offset = n
+	}
+	if v := first(q, "limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, errorf(http.StatusBadRequest, "invalid limit %q", v))
+			return
+		}
+		limit = min(n, maxLimit)
+	}
+	p := page[T]{Total: len(items), Offset: offset, Items: []T{}}
+	if offset < len(items) {
+		p.Items = items[offset:min(offset+limit, len(items))]
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func first(q map[string][]string, key string) string {
+	if v := q[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// filter selects transactions by the query parameters host, method,
+// status, client, q (a substring of the URL) and from and to (RFC 3339
+// times).
+type filter struct {
+	host, method, client, text string
+	status                     int
+	from, to                   time.Time
+}
+
+func parseFilter(q map[string][]string) (filter, error) {
+	f := filter{
+		host:   strings.ToLower(first(q, "host")),
+		method: strings.ToUpper(first(q, "method")),
+		client: first(q, "client"),
+		text:   strings.ToLower(first(q, "q")),
+	}
+	var err error
+	if v := first(q, "status"); v != "" {
+		if f.status, err = strconv.Atoi(v); err != nil {
+			return f, errorf(http.StatusBadRequest, "invalid status %q", v)
+		}
+	}
+	for _, t := range []struct {
+		key string
+		to  *time.Time
+	}{{"from", &f.from}, {"to", &f.to}} {
+		if v := first(q, t.key); v != "" {
+			if *t.to, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, errorf(http.StatusBadRequest, "invalid %s time %q", t.key, v)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f filter) match(t Transaction) bool {
+	switch {
+	case f.host != "" && !matchHost(strings.ToLower(stripPort(t.Host)), f.host):
+		return false
+	case f.method != "" && t.Method != f.method:
+		return false
+	case f.status != 0 && t.Status != f.status:
+		return false
+	case f.client != "" && stripPort(t.Client) != f.client && t.Client != f.client:
+		return false
+	case f.text != "" && !strings.Contains(strings.ToLower(t.URL), f.text):
+		return false
+	case !f.from.IsZero() && t.Time.Before(f.from):
+		return false
+	case !f.to.IsZero() && t.Time.After(f.to):
+		return false
+	}
+	return true
+}
+
+// matchHost reports whether host is pattern, or a subdomain of it when
+// pattern starts with "*.".
+func matchHost(host, pattern string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// stripPort removes the port, if any, from a Host header value or address.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// findPart returns the form part called name from a multipart body.
+func findPart(body io.Reader, boundary, name string) (*multipart.Part, error) {
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errorf(http.StatusBadRequest, "no %q part in form", name)
+		}
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid form: %v", err)
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
+	}
+}
@@ -0,0 +1,495 @@
+// Package sqlite stores the flows, HTTP transactions and DNS messages of a
+// run in a SQLite database, in normalized tables to be queried with SQL
+// afterwards.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	_ "modernc.org/sqlite"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+)
+
+// Schema creates the tables, and the transactions view joining requests
+// with their responses. Every run adds a row to captures, and the rows it
+// writes elsewhere refer to it, so that one database can hold many runs.
+const Schema = `
+CREATE TABLE IF NOT EXISTS captures (
+    id          INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL,
+    created_at  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS flows (
+    id           INTEGER PRIMARY KEY,
+    capture_id   INTEGER NOT NULL REFERENCES captures(id),
+    transport    TEXT NOT NULL,
+    client_ip    TEXT NOT NULL,
+    client_port  INTEGER NOT NULL,
+    server_ip    TEXT NOT NULL,
+    server_port  INTEGER NOT NULL,
+    first_seen   TEXT NOT NULL,
+    last_seen    TEXT NOT NULL,
+    packets      INTEGER NOT NULL,
+    bytes        INTEGER NOT NULL,
+    client_bytes INTEGER NOT NULL,
+    server_bytes INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS http_requests (
+    id             INTEGER PRIMARY KEY,
+    capture_id     INTEGER NOT NULL REFERENCES captures(id),
+    flow_id        INTEGER REFERENCES flows(id),
+    txid           TEXT,
+    time           TEXT NOT NULL,
+    src_ip         TEXT NOT NULL,
+    src_port       INTEGER,
+    dst_ip         TEXT NOT NULL,
+    dst_port       INTEGER,
+    method         TEXT NOT NULL,
+    url            TEXT NOT NULL,
+    host           TEXT,
+    uri            TEXT,
+    proto          TEXT,
+    content_type   TEXT,
+    user_agent     TEXT,
+    body_size      INTEGER NOT NULL,
+    body           BLOB,
+    body_truncated INTEGER NOT NULL,
+    sha256         TEXT
+);
+CREATE TABLE IF NOT EXISTS http_responses (
+    id             INTEGER PRIMARY KEY,
+    capture_id     INTEGER NOT NULL REFERENCES captures(id),
+    flow_id        INTEGER REFERENCES flows(id),
+    request_id     INTEGER REFERENCES http_requests(id),
+    txid           TEXT,
+    time           TEXT NOT NULL,
+    src_ip         TEXT NOT NULL,
+    src_port       INTEGER,
+    dst_ip         TEXT NOT NULL,
+    dst_port       INTEGER,
+    status         INTEGER NOT NULL,
+    status_text    TEXT,
+    proto          TEXT,
+    content_type   TEXT,
+    latency_ms     REAL,
+    body_size      INTEGER NOT NULL,
+    body           BLOB,
+    body_truncated INTEGER NOT NULL,
+    sha256         TEXT
+);
+CREATE TABLE IF NOT EXISTS http_request_headers (
+    request_id INTEGER NOT NULL REFERENCES http_requests(id),
+    name       TEXT NOT NULL,
+    value      TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS http_response_headers (
+    response_id INTEGER NOT NULL REFERENCES http_responses(id),
+    name        TEXT NOT NULL,
+    value       TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS dns_messages (
+    id         INTEGER PRIMARY KEY,
+    capture_id INTEGER NOT NULL REFERENCES captures(id),
+    flow_id    INTEGER REFERENCES flows(id),
+    time       TEXT NOT NULL,
+    src_ip     TEXT NOT NULL,
+    dst_ip     TEXT NOT NULL,
+    response   INTEGER NOT NULL,
+    question   TEXT NOT NULL,
+    qtype      TEXT NOT NULL,
+    rcode      TEXT
+);
+CREATE TABLE IF NOT EXISTS dns_answers (
+    message_id INTEGER NOT NULL REFERENCES dns_messages(id),
+    name       TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    value      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS http_requests_flow ON http_requests(flow_id);
+CREATE INDEX IF NOT EXISTS http_responses_request ON http_responses(request_id);
+CREATE INDEX IF NOT EXISTS http_request_headers_request ON http_request_headers(request_id, name);
+CREATE INDEX IF NOT EXISTS http_response_headers_response ON http_response_headers(response_id, name);
+CREATE INDEX IF NOT EXISTS dns_messages_question ON dns_messages(question);
+CREATE INDEX IF NOT EXISTS dns_answers_message ON dns_answers(message_id);
+CREATE VIEW IF NOT EXISTS transactions AS
+SELECT q.capture_id, q.flow_id, q.txid, q.time, q.src_ip, q.dst_ip, q.dst_port,
+       q.method, q.url, q.host, q.user_agent, r.status, r.content_type,
+       r.latency_ms, q.body_size AS request_size, r.body_size AS response_size,
+       q.id AS request_id, r.id AS response_id
+FROM http_requests q LEFT JOIN http_responses r ON r.request_id = q.id;
+`
+
+// commitEvery is how many rows are written before they are committed, so
+// that a long-running capture shows up in the database as it goes.
+const commitEvery = 10000
+
+// udpTimeout is how long a UDP flow may be idle before the next datagram
+// starts a new one.
+const udpTimeout = 60 * time.Second
+
+// Counts is how many rows of each kind were written.
+type Counts struct {
+	Requests, Responses, DNS, Flows int64
+}
+
+// DB is a handler writing every flow, request, response and DNS message it
+// receives. Flows are written when the database is closed, once their
+// packets have all been counted; the rest as they arrive.
+type DB struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	tx      *sql.Tx
+	stmts   map[string]*sql.Stmt
+	capture int64
+	rows    int
+	counts  Counts
+	err     error
+
+	// Flows get their IDs as they open, so that the messages they carry
+	// can refer to them before they are written
+	nextFlow int64
+	open     map[flowKey]*flow
+	byConn   map[int64]*flow
+	flows    []*flow
+	// datagram is the last UDP packet, which any DNS message that follows
+	// was read from
+	datagram     datagram
+	datagramFlow *flow
+	// requests holds the IDs of the requests not yet answered
+	requests map[*httpstream.Request]int64
+}
+
+type flowKey struct {
+	a, b string
+}
+
+type datagram struct {
+	ts       int64
+	src, dst string
+}
+
+type flow struct {
+	id                 int64
+	transport          string
+	clientIP, serverIP string
+	clientPort         string
+	serverPort         string
+	first, last        time.Time
+	packets, bytes     int64
+	clientBytes        int64
+	serverBytes        int64
+	closed             bool
+}
+
+var statements = map[string]string{
+	"request": `INSERT INTO http_requests (capture_id, flow_id, txid, time, src_ip, src_port, dst_ip, dst_port,
+        method, url, host, uri, proto, content_type, user_agent, body_size, body, body_truncated, sha256)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	"response": `INSERT INTO http_responses (capture_id, flow_id, request_id, txid, time, src_ip, src_port, dst_ip, dst_port,
+        status, status_text, proto, content_type, latency_ms, body_size, body, body_truncated, sha256)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	"request_header":  `INSERT INTO http_request_headers (request_id, name, value) VALUES (?, ?, ?)`,
+	"response_header": `INSERT INTO http_response_headers (response_id, name, value) VALUES (?, ?, ?)`,
+	"dns": `INSERT INTO dns_messages (capture_id, flow_id, time, src_ip, dst_ip, response, question, qtype, rcode)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	"dns_answer": `INSERT INTO dns_answers (message_id, name, type, value) VALUES (?, ?, ?, ?)`,
+	"flow": `INSERT INTO flows (id, capture_id, transport, client_ip, client_port, server_ip, server_port,
+        first_seen, last_seen, packets, bytes, client_bytes, server_bytes)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+}
+
+// Open opens the database at path, creating it and its tables if need
+// be, and records a capture named name for the rows written to refer to.
+func Open(path, name string) (*DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection, since SQLite writes one transaction at a time
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if _, err := db.Exec(Schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: creating tables: %w", path, err)
+	}
+	d := &DB{
+		db:       db,
+		stmts:    make(map[string]*sql.Stmt),
+		open:     make(map[flowKey]*flow),
+		byConn:   make(map[int64]*flow),
+		requests: make(map[*httpstream.Request]int64),
+	}
+	res, err := db.Exec(`INSERT INTO captures (name, created_at) VALUES (?, ?)`, name, timestamp(time.Now()))
+	if err == nil {
+		d.capture, err = res.LastInsertId()
+	}
+	if err == nil {
+		err = db.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM flows`).Scan(&d.nextFlow)
+	}
+	if err == nil {
+		err = d.begin()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+// begin starts the transaction rows are written in, preparing the
+// statements that write them.
+func (d *DB) begin() error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for name, q := range statements {
+		stmt, err := tx.Prepare(q)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		d.stmts[name] = stmt
+	}
+	d.tx = tx
+	return nil
+}
+
+// exec runs one of the statements, returning the ID of the row it
+// inserted. Once a statement fails, nothing more is written. d.mu must be
+// held.
+func (d *DB) exec(stmt string, args ...any) int64 {
+	if d.err != nil || d.tx == nil {
+		return 0
+	}
+	res, err := d.stmts[stmt].Exec(args...)
+	if err != nil {
+		d.err = fmt.Errorf("writing %s: %w", strings.ReplaceAll(stmt, "_", " "), err)
+		return 0
+	}
+	d.rows++
+	if d.rows >= commitEvery {
+		d.commit()
+		if d.err == nil {
+			d.err = d.begin()
+		}
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// commit ends the current transaction. d.mu must be held.
+func (d *DB) commit() {
+	if d.tx == nil {
+		return
+	}
+	err := d.tx.Commit()
+	if d.err == nil {
+		d.err = err
+	}
+	d.tx, d.rows = nil, 0
+}
+
+func (d *DB) HandlePacket(p *analyzer.Packet) {
+	src, dst := p.Network.Endpoints()
+	sport, dport := p.Transport.Endpoints()
+	ts := p.CaptureInfo.Timestamp
+	from, to := src.String()+"|"+sport.String(), dst.String()+"|"+dport.String()
+	key := flowKey{from, to}
+	if from > to {
+		key = flowKey{to, from}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f := d.open[key]
+	switch {
+	case f == nil:
+	case p.TCP != nil && p.TCP.SYN && !p.TCP.ACK && f.closed:
+		f = nil
+	case p.TCP == nil && ts.Sub(f.last) > udpTimeout:
+		f = nil
+	}
+	if f == nil {
+		f = &flow{id: d.nextFlow, transport: layers.IPProtocolUDP.String(), first: ts}
+		d.nextFlow++
+		f.clientIP, f.clientPort, f.serverIP, f.serverPort = src.String(), sport.String(), dst.String(), dport.String()
+		if p.TCP != nil {
+			f.transport = layers.IPProtocolTCP.String()
+			// The sender of a SYN-ACK is the server, whatever was seen
+			// first
+			if p.TCP.SYN && p.TCP.ACK {
+				f.clientIP, f.clientPort, f.serverIP, f.serverPort = f.serverIP, f.serverPort, f.clientIP, f.clientPort
+			}
+			d.byConn[p.Number] = f
+		}
+		d.open[key] = f
+		d.flows = append(d.flows, f)
+	}
+	f.last = ts
+	f.packets++
+	f.bytes += int64(p.CaptureInfo.Length)
+	if src.String() == f.clientIP && sport.String() == f.clientPort {
+		f.clientBytes += int64(len(p.Payload))
+	} else {
+		f.serverBytes += int64(len(p.Payload))
+	}
+	if p.TCP != nil && (p.TCP.FIN || p.TCP.RST) {
+		f.closed = true
+	}
+	if p.TCP == nil {
+		d.datagram, d.datagramFlow = datagram{ts.UnixNano(), src.String(), dst.String()}, f
+	}
+}
+
+// flowID returns the ID of the flow that carried m, or nil when its
+// packets weren't seen. d.mu must be held.
+func (d *DB) flowID(m *httpstream.Message) any {
+	if f := d.byConn[m.Conn]; m.Conn != 0 && f != nil {
+		return f.id
+	}
+	return nil
+}
+
+func (d *DB) HandleRequest(req *httpstream.Request) {
+	body := d.body(&req.Message)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.exec("request", d.capture, d.flowID(&req.Message), null(req.ID()), timestamp(req.Timestamp),
+		req.SrcIP, port(req.SrcPort), req.DstIP, port(req.DstPort),
+		req.Method, req.URL, null(req.Host), null(req.URI), null(req.Proto),
+		null(req.Header.Get("Content-Type")), null(req.Header.Get("User-Agent")),
+		req.BodySize, body, req.BodySize > int64(len(req.Body)), null(req.SHA256))
+	if id == 0 {
+		return
+	}
+	d.counts.Requests++
+	d.requests[req] = id
+	for name, values := range req.Header {
+		for _, v := range values {
+			d.exec("request_header", id, name, v)
+		}
+	}
+}
+
+func (d *DB) HandleResponse(resp *httpstream.Response) {
+	body := d.body(&resp.Message)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var requestID, latency any
+	if req := resp.Request; req != nil {
+		if id, ok := d.requests[req]; ok {
+			requestID = id
+			delete(d.requests, req)
+		}
+		latency = float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+	}
+	_, text, _ := strings.Cut(resp.Status, " ")
+	id := d.exec("response", d.capture, d.flowID(&resp.Message), requestID, null(resp.ID()), timestamp(resp.Timestamp),
+		resp.SrcIP, port(resp.SrcPort), resp.DstIP, port(resp.DstPort),
+		resp.StatusCode, null(text), null(resp.Proto), null(resp.Header.Get("Content-Type")), latency,
+		resp.BodySize, body, resp.BodySize > int64(len(resp.Body)), null(resp.SHA256))
+	if id == 0 {
+		return
+	}
+	d.counts.Responses++
+	for name, values := range resp.Header {
+		for _, v := range values {
+			d.exec("response_header", id, name, v)
+		}
+	}
+}
+
+// body returns the part of a message's body that was kept, with gzip
+// removed, or nil when it has none.
+func (d *DB) body(m *httpstream.Message) []byte {
+	if len(m.Body) == 0 {
+		return nil
+	}
+	body, _, err := m.DecodedBody()
+	if err != nil {
+		return m.Body
+	}
+	return body
+}
+
+func (d *DB) HandleDNS(msg *dns.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var flowID any
+	if d.datagramFlow != nil && d.datagram == (datagram{msg.Timestamp.UnixNano(), msg.SrcIP, msg.DstIP}) {
+		flowID = d.datagramFlow.id
+	}
+	id := d.exec("dns", d.capture, flowID, timestamp(msg.Timestamp), msg.SrcIP, msg.DstIP,
+		msg.Response, strings.TrimSuffix(msg.Question, "."), msg.QType, null(msg.Rcode))
+	if id == 0 {
+		return
+	}
+	d.counts.DNS++
+	for _, a := range msg.Answers {
+		d.exec("dns_answer", id, strings.TrimSuffix(a.Name, "."), a.Type, strings.TrimSuffix(a.Value, "."))
+	}
+}
+
+// Close writes the flows, commits and closes the database. It returns the
+// first write that failed; nothing after it was written.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range d.flows {
+		if d.exec("flow", f.id, d.capture, f.transport, f.clientIP, port(f.clientPort), f.serverIP, port(f.serverPort),
+			timestamp(f.first), timestamp(f.last), f.packets, f.bytes, f.clientBytes, f.serverBytes) != 0 {
+			d.counts.Flows++
+		}
+	}
+	d.flows = nil
+	d.commit()
+	if err := d.db.Close(); d.err == nil {
+		d.err = err
+	}
+	return d.err
+}
+
+// Counts returns how many rows of each kind were written. It is only
+// final after Close.
+func (d *DB) Counts() Counts {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.counts
+}
+
+// timestamp formats t as SQLite's date and time functions take it.
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// port returns p as a number, or nil when it isn't one.
+func port(p string) any {
+	n, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil
+	}
+	return int64(n)
+}
+
+// null returns s, or nil for NULL when it is empty.
+func null(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
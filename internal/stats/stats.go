@@ -0,0 +1,116 @@
+// Package stats holds counters updated while a capture is processed.
+package stats
+
+import "sync/atomic"
+
+// Counters tracks how much of a capture has been processed. Fields are
+// updated atomically and may be read while processing is in progress.
+type Counters struct {
+	// InputBytes is how much of the capture file has been read.
+	InputBytes atomic.Int64
+	Packets    atomic.Int64
+	Bytes      atomic.Int64
+	// Skipped counts packets that weren't analyzed: those that aren't TCP
+	// or UDP, UDP other than DNS, and TCP on ports that can't carry HTTP.
+	Skipped atomic.Int64
+	// Streams counts TCP connections reassembled.
+	Streams   atomic.Int64
+	Requests  atomic.Int64
+	Responses atomic.Int64
+	// TLSFlows counts connections skipped because they carry TLS, and
+	// DecryptedFlows the TLS connections decrypted with a key log.
+	TLSFlows       atomic.Int64
+	DecryptedFlows atomic.Int64
+	// Tunnels counts the CONNECT tunnels set up through proxies, whose
+	// connections are counted by what the tunnels carry.
+	Tunnels     atomic.Int64
+	DNSMessages atomic.Int64
+	// DNSCacheHits and DNSCacheMisses count the requests whose server
+	// address was and wasn't among the DNS answers seen before them.
+	DNSCacheHits   atomic.Int64
+	DNSCacheMisses atomic.Int64
+	// ParseErrors counts HTTP messages that couldn't be parsed.
+	ParseErrors atomic.Int64
+	// TruncatedBytes is how much body data was dropped because bodies are
+	// only kept up to their in-memory limit.
+	TruncatedBytes atomic.Int64
+	// LostBytes is how much TCP payload reassembly skipped over, because
+	// it was never captured or because buffering limits were reached.
+	LostBytes atomic.Int64
+	// Shed counts the times the memory budget was approached, and
+	// ShedConnections and ShedDNSEntries what was released each time.
+	Shed            atomic.Int64
+	ShedConnections atomic.Int64
+	ShedDNSEntries  atomic.Int64
+}
+
+// Snapshot is a copy of Counters at one moment.
+type Snapshot struct {
+	InputBytes      int64 `json:"input_bytes"`
+	Packets         int64 `json:"packets"`
+	Bytes           int64 `json:"bytes"`
+	Skipped         int64 `json:"skipped_packets"`
+	Streams         int64 `json:"tcp_streams"`
+	Requests        int64 `json:"http_requests"`
+	Responses       int64 `json:"http_responses"`
+	TLSFlows        int64 `json:"tls_flows"`
+	DecryptedFlows  int64 `json:"decrypted_tls_flows"`
+	Tunnels         int64 `json:"connect_tunnels"`
+	DNSMessages     int64 `json:"dns_messages"`
+	DNSCacheHits    int64 `json:"dns_cache_hits"`
+	DNSCacheMisses  int64 `json:"dns_cache_misses"`
+	ParseErrors     int64 `json:"parse_errors"`
+	TruncatedBytes  int64 `json:"truncated_body_bytes"`
+	LostBytes       int64 `json:"lost_tcp_bytes"`
+	Shed            int64 `json:"memory_shed"`
+	ShedConnections int64 `json:"shed_connections"`
+	ShedDNSEntries  int64 `json:"shed_dns_entries"`
+}
+
+// Snapshot returns the current values of the counters.
+func (c *Counters) Snapshot() Snapshot {
+	return Snapshot{
+		InputBytes:      c.InputBytes.Load(),
+		Packets:         c.Packets.Load(),
+		Bytes:           c.Bytes.Load(),
+		Skipped:         c.Skipped.Load(),
+		Streams:         c.Streams.Load(),
+		Requests:        c.Requests.Load(),
+		Responses:       c.Responses.Load(),
+		TLSFlows:        c.TLSFlows.Load(),
+		DecryptedFlows:  c.DecryptedFlows.Load(),
+		Tunnels:         c.Tunnels.Load(),
+		DNSMessages:     c.DNSMessages.Load(),
+		DNSCacheHits:    c.DNSCacheHits.Load(),
+		DNSCacheMisses:  c.DNSCacheMisses.Load(),
+		ParseErrors:     c.ParseErrors.Load(),
+		TruncatedBytes:  c.TruncatedBytes.Load(),
+		LostBytes:       c.LostBytes.Load(),
+		Shed:            c.Shed.Load(),
+		ShedConnections: c.ShedConnections.Load(),
+		ShedDNSEntries:  c.ShedDNSEntries.Load(),
+	}
+}
+
+// Add adds the values in s to the counters, other than InputBytes, which
+// always reflects what has actually been read.
+func (c *Counters) Add(s Snapshot) {
+	c.Packets.Add(s.Packets)
+	c.Bytes.Add(s.Bytes)
+	c.Skipped.Add(s.Skipped)
+	c.Streams.Add(s.Streams)
+	c.Requests.Add(s.Requests)
+	c.Responses.Add(s.Responses)
+	c.TLSFlows.Add(s.TLSFlows)
+	c.DecryptedFlows.Add(s.DecryptedFlows)
+	c.Tunnels.Add(s.Tunnels)
+	c.DNSMessages.Add(s.DNSMessages)
+	c.DNSCacheHits.Add(s.DNSCacheHits)
+	c.DNSCacheMisses.Add(s.DNSCacheMisses)
+	c.ParseErrors.Add(s.ParseErrors)
+	c.TruncatedBytes.Add(s.TruncatedBytes)
+	c.LostBytes.Add(s.LostBytes)
+	c.Shed.Add(s.Shed)
+	c.ShedConnections.Add(s.ShedConnections)
+	c.ShedDNSEntries.Add(s.ShedDNSEntries)
+}
@@ -1,62 +1,334 @@
 package stream
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
 	"github.com/pcap-analyzer/internal/dns"
 	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stats"
+	"github.com/pcap-analyzer/internal/tlsdecrypt"
 )
 
+// detectBytes is how much leading payload a Parser is shown in Detect.
+const detectBytes = 64
+
+// defaultWorkers is the number of parse workers used when Factory.Workers
+// is zero.
+const defaultWorkers = 64
+
+// Parser decodes a TCP protocol other than HTTP. Parsers registered on a
+// Factory are offered every connection whose payload is neither HTTP nor TLS.
+type Parser interface {
+	// Detect reports whether the connection carries the parser's protocol,
+	// given the first bytes of its reassembled payload.
+	Detect(net, transport gopacket.Flow, payload []byte) bool
+	// Parse consumes the connection's payload until io.EOF.
+	Parse(net, transport gopacket.Flow, r io.Reader)
+}
+
+// Factory creates an HTTP stream parser for every TCP connection seen by
+// the assembler.
 type Factory struct {
 	dnsCache *dns.Cache
+	handler  httpstream.Handler
+	parsers  []Parser
+	wg       sync.WaitGroup
+	// Workers is the number of goroutines parsing streams; it must be set
+	// before the factory is used. Zero means defaultWorkers.
+	Workers int
+	sched   *scheduler
+	once    sync.Once
+	// MaxBuffer caps the unread payload each stream keeps in memory;
+	// the excess is spilled to a temporary file. Zero means no limit.
+	MaxBuffer int
+	// SpoolBodies keeps long message bodies in temporary files so the
+	// handler can stream them in full.
+	SpoolBodies bool
+	// HashBodies and HashMD5 have streams hash message bodies.
+	HashBodies, HashMD5 bool
+	// RecordChunks has streams list the chunks of chunked bodies.
+	RecordChunks bool
+	// Keys, if set, has streams decrypt the TLS connections it holds the
+	// secrets of.
+	Keys *tlsdecrypt.Keys
+	// Stats, if set, counts the streams created.
+	Stats *stats.Counters
+
+	// open holds the keys of connections whose reassembly hasn't completed,
+	// and resumed those that were open when a checkpoint was taken.
+	mu      sync.Mutex
+	open    map[string]struct{}
+	resumed map[string]bool
 }
 
-func NewFactory(dnsCache *dns.Cache) *Factory {
+func NewFactory(dnsCache *dns.Cache, handler httpstream.Handler) *Factory {
 	return &Factory{
 		dnsCache: dnsCache,
+		handler:  handler,
+		open:     make(map[string]struct{}),
+	}
+}
+
+// FlowKey identifies a connection the same way whichever direction its
+// first packet travelled.
+func FlowKey(net, transport gopacket.Flow) string {
+	id := NewFlowID(net, transport)
+	return id.Net.String() + " " + id.Transport.String()
+}
+
+// FlowID identifies a connection like FlowKey, as a comparable value that
+// map lookups for every packet can use without allocating.
+type FlowID struct {
+	Net, Transport gopacket.Flow
+}
+
+// NewFlowID returns the ID of the connection a packet between net and
+// transport belongs to, whichever direction it travelled.
+func NewFlowID(net, transport gopacket.Flow) FlowID {
+	src, dst := net.Endpoints()
+	sport, dport := transport.Endpoints()
+	if dst.LessThan(src) || (src == dst && dport.LessThan(sport)) {
+		net, transport = net.Reverse(), transport.Reverse()
+	}
+	return FlowID{net, transport}
+}
+
+// OpenFlows returns the keys of connections that are still being
+// reassembled.
+func (f *Factory) OpenFlows() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.open))
+	for k := range f.open {
+		keys = append(keys, k)
 	}
+	return keys
 }
 
+// Resume marks connections, given by FlowKey, that were already open when
+// the capture was resumed part way through. Their first packets start
+// reassembly straight away instead of waiting for a SYN that was left
+// behind. Resume must be called before the factory is used.
+func (f *Factory) Resume(keys []string) {
+	f.resumed = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		f.resumed[k] = true
+	}
+}
+
+// Register adds a parser for connections the HTTP parser declines. Parsers
+// are tried in registration order; Register must not be called once the
+// factory is in use by an assembler.
+func (f *Factory) Register(p Parser) {
+	f.parsers = append(f.parsers, p)
+}
+
+// New returns the reassembly stream of a connection. The connection is
+// only counted, and its parsing set up, once a segment opens it or carries
+// payload; the ACK that follows a connection's FINs, or a stray RST, would
+// otherwise start another.
 func (f *Factory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
-	hstream := &httpstream.Stream{}
-	// Access private fields using reflection would be needed here,
-	// but for simplicity, we'll create a wrapper
-	reader := &tcpReader{
-		ident:    fmt.Sprintf("%s:%s", net, transport),
-		isClient: true,
-		stream:   hstream,
-		factory:  f,
+	key := FlowKey(net, transport)
+	t := &tcpReader{
+		factory:   f,
+		key:       key,
+		resumed:   f.resumed[key],
+		net:       net,
+		transport: transport,
+	}
+	if c, ok := ac.(*Context); ok {
+		t.first = c.Number
+	}
+	return t
+}
+
+// start sets up the parsing of the connection t reassembles, numbered
+// after the packet that opened it or else the first one seen.
+func (f *Factory) start(t *tcpReader, tcp *layers.TCP, ac reassembly.AssemblerContext) {
+	if f.Stats != nil {
+		f.Stats.Streams.Add(1)
 	}
+	f.once.Do(func() {
+		workers := f.Workers
+		if workers <= 0 {
+			workers = defaultWorkers
+		}
+		f.sched = newScheduler(workers)
+	})
 
-	go func() {
-		// This would need to be implemented properly with the actual HTTP stream logic
-		// For now, this is a placeholder
-	}()
+	f.mu.Lock()
+	f.open[t.key] = struct{}{}
+	f.mu.Unlock()
 
-	return reader
+	net, transport := t.net, t.transport
+	hstream := httpstream.NewStream(net, transport, f.MaxBuffer)
+	hstream.SpoolBodies = f.SpoolBodies
+	hstream.HashBodies, hstream.HashMD5 = f.HashBodies, f.HashMD5
+	hstream.RecordChunks = f.RecordChunks
+	hstream.Keys = f.Keys
+	hstream.Conn = t.first
+	if c, ok := ac.(*Context); ok && tcp.SYN {
+		hstream.Conn = c.Number
+	}
+	if f.Stats != nil {
+		hstream.Stats = f.Stats
+	}
+	t.task = &task{}
+	t.task.run = func() bool {
+		return f.step(net, transport, hstream)
+	}
+	f.wg.Add(1)
+	t.stream, t.sched = hstream, f.sched
+}
+
+// step parses whatever payload the stream has received and reports whether
+// the stream is finished.
+func (f *Factory) step(net, transport gopacket.Flow, hstream *httpstream.Stream) bool {
+	done, err := hstream.Step(f.dnsCache, f.handler)
+	if !done {
+		return false
+	}
+	if errors.Is(err, httpstream.ErrNotHTTP) {
+		if p := f.detect(net, transport, hstream.Peek(detectBytes)); p != nil {
+			// Other parsers read the stream to the end, so they get a
+			// goroutine of their own rather than holding a worker
+			go func() {
+				defer f.finish(hstream)
+				p.Parse(net, transport, hstream.Reader())
+			}()
+			return true
+		}
+	}
+	f.finish(hstream)
+	return true
+}
+
+func (f *Factory) detect(net, transport gopacket.Flow, payload []byte) Parser {
+	for _, p := range f.parsers {
+		if p.Detect(net, transport, payload) {
+			return p
+		}
+	}
+	return nil
+}
+
+// finish releases a stream once parsing is over; the rest of the connection
+// is of no use, so stop buffering it.
+func (f *Factory) finish(hstream *httpstream.Stream) {
+	hstream.Discard()
+	f.wg.Done()
+}
+
+// Wait blocks until every stream created so far has finished parsing, then
+// stops the parse workers. Call it after the assembler has been flushed.
+func (f *Factory) Wait() {
+	f.wg.Wait()
+	if f.sched != nil {
+		f.sched.close()
+	}
+}
+
+// Context carries per-packet capture metadata through the assembler.
+type Context struct {
+	CaptureInfo gopacket.CaptureInfo
+	// Number is the packet's 1-based position in the capture.
+	Number int64
+}
+
+func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.CaptureInfo
 }
 
 type tcpReader struct {
-	ident    string
-	isClient bool
-	stream   *httpstream.Stream
-	factory  *Factory
+	factory   *Factory
+	key       string
+	resumed   bool
+	net       gopacket.Flow
+	transport gopacket.Flow
+	// first is the number of the first packet seen.
+	first int64
+	// stream is nil until the connection has started.
+	stream *httpstream.Stream
+	sched  *scheduler
+	task   *task
 }
 
 func (t *tcpReader) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
 	length, _ := sg.Lengths()
 	data := sg.Fetch(length)
-	// Implementation needed - would write to stream buffer
-	_ = data
+	dir, _, _, skip := sg.Info()
+	if skip > 0 && t.factory.Stats != nil {
+		t.factory.Stats.LostBytes.Add(int64(skip))
+	}
+	var ts time.Time
+	if ac != nil {
+		ts = ac.GetCaptureInfo().Timestamp
+	}
+	t.stream.Append(data, ts, dir == reassembly.TCPDirServerToClient)
+	t.sched.wake(t.task)
 }
 
 func (t *tcpReader) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	return false
+	if t.stream == nil {
+		return true
+	}
+	// Signal that reassembly is complete so parsers blocked on the
+	// stream see EOF once the remaining data is consumed. The parser keeps
+	// its own buffer, so the assembler can drop the connection.
+	t.stream.Close()
+	t.sched.wake(t.task)
+	t.factory.mu.Lock()
+	delete(t.factory.open, t.key)
+	t.factory.mu.Unlock()
+	return true
 }
 
-func (t *tcpReader) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, seq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+func (t *tcpReader) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if t.stream == nil {
+		if !tcp.SYN && len(tcp.Payload) == 0 {
+			// Nothing to reassemble, and nothing to start a connection
+			return false
+		}
+		t.factory.start(t, tcp, ac)
+	}
+	if t.resumed {
+		// The handshake came before the checkpoint; only takes effect
+		// until the direction has started
+		*start = true
+	}
+	if h := segmentHealth(tcp, nextSeq); h.Any() {
+		t.stream.AddHealth(h)
+	}
 	return true
 }
+
+// segmentHealth classifies a segment against the next sequence number
+// expected in its direction, which is negative until the direction starts.
+func segmentHealth(tcp *layers.TCP, nextSeq reassembly.Sequence) httpstream.TCPHealth {
+	var h httpstream.TCPHealth
+	if tcp.RST {
+		h.Resets++
+		return h
+	}
+	if tcp.Window == 0 && !tcp.SYN && !tcp.FIN {
+		h.ZeroWindows++
+	}
+	if len(tcp.Payload) == 0 || nextSeq < 0 {
+		return h
+	}
+	switch diff := nextSeq.Difference(reassembly.Sequence(tcp.Seq)); {
+	// Keep-alive probes resend the last byte, or nothing at all
+	case diff == -1 && len(tcp.Payload) <= 1:
+	case diff < 0:
+		h.Retransmissions++
+	case diff > 0:
+		h.OutOfOrder++
+	}
+	return h
+}
@@ -0,0 +1,201 @@
+package stream
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/stats"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// collector keeps the messages a factory's streams parse.
+type collector struct {
+	mu    sync.Mutex
+	reqs  []*httpstream.Request
+	resps []*httpstream.Response
+}
+
+func (c *collector) HandleRequest(req *httpstream.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqs = append(c.reqs, req)
+}
+
+func (c *collector) HandleResponse(resp *httpstream.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resps = append(c.resps, resp)
+}
+
+// newTestFactory returns a factory counting into fresh stats, and the
+// collector its streams hand messages to.
+func newTestFactory() (*Factory, *collector, *stats.Counters) {
+	c := &collector{}
+	f := NewFactory(dns.NewCache(), c)
+	f.Workers = 2
+	f.Stats = &stats.Counters{}
+	return f, c, f.Stats
+}
+
+// assemble feeds packets to an assembler using f.
+func assemble(t *testing.T, f *Factory, packets []testutil.Packet) *reassembly.Assembler {
+	t.Helper()
+	a := reassembly.NewAssembler(reassembly.NewStreamPool(f))
+	for i, p := range packets {
+		packet := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.Default)
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			continue
+		}
+		ctx := &Context{CaptureInfo: p.CaptureInfo, Number: int64(i + 1)}
+		a.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
+	}
+	return a
+}
+
+func TestFactoryCountsClosedConnectionOnce(t *testing.T) {
+	f, c, counters := newTestFactory()
+	b := testutil.NewBuilder()
+	b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	a := assemble(t, f, b.Packets())
+	a.FlushAll()
+	f.Wait()
+
+	if n := counters.Streams.Load(); n != 1 {
+		t.Errorf("counted %d streams for one connection, want 1", n)
+	}
+	if len(c.reqs) != 1 || len(c.resps) != 1 {
+		t.Errorf("got %d requests and %d responses, want 1 of each", len(c.reqs), len(c.resps))
+	}
+	if open := f.OpenFlows(); len(open) != 0 {
+		t.Errorf("connections still open after FlushAll: %v", open)
+	}
+}
+
+func TestFactoryStreams(t *testing.T) {
+	const (
+		request  = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		response = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	)
+	tests := []struct {
+		name    string
+		build   func(b *testutil.Builder)
+		streams int64
+		reqs    int
+	}{
+		{"one exchange", func(b *testutil.Builder) {
+			b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80", request, response)
+		}, 1, 1},
+		{"two connections", func(b *testutil.Builder) {
+			b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80", request, response)
+			b.HTTPExchange("10.0.0.1:40001", "10.0.0.2:80", request, response)
+		}, 2, 2},
+		{"port reused", func(b *testutil.Builder) {
+			b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80", request, response)
+			b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80", request, response)
+		}, 2, 2},
+		{"refused", func(b *testutil.Builder) {
+			b.TCPConn("10.0.0.1:40000", "10.0.0.2:81").Refused()
+		}, 1, 0},
+		{"no payload or SYN", func(b *testutil.Builder) {
+			c := b.TCPConn("10.0.0.1:40000", "10.0.0.2:80")
+			c.Close()
+			c.Reset()
+		}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c, counters := newTestFactory()
+			b := testutil.NewBuilder()
+			tt.build(b)
+			assemble(t, f, b.Packets()).FlushAll()
+			f.Wait()
+			if n := counters.Streams.Load(); n != tt.streams {
+				t.Errorf("counted %d streams, want %d", n, tt.streams)
+			}
+			if len(c.reqs) != tt.reqs {
+				t.Errorf("got %d requests, want %d", len(c.reqs), tt.reqs)
+			}
+		})
+	}
+}
+
+func TestFactoryFlush(t *testing.T) {
+	f, c, _ := newTestFactory()
+	b := testutil.NewBuilder()
+	conn := b.TCPConn("10.0.0.1:40000", "10.0.0.2:80").Handshake()
+	conn.ClientSend([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	conn.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	a := assemble(t, f, b.Packets())
+
+	open := f.OpenFlows()
+	if len(open) != 1 {
+		t.Fatalf("got open connections %v, want one", open)
+	}
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 2}, []byte{10, 0, 0, 1})
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0, 80}, []byte{0x9c, 0x40})
+	if want := FlowKey(net, transport); open[0] != want {
+		t.Errorf("open connection %q, want %q", open[0], want)
+	}
+
+	// Nothing has been quiet since before the capture started
+	if _, closed := a.FlushCloseOlderThan(b.Packets()[0].CaptureInfo.Timestamp); closed != 0 {
+		t.Errorf("flush closed %d connections still in use", closed)
+	}
+	if _, closed := a.FlushCloseOlderThan(b.Now()); closed == 0 {
+		t.Error("flush closed no connections gone quiet")
+	}
+	f.Wait()
+	if open := f.OpenFlows(); len(open) != 0 {
+		t.Errorf("connections still open after the flush: %v", open)
+	}
+	if len(c.reqs) != 1 || len(c.resps) != 1 {
+		t.Errorf("got %d requests and %d responses, want 1 of each", len(c.reqs), len(c.resps))
+	}
+}
+
+func TestFactoryLostData(t *testing.T) {
+	tests := []struct {
+		name string
+		drop int // index of the body segment dropped, or -1
+		lost int64
+	}{
+		{"nothing lost", -1, 0},
+		{"first body segment", 0, 10},
+		{"middle body segment", 2, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c, counters := newTestFactory()
+			b := testutil.NewBuilder()
+			conn := b.TCPConn("10.0.0.1:40000", "10.0.0.2:80").Handshake()
+			conn.SegmentSize = 10
+			conn.ClientSend([]byte("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 40\r\n\r\n"))
+			conn.ClientSend([]byte(strings.Repeat("b", 40)))
+			body := b.Len() - 4
+			conn.Close()
+
+			packets := append([]testutil.Packet(nil), b.Packets()...)
+			if tt.drop >= 0 {
+				i := body + tt.drop
+				packets = append(packets[:i], packets[i+1:]...)
+			}
+			assemble(t, f, packets).FlushAll()
+			f.Wait()
+			if n := counters.LostBytes.Load(); n != tt.lost {
+				t.Errorf("counted %d bytes lost, want %d", n, tt.lost)
+			}
+			if tt.lost == 0 && len(c.reqs) != 1 {
+				t.Errorf("got %d requests, want 1", len(c.reqs))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"sync"
+)
+
+// Stream scheduling states.
+const (
+	stateIdle = iota
+	stateQueued
+	stateRunning
+	stateDone
+)
+
+// task is a stream's place in the scheduler.
+type task struct {
+	// state and dirty are guarded by scheduler.mu
+	state int
+	// dirty is set when the stream is woken while a worker is running it,
+	// so the worker runs it again instead of letting it go idle.
+	dirty bool
+	run   func() (done bool)
+}
+
+// scheduler runs stream parsers on a fixed pool of workers. A stream is only
+// queued when new payload arrives for it, so idle connections cost no
+// goroutine and a capture with many short flows doesn't spawn one per flow.
+type scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue is unbounded: wake is called from the assembler, which must
+	// never block on workers that may themselves be waiting for payload.
+	queue  []*task
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newScheduler(workers int) *scheduler {
+	s := &scheduler{}
+	s.cond = sync.NewCond(&s.mu)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// wake schedules t to run unless it is already queued or finished.
+func (s *scheduler) wake(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch t.state {
+	case stateIdle:
+		s.push(t)
+	case stateRunning:
+		t.dirty = true
+	}
+}
+
+func (s *scheduler) push(t *task) {
+	t.state = stateQueued
+	s.queue = append(s.queue, t)
+	s.cond.Signal()
+}
+
+func (s *scheduler) worker() {
+	defer s.wg.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			return
+		}
+		t := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		t.state = stateRunning
+		t.dirty = false
+		s.mu.Unlock()
+
+		done := t.run()
+
+		s.mu.Lock()
+		switch {
+		case done:
+			t.state = stateDone
+		case t.dirty:
+			s.push(t)
+		default:
+			t.state = stateIdle
+		}
+	}
+}
+
+// close stops the workers once the queue has drained.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
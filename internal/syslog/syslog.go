@@ -0,0 +1,378 @@
+// Package syslog forwards a summary of each HTTP transaction to a syslog
+// server as an RFC 5424 message, for the syslog and SIEM pipelines that
+// collect everything else.
+package syslog
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// queueSize is how many messages wait for the server before more are
+// dropped.
+const queueSize = 10000
+
+// writeTimeout bounds sending each message, and dialTimeout connecting.
+const (
+	writeTimeout = 10 * time.Second
+	dialTimeout  = 10 * time.Second
+)
+
+// sdID names the structured data of the messages. 32473 is the private
+// enterprise number RFC 5612 sets aside for examples, as none is
+// registered for pcap-analyzer.
+const sdID = "http@32473"
+
+// facilities are the facility names and their codes.
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"ntp": 12, "audit": 13, "alert": 14, "clock": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severities are the severity names and their codes.
+var severities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3,
+	"warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Facility returns the code of a facility name such as "local0".
+func Facility(name string) (int, error) {
+	if f, ok := facilities[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility %q", name)
+}
+
+// Severity returns the code of a severity name such as "info".
+func Severity(name string) (int, error) {
+	if s, ok := severities[strings.ToLower(name)]; ok {
+		return s, nil
+	}
+	return 0, fmt.Errorf("unknown syslog severity %q", name)
+}
+
+// Config describes the server messages are sent to.
+type Config struct {
+	// Addr is the server as udp://host:port, tcp://host:port,
+	// tls://host:port or unix:///dev/log. A bare host:port is UDP, and
+	// the port defaults to 514 for UDP and TCP and 6514 for TLS.
+	Addr string
+	// Facility and Severity are the codes every message carries.
+	Facility, Severity int
+	// Insecure skips verifying the server's certificate over TLS.
+	Insecure bool
+	// Capture fills the capture parameter of every message.
+	Capture string
+}
+
+// Writer is a handler sending a message per transaction as soon as its
+// response is parsed, and for the requests still unanswered when it is
+// closed. Messages are sent by a goroutine of their own, so a slow server
+// doesn't hold up the capture; when it falls too far behind, messages are
+// dropped.
+type Writer struct {
+	// Filter, when set, limits the messages to the transactions whose
+	// request or response matches.
+	Filter *filter.Filter
+
+	cfg      Config
+	network  string
+	addr     string
+	hostname string
+
+	mu      sync.Mutex
+	pending map[*httpstream.Request]bool
+	closed  bool
+
+	queue chan []byte
+	done  chan struct{}
+	conn  net.Conn
+	// stream is set when conn is a stream rather than datagrams, so that
+	// messages are told apart by the octet counting of RFC 6587
+	stream bool
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	// Set by the sending goroutine, and read once it has finished
+	err error
+}
+
+// New connects to the server and returns a Writer sending to it.
+func New(cfg Config) (*Writer, error) {
+	network, addr, err := parseAddr(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Facility < 0 || cfg.Facility > 23 || cfg.Severity < 0 || cfg.Severity > 7 {
+		return nil, errors.New("facility or severity out of range")
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	w := &Writer{
+		cfg:      cfg,
+		network:  network,
+		addr:     addr,
+		hostname: hostname,
+		pending:  make(map[*httpstream.Request]bool),
+		queue:    make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+	}
+	if w.conn, w.stream, err = w.dial(); err != nil {
+		return nil, err
+	}
+	go w.sendAll()
+	return w, nil
+}
+
+func parseAddr(s string) (network, addr string, err error) {
+	network, addr = "udp", s
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		network, addr = scheme, rest
+	}
+	switch network {
+	case "unix":
+		if addr == "" {
+			return "", "", fmt.Errorf("%q names no socket", s)
+		}
+		return network, addr, nil
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("%q: want udp://, tcp://, tls:// or unix://", s)
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "514"
+		if network == "tls" {
+			port = "6514"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	if u, err := url.Parse("//" + addr); err != nil || u.Hostname() == "" {
+		return "", "", fmt.Errorf("%q is not a syslog server", s)
+	}
+	return network, addr, nil
+}
+
+// dial connects to the server, reporting whether the connection is a
+// stream.
+func (w *Writer) dial() (net.Conn, bool, error) {
+	switch w.network {
+	case "udp":
+		c, err := net.DialTimeout("udp", w.addr, dialTimeout)
+		return c, false, err
+	case "tls":
+		host, _, _ := net.SplitHostPort(w.addr)
+		d := &net.Dialer{Timeout: dialTimeout}
+		c, err := tls.DialWithDialer(d, "tcp", w.addr, &tls.Config{ServerName: host, InsecureSkipVerify: w.cfg.Insecure})
+		return c, true, err
+	case "unix":
+		// The local socket is a datagram socket on most systems, and a
+		// stream socket on some
+		if c, err := net.DialTimeout("unixgram", w.addr, dialTimeout); err == nil {
+			return c, false, nil
+		}
+		c, err := net.DialTimeout("unix", w.addr, dialTimeout)
+		return c, true, err
+	}
+	c, err := net.DialTimeout("tcp", w.addr, dialTimeout)
+	return c, true, err
+}
+
+func (w *Writer) HandleRequest(req *httpstream.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.pending[req] = true
+	}
+}
+
+func (w *Writer) HandleResponse(resp *httpstream.Response) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Messages start from a request, so responses to requests that weren't
+	// seen are left out
+	if w.closed || resp.Request == nil || !w.pending[resp.Request] {
+		return
+	}
+	delete(w.pending, resp.Request)
+	w.queueMessage(resp.Request, resp)
+}
+
+func (w *Writer) HandleDNS(*dns.Message) {}
+
+// queueMessage queues the message of a transaction, or drops it when the
+// queue is full; resp is nil for requests never answered. w.mu must be
+// held.
+func (w *Writer) queueMessage(req *httpstream.Request, resp *httpstream.Response) {
+	if !w.match(req, resp) {
+		return
+	}
+	select {
+	case w.queue <- w.format(req, resp):
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *Writer) match(req *httpstream.Request, resp *httpstream.Response) bool {
+	return w.Filter == nil || w.Filter.MatchRequest(req) || resp != nil && w.Filter.MatchResponse(resp)
+}
+
+// format renders the RFC 5424 message of a transaction, timed by its
+// request.
+func (w *Writer) format(req *httpstream.Request, resp *httpstream.Response) []byte {
+	params := [][2]string{
+		{"id", req.ID()},
+		{"capture", w.cfg.Capture},
+		{"client", net.JoinHostPort(req.SrcIP, req.SrcPort)},
+		{"server", net.JoinHostPort(req.DstIP, req.DstPort)},
+		{"method", req.Method},
+		{"url", req.URL},
+		{"host", req.Host},
+		{"user_agent", req.Header.Get("User-Agent")},
+		{"request_bytes", strconv.FormatInt(req.BodySize, 10)},
+	}
+	msg := req.Method + " " + req.URL
+	if resp != nil {
+		latency := float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+		params = append(params,
+			[2]string{"status", strconv.Itoa(resp.StatusCode)},
+			[2]string{"response_bytes", strconv.FormatInt(resp.BodySize, 10)},
+			[2]string{"latency_ms", strconv.FormatFloat(latency, 'f', 3, 64)},
+			[2]string{"content_type", resp.Header.Get("Content-Type")},
+		)
+		msg += fmt.Sprintf(" %d %.1fms", resp.StatusCode, latency)
+	} else {
+		msg += " no response"
+	}
+	msg += " " + net.JoinHostPort(req.SrcIP, req.SrcPort) + " -> " + net.JoinHostPort(req.DstIP, req.DstPort)
+
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		sd.WriteString(" " + p[0] + `="`)
+		sd.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(p[1]))
+		sd.WriteString(`"`)
+	}
+	sd.WriteString("]")
+
+	pri := w.cfg.Facility*8 + w.cfg.Severity
+	return []byte(fmt.Sprintf("<%d>1 %s %s pcap-analyzer %d http %s %s",
+		pri, req.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"), headerField(w.hostname),
+		os.Getpid(), sd.String(), msg))
+}
+
+// headerField makes s fit a header field: printable ASCII without spaces,
+// at most 255 characters.
+func headerField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (w *Writer) sendAll() {
+	defer close(w.done)
+	for m := range w.queue {
+		if err := w.send(m); err != nil {
+			w.dropped.Add(1)
+			if w.err == nil {
+				w.err = err
+			}
+			continue
+		}
+		w.sent.Add(1)
+	}
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// send writes a message, connecting again once if the connection was
+// lost.
+func (w *Writer) send(m []byte) error {
+	if w.stream {
+		m = append([]byte(strconv.Itoa(len(m))+" "), m...)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, w.stream, err = w.dial(); err != nil {
+				continue
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = w.conn.Write(m); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// Close sends the requests never answered and waits for every message
+// queued to be sent. Transactions handled after Close are discarded. It
+// returns the first message that couldn't be sent.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	unanswered := make([]*httpstream.Request, 0, len(w.pending))
+	for req := range w.pending {
+		unanswered = append(unanswered, req)
+	}
+	w.pending = nil
+	w.closed = true
+	w.mu.Unlock()
+	sort.Slice(unanswered, func(i, j int) bool { return unanswered[i].Timestamp.Before(unanswered[j].Timestamp) })
+	for _, req := range unanswered {
+		if w.match(req, nil) {
+			w.queue <- w.format(req, nil)
+		}
+	}
+	close(w.queue)
+	<-w.done
+	return w.err
+}
+
+// Counts returns how many messages were sent and how many were dropped,
+// because the queue was full or sending failed. It is only final after
+// Close.
+func (w *Writer) Counts() (sent, dropped int64) {
+	return w.sent.Load(), w.dropped.Load()
+}
+
+// Addr returns the server messages are sent to.
+func (w *Writer) Addr() string {
+	return w.network + "://" + w.addr
+}
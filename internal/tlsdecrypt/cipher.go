@@ -0,0 +1,276 @@
+package tlsdecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Record encryption of a suite.
+const (
+	modeGCM = iota
+	modeChaCha
+	modeCBC
+)
+
+// suite is what decrypting a cipher suite's records takes.
+type suite struct {
+	mode int
+	// tls13 is set for the suites of TLS 1.3, whose keys are expanded
+	// from traffic secrets with HKDF rather than from the master secret
+	// with the TLS 1.2 PRF.
+	tls13 bool
+	// keyLen is the length of the encryption key, ivLen that of the IV
+	// taken from the key block, and macLen that of the record MAC of CBC
+	// suites.
+	keyLen, ivLen, macLen int
+	// hash is the hash of the PRF or HKDF, and mac that of the record MAC.
+	hash, mac func() hash.Hash
+}
+
+var (
+	gcm128    = &suite{mode: modeGCM, keyLen: 16, ivLen: 4, hash: sha256.New}
+	gcm256    = &suite{mode: modeGCM, keyLen: 32, ivLen: 4, hash: sha512.New384}
+	chacha    = &suite{mode: modeChaCha, keyLen: 32, ivLen: 12, hash: sha256.New}
+	cbc128    = &suite{mode: modeCBC, keyLen: 16, ivLen: 16, macLen: 20, hash: sha256.New, mac: sha1.New}
+	cbc256    = &suite{mode: modeCBC, keyLen: 32, ivLen: 16, macLen: 20, hash: sha256.New, mac: sha1.New}
+	cbc128256 = &suite{mode: modeCBC, keyLen: 16, ivLen: 16, macLen: 32, hash: sha256.New, mac: sha256.New}
+	cbc256256 = &suite{mode: modeCBC, keyLen: 32, ivLen: 16, macLen: 32, hash: sha256.New, mac: sha256.New}
+	cbc256384 = &suite{mode: modeCBC, keyLen: 32, ivLen: 16, macLen: 48, hash: sha512.New384, mac: sha512.New384}
+)
+
+// suites are the cipher suites that can be decrypted, by ID.
+var suites = map[uint16]*suite{
+	0x1301: {mode: modeGCM, tls13: true, keyLen: 16, ivLen: 12, hash: sha256.New},
+	0x1302: {mode: modeGCM, tls13: true, keyLen: 32, ivLen: 12, hash: sha512.New384},
+	0x1303: {mode: modeChaCha, tls13: true, keyLen: 32, ivLen: 12, hash: sha256.New},
+
+	0x009c: gcm128, 0x009e: gcm128, 0xc02b: gcm128, 0xc02f: gcm128,
+	0x009d: gcm256, 0x009f: gcm256, 0xc02c: gcm256, 0xc030: gcm256,
+	0xcca8: chacha, 0xcca9: chacha, 0xccaa: chacha,
+
+	0x002f: cbc128, 0x0033: cbc128, 0xc009: cbc128, 0xc013: cbc128,
+	0x0035: cbc256, 0x0039: cbc256, 0xc00a: cbc256, 0xc014: cbc256,
+	0x003c: cbc128256, 0x0067: cbc128256, 0xc023: cbc128256, 0xc027: cbc128256,
+	0x003d: cbc256256, 0x006b: cbc256256,
+	0xc024: cbc256384, 0xc028: cbc256384,
+}
+
+var errAuth = errors.New("record failed authentication")
+
+// recordCipher decrypts the records one side sends, given each record's
+// header and sequence number.
+type recordCipher interface {
+	open(hdr, body []byte, seq uint64) ([]byte, error)
+}
+
+// prf12 is the TLS 1.2 pseudorandom function.
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	out := make([]byte, 0, n)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:n]
+}
+
+// keys12 returns the record ciphers of the client and server of a TLS 1.2
+// connection.
+func keys12(s *suite, master, clientRandom, serverRandom []byte, etm bool) (client, server recordCipher, err error) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	block := prf12(s.hash, master, "key expansion", seed, 2*(s.macLen+s.keyLen+s.ivLen))
+	take := func(n int) []byte {
+		b := block[:n]
+		block = block[n:]
+		return b
+	}
+	clientMAC, serverMAC := take(s.macLen), take(s.macLen)
+	clientKey, serverKey := take(s.keyLen), take(s.keyLen)
+	clientIV, serverIV := take(s.ivLen), take(s.ivLen)
+	if client, err = newCipher12(s, clientKey, clientIV, clientMAC, etm); err != nil {
+		return nil, nil, err
+	}
+	if server, err = newCipher12(s, serverKey, serverIV, serverMAC, etm); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+func newCipher12(s *suite, key, iv, macKey []byte, etm bool) (recordCipher, error) {
+	if s.mode == modeCBC {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return &cbcCipher{block: block, mac: s.mac, macKey: macKey, etm: etm}, nil
+	}
+	aead, err := newAEAD(s.mode, key)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadCipher12{aead: aead, iv: iv, explicit: s.mode == modeGCM}, nil
+}
+
+func newAEAD(mode int, key []byte) (cipher.AEAD, error) {
+	if mode == modeChaCha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// expandLabel is TLS 1.3's HKDF-Expand-Label with an empty context.
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(n))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, n)
+	hkdf.Expand(h, secret, info).Read(out)
+	return out
+}
+
+// keys13 returns the record cipher of a TLS 1.3 traffic secret.
+func keys13(s *suite, secret []byte) (recordCipher, error) {
+	aead, err := newAEAD(s.mode, expandLabel(s.hash, secret, "key", s.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &aeadCipher13{aead: aead, iv: expandLabel(s.hash, secret, "iv", s.ivLen)}, nil
+}
+
+// nextSecret returns the traffic secret that follows secret after a
+// KeyUpdate.
+func nextSecret(s *suite, secret []byte) []byte {
+	return expandLabel(s.hash, secret, "traffic upd", s.hash().Size())
+}
+
+// xorNonce returns iv XORed with the big-endian sequence number, the
+// per-record nonce of TLS 1.3 and of ChaCha20-Poly1305 in TLS 1.2.
+func xorNonce(iv []byte, seq uint64) []byte {
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+	}
+	return nonce
+}
+
+// aeadCipher12 decrypts TLS 1.2 AEAD records. GCM records carry the
+// explicit part of their nonce before the ciphertext.
+type aeadCipher12 struct {
+	aead     cipher.AEAD
+	iv       []byte
+	explicit bool
+}
+
+func (c *aeadCipher12) open(hdr, body []byte, seq uint64) ([]byte, error) {
+	var nonce []byte
+	if c.explicit {
+		if len(body) < 8 {
+			return nil, errAuth
+		}
+		nonce = append(append([]byte(nil), c.iv...), body[:8]...)
+		body = body[8:]
+	} else {
+		nonce = xorNonce(c.iv, seq)
+	}
+	if len(body) < c.aead.Overhead() {
+		return nil, errAuth
+	}
+	ad := binary.BigEndian.AppendUint64(nil, seq)
+	ad = append(ad, hdr[:3]...)
+	ad = binary.BigEndian.AppendUint16(ad, uint16(len(body)-c.aead.Overhead()))
+	return c.aead.Open(nil, nonce, body, ad)
+}
+
+// aeadCipher13 decrypts TLS 1.3 records, whose additional data is the
+// record header.
+type aeadCipher13 struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+func (c *aeadCipher13) open(hdr, body []byte, seq uint64) ([]byte, error) {
+	return c.aead.Open(nil, xorNonce(c.iv, seq), body, hdr)
+}
+
+// cbcCipher decrypts TLS 1.2 CBC records, each with its IV before the
+// ciphertext and a MAC over the plaintext or, with encrypt-then-MAC, over
+// the ciphertext.
+type cbcCipher struct {
+	block  cipher.Block
+	mac    func() hash.Hash
+	macKey []byte
+	etm    bool
+}
+
+func (c *cbcCipher) sum(hdr []byte, seq uint64, data []byte) []byte {
+	m := hmac.New(c.mac, c.macKey)
+	var b [13]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	copy(b[8:], hdr[:3])
+	binary.BigEndian.PutUint16(b[11:], uint16(len(data)))
+	m.Write(b[:])
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func (c *cbcCipher) open(hdr, body []byte, seq uint64) ([]byte, error) {
+	macLen, bs := c.mac().Size(), c.block.BlockSize()
+	if c.etm {
+		if len(body) < macLen {
+			return nil, errAuth
+		}
+		body, tag := body[:len(body)-macLen], body[len(body)-macLen:]
+		if !hmac.Equal(c.sum(hdr, seq, body), tag) {
+			return nil, errAuth
+		}
+		return c.decrypt(body, bs)
+	}
+	pt, err := c.decrypt(body, bs)
+	if err != nil || len(pt) < macLen {
+		return nil, errAuth
+	}
+	pt, tag := pt[:len(pt)-macLen], pt[len(pt)-macLen:]
+	if !hmac.Equal(c.sum(hdr, seq, pt), tag) {
+		return nil, errAuth
+	}
+	return pt, nil
+}
+
+// decrypt decrypts an IV and ciphertext and removes the padding.
+func (c *cbcCipher) decrypt(body []byte, bs int) ([]byte, error) {
+	if len(body) < 2*bs || len(body)%bs != 0 {
+		return nil, errAuth
+	}
+	pt := make([]byte, len(body)-bs)
+	cipher.NewCBCDecrypter(c.block, body[:bs]).CryptBlocks(pt, body[bs:])
+	pad := int(pt[len(pt)-1])
+	if pad+1 > len(pt) {
+		return nil, errAuth
+	}
+	return pt[:len(pt)-pad-1], nil
+}
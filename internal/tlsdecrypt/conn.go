@@ -0,0 +1,354 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Record content types.
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// Handshake message types.
+const (
+	msgClientHello         = 1
+	msgServerHello         = 2
+	msgEncryptedExtensions = 8
+	msgFinished            = 20
+	msgKeyUpdate           = 24
+)
+
+// Extensions read from the ServerHello and EncryptedExtensions.
+const (
+	extALPN              = 0x0010
+	extEncryptThenMAC    = 0x0016
+	extSupportedVersions = 0x002b
+)
+
+// Record and handshake message size limits: a record's ciphertext is at
+// most 2^14 bytes of plaintext plus 2048 of expansion, and handshake
+// messages longer than maxHandshake aren't waited for.
+const (
+	maxRecord    = 1<<14 + 2048
+	maxHandshake = 1 << 20
+)
+
+// helloRetryRandom is the random of a ServerHello that is really a
+// HelloRetryRequest.
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var (
+	// ErrNoKeys is returned for a connection the key log has no secrets
+	// for.
+	ErrNoKeys = errors.New("no secrets logged for the connection")
+	// ErrUnsupported is returned for a connection whose version or cipher
+	// suite can't be decrypted.
+	ErrUnsupported = errors.New("TLS version or cipher suite not supported")
+)
+
+// side is one direction of a connection.
+type side struct {
+	buf []byte
+	// off is the offset of buf in what the side has sent.
+	off int64
+	// hs holds handshake messages that have only partly arrived.
+	hs []byte
+	// cipher decrypts the side's records once they are encrypted, from
+	// its ChangeCipherSpec in TLS 1.2, when it becomes next.
+	cipher, next recordCipher
+	seq          uint64
+	// secret is the current TLS 1.3 traffic secret, and opened is set
+	// once a record has been decrypted with it.
+	secret []byte
+	opened bool
+}
+
+// Conn decrypts one TLS connection from its records. Its ClientHello and
+// ServerHello give the client random the secrets are looked up by and the
+// cipher suite negotiated. Secrets logged for TLS 1.2 (CLIENT_RANDOM) and
+// TLS 1.3 (the handshake and first traffic secrets) are both understood,
+// and without them a TLS 1.2 RSA key exchange is decrypted with the
+// server's private key; TLS 1.3 early data isn't decrypted.
+type Conn struct {
+	keys         *Keys
+	clientRandom []byte
+	// transcript holds the handshake messages while an extended master
+	// secret may need their hash, and rsa the RSA key exchange under way.
+	transcript []byte
+	rsa        *rsaExchange
+	tls13      bool
+	suite      *suite
+	secrets    map[string][]byte
+	alpn       string
+	sides      [2]side
+	err        error
+}
+
+// NewConn returns a Conn decrypting with the secrets in keys.
+func NewConn(keys *Keys) *Conn {
+	return &Conn{keys: keys}
+}
+
+// ALPN returns the application protocol the server chose, such as h2, or
+// "" until it is known or when none was.
+func (c *Conn) ALPN() string {
+	return c.alpn
+}
+
+// Write adds the payload one side of the connection sent, the server if
+// server is set, calling fn with the plaintext of every application data
+// record it completes and the offset the record started at in what the
+// side sent. Once the connection can't be decrypted, Write returns why,
+// and so does every later call.
+func (c *Conn) Write(server bool, p []byte, fn func(data []byte, start int64)) error {
+	if c.err != nil {
+		return c.err
+	}
+	d := &c.sides[0]
+	if server {
+		d = &c.sides[1]
+	}
+	d.buf = append(d.buf, p...)
+	for len(d.buf) >= 5 {
+		n := int(binary.BigEndian.Uint16(d.buf[3:5]))
+		if n > maxRecord || d.buf[1] != 3 {
+			c.err = errors.New("not a TLS record")
+			return c.err
+		}
+		if len(d.buf) < 5+n {
+			break
+		}
+		hdr, body := d.buf[:5], d.buf[5:5+n]
+		start := d.off
+		d.buf = d.buf[5+n:]
+		d.off += int64(5 + n)
+		if err := c.record(d, server, hdr, body, start, fn); err != nil {
+			c.err = err
+			return err
+		}
+	}
+	// Keep what's left in a buffer of its own rather than pinning the
+	// records before it
+	d.buf = append([]byte(nil), d.buf...)
+	return nil
+}
+
+// record handles a record, decrypting it if need be.
+func (c *Conn) record(d *side, server bool, hdr, body []byte, start int64, fn func([]byte, int64)) error {
+	typ := hdr[0]
+	if typ == recordChangeCipherSpec {
+		// TLS 1.3 sends it only for middleboxes' sake
+		if !c.tls13 && d.next != nil {
+			d.cipher, d.next, d.seq = d.next, nil, 0
+		}
+		return nil
+	}
+	if d.cipher != nil && (!c.tls13 || typ == recordApplicationData) {
+		pt, err := d.cipher.open(hdr, body, d.seq)
+		if err != nil {
+			if c.tls13 && !server && !d.opened {
+				// Early data the server turned down, sent under keys
+				// that aren't logged
+				return nil
+			}
+			return fmt.Errorf("decrypting record: %w", err)
+		}
+		d.seq++
+		d.opened = true
+		body = pt
+		if c.tls13 {
+			// The real content type is the last byte before the padding
+			body = bytes.TrimRight(body, "\x00")
+			if len(body) == 0 {
+				return errors.New("TLS 1.3 record without a content type")
+			}
+			typ, body = body[len(body)-1], body[:len(body)-1]
+		}
+	} else if typ == recordApplicationData {
+		// Encrypted under keys that aren't known yet, as early data is
+		return nil
+	}
+	switch typ {
+	case recordApplicationData:
+		if len(body) > 0 {
+			fn(body, start)
+		}
+	case recordHandshake:
+		d.hs = append(d.hs, body...)
+		for len(d.hs) >= 4 {
+			n := int(d.hs[1])<<16 | int(d.hs[2])<<8 | int(d.hs[3])
+			if n > maxHandshake {
+				return errors.New("handshake message too long")
+			}
+			if len(d.hs) < 4+n {
+				break
+			}
+			raw := d.hs[:4+n]
+			d.hs = d.hs[4+n:]
+			if err := c.handshake(d, server, raw); err != nil {
+				return err
+			}
+		}
+		if len(d.hs) == 0 {
+			d.hs = nil
+		}
+	}
+	return nil
+}
+
+// handshake handles a handshake message, given with its header: the
+// hellos, which set the connection's keys up, the messages of an RSA key
+// exchange, and in TLS 1.3 the messages that change the keys.
+func (c *Conn) handshake(d *side, server bool, raw []byte) error {
+	typ, msg := raw[0], raw[4:]
+	if c.suite == nil || c.rsa != nil {
+		// An extended master secret is derived from a hash of the
+		// messages up to the ClientKeyExchange
+		c.transcript = append(c.transcript, raw...)
+	}
+	switch {
+	case typ == msgClientHello && !server:
+		if len(msg) < 34 {
+			return errors.New("truncated ClientHello")
+		}
+		c.clientRandom = append([]byte(nil), msg[2:34]...)
+	case typ == msgServerHello && server:
+		return c.serverHello(msg)
+	case typ == msgCertificate && server && c.rsa != nil:
+		c.rsa.cert = certificateKey(msg)
+	case typ == msgClientKeyExchange && !server && c.rsa != nil:
+		return c.clientKeyExchange(msg)
+	case typ == msgEncryptedExtensions && server:
+		// Where TLS 1.3 servers send their choice of protocol
+		extensions(msg, func(typ uint16, data []byte) {
+			if typ == extALPN {
+				c.alpn = alpn(data)
+			}
+		})
+	case typ == msgFinished && c.tls13:
+		// The side's handshake is over; what it sends next is under its
+		// first traffic secret
+		label := labelClientTrafficSecret
+		if server {
+			label = labelServerTrafficSecret
+		}
+		return c.setSecret(d, c.secrets[label])
+	case typ == msgKeyUpdate && c.tls13 && d.secret != nil:
+		return c.setSecret(d, nextSecret(c.suite, d.secret))
+	}
+	return nil
+}
+
+// serverHello reads the version and cipher suite the server chose and
+// sets the keys of both sides up.
+func (c *Conn) serverHello(msg []byte) error {
+	if len(msg) < 35 {
+		return errors.New("truncated ServerHello")
+	}
+	version := binary.BigEndian.Uint16(msg)
+	random := msg[2:34]
+	if bytes.Equal(random, helloRetryRandom) {
+		// A HelloRetryRequest; the real ServerHello follows another
+		// ClientHello
+		return nil
+	}
+	rest := msg[34:]
+	sid := int(rest[0])
+	if len(rest) < 1+sid+3 {
+		return errors.New("truncated ServerHello")
+	}
+	id := binary.BigEndian.Uint16(rest[1+sid:])
+	rest = rest[1+sid+3:]
+	etm, ems := false, false
+	extensions(rest, func(typ uint16, data []byte) {
+		switch {
+		case typ == extSupportedVersions && len(data) == 2:
+			version = binary.BigEndian.Uint16(data)
+		case typ == extEncryptThenMAC:
+			etm = true
+		case typ == extExtendedMasterSecret:
+			ems = true
+		case typ == extALPN:
+			c.alpn = alpn(data)
+		}
+	})
+	s := suites[id]
+	if s == nil || version < 0x0303 || version > 0x0304 || s.tls13 != (version == 0x0304) {
+		return ErrUnsupported
+	}
+	if c.clientRandom == nil {
+		return ErrNoKeys
+	}
+	c.suite, c.tls13 = s, s.tls13
+	c.secrets = c.keys.lookup([32]byte(c.clientRandom))
+	if c.tls13 {
+		if err := c.setSecret(&c.sides[0], c.secrets[labelClientHandshakeSecret]); err != nil {
+			return err
+		}
+		return c.setSecret(&c.sides[1], c.secrets[labelServerHandshakeSecret])
+	}
+	master := c.secrets[labelMasterSecret]
+	if master == nil && rsaKeyExchange[id] && len(c.keys.privateKeys(nil)) > 0 {
+		// The keys follow from the ClientKeyExchange
+		c.rsa = &rsaExchange{serverRandom: append([]byte(nil), random...), ems: ems, etm: etm}
+		return nil
+	}
+	c.transcript = nil
+	if master == nil {
+		return ErrNoKeys
+	}
+	client, server, err := keys12(s, master, c.clientRandom, random, etm)
+	if err != nil {
+		return err
+	}
+	c.sides[0].next, c.sides[1].next = client, server
+	return nil
+}
+
+// setSecret has a side's TLS 1.3 records decrypted with a new traffic
+// secret from the next one on.
+func (c *Conn) setSecret(d *side, secret []byte) error {
+	if secret == nil {
+		return ErrNoKeys
+	}
+	rc, err := keys13(c.suite, secret)
+	if err != nil {
+		return err
+	}
+	d.cipher, d.secret, d.seq = rc, secret, 0
+	return nil
+}
+
+// extensions calls fn with each extension of a list preceded by its
+// length, as hellos end with.
+func extensions(b []byte, fn func(typ uint16, data []byte)) {
+	if len(b) < 2 {
+		return
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return
+		}
+		fn(typ, b[4:4+n])
+		b = b[4+n:]
+	}
+}
+
+// alpn returns the protocol of a server's ALPN extension, which names
+// exactly one.
+func alpn(data []byte) string {
+	if len(data) < 3 || int(data[2]) > len(data)-3 {
+		return ""
+	}
+	return string(data[3 : 3+data[2]])
+}
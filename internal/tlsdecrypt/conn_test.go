@@ -0,0 +1,287 @@
+package tlsdecrypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/pkg/analyzer"
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+const (
+	request  = "GET /secret HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response = "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello, tls!"
+)
+
+// recorder keeps the messages it is handed.
+type recorder struct {
+	mu    sync.Mutex
+	reqs  []*httpstream.Request
+	resps []*httpstream.Response
+}
+
+func (r *recorder) HandleRequest(req *httpstream.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reqs = append(r.reqs, req)
+}
+
+func (r *recorder) HandleResponse(resp *httpstream.Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resps = append(r.resps, resp)
+}
+
+func (r *recorder) HandleDNS(*dns.Message) {}
+
+// serverKey returns an RSA key and a certificate for example.com made with
+// it.
+func serverKey(t *testing.T) (*rsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// wire records what both ends of a connection write, in the order they
+// write it.
+type wire struct {
+	mu     sync.Mutex
+	chunks []chunk
+}
+
+type chunk struct {
+	server bool
+	data   []byte
+}
+
+// recordedConn is one end of a connection whose writes go to a wire.
+type recordedConn struct {
+	net.Conn
+	wire   *wire
+	server bool
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	c.wire.mu.Lock()
+	c.wire.chunks = append(c.wire.chunks, chunk{c.server, bytes.Clone(p)})
+	c.wire.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// tlsCapture has a client and server configured by client and server
+// exchange request and response over TLS on the loopback interface,
+// returning a capture of what they sent.
+func tlsCapture(t *testing.T, client, server *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w := &wire{}
+	served := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		conn := tls.Server(&recordedConn{c, w, true}, server)
+		defer conn.Close()
+		buf := make([]byte, len(request))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			served <- err
+			return
+		}
+		_, err = io.WriteString(conn, response)
+		served <- err
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(&recordedConn{c, w, false}, client)
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Fatalf("client read %q", got)
+	}
+
+	b := testutil.NewBuilder()
+	tc := b.TCPConn("10.0.0.1:40000", "10.0.0.2:443").Handshake()
+	w.mu.Lock()
+	for _, ch := range w.chunks {
+		if ch.server {
+			tc.ServerSend(ch.data)
+		} else {
+			tc.ClientSend(ch.data)
+		}
+	}
+	w.mu.Unlock()
+	tc.Close()
+	path := filepath.Join(t.TempDir(), "tls.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkDecrypted fails the test unless running the analyzer over capture
+// with keys finds the request and response, or finds nothing if want is
+// unset.
+func checkDecrypted(t *testing.T, capture string, keys *analyzer.TLSKeys, want bool) {
+	t.Helper()
+	var r recorder
+	if err := analyzer.Run(capture, analyzer.Options{TLSKeys: keys}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if !want {
+		if len(r.reqs) != 0 || len(r.resps) != 0 {
+			t.Errorf("got %d requests and %d responses without the secrets", len(r.reqs), len(r.resps))
+		}
+		return
+	}
+	if len(r.reqs) != 1 || len(r.resps) != 1 {
+		t.Fatalf("got %d requests and %d responses, want 1 of each", len(r.reqs), len(r.resps))
+	}
+	if req := r.reqs[0]; req.Method != "GET" || req.URI != "/secret" || req.Host != "example.com" {
+		t.Errorf("got request %s %s for %s", req.Method, req.URI, req.Host)
+	}
+	if resp := r.resps[0]; resp.StatusCode != 200 || string(resp.Body) != "hello, tls!" {
+		t.Errorf("got response %d %q", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestKeyLog(t *testing.T) {
+	_, cert := serverKey(t)
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+		// logged is unset when the key log holds another connection's
+		// secrets instead.
+		logged bool
+	}{
+		{"TLS 1.3", tls.VersionTLS13, 0, true},
+		{"TLS 1.2 AES-128-GCM", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"TLS 1.2 AES-256-GCM", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, true},
+		{"TLS 1.2 ChaCha20-Poly1305", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, true},
+		{"TLS 1.2 AES-128-CBC-SHA", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, true},
+		{"TLS 1.2 AES-256-CBC-SHA", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, true},
+		{"TLS 1.2 AES-128-CBC-SHA256", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, true},
+		{"TLS 1.3 without its secrets", tls.VersionTLS13, 0, false},
+		{"TLS 1.2 without its secrets", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keyLog bytes.Buffer
+			client := &tls.Config{
+				ServerName: "example.com",
+				MinVersion: tt.version,
+				MaxVersion: tt.version,
+				// The certificate is made up, and only what the
+				// connection carries matters
+				InsecureSkipVerify: true,
+				KeyLogWriter:       &keyLog,
+			}
+			if tt.suite != 0 {
+				client.CipherSuites = []uint16{tt.suite}
+			}
+			server := &tls.Config{Certificates: []tls.Certificate{cert}, CipherSuites: client.CipherSuites}
+			capture := tlsCapture(t, client, server)
+			if !tt.logged {
+				keyLog.Reset()
+				client.KeyLogWriter = &keyLog
+				tlsCapture(t, client, server)
+			}
+
+			path := filepath.Join(t.TempDir(), "sslkeys.log")
+			if err := os.WriteFile(path, keyLog.Bytes(), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := analyzer.LoadKeyLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys.Len() != 1 {
+				t.Fatalf("key log holds secrets for %d connections, want 1", keys.Len())
+			}
+			checkDecrypted(t, capture, keys, tt.logged)
+		})
+	}
+}
+
+func TestLoadKeyLog(t *testing.T) {
+	random := bytes.Repeat([]byte("ab"), 32)
+	tests := []struct {
+		name string
+		log  string
+		want int // connections with secrets, or -1 for an error
+	}{
+		{"TLS 1.2", "CLIENT_RANDOM " + string(random) + " " + string(bytes.Repeat([]byte("cd"), 48)) + "\n", 1},
+		{"comments and blank lines", "# SSL/TLS secrets log file\n\nCLIENT_RANDOM " + string(random) + " 00\n", 1},
+		{"TLS 1.3", "CLIENT_HANDSHAKE_TRAFFIC_SECRET " + string(random) + " 00\nSERVER_TRAFFIC_SECRET_0 " + string(random) + " 00\n", 1},
+		{"unknown labels", "EXPORTER_SECRET " + string(random) + " 00\n", 0},
+		{"bad hex", "CLIENT_RANDOM zz 00\n", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sslkeys.log")
+			if err := os.WriteFile(path, []byte(tt.log), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := analyzer.LoadKeyLog(path)
+			if tt.want < 0 {
+				if err == nil {
+					t.Error("loaded a malformed key log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys.Len() != tt.want {
+				t.Errorf("got secrets for %d connections, want %d", keys.Len(), tt.want)
+			}
+		})
+	}
+}
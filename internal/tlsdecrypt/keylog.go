@@ -0,0 +1,139 @@
+// Package tlsdecrypt decrypts captured TLS 1.2 and 1.3 connections with
+// the secrets their clients logged to an NSS key log file, the
+// SSLKEYLOGFILE that browsers, curl and Go's crypto/tls write, or, for
+// TLS 1.2 RSA key exchange, with the server's private key.
+package tlsdecrypt
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of the key log lines used.
+const (
+	labelMasterSecret          = "CLIENT_RANDOM"
+	labelClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	labelServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// keyLogFile is a key log file with what was last read of it.
+type keyLogFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Keys holds the secrets of key log files by client random. A file is
+// read again when a connection's secrets aren't found and it has changed
+// since, so a capture can be decrypted while its key log is still being
+// written. It is safe for concurrent use.
+type Keys struct {
+	mu      sync.Mutex
+	files   []*keyLogFile
+	secrets map[[32]byte]map[string][]byte
+	private []*rsa.PrivateKey
+}
+
+// LoadKeyLog reads the secrets of key log files, of which there may be
+// none when only private keys are to be added.
+func LoadKeyLog(paths ...string) (*Keys, error) {
+	k := &Keys{secrets: make(map[[32]byte]map[string][]byte)}
+	for _, path := range paths {
+		f := &keyLogFile{path: path}
+		if err := k.read(f); err != nil {
+			return nil, err
+		}
+		k.files = append(k.files, f)
+	}
+	return k, nil
+}
+
+// Len returns how many connections the keys have secrets for.
+func (k *Keys) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.secrets)
+}
+
+// read reads f, adding the secrets it holds. k.mu must be held, or k not
+// yet shared.
+func (k *Keys) read(f *keyLogFile) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := k.parse(file, f.path); err != nil {
+		return err
+	}
+	f.size, f.modTime = info.Size(), info.ModTime()
+	return nil
+}
+
+// parse adds the secrets of a key log. Labels that aren't used are
+// skipped.
+func (k *Keys) parse(r io.Reader, name string) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: want a label, a client random and a secret", name, line)
+		}
+		switch fields[0] {
+		case labelMasterSecret, labelClientHandshakeSecret, labelServerHandshakeSecret,
+			labelClientTrafficSecret, labelServerTrafficSecret:
+		default:
+			continue
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return fmt.Errorf("%s:%d: malformed client random", name, line)
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			return fmt.Errorf("%s:%d: malformed secret", name, line)
+		}
+		key := [32]byte(random)
+		if k.secrets[key] == nil {
+			k.secrets[key] = make(map[string][]byte)
+		}
+		k.secrets[key][fields[0]] = secret
+	}
+	return sc.Err()
+}
+
+// lookup returns the secrets logged for the connection whose ClientHello
+// carried random, reading the files again if they have changed.
+func (k *Keys) lookup(random [32]byte) map[string][]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if s, ok := k.secrets[random]; ok {
+		return s
+	}
+	for _, f := range k.files {
+		info, err := os.Stat(f.path)
+		if err != nil || info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+			continue
+		}
+		// A line being written may not parse yet; it will once it's done
+		k.read(f)
+	}
+	return k.secrets[random]
+}
@@ -0,0 +1,154 @@
+package tlsdecrypt
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// rsaKeyExchange are the TLS 1.2 cipher suites whose premaster secret the
+// client sends encrypted to the server's RSA key, so that the server's
+// private key recovers it.
+var rsaKeyExchange = map[uint16]bool{
+	0x002f: true, 0x0035: true, 0x003c: true, 0x003d: true, 0x009c: true, 0x009d: true,
+}
+
+// Handshake messages of an RSA key exchange.
+const (
+	msgCertificate       = 11
+	msgClientKeyExchange = 16
+)
+
+// extExtendedMasterSecret has the master secret derived from a hash of
+// the handshake rather than from the hellos' randoms.
+const extExtendedMasterSecret = 0x0017
+
+// rsaExchange is a TLS 1.2 connection with RSA key exchange waiting for
+// the client's encrypted premaster secret.
+type rsaExchange struct {
+	serverRandom []byte
+	ems, etm     bool
+	// cert is the public key of the server's certificate, when it was
+	// seen.
+	cert *rsa.PublicKey
+}
+
+// LoadPrivateKeys adds the RSA private keys of servers, in PEM files, to
+// decrypt the TLS 1.2 connections that used RSA key exchange with them and
+// have no secrets in the key log.
+func (k *Keys) LoadPrivateKeys(paths ...string) error {
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found := false
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			var key any
+			switch block.Type {
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			default:
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return fmt.Errorf("%s: not an RSA key", path)
+			}
+			k.mu.Lock()
+			k.private = append(k.private, rsaKey)
+			k.mu.Unlock()
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("%s: no private key found", path)
+		}
+	}
+	return nil
+}
+
+// privateKeys returns the RSA private keys, those of cert first if it is
+// given.
+func (k *Keys) privateKeys(cert *rsa.PublicKey) []*rsa.PrivateKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cert != nil {
+		for _, key := range k.private {
+			if key.PublicKey.Equal(cert) {
+				return []*rsa.PrivateKey{key}
+			}
+		}
+	}
+	return k.private
+}
+
+// certificateKey returns the RSA public key of the first certificate of a
+// Certificate message, or nil.
+func certificateKey(msg []byte) *rsa.PublicKey {
+	if len(msg) < 6 {
+		return nil
+	}
+	n := int(msg[3])<<16 | int(msg[4])<<8 | int(msg[5])
+	if len(msg) < 6+n {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(msg[6 : 6+n])
+	if err != nil {
+		return nil
+	}
+	key, _ := cert.PublicKey.(*rsa.PublicKey)
+	return key
+}
+
+// clientKeyExchange recovers the premaster secret of an RSA key exchange
+// and derives the keys of both sides from it.
+func (c *Conn) clientKeyExchange(msg []byte) error {
+	x := c.rsa
+	c.rsa = nil
+	if len(msg) < 2 || int(binary.BigEndian.Uint16(msg)) != len(msg)-2 {
+		return errors.New("malformed ClientKeyExchange")
+	}
+	var premaster []byte
+	for _, key := range c.keys.privateKeys(x.cert) {
+		pms, err := rsa.DecryptPKCS1v15(nil, key, msg[2:])
+		// The premaster secret starts with the version the client offered;
+		// some clients put the version negotiated instead
+		if err == nil && len(pms) == 48 && pms[0] == 3 {
+			premaster = pms
+			break
+		}
+	}
+	if premaster == nil {
+		return ErrNoKeys
+	}
+	var master []byte
+	if x.ems {
+		h := c.suite.hash()
+		h.Write(c.transcript)
+		master = prf12(c.suite.hash, premaster, "extended master secret", h.Sum(nil), 48)
+	} else {
+		seed := append(append([]byte(nil), c.clientRandom...), x.serverRandom...)
+		master = prf12(c.suite.hash, premaster, "master secret", seed, 48)
+	}
+	c.transcript = nil
+	client, server, err := keys12(c.suite, master, c.clientRandom, x.serverRandom, x.etm)
+	if err != nil {
+		return err
+	}
+	c.sides[0].next, c.sides[1].next = client, server
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package tsdb aggregates requests, responses and DNS messages into metrics
+// per time bucket and writes them to a time-series database, as InfluxDB
+// line protocol or a Prometheus remote-write request, so that a capture can
+// be graphed next to live telemetry.
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	httpstream "github.com/pcap-analyzer/internal/http"
+)
+
+// Formats metrics are written in.
+const (
+	Influx      = "influx"
+	RemoteWrite = "remote-write"
+)
+
+// DefaultInterval is the width of a bucket when none is given.
+const DefaultInterval = 10 * time.Second
+
+// Config describes where metrics are written.
+type Config struct {
+	// URL is the write endpoint: InfluxDB's /api/v2/write (with its org
+	// and bucket) or /write, or a Prometheus remote-write receiver.
+	URL string
+	// Format is Influx or RemoteWrite.
+	Format string
+	// Interval is the width of a bucket; zero means DefaultInterval.
+	Interval time.Duration
+	// Tags are added to every point, such as the capture it came from.
+	Tags map[string]string
+	// User and Password authenticate with basic authentication when User
+	// is set; Token is sent as an API token instead when it is.
+	User, Password, Token string
+}
+
+// Point is one measurement of a bucket, with its fields in a fixed order.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	Time        time.Time
+}
+
+// Field is one value of a point. Counts are integers; rates, ratios and
+// latencies aren't.
+type Field struct {
+	Name    string
+	Value   float64
+	Integer bool
+}
+
+// httpBucket is the HTTP traffic to one host in one bucket.
+type httpBucket struct {
+	requests, responses int64
+	clientErrors        int64
+	serverErrors        int64
+	latencies           []time.Duration
+}
+
+// dnsBucket is the DNS traffic in one bucket.
+type dnsBucket struct {
+	queries, responses int64
+	failures           int64
+	nxdomain, servfail int64
+}
+
+// Sink is a handler aggregating every event it receives into buckets of
+// capture time; Write sends the metrics once the capture has been read.
+type Sink struct {
+	cfg Config
+	mu  sync.Mutex
+
+	// http holds the buckets of each host by bucket number.
+	http map[string]map[int64]*httpBucket
+	dns  map[int64]*dnsBucket
+}
+
+// New returns a Sink writing to cfg.URL.
+func New(cfg Config) (*Sink, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Format == "" {
+		cfg.Format = Influx
+	}
+	if cfg.Format != Influx && cfg.Format != RemoteWrite {
+		return nil, fmt.Errorf("unknown format %q; use %s or %s", cfg.Format, Influx, RemoteWrite)
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http or https URL", cfg.URL)
+	}
+	return &Sink{
+		cfg:  cfg,
+		http: make(map[string]map[int64]*httpBucket),
+		dns:  make(map[int64]*dnsBucket),
+	}, nil
+}
+
+func (s *Sink) bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(s.cfg.Interval)
+}
+
+// httpBucket returns the bucket of host at t. s.mu must be held.
+func (s *Sink) httpBucket(host string, t time.Time) *httpBucket {
+	buckets, ok := s.http[host]
+	if !ok {
+		buckets = make(map[int64]*httpBucket)
+		s.http[host] = buckets
+	}
+	i := s.bucketOf(t)
+	b, ok := buckets[i]
+	if !ok {
+		b = &httpBucket{}
+		buckets[i] = b
+	}
+	return b
+}
+
+// hostOf returns the host a request was sent to, falling back to the
+// server address without a Host header.
+func hostOf(req *httpstream.Request) string {
+	if req.Host == "" {
+		return req.DstIP
+	}
+	return strings.TrimSuffix(strings.ToLower(req.Host), ".")
+}
+
+func (s *Sink) HandleRequest(req *httpstream.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.httpBucket(hostOf(req), req.Timestamp).requests++
+}
+
+func (s *Sink) HandleResponse(resp *httpstream.Response) {
+	host := resp.SrcIP
+	if resp.Request != nil {
+		host = hostOf(resp.Request)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.httpBucket(host, resp.Timestamp)
+	b.responses++
+	switch {
+	case resp.StatusCode >= 500:
+		b.serverErrors++
+	case resp.StatusCode >= 400:
+		b.clientErrors++
+	}
+	if req := resp.Request; req != nil && !resp.Timestamp.Before(req.Timestamp) {
+		b.latencies = append(b.latencies, resp.Timestamp.Sub(req.Timestamp))
+	}
+}
+
+func (s *Sink) HandleDNS(msg *dns.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.bucketOf(msg.Timestamp)
+	b, ok := s.dns[i]
+	if !ok {
+		b = &dnsBucket{}
+		s.dns[i] = b
+	}
+	if !msg.Response {
+		b.queries++
+		return
+	}
+	b.responses++
+	switch msg.Rcode {
+	case "NOERROR":
+	case "NXDOMAIN":
+		b.nxdomain++
+		b.failures++
+	case "SERVFAIL":
+		b.servfail++
+		b.failures++
+	default:
+		b.failures++
+	}
+}
+
+// Points returns the metrics of every bucket, in time order per host. Each
+// series runs from its first bucket to its last, with zero counts for the
+// buckets between without traffic, so graphs of it don't interpolate over
+// quiet spells.
+func (s *Sink) Points() []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var points []Point
+
+	hosts := make([]string, 0, len(s.http))
+	for host := range s.http {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		buckets := s.http[host]
+		first, last := span(buckets)
+		for i := first; i <= last; i++ {
+			b, ok := buckets[i]
+			if !ok {
+				b = &httpBucket{}
+			}
+			points = append(points, Point{
+				Measurement: "http",
+				Tags:        s.tags("host", host),
+				Fields:      s.httpFields(b),
+				Time:        time.Unix(0, i*int64(s.cfg.Interval)),
+			})
+		}
+	}
+
+	first, last := span(s.dns)
+	for i := first; i <= last && len(s.dns) > 0; i++ {
+		b, ok := s.dns[i]
+		if !ok {
+			b = &dnsBucket{}
+		}
+		points = append(points, Point{
+			Measurement: "dns",
+			Tags:        s.tags(),
+			Fields: []Field{
+				{Name: "queries", Value: float64(b.queries), Integer: true},
+				{Name: "responses", Value: float64(b.responses), Integer: true},
+				{Name: "failures", Value: float64(b.failures), Integer: true},
+				{Name: "nxdomain", Value: float64(b.nxdomain), Integer: true},
+				{Name: "servfail", Value: float64(b.servfail), Integer: true},
+			},
+			Time: time.Unix(0, i*int64(s.cfg.Interval)),
+		})
+	}
+	return points
+}
+
+func (s *Sink) httpFields(b *httpBucket) []Field {
+	fields := []Field{
+		{Name: "requests", Value: float64(b.requests), Integer: true},
+		{Name: "request_rate", Value: float64(b.requests) / s.cfg.Interval.Seconds()},
+		{Name: "responses", Value: float64(b.responses), Integer: true},
+		{Name: "errors_4xx", Value: float64(b.clientErrors), Integer: true},
+		{Name: "errors_5xx", Value: float64(b.serverErrors), Integer: true},
+	}
+	if b.responses > 0 {
+		fields = append(fields, Field{Name: "error_ratio", Value: float64(b.clientErrors+b.serverErrors) / float64(b.responses)})
+	}
+	if len(b.latencies) > 0 {
+		sort.Slice(b.latencies, func(i, j int) bool { return b.latencies[i] < b.latencies[j] })
+		ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		fields = append(fields,
+			Field{Name: "latency_p50_ms", Value: ms(percentile(b.latencies, 50))},
+			Field{Name: "latency_p90_ms", Value: ms(percentile(b.latencies, 90))},
+			Field{Name: "latency_p99_ms", Value: ms(percentile(b.latencies, 99))},
+			Field{Name: "latency_max_ms", Value: ms(b.latencies[len(b.latencies)-1])},
+		)
+	}
+	return fields
+}
+
+// tags returns the configured tags plus the given name and value pairs.
+func (s *Sink) tags(pairs ...string) map[string]string {
+	tags := make(map[string]string, len(s.cfg.Tags)+len(pairs)/2)
+	for k, v := range s.cfg.Tags {
+		tags[k] = v
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		tags[pairs[i]] = pairs[i+1]
+	}
+	return tags
+}
+
+// span returns the first and last bucket numbers of buckets.
+func span[T any](buckets map[int64]T) (first, last int64) {
+	first, last = math.MaxInt64, math.MinInt64
+	for i := range buckets {
+		first, last = min(first, i), max(last, i)
+	}
+	return first, last
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,215 @@
+package tsdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// batchSize is how many points each write carries.
+const batchSize = 5000
+
+// requestTimeout bounds each write.
+const requestTimeout = time.Minute
+
+// Write sends the metrics and returns how many points were written. Points
+// are sent in batches, and the first batch that fails ends the write.
+func (s *Sink) Write() (int, error) {
+	points := s.Points()
+	client := &http.Client{Timeout: requestTimeout}
+	written := 0
+	for len(points) > 0 {
+		n := min(batchSize, len(points))
+		var body []byte
+		var header http.Header
+		if s.cfg.Format == RemoteWrite {
+			body, header = encodeRemoteWrite(points[:n]), http.Header{
+				"Content-Type":                      {"application/x-protobuf"},
+				"Content-Encoding":                  {"snappy"},
+				"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+			}
+		} else {
+			body, header = encodeInflux(points[:n]), http.Header{
+				"Content-Type": {"text/plain; charset=utf-8"},
+			}
+		}
+		if err := s.post(client, body, header); err != nil {
+			return written, err
+		}
+		written += n
+		points = points[n:]
+	}
+	return written, nil
+}
+
+func (s *Sink) post(client *http.Client, body []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	switch {
+	case s.cfg.Token != "" && s.cfg.Format == Influx:
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	case s.cfg.Token != "":
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	case s.cfg.User != "":
+		req.SetBasicAuth(s.cfg.User, s.cfg.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// encodeInflux returns points as InfluxDB line protocol with nanosecond
+// timestamps.
+func encodeInflux(points []Point) []byte {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(influxEscape(p.Measurement, ", "))
+		for _, k := range sortedKeys(p.Tags) {
+			if p.Tags[k] == "" {
+				continue
+			}
+			fmt.Fprintf(&b, ",%s=%s", influxEscape(k, ",= "), influxEscape(p.Tags[k], ",= "))
+		}
+		for i, f := range p.Fields {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			b.WriteString(sep + influxEscape(f.Name, ",= ") + "=")
+			if f.Integer {
+				b.WriteString(strconv.FormatInt(int64(f.Value), 10) + "i")
+			} else {
+				b.WriteString(strconv.FormatFloat(f.Value, 'g', -1, 64))
+			}
+		}
+		fmt.Fprintf(&b, " %d\n", p.Time.UnixNano())
+	}
+	return b.Bytes()
+}
+
+// influxEscape backslash-escapes the characters in special, and newlines,
+// which line protocol doesn't allow at all.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\\' || strings.ContainsRune(special, r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeRemoteWrite returns points as a snappy-compressed Prometheus
+// WriteRequest. Each field becomes a series named after its measurement,
+// such as pcap_http_requests, with the point's tags as labels.
+func encodeRemoteWrite(points []Point) []byte {
+	type sample struct {
+		value float64
+		ms    int64
+	}
+	type series struct {
+		labels  [][2]string
+		samples []sample
+	}
+	var order []string
+	all := make(map[string]*series)
+	for _, p := range points {
+		for _, f := range p.Fields {
+			labels := [][2]string{{"__name__", "pcap_" + p.Measurement + "_" + f.Name}}
+			for _, k := range sortedKeys(p.Tags) {
+				if p.Tags[k] != "" {
+					labels = append(labels, [2]string{k, p.Tags[k]})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+			key := fmt.Sprint(labels)
+			ts, ok := all[key]
+			if !ok {
+				ts = &series{labels: labels}
+				all[key] = ts
+				order = append(order, key)
+			}
+			ts.samples = append(ts.samples, sample{f.Value, p.Time.UnixMilli()})
+		}
+	}
+
+	// WriteRequest{repeated TimeSeries timeseries = 1}, where TimeSeries is
+	// {repeated Label labels = 1; repeated Sample samples = 2}, Label is
+	// {string name = 1; string value = 2} and Sample is {double value = 1;
+	// int64 timestamp = 2}
+	var req []byte
+	for _, key := range order {
+		ts := all[key]
+		var msg []byte
+		for _, l := range ts.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, label)
+		}
+		for _, smp := range ts.samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(smp.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(smp.ms))
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, sample)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, msg)
+	}
+	return snappyLiteral(req)
+}
+
+// snappyLiteral encodes p in the snappy block format as literals only. It
+// doesn't compress, but every snappy decoder reads it, which spares a
+// dependency for the few kilobytes a capture's metrics take.
+func snappyLiteral(p []byte) []byte {
+	out := protowire.AppendVarint(nil, uint64(len(p)))
+	for len(p) > 0 {
+		n := min(len(p), 1<<16)
+		// A literal of up to 65536 bytes: tag 61<<2, then its length
+		// minus one in two little-endian bytes
+		out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		out = append(out, p[:n]...)
+		p = p[n:]
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
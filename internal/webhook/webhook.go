@@ -0,0 +1,350 @@
+// Package webhook posts the events matching filter expressions or IDS rules
+// to HTTP endpoints as they are parsed, so incident automation can act on
+// them without polling the output.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/filter"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/rules"
+)
+
+// DefaultQueue is how many notifications wait to be posted when Config
+// gives zero.
+const DefaultQueue = 256
+
+// SignatureHeader carries the HMAC-SHA256 of the body, as "sha256=" and
+// its hex digest, when a secret is configured.
+const SignatureHeader = "X-Pcap-Analyzer-Signature-256"
+
+// requestTimeout bounds each post.
+const requestTimeout = 10 * time.Second
+
+// retries is how many times a post that failed is attempted again.
+const retries = 3
+
+// Config describes which events are posted and where.
+type Config struct {
+	// URLs are the endpoints every notification is posted to.
+	URLs []string
+	// Filters are filter expressions; an event matching one is posted.
+	Filters []string
+	// Rules, if set, posts the events that IDS rules alert on.
+	Rules *rules.Set
+	// Secret, if set, signs each body in SignatureHeader.
+	Secret string
+	// Queue is how many notifications may wait to be posted; zero means
+	// DefaultQueue.
+	Queue int
+}
+
+// Notification is the JSON body posted for each match.
+type Notification struct {
+	Time    time.Time `json:"time"`
+	Trigger Trigger   `json:"trigger"`
+	Event   Event     `json:"event"`
+}
+
+// Trigger is what matched: a filter expression, or an IDS rule.
+type Trigger struct {
+	Kind      string `json:"kind"`
+	Filter    string `json:"filter,omitempty"`
+	SID       int    `json:"sid,omitempty"`
+	Rev       int    `json:"rev,omitempty"`
+	Msg       string `json:"msg,omitempty"`
+	Classtype string `json:"classtype,omitempty"`
+}
+
+// Event is the request, response or DNS message that matched. Responses
+// repeat the method, URL and host of the request they answer.
+type Event struct {
+	Type      string              `json:"type"`
+	ID        string              `json:"id,omitempty"`
+	SrcIP     string              `json:"src_ip"`
+	SrcPort   string              `json:"src_port,omitempty"`
+	DstIP     string              `json:"dst_ip"`
+	DstPort   string              `json:"dst_port,omitempty"`
+	Method    string              `json:"method,omitempty"`
+	URL       string              `json:"url,omitempty"`
+	Host      string              `json:"host,omitempty"`
+	Proto     string              `json:"proto,omitempty"`
+	Status    int                 `json:"status,omitempty"`
+	LatencyMs float64             `json:"latency_ms,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	BodySize  int64               `json:"body_size,omitempty"`
+	Name      string              `json:"name,omitempty"`
+	QType     string              `json:"qtype,omitempty"`
+	Rcode     string              `json:"rcode,omitempty"`
+	Answers   []string            `json:"answers,omitempty"`
+}
+
+// Notifier is a handler posting a notification for every filter or rule
+// an event matches. Posting happens on a goroutine of its own so the
+// capture isn't held up; when the queue is full, notifications are dropped
+// and counted instead.
+type Notifier struct {
+	cfg      Config
+	triggers atomic.Pointer[triggers]
+	client   *http.Client
+	queue    chan []byte
+	done     chan struct{}
+
+	// mu guards queue against being sent to once Close has closed it
+	mu      sync.RWMutex
+	closed  bool
+	sent    atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+	// err is the first post that failed; it is set by the posting
+	// goroutine and read once it has finished.
+	err error
+}
+
+// triggers are the filters and rules events are matched against.
+type triggers struct {
+	filters []*filter.Filter
+	rules   *rules.Set
+}
+
+// New compiles cfg's filters and starts posting.
+func New(cfg Config) (*Notifier, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, fmt.Errorf("no webhook URL")
+	}
+	for _, u := range cfg.URLs {
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+			return nil, fmt.Errorf("%q is not an http or https URL", u)
+		}
+	}
+	if cfg.Queue <= 0 {
+		cfg.Queue = DefaultQueue
+	}
+	n := &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan []byte, cfg.Queue),
+		done:   make(chan struct{}),
+	}
+	if err := n.Reload(cfg.Filters, cfg.Rules); err != nil {
+		return nil, err
+	}
+	go n.postAll()
+	return n, nil
+}
+
+// Reload replaces the filters and rules that events are matched against
+// from the next event on. On error the old ones are kept.
+func (n *Notifier) Reload(filters []string, set *rules.Set) error {
+	if len(filters) == 0 && set == nil {
+		return fmt.Errorf("no filter or rules to notify on")
+	}
+	t := &triggers{rules: set}
+	for _, expr := range filters {
+		f, err := filter.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("filter %q: %w", expr, err)
+		}
+		t.filters = append(t.filters, f)
+	}
+	n.triggers.Store(t)
+	return nil
+}
+
+func (n *Notifier) HandleRequest(req *httpstream.Request) {
+	t := n.triggers.Load()
+	var matched []*rules.Rule
+	if t.rules != nil {
+		matched = t.rules.MatchRequest(req)
+	}
+	n.notify(t, req.Timestamp, matched, func(f *filter.Filter) bool { return f.MatchRequest(req) }, func() Event {
+		e := httpEvent("request", &req.Message)
+		e.Method, e.URL, e.Host = req.Method, req.URL, req.Host
+		return e
+	})
+}
+
+func (n *Notifier) HandleResponse(resp *httpstream.Response) {
+	t := n.triggers.Load()
+	var matched []*rules.Rule
+	if t.rules != nil {
+		matched = t.rules.MatchResponse(resp)
+	}
+	n.notify(t, resp.Timestamp, matched, func(f *filter.Filter) bool { return f.MatchResponse(resp) }, func() Event {
+		e := httpEvent("response", &resp.Message)
+		e.Status = resp.StatusCode
+		if req := resp.Request; req != nil {
+			e.Method, e.URL, e.Host = req.Method, req.URL, req.Host
+			e.LatencyMs = float64(resp.Timestamp.Sub(req.Timestamp)) / float64(time.Millisecond)
+		}
+		return e
+	})
+}
+
+func (n *Notifier) HandleDNS(msg *dns.Message) {
+	t := n.triggers.Load()
+	var matched []*rules.Rule
+	if t.rules != nil {
+		matched = t.rules.MatchDNS(msg)
+	}
+	n.notify(t, msg.Timestamp, matched, func(f *filter.Filter) bool { return f.MatchDNS(msg) }, func() Event {
+		e := Event{
+			Type:  "dns",
+			SrcIP: msg.SrcIP,
+			DstIP: msg.DstIP,
+			Name:  strings.TrimSuffix(msg.Question, "."),
+			QType: msg.QType,
+			Rcode: msg.Rcode,
+		}
+		for _, a := range msg.Answers {
+			e.Answers = append(e.Answers, strings.TrimSuffix(a.Value, "."))
+		}
+		return e
+	})
+}
+
+func httpEvent(typ string, m *httpstream.Message) Event {
+	return Event{
+		Type:     typ,
+		ID:       m.ID(),
+		SrcIP:    m.SrcIP,
+		SrcPort:  m.SrcPort,
+		DstIP:    m.DstIP,
+		DstPort:  m.DstPort,
+		Proto:    m.Proto,
+		Headers:  m.Header,
+		BodySize: m.BodySize,
+	}
+}
+
+// notify queues a notification for each filter the event matches and each
+// rule in matched. The event is only built once something has matched.
+func (n *Notifier) notify(t *triggers, ts time.Time, matched []*rules.Rule, match func(*filter.Filter) bool, event func() Event) {
+	var fired []Trigger
+	for _, f := range t.filters {
+		if match(f) {
+			fired = append(fired, Trigger{Kind: "filter", Filter: f.String()})
+		}
+	}
+	for _, r := range matched {
+		fired = append(fired, Trigger{Kind: "rule", SID: r.SID, Rev: r.Rev, Msg: r.Msg, Classtype: r.Classtype})
+	}
+	if len(fired) == 0 {
+		return
+	}
+	e := event()
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+	for _, tr := range fired {
+		var body bytes.Buffer
+		enc := json.NewEncoder(&body)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(Notification{Time: ts, Trigger: tr, Event: e}); err != nil {
+			continue
+		}
+		select {
+		case n.queue <- body.Bytes():
+		default:
+			n.dropped.Add(1)
+		}
+	}
+}
+
+// Close posts the notifications still queued and waits for them; events
+// handled after Close are ignored. It returns the first post that failed.
+func (n *Notifier) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	<-n.done
+	return n.err
+}
+
+// Counts returns how many notifications were posted to every endpoint,
+// how many failed to reach at least one, and how many were dropped because
+// the queue was full.
+func (n *Notifier) Counts() (sent, failed, dropped int64) {
+	return n.sent.Load(), n.failed.Load(), n.dropped.Load()
+}
+
+func (n *Notifier) postAll() {
+	defer close(n.done)
+	for body := range n.queue {
+		ok := true
+		for _, u := range n.cfg.URLs {
+			if err := n.post(u, body); err != nil {
+				ok = false
+				if n.err == nil {
+					n.err = fmt.Errorf("%s: %w", u, err)
+				}
+			}
+		}
+		if ok {
+			n.sent.Add(1)
+		} else {
+			n.failed.Add(1)
+		}
+	}
+}
+
+// post sends body to u, retrying after network errors and 5xx and 429
+// responses.
+func (n *Notifier) post(u string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<(attempt-1)) * time.Second)
+		}
+		var retry bool
+		retry, err = n.do(u, body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (n *Notifier) do(u string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errors.New(resp.Status)
+	}
+	return false, nil
+}
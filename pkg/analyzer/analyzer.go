@@ -0,0 +1,535 @@
+// Package analyzer reconstructs HTTP transactions and DNS messages from
+// packet captures.
+package analyzer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/reassembly"
+	"github.com/pcap-analyzer/internal/dns"
+	"github.com/pcap-analyzer/internal/har"
+	httpstream "github.com/pcap-analyzer/internal/http"
+	"github.com/pcap-analyzer/internal/objstore"
+	"github.com/pcap-analyzer/internal/stats"
+	"github.com/pcap-analyzer/internal/stream"
+	"github.com/pcap-analyzer/internal/tlsdecrypt"
+)
+
+type (
+	// Request is an HTTP request reconstructed from a TCP stream.
+	Request = httpstream.Request
+	// Response is an HTTP response reconstructed from a TCP stream.
+	Response = httpstream.Response
+	// DNSMessage is a DNS query or response.
+	DNSMessage = dns.Message
+	// Parser decodes TCP connections that are neither HTTP nor TLS.
+	Parser = stream.Parser
+	// Stats counts what has been processed. Fields may be read while Run
+	// is in progress.
+	Stats = stats.Counters
+	// StatsSnapshot is a copy of Stats taken at one moment.
+	StatsSnapshot = stats.Snapshot
+	// TLSKeys holds the secrets of a TLS key log and servers' private keys.
+	TLSKeys = tlsdecrypt.Keys
+)
+
+// LoadKeyLog reads the secrets of NSS key log files, as SSLKEYLOGFILE has
+// browsers, curl and Go programs write them.
+func LoadKeyLog(paths ...string) (*TLSKeys, error) {
+	return tlsdecrypt.LoadKeyLog(paths...)
+}
+
+// StatsHandler is implemented by handlers that report processing
+// statistics. HandleStats is called once, after every other event.
+type StatsHandler interface {
+	HandleStats(s StatsSnapshot)
+}
+
+// Handler receives events while a capture is analyzed. Methods are called
+// concurrently and must be safe for concurrent use. Handlers that also
+// implement PacketHandler see every TCP and UDP packet.
+type Handler interface {
+	HandleRequest(req *Request)
+	HandleResponse(resp *Response)
+	HandleDNS(msg *DNSMessage)
+}
+
+// Options controls what the analyzer extracts from a capture.
+type Options struct {
+	// DNS enables DNS parsing. Resolved names are also used for request
+	// URLs that lack a Host header.
+	DNS bool
+	// Parsers are offered connections the HTTP parser declines.
+	Parsers []Parser
+	// MaxStreamMemory caps how much reassembled payload a single stream
+	// keeps in memory before spilling to a temporary file. Zero means no
+	// limit.
+	MaxStreamMemory int
+	// SpoolBodies keeps bodies longer than 1MB in temporary files while
+	// the handler runs, so it can stream them in full with BodyReader
+	// instead of seeing only the first 1MB.
+	SpoolBodies bool
+	// HashBodies sets Message.SHA256 on every message with a body, and
+	// HashMD5 Message.MD5. Together with SpoolBodies bodies over 1MB are
+	// hashed in full; otherwise only their first 1MB is.
+	HashBodies, HashMD5 bool
+	// RecordChunks lists the chunks of chunked bodies in Message.Chunks.
+	RecordChunks bool
+	// TLSKeys, if set, decrypts the TLS connections it holds the secrets
+	// of, so that the HTTP they carry is reported like any other.
+	TLSKeys *TLSKeys
+	// IdleTimeout closes connections that have seen no packets for this
+	// long, measured in capture time, releasing their memory before the end
+	// of the capture. Zero keeps connections open until the end.
+	IdleTimeout time.Duration
+	// FlushInterval is how often idle connections are looked for: in
+	// capture time when reading captures, and by the wall clock when
+	// capturing live. Zero uses IdleTimeout.
+	FlushInterval time.Duration
+	// Workers is the number of TCP reassembly shards. Connections are
+	// spread across shards by flow hash; zero uses one per CPU.
+	Workers int
+	// ParseWorkers caps how many streams are parsed at once. Streams are
+	// only scheduled when new payload arrives; zero uses a default of 64.
+	ParseWorkers int
+	// DNSCacheSize bounds how many resolved addresses are remembered,
+	// forgetting the oldest first. Zero means no limit.
+	DNSCacheSize int
+	// MaxBufferedPagesTotal and MaxBufferedPagesPerConnection bound the
+	// out-of-order segments each reassembly shard holds, in pages of about
+	// 2KB. When a limit is hit the oldest gap is skipped and its data lost.
+	// Zero means no limit.
+	MaxBufferedPagesTotal         int
+	MaxBufferedPagesPerConnection int
+	// MaxMemory is a memory budget in bytes. It becomes the Go runtime's
+	// soft memory limit for the run, and when usage nears it the
+	// connections idle longest are closed early and the DNS cache is
+	// shrunk, each time counted in Stats. Zero means no budget.
+	MaxMemory int64
+	// Checkpoint, if set, is a file progress is saved to every
+	// CheckpointInterval of wall-clock time. It is removed once the capture
+	// has been analyzed in full.
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	// Resume continues from Checkpoint if it was saved for the same
+	// capture, rather than starting from the beginning.
+	Resume bool
+	// Stats, if set, is updated as the capture is processed.
+	Stats *Stats
+}
+
+// Transaction pairs a request with its response. Either side may be nil
+// when only half of the exchange was captured.
+type Transaction struct {
+	Request  *Request
+	Response *Response
+}
+
+// Time returns when the transaction started.
+func (t Transaction) Time() time.Time {
+	if t.Request != nil {
+		return t.Request.Timestamp
+	}
+	return t.Response.Timestamp
+}
+
+// Results holds everything extracted from a capture.
+type Results struct {
+	Transactions []Transaction
+	DNS          []*DNSMessage
+}
+
+// AnalyzeFile reads the capture at path and returns its transactions and
+// DNS messages in capture order. It keeps everything in memory and is meant
+// for small captures; use Run to stream events from large ones.
+func AnalyzeFile(path string, opts Options) (Results, error) {
+	c := newCollector()
+	if err := Run(path, opts, c); err != nil {
+		return Results{}, err
+	}
+	return c.results(), nil
+}
+
+// Run reads the capture at path and passes every event to h. It returns
+// once all streams have been parsed. The file may also be a HAR file, whose
+// requests and responses are passed on as if they had been captured. An
+// s3:// or gs:// URL is streamed from object storage as RunReader would
+// read it, without checkpoints.
+func Run(path string, opts Options, h Handler) error {
+	if objstore.IsURL(path) {
+		obj, err := objstore.Open(path)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+		return RunReader(obj, opts, h)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	if isHAR(f) {
+		return runHAR(f, opts, h)
+	}
+
+	resume := resumeFrom(opts, path, info)
+	var src io.Reader = f
+	if resume != nil && resume.Offset >= 0 {
+		if src, err = resumeReader(f, resume); err != nil {
+			return err
+		}
+		opts.Stats.InputBytes.Add(resume.Offset - pcapHeaderLen)
+	}
+
+	r, err := newPacketReader(countingReader{r: src, n: &opts.Stats.InputBytes})
+	if err != nil {
+		return err
+	}
+	return analyze(r, opts, h, &captureFile{path: path, info: info, resume: resume}, nil)
+}
+
+// RunReader reads a pcap or pcapng stream from r, such as the output of
+// tcpdump -w - on standard input, or a HAR file, and passes every event to
+// h. It returns once r is exhausted and all streams have been parsed.
+// Checkpoints are not taken.
+func RunReader(r io.Reader, opts Options, h Handler) error {
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(sniffLen); har.Sniff(head) {
+		return runHAR(br, opts, h)
+	}
+	pr, err := newPacketReader(countingReader{r: br, n: &opts.Stats.InputBytes})
+	if err != nil {
+		return err
+	}
+	return analyze(pr, opts, h, nil, nil)
+}
+
+// captureFile is the file a run reads, which checkpoints are taken of.
+type captureFile struct {
+	path   string
+	info   os.FileInfo
+	resume *Checkpoint
+}
+
+// flushTicker returns a ticker for looking for idle connections by the
+// wall clock, as Live does, or nil if opts doesn't close idle connections.
+func flushTicker(opts Options) *time.Ticker {
+	if opts.IdleTimeout <= 0 {
+		return nil
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = opts.IdleTimeout
+	}
+	return time.NewTicker(interval)
+}
+
+// analyze reads every packet from r and passes the events to h. When the
+// packets come from a file, progress is checkpointed and resumed as opts
+// asks. Idle connections are looked for at each tick of ticks, or, if it
+// is nil, as capture time passes.
+func analyze(r packetReader, opts Options, h Handler, file *captureFile, ticks <-chan time.Time) error {
+	counters := opts.Stats
+	var resume *Checkpoint
+	checkpoint := ""
+	if file != nil {
+		resume, checkpoint = file.resume, opts.Checkpoint
+	}
+
+	dnsCache := dns.NewBoundedCache(opts.DNSCacheSize)
+
+	streamFactory := stream.NewFactory(dnsCache, h)
+	streamFactory.MaxBuffer = opts.MaxStreamMemory
+	streamFactory.Workers = opts.ParseWorkers
+	streamFactory.SpoolBodies = opts.SpoolBodies
+	streamFactory.HashBodies, streamFactory.HashMD5 = opts.HashBodies, opts.HashMD5
+	streamFactory.RecordChunks = opts.RecordChunks
+	streamFactory.Keys = opts.TLSKeys
+	streamFactory.Stats = counters
+	for _, p := range opts.Parsers {
+		streamFactory.Register(p)
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	shards := newShardSet(workers, streamFactory, reassembly.AssemblerOptions{
+		MaxBufferedPagesTotal:         opts.MaxBufferedPagesTotal,
+		MaxBufferedPagesPerConnection: opts.MaxBufferedPagesPerConnection,
+	})
+
+	decoder := newDecoder(r.LinkType())
+
+	packetHandler, _ := h.(PacketHandler)
+	// Classic pcap records follow a 24-byte file header, each with a
+	// 16-byte record header of its own
+	offset := int64(-1)
+	if _, ok := r.(*pcapgo.Reader); ok {
+		offset = 24
+	}
+	var number int64
+
+	if resume != nil {
+		for ip, name := range resume.DNS {
+			dnsCache.Add(ip, name)
+		}
+		streamFactory.Resume(resume.OpenFlows)
+		counters.Add(resume.Stats)
+		number = resume.Packets
+		if offset >= 0 {
+			offset = resume.Offset
+		} else {
+			for i := int64(0); i < resume.Packets; i++ {
+				if _, _, err := r.ReadPacketData(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	var governor *memoryGovernor
+	if opts.MaxMemory > 0 {
+		governor = newMemoryGovernor(opts.MaxMemory, opts.IdleTimeout)
+		defer governor.stop()
+	}
+
+	checkpointInterval := opts.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+	lastCheckpoint := time.Now()
+
+	flushInterval := opts.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = opts.IdleTimeout
+	}
+	var nextFlush time.Time
+
+	// A quiet interface has no packets to tell the time by, so live
+	// captures flush on ticks from the wall clock instead
+	stopTicks := func() {}
+	if ticks != nil && opts.IdleTimeout > 0 {
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for {
+				select {
+				case now := <-ticks:
+					shards.flushOlderThan(now.Add(-opts.IdleTimeout), nil)
+				case <-stop:
+					return
+				}
+			}
+		}()
+		var once sync.Once
+		stopTicks = func() {
+			once.Do(func() {
+				close(stop)
+				<-stopped
+			})
+		}
+		defer stopTicks()
+	}
+
+	var lastTime time.Time
+	for {
+		// Checkpoints are taken between packets, so that everything up to
+		// number has been handed to reassembly
+		if checkpoint != "" && number%1024 == 0 && time.Since(lastCheckpoint) >= checkpointInterval {
+			// Let the shards catch up so the open flows are current
+			shards.sync()
+			cp := &Checkpoint{
+				Capture:   abs(file.path),
+				Size:      file.info.Size(),
+				ModTime:   file.info.ModTime(),
+				Packets:   number,
+				Offset:    offset,
+				Time:      lastTime,
+				Stats:     counters.Snapshot(),
+				DNS:       dnsCache.Entries(),
+				OpenFlows: streamFactory.OpenFlows(),
+			}
+			if err := cp.save(checkpoint); err != nil {
+				return fmt.Errorf("saving checkpoint: %w", err)
+			}
+			lastCheckpoint = time.Now()
+		}
+
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		counters.Packets.Add(1)
+		counters.Bytes.Add(int64(len(data)))
+		number++
+		lastTime = ci.Timestamp
+		recordOffset := offset
+		if offset >= 0 {
+			offset += 16 + int64(len(data))
+		}
+
+		if governor != nil && number%memoryCheckInterval == 0 {
+			governor.check(ci.Timestamp, shards, dnsCache, counters)
+		}
+
+		// Capture timestamps drive idle flushing so an offline run closes
+		// the same connections however fast the file is read
+		if opts.IdleTimeout > 0 && ticks == nil {
+			now := ci.Timestamp
+			if nextFlush.IsZero() {
+				nextFlush = now.Add(flushInterval)
+			} else if !now.Before(nextFlush) {
+				shards.flushOlderThan(now.Add(-opts.IdleTimeout), nil)
+				nextFlush = now.Add(flushInterval)
+			}
+		}
+
+		packet, ok := decoder.decode(data)
+		if !ok {
+			counters.Skipped.Add(1)
+			continue
+		}
+		if packetHandler != nil {
+			packetHandler.HandlePacket(&Packet{
+				Number:      number,
+				Offset:      recordOffset,
+				CaptureInfo: ci,
+				Network:     packet.netFlow,
+				Transport:   packet.transport,
+				TCP:         packet.tcp,
+				Data:        data,
+				Payload:     packet.payload,
+			})
+		}
+
+		if packet.dns != nil && opts.DNS {
+			src, dst := packet.netFlow.Endpoints()
+			if msg := dns.Parse(packet.dns, ci.Timestamp, src.String(), dst.String(), dnsCache); msg != nil {
+				counters.DNSMessages.Add(1)
+				h.HandleDNS(msg)
+			} else {
+				counters.ParseErrors.Add(1)
+			}
+			continue
+		}
+		if packet.tcp == nil {
+			counters.Skipped.Add(1)
+			continue
+		}
+
+		// Get port information for filtering
+		srcPort := packet.tcp.SrcPort.String()
+		dstPort := packet.tcp.DstPort.String()
+
+		if isHTTPPort(srcPort) || isHTTPPort(dstPort) {
+			shards.assemble(packet.netFlow, packet.tcp, &stream.Context{CaptureInfo: ci, Number: number})
+		} else {
+			counters.Skipped.Add(1)
+		}
+	}
+
+	// Flush remaining data and wait for parsers to complete
+	stopTicks()
+	shards.close()
+	streamFactory.Wait()
+
+	if sh, ok := h.(StatsHandler); ok {
+		sh.HandleStats(counters.Snapshot())
+	}
+
+	if checkpoint != "" {
+		if err := os.Remove(checkpoint); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func abs(path string) string {
+	if a, err := filepath.Abs(path); err == nil {
+		return a
+	}
+	return path
+}
+
+// isHTTPPort reports whether a TCP stream using port might carry HTTP.
+// Obvious non-HTTP ports are skipped but unknown ports are let through so
+// content detection can decide.
+func isHTTPPort(port string) bool {
+	switch port {
+	case "80", "8080", "8000", "8888", "3000", "5000", "9000":
+		return true // Common HTTP ports
+	case "443", "8443":
+		return true // HTTPS ports (we'll filter TLS later)
+	case "22", "23", "25", "53", "110", "143", "993", "995":
+		return false // Definitely not HTTP
+	default:
+		return true // Unknown ports - let content detection decide
+	}
+}
+
+// collector is the Handler behind AnalyzeFile.
+type collector struct {
+	mu           sync.Mutex
+	transactions []Transaction
+	byRequest    map[*Request]int
+	dns          []*DNSMessage
+}
+
+func newCollector() *collector {
+	return &collector{byRequest: make(map[*Request]int)}
+}
+
+func (c *collector) HandleRequest(req *Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byRequest[req] = len(c.transactions)
+	c.transactions = append(c.transactions, Transaction{Request: req})
+}
+
+func (c *collector) HandleResponse(resp *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.byRequest[resp.Request]; ok && resp.Request != nil {
+		c.transactions[i].Response = resp
+		return
+	}
+	c.transactions = append(c.transactions, Transaction{Response: resp})
+}
+
+func (c *collector) HandleDNS(msg *DNSMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dns = append(c.dns, msg)
+}
+
+func (c *collector) results() Results {
+	sort.SliceStable(c.transactions, func(i, j int) bool {
+		return c.transactions[i].Time().Before(c.transactions[j].Time())
+	})
+	return Results{Transactions: c.transactions, DNS: c.dns}
+}
@@ -0,0 +1,277 @@
+package analyzer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+const (
+	testClient = "10.0.0.1:40000"
+	testServer = "10.0.0.2:80"
+)
+
+// runCapture writes b to a file and runs the analyzer over it.
+func runCapture(t *testing.T, b *testutil.Builder, opts Options) *recorder {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var r recorder
+	if err := Run(path, opts, &r); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+func TestRun(t *testing.T) {
+	const (
+		request  = "POST /submit HTTP/1.1\r\nHost: example.com\r\nContent-Length: 26\r\n\r\nabcdefghijklmnopqrstuvwxyz"
+		response = "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nhello, world"
+	)
+	// exchange has the client send its request in 8-byte segments, calling
+	// mangle once they have all been added with the index of the first.
+	exchange := func(mangle func(b *testutil.Builder, first int)) func(b *testutil.Builder) {
+		return func(b *testutil.Builder) {
+			c := b.TCPConn(testClient, testServer).Handshake()
+			c.SegmentSize = 8
+			first := b.Len()
+			c.ClientSend([]byte(request))
+			if mangle != nil {
+				mangle(b, first)
+			}
+			c.ServerSend([]byte(response))
+			c.Close()
+		}
+	}
+	post := []string{"POST http://example.com/submit abcdefghijklmnopqrstuvwxyz"}
+	ok := []string{"200 http://example.com/submit hello, world"}
+
+	tests := []struct {
+		name  string
+		build func(b *testutil.Builder)
+		reqs  []string
+		resps []string
+		dns   []string
+	}{
+		{
+			name:  "segmented",
+			build: exchange(nil),
+			reqs:  post,
+			resps: ok,
+		},
+		{
+			name: "retransmitted segment",
+			build: exchange(func(b *testutil.Builder, first int) {
+				b.Retransmit(first + 2)
+			}),
+			reqs:  post,
+			resps: ok,
+		},
+		{
+			name: "out-of-order segments",
+			build: exchange(func(b *testutil.Builder, first int) {
+				b.Swap(first+1, first+3)
+			}),
+			reqs:  post,
+			resps: ok,
+		},
+		{
+			name: "out-of-order header and body",
+			build: exchange(func(b *testutil.Builder, first int) {
+				b.Swap(first+4, first+8)
+			}),
+			reqs:  post,
+			resps: ok,
+		},
+		{
+			name: "capture starts mid-connection",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer)
+				c.ClientSend([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"))
+				c.ClientSend([]byte("GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+			},
+			reqs:  []string{"GET http://example.com/a", "GET http://example.com/b"},
+			resps: []string{"200 http://example.com/a a", "200 http://example.com/b b"},
+		},
+		{
+			name: "pipelined, HEAD and 100-continue",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.ClientSend([]byte("HEAD /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"))
+				c.ClientSend([]byte("PUT /c HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 1\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				c.ClientSend([]byte("c"))
+				c.ServerSend([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"))
+				c.Close()
+			},
+			reqs: []string{
+				"GET http://example.com/b",
+				"HEAD http://example.com/a",
+				"PUT http://example.com/c c",
+			},
+			resps: []string{
+				"200 http://example.com/a",
+				"200 http://example.com/b b",
+				"201 http://example.com/c",
+			},
+		},
+		{
+			name: "chunked with trailer",
+			build: func(b *testutil.Builder) {
+				c := b.TCPConn(testClient, testServer).Handshake()
+				c.SegmentSize = 6
+				c.ClientSend([]byte("GET /chunks HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				c.ServerSend([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+					"3\r\nabc\r\n4\r\ndefg\r\n0\r\nX-Digest: 1\r\n\r\n"))
+				c.Close()
+			},
+			reqs:  []string{"GET http://example.com/chunks"},
+			resps: []string{"200 http://example.com/chunks abcdefg X-Digest=1"},
+		},
+		{
+			name: "DNS names the server",
+			build: func(b *testutil.Builder) {
+				b.DNSQuery("10.0.0.1:53000", "10.0.0.53:53", "api.example.com")
+				b.DNSResponse("10.0.0.1:53000", "10.0.0.53:53", "api.example.com", "10.0.0.2")
+				b.DNSNXDomain("10.0.0.1:53001", "10.0.0.53:53", "missing.example.com")
+				b.HTTPExchange(testClient, testServer,
+					"GET /v1 HTTP/1.0\r\n\r\n",
+					"HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nv1")
+			},
+			reqs:  []string{"GET http://api.example.com/v1"},
+			resps: []string{"200 http://api.example.com/v1 v1"},
+			dns: []string{
+				"query api.example.com.",
+				"response api.example.com. NOERROR 10.0.0.2",
+				"response missing.example.com. NXDOMAIN",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testutil.NewBuilder()
+			tt.build(b)
+			stats := &Stats{}
+			r := runCapture(t, b, Options{DNS: true, Stats: stats})
+			if n := stats.ParseErrors.Load(); n != 0 {
+				t.Errorf("%d parse errors", n)
+			}
+
+			var reqs, resps, msgs []string
+			for _, req := range r.requests {
+				s := req.Method + " " + req.URL
+				if len(req.Body) > 0 {
+					s += " " + string(req.Body)
+				}
+				reqs = append(reqs, s)
+			}
+			for _, resp := range r.resps {
+				s := fmt.Sprint(resp.StatusCode)
+				if resp.Request != nil {
+					s += " " + resp.Request.URL
+				}
+				if len(resp.Body) > 0 {
+					s += " " + string(resp.Body)
+				}
+				for k := range resp.Trailer {
+					s += " " + k + "=" + resp.Trailer.Get(k)
+				}
+				resps = append(resps, s)
+			}
+			for _, msg := range r.dns {
+				s := "query " + msg.Question
+				if msg.Response {
+					s = "response " + msg.Question + " " + msg.Rcode
+					for _, a := range msg.Answers {
+						s += " " + a.Value
+					}
+				}
+				msgs = append(msgs, s)
+			}
+			// Connections are parsed concurrently, so only the set of
+			// messages is checked
+			for _, l := range [][]string{reqs, resps, msgs} {
+				sort.Strings(l)
+			}
+			check := func(what string, got, want []string) {
+				if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+					t.Errorf("%s:\n%s\nwant:\n%s", what, g, w)
+				}
+			}
+			check("requests", reqs, tt.reqs)
+			check("responses", resps, tt.resps)
+			check("DNS messages", msgs, tt.dns)
+		})
+	}
+}
+
+// heldReader reads packets like a live capture that then goes quiet: once
+// they are read, it blocks until release is closed.
+type heldReader struct {
+	packets []testutil.Packet
+	release chan struct{}
+}
+
+func (r *heldReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(r.packets) == 0 {
+		<-r.release
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	p := r.packets[0]
+	r.packets = r.packets[1:]
+	return p.Data, p.CaptureInfo, nil
+}
+
+func (r *heldReader) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func TestAnalyzeFlushTicks(t *testing.T) {
+	b := testutil.NewBuilder()
+	c := b.TCPConn(testClient, testServer).Handshake()
+	c.ClientSend([]byte("GET /quiet HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	// The body runs to the end of the connection, so the response is
+	// only complete once the connection is closed
+	c.ServerSend([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nok"))
+
+	r := &heldReader{packets: b.Packets(), release: make(chan struct{})}
+	defer close(r.release)
+	ticks := make(chan time.Time)
+	var rec recorder
+	go analyze(r, Options{IdleTimeout: time.Minute, Stats: &Stats{}}, &rec, nil, ticks)
+
+	responses := func() []*Response {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return append([]*Response(nil), rec.resps...)
+	}
+	// Nothing arrives to show that time has passed, so only a tick can
+	// close the connection
+	time.Sleep(50 * time.Millisecond)
+	if n := len(responses()); n != 0 {
+		t.Fatalf("got %d responses before the connection went idle", n)
+	}
+	ticks <- b.Now().Add(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); len(responses()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection was never closed")
+		}
+	}
+	if body := string(responses()[0].Body); body != "ok" {
+		t.Errorf("got body %q, want %q", body, "ok")
+	}
+}
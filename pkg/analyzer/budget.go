@@ -0,0 +1,83 @@
+package analyzer
+
+import (
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+
+	"github.com/pcap-analyzer/internal/dns"
+)
+
+const (
+	// shedAbove and relaxBelow are the fractions of Options.MaxMemory at
+	// which shedding starts and at which it is considered over.
+	shedAbove  = 0.9
+	relaxBelow = 0.75
+	// minShedWindow is the shortest idle time for which shedding closes
+	// connections.
+	minShedWindow = time.Second
+	// memoryCheckInterval is how many packets are read between checks of
+	// memory use.
+	memoryCheckInterval = 4096
+)
+
+// memoryGovernor keeps a run under Options.MaxMemory. Beyond setting the
+// Go runtime's soft memory limit, it sheds state when usage nears the
+// budget: connections idle longest are closed early and the DNS cache is
+// halved, instead of the process being killed partway through.
+type memoryGovernor struct {
+	limit   float64
+	initial time.Duration
+	// window is how long a connection must have been idle to be closed
+	// when shedding. It halves each time shedding isn't enough.
+	window  time.Duration
+	samples []metrics.Sample
+	restore int64
+}
+
+func newMemoryGovernor(limit int64, idleTimeout time.Duration) *memoryGovernor {
+	initial := idleTimeout
+	if initial <= 0 {
+		initial = time.Minute
+	}
+	return &memoryGovernor{
+		limit:   float64(limit),
+		initial: initial,
+		window:  initial,
+		samples: []metrics.Sample{
+			{Name: "/memory/classes/total:bytes"},
+			{Name: "/memory/classes/heap/released:bytes"},
+		},
+		restore: debug.SetMemoryLimit(limit),
+	}
+}
+
+// stop restores the runtime memory limit in place before the run.
+func (g *memoryGovernor) stop() {
+	debug.SetMemoryLimit(g.restore)
+}
+
+// inUse returns the memory the runtime holds from the OS.
+func (g *memoryGovernor) inUse() float64 {
+	metrics.Read(g.samples)
+	return float64(g.samples[0].Value.Uint64() - g.samples[1].Value.Uint64())
+}
+
+// check sheds state if memory use is near the budget. now is the capture
+// time of the latest packet.
+func (g *memoryGovernor) check(now time.Time, shards *shardSet, cache *dns.Cache, counters *Stats) {
+	used := g.inUse()
+	if used < g.limit*relaxBelow {
+		g.window = g.initial
+	}
+	if used < g.limit*shedAbove {
+		return
+	}
+
+	counters.Shed.Add(1)
+	shards.flushOlderThan(now.Add(-g.window), &counters.ShedConnections)
+	if g.window > minShedWindow {
+		g.window /= 2
+	}
+	counters.ShedDNSEntries.Add(int64(cache.Trim(cache.Size() / 2)))
+}
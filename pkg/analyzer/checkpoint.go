@@ -0,0 +1,120 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pcap-analyzer/internal/stats"
+)
+
+// defaultCheckpointInterval is how often progress is saved when
+// Options.CheckpointInterval is zero.
+const defaultCheckpointInterval = time.Minute
+
+// pcapHeaderLen is the length of a classic pcap file header.
+const pcapHeaderLen = 24
+
+// Checkpoint is the progress of a run, saved periodically so that an
+// interrupted analysis of a large capture can resume instead of starting
+// over.
+//
+// Reassembly state isn't saved: connections open at the checkpoint resume
+// mid-stream, so messages they were in the middle of are lost, and events
+// produced between the checkpoint and the interruption are produced again.
+type Checkpoint struct {
+	// Capture, Size and ModTime identify the capture the checkpoint was
+	// taken for.
+	Capture string    `json:"capture"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Packets is how many packets had been read. Offset is where the next
+	// record starts in a classic pcap file; pcapng captures, for which it
+	// is -1, are resumed by skipping Packets packets.
+	Packets int64 `json:"packets"`
+	Offset  int64 `json:"offset"`
+	// Time is the capture time of the last packet read.
+	Time time.Time `json:"time"`
+	// Stats are the counters, other than InputBytes.
+	Stats stats.Snapshot `json:"stats"`
+	// DNS is the DNS cache, mapping addresses to names.
+	DNS map[string]string `json:"dns,omitempty"`
+	// OpenFlows are the connections still being reassembled, as keys from
+	// stream.FlowKey.
+	OpenFlows []string `json:"open_flows,omitempty"`
+}
+
+// LoadCheckpoint reads a checkpoint saved during an earlier run.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint to path, replacing any earlier one only once
+// it has been written in full.
+func (cp *Checkpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// matches reports whether the checkpoint was taken for the capture at path
+// as it is now.
+func (cp *Checkpoint) matches(path string, info os.FileInfo) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return cp.Capture == abs && cp.Size == info.Size() && cp.ModTime.Equal(info.ModTime())
+}
+
+// resumeFrom returns the checkpoint to resume from, or nil to start from
+// the beginning because there is none for this capture.
+func resumeFrom(opts Options, path string, info os.FileInfo) *Checkpoint {
+	if !opts.Resume || opts.Checkpoint == "" {
+		return nil
+	}
+	cp, err := LoadCheckpoint(opts.Checkpoint)
+	if err != nil || !cp.matches(path, info) {
+		return nil
+	}
+	return cp
+}
+
+// resumeReader returns a reader over f that skips straight to the record
+// at cp.Offset, keeping the file header the pcap reader expects.
+func resumeReader(f *os.File, cp *Checkpoint) (io.Reader, error) {
+	header := make([]byte, pcapHeaderLen)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(header), f), nil
+}
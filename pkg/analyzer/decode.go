@@ -0,0 +1,146 @@
+package analyzer
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// decodedPacket holds the parts of a packet the analyzer uses.
+type decodedPacket struct {
+	netFlow, transport gopacket.Flow
+	// tcp is a copy owned by the caller, safe to hand to another goroutine.
+	// It is nil for UDP packets.
+	tcp *layers.TCP
+	// payload is the segment's or datagram's payload.
+	payload []byte
+	// dns is the UDP payload of a packet to or from the DNS port.
+	dns []byte
+}
+
+// decoder extracts TCP segments and UDP datagrams from raw packet data. For
+// common link types it uses DecodingLayerParsers, which reuse their layer
+// structs and skip everything above TCP and UDP; other link types fall back
+// to full packet decoding.
+type decoder struct {
+	link layers.LinkType
+	// parser handles the link type; parser6 is used instead for raw IP
+	// captures whose packets are IPv6.
+	parser, parser6 *gopacket.DecodingLayerParser
+	decoded         []gopacket.LayerType
+
+	eth     layers.Ethernet
+	sll     layers.LinuxSLL
+	loop    layers.Loopback
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	payload gopacket.Payload
+}
+
+func newDecoder(link layers.LinkType) *decoder {
+	d := &decoder{link: link}
+
+	var first gopacket.LayerType
+	switch link {
+	case layers.LinkTypeEthernet:
+		first = layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		first = layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		first = layers.LayerTypeLoopback
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+	default:
+		return d
+	}
+
+	decoders := []gopacket.DecodingLayer{
+		&d.eth, &d.sll, &d.loop, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload,
+	}
+	d.parser = gopacket.NewDecodingLayerParser(first, decoders...)
+	d.parser.IgnoreUnsupported = true
+	if link == layers.LinkTypeRaw {
+		d.parser6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, decoders...)
+		d.parser6.IgnoreUnsupported = true
+	}
+	return d
+}
+
+// decode returns the TCP segment or UDP datagram carried by data, along
+// with the payload of DNS datagrams. The boolean is false for packets
+// carrying neither.
+func (d *decoder) decode(data []byte) (decodedPacket, bool) {
+	if d.parser == nil {
+		return d.decodeSlow(data)
+	}
+
+	parser := d.parser
+	if d.parser6 != nil && len(data) > 0 && data[0]>>4 == 6 {
+		parser = d.parser6
+	}
+	if err := parser.DecodeLayers(data, &d.decoded); err != nil {
+		return decodedPacket{}, false
+	}
+
+	var p decodedPacket
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			p.netFlow = d.ip4.NetworkFlow()
+		case layers.LayerTypeIPv6:
+			p.netFlow = d.ip6.NetworkFlow()
+		case layers.LayerTypeTCP:
+			p.tcp = copyTCP(&d.tcp)
+			p.transport = d.tcp.TransportFlow()
+			p.payload = d.tcp.Payload
+			return p, true
+		case layers.LayerTypeUDP:
+			p.transport = d.udp.TransportFlow()
+			p.payload = d.udp.Payload
+			if d.udp.NextLayerType() == layers.LayerTypeDNS {
+				p.dns = d.udp.Payload
+			}
+			return p, true
+		}
+	}
+	return p, false
+}
+
+// decodeSlow decodes data with the link type's full decoder.
+func (d *decoder) decodeSlow(data []byte) (decodedPacket, bool) {
+	packet := gopacket.NewPacket(data, d.link, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	net := packet.NetworkLayer()
+	if net == nil {
+		return decodedPacket{}, false
+	}
+	p := decodedPacket{netFlow: net.NetworkFlow()}
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		p.tcp = tcp
+		p.transport = tcp.TransportFlow()
+		p.payload = tcp.Payload
+		return p, true
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		p.transport = udp.TransportFlow()
+		p.payload = udp.Payload
+		if udp.NextLayerType() == layers.LayerTypeDNS {
+			p.dns = udp.Payload
+		}
+		return p, true
+	}
+	return decodedPacket{}, false
+}
+
+// copyTCP copies a segment out of the parser's reused layer. Slices into
+// the packet data are shared, which is safe because every packet is read
+// into its own buffer.
+func copyTCP(tcp *layers.TCP) *layers.TCP {
+	c := new(layers.TCP)
+	*c = *tcp
+	c.Options = append([]layers.TCPOption(nil), tcp.Options...)
+	return c
+}
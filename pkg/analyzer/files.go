@@ -0,0 +1,228 @@
+package analyzer
+
+import (
+	"container/heap"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// mergeBuffer is how many events each capture can get ahead of the merge.
+const mergeBuffer = 1024
+
+// RunFiles analyzes several captures, up to parallel at a time, and passes
+// their events to h merged in timestamp order: the events of each capture
+// come in the order Run would pass them, and those of different captures
+// are interleaved by which capture's next event is earliest. Each file is
+// analyzed on its own, so a connection split across rotated files is seen
+// as two. A capture that gets ahead of the others waits for them, giving
+// up its turn to one that hasn't started, so memory stays bounded however
+// many captures there are. Zero parallel means one file per CPU.
+func RunFiles(paths []string, parallel int, opts Options, h Handler) error {
+	if len(paths) == 1 {
+		return Run(paths[0], opts, h)
+	}
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+
+	sem := make(chan struct{}, parallel)
+	logs := make([]*eventLog, len(paths))
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		logs[i] = &eventLog{
+			capture: i,
+			events:  make(chan event, mergeBuffer),
+			sem:     sem,
+			wait:    opts.SpoolBodies,
+		}
+		go func(i int, path string) {
+			l := logs[i]
+			defer close(l.events)
+			l.acquire()
+			defer l.release()
+			fileOpts := opts
+			if opts.Checkpoint != "" {
+				// Each file keeps its own progress
+				fileOpts.Checkpoint = fmt.Sprintf("%s.%d", opts.Checkpoint, i)
+			}
+			errs[i] = Run(path, fileOpts, l)
+		}(i, path)
+	}
+
+	mergeEvents(logs, h)
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if sh, ok := h.(StatsHandler); ok {
+		sh.HandleStats(opts.Stats.Snapshot())
+	}
+	return nil
+}
+
+// event is one handler call passed on to the merge.
+type event struct {
+	ts     time.Time
+	req    *Request
+	resp   *Response
+	dns    *DNSMessage
+	packet *Packet
+	// done, if set, is closed once the event has been delivered.
+	done chan struct{}
+}
+
+func (e event) deliver(h Handler) {
+	switch {
+	case e.packet != nil:
+		if ph, ok := h.(PacketHandler); ok {
+			ph.HandlePacket(e.packet)
+		}
+	case e.req != nil:
+		h.HandleRequest(e.req)
+	case e.resp != nil:
+		h.HandleResponse(e.resp)
+	default:
+		h.HandleDNS(e.dns)
+	}
+	if e.done != nil {
+		close(e.done)
+	}
+}
+
+// eventLog passes the events of one capture on to the merge, marking its
+// messages and packets with the capture's position. The capture holds one
+// of the parallel slots in sem while it is analyzed, and gives it up
+// whenever it has to wait for the merge to catch up.
+type eventLog struct {
+	capture int
+	events  chan event
+	sem     chan struct{}
+	// wait has requests and responses wait until they are delivered, as
+	// the bodies spooled for them are removed when the handler returns.
+	wait bool
+
+	mu      sync.Mutex
+	waiting int
+}
+
+func (l *eventLog) acquire() { l.sem <- struct{}{} }
+
+func (l *eventLog) release() { <-l.sem }
+
+// add passes e on to the merge, waiting until it is delivered if asked to.
+func (l *eventLog) add(e event, wait bool) {
+	if wait {
+		e.done = make(chan struct{})
+	}
+	select {
+	case l.events <- e:
+	default:
+		l.idle(func() { l.events <- e })
+	}
+	if wait {
+		select {
+		case <-e.done:
+		default:
+			l.idle(func() { <-e.done })
+		}
+	}
+}
+
+// idle runs fn, which waits for the merge, with the capture's slot given
+// up for as long as any of its goroutines is waiting.
+func (l *eventLog) idle(fn func()) {
+	l.mu.Lock()
+	if l.waiting++; l.waiting == 1 {
+		l.release()
+	}
+	l.mu.Unlock()
+	fn()
+	l.mu.Lock()
+	if l.waiting--; l.waiting == 0 {
+		l.acquire()
+	}
+	l.mu.Unlock()
+}
+
+func (l *eventLog) HandleRequest(req *Request) {
+	req.Capture = l.capture
+	l.add(event{ts: req.Timestamp, req: req}, l.wait)
+}
+
+func (l *eventLog) HandleResponse(resp *Response) {
+	resp.Capture = l.capture
+	l.add(event{ts: resp.Timestamp, resp: resp}, l.wait)
+}
+
+func (l *eventLog) HandleDNS(msg *DNSMessage) {
+	l.add(event{ts: msg.Timestamp, dns: msg}, false)
+}
+
+// HandlePacket passes on a copy of p. Run reads every packet into its own
+// buffer and decodes it into its own layers, so the copy can keep sharing
+// them once the call returns.
+func (l *eventLog) HandlePacket(p *Packet) {
+	c := *p
+	c.Capture = l.capture
+	l.add(event{ts: p.CaptureInfo.Timestamp, packet: &c}, false)
+}
+
+// mergeEvents delivers the events of all the logs, always taking the
+// earliest of the next event of each, until every log has been closed.
+// Ties go to the earlier file.
+func mergeEvents(logs []*eventLog, h Handler) {
+	var q mergeQueue
+	for i, l := range logs {
+		if e, ok := <-l.events; ok {
+			q = append(q, mergeCursor{file: i, next: e, events: l.events})
+		}
+	}
+	heap.Init(&q)
+	for len(q) > 0 {
+		c := &q[0]
+		c.next.deliver(h)
+		if e, ok := <-c.events; ok {
+			c.next = e
+			heap.Fix(&q, 0)
+		} else {
+			heap.Pop(&q)
+		}
+	}
+}
+
+// mergeCursor is the next event of one file and where the rest come from.
+type mergeCursor struct {
+	file   int
+	next   event
+	events <-chan event
+}
+
+// mergeQueue is a heap of cursors ordered by their next event.
+type mergeQueue []mergeCursor
+
+func (q mergeQueue) Len() int { return len(q) }
+
+func (q mergeQueue) Less(i, j int) bool {
+	ti, tj := q[i].next.ts, q[j].next.ts
+	if ti.Equal(tj) {
+		return q[i].file < q[j].file
+	}
+	return ti.Before(tj)
+}
+
+func (q mergeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *mergeQueue) Push(x any) { *q = append(*q, x.(mergeCursor)) }
+
+func (q *mergeQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
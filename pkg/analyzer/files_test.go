@@ -0,0 +1,150 @@
+package analyzer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pcap-analyzer/pkg/testutil"
+)
+
+// recorder keeps the events it is handed, in the order they came.
+type recorder struct {
+	mu       sync.Mutex
+	packets  []time.Time
+	requests []*Request
+	resps    []*Response
+	dns      []*DNSMessage
+}
+
+func (r *recorder) HandleRequest(req *Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+func (r *recorder) HandleResponse(resp *Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resps = append(r.resps, resp)
+}
+
+func (r *recorder) HandleDNS(msg *DNSMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = append(r.dns, msg)
+}
+
+func (r *recorder) HandlePacket(p *Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, p.CaptureInfo.Timestamp)
+}
+
+// writeCaptures writes n captures of one exchange each, their clocks
+// staggered so the files' packets interleave, and returns their paths and
+// how many packets each holds.
+func writeCaptures(t *testing.T, n int) ([]string, int) {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	packets := 0
+	for i := 0; i < n; i++ {
+		b := testutil.NewBuilder()
+		b.Advance(time.Duration(i) * 300 * time.Microsecond)
+		b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80",
+			"GET /file HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		b.DNSQuery("10.0.0.1:53000", "10.0.0.53:53", "example.com")
+		path := filepath.Join(dir, "capture"+string(rune('a'+i))+".pcap")
+		if err := b.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		packets = b.Len()
+	}
+	return paths, packets
+}
+
+func TestRunFilesPackets(t *testing.T) {
+	paths, perFile := writeCaptures(t, 3)
+	var r recorder
+	if err := RunFiles(paths, 2, Options{DNS: true}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.packets), 3*perFile; got != want {
+		t.Errorf("got %d packets, want %d", got, want)
+	}
+	if len(r.requests) != 3 || len(r.resps) != 3 || len(r.dns) != 3 {
+		t.Errorf("got %d requests, %d responses and %d DNS messages, want 3 of each",
+			len(r.requests), len(r.resps), len(r.dns))
+	}
+	// Packets come from each capture in order, so merged they stay in order
+	for i := 1; i < len(r.packets); i++ {
+		if r.packets[i].Before(r.packets[i-1]) {
+			t.Fatalf("packet %d at %v came after one at %v", i, r.packets[i], r.packets[i-1])
+		}
+	}
+}
+
+func TestRunFilesOneAtATime(t *testing.T) {
+	// Overlapping captures analyzed one at a time still have to be merged
+	paths, perFile := writeCaptures(t, 4)
+	var r recorder
+	if err := RunFiles(paths, 1, Options{DNS: true}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.packets), 4*perFile; got != want {
+		t.Errorf("got %d packets, want %d", got, want)
+	}
+	if len(r.requests) != 4 || len(r.resps) != 4 {
+		t.Errorf("got %d requests and %d responses, want 4 of each", len(r.requests), len(r.resps))
+	}
+}
+
+// bodyReader reads the whole of every response body while it is handled.
+type bodyReader struct {
+	recorder
+	sizes []int64
+}
+
+func (b *bodyReader) HandleResponse(resp *Response) {
+	n, _ := io.Copy(io.Discard, resp.BodyReader())
+	b.mu.Lock()
+	b.sizes = append(b.sizes, n)
+	b.mu.Unlock()
+}
+
+func TestRunFilesSpooledBodies(t *testing.T) {
+	const size = 3 << 20
+	body := strings.Repeat("x", size)
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 2; i++ {
+		b := testutil.NewBuilder()
+		b.HTTPExchange("10.0.0.1:40000", "10.0.0.2:80",
+			"GET /big HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", size, body))
+		path := filepath.Join(dir, fmt.Sprintf("big%d.pcap", i))
+		if err := b.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	var b bodyReader
+	if err := RunFiles(paths, 2, Options{SpoolBodies: true}, &b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.sizes) != 2 {
+		t.Fatalf("got %d responses, want 2", len(b.sizes))
+	}
+	for _, n := range b.sizes {
+		if n != size {
+			t.Errorf("read %d bytes of a %d byte body", n, size)
+		}
+	}
+}
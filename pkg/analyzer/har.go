@@ -0,0 +1,52 @@
+package analyzer
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pcap-analyzer/internal/har"
+)
+
+// sniffLen is how much of a file is looked at to tell a HAR file from a
+// capture.
+const sniffLen = 64
+
+// isHAR reports whether f holds a HAR file rather than a capture.
+func isHAR(f *os.File) bool {
+	head := make([]byte, sniffLen)
+	n, _ := f.ReadAt(head, 0)
+	return har.Sniff(head[:n])
+}
+
+// runHAR passes the requests and responses of a HAR file to h in timestamp
+// order, as Run would for a capture of the same traffic. There are no
+// packets or DNS messages, and checkpoints are not taken.
+func runHAR(r io.Reader, opts Options, h Handler) error {
+	entries, err := har.Read(countingReader{r: r, n: &opts.Stats.InputBytes}, har.Options{
+		HashBodies: opts.HashBodies,
+		HashMD5:    opts.HashMD5,
+	})
+	if err != nil {
+		return err
+	}
+	var events []event
+	for _, e := range entries {
+		opts.Stats.Requests.Add(1)
+		events = append(events, event{ts: e.Request.Timestamp, req: e.Request})
+		if e.Response != nil {
+			opts.Stats.Responses.Add(1)
+			events = append(events, event{ts: e.Response.Timestamp, resp: e.Response})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ts.Before(events[j].ts)
+	})
+	for _, e := range events {
+		e.deliver(h)
+	}
+	if sh, ok := h.(StatsHandler); ok {
+		sh.HandleStats(opts.Stats.Snapshot())
+	}
+	return nil
+}
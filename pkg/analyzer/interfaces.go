@@ -0,0 +1,17 @@
+package analyzer
+
+// Interface is a network interface that Live can capture from.
+type Interface struct {
+	// Name is what Live is given, such as "eth0", or "\Device\NPF_{...}"
+	// on Windows.
+	Name string
+	// FriendlyName is the name the system shows, such as "Wi-Fi" on
+	// Windows, which Live also takes. It is Name where there is no other.
+	FriendlyName string
+	// Description is the adapter's description, where there is one.
+	Description string
+	// Addresses are the interface's IP addresses in CIDR notation.
+	Addresses []string
+	Up        bool
+	Loopback  bool
+}
@@ -0,0 +1,73 @@
+package analyzer
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// liveSnapLen is how much of each frame is captured, enough for any frame
+// on interfaces with offloading that hand up more than the MTU.
+const liveSnapLen = 65536
+
+// Live captures packets on the network interface iface and passes every
+// event to h. It runs until reading from the interface fails, which needs
+// root or CAP_NET_RAW to begin with. Set opts.IdleTimeout so connections
+// that go quiet are parsed and released rather than held forever.
+func Live(iface string, opts Options, h Handler) error {
+	handle, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetCaptureLength(liveSnapLen); err != nil {
+		return err
+	}
+	if err := handle.SetPromiscuous(true); err != nil {
+		return err
+	}
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	var ticks <-chan time.Time
+	if t := flushTicker(opts); t != nil {
+		defer t.Stop()
+		ticks = t.C
+	}
+	return analyze(liveReader{handle}, opts, h, nil, ticks)
+}
+
+// liveReader reads Ethernet frames from a raw socket.
+type liveReader struct {
+	*pcapgo.EthernetHandle
+}
+
+func (liveReader) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// Interfaces lists the network interfaces that Live can capture from.
+func Interfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var r []Interface
+	for _, ifc := range ifaces {
+		i := Interface{
+			Name:         ifc.Name,
+			FriendlyName: ifc.Name,
+			Up:           ifc.Flags&net.FlagUp != 0,
+			Loopback:     ifc.Flags&net.FlagLoopback != 0,
+		}
+		if addrs, err := ifc.Addrs(); err == nil {
+			for _, a := range addrs {
+				i.Addresses = append(i.Addresses, a.String())
+			}
+		}
+		r = append(r, i)
+	}
+	return r, nil
+}
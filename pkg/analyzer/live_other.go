@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+package analyzer
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Live captures packets on the network interface iface and passes every
+// event to h. It is only supported on Linux and Windows.
+func Live(iface string, opts Options, h Handler) error {
+	return fmt.Errorf("live capture is not supported on %s", runtime.GOOS)
+}
+
+// Interfaces lists the network interfaces that Live can capture from.
+func Interfaces() ([]Interface, error) {
+	return nil, fmt.Errorf("live capture is not supported on %s", runtime.GOOS)
+}
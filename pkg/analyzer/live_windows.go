@@ -0,0 +1,152 @@
+package analyzer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/windows"
+)
+
+// liveSnapLen is how much of each frame is captured, enough for any frame
+// on interfaces with offloading that hand up more than the MTU.
+const liveSnapLen = 65536
+
+// npcapHint is added to errors loading wpcap.dll.
+const npcapHint = "live capture needs Npcap, from https://npcap.com"
+
+// Live captures packets on the network interface iface and passes every
+// event to h. It runs until reading from the interface fails. On Windows
+// it captures through Npcap, and iface may be the device name, its GUID,
+// or the friendly name shown by Interfaces, such as "Ethernet". Set
+// opts.IdleTimeout so connections that go quiet are parsed and released
+// rather than held forever.
+func Live(iface string, opts Options, h Handler) error {
+	if err := pcap.LoadWinPCAP(); err != nil {
+		return fmt.Errorf("%s: %w", npcapHint, err)
+	}
+	device, err := findDevice(iface)
+	if err != nil {
+		return err
+	}
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(liveSnapLen); err != nil {
+		return err
+	}
+	if err := inactive.SetPromisc(true); err != nil {
+		return err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return err
+	}
+	// Npcap otherwise holds packets back until its buffer fills, which on
+	// a quiet interface delays events indefinitely
+	if err := inactive.SetImmediateMode(true); err != nil {
+		return err
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if opts.Stats == nil {
+		opts.Stats = &Stats{}
+	}
+	var ticks <-chan time.Time
+	if t := flushTicker(opts); t != nil {
+		defer t.Stop()
+		ticks = t.C
+	}
+	return analyze(handle, opts, h, nil, ticks)
+}
+
+// findDevice returns the Npcap device of the interface named iface.
+func findDevice(iface string) (string, error) {
+	ifaces, err := Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, i := range ifaces {
+		if strings.EqualFold(i.Name, iface) || strings.EqualFold(i.FriendlyName, iface) ||
+			strings.EqualFold(strings.TrimPrefix(i.Name, `\Device\NPF_`), iface) {
+			return i.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no interface %q; -list-interfaces shows them", iface)
+}
+
+// Interfaces lists the network interfaces that Live can capture from.
+// Npcap names them by GUID, so the friendly names Windows shows are
+// looked up from the adapters.
+func Interfaces() ([]Interface, error) {
+	if err := pcap.LoadWinPCAP(); err != nil {
+		return nil, fmt.Errorf("%s: %w", npcapHint, err)
+	}
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	friendly := adapterNames()
+	var r []Interface
+	for _, d := range devs {
+		i := Interface{
+			Name:        d.Name,
+			Description: d.Description,
+			Up:          d.Flags&pcapIfUp != 0,
+			Loopback:    d.Flags&pcapIfLoopback != 0,
+		}
+		i.FriendlyName = friendly[strings.TrimPrefix(d.Name, `\Device\NPF_`)]
+		if i.FriendlyName == "" {
+			i.FriendlyName = d.Name
+		}
+		for _, a := range d.Addresses {
+			if ones, bits := a.Netmask.Size(); bits > 0 {
+				i.Addresses = append(i.Addresses, fmt.Sprintf("%s/%d", a.IP, ones))
+			} else {
+				i.Addresses = append(i.Addresses, a.IP.String())
+			}
+		}
+		r = append(r, i)
+	}
+	return r, nil
+}
+
+// Flags of pcap_if_t.
+const (
+	pcapIfLoopback = 0x1
+	pcapIfUp       = 0x2
+)
+
+// gaaFlagSkipAddresses leaves the anycast, multicast and DNS server
+// addresses out of GetAdaptersAddresses, since only names are wanted.
+const gaaFlagSkipAddresses = 0x2 | 0x4 | 0x8
+
+// adapterNames maps adapter GUIDs, such as "{4D36E972-...}", to their
+// friendly names. It returns what it can; interfaces it misses are shown
+// by device name.
+func adapterNames() map[string]string {
+	names := make(map[string]string)
+	size := uint32(15 << 10)
+	for attempt := 0; attempt < 3; attempt++ {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, gaaFlagSkipAddresses, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return names
+		}
+		for a := first; a != nil; a = a.Next {
+			names[windows.BytePtrToString(a.AdapterName)] = windows.UTF16PtrToString(a.FriendlyName)
+		}
+		return names
+	}
+	return names
+}
@@ -0,0 +1,23 @@
+package analyzer
+
+import "time"
+
+// ConstantMemory returns options that bound everything the analyzer keeps
+// per connection and per address, so its memory follows the traffic active
+// at once rather than the size of the capture: stream buffers spill to
+// disk early, idle connections are closed quickly, the DNS cache forgets
+// old entries and reassembly drops out-of-order data it can't hold. Only
+// the bounds are set; copy them into the options actually used.
+//
+// Peak memory is then roughly the number of connections open at once times
+// MaxStreamMemory, plus MaxBufferedPagesTotal pages per reassembly worker.
+func ConstantMemory() Options {
+	return Options{
+		MaxStreamMemory:               256 << 10,
+		IdleTimeout:                   30 * time.Second,
+		FlushInterval:                 5 * time.Second,
+		DNSCacheSize:                  100000,
+		MaxBufferedPagesTotal:         8192,
+		MaxBufferedPagesPerConnection: 256,
+	}
+}
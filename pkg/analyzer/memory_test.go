@@ -0,0 +1,24 @@
+package analyzer
+
+import "testing"
+
+func TestConstantMemoryBounds(t *testing.T) {
+	o := ConstantMemory()
+	bounds := []struct {
+		name string
+		set  bool
+	}{
+		{"MaxStreamMemory", o.MaxStreamMemory > 0},
+		{"IdleTimeout", o.IdleTimeout > 0},
+		{"FlushInterval", o.FlushInterval > 0 && o.FlushInterval <= o.IdleTimeout},
+		{"DNSCacheSize", o.DNSCacheSize > 0},
+		{"MaxBufferedPagesTotal", o.MaxBufferedPagesTotal > 0},
+		{"MaxBufferedPagesPerConnection", o.MaxBufferedPagesPerConnection > 0 &&
+			o.MaxBufferedPagesPerConnection <= o.MaxBufferedPagesTotal},
+	}
+	for _, b := range bounds {
+		if !b.set {
+			t.Errorf("%s isn't bounded", b.name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package analyzer
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Packet is a TCP or UDP packet as read from the capture.
+type Packet struct {
+	// Number is the packet's 1-based position in the capture, and Capture
+	// the position of the capture, counting from 0, when several are read
+	// together.
+	Number  int64
+	Capture int
+	// Offset is where the packet's record starts in a classic pcap file,
+	// or -1 for pcapng captures, whose records can't be located as cheaply.
+	Offset      int64
+	CaptureInfo gopacket.CaptureInfo
+	Network     gopacket.Flow
+	Transport   gopacket.Flow
+	// TCP is the segment for TCP packets and nil for UDP.
+	TCP *layers.TCP
+	// Data is the whole packet and Payload what the segment or datagram
+	// carries. They are only valid during the call.
+	Data    []byte
+	Payload []byte
+}
+
+// PacketHandler is implemented by handlers that also want to see every TCP
+// and UDP packet, such as those accounting for flows. HandlePacket is called
+// from the reading goroutine in capture order, before the packet is
+// reassembled, so it must not block for long.
+type PacketHandler interface {
+	HandlePacket(p *Packet)
+}
@@ -0,0 +1,111 @@
+package analyzer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/pcap-analyzer/internal/stream"
+)
+
+// shardQueueSize is how many packets may wait for each shard before the
+// reader blocks.
+const shardQueueSize = 1024
+
+// shardPacket is a TCP segment routed to a shard, or a flush or sync
+// request when tcp is nil.
+type shardPacket struct {
+	netFlow gopacket.Flow
+	tcp     *layers.TCP
+	ctx     *stream.Context
+	// flushBefore closes connections idle since before this time, adding
+	// how many were closed to closed if it is set.
+	flushBefore time.Time
+	closed      *atomic.Int64
+	// synced is marked done once every earlier packet has been assembled.
+	synced *sync.WaitGroup
+}
+
+// shard owns one assembler and stream pool. Every packet of a connection is
+// routed to the same shard, so shards never share reassembly state.
+type shard struct {
+	packets   chan shardPacket
+	assembler *reassembly.Assembler
+}
+
+// shardSet spreads TCP reassembly across several goroutines.
+type shardSet struct {
+	shards []*shard
+	wg     sync.WaitGroup
+}
+
+func newShardSet(n int, factory reassembly.StreamFactory, limits reassembly.AssemblerOptions) *shardSet {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardSet{}
+	for i := 0; i < n; i++ {
+		sh := &shard{
+			packets:   make(chan shardPacket, shardQueueSize),
+			assembler: reassembly.NewAssembler(reassembly.NewStreamPool(factory)),
+		}
+		sh.assembler.AssemblerOptions = limits
+		s.shards = append(s.shards, sh)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for p := range sh.packets {
+				if p.synced != nil {
+					p.synced.Done()
+					continue
+				}
+				if p.tcp == nil {
+					_, n := sh.assembler.FlushCloseOlderThan(p.flushBefore)
+					if p.closed != nil {
+						p.closed.Add(int64(n))
+					}
+					continue
+				}
+				sh.assembler.AssembleWithContext(p.netFlow, p.tcp, p.ctx)
+			}
+			sh.assembler.FlushAll()
+		}()
+	}
+	return s
+}
+
+// assemble routes a segment to the shard owning its connection. FastHash is
+// symmetric, so both directions land on the same shard.
+func (s *shardSet) assemble(netFlow gopacket.Flow, tcp *layers.TCP, ctx *stream.Context) {
+	h := netFlow.FastHash() ^ tcp.TransportFlow().FastHash()
+	s.shards[h%uint64(len(s.shards))].packets <- shardPacket{netFlow: netFlow, tcp: tcp, ctx: ctx}
+}
+
+// flushOlderThan asks every shard to flush and close connections that have
+// seen no packets since t, counting them in closed if it is set.
+func (s *shardSet) flushOlderThan(t time.Time, closed *atomic.Int64) {
+	for _, sh := range s.shards {
+		sh.packets <- shardPacket{flushBefore: t, closed: closed}
+	}
+}
+
+// sync waits until every shard has assembled the packets sent to it so far.
+func (s *shardSet) sync() {
+	var wg sync.WaitGroup
+	wg.Add(len(s.shards))
+	for _, sh := range s.shards {
+		sh.packets <- shardPacket{synced: &wg}
+	}
+	wg.Wait()
+}
+
+// close flushes every shard and waits for them to finish.
+func (s *shardSet) close() {
+	for _, sh := range s.shards {
+		close(sh.packets)
+	}
+	s.wg.Wait()
+}
@@ -0,0 +1,109 @@
+package analyzer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcap-analyzer/internal/har"
+	"github.com/pcap-analyzer/internal/objstore"
+)
+
+// writeSnapLen is the snapshot length written to pcap headers, large
+// enough for any packet read.
+const writeSnapLen = 262144
+
+// WritePackets reads the captures at paths again and writes the TCP and
+// UDP packets keep accepts to w, as one classic pcap file in the order
+// read. It returns how many packets were written. The captures must share
+// a link type; HAR files, having no packets, are refused.
+func WritePackets(paths []string, w io.Writer, keep func(p *Packet) bool) (int64, error) {
+	var pw *pcapgo.Writer
+	var link layers.LinkType
+	var written int64
+	for i, path := range paths {
+		f, err := openCapture(path)
+		if err != nil {
+			return written, err
+		}
+		br := bufio.NewReader(f)
+		if head, _ := br.Peek(sniffLen); har.Sniff(head) {
+			f.Close()
+			return written, fmt.Errorf("%s is a HAR file, which has no packets to write", path)
+		}
+		r, err := newPacketReader(br)
+		if err != nil {
+			f.Close()
+			return written, fmt.Errorf("%s: %w", path, err)
+		}
+		if pw == nil {
+			link = r.LinkType()
+			pw = pcapgo.NewWriter(w)
+			if err := pw.WriteFileHeader(writeSnapLen, link); err != nil {
+				f.Close()
+				return written, err
+			}
+		} else if r.LinkType() != link {
+			f.Close()
+			return written, fmt.Errorf("%s: link type %v differs from %v of the first capture", path, r.LinkType(), link)
+		}
+
+		n, err := copyPackets(r, i, pw, keep)
+		written += n
+		f.Close()
+		if err != nil {
+			return written, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return written, nil
+}
+
+// openCapture opens the capture at path, which may be an s3:// or gs://
+// URL.
+func openCapture(path string) (io.ReadCloser, error) {
+	if objstore.IsURL(path) {
+		return objstore.Open(path)
+	}
+	return os.Open(path)
+}
+
+func copyPackets(r packetReader, capture int, pw *pcapgo.Writer, keep func(p *Packet) bool) (int64, error) {
+	decoder := newDecoder(r.LinkType())
+	var number, written int64
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		number++
+		packet, ok := decoder.decode(data)
+		if !ok {
+			continue
+		}
+		p := &Packet{
+			Number:      number,
+			Capture:     capture,
+			Offset:      -1,
+			CaptureInfo: ci,
+			Network:     packet.netFlow,
+			Transport:   packet.transport,
+			TCP:         packet.tcp,
+			Data:        data,
+			Payload:     packet.payload,
+		}
+		if !keep(p) {
+			continue
+		}
+		ci.CaptureLength = len(data)
+		if err := pw.WritePacket(ci, data); err != nil {
+			return written, err
+		}
+		written++
+	}
+}
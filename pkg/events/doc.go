@@ -0,0 +1,4 @@
+// Package events defines the gRPC service pcap-analyzer grpc serves, which
+// streams parsed HTTP and DNS events to subscribers. The types are
+// generated from events.proto with make proto.
+package events
@@ -0,0 +1,365 @@
+// Package testutil builds synthetic capture files so the analyzer can be
+// exercised with deterministic traffic and bug reports can be reproduced
+// without sharing the original capture.
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
+)
+
+// DefaultSegmentSize is the payload size used when a Conn splits data into
+// TCP segments and no explicit size is given.
+const DefaultSegmentSize = 1460
+
+// Packet is a serialized frame together with its capture metadata.
+type Packet struct {
+	CaptureInfo gopacket.CaptureInfo
+	Data        []byte
+}
+
+// Builder accumulates Ethernet frames in capture order.
+type Builder struct {
+	packets []Packet
+	now     time.Time
+	// Step is how far the capture clock advances for every packet added.
+	Step time.Duration
+}
+
+// NewBuilder returns a Builder whose clock starts at a fixed instant so the
+// generated captures are byte-for-byte reproducible.
+func NewBuilder() *Builder {
+	return &Builder{
+		now:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Step: time.Millisecond,
+	}
+}
+
+// Advance moves the capture clock forward without emitting a packet.
+func (b *Builder) Advance(d time.Duration) {
+	b.now = b.now.Add(d)
+}
+
+// Now returns the timestamp the next packet will receive.
+func (b *Builder) Now() time.Time {
+	return b.now
+}
+
+// Len returns the number of packets added so far.
+func (b *Builder) Len() int {
+	return len(b.packets)
+}
+
+// Packets returns the packets in capture order.
+func (b *Builder) Packets() []Packet {
+	return b.packets
+}
+
+// Swap exchanges the position, but not the timestamps, of packets i and j,
+// producing out-of-order delivery.
+func (b *Builder) Swap(i, j int) {
+	ti, tj := b.packets[i].CaptureInfo.Timestamp, b.packets[j].CaptureInfo.Timestamp
+	b.packets[i], b.packets[j] = b.packets[j], b.packets[i]
+	b.packets[i].CaptureInfo.Timestamp, b.packets[j].CaptureInfo.Timestamp = ti, tj
+}
+
+// Retransmit appends a copy of packet i at the current clock.
+func (b *Builder) Retransmit(i int) {
+	b.add(append([]byte(nil), b.packets[i].Data...))
+}
+
+// Write writes the packets as a classic pcap file with an Ethernet link
+// type.
+func (b *Builder) Write(w io.Writer) error {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+	for _, p := range b.packets {
+		if err := pw.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile writes the packets to a pcap file at path.
+func (b *Builder) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := b.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *Builder) add(data []byte) {
+	b.packets = append(b.packets, Packet{
+		CaptureInfo: gopacket.CaptureInfo{
+			Timestamp:     b.now,
+			CaptureLength: len(data),
+			Length:        len(data),
+		},
+		Data: data,
+	})
+	b.now = b.now.Add(b.Step)
+}
+
+// endpoint is a parsed "ip:port" address.
+type endpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+func parseEndpoint(addr string) (endpoint, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return endpoint{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return endpoint{}, fmt.Errorf("invalid IP address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("invalid port %q", port)
+	}
+	return endpoint{ip: ip, port: uint16(p)}, nil
+}
+
+func mustEndpoint(addr string) endpoint {
+	ep, err := parseEndpoint(addr)
+	if err != nil {
+		panic(fmt.Sprintf("testutil: %v", err))
+	}
+	return ep
+}
+
+// network returns the link and network layers for a packet from src to dst.
+func network(src, dst net.IP, proto layers.IPProtocol) (*layers.Ethernet, gopacket.NetworkLayer, gopacket.SerializableLayer) {
+	eth := &layers.Ethernet{
+		SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+	}
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: proto,
+			SrcIP:    src4,
+			DstIP:    dst4,
+		}
+		return eth, ip, ip
+	}
+	eth.EthernetType = layers.EthernetTypeIPv6
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: proto,
+		SrcIP:      src.To16(),
+		DstIP:      dst.To16(),
+	}
+	return eth, ip, ip
+}
+
+func serialize(layerList ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, layerList...); err != nil {
+		panic(fmt.Sprintf("testutil: serialize packet: %v", err))
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// Conn emits the packets of a single TCP connection into a Builder.
+type Conn struct {
+	b              *Builder
+	client, server endpoint
+	clientSeq      uint32
+	serverSeq      uint32
+	// SegmentSize caps the payload carried by each data segment.
+	SegmentSize int
+}
+
+// TCPConn starts a TCP connection between client and server, both given as
+// "ip:port". It panics on malformed addresses since it is meant for
+// fixtures.
+func (b *Builder) TCPConn(client, server string) *Conn {
+	return &Conn{
+		b:           b,
+		client:      mustEndpoint(client),
+		server:      mustEndpoint(server),
+		clientSeq:   1000,
+		serverSeq:   5000,
+		SegmentSize: DefaultSegmentSize,
+	}
+}
+
+func (c *Conn) segment(fromClient bool, flags func(*layers.TCP), payload []byte) {
+	src, dst := c.client, c.server
+	seq, ack := c.clientSeq, c.serverSeq
+	if !fromClient {
+		src, dst = c.server, c.client
+		seq, ack = c.serverSeq, c.clientSeq
+	}
+
+	eth, ip, ipLayer := network(src.ip, dst.ip, layers.IPProtocolTCP)
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(src.port),
+		DstPort: layers.TCPPort(dst.port),
+		Seq:     seq,
+		Ack:     ack,
+		Window:  65535,
+	}
+	flags(tcp)
+	tcp.SetNetworkLayerForChecksum(ip)
+	c.b.add(serialize(eth, ipLayer, tcp, gopacket.Payload(payload)))
+
+	advance := uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		advance++
+	}
+	if fromClient {
+		c.clientSeq += advance
+	} else {
+		c.serverSeq += advance
+	}
+}
+
+// Handshake emits the SYN, SYN/ACK, ACK exchange.
+func (c *Conn) Handshake() *Conn {
+	c.segment(true, func(t *layers.TCP) { t.SYN = true; t.Ack = 0 }, nil)
+	c.segment(false, func(t *layers.TCP) { t.SYN = true; t.ACK = true }, nil)
+	c.segment(true, func(t *layers.TCP) { t.ACK = true }, nil)
+	return c
+}
+
+// Refused emits a SYN answered by a RST, as for a port nothing listens on.
+func (c *Conn) Refused() {
+	c.segment(true, func(t *layers.TCP) { t.SYN = true; t.Ack = 0 }, nil)
+	c.segment(false, func(t *layers.TCP) { t.RST = true; t.ACK = true; t.Seq = 0 }, nil)
+}
+
+// ClientSend emits data from client to server split into SegmentSize
+// segments.
+func (c *Conn) ClientSend(data []byte) *Conn {
+	c.send(true, data)
+	return c
+}
+
+// ServerSend emits data from server to client split into SegmentSize
+// segments.
+func (c *Conn) ServerSend(data []byte) *Conn {
+	c.send(false, data)
+	return c
+}
+
+func (c *Conn) send(fromClient bool, data []byte) {
+	size := c.SegmentSize
+	if size <= 0 {
+		size = DefaultSegmentSize
+	}
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		c.segment(fromClient, func(t *layers.TCP) { t.ACK = true; t.PSH = true }, data[:n])
+		data = data[n:]
+	}
+}
+
+// Close emits a FIN from each side followed by the final ACK.
+func (c *Conn) Close() {
+	c.segment(true, func(t *layers.TCP) { t.FIN = true; t.ACK = true }, nil)
+	c.segment(false, func(t *layers.TCP) { t.FIN = true; t.ACK = true }, nil)
+	c.segment(true, func(t *layers.TCP) { t.ACK = true }, nil)
+}
+
+// Reset emits a RST from the client.
+func (c *Conn) Reset() {
+	c.segment(true, func(t *layers.TCP) { t.RST = true }, nil)
+}
+
+// HTTPExchange is a convenience for a complete connection carrying one
+// request and its response.
+func (b *Builder) HTTPExchange(client, server, request, response string) *Conn {
+	c := b.TCPConn(client, server).Handshake()
+	c.ClientSend([]byte(request))
+	c.ServerSend([]byte(response))
+	c.Close()
+	return c
+}
+
+func (b *Builder) udp(src, dst endpoint, payload []byte) {
+	eth, ip, ipLayer := network(src.ip, dst.ip, layers.IPProtocolUDP)
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.port),
+		DstPort: layers.UDPPort(dst.port),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	b.add(serialize(eth, ipLayer, udp, gopacket.Payload(payload)))
+}
+
+// DNSQuery emits an A query for name from client ("ip:port") to server.
+func (b *Builder) DNSQuery(client, server, name string) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Id = 1
+	b.dns(mustEndpoint(client), mustEndpoint(server), msg)
+}
+
+// DNSResponse emits a response from server to client answering name with
+// the given addresses. IPv4 addresses become A records and IPv6 addresses
+// AAAA records.
+func (b *Builder) DNSResponse(client, server, name string, addrs ...string) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	query.Id = 1
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: 300}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	b.dns(mustEndpoint(server), mustEndpoint(client), msg)
+}
+
+// DNSNXDomain emits a response from server to client saying name doesn't
+// exist.
+func (b *Builder) DNSNXDomain(client, server, name string) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	query.Id = 1
+	msg := new(dns.Msg)
+	msg.SetRcode(query, dns.RcodeNameError)
+	b.dns(mustEndpoint(server), mustEndpoint(client), msg)
+}
+
+func (b *Builder) dns(src, dst endpoint, msg *dns.Msg) {
+	payload, err := msg.Pack()
+	if err != nil {
+		panic(fmt.Sprintf("testutil: pack DNS message: %v", err))
+	}
+	b.udp(src, dst, payload)
+}